@@ -0,0 +1,581 @@
+package shuffle
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Scoped API keys start with this so they can be told apart from the
+// legacy per-user UUID keys in HandleApiAuthentication.
+const userApiKeyPrefix = "shuffle_"
+
+const (
+	defaultApiKeyDays = 90
+	maxApiKeyDays     = 365
+	maxApiKeysPerUser = 50
+)
+
+func hashUserApiKey(apikey string) string {
+	hash := sha256.Sum256([]byte(apikey))
+	return hex.EncodeToString(hash[:])
+}
+
+func generateUserApiKey() (string, error) {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return userApiKeyPrefix + hex.EncodeToString(randomBytes), nil
+}
+
+// Keys that only have read scopes can't be used to change anything
+func isReadOnlyApiKey(scopes []string) bool {
+	for _, scope := range scopes {
+		if !strings.HasSuffix(scope, ":read") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Authenticates a scoped API key. The key is bound to the org it was
+// created in, and the user gets their role in that org.
+func authenticateUserApiKey(ctx context.Context, request *http.Request, apikey, orgId string) (User, error) {
+	apiKey, err := GetUserApiKeyByHash(ctx, hashUserApiKey(apikey))
+	if err != nil {
+		return User{}, errors.New("Invalid API key")
+	}
+
+	if apiKey.Expires > 0 && apiKey.Expires < time.Now().Unix() {
+		log.Printf("[AUDIT] Expired API key %s (%s) used for user %s", apiKey.Name, apiKey.Id, apiKey.UserId)
+		return User{}, errors.New("API key has expired")
+	}
+
+	if len(orgId) > 0 && orgId != apiKey.OrgId {
+		return User{}, errors.New(fmt.Sprintf("API key doesn't have access to org %s", orgId))
+	}
+
+	user, err := GetUser(ctx, apiKey.UserId)
+	if err != nil {
+		return User{}, errors.New("Couldn't find the user")
+	}
+
+	if !user.Active {
+		return User{}, errors.New("User is deactivated")
+	}
+
+	org, err := GetOrg(ctx, apiKey.OrgId)
+	if err != nil {
+		return User{}, errors.New("Couldn't find the API key org")
+	}
+
+	role := getOrgUserRole(org, user.Id)
+	if len(role) == 0 {
+		return User{}, errors.New(fmt.Sprintf("User is no longer in org %s", org.Id))
+	}
+
+	if isReadOnlyApiKey(apiKey.Scopes) && request.Method != "GET" && request.Method != "HEAD" && request.Method != "OPTIONS" {
+		return User{}, errors.New("Read-only API key can't be used for this request")
+	}
+
+	err = checkApiKeyRoute(request, apiKey.Scopes)
+	if err != nil {
+		log.Printf("[AUDIT] API key %s of user %s denied for %s %s: %s", apiKey.Id, apiKey.UserId, request.Method, request.URL.Path, err)
+		return User{}, err
+	}
+
+	user.ActiveOrg.Id = org.Id
+	user.ActiveOrg.Name = org.Name
+	user.ActiveOrg.Image = org.Image
+	user.ActiveOrg.Role = role
+	user.Role = role
+	user.ApiKey = apikey
+	user.SessionLogin = false
+	user.ApiKeyId = apiKey.Id
+	user.ApiKeyScopes = apiKey.Scopes
+	user.ApiKeyWorkflows = apiKey.WorkflowIds
+
+	// Only written once a minute to not hit the database on every request
+	usedKey := fmt.Sprintf("user_api_keys_used_%s", apiKey.Id)
+	if _, err := GetCache(ctx, usedKey); err != nil {
+		SetCache(ctx, usedKey, []byte("1"), 1)
+
+		apiKey.LastUsed = time.Now().Unix()
+		apiKey.LastUsedIp = GetRequestIp(request)
+		err = SetUserApiKey(ctx, *apiKey)
+		if err != nil {
+			log.Printf("[WARNING] Failed updating last use of API key %s: %s", apiKey.Id, err)
+		}
+
+		setRateLimitOrg(ctx, request, org.Id)
+	}
+
+	go IncrementCache(ctx, org.Id, "api_usage")
+	return *user, nil
+}
+
+// The scope a scoped API key needs for a route. Routes that aren't listed
+// can't be used with scoped API keys at all, so handlers that don't check
+// permissions themselves are closed to them by default.
+type apiKeyRouteScope struct {
+	Prefix string
+	Read   string
+	Write  string
+}
+
+var apiKeyRouteScopes = []apiKeyRouteScope{
+	{Prefix: "/apps/authentication", Read: "app-auth:use", Write: "app-auth:manage"},
+	{Prefix: "/apps", Read: "workflow:read", Write: "apps:write"},
+	{Prefix: "/workflows", Read: "workflow:read", Write: "workflow:write"},
+	{Prefix: "/files", Read: "files:read", Write: "files:write"},
+	{Prefix: "/hooks", Read: "workflow:read", Write: "triggers:write"},
+	{Prefix: "/triggers", Read: "workflow:read", Write: "triggers:write"},
+	{Prefix: "/environments", Read: "workflow:read", Write: "org:manage"},
+	{Prefix: "/detections", Read: "detection:write", Write: "detection:write"},
+	{Prefix: "/notifications", Read: "notifications:write", Write: "notifications:write"},
+	{Prefix: "/users", Read: "users:manage", Write: "users:manage"},
+	{Prefix: "/orgs", Read: "org:manage", Write: "org:manage"},
+}
+
+func getApiKeyRouteScope(request *http.Request) (string, bool) {
+	path := strings.ToLower(request.URL.Path)
+	for _, prefix := range []string{"/api/v1", "/api/v2"} {
+		if strings.HasPrefix(path, prefix+"/") {
+			path = strings.TrimPrefix(path, prefix)
+			break
+		}
+	}
+
+	if strings.HasPrefix(path, "/workflows/") {
+		if strings.HasSuffix(path, "/execute") || strings.HasSuffix(path, "/run") {
+			return "workflow:execute", true
+		}
+
+		if strings.HasSuffix(path, "/abort") {
+			return "executions:manage", true
+		}
+
+		// Searching is a POST, but doesn't change anything
+		if strings.HasSuffix(path, "/search") {
+			return "workflow:read", true
+		}
+	}
+
+	for _, route := range apiKeyRouteScopes {
+		if path != route.Prefix && !strings.HasPrefix(path, route.Prefix+"/") {
+			continue
+		}
+
+		if request.Method == "GET" || request.Method == "HEAD" || request.Method == "OPTIONS" {
+			return route.Read, true
+		}
+
+		return route.Write, true
+	}
+
+	return "", false
+}
+
+// Checks that the scopes of an API key cover the route of the request
+func checkApiKeyRoute(request *http.Request, scopes []string) error {
+	scope, found := getApiKeyRouteScope(request)
+	if !found {
+		return errors.New(fmt.Sprintf("Scoped API keys can't be used for %s", request.URL.Path))
+	}
+
+	if !permissionsContain(scopes, scope) {
+		return errors.New(fmt.Sprintf("API key is missing scope %s", scope))
+	}
+
+	return nil
+}
+
+// Legacy keys from GenerateApikey expire like scoped keys. Keys created
+// before that was tracked start expiring the first time they're used.
+// SHUFFLE_LEGACY_APIKEY_DAYS changes how long they last.
+func getLegacyApiKeyDays() int {
+	days, err := strconv.Atoi(os.Getenv("SHUFFLE_LEGACY_APIKEY_DAYS"))
+	if err != nil || days <= 0 || days > maxApiKeyDays {
+		return defaultApiKeyDays
+	}
+
+	return days
+}
+
+func isLegacyApiKeyExpired(user User, timeNow int64) bool {
+	return user.ApiKeyCreated > 0 && user.ApiKeyCreated+int64(getLegacyApiKeyDays())*86400 < timeNow
+}
+
+func checkLegacyApiKeyExpiry(ctx context.Context, user *User) error {
+	timeNow := time.Now().Unix()
+	if user.ApiKeyCreated == 0 {
+		user.ApiKeyCreated = timeNow
+		err := SetUser(ctx, user, false)
+		if err != nil {
+			log.Printf("[WARNING] Failed setting API key creation time for user %s: %s", user.Id, err)
+		}
+
+		return nil
+	}
+
+	if isLegacyApiKeyExpired(*user, timeNow) {
+		log.Printf("[AUDIT] Expired legacy API key used for user %s (%s)", user.Username, user.Id)
+		return errors.New("API key has expired. Generate a new one or create a scoped API key")
+	}
+
+	return nil
+}
+
+// Checks the workflow restriction of a scoped API key
+func checkApiKeyWorkflow(user User, workflowId string) error {
+	if len(user.ApiKeyId) == 0 || len(user.ApiKeyWorkflows) == 0 {
+		return nil
+	}
+
+	if !ArrayContains(user.ApiKeyWorkflows, workflowId) {
+		return errors.New(fmt.Sprintf("API key doesn't have access to workflow %s", workflowId))
+	}
+
+	return nil
+}
+
+// Same as Authorize, but also checks the workflow restriction of scoped API keys
+func AuthorizeWorkflow(user User, permission string, workflow Workflow) error {
+	err := Authorize(user, permission, workflow.OrgId)
+	if err != nil {
+		return err
+	}
+
+	return checkApiKeyWorkflow(user, workflow.ID)
+}
+
+// Removes the workflows a scoped API key doesn't have access to from a listing
+func filterApiKeyWorkflows(user User, workflows []Workflow) []Workflow {
+	if len(user.ApiKeyId) == 0 || len(user.ApiKeyWorkflows) == 0 {
+		return workflows
+	}
+
+	filtered := []Workflow{}
+	for _, workflow := range workflows {
+		if checkApiKeyWorkflow(user, workflow.ID) == nil {
+			filtered = append(filtered, workflow)
+		}
+	}
+
+	return filtered
+}
+
+// Lists the API keys of the current user. Key hashes are never returned.
+func HandleGetUserApiKeys(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in get API keys: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	owner, err := getApiKeyOwner(ctx, user, request.URL.Query().Get("service_account_id"))
+	if err != nil {
+		resp.WriteHeader(404)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	apiKeys, err := GetUserApiKeys(ctx, owner.Id)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting API keys for user %s: %s", owner.Id, err)
+		apiKeys = []UserApiKey{}
+	}
+
+	for index := range apiKeys {
+		apiKeys[index].KeyHash = ""
+	}
+
+	newjson, err := json.Marshal(struct {
+		Success bool         `json:"success"`
+		ApiKeys []UserApiKey `json:"apikeys"`
+	}{
+		Success: true,
+		ApiKeys: apiKeys,
+	})
+	if err != nil {
+		log.Printf("[WARNING] Failed marshalling API keys: %s", err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// Creates a new API key for the current user, or one of the org's service
+// accounts, in the active org. The key itself is only returned once.
+func HandleCreateUserApiKey(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in create API key: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if len(user.ApiKeyId) > 0 {
+		resp.WriteHeader(403)
+		resp.Write([]byte(`{"success": false, "reason": "Scoped API keys can't create new API keys"}`))
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	var input struct {
+		Name             string   `json:"name"`
+		Scopes           []string `json:"scopes"`
+		WorkflowIds      []string `json:"workflow_ids"`
+		ExpiresInDays    int      `json:"expires_in_days"`
+		ServiceAccountId string   `json:"service_account_id"`
+	}
+
+	err = json.Unmarshal(body, &input)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Failed parsing body"}`))
+		return
+	}
+
+	input.Name = strings.TrimSpace(input.Name)
+	if len(input.Name) == 0 || len(input.Name) > 100 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Name must be between 1 and 100 characters"}`))
+		return
+	}
+
+	if len(input.Scopes) == 0 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "At least one scope is required"}`))
+		return
+	}
+
+	for _, scope := range input.Scopes {
+		if !isValidPermission(scope) {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Invalid scope %s"}`, scope)))
+			return
+		}
+	}
+
+	if input.ExpiresInDays == 0 {
+		input.ExpiresInDays = defaultApiKeyDays
+	}
+
+	if input.ExpiresInDays < 0 || input.ExpiresInDays > maxApiKeyDays {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Expiry must be between 1 and %d days"}`, maxApiKeyDays)))
+		return
+	}
+
+	ctx := GetContext(request)
+	owner, err := getApiKeyOwner(ctx, user, input.ServiceAccountId)
+	if err != nil {
+		resp.WriteHeader(404)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	for _, workflowId := range input.WorkflowIds {
+		workflow, err := GetWorkflow(ctx, workflowId)
+		if err != nil || workflow.OrgId != user.ActiveOrg.Id {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Workflow %s not found"}`, workflowId)))
+			return
+		}
+	}
+
+	apiKeys, err := GetUserApiKeys(ctx, owner.Id)
+	if err == nil && len(apiKeys) >= maxApiKeysPerUser {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Max %d API keys per user. Revoke one first"}`, maxApiKeysPerUser)))
+		return
+	}
+
+	newKey, err := generateUserApiKey()
+	if err != nil {
+		log.Printf("[ERROR] Failed generating API key: %s", err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	timeNow := time.Now()
+	apiKey := UserApiKey{
+		Id:          uuid.NewV4().String(),
+		UserId:      owner.Id,
+		OrgId:       user.ActiveOrg.Id,
+		Name:        input.Name,
+		KeyHash:     hashUserApiKey(newKey),
+		Prefix:      newKey[:len(userApiKeyPrefix)+6],
+		Scopes:      input.Scopes,
+		WorkflowIds: input.WorkflowIds,
+		Created:     timeNow.Unix(),
+		CreatedBy:   user.Username,
+		Expires:     timeNow.AddDate(0, 0, input.ExpiresInDays).Unix(),
+	}
+
+	err = SetUserApiKey(ctx, apiKey)
+	if err != nil {
+		log.Printf("[ERROR] Failed saving API key for user %s: %s", owner.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	log.Printf("[AUDIT] User %s (%s) created API key %s (%s) for user %s in org %s with scopes %s", user.Username, user.Id, apiKey.Name, apiKey.Id, owner.Username, apiKey.OrgId, strings.Join(apiKey.Scopes, ","))
+	CreateAuditEvent(ctx, request, user, user.ActiveOrg.Id, "api_key.create", "api_key", apiKey.Id, nil, map[string]interface{}{"name": apiKey.Name, "user_id": owner.Id, "scopes": apiKey.Scopes, "workflow_ids": apiKey.WorkflowIds, "expires": apiKey.Expires})
+
+	apiKey.KeyHash = ""
+	newjson, err := json.Marshal(struct {
+		Success bool       `json:"success"`
+		ApiKey  UserApiKey `json:"apikey"`
+		Key     string     `json:"key"`
+	}{
+		Success: true,
+		ApiKey:  apiKey,
+		Key:     newKey,
+	})
+	if err != nil {
+		log.Printf("[WARNING] Failed marshalling API key: %s", err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// Keys are owned by the current user, unless an admin with users:manage
+// picks a service account in the org
+func getApiKeyOwner(ctx context.Context, user User, serviceAccountId string) (User, error) {
+	if len(serviceAccountId) == 0 {
+		return user, nil
+	}
+
+	if Authorize(user, "users:manage", "") != nil {
+		return User{}, errors.New("You don't have access to manage service accounts")
+	}
+
+	serviceAccount, err := getOrgServiceAccount(ctx, user.ActiveOrg.Id, serviceAccountId)
+	if err != nil {
+		return User{}, err
+	}
+
+	err = canManageUser(ctx, user, *serviceAccount)
+	if err != nil {
+		return User{}, err
+	}
+
+	return *serviceAccount, nil
+}
+
+// Revokes an API key. Users can revoke their own keys, and admins
+// with users:manage can revoke any key in their org.
+func HandleRevokeUserApiKey(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in revoke API key: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	location := strings.Split(strings.Split(request.URL.String(), "?")[0], "/")
+	if len(location) <= 5 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "API key ID required"}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	apiKey, err := GetUserApiKey(ctx, location[5])
+	if err != nil {
+		resp.WriteHeader(404)
+		resp.Write([]byte(`{"success": false, "reason": "API key not found"}`))
+		return
+	}
+
+	if apiKey.UserId != user.Id && (apiKey.OrgId != user.ActiveOrg.Id || Authorize(user, "users:manage", "") != nil) {
+		resp.WriteHeader(404)
+		resp.Write([]byte(`{"success": false, "reason": "API key not found"}`))
+		return
+	}
+
+	// Admins can't revoke the keys of users they can't manage
+	if apiKey.UserId != user.Id {
+		owner, err := GetUser(ctx, apiKey.UserId)
+		if err != nil {
+			log.Printf("[WARNING] Failed getting owner %s of API key %s: %s", apiKey.UserId, apiKey.Id, err)
+			resp.WriteHeader(404)
+			resp.Write([]byte(`{"success": false, "reason": "API key not found"}`))
+			return
+		}
+
+		err = canManageUser(ctx, user, *owner)
+		if err != nil {
+			resp.WriteHeader(403)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+			return
+		}
+	}
+
+	err = DeleteUserApiKey(ctx, *apiKey)
+	if err != nil {
+		log.Printf("[ERROR] Failed revoking API key %s: %s", apiKey.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	log.Printf("[AUDIT] User %s (%s) revoked API key %s (%s) of user %s", user.Username, user.Id, apiKey.Name, apiKey.Id, apiKey.UserId)
+	CreateAuditEvent(ctx, request, user, user.ActiveOrg.Id, "api_key.revoke", "api_key", apiKey.Id, map[string]interface{}{"name": apiKey.Name, "user_id": apiKey.UserId}, nil)
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
@@ -0,0 +1,188 @@
+package shuffle
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckApiKeyRoute(t *testing.T) {
+	handlers := []struct {
+		method   string
+		path     string
+		scopes   []string
+		expected bool
+	}{
+		{"GET", "/api/v1/workflows", []string{"workflow:read"}, true},
+		{"POST", "/api/v1/workflows", []string{"workflow:read"}, false},
+		{"POST", "/api/v1/workflows/search", []string{"workflow:read"}, true},
+		{"POST", "/api/v1/workflows/abc/execute", []string{"workflow:execute"}, true},
+		{"POST", "/api/v1/workflows/abc/execute", []string{"workflow:read"}, false},
+		{"GET", "/api/v1/workflows/abc/executions/def/abort", []string{"workflow:*"}, false},
+		{"GET", "/api/v1/files/abc/content", []string{"files:read"}, true},
+		{"DELETE", "/api/v1/files/abc", []string{"files:read"}, false},
+		{"GET", "/api/v1/apps/authentication", []string{"workflow:read"}, false},
+		{"PUT", "/api/v1/users/updateuser", []string{"workflow:*", "files:*"}, false},
+		{"GET", "/api/v1/orgs/abc", []string{"*"}, true},
+
+		// Routes that aren't listed are denied
+		{"GET", "/api/v1/getinfo", []string{"*"}, false},
+		{"GET", "/api/v1/workflowsearch", []string{"workflow:read"}, false},
+	}
+
+	for _, tt := range handlers {
+		request := httptest.NewRequest(tt.method, tt.path, nil)
+		err := checkApiKeyRoute(request, tt.scopes)
+		if (err == nil) != tt.expected {
+			t.Errorf("checkApiKeyRoute(%s %s, %v) = %v; expected success %v", tt.method, tt.path, tt.scopes, err, tt.expected)
+		}
+	}
+}
+
+func TestIsLegacyApiKeyExpired(t *testing.T) {
+	os.Unsetenv("SHUFFLE_LEGACY_APIKEY_DAYS")
+	timeNow := time.Now().Unix()
+
+	if isLegacyApiKeyExpired(User{}, timeNow) {
+		t.Errorf("Legacy keys without a creation time should start expiring on use, not be expired")
+	}
+
+	if isLegacyApiKeyExpired(User{ApiKeyCreated: timeNow - 86400}, timeNow) {
+		t.Errorf("A legacy key created yesterday shouldn't be expired")
+	}
+
+	if !isLegacyApiKeyExpired(User{ApiKeyCreated: timeNow - int64(defaultApiKeyDays+1)*86400}, timeNow) {
+		t.Errorf("A legacy key older than %d days should be expired", defaultApiKeyDays)
+	}
+
+	os.Setenv("SHUFFLE_LEGACY_APIKEY_DAYS", "1")
+	defer os.Unsetenv("SHUFFLE_LEGACY_APIKEY_DAYS")
+	if !isLegacyApiKeyExpired(User{ApiKeyCreated: timeNow - 2*86400}, timeNow) {
+		t.Errorf("SHUFFLE_LEGACY_APIKEY_DAYS should shorten the expiry")
+	}
+}
+
+func TestIsReadOnlyApiKey(t *testing.T) {
+	if !isReadOnlyApiKey([]string{"workflow:read", "files:read"}) {
+		t.Errorf("Keys with only read scopes should be read-only")
+	}
+
+	if isReadOnlyApiKey([]string{"workflow:read", "workflow:execute"}) {
+		t.Errorf("Keys with execute scopes shouldn't be read-only")
+	}
+}
+
+// Caches a scoped API key with its user and org, so HandleApiAuthentication
+// accepts it without the database. Returns the key to send.
+func setTestApiKeyCache(t *testing.T, user User, org Org, apiKey UserApiKey) string {
+	setTestOrgCache(t, org)
+
+	ctx := context.Background()
+	rawKey := userApiKeyPrefix + strings.Repeat("a", 40) + apiKey.Id
+	apiKey.KeyHash = hashUserApiKey(rawKey)
+	apiKey.UserId = user.Id
+	apiKey.OrgId = org.Id
+	for cacheKey, value := range map[string]interface{}{
+		"user_api_keys_" + apiKey.KeyHash:  apiKey,
+		"user_" + strings.ToLower(user.Id): user,
+	} {
+		data, err := json.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		SetCache(ctx, cacheKey, data, 10)
+	}
+
+	// Skips writing the last use of the key
+	SetCache(ctx, "user_api_keys_used_"+apiKey.Id, []byte("1"), 10)
+	return rawKey
+}
+
+func setTestWorkflowCache(t *testing.T, workflow Workflow) {
+	data, err := json.Marshal(workflow)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SetCache(context.Background(), "workflow_"+workflow.ID, data, 10)
+}
+
+func TestFilterApiKeyWorkflows(t *testing.T) {
+	workflows := []Workflow{Workflow{ID: "allowed"}, Workflow{ID: "other"}}
+	if filtered := filterApiKeyWorkflows(User{}, workflows); len(filtered) != 2 {
+		t.Errorf("Session users got %d of 2 workflows", len(filtered))
+	}
+
+	if filtered := filterApiKeyWorkflows(User{ApiKeyId: "key"}, workflows); len(filtered) != 2 {
+		t.Errorf("Keys without workflow restrictions got %d of 2 workflows", len(filtered))
+	}
+
+	filtered := filterApiKeyWorkflows(User{ApiKeyId: "key", ApiKeyWorkflows: []string{"allowed"}}, workflows)
+	if len(filtered) != 1 || filtered[0].ID != "allowed" {
+		t.Errorf("Restricted key got workflows %#v; expected only 'allowed'", filtered)
+	}
+}
+
+func TestScopedApiKeyWorkflowRejections(t *testing.T) {
+	orgId := "apikey-test-org"
+	user := User{Id: "apikey-test-user", Username: "apikey-test", Role: "admin", Active: true, ActiveOrg: OrgMini{Id: orgId}}
+	org := Org{Id: orgId, Name: "apikey-test", Users: []User{user}}
+	allowedId := "11111111-1111-4111-8111-111111111111"
+	otherId := "22222222-2222-4222-8222-222222222222"
+
+	rawKey := setTestApiKeyCache(t, user, org, UserApiKey{
+		Id:          "apikey-test-key",
+		Scopes:      []string{"workflow:read", "executions:manage"},
+		WorkflowIds: []string{allowedId},
+	})
+
+	setTestWorkflowCache(t, Workflow{ID: otherId, OrgId: orgId, Owner: "someone-else"})
+	handlers := []struct {
+		name    string
+		path    string
+		handler func(http.ResponseWriter, *http.Request)
+	}{
+		{"GetWorkflowExecutions", "/api/v1/workflows/" + otherId + "/executions", GetWorkflowExecutions},
+		{"GetWorkflowExecutionsV2", "/api/v2/workflows/" + otherId + "/executions", GetWorkflowExecutionsV2},
+	}
+
+	for _, tt := range handlers {
+		request := httptest.NewRequest("GET", tt.path, nil)
+		request.Header.Set("Authorization", "Bearer "+rawKey)
+		resp := httptest.NewRecorder()
+		tt.handler(resp, request)
+
+		if resp.Code != 401 || !strings.Contains(resp.Body.String(), "API key doesn't have access") {
+			t.Errorf("%s let a key restricted to another workflow through: %d %s", tt.name, resp.Code, resp.Body.String())
+		}
+	}
+
+	executionId := "33333333-3333-4333-8333-333333333333"
+	execution := WorkflowExecution{
+		ExecutionId:   executionId,
+		Authorization: "execution-authorization",
+		Status:        "EXECUTING",
+		Workflow:      Workflow{ID: otherId, OrgId: orgId, Owner: "someone-else"},
+	}
+
+	data, err := json.Marshal(execution)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SetCache(context.Background(), "workflowexecution_"+executionId, data, 10)
+	request := httptest.NewRequest("GET", "/api/v1/workflows/"+otherId+"/executions/"+executionId+"/abort", nil)
+	request.Header.Set("Authorization", "Bearer "+rawKey)
+	resp := httptest.NewRecorder()
+	AbortExecution(resp, request)
+
+	if resp.Code != 401 || !strings.Contains(resp.Body.String(), "API key doesn't have access") {
+		t.Errorf("AbortExecution let a key restricted to another workflow through: %d %s", resp.Code, resp.Body.String())
+	}
+}
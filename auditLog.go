@@ -0,0 +1,556 @@
+package shuffle
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	defaultAuditRetentionDays = 365
+	maxAuditRetentionDays     = 365 * 7
+	maxAuditSummaryLength     = 2000
+	maxAuditEvents            = 1000
+	maxAuditExportEvents      = 10000
+)
+
+// The actor of changes made by an identity provider through SCIM
+var scimAuditUser = User{Id: "scim", Username: "SCIM"}
+
+// Who did something. Service accounts, API keys and support users are
+// kept apart from regular users so they are easy to tell apart in the log.
+func getAuditActor(user User, orgId string) (string, string, string) {
+	if len(user.Id) == 0 {
+		return "", "shuffle", "system"
+	}
+
+	if user.Id == scimAuditUser.Id {
+		return user.Id, user.Username, "scim"
+	}
+
+	if user.ServiceAccount {
+		return user.Id, user.Username, "service_account"
+	}
+
+	if len(user.ApiKeyId) > 0 {
+		return user.Id, user.Username, "api_key"
+	}
+
+	if isSupportUser(user) && !ArrayContains(user.Orgs, orgId) {
+		return user.Id, user.Username, "support"
+	}
+
+	return user.Id, user.Username, "user"
+}
+
+// Strings are kept as is, everything else is stored as JSON
+func summarizeAuditValue(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+
+	summary := ""
+	if stringValue, ok := value.(string); ok {
+		summary = stringValue
+	} else {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return ""
+		}
+
+		summary = string(data)
+	}
+
+	if len(summary) > maxAuditSummaryLength {
+		summary = summary[:maxAuditSummaryLength]
+	}
+
+	return summary
+}
+
+// Records an event in the org. before and after should only summarize
+// the change, and never contain secrets.
+func CreateAuditEvent(ctx context.Context, request *http.Request, user User, orgId, action, resourceType, resourceId string, before, after interface{}) {
+	if len(orgId) == 0 {
+		return
+	}
+
+	actorId, actorName, actorType := getAuditActor(user, orgId)
+	event := AuditEvent{
+		Id:           uuid.NewV4().String(),
+		OrgId:        orgId,
+		ActorId:      actorId,
+		ActorName:    actorName,
+		ActorType:    actorType,
+		Action:       action,
+		ResourceType: resourceType,
+		ResourceId:   resourceId,
+		Before:       summarizeAuditValue(before),
+		After:        summarizeAuditValue(after),
+		Timestamp:    time.Now().Unix(),
+	}
+
+	if request != nil {
+		event.IP = GetRequestIp(request)
+	}
+
+	err := SetAuditEvent(ctx, event)
+	if err != nil {
+		log.Printf("[ERROR] Failed storing audit event %s for %s %s in org %s: %s", action, resourceType, resourceId, orgId, err)
+	}
+
+	config, err := getAuditConfig(ctx, orgId)
+	if err != nil {
+		return
+	}
+
+	if len(config.SyslogAddress) > 0 {
+		go func() {
+			err := sendAuditSyslog(config, event)
+			if err != nil {
+				log.Printf("[WARNING] Failed streaming audit event %s to %s for org %s: %s", event.Id, config.SyslogAddress, orgId, err)
+			}
+		}()
+	}
+
+	// Old events are cleaned up at most once a day per org
+	cleanupKey := fmt.Sprintf("audit_cleanup_%s", orgId)
+	if _, err := GetCache(ctx, cleanupKey); err != nil {
+		SetCache(ctx, cleanupKey, []byte("1"), 60*24)
+		go CleanupAuditEvents(context.Background(), orgId)
+	}
+}
+
+func getAuditConfigCacheKey(orgId string) string {
+	return fmt.Sprintf("audit_config_%s", orgId)
+}
+
+// Every event needs the org's syslog config, so it is cached apart from
+// the org. Changing the config clears it.
+func getAuditConfig(ctx context.Context, orgId string) (AuditConfig, error) {
+	config := AuditConfig{}
+	cache, err := GetCache(ctx, getAuditConfigCacheKey(orgId))
+	if err == nil {
+		err = json.Unmarshal([]byte(cache.([]uint8)), &config)
+		if err == nil {
+			return config, nil
+		}
+	}
+
+	org, err := GetOrg(ctx, orgId)
+	if err != nil {
+		return config, err
+	}
+
+	data, err := json.Marshal(org.AuditConfig)
+	if err == nil {
+		SetCache(ctx, getAuditConfigCacheKey(orgId), data, 10)
+	}
+
+	return org.AuditConfig, nil
+}
+
+func getAuditRetentionDays(org Org) int {
+	if org.AuditConfig.RetentionDays <= 0 {
+		return defaultAuditRetentionDays
+	}
+
+	return org.AuditConfig.RetentionDays
+}
+
+// Deletes audit events older than the retention of the org
+func CleanupAuditEvents(ctx context.Context, orgId string) error {
+	org, err := GetOrg(ctx, orgId)
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().AddDate(0, 0, -getAuditRetentionDays(*org)).Unix()
+	deleted := 0
+	for i := 0; i < 100; i++ {
+		events, err := GetAuditEvents(ctx, orgId, AuditEventSearch{EndTime: cutoff, Limit: maxAuditEvents})
+		if err != nil {
+			return err
+		}
+
+		if len(events) == 0 {
+			break
+		}
+
+		for _, event := range events {
+			err = DeleteAuditEvent(ctx, event.Id)
+			if err != nil {
+				log.Printf("[WARNING] Failed deleting audit event %s: %s", event.Id, err)
+				continue
+			}
+
+			deleted += 1
+		}
+
+		if len(events) < maxAuditEvents {
+			break
+		}
+	}
+
+	if deleted > 0 {
+		log.Printf("[INFO] Deleted %d audit events older than %d days in org %s", deleted, getAuditRetentionDays(*org), orgId)
+	}
+
+	return nil
+}
+
+func escapeCefHeader(value string) string {
+	value = strings.ReplaceAll(value, "\\", "\\\\")
+	return strings.ReplaceAll(value, "|", "\\|")
+}
+
+func escapeCefValue(value string) string {
+	value = strings.ReplaceAll(value, "\\", "\\\\")
+	value = strings.ReplaceAll(value, "=", "\\=")
+	value = strings.ReplaceAll(value, "\r", "\\r")
+	return strings.ReplaceAll(value, "\n", "\\n")
+}
+
+func formatAuditCef(event AuditEvent) string {
+	severity := 3
+	if event.ActorType == "support" || strings.HasSuffix(event.Action, "delete") || strings.HasSuffix(event.Action, "revoke") {
+		severity = 6
+	}
+
+	extensions := []string{
+		fmt.Sprintf("rt=%d", event.Timestamp*1000),
+		fmt.Sprintf("suid=%s", escapeCefValue(event.ActorId)),
+		fmt.Sprintf("suser=%s", escapeCefValue(event.ActorName)),
+		fmt.Sprintf("src=%s", escapeCefValue(event.IP)),
+		fmt.Sprintf("externalId=%s", escapeCefValue(event.Id)),
+		fmt.Sprintf("cs1Label=org cs1=%s", escapeCefValue(event.OrgId)),
+		fmt.Sprintf("cs2Label=actorType cs2=%s", escapeCefValue(event.ActorType)),
+		fmt.Sprintf("cs3Label=resourceType cs3=%s", escapeCefValue(event.ResourceType)),
+		fmt.Sprintf("cs4Label=resourceId cs4=%s", escapeCefValue(event.ResourceId)),
+		fmt.Sprintf("cs5Label=before cs5=%s", escapeCefValue(event.Before)),
+		fmt.Sprintf("cs6Label=after cs6=%s", escapeCefValue(event.After)),
+	}
+
+	return fmt.Sprintf("CEF:0|Shuffle|Shuffle|1.0|%s|%s|%d|%s", escapeCefHeader(event.Action), escapeCefHeader(event.Action), severity, strings.Join(extensions, " "))
+}
+
+// RFC 5424 messages with the authpriv facility. TCP messages are
+// newline terminated.
+func sendAuditSyslog(config AuditConfig, event AuditEvent) error {
+	protocol := config.SyslogProtocol
+	if len(protocol) == 0 {
+		protocol = "udp"
+	}
+
+	message := formatAuditCef(event)
+	if config.SyslogFormat == "json" {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+
+		message = string(data)
+	}
+
+	conn, err := getSyslogDialer().Dial(protocol, config.SyslogAddress)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+
+	timestamp := time.Unix(event.Timestamp, 0).UTC().Format(time.RFC3339)
+	_, err = conn.Write([]byte(fmt.Sprintf("<86>1 %s shuffle shuffle - %s - %s\n", timestamp, event.Action, message)))
+	return err
+}
+
+func isInternalIp(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsUnspecified()
+}
+
+// Syslog streams go out from our servers, so internal addresses are
+// blocked on cloud
+func validateSyslogAddress(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || len(host) == 0 || len(port) == 0 {
+		return errors.New("Syslog address has to be host:port")
+	}
+
+	if project.Environment != "cloud" {
+		return nil
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed resolving %s", host))
+	}
+
+	for _, ip := range ips {
+		if isInternalIp(ip) {
+			return errors.New("Syslog address can't be an internal address")
+		}
+	}
+
+	return nil
+}
+
+// The address is checked again for every connection, as the name can
+// resolve to something else than when the config was saved
+func checkSyslogConnection(network, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || isInternalIp(ip) {
+		return errors.New(fmt.Sprintf("Syslog address %s is an internal address", host))
+	}
+
+	return nil
+}
+
+func getSyslogDialer() *net.Dialer {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if project.Environment == "cloud" {
+		dialer.Control = checkSyslogConnection
+	}
+
+	return dialer
+}
+
+func parseAuditEventSearch(request *http.Request) AuditEventSearch {
+	query := request.URL.Query()
+	search := AuditEventSearch{
+		ActorId:      query.Get("actor_id"),
+		Action:       query.Get("action"),
+		ResourceType: query.Get("resource_type"),
+		ResourceId:   query.Get("resource_id"),
+	}
+
+	search.StartTime, _ = strconv.ParseInt(query.Get("start_time"), 10, 64)
+	search.EndTime, _ = strconv.ParseInt(query.Get("end_time"), 10, 64)
+	search.Limit, _ = strconv.Atoi(query.Get("limit"))
+	return search
+}
+
+func getAuditUser(resp http.ResponseWriter, request *http.Request, action string) (User, bool) {
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in %s: %s", action, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return user, false
+	}
+
+	if !isOrgMember(user) || Authorize(user, "org:manage", "") != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "You don't have access to the audit log"}`))
+		return user, false
+	}
+
+	return user, true
+}
+
+func HandleGetAuditEvents(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, ok := getAuditUser(resp, request, "get audit events")
+	if !ok {
+		return
+	}
+
+	search := parseAuditEventSearch(request)
+	if search.Limit <= 0 || search.Limit > maxAuditEvents {
+		search.Limit = 100
+	}
+
+	ctx := GetContext(request)
+	events, err := GetAuditEvents(ctx, user.ActiveOrg.Id, search)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting audit events for org %s: %s", user.ActiveOrg.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed getting audit events"}`))
+		return
+	}
+
+	newjson, err := json.Marshal(struct {
+		Success bool         `json:"success"`
+		Events  []AuditEvent `json:"events"`
+	}{
+		Success: true,
+		Events:  events,
+	})
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// Exports events as JSON lines (default) or CEF with ?format=cef
+func HandleExportAuditEvents(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, ok := getAuditUser(resp, request, "export audit events")
+	if !ok {
+		return
+	}
+
+	format := request.URL.Query().Get("format")
+	if len(format) == 0 {
+		format = "jsonl"
+	}
+
+	if format != "jsonl" && format != "cef" {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Format has to be jsonl or cef"}`))
+		return
+	}
+
+	search := parseAuditEventSearch(request)
+	if search.Limit <= 0 || search.Limit > maxAuditExportEvents {
+		search.Limit = maxAuditExportEvents
+	}
+
+	ctx := GetContext(request)
+	events, err := GetAuditEvents(ctx, user.ActiveOrg.Id, search)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting audit events for export in org %s: %s", user.ActiveOrg.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed getting audit events"}`))
+		return
+	}
+
+	lines := []string{}
+	for _, event := range events {
+		if format == "cef" {
+			lines = append(lines, formatAuditCef(event))
+			continue
+		}
+
+		data, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+
+		lines = append(lines, string(data))
+	}
+
+	log.Printf("[AUDIT] User %s (%s) exported %d audit events from org %s as %s", user.Username, user.Id, len(events), user.ActiveOrg.Id, format)
+	CreateAuditEvent(ctx, request, user, user.ActiveOrg.Id, "audit.export", "org", user.ActiveOrg.Id, nil, map[string]interface{}{"format": format, "events": len(events)})
+
+	resp.Header().Set("Content-Type", "text/plain")
+	resp.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=audit_%s.%s", user.ActiveOrg.Id, format))
+	resp.WriteHeader(200)
+	resp.Write([]byte(strings.Join(lines, "\n")))
+}
+
+func HandleSetAuditConfig(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, ok := getAuditUser(resp, request, "set audit config")
+	if !ok {
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		log.Printf("[WARNING] Failed reading body in set audit config: %s", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	var config AuditConfig
+	err = json.Unmarshal(body, &config)
+	if err != nil {
+		log.Printf("[WARNING] Failed unmarshalling audit config: %s", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Failed parsing audit config"}`))
+		return
+	}
+
+	if config.RetentionDays < 0 || config.RetentionDays > maxAuditRetentionDays {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Retention has to be between 1 and %d days, or 0 for the default"}`, maxAuditRetentionDays)))
+		return
+	}
+
+	config.SyslogAddress = strings.TrimSpace(config.SyslogAddress)
+	if len(config.SyslogAddress) > 0 {
+		if config.SyslogProtocol != "" && config.SyslogProtocol != "udp" && config.SyslogProtocol != "tcp" {
+			resp.WriteHeader(400)
+			resp.Write([]byte(`{"success": false, "reason": "Syslog protocol has to be udp or tcp"}`))
+			return
+		}
+
+		if config.SyslogFormat != "" && config.SyslogFormat != "cef" && config.SyslogFormat != "json" {
+			resp.WriteHeader(400)
+			resp.Write([]byte(`{"success": false, "reason": "Syslog format has to be cef or json"}`))
+			return
+		}
+
+		err = validateSyslogAddress(config.SyslogAddress)
+		if err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+			return
+		}
+	}
+
+	ctx := GetContext(request)
+	org, err := GetOrg(ctx, user.ActiveOrg.Id)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting org %s for audit config: %s", user.ActiveOrg.Id, err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	oldConfig := org.AuditConfig
+	org.AuditConfig = config
+	err = SetOrg(ctx, *org, org.Id)
+	if err != nil {
+		log.Printf("[ERROR] Failed saving audit config for org %s: %s", org.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	DeleteCache(ctx, getAuditConfigCacheKey(org.Id))
+
+	log.Printf("[AUDIT] User %s (%s) updated the audit config of org %s", user.Username, user.Id, org.Id)
+	CreateAuditEvent(ctx, request, user, org.Id, "audit.config_update", "org", org.Id, oldConfig, config)
+
+	if config.RetentionDays != oldConfig.RetentionDays {
+		go CleanupAuditEvents(context.Background(), org.Id)
+	}
+
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
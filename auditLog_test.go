@@ -0,0 +1,74 @@
+package shuffle
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+func TestGetAuditActor(t *testing.T) {
+	for _, testCase := range []struct {
+		user      User
+		actorType string
+	}{
+		{User{}, "system"},
+		{scimAuditUser, "scim"},
+		{User{Id: "service", ServiceAccount: true}, "service_account"},
+		{User{Id: "key", ApiKeyId: "key-id", Orgs: []string{"org"}}, "api_key"},
+		{User{Id: "user", Orgs: []string{"org"}}, "user"},
+	} {
+		if _, _, actorType := getAuditActor(testCase.user, "org"); actorType != testCase.actorType {
+			t.Errorf("getAuditActor(%#v) = %s; expected %s", testCase.user, actorType, testCase.actorType)
+		}
+	}
+}
+
+func TestGetAuditConfigCached(t *testing.T) {
+	ctx := context.Background()
+	config := AuditConfig{SyslogAddress: "syslog.example.com:514", RetentionDays: 30}
+	data, _ := json.Marshal(config)
+	SetCache(ctx, getAuditConfigCacheKey("audit-config-org"), data, 10)
+
+	// Doesn't need the org from the database
+	found, err := getAuditConfig(ctx, "audit-config-org")
+	if err != nil || found.SyslogAddress != config.SyslogAddress || found.RetentionDays != 30 {
+		t.Errorf("getAuditConfig = %#v, %v; expected the cached config", found, err)
+	}
+}
+
+func TestCheckSyslogConnection(t *testing.T) {
+	for _, address := range []string{"127.0.0.1:514", "10.0.0.1:514", "192.168.1.1:514", "169.254.169.254:514", "[::1]:514", "0.0.0.0:514"} {
+		if err := checkSyslogConnection("udp", address, nil); err == nil {
+			t.Errorf("Syslog connection to internal address %s was allowed", address)
+		}
+	}
+
+	if err := checkSyslogConnection("tcp", "8.8.8.8:514", nil); err != nil {
+		t.Errorf("Syslog connection to a public address was blocked: %s", err)
+	}
+}
+
+func TestGetSyslogDialer(t *testing.T) {
+	oldEnvironment := project.Environment
+	defer func() { project.Environment = oldEnvironment }()
+
+	project.Environment = "onprem"
+	if getSyslogDialer().Control != nil {
+		t.Errorf("Internal syslog addresses were blocked onprem")
+	}
+
+	// Resolving to an internal address at dial time is blocked, not only when saving the config
+	project.Environment = "cloud"
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+	conn, err := getSyslogDialer().Dial("tcp", listener.Addr().String())
+	if err == nil {
+		conn.Close()
+		t.Errorf("Dialed an internal syslog address on cloud")
+	}
+}
@@ -780,7 +780,7 @@ func CheckCreatorSelfPermission(ctx context.Context, requestUser, creatorUser Us
 			log.Printf("[AUDIT] Found org %s (%s) for creator %s (%s)", org.Name, org.Id, algoliaUser.Username, algoliaUser.ObjectID)
 			for _, user := range org.Users {
 				if user.Id == requestUser.Id {
-					if user.Role == "admin" {
+					if hasOrgPermission(user, org.Id, "org:manage") {
 						return true
 					}
 
@@ -1185,7 +1185,7 @@ func ActivateWorkflowApp(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Role == "org-reader" {
+	if Authorize(user, "apps:write", "") != nil {
 		log.Printf("[WARNING] Org-reader doesn't have access to activate workflow app (shared): %s (%s)", user.Username, user.Id)
 		resp.WriteHeader(403)
 		resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
@@ -0,0 +1,672 @@
+package shuffle
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Operations kept per workflow for editors reconnecting with a last seq
+var maxWorkflowCollabOps = 1000
+
+// Editors without a presence update in this many seconds are removed
+var collaboratorPresenceTimeout = int64(30)
+
+// How often streams check the shared cache for changes made through other instances
+var workflowCollabPollInterval = 2 * time.Second
+
+// Max time an operation waits for other editors' operations to be written
+var workflowCollabLockWait = 5 * time.Second
+
+var validWorkflowEditOperations = []string{"add_node", "move_node", "delete_node", "rename_node", "change_parameter", "add_branch", "delete_branch"}
+
+// The merged state of a collaborative session. Workflow is the saved
+// workflow with every operation from Start up to Seq applied to it.
+// The state is kept in the shared cache, so every instance sees the same log.
+type workflowCollabState struct {
+	Start    int64                   `json:"start"`
+	Seq      int64                   `json:"seq"`
+	Workflow Workflow                `json:"workflow"`
+	Deleted  []string                `json:"deleted"`
+	Ops      []WorkflowEditOperation `json:"ops"`
+}
+
+// A full workflow sent by an older client
+type workflowCollabUpdate struct {
+	Id     int64  `json:"id"`
+	UserId string `json:"user_id"`
+	Data   string `json:"data"`
+}
+
+// Wakes up the streams connected to a workflow on this instance.
+// Streams read what changed from the shared cache, and also poll it
+// to get changes made through other instances.
+type collabHub struct {
+	sync.Mutex
+	subscribers map[string]map[chan bool]bool
+}
+
+var workflowCollabHub = &collabHub{
+	subscribers: map[string]map[chan bool]bool{},
+}
+
+func (hub *collabHub) subscribe(workflowId string) chan bool {
+	hub.Lock()
+	defer hub.Unlock()
+
+	if _, ok := hub.subscribers[workflowId]; !ok {
+		hub.subscribers[workflowId] = map[chan bool]bool{}
+	}
+
+	channel := make(chan bool, 1)
+	hub.subscribers[workflowId][channel] = true
+	return channel
+}
+
+func (hub *collabHub) unsubscribe(workflowId string, channel chan bool) {
+	hub.Lock()
+	defer hub.Unlock()
+
+	if _, ok := hub.subscribers[workflowId][channel]; !ok {
+		return
+	}
+
+	delete(hub.subscribers[workflowId], channel)
+	if len(hub.subscribers[workflowId]) == 0 {
+		delete(hub.subscribers, workflowId)
+	}
+}
+
+// Never blocks. A stream that hasn't handled its last notification yet
+// reads this change along with it.
+func (hub *collabHub) notify(workflowId string) {
+	hub.Lock()
+	defer hub.Unlock()
+
+	for channel := range hub.subscribers[workflowId] {
+		select {
+		case channel <- true:
+		default:
+		}
+	}
+}
+
+// Serializes writes to a workflow's session across every instance sharing
+// the cache, so seq numbers are never reused. Returns the unlock function.
+func lockWorkflowCollab(ctx context.Context, lockKey string) (func(), error) {
+	lockId := uuid.NewV4().String()
+	deadline := time.Now().Add(workflowCollabLockWait)
+	for {
+		// Expires by itself if the instance holding it dies
+		err := AddCache(ctx, lockKey, []byte(lockId), 10)
+		if err == nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			return nil, errors.New("Timed out waiting for other editors. Try again")
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	return func() {
+		cache, err := GetCache(ctx, lockKey)
+		if err == nil && string(cache.([]uint8)) == lockId {
+			DeleteCache(ctx, lockKey)
+		}
+	}, nil
+}
+
+func getWorkflowCollabState(ctx context.Context, workflow Workflow) workflowCollabState {
+	state := workflowCollabState{
+		Workflow: workflow,
+		Deleted:  []string{},
+		Ops:      []WorkflowEditOperation{},
+	}
+
+	cache, err := GetCache(ctx, fmt.Sprintf("workflow_collab_%s", workflow.ID))
+	if err == nil {
+		cacheData := []byte(cache.([]uint8))
+		err = json.Unmarshal(cacheData, &state)
+		if err != nil {
+			log.Printf("[WARNING] Failed unmarshalling collaboration state for workflow %s: %s", workflow.ID, err)
+		}
+	}
+
+	return state
+}
+
+// The latest seq of a session, without reading the whole state
+func getWorkflowCollabSeq(ctx context.Context, workflowId string) int64 {
+	cache, err := GetCache(ctx, fmt.Sprintf("workflow_collab_seq_%s", workflowId))
+	if err != nil {
+		return 0
+	}
+
+	seq, err := strconv.ParseInt(string(cache.([]uint8)), 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return seq
+}
+
+func setWorkflowCollabState(ctx context.Context, state workflowCollabState) error {
+	if len(state.Ops) > maxWorkflowCollabOps {
+		state.Ops = state.Ops[len(state.Ops)-maxWorkflowCollabOps:]
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	err = SetCache(ctx, fmt.Sprintf("workflow_collab_%s", state.Workflow.ID), data, 60)
+	if err != nil {
+		return err
+	}
+
+	return SetCache(ctx, fmt.Sprintf("workflow_collab_seq_%s", state.Workflow.ID), []byte(strconv.FormatInt(state.Seq, 10)), 60)
+}
+
+// A new session starts its seq at the current time in milliseconds. That way seq
+// keeps increasing for reconnecting editors even if the cached session expired.
+func newWorkflowCollabSeq() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// Replaces the merged workflow after a normal save, keeping the seq so
+// connected editors don't have to start over.
+func resetWorkflowCollabSnapshot(ctx context.Context, workflow Workflow) {
+	_, err := GetCache(ctx, fmt.Sprintf("workflow_collab_%s", workflow.ID))
+	if err != nil {
+		return
+	}
+
+	unlock, err := lockWorkflowCollab(ctx, fmt.Sprintf("workflow_collab_lock_%s", workflow.ID))
+	if err != nil {
+		log.Printf("[WARNING] Failed resetting collaboration state for workflow %s: %s", workflow.ID, err)
+		return
+	}
+
+	defer unlock()
+
+	state := getWorkflowCollabState(ctx, workflow)
+	state.Workflow = workflow
+	err = setWorkflowCollabState(ctx, state)
+	if err != nil {
+		log.Printf("[WARNING] Failed resetting collaboration state for workflow %s: %s", workflow.ID, err)
+	}
+
+	workflowCollabHub.notify(workflow.ID)
+}
+
+// Adds an operation to the workflow's log and lets every editor know.
+// An operation is made on top of the seq the editor had seen (BaseSeq). If other
+// editors have changed the workflow since, it is rebased on top of their changes,
+// unless one of them touched the same node field or deleted the node.
+func ApplyWorkflowOperation(ctx context.Context, workflow Workflow, op WorkflowEditOperation) (*WorkflowEditOperation, error) {
+	if !ArrayContains(validWorkflowEditOperations, op.Type) {
+		return &op, errors.New(fmt.Sprintf("Invalid operation type '%s'", op.Type))
+	}
+
+	unlock, err := lockWorkflowCollab(ctx, fmt.Sprintf("workflow_collab_lock_%s", workflow.ID))
+	if err != nil {
+		return &op, err
+	}
+
+	defer unlock()
+
+	state := getWorkflowCollabState(ctx, workflow)
+	if state.Seq == 0 {
+		state.Start = newWorkflowCollabSeq()
+		state.Seq = state.Start
+	}
+
+	err = rebaseWorkflowOperation(state, op)
+	if err != nil {
+		return &op, err
+	}
+
+	err = applyWorkflowOperation(&state.Workflow, &state.Deleted, op)
+	if err != nil {
+		return &op, err
+	}
+
+	state.Seq += 1
+	op.Seq = state.Seq
+	op.WorkflowId = workflow.ID
+	op.Timestamp = time.Now().Unix()
+	state.Ops = append(state.Ops, op)
+
+	err = setWorkflowCollabState(ctx, state)
+	if err != nil {
+		return &op, err
+	}
+
+	workflowCollabHub.notify(workflow.ID)
+	return &op, nil
+}
+
+// Checks that an operation can be applied on top of everything that
+// happened since its BaseSeq. A BaseSeq of 0 is the saved workflow.
+func rebaseWorkflowOperation(state workflowCollabState, op WorkflowEditOperation) error {
+	baseSeq := op.BaseSeq
+	if baseSeq == 0 {
+		baseSeq = state.Start
+	}
+
+	if baseSeq > state.Seq {
+		return errors.New(fmt.Sprintf("base_seq %d is newer than the workflow (%d). Reload the workflow", op.BaseSeq, state.Seq))
+	}
+
+	if baseSeq == state.Seq {
+		return nil
+	}
+
+	if baseSeq < state.Start || len(state.Ops) == 0 || state.Ops[0].Seq > baseSeq+1 {
+		return errors.New(fmt.Sprintf("base_seq %d is too old. Reload the workflow", op.BaseSeq))
+	}
+
+	for _, applied := range state.Ops {
+		// An editor's own operations are always applied in the order they were sent
+		if applied.Seq <= baseSeq || applied.UserId == op.UserId {
+			continue
+		}
+
+		if workflowOperationsConflict(applied, op) {
+			return errors.New(fmt.Sprintf("Node %s was changed by %s (seq %d). Reload the workflow", op.NodeId, applied.Username, applied.Seq))
+		}
+	}
+
+	return nil
+}
+
+func workflowOperationsConflict(applied, op WorkflowEditOperation) bool {
+	if applied.NodeId != op.NodeId {
+		return false
+	}
+
+	if applied.Type == "delete_node" || applied.Type == "delete_branch" {
+		return true
+	}
+
+	return applied.Type == op.Type && applied.Field == op.Field
+}
+
+func applyWorkflowOperation(workflow *Workflow, deleted *[]string, op WorkflowEditOperation) error {
+	if len(op.NodeId) == 0 {
+		return errors.New("node_id is required")
+	}
+
+	if op.Type != "add_node" && op.Type != "add_branch" && ArrayContains(*deleted, op.NodeId) {
+		return errors.New(fmt.Sprintf("Node %s has been deleted by another editor", op.NodeId))
+	}
+
+	switch op.Type {
+	case "add_node":
+		if op.NodeType == "trigger" {
+			trigger := Trigger{}
+			err := json.Unmarshal(op.Value, &trigger)
+			if err != nil {
+				return errors.New(fmt.Sprintf("Invalid trigger: %s", err))
+			}
+
+			trigger.ID = op.NodeId
+			for _, existing := range workflow.Triggers {
+				if existing.ID == trigger.ID {
+					return nil
+				}
+			}
+
+			workflow.Triggers = append(workflow.Triggers, trigger)
+		} else {
+			action := Action{}
+			err := json.Unmarshal(op.Value, &action)
+			if err != nil {
+				return errors.New(fmt.Sprintf("Invalid action: %s", err))
+			}
+
+			action.ID = op.NodeId
+			for _, existing := range workflow.Actions {
+				if existing.ID == action.ID {
+					return nil
+				}
+			}
+
+			workflow.Actions = append(workflow.Actions, action)
+		}
+
+		newDeleted := []string{}
+		for _, id := range *deleted {
+			if id != op.NodeId {
+				newDeleted = append(newDeleted, id)
+			}
+		}
+
+		*deleted = newDeleted
+	case "move_node":
+		if op.Position == nil {
+			return errors.New("position is required")
+		}
+
+		for actionIndex, action := range workflow.Actions {
+			if action.ID == op.NodeId {
+				workflow.Actions[actionIndex].Position = *op.Position
+				return nil
+			}
+		}
+
+		for triggerIndex, trigger := range workflow.Triggers {
+			if trigger.ID == op.NodeId {
+				workflow.Triggers[triggerIndex].Position.X = op.Position.X
+				workflow.Triggers[triggerIndex].Position.Y = op.Position.Y
+				return nil
+			}
+		}
+
+		return errors.New(fmt.Sprintf("Node %s not found", op.NodeId))
+	case "rename_node":
+		label := ""
+		err := json.Unmarshal(op.Value, &label)
+		if err != nil {
+			return errors.New("value has to be a string")
+		}
+
+		for actionIndex, action := range workflow.Actions {
+			if action.ID == op.NodeId {
+				workflow.Actions[actionIndex].Label = label
+				return nil
+			}
+		}
+
+		for triggerIndex, trigger := range workflow.Triggers {
+			if trigger.ID == op.NodeId {
+				workflow.Triggers[triggerIndex].Label = label
+				return nil
+			}
+		}
+
+		return errors.New(fmt.Sprintf("Node %s not found", op.NodeId))
+	case "change_parameter":
+		if len(op.Field) == 0 {
+			return errors.New("field is required")
+		}
+
+		value := ""
+		err := json.Unmarshal(op.Value, &value)
+		if err != nil {
+			return errors.New("value has to be a string")
+		}
+
+		setParameter := func(parameters []WorkflowAppActionParameter) []WorkflowAppActionParameter {
+			for paramIndex, param := range parameters {
+				if param.Name == op.Field {
+					parameters[paramIndex].Value = value
+					return parameters
+				}
+			}
+
+			return append(parameters, WorkflowAppActionParameter{
+				Name:  op.Field,
+				Value: value,
+			})
+		}
+
+		for actionIndex, action := range workflow.Actions {
+			if action.ID == op.NodeId {
+				workflow.Actions[actionIndex].Parameters = setParameter(action.Parameters)
+				return nil
+			}
+		}
+
+		for triggerIndex, trigger := range workflow.Triggers {
+			if trigger.ID == op.NodeId {
+				workflow.Triggers[triggerIndex].Parameters = setParameter(trigger.Parameters)
+				return nil
+			}
+		}
+
+		return errors.New(fmt.Sprintf("Node %s not found", op.NodeId))
+	case "delete_node":
+		newActions := []Action{}
+		for _, action := range workflow.Actions {
+			if action.ID != op.NodeId {
+				newActions = append(newActions, action)
+			}
+		}
+
+		newTriggers := []Trigger{}
+		for _, trigger := range workflow.Triggers {
+			if trigger.ID != op.NodeId {
+				newTriggers = append(newTriggers, trigger)
+			}
+		}
+
+		newBranches := []Branch{}
+		for _, branch := range workflow.Branches {
+			if branch.SourceID != op.NodeId && branch.DestinationID != op.NodeId {
+				newBranches = append(newBranches, branch)
+			}
+		}
+
+		workflow.Actions = newActions
+		workflow.Triggers = newTriggers
+		workflow.Branches = newBranches
+		*deleted = append(*deleted, op.NodeId)
+	case "add_branch":
+		branch := Branch{}
+		err := json.Unmarshal(op.Value, &branch)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Invalid branch: %s", err))
+		}
+
+		branch.ID = op.NodeId
+		if ArrayContains(*deleted, branch.SourceID) || ArrayContains(*deleted, branch.DestinationID) {
+			return errors.New("Branch points to a node that has been deleted by another editor")
+		}
+
+		for branchIndex, existing := range workflow.Branches {
+			if existing.ID == branch.ID {
+				workflow.Branches[branchIndex] = branch
+				return nil
+			}
+		}
+
+		workflow.Branches = append(workflow.Branches, branch)
+	case "delete_branch":
+		newBranches := []Branch{}
+		for _, branch := range workflow.Branches {
+			if branch.ID != op.NodeId {
+				newBranches = append(newBranches, branch)
+			}
+		}
+
+		workflow.Branches = newBranches
+	}
+
+	return nil
+}
+
+func getCollaboratorPresence(ctx context.Context, workflowId string) map[string]CollaboratorPresence {
+	presenceMap := map[string]CollaboratorPresence{}
+	cache, err := GetCache(ctx, fmt.Sprintf("workflow_presence_%s", workflowId))
+	if err == nil {
+		cacheData := []byte(cache.([]uint8))
+		json.Unmarshal(cacheData, &presenceMap)
+	}
+
+	return presenceMap
+}
+
+// The editors currently in a workflow, without the ones that timed out
+func getCollaborators(presenceMap map[string]CollaboratorPresence, timeNow int64) []CollaboratorPresence {
+	collaborators := []CollaboratorPresence{}
+	for _, item := range presenceMap {
+		if timeNow-item.LastSeen > collaboratorPresenceTimeout {
+			continue
+		}
+
+		collaborators = append(collaborators, item)
+	}
+
+	sort.Slice(collaborators, func(i, j int) bool {
+		return collaborators[i].Username < collaborators[j].Username
+	})
+
+	return collaborators
+}
+
+// Updates a user's cursor/selection and returns the new list of editors
+func UpdateCollaboratorPresence(ctx context.Context, workflowId string, presence CollaboratorPresence, leaving bool) []CollaboratorPresence {
+	timeNow := time.Now().Unix()
+	unlock, err := lockWorkflowCollab(ctx, fmt.Sprintf("workflow_presence_lock_%s", workflowId))
+	if err != nil {
+		log.Printf("[WARNING] Failed updating presence in workflow %s: %s", workflowId, err)
+		return getCollaborators(getCollaboratorPresence(ctx, workflowId), timeNow)
+	}
+
+	presenceMap := getCollaboratorPresence(ctx, workflowId)
+	if leaving {
+		delete(presenceMap, presence.UserId)
+	} else {
+		presence.LastSeen = timeNow
+		presenceMap[presence.UserId] = presence
+	}
+
+	for userId, item := range presenceMap {
+		if timeNow-item.LastSeen > collaboratorPresenceTimeout {
+			delete(presenceMap, userId)
+		}
+	}
+
+	data, err := json.Marshal(presenceMap)
+	if err == nil {
+		SetCache(ctx, fmt.Sprintf("workflow_presence_%s", workflowId), data, 10)
+	}
+
+	unlock()
+	workflowCollabHub.notify(workflowId)
+	return getCollaborators(presenceMap, timeNow)
+}
+
+// Stores a full workflow from an older client for every stream to send.
+// Raw newlines can't be in valid JSON values, and would break the event format.
+func SetWorkflowCollabUpdate(ctx context.Context, workflowId, userId string, body []byte) error {
+	update := workflowCollabUpdate{
+		Id:     time.Now().UnixNano(),
+		UserId: userId,
+		Data:   strings.Replace(strings.Replace(string(body), "\r", "", -1), "\n", "", -1),
+	}
+
+	data, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+
+	err = SetCache(ctx, fmt.Sprintf("workflow_collab_update_%s", workflowId), data, 10)
+	if err != nil {
+		return err
+	}
+
+	err = SetCache(ctx, fmt.Sprintf("workflow_collab_update_id_%s", workflowId), []byte(strconv.FormatInt(update.Id, 10)), 10)
+	if err != nil {
+		return err
+	}
+
+	workflowCollabHub.notify(workflowId)
+	return nil
+}
+
+// What a single stream has sent, so it only sends what changed since
+type workflowCollabStream struct {
+	workflow     Workflow
+	userId       string
+	started      bool
+	lastSeq      int64
+	lastUpdate   int64
+	lastPresence string
+}
+
+// Returns the server-sent events for everything that changed in the shared
+// cache since the last call: operations (or a snapshot if the log no longer
+// goes back far enough), full workflow updates and the list of editors.
+func (stream *workflowCollabStream) nextEvents(ctx context.Context) []string {
+	events := []string{}
+
+	if !stream.started || getWorkflowCollabSeq(ctx, stream.workflow.ID) > stream.lastSeq {
+		state := getWorkflowCollabState(ctx, stream.workflow)
+
+		// A snapshot with seq 0 is the saved workflow the session started from
+		fromSeq := stream.lastSeq
+		if fromSeq == 0 && stream.started {
+			fromSeq = state.Start
+		}
+
+		if fromSeq > 0 && fromSeq >= state.Start && len(state.Ops) > 0 && state.Ops[0].Seq <= fromSeq+1 {
+			for _, op := range state.Ops {
+				if op.Seq <= fromSeq {
+					continue
+				}
+
+				data, err := json.Marshal(op)
+				if err != nil {
+					continue
+				}
+
+				events = append(events, fmt.Sprintf("id: %d\nevent: operation\ndata: %s\n\n", op.Seq, data))
+				stream.lastSeq = op.Seq
+			}
+		} else if !stream.started || state.Seq > stream.lastSeq {
+			snapshot, err := json.Marshal(map[string]interface{}{
+				"seq":      state.Seq,
+				"workflow": state.Workflow,
+			})
+			if err == nil {
+				events = append(events, fmt.Sprintf("id: %d\nevent: snapshot\ndata: %s\n\n", state.Seq, snapshot))
+			}
+
+			stream.lastSeq = state.Seq
+		}
+
+		stream.started = true
+	}
+
+	cache, err := GetCache(ctx, fmt.Sprintf("workflow_collab_update_id_%s", stream.workflow.ID))
+	if err == nil {
+		updateId, err := strconv.ParseInt(string(cache.([]uint8)), 10, 64)
+		if err == nil && updateId > stream.lastUpdate {
+			stream.lastUpdate = updateId
+
+			update := workflowCollabUpdate{}
+			cache, err := GetCache(ctx, fmt.Sprintf("workflow_collab_update_%s", stream.workflow.ID))
+			if err == nil {
+				err = json.Unmarshal([]byte(cache.([]uint8)), &update)
+			}
+
+			// Full workflow updates aren't echoed back to the sender
+			if err == nil && (update.UserId != stream.userId || len(stream.userId) == 0) {
+				events = append(events, fmt.Sprintf("event: update\ndata: %s\n\n", update.Data))
+			}
+		}
+	}
+
+	collaborators := getCollaborators(getCollaboratorPresence(ctx, stream.workflow.ID), time.Now().Unix())
+	data, err := json.Marshal(collaborators)
+	if err == nil && string(data) != stream.lastPresence {
+		stream.lastPresence = string(data)
+		events = append(events, fmt.Sprintf("event: presence\ndata: %s\n\n", data))
+	}
+
+	return events
+}
@@ -0,0 +1,221 @@
+package shuffle
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAddCache(t *testing.T) {
+	ctx := context.Background()
+	if err := AddCache(ctx, "add_cache_test", []byte("first"), 10); err != nil {
+		t.Fatalf("AddCache on a new key failed: %s", err)
+	}
+
+	if err := AddCache(ctx, "add_cache_test", []byte("second"), 10); err == nil {
+		t.Errorf("AddCache overwrote an existing key")
+	}
+
+	cache, err := GetCache(ctx, "add_cache_test")
+	if err != nil || string(cache.([]uint8)) != "first" {
+		t.Errorf("AddCache key contains %v (%v); expected the first value", cache, err)
+	}
+}
+
+func TestLockWorkflowCollab(t *testing.T) {
+	ctx := context.Background()
+	oldWait := workflowCollabLockWait
+	workflowCollabLockWait = 50 * time.Millisecond
+	defer func() { workflowCollabLockWait = oldWait }()
+
+	unlock, err := lockWorkflowCollab(ctx, "workflow_collab_lock_test")
+	if err != nil {
+		t.Fatalf("Failed taking a free lock: %s", err)
+	}
+
+	// Another instance sharing the cache has to wait for it
+	if _, err := lockWorkflowCollab(ctx, "workflow_collab_lock_test"); err == nil {
+		t.Fatalf("Took a lock that was already taken")
+	}
+
+	unlock()
+	unlock, err = lockWorkflowCollab(ctx, "workflow_collab_lock_test")
+	if err != nil {
+		t.Fatalf("Failed taking a released lock: %s", err)
+	}
+
+	unlock()
+}
+
+func newCollabTestOp(userId, opType, nodeId string, baseSeq int64, value string) WorkflowEditOperation {
+	return WorkflowEditOperation{
+		UserId:   userId,
+		Username: userId,
+		Type:     opType,
+		NodeId:   nodeId,
+		Field:    "body",
+		BaseSeq:  baseSeq,
+		Value:    json.RawMessage(value),
+	}
+}
+
+func TestApplyWorkflowOperationRebase(t *testing.T) {
+	ctx := context.Background()
+	workflow := Workflow{ID: "collab-rebase-test", Actions: []Action{{ID: "node1"}, {ID: "node2"}}}
+
+	first, err := ApplyWorkflowOperation(ctx, workflow, newCollabTestOp("alice", "change_parameter", "node1", 0, `"a"`))
+	if err != nil {
+		t.Fatalf("First operation was rejected: %s", err)
+	}
+
+	// Seq starts from the time, so it keeps increasing if the cached session expires
+	if first.Seq < newWorkflowCollabSeq()-60000 {
+		t.Errorf("First seq %d doesn't start from the current time", first.Seq)
+	}
+
+	// Another node, based on the saved workflow: rebased on top of alice's change
+	second, err := ApplyWorkflowOperation(ctx, workflow, newCollabTestOp("bob", "change_parameter", "node2", 0, `"b"`))
+	if err != nil || second.Seq != first.Seq+1 {
+		t.Fatalf("Non-conflicting stale operation = %v, %v; expected seq %d", second, err, first.Seq+1)
+	}
+
+	// The same field, without having seen alice's change
+	_, err = ApplyWorkflowOperation(ctx, workflow, newCollabTestOp("bob", "change_parameter", "node1", 0, `"c"`))
+	if err == nil || !strings.Contains(err.Error(), "was changed by alice") {
+		t.Errorf("Conflicting stale operation was applied: %v", err)
+	}
+
+	// After seeing it, it's fine
+	third, err := ApplyWorkflowOperation(ctx, workflow, newCollabTestOp("bob", "change_parameter", "node1", first.Seq, `"c"`))
+	if err != nil {
+		t.Fatalf("Operation based on the latest change was rejected: %s", err)
+	}
+
+	_, err = ApplyWorkflowOperation(ctx, workflow, newCollabTestOp("alice", "change_parameter", "node2", first.Seq, `"d"`))
+	if err == nil {
+		t.Errorf("Alice overwrote bob's change to node2 without seeing it")
+	}
+
+	// An editor's own operations are sent before they are acknowledged, and never conflict
+	_, err = ApplyWorkflowOperation(ctx, workflow, newCollabTestOp("alice", "change_parameter", "node2", third.Seq, `"e"`))
+	if err != nil {
+		t.Fatalf("Operation based on the latest change was rejected: %s", err)
+	}
+
+	_, err = ApplyWorkflowOperation(ctx, workflow, newCollabTestOp("alice", "change_parameter", "node2", third.Seq, `"f"`))
+	if err != nil {
+		t.Errorf("Alice was blocked by her own operation: %s", err)
+	}
+
+	_, err = ApplyWorkflowOperation(ctx, workflow, newCollabTestOp("alice", "rename_node", "node1", first.Seq+100, `"name"`))
+	if err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("Operation from the future was applied: %v", err)
+	}
+
+	_, err = ApplyWorkflowOperation(ctx, workflow, newCollabTestOp("alice", "rename_node", "node1", 12345, `"name"`))
+	if err == nil || !strings.Contains(err.Error(), "too old") {
+		t.Errorf("Operation from another session was applied: %v", err)
+	}
+
+	_, err = ApplyWorkflowOperation(ctx, workflow, newCollabTestOp("alice", "invalid", "node1", 0, `""`))
+	if err == nil {
+		t.Errorf("Invalid operation type was applied")
+	}
+}
+
+func filterCollabEvents(events []string, event string) []string {
+	filtered := []string{}
+	for _, item := range events {
+		if strings.Contains(item, "event: "+event+"\n") {
+			filtered = append(filtered, item)
+		}
+	}
+
+	return filtered
+}
+
+func TestWorkflowCollabStreamEvents(t *testing.T) {
+	ctx := context.Background()
+	workflow := Workflow{ID: "collab-stream-test", Actions: []Action{{ID: "node1"}}}
+
+	stream := &workflowCollabStream{workflow: workflow, userId: "alice"}
+	events := stream.nextEvents(ctx)
+	if len(events) != 2 || !strings.Contains(events[0], "event: snapshot") || !strings.Contains(events[1], "event: presence") {
+		t.Fatalf("First events = %v; expected a snapshot and the editors", events)
+	}
+
+	if events := stream.nextEvents(ctx); len(events) > 0 {
+		t.Errorf("Events sent without changes: %v", events)
+	}
+
+	// Written through any instance, read from the shared cache
+	op, err := ApplyWorkflowOperation(ctx, workflow, newCollabTestOp("bob", "rename_node", "node1", 0, `"renamed"`))
+	if err != nil {
+		t.Fatalf("Operation was rejected: %s", err)
+	}
+
+	events = stream.nextEvents(ctx)
+	if len(events) != 1 || !strings.Contains(events[0], "event: operation") || !strings.Contains(events[0], "renamed") {
+		t.Fatalf("Events after an operation = %v; expected the operation", events)
+	}
+
+	// Reconnecting with the last seq only gets what was missed
+	ApplyWorkflowOperation(ctx, workflow, newCollabTestOp("bob", "change_parameter", "node1", op.Seq, `"value"`))
+	second, _ := ApplyWorkflowOperation(ctx, workflow, newCollabTestOp("bob", "rename_node", "node1", op.Seq, `"again"`))
+	resumed := &workflowCollabStream{workflow: workflow, lastSeq: op.Seq + 1}
+	events = filterCollabEvents(resumed.nextEvents(ctx), "operation")
+	if len(events) != 1 || !strings.Contains(events[0], "again") || resumed.lastSeq != second.Seq {
+		t.Errorf("Resumed events = %v; expected only operation %d", events, second.Seq)
+	}
+
+	if events := filterCollabEvents(stream.nextEvents(ctx), "operation"); len(events) != 2 {
+		t.Errorf("Events after two operations = %v; expected both", events)
+	}
+
+	// Too old to resume from the log
+	old := &workflowCollabStream{workflow: workflow, lastSeq: 1}
+	events = old.nextEvents(ctx)
+	if len(events) == 0 || !strings.Contains(events[0], "event: snapshot") || len(filterCollabEvents(events, "operation")) > 0 {
+		t.Errorf("Events for an expired seq = %v; expected a snapshot", events)
+	}
+
+	// Full workflow updates go to everyone but the sender
+	SetWorkflowCollabUpdate(ctx, workflow.ID, "alice", []byte("{\"id\":\n\"x\"}"))
+	if events := stream.nextEvents(ctx); len(events) > 0 {
+		t.Errorf("Full workflow update was echoed to its sender: %v", events)
+	}
+
+	events = resumed.nextEvents(ctx)
+	if len(events) != 1 || events[0] != "event: update\ndata: {\"id\":\"x\"}\n\n" {
+		t.Errorf("Update events = %#v; expected the update without newlines", events)
+	}
+
+	UpdateCollaboratorPresence(ctx, workflow.ID, CollaboratorPresence{UserId: "bob", Username: "bob"}, false)
+	events = stream.nextEvents(ctx)
+	if len(events) != 1 || !strings.Contains(events[0], "event: presence") || !strings.Contains(events[0], "bob") {
+		t.Errorf("Events after bob joined = %v; expected presence", events)
+	}
+
+	UpdateCollaboratorPresence(ctx, workflow.ID, CollaboratorPresence{UserId: "bob"}, true)
+	events = stream.nextEvents(ctx)
+	if len(events) != 1 || strings.Contains(events[0], "bob") {
+		t.Errorf("Events after bob left = %v; expected presence without bob", events)
+	}
+}
+
+func TestCollabHubNotify(t *testing.T) {
+	channel := workflowCollabHub.subscribe("collab-hub-test")
+	defer workflowCollabHub.unsubscribe("collab-hub-test", channel)
+
+	// Never blocks, even if nobody reads
+	workflowCollabHub.notify("collab-hub-test")
+	workflowCollabHub.notify("collab-hub-test")
+
+	select {
+	case <-channel:
+	default:
+		t.Errorf("Subscriber wasn't notified")
+	}
+}
@@ -0,0 +1,1085 @@
+package shuffle
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Executions are limited per workflow, the rest per export
+const (
+	maxExportExecutions  = 1000
+	maxExportCacheKeys   = 10000
+	maxDataExports       = 100
+	maxDeletionReports   = 100
+	dataExportNamespace  = "exports"
+	dataExportExpiryDays = 7
+)
+
+// Secrets are never exported. Users get the same view as in the user list.
+func getExportUser(user User) User {
+	user.Password = ""
+	user.PasswordHistory = []string{}
+	user.Session = ""
+	user.UsersLastSession = ""
+	user.ApiKey = ""
+	user.VerificationToken = ""
+	user.EthInfo = EthInfo{}
+	user.Authentication = []UserAuth{}
+	user.PrivateApps = []WorkflowApp{}
+	user.MFA = MFAInfo{
+		Active:         user.MFA.Active,
+		Authenticators: user.MFA.Authenticators,
+	}
+
+	return user
+}
+
+// The authorization of an execution lets anyone holding it read and
+// update the execution
+func getExportExecution(execution WorkflowExecution) WorkflowExecution {
+	execution.Authorization = ""
+	for resultIndex := range execution.Results {
+		execution.Results[resultIndex].Authorization = ""
+	}
+
+	return execution
+}
+
+func getExportOrg(org Org) Org {
+	org.Users = []User{}
+	org.SSOConfig.OpenIdClientSecret = ""
+	org.SamlConfig.SPPrivateKey = ""
+	org.ScimConfig = ScimConfig{}
+	return org
+}
+
+type exportArchive struct {
+	zipWriter *zip.Writer
+	counts    []ResourceCount
+}
+
+func (archive *exportArchive) addFile(name string, data []byte) error {
+	zipFile, err := archive.zipWriter.Create(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = zipFile.Write(data)
+	return err
+}
+
+// Adds a JSON file with a resource type and counts it
+func (archive *exportArchive) add(resourceType string, value interface{}, count int) {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		log.Printf("[WARNING] Failed marshalling %s for export: %s", resourceType, err)
+		archive.counts = append(archive.counts, ResourceCount{ResourceType: resourceType, Reason: "Failed marshalling"})
+		return
+	}
+
+	err = archive.addFile(fmt.Sprintf("%s.json", resourceType), data)
+	if err != nil {
+		log.Printf("[WARNING] Failed adding %s to export: %s", resourceType, err)
+		archive.counts = append(archive.counts, ResourceCount{ResourceType: resourceType, Reason: "Failed adding to archive"})
+		return
+	}
+
+	archive.counts = append(archive.counts, ResourceCount{ResourceType: resourceType, Count: count})
+}
+
+func getOrgWorkflows(ctx context.Context, user User, orgId string) []Workflow {
+	user.ActiveOrg.Id = orgId
+	allWorkflows, err := GetAllWorkflowsByQuery(ctx, user, 250, "")
+	if err != nil && len(allWorkflows) == 0 {
+		log.Printf("[WARNING] Failed getting workflows of org %s: %s", orgId, err)
+	}
+
+	workflows := []Workflow{}
+	for _, workflow := range allWorkflows {
+		if workflow.OrgId == orgId {
+			workflows = append(workflows, workflow)
+		}
+	}
+
+	return workflows
+}
+
+func getOrgCacheKeys(ctx context.Context, orgId string) []CacheKeyData {
+	cacheKeys := []CacheKeyData{}
+	cursor := ""
+	for len(cacheKeys) < maxExportCacheKeys {
+		newKeys, newCursor, err := GetAllCacheKeys(ctx, orgId, 1000, cursor)
+		if err != nil && len(newKeys) == 0 {
+			log.Printf("[WARNING] Failed getting cache keys of org %s: %s", orgId, err)
+			break
+		}
+
+		for _, cacheKey := range newKeys {
+			if cacheKey.OrgId == orgId {
+				cacheKeys = append(cacheKeys, cacheKey)
+			}
+		}
+
+		if len(newCursor) == 0 || newCursor == cursor || len(newKeys) == 0 {
+			break
+		}
+
+		cursor = newCursor
+	}
+
+	return cacheKeys
+}
+
+// Matches the ID cache keys are stored with in SetCacheKey
+func getCacheKeyId(cacheKey CacheKeyData) string {
+	cacheId := fmt.Sprintf("%s_%s", cacheKey.OrgId, cacheKey.Key)
+	if len(cacheId) > 128 {
+		cacheId = cacheId[0:127]
+	}
+
+	return url.QueryEscape(cacheId)
+}
+
+// Auth values stay encrypted in the database and are left out
+func getExportAppAuth(auths []AppAuthenticationStorage, orgId string) []AppAuthenticationStorage {
+	newAuths := []AppAuthenticationStorage{}
+	for _, auth := range auths {
+		if auth.OrgId != orgId {
+			continue
+		}
+
+		for fieldIndex := range auth.Fields {
+			auth.Fields[fieldIndex].Value = ""
+		}
+
+		auth.App = WorkflowApp{
+			ID:         auth.App.ID,
+			Name:       auth.App.Name,
+			AppVersion: auth.App.AppVersion,
+		}
+
+		newAuths = append(newAuths, auth)
+	}
+
+	return newAuths
+}
+
+func addOrgExport(ctx context.Context, archive *exportArchive, org *Org, user User) {
+	archive.add("org", getExportOrg(*org), 1)
+
+	users := []User{}
+	for _, orgUser := range org.Users {
+		foundUser, err := GetUser(ctx, orgUser.Id)
+		if err != nil {
+			log.Printf("[WARNING] Failed getting user %s for export of org %s: %s", orgUser.Id, org.Id, err)
+			continue
+		}
+
+		users = append(users, getExportUser(*foundUser))
+	}
+
+	archive.add("users", users, len(users))
+
+	workflows := getOrgWorkflows(ctx, user, org.Id)
+	archive.add("workflows", workflows, len(workflows))
+
+	executionCount := 0
+	for _, workflow := range workflows {
+		executions, err := GetAllWorkflowExecutions(ctx, workflow.ID, maxExportExecutions)
+		if err != nil && len(executions) == 0 {
+			continue
+		}
+
+		for executionIndex := range executions {
+			executions[executionIndex] = getExportExecution(executions[executionIndex])
+		}
+
+		data, err := json.MarshalIndent(executions, "", "  ")
+		if err != nil {
+			continue
+		}
+
+		err = archive.addFile(fmt.Sprintf("executions/%s.json", workflow.ID), data)
+		if err == nil {
+			executionCount += len(executions)
+		}
+	}
+
+	archive.counts = append(archive.counts, ResourceCount{ResourceType: "executions", Count: executionCount})
+
+	apps := []WorkflowApp{}
+	for _, appId := range org.ActiveApps {
+		app, err := GetApp(ctx, appId, user, false)
+		if err != nil || app.ReferenceOrg != org.Id {
+			continue
+		}
+
+		apps = append(apps, *app)
+	}
+
+	archive.add("apps", apps, len(apps))
+
+	auths, err := GetAllWorkflowAppAuth(ctx, org.Id)
+	if err != nil && len(auths) == 0 {
+		log.Printf("[WARNING] Failed getting app auth for export of org %s: %s", org.Id, err)
+	}
+
+	auths = getExportAppAuth(auths, org.Id)
+	archive.add("app_auth", auths, len(auths))
+
+	files, err := GetAllFiles(ctx, org.Id, "")
+	if err != nil && len(files) == 0 {
+		log.Printf("[WARNING] Failed getting files for export of org %s: %s", org.Id, err)
+	}
+
+	exportedFiles := []File{}
+	for _, file := range files {
+		if file.OrgId != org.Id || file.Status != "active" {
+			continue
+		}
+
+		content, err := GetFileContent(ctx, &file, nil)
+		if err != nil {
+			log.Printf("[WARNING] Failed getting content of file %s for export: %s", file.Id, err)
+			continue
+		}
+
+		err = archive.addFile(fmt.Sprintf("files/%s/%s_%s", file.Namespace, file.Id, file.Filename), content)
+		if err == nil {
+			exportedFiles = append(exportedFiles, file)
+		}
+	}
+
+	archive.add("files", exportedFiles, len(exportedFiles))
+
+	notifications, err := GetOrgNotifications(ctx, org.Id)
+	if err != nil && len(notifications) == 0 {
+		log.Printf("[WARNING] Failed getting notifications for export of org %s: %s", org.Id, err)
+	}
+
+	archive.add("notifications", notifications, len(notifications))
+
+	cacheKeys := getOrgCacheKeys(ctx, org.Id)
+	for cacheIndex := range cacheKeys {
+		cacheKeys[cacheIndex].Authorization = ""
+	}
+
+	archive.add("cache_keys", cacheKeys, len(cacheKeys))
+
+	stats, err := GetOrgStatistics(ctx, org.Id)
+	if err == nil {
+		archive.add("stats", stats, 1)
+	}
+
+	events, err := GetAuditEvents(ctx, org.Id, AuditEventSearch{Limit: maxAuditExportEvents})
+	if err == nil {
+		archive.add("audit_events", events, len(events))
+	}
+}
+
+// Everything referencing one user in the org the export is made from
+func addUserExport(ctx context.Context, archive *exportArchive, org *Org, subject *User, user User) {
+	archive.add("user", getExportUser(*subject), 1)
+
+	apiKeys, err := GetUserApiKeys(ctx, subject.Id)
+	if err == nil {
+		for keyIndex := range apiKeys {
+			apiKeys[keyIndex].KeyHash = ""
+		}
+
+		archive.add("api_keys", apiKeys, len(apiKeys))
+	}
+
+	sessions := []SessionInfo{}
+	for _, session := range getActiveSessions(ctx, *subject) {
+		sessions = append(sessions, SessionInfo{
+			Id:           getSessionId(session.Session),
+			Created:      session.Created,
+			LastActivity: session.LastActivity,
+			IP:           session.IP,
+			UserAgent:    session.UserAgent,
+		})
+	}
+
+	archive.add("sessions", sessions, len(sessions))
+
+	workflows := []Workflow{}
+	for _, workflow := range getOrgWorkflows(ctx, user, org.Id) {
+		if workflow.Owner == subject.Id {
+			workflows = append(workflows, workflow)
+		}
+	}
+
+	archive.add("workflows", workflows, len(workflows))
+
+	notifications, err := GetUserNotifications(ctx, subject.Id)
+	if err == nil {
+		archive.add("notifications", notifications, len(notifications))
+	}
+
+	events, err := GetAuditEvents(ctx, org.Id, AuditEventSearch{ActorId: subject.Id, Limit: maxAuditExportEvents})
+	if err == nil {
+		archive.add("audit_events", events, len(events))
+	}
+}
+
+// Creates the org file the archive is written to. The status keeps it out
+// of the file APIs, so only the export download can read it.
+func createDataExportFile(ctx context.Context, export DataExport) (*File, error) {
+	if len(basepath) == 0 {
+		basepath = "files"
+	}
+
+	folderPath := fmt.Sprintf("%s/%s/%s", basepath, export.OrgId, "global")
+	if project.Environment != "cloud" {
+		err := os.MkdirAll(folderPath, os.ModePerm)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	timeNow := time.Now().Unix()
+	fileId := fmt.Sprintf("file_%s", uuid.NewV4().String())
+	file := &File{
+		Id:           fileId,
+		CreatedAt:    timeNow,
+		UpdatedAt:    timeNow,
+		Description:  fmt.Sprintf("Data export %s", export.Id),
+		Status:       "created",
+		Filename:     fmt.Sprintf("%s_export_%s_%s.zip", export.Type, export.SubjectId, time.Now().Format("2006-01-02")),
+		OrgId:        export.OrgId,
+		WorkflowId:   "global",
+		DownloadPath: fmt.Sprintf("%s/%s", folderPath, fileId),
+		Subflows:     []string{},
+		StorageArea:  "local",
+		Namespace:    dataExportNamespace,
+		Tags:         []string{"export"},
+	}
+
+	if project.Environment == "cloud" {
+		file.StorageArea = "google_storage"
+	}
+
+	return file, SetFile(ctx, *file)
+}
+
+// Exports can be larger than what fits in memory, so they are written
+// straight to storage
+func openDataExportWriter(ctx context.Context, file *File) (io.WriteCloser, error) {
+	if file.StorageArea == "google_storage" {
+		return project.StorageClient.Bucket(orgFileBucket).Object(file.DownloadPath).NewWriter(ctx), nil
+	}
+
+	return os.OpenFile(file.DownloadPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+}
+
+func openDataExportReader(ctx context.Context, file *File) (io.ReadCloser, error) {
+	if file.StorageArea == "google_storage" {
+		return project.StorageClient.Bucket(orgFileBucket).Object(file.DownloadPath).NewReader(ctx)
+	}
+
+	return os.Open(file.DownloadPath)
+}
+
+type countingWriter struct {
+	writer io.Writer
+	count  int64
+}
+
+func (writer *countingWriter) Write(data []byte) (int, error) {
+	written, err := writer.writer.Write(data)
+	writer.count += int64(written)
+	return written, err
+}
+
+// Writes the archive of an export to w
+func writeDataExport(ctx context.Context, w io.Writer, export DataExport, org *Org, user User) ([]ResourceCount, error) {
+	archive := &exportArchive{
+		zipWriter: zip.NewWriter(w),
+		counts:    []ResourceCount{},
+	}
+
+	if export.Type == "user" {
+		subject, err := GetUser(ctx, export.SubjectId)
+		if err != nil {
+			return archive.counts, errors.New("Failed getting user")
+		}
+
+		addUserExport(ctx, archive, org, subject, user)
+	} else {
+		addOrgExport(ctx, archive, org, user)
+	}
+
+	archive.add("export", export, 1)
+	return archive.counts, archive.zipWriter.Close()
+}
+
+func storeDataExport(ctx context.Context, export DataExport, org *Org, user User) (string, []ResourceCount, error) {
+	file, err := createDataExportFile(ctx, export)
+	if err != nil {
+		return "", []ResourceCount{}, err
+	}
+
+	writer, err := openDataExportWriter(ctx, file)
+	if err != nil {
+		eraseFile(ctx, *file)
+		return "", []ResourceCount{}, err
+	}
+
+	counter := &countingWriter{writer: writer}
+	counts, err := writeDataExport(ctx, counter, export, org, user)
+	closeErr := writer.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		eraseFile(ctx, *file)
+		return "", counts, err
+	}
+
+	file.Status = "export"
+	file.FileSize = counter.count
+	file.UpdatedAt = time.Now().Unix()
+	err = SetFile(ctx, *file)
+	if err != nil {
+		eraseFile(ctx, *file)
+		return "", counts, err
+	}
+
+	return file.Id, counts, nil
+}
+
+func runDataExport(ctx context.Context, export DataExport, user User) {
+	org, err := GetOrg(ctx, export.OrgId)
+	if err != nil {
+		export.Status = "failed"
+		export.Reason = "Failed getting org"
+	} else {
+		export.FileId, export.Counts, err = storeDataExport(ctx, export, org, user)
+		export.Status = "finished"
+		export.Expires = time.Now().AddDate(0, 0, dataExportExpiryDays).Unix()
+		if err != nil {
+			log.Printf("[ERROR] Failed data export %s of %s %s: %s", export.Id, export.Type, export.SubjectId, err)
+			export.Status = "failed"
+			export.Reason = err.Error()
+			export.Expires = 0
+		}
+	}
+
+	export.Completed = time.Now().Unix()
+	err = SetDataExport(ctx, export)
+	if err != nil {
+		log.Printf("[ERROR] Failed saving data export %s: %s", export.Id, err)
+	}
+
+	log.Printf("[AUDIT] Data export %s of %s %s in org %s is %s", export.Id, export.Type, export.SubjectId, export.OrgId, export.Status)
+}
+
+func isDataExportExpired(export DataExport, now int64) bool {
+	return export.Status == "finished" && export.Expires > 0 && export.Expires <= now
+}
+
+// Deletes the archives of expired exports. The export itself is kept as a
+// record of what was exported.
+func CleanupDataExports(ctx context.Context, orgId string) error {
+	exports, err := GetDataExports(ctx, orgId, maxDataExports)
+	if err != nil {
+		return err
+	}
+
+	timeNow := time.Now().Unix()
+	for _, export := range exports {
+		if !isDataExportExpired(export, timeNow) {
+			continue
+		}
+
+		if len(export.FileId) > 0 {
+			file, err := GetFile(ctx, export.FileId)
+			if err == nil && file.OrgId == export.OrgId && file.Status == "export" {
+				err = eraseFile(ctx, *file)
+				if err != nil {
+					log.Printf("[WARNING] Failed deleting file of expired data export %s: %s", export.Id, err)
+					continue
+				}
+			}
+		}
+
+		export.Status = "expired"
+		export.FileId = ""
+		err = SetDataExport(ctx, export)
+		if err != nil {
+			log.Printf("[WARNING] Failed marking data export %s as expired: %s", export.Id, err)
+			continue
+		}
+
+		log.Printf("[AUDIT] Deleted the archive of expired data export %s in org %s", export.Id, orgId)
+	}
+
+	return nil
+}
+
+// Expired exports are cleaned up at most once a day per org
+func triggerDataExportCleanup(ctx context.Context, orgId string) {
+	cleanupKey := fmt.Sprintf("data_export_cleanup_%s", orgId)
+	if _, err := GetCache(ctx, cleanupKey); err != nil {
+		SetCache(ctx, cleanupKey, []byte("1"), 60*24)
+		go CleanupDataExports(context.Background(), orgId)
+	}
+}
+
+// Starts an export of the active org, or of one of its users with
+// {"type": "user", "user_id": ""}. Users can always export themselves.
+func HandleCreateDataExport(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in create data export: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		log.Printf("[WARNING] Failed reading body in create data export: %s", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	var exportRequest struct {
+		Type   string `json:"type"`
+		UserId string `json:"user_id"`
+	}
+
+	if len(body) > 0 {
+		err = json.Unmarshal(body, &exportRequest)
+		if err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(`{"success": false, "reason": "Failed parsing export request"}`))
+			return
+		}
+	}
+
+	if len(exportRequest.Type) == 0 {
+		exportRequest.Type = "org"
+	}
+
+	if exportRequest.Type != "org" && exportRequest.Type != "user" {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Type has to be org or user"}`))
+		return
+	}
+
+	isAdmin := isOrgMember(user) && Authorize(user, "org:manage", "") == nil
+	subjectId := user.ActiveOrg.Id
+	ctx := GetContext(request)
+	if exportRequest.Type == "user" {
+		subjectId = exportRequest.UserId
+		if len(subjectId) == 0 {
+			subjectId = user.Id
+		}
+
+		subject, err := GetUser(ctx, subjectId)
+		if err != nil || !ArrayContains(subject.Orgs, user.ActiveOrg.Id) {
+			resp.WriteHeader(404)
+			resp.Write([]byte(`{"success": false, "reason": "User not found"}`))
+			return
+		}
+	}
+
+	if !isAdmin && !(exportRequest.Type == "user" && subjectId == user.Id) {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "You don't have access to export this data"}`))
+		return
+	}
+
+	export := DataExport{
+		Id:          uuid.NewV4().String(),
+		OrgId:       user.ActiveOrg.Id,
+		Type:        exportRequest.Type,
+		SubjectId:   subjectId,
+		Status:      "running",
+		Counts:      []ResourceCount{},
+		RequestedBy: user.Id,
+		Created:     time.Now().Unix(),
+	}
+
+	err = SetDataExport(ctx, export)
+	if err != nil {
+		log.Printf("[ERROR] Failed saving data export for org %s: %s", user.ActiveOrg.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	go runDataExport(context.Background(), export, user)
+	triggerDataExportCleanup(ctx, user.ActiveOrg.Id)
+
+	log.Printf("[AUDIT] User %s (%s) started data export %s of %s %s", user.Username, user.Id, export.Id, export.Type, subjectId)
+	CreateAuditEvent(ctx, request, user, user.ActiveOrg.Id, "data.export", export.Type, subjectId, nil, nil)
+	resp.WriteHeader(200)
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "id": "%s"}`, export.Id)))
+}
+
+// Admins see every export of the org, other users only their own
+func HandleGetDataExports(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in get data exports: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	allExports, err := GetDataExports(ctx, user.ActiveOrg.Id, maxDataExports)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting data exports for org %s: %s", user.ActiveOrg.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed getting exports"}`))
+		return
+	}
+
+	triggerDataExportCleanup(ctx, user.ActiveOrg.Id)
+
+	isAdmin := isOrgMember(user) && Authorize(user, "org:manage", "") == nil
+	exports := []DataExport{}
+	timeNow := time.Now().Unix()
+	for _, export := range allExports {
+		if isDataExportExpired(export, timeNow) {
+			export.Status = "expired"
+			export.FileId = ""
+		}
+
+		if isAdmin || export.RequestedBy == user.Id {
+			exports = append(exports, export)
+		}
+	}
+
+	newjson, err := json.Marshal(struct {
+		Success bool         `json:"success"`
+		Exports []DataExport `json:"exports"`
+	}{
+		Success: true,
+		Exports: exports,
+	})
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+func HandleDownloadDataExport(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in download data export: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	location := strings.Split(strings.Split(request.URL.String(), "?")[0], "/")
+	if len(location) <= 5 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Export ID required"}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	export, err := GetDataExport(ctx, location[5])
+	isAdmin := isOrgMember(user) && Authorize(user, "org:manage", "") == nil
+	if err != nil || export.OrgId != user.ActiveOrg.Id || (!isAdmin && export.RequestedBy != user.Id) {
+		resp.WriteHeader(404)
+		resp.Write([]byte(`{"success": false, "reason": "Export not found"}`))
+		return
+	}
+
+	if isDataExportExpired(*export, time.Now().Unix()) {
+		resp.WriteHeader(410)
+		resp.Write([]byte(`{"success": false, "reason": "The export has expired"}`))
+		return
+	}
+
+	if export.Status != "finished" || len(export.FileId) == 0 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "The export is %s"}`, export.Status)))
+		return
+	}
+
+	file, err := GetFile(ctx, export.FileId)
+	if err != nil || file.OrgId != export.OrgId || file.Status != "export" {
+		resp.WriteHeader(404)
+		resp.Write([]byte(`{"success": false, "reason": "The export file doesn't exist anymore"}`))
+		return
+	}
+
+	reader, err := openDataExportReader(ctx, file)
+	if err != nil {
+		log.Printf("[ERROR] Failed reading data export %s: %s", export.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed reading export"}`))
+		return
+	}
+
+	defer reader.Close()
+
+	log.Printf("[AUDIT] User %s (%s) downloaded data export %s", user.Username, user.Id, export.Id)
+	CreateAuditEvent(ctx, request, user, user.ActiveOrg.Id, "data.export_download", export.Type, export.SubjectId, nil, nil)
+	resp.Header().Set("Content-Type", "application/zip")
+	resp.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", file.Filename))
+	if file.FileSize > 0 {
+		resp.Header().Set("Content-Length", strconv.FormatInt(file.FileSize, 10))
+	}
+
+	resp.WriteHeader(200)
+	_, err = io.Copy(resp, reader)
+	if err != nil {
+		log.Printf("[WARNING] Failed sending data export %s: %s", export.Id, err)
+	}
+}
+
+func getErasedCount(resourceType string, erased, failed []string) ResourceCount {
+	return ResourceCount{
+		ResourceType: resourceType,
+		Count:        len(erased),
+		Ids:          erased,
+		Failed:       failed,
+	}
+}
+
+// Removes the stored content of a file as well as the file itself
+func eraseFile(ctx context.Context, file File) error {
+	if file.Status != "deleted" {
+		if project.Environment == "cloud" || file.StorageArea == "google_storage" {
+			err := project.StorageClient.Bucket(orgFileBucket).Object(file.DownloadPath).Delete(ctx)
+			if err != nil {
+				log.Printf("[WARNING] Failed deleting file %s from storage: %s", file.Id, err)
+			}
+		} else if fileExists(file.DownloadPath) {
+			err := os.Remove(file.DownloadPath)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	DeleteCache(ctx, fmt.Sprintf("Files_%s", file.OrgId))
+	return DeleteKey(ctx, "files", file.Id)
+}
+
+// Erases what an org owns besides workflows, which have to be deleted
+// before the org can be
+func eraseOrgData(ctx context.Context, org *Org) []ResourceCount {
+	counts := []ResourceCount{}
+
+	erased, failed := []string{}, []string{}
+	files, err := GetAllFiles(ctx, org.Id, "")
+	if err != nil && len(files) == 0 {
+		log.Printf("[WARNING] Failed getting files to erase in org %s: %s", org.Id, err)
+	}
+
+	for _, file := range files {
+		if file.OrgId != org.Id {
+			continue
+		}
+
+		if eraseFile(ctx, file) != nil {
+			failed = append(failed, file.Id)
+		} else {
+			erased = append(erased, file.Id)
+		}
+	}
+
+	counts = append(counts, getErasedCount("files", erased, failed))
+
+	erased, failed = []string{}, []string{}
+	notifications, err := GetOrgNotifications(ctx, org.Id)
+	if err != nil && len(notifications) == 0 {
+		log.Printf("[WARNING] Failed getting notifications to erase in org %s: %s", org.Id, err)
+	}
+
+	for _, notification := range notifications {
+		if DeleteKey(ctx, "notifications", notification.Id) != nil {
+			failed = append(failed, notification.Id)
+		} else {
+			erased = append(erased, notification.Id)
+		}
+	}
+
+	DeleteCache(ctx, fmt.Sprintf("notifications_%s", org.Id))
+	counts = append(counts, getErasedCount("notifications", erased, failed))
+
+	erased, failed = []string{}, []string{}
+	for _, cacheKey := range getOrgCacheKeys(ctx, org.Id) {
+		if DeleteKey(ctx, "org_cache", getCacheKeyId(cacheKey)) != nil {
+			failed = append(failed, cacheKey.Key)
+		} else {
+			erased = append(erased, cacheKey.Key)
+		}
+	}
+
+	counts = append(counts, getErasedCount("cache_keys", erased, failed))
+
+	erased, failed = []string{}, []string{}
+	auths, err := GetAllWorkflowAppAuth(ctx, org.Id)
+	if err != nil && len(auths) == 0 {
+		log.Printf("[WARNING] Failed getting app auth to erase in org %s: %s", org.Id, err)
+	}
+
+	for _, auth := range auths {
+		if auth.OrgId != org.Id {
+			continue
+		}
+
+		if DeleteKey(ctx, "workflowappauth", auth.Id) != nil {
+			failed = append(failed, auth.Id)
+		} else {
+			erased = append(erased, auth.Id)
+		}
+	}
+
+	DeleteCache(ctx, fmt.Sprintf("workflowappauth_%s", org.Id))
+	counts = append(counts, getErasedCount("app_auth", erased, failed))
+
+	erased, failed = []string{}, []string{}
+	apiKeys, err := searchUserApiKeys(ctx, "org_id", org.Id)
+	if err != nil && len(apiKeys) == 0 {
+		log.Printf("[WARNING] Failed getting API keys to erase in org %s: %s", org.Id, err)
+	}
+
+	for _, apiKey := range apiKeys {
+		if DeleteUserApiKey(ctx, apiKey) != nil {
+			failed = append(failed, apiKey.Id)
+		} else {
+			erased = append(erased, apiKey.Id)
+		}
+	}
+
+	counts = append(counts, getErasedCount("api_keys", erased, failed))
+	return counts
+}
+
+// Erases what is stored about a user outside the user itself
+func eraseUserData(ctx context.Context, user *User) []ResourceCount {
+	counts := []ResourceCount{}
+
+	erased, failed := []string{}, []string{}
+	apiKeys, err := GetUserApiKeys(ctx, user.Id)
+	if err != nil && len(apiKeys) == 0 {
+		log.Printf("[WARNING] Failed getting API keys to erase for user %s: %s", user.Id, err)
+	}
+
+	for _, apiKey := range apiKeys {
+		if DeleteUserApiKey(ctx, apiKey) != nil {
+			failed = append(failed, apiKey.Id)
+		} else {
+			erased = append(erased, apiKey.Id)
+		}
+	}
+
+	counts = append(counts, getErasedCount("api_keys", erased, failed))
+
+	// Sessions are listed by the hash, never the token
+	erased, failed = []string{}, []string{}
+	sessions, err := GetUserSessions(ctx, user.Id)
+	if err != nil && len(sessions) == 0 {
+		log.Printf("[WARNING] Failed getting sessions to erase for user %s: %s", user.Id, err)
+	}
+
+	for _, session := range sessions {
+		if DeleteSession(ctx, session.Session) != nil {
+			failed = append(failed, getSessionId(session.Session))
+		} else {
+			erased = append(erased, getSessionId(session.Session))
+		}
+	}
+
+	counts = append(counts, getErasedCount("sessions", erased, failed))
+
+	erased, failed = []string{}, []string{}
+	notifications, err := GetUserNotifications(ctx, user.Id)
+	if err != nil && len(notifications) == 0 {
+		log.Printf("[WARNING] Failed getting notifications to erase for user %s: %s", user.Id, err)
+	}
+
+	for _, notification := range notifications {
+		if notification.UserId != user.Id {
+			continue
+		}
+
+		if DeleteKey(ctx, "notifications", notification.Id) != nil {
+			failed = append(failed, notification.Id)
+		} else {
+			erased = append(erased, notification.Id)
+		}
+	}
+
+	DeleteCache(ctx, fmt.Sprintf("notifications_%s", user.Id))
+	counts = append(counts, getErasedCount("notifications", erased, failed))
+	return counts
+}
+
+// Audit events outlive deletions until they expire
+func getRetainedAuditEvents(ctx context.Context, org *Org, actorId string) ResourceCount {
+	events, err := GetAuditEvents(ctx, org.Id, AuditEventSearch{ActorId: actorId, Limit: maxAuditExportEvents})
+	if err != nil {
+		log.Printf("[WARNING] Failed counting audit events of org %s: %s", org.Id, err)
+	}
+
+	return ResourceCount{
+		ResourceType: "audit_events",
+		Count:        len(events),
+		Reason:       fmt.Sprintf("Kept for the audit retention period of %d days", getAuditRetentionDays(*org)),
+	}
+}
+
+// HMAC of the report with the server's encryption modifier, so reports
+// can't be changed in the database without it showing
+func getDeletionReportChecksum(report DeletionReport) (string, error) {
+	modifier := getEncryptionModifier(report.KeyVersion)
+	if len(modifier) == 0 {
+		return "", errors.New(fmt.Sprintf("No encryption modifier set for key version %d", report.KeyVersion))
+	}
+
+	report.Checksum = ""
+	report.Verified = false
+	data, err := json.Marshal(report)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, []byte(modifier))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func verifyDeletionReport(report DeletionReport) bool {
+	if len(report.Checksum) == 0 {
+		return false
+	}
+
+	checksum, err := getDeletionReportChecksum(report)
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal([]byte(checksum), []byte(report.Checksum))
+}
+
+// Saves a report of a deletion. Returns the ID of the report
+func createDeletionReport(ctx context.Context, user User, orgId, reportType, subjectId, subjectName string, erased, retained []ResourceCount) string {
+	report := DeletionReport{
+		Id:          uuid.NewV4().String(),
+		OrgId:       orgId,
+		Type:        reportType,
+		SubjectId:   subjectId,
+		SubjectName: subjectName,
+		DeletedBy:   user.Id,
+		Erased:      erased,
+		Retained:    retained,
+		Timestamp:   time.Now().Unix(),
+		KeyVersion:  getEncryptionKeyVersion(),
+	}
+
+	checksum, err := getDeletionReportChecksum(report)
+	if err != nil {
+		log.Printf("[WARNING] Failed signing deletion report for %s %s: %s", reportType, subjectId, err)
+	}
+
+	report.Checksum = checksum
+	err = SetDeletionReport(ctx, report)
+	if err != nil {
+		log.Printf("[ERROR] Failed saving deletion report for %s %s: %s", reportType, subjectId, err)
+		return ""
+	}
+
+	log.Printf("[AUDIT] Saved deletion report %s for %s %s in org %s", report.Id, reportType, subjectId, orgId)
+	return report.Id
+}
+
+func HandleGetDeletionReports(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in get deletion reports: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if !isOrgMember(user) || Authorize(user, "org:manage", "") != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "You don't have access to deletion reports"}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	reports, err := GetDeletionReports(ctx, user.ActiveOrg.Id, maxDeletionReports)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting deletion reports for org %s: %s", user.ActiveOrg.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed getting deletion reports"}`))
+		return
+	}
+
+	for reportIndex := range reports {
+		reports[reportIndex].Verified = verifyDeletionReport(reports[reportIndex])
+	}
+
+	newjson, err := json.Marshal(struct {
+		Success bool             `json:"success"`
+		Reports []DeletionReport `json:"reports"`
+	}{
+		Success: true,
+		Reports: reports,
+	})
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
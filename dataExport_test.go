@@ -0,0 +1,101 @@
+package shuffle
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestGetExportExecution(t *testing.T) {
+	execution := getExportExecution(WorkflowExecution{
+		ExecutionId:   "execution",
+		Authorization: "execution-token",
+		Results:       []ActionResult{{Authorization: "result-token", Result: "result"}},
+	})
+
+	if len(execution.Authorization) > 0 || len(execution.Results[0].Authorization) > 0 {
+		t.Errorf("Exported execution kept its authorization: %#v", execution)
+	}
+
+	if execution.Results[0].Result != "result" {
+		t.Errorf("Exported execution lost its results")
+	}
+}
+
+func TestIsDataExportExpired(t *testing.T) {
+	now := time.Now().Unix()
+	for _, testCase := range []struct {
+		export   DataExport
+		expected bool
+	}{
+		{DataExport{Status: "finished", Expires: now - 1}, true},
+		{DataExport{Status: "finished", Expires: now + 3600}, false},
+		{DataExport{Status: "finished"}, false},
+		{DataExport{Status: "failed", Expires: now - 1}, false},
+		{DataExport{Status: "expired", Expires: now - 1}, false},
+	} {
+		if isDataExportExpired(testCase.export, now) != testCase.expected {
+			t.Errorf("isDataExportExpired(%#v) = %t", testCase.export, !testCase.expected)
+		}
+	}
+}
+
+func TestCountingWriter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	writer := &countingWriter{writer: buf}
+	writer.Write([]byte("abc"))
+	writer.Write([]byte("de"))
+	if writer.count != 5 || buf.String() != "abcde" {
+		t.Errorf("countingWriter = %d, %s; expected 5, abcde", writer.count, buf.String())
+	}
+}
+
+func TestDeletionReportChecksum(t *testing.T) {
+	t.Setenv("SHUFFLE_ENCRYPTION_MODIFIER", "deletion-report-test")
+	report := DeletionReport{
+		Id:         "report",
+		OrgId:      "org",
+		Type:       "user",
+		SubjectId:  "user",
+		Erased:     []ResourceCount{{ResourceType: "workflows", Count: 2}},
+		Timestamp:  time.Now().Unix(),
+		KeyVersion: 1,
+	}
+
+	checksum, err := getDeletionReportChecksum(report)
+	if err != nil {
+		t.Fatalf("Failed signing deletion report: %s", err)
+	}
+
+	report.Checksum = checksum
+	if !verifyDeletionReport(report) {
+		t.Errorf("Signed deletion report wasn't verified")
+	}
+
+	// Verified is only set in responses, and isn't signed
+	report.Verified = true
+	if !verifyDeletionReport(report) {
+		t.Errorf("Deletion report with the verified flag set wasn't verified")
+	}
+
+	tampered := report
+	tampered.Erased = []ResourceCount{{ResourceType: "workflows", Count: 3}}
+	if verifyDeletionReport(tampered) {
+		t.Errorf("Changed deletion report was verified")
+	}
+
+	// A plain hash can be recomputed by anyone with database access. The HMAC can't.
+	t.Setenv("SHUFFLE_ENCRYPTION_MODIFIER", "another-server")
+	if verifyDeletionReport(report) {
+		t.Errorf("Deletion report was verified with another key")
+	}
+
+	t.Setenv("SHUFFLE_ENCRYPTION_MODIFIER", "")
+	if _, err := getDeletionReportChecksum(report); err == nil {
+		t.Errorf("Deletion report was signed without a key")
+	}
+
+	if verifyDeletionReport(DeletionReport{Id: "unsigned"}) {
+		t.Errorf("Deletion report without a checksum was verified")
+	}
+}
@@ -32,6 +32,8 @@ import (
 	//"github.com/frikky/kin-openapi/openapi3"
 	"github.com/patrickmn/go-cache"
 	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
 
 	"cloud.google.com/go/storage"
 	gomemcache "github.com/bradfitz/gomemcache/memcache"
@@ -40,6 +42,8 @@ import (
 	//opensearch "github.com/shuffle/opensearch-go"
 	opensearch "github.com/opensearch-project/opensearch-go"
 	"github.com/opensearch-project/opensearch-go/v2/opensearchapi"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var requestCache = cache.New(60*time.Minute, 60*time.Minute)
@@ -303,7 +307,7 @@ func HandleIncrement(dataType string, orgStatistics *ExecutionInfo, increment ui
 		for index, AlertThreshold := range org.Billing.AlertThreshold {
 			if int64(AlertThreshold.Count) < orgStatistics.MonthlyAppExecutions && AlertThreshold.Email_send == false {
 				for _, user := range org.Users {
-					if user.Role == "admin" {
+					if hasOrgPermission(user, org.Id, "org:manage") {
 						var BccAddress []string
 						if int64(AlertThreshold.Count) >= 5000 || int64(AlertThreshold.Count) >= 10000 && AlertThreshold.Email_send == false {
 							BccAddress = []string{"support@shuffler.io", "jay@shuffler.io"}
@@ -949,6 +953,12 @@ func DeleteCache(ctx context.Context, name string) error {
 
 // Cache handlers
 func GetCache(ctx context.Context, name string) (interface{}, error) {
+	value, err := getCacheValue(ctx, name)
+	observeCacheRequest(err == nil)
+	return value, err
+}
+
+func getCacheValue(ctx context.Context, name string) (interface{}, error) {
 	if len(name) == 0 {
 		log.Printf("[ERROR] No name provided for cache")
 		return "", nil
@@ -1178,9 +1188,68 @@ func SetCache(ctx context.Context, name string, data []byte, expiration int32) e
 	return nil
 }
 
+// Sets a key in cache only if it doesn't exist yet, e.g. for locks shared
+// between every instance using the same cache. Expiration is in seconds.
+func AddCache(ctx context.Context, name string, data []byte, expiration int32) error {
+	if len(name) == 0 {
+		return errors.New("No name provided for cache")
+	}
+
+	name = strings.Replace(name, " ", "_", -1)
+	if len(memcached) > 0 {
+		return mc.Add(&gomemcache.Item{
+			Key:        name,
+			Value:      data,
+			Expiration: expiration,
+		})
+	}
+
+	return requestCache.Add(name, data, time.Second*time.Duration(expiration))
+}
+
+// Atomically increments a counter shared between every instance using
+// the same cache, and returns the new value. Expiration is in minutes.
+func IncrementCacheCounter(ctx context.Context, name string, expiration int32) (int64, error) {
+	name = strings.Replace(name, " ", "_", -1)
+	if len(memcached) > 0 {
+		// Fails if it already exists, which is fine
+		mc.Add(&gomemcache.Item{
+			Key:        name,
+			Value:      []byte("0"),
+			Expiration: expiration * 60,
+		})
+
+		value, err := mc.Increment(name, 1)
+		return int64(value), err
+	}
+
+	requestCache.Add(name, int64(0), time.Minute*time.Duration(expiration))
+	return requestCache.IncrementInt64(name, 1)
+}
+
+// Reads a counter set by IncrementCacheCounter. Returns 0 if it doesn't exist.
+func GetCacheCounter(ctx context.Context, name string) int64 {
+	cache, err := GetCache(ctx, name)
+	if err != nil {
+		return 0
+	}
+
+	switch value := cache.(type) {
+	case int64:
+		return value
+	case []uint8:
+		parsed, err := strconv.ParseInt(strings.TrimSpace(string(value)), 10, 64)
+		if err == nil {
+			return parsed
+		}
+	}
+
+	return 0
+}
+
 func GetDatastoreClient(ctx context.Context, projectID string) (datastore.Client, error) {
 	//client, err := datastore.NewClient(ctx, projectID, option.WithCredentialsFile(test"))
-	client, err := datastore.NewClient(ctx, projectID)
+	client, err := datastore.NewClient(ctx, projectID, option.WithGRPCDialOption(grpc.WithUnaryInterceptor(observeDatastoreRequest)))
 	//client, err := datastore.NewClient(ctx, projectID, option.WithCredentialsFile("test"))
 	if err != nil {
 		return datastore.Client{}, err
@@ -1283,6 +1352,11 @@ func SetWorkflowExecution(ctx context.Context, workflowExecution WorkflowExecuti
 		dbSave = true
 	}
 
+	recordExecutionStreamEvents(ctx, workflowExecution)
+	recordExecutionSpan(ctx, workflowExecution)
+	observeExecutionFinished(workflowExecution)
+	persistExecutionLogs(ctx, workflowExecution)
+
 	cacheKey := fmt.Sprintf("%s_%s", nameKey, workflowExecution.ExecutionId)
 	executionData, err := json.Marshal(workflowExecution)
 	if err == nil {
@@ -3397,15 +3471,8 @@ func GetAllWorkflowsByQuery(ctx context.Context, user User, maxAmount int, curso
 	var err error
 	limit := 30
 
-	if user.Role == "org-reader" {
-		log.Printf("[DEBUG] Giving org-reader %s (%s) access to all workflows in their active org.", user.Username, user.Id)
-		user.Role = "admin"
-	}
-
-	if user.Role == "user" {
-		log.Printf("[DEBUG] Giving org-user %s (%s) access to all workflows in their active org.", user.Username, user.Id)
-		user.Role = "admin"
-	}
+	// Anyone who can read workflows gets all of them in their active org
+	orgAccess := Authorize(user, "workflow:read", "") == nil
 
 	// Cache
 	if maxAmount == 0 || maxAmount > 250 {
@@ -3515,7 +3582,7 @@ func GetAllWorkflowsByQuery(ctx context.Context, user User, maxAmount int, curso
 			}
 		}
 
-		if user.Role == "admin" {
+		if orgAccess {
 			var buf bytes.Buffer
 			query = map[string]interface{}{
 				"size": maxAmount,
@@ -3873,6 +3940,7 @@ func GetOrgByCreatorId(ctx context.Context, id string) (*Org, error) {
 	newUsers := []User{}
 	for _, user := range curOrg.Users {
 		user.Password = ""
+		user.PasswordHistory = []string{}
 		user.Session = ""
 		user.ResetReference = ""
 		user.PrivateApps = []WorkflowApp{}
@@ -4025,6 +4093,7 @@ func GetOrg(ctx context.Context, id string) (*Org, error) {
 	newUsers := []User{}
 	for _, user := range curOrg.Users {
 		user.Password = ""
+		user.PasswordHistory = []string{}
 		user.Session = ""
 		user.ResetReference = ""
 		user.PrivateApps = []WorkflowApp{}
@@ -4312,7 +4381,7 @@ func GetTutorials(ctx context.Context, org Org, updateOrg bool) *Org {
 	selectedUser := User{}
 	for _, inputUser := range org.Users {
 		user, err := GetUser(ctx, inputUser.Id)
-		if user.Role == "admin" && user.ActiveOrg.Id == org.Id {
+		if err == nil && user.ActiveOrg.Id == org.Id && hasOrgPermission(*user, org.Id, "org:manage") {
 			if err == nil {
 				selectedUser = *user
 				break
@@ -4527,6 +4596,7 @@ func SetOrg(ctx context.Context, data Org, id string) error {
 	}
 
 	data.Id = id
+	data.SamlConfig = encryptSamlPrivateKey(id, data.SamlConfig)
 	if len(data.Name) == 0 {
 		data.Name = "tmp"
 
@@ -4547,6 +4617,7 @@ func SetOrg(ctx context.Context, data Org, id string) error {
 	newUsers := []User{}
 	for _, user := range data.Users {
 		user.Password = ""
+		user.PasswordHistory = []string{}
 		user.Session = ""
 		user.PrivateApps = []WorkflowApp{}
 		user.MFA = MFAInfo{}
@@ -4606,6 +4677,7 @@ func SetOrg(ctx context.Context, data Org, id string) error {
 		newUsers := []User{}
 		for _, user := range data.Users {
 			user.Password = ""
+			user.PasswordHistory = []string{}
 			user.Session = ""
 			user.ResetReference = ""
 			user.PrivateApps = []WorkflowApp{}
@@ -4681,7 +4753,7 @@ func GetSession(ctx context.Context, thissession string) (*Session, error) {
 	}
 
 	if project.CacheDb {
-		data, err := json.Marshal(thissession)
+		data, err := json.Marshal(session)
 		if err != nil {
 			log.Printf("[WARNING] Failed marshalling session: %s", err)
 			return session, nil
@@ -4994,8 +5066,23 @@ func SetSession(ctx context.Context, user User, value string) error {
 		sessiondata.Username = strings.ToLower(user.Username)
 		sessiondata.Session = user.Session
 		sessiondata.Id = user.Id
+		sessiondata.Created = time.Now().Unix()
+		sessiondata.LastActivity = sessiondata.Created
 		nameKey = "sessions"
 
+		// Logins reusing a session keep its history
+		existing, err := GetSession(ctx, sessiondata.Session)
+		if err == nil && existing.UserId == sessiondata.UserId && existing.Created > 0 && existing.Created >= user.PasswordChanged {
+			sessiondata.Created = existing.Created
+			sessiondata.LastActivity = existing.LastActivity
+			sessiondata.IP = existing.IP
+			sessiondata.UserAgent = existing.UserAgent
+		}
+
+		if project.CacheDb {
+			DeleteCache(ctx, sessiondata.Session)
+		}
+
 		if project.DbType == "opensearch" {
 			data, err := json.Marshal(sessiondata)
 			if err != nil {
@@ -5609,7 +5696,7 @@ func DeleteUsersAccount(ctx context.Context, user *User) error {
 func getDatastoreClient(ctx context.Context, projectID string) (datastore.Client, error) {
 	// FIXME - this doesn't work
 	//client, err := datastore.NewClient(ctx, projectID, option.WithCredentialsFile(test"))
-	client, err := datastore.NewClient(ctx, projectID)
+	client, err := datastore.NewClient(ctx, projectID, option.WithGRPCDialOption(grpc.WithUnaryInterceptor(observeDatastoreRequest)))
 	//client, err := datastore.NewClient(ctx, projectID, option.WithCredentialsFile("test"))
 	if err != nil {
 		return datastore.Client{}, err
@@ -5637,6 +5724,7 @@ func fixUserOrg(ctx context.Context, user *User) *User {
 	innerUser.Limits = UserLimits{}
 	innerUser.Authentication = []UserAuth{}
 	innerUser.Password = ""
+	innerUser.PasswordHistory = []string{}
 	innerUser.Session = ""
 
 	// Might be vulnerable to timing attacks.
@@ -5784,13 +5872,7 @@ func GetAllWorkflowAppAuth(ctx context.Context, orgId string) ([]AppAuthenticati
 			// No recursion as parents can't have parents
 			parentAuths, err := GetAllWorkflowAppAuth(ctx, parentOrg.Id)
 			if err == nil {
-				for _, parentAuth := range parentAuths {
-					if !parentAuth.SuborgDistributed {
-						continue
-					}
-
-					allworkflowappAuths = append(allworkflowappAuths, parentAuth)
-				}
+				allworkflowappAuths = getInheritedAppAuth(allworkflowappAuths, parentAuths, getInheritanceMode(parentOrg, "app_auth"))
 			}
 		}
 	}
@@ -7114,6 +7196,21 @@ func SetWorkflowQueue(ctx context.Context, executionRequest ExecutionRequest, en
 	env = strings.ReplaceAll(env, " ", "-")
 	nameKey := fmt.Sprintf("workflowqueue-%s", env)
 
+	// Passes the trace on to Orborus and the worker
+	if len(executionRequest.TraceParent) == 0 && tracingEnabled() {
+		workflowExecution, err := GetWorkflowExecution(ctx, executionRequest.ExecutionId)
+		if err == nil {
+			executionRequest.TraceParent = workflowExecution.TraceParent
+		}
+	}
+
+	ctx, span := startChildSpan(ctx, "SetWorkflowQueue", executionRequest.TraceParent,
+		attribute.String("shuffle.execution_id", executionRequest.ExecutionId),
+		attribute.String("shuffle.environment", env),
+		attribute.Int64("shuffle.priority", executionRequest.Priority),
+	)
+	defer span.End()
+
 	if project.Environment == "cloud" {
 		//log.Printf("[DEBUG] Adding execution to queue: %s", nameKey)
 	}
@@ -7261,6 +7358,7 @@ func GetWorkflowQueue(ctx context.Context, id string, limit int) (ExecutionReque
 		}
 	}
 
+	observeQueueDepth(id, len(executions))
 	return ExecutionRequestWrapper{
 		Data: executions,
 	}, nil
@@ -8446,6 +8544,7 @@ func SetWorkflowAppAuthDatastore(ctx context.Context, workflowappauth AppAuthent
 			//log.Printf("[INFO] Encrypted authentication values as they weren't already encrypted")
 			workflowappauth.Fields = newFields
 			workflowappauth.Encrypted = true
+			workflowappauth.KeyVersion = getEncryptionKeyVersion()
 		}
 	}
 
@@ -9254,6 +9353,7 @@ func GetHook(ctx context.Context, hookId string) (*Hook, error) {
 
 func SetHook(ctx context.Context, hook Hook) error {
 	nameKey := "hooks"
+	hook = encryptHookSecret(hook)
 
 	// New struct, to not add body, author etc
 	hookData, err := json.Marshal(hook)
@@ -12089,6 +12189,7 @@ func GetEsConfig(defaultCreds bool) *opensearch.Client {
 		Password:      password,
 		MaxRetries:    5,
 		RetryOnStatus: []int{500, 502, 503, 504, 429, 403},
+		Logger:        opensearchMetricsLogger{},
 
 		// User Agent to work with Elasticsearch 8
 	}
@@ -13905,7 +14006,7 @@ func GetOrgAuth(ctx context.Context, session string) (User, error) {
 		}
 
 		for _, user := range org.Users {
-			if user.Role == "admin" {
+			if hasOrgPermission(user, org.Id, "org:manage") {
 				log.Printf("[DEBUG] Letting org auth token %#v impersonate admin user %s (%s) in org %s (%s)", session, user.Username, user.Id, org.Name, org.Id)
 				return user, nil
 			}
@@ -13915,3 +14016,1929 @@ func GetOrgAuth(ctx context.Context, session string) (User, error) {
 	// If found, return a sample admin user
 	return User{}, nil
 }
+
+func GetMaintenanceCalendar(ctx context.Context, id string) (*MaintenanceCalendar, error) {
+	nameKey := "maintenance_calendars"
+	cacheKey := fmt.Sprintf("%s_%s", nameKey, id)
+
+	calendar := &MaintenanceCalendar{}
+	if project.CacheDb {
+		cache, err := GetCache(ctx, cacheKey)
+		if err == nil {
+			cacheData := []byte(cache.([]uint8))
+			err = json.Unmarshal(cacheData, &calendar)
+			if err == nil && len(calendar.Id) > 0 {
+				return calendar, nil
+			}
+		}
+	}
+
+	if project.DbType == "opensearch" {
+		res, err := project.Es.Get(strings.ToLower(GetESIndexPrefix(nameKey)), id)
+		if err != nil {
+			log.Printf("[WARNING] Error for %s: %s", cacheKey, err)
+			return calendar, err
+		}
+
+		defer res.Body.Close()
+		if res.StatusCode == 404 {
+			return calendar, errors.New("Calendar doesn't exist")
+		}
+
+		respBody, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return calendar, err
+		}
+
+		wrapped := MaintenanceCalendarWrapper{}
+		err = json.Unmarshal(respBody, &wrapped)
+		if err != nil {
+			return calendar, err
+		}
+
+		calendar = &wrapped.Source
+	} else {
+		key := datastore.NameKey(nameKey, id, nil)
+		if err := project.Dbclient.Get(ctx, key, calendar); err != nil {
+			return calendar, err
+		}
+	}
+
+	if len(calendar.Id) == 0 {
+		return calendar, errors.New("Calendar doesn't exist")
+	}
+
+	if project.CacheDb {
+		data, err := json.Marshal(calendar)
+		if err != nil {
+			log.Printf("[WARNING] Failed marshalling calendar %s: %s", id, err)
+			return calendar, nil
+		}
+
+		err = SetCache(ctx, cacheKey, data, 30)
+		if err != nil {
+			log.Printf("[WARNING] Failed setting cache for calendar '%s': %s", cacheKey, err)
+		}
+	}
+
+	return calendar, nil
+}
+
+func SetMaintenanceCalendar(ctx context.Context, calendar MaintenanceCalendar) error {
+	nameKey := "maintenance_calendars"
+	timeNow := time.Now().Unix()
+	calendar.Edited = timeNow
+	if calendar.Created == 0 {
+		calendar.Created = timeNow
+	}
+
+	data, err := json.Marshal(calendar)
+	if err != nil {
+		log.Printf("[WARNING] Failed marshalling in set calendar: %s", err)
+		return err
+	}
+
+	if project.DbType == "opensearch" {
+		err = indexEs(ctx, nameKey, calendar.Id, data)
+		if err != nil {
+			return err
+		}
+	} else {
+		key := datastore.NameKey(nameKey, calendar.Id, nil)
+		if _, err := project.Dbclient.Put(ctx, key, &calendar); err != nil {
+			log.Printf("[WARNING] Error adding calendar %s: %s", calendar.Id, err)
+			return err
+		}
+	}
+
+	if project.CacheDb {
+		cacheKey := fmt.Sprintf("%s_%s", nameKey, calendar.Id)
+		err = SetCache(ctx, cacheKey, data, 30)
+		if err != nil {
+			log.Printf("[WARNING] Failed setting cache for calendar '%s': %s", cacheKey, err)
+		}
+
+		DeleteCache(ctx, fmt.Sprintf("%s_org_%s", nameKey, calendar.OrgId))
+	}
+
+	return nil
+}
+
+func GetMaintenanceCalendars(ctx context.Context, orgId string) ([]MaintenanceCalendar, error) {
+	nameKey := "maintenance_calendars"
+	cacheKey := fmt.Sprintf("%s_org_%s", nameKey, orgId)
+
+	calendars := []MaintenanceCalendar{}
+	if project.CacheDb {
+		cache, err := GetCache(ctx, cacheKey)
+		if err == nil {
+			cacheData := []byte(cache.([]uint8))
+			err = json.Unmarshal(cacheData, &calendars)
+			if err == nil {
+				return calendars, nil
+			}
+		}
+	}
+
+	if project.DbType == "opensearch" {
+		var buf bytes.Buffer
+		query := map[string]interface{}{
+			"from": 0,
+			"size": 1000,
+			"query": map[string]interface{}{
+				"match": map[string]interface{}{
+					"org_id": orgId,
+				},
+			},
+		}
+
+		if err := json.NewEncoder(&buf).Encode(query); err != nil {
+			log.Printf("[WARNING] Error encoding find calendar query: %s", err)
+			return calendars, err
+		}
+
+		res, err := project.Es.Search(
+			project.Es.Search.WithContext(ctx),
+			project.Es.Search.WithIndex(strings.ToLower(GetESIndexPrefix(nameKey))),
+			project.Es.Search.WithBody(&buf),
+			project.Es.Search.WithTrackTotalHits(true),
+		)
+		if err != nil {
+			log.Printf("[ERROR] Error getting response from Opensearch (get calendars): %s", err)
+			return calendars, err
+		}
+
+		defer res.Body.Close()
+		if res.StatusCode == 404 {
+			return calendars, nil
+		}
+
+		if res.IsError() {
+			var e map[string]interface{}
+			if err := json.NewDecoder(res.Body).Decode(&e); err != nil {
+				log.Printf("[WARNING] Error parsing the response body: %s", err)
+				return calendars, err
+			} else {
+				// Print the response status and error information.
+				log.Printf("[%s] %s: %s",
+					res.Status(),
+					e["error"].(map[string]interface{})["type"],
+					e["error"].(map[string]interface{})["reason"],
+				)
+			}
+		}
+
+		if res.StatusCode != 200 && res.StatusCode != 201 {
+			return calendars, errors.New(fmt.Sprintf("Bad statuscode: %d", res.StatusCode))
+		}
+
+		respBody, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return calendars, err
+		}
+
+		wrapped := MaintenanceCalendarSearchWrapper{}
+		err = json.Unmarshal(respBody, &wrapped)
+		if err != nil {
+			return calendars, err
+		}
+
+		for _, hit := range wrapped.Hits.Hits {
+			if hit.Source.OrgId != orgId {
+				continue
+			}
+
+			calendars = append(calendars, hit.Source)
+		}
+	} else {
+		q := datastore.NewQuery(nameKey).Filter("org_id =", orgId).Limit(1000)
+		_, err := project.Dbclient.GetAll(ctx, q, &calendars)
+		if err != nil && len(calendars) == 0 {
+			return calendars, err
+		}
+	}
+
+	if project.CacheDb {
+		data, err := json.Marshal(calendars)
+		if err != nil {
+			log.Printf("[WARNING] Failed marshalling calendar cache: %s", err)
+			return calendars, nil
+		}
+
+		err = SetCache(ctx, cacheKey, data, 30)
+		if err != nil {
+			log.Printf("[WARNING] Failed updating calendar cache: %s", err)
+		}
+	}
+
+	return calendars, nil
+}
+
+func SetSuppressedTrigger(ctx context.Context, suppressed SuppressedTrigger) error {
+	nameKey := "suppressed_triggers"
+	data, err := json.Marshal(suppressed)
+	if err != nil {
+		log.Printf("[WARNING] Failed marshalling in set suppressed trigger: %s", err)
+		return err
+	}
+
+	if project.DbType == "opensearch" {
+		err = indexEs(ctx, nameKey, suppressed.Id, data)
+		if err != nil {
+			return err
+		}
+	} else {
+		key := datastore.NameKey(nameKey, suppressed.Id, nil)
+		if _, err := project.Dbclient.Put(ctx, key, &suppressed); err != nil {
+			log.Printf("[WARNING] Error adding suppressed trigger %s: %s", suppressed.Id, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Status is optional. Empty orgId is only used by the queue release job.
+func GetSuppressedTriggers(ctx context.Context, orgId, status string, maxAmount int) ([]SuppressedTrigger, error) {
+	nameKey := "suppressed_triggers"
+	if maxAmount <= 0 || maxAmount > 1000 {
+		maxAmount = 1000
+	}
+
+	suppressed := []SuppressedTrigger{}
+	if project.DbType == "opensearch" {
+		must := []map[string]interface{}{}
+		if len(orgId) > 0 {
+			must = append(must, map[string]interface{}{
+				"match": map[string]interface{}{
+					"org_id": orgId,
+				},
+			})
+		}
+
+		if len(status) > 0 {
+			must = append(must, map[string]interface{}{
+				"match": map[string]interface{}{
+					"status": status,
+				},
+			})
+		}
+
+		var buf bytes.Buffer
+		query := map[string]interface{}{
+			"from": 0,
+			"size": maxAmount,
+			"sort": map[string]interface{}{
+				"created": map[string]interface{}{
+					"order": "desc",
+				},
+			},
+			"query": map[string]interface{}{
+				"bool": map[string]interface{}{
+					"must": must,
+				},
+			},
+		}
+
+		if err := json.NewEncoder(&buf).Encode(query); err != nil {
+			log.Printf("[WARNING] Error encoding suppressed trigger query: %s", err)
+			return suppressed, err
+		}
+
+		res, err := project.Es.Search(
+			project.Es.Search.WithContext(ctx),
+			project.Es.Search.WithIndex(strings.ToLower(GetESIndexPrefix(nameKey))),
+			project.Es.Search.WithBody(&buf),
+			project.Es.Search.WithTrackTotalHits(true),
+		)
+		if err != nil {
+			log.Printf("[ERROR] Error getting response from Opensearch (get suppressed triggers): %s", err)
+			return suppressed, err
+		}
+
+		defer res.Body.Close()
+		if res.StatusCode == 404 {
+			return suppressed, nil
+		}
+
+		if res.StatusCode != 200 && res.StatusCode != 201 {
+			return suppressed, errors.New(fmt.Sprintf("Bad statuscode: %d", res.StatusCode))
+		}
+
+		respBody, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return suppressed, err
+		}
+
+		wrapped := SuppressedTriggerSearchWrapper{}
+		err = json.Unmarshal(respBody, &wrapped)
+		if err != nil {
+			return suppressed, err
+		}
+
+		for _, hit := range wrapped.Hits.Hits {
+			suppressed = append(suppressed, hit.Source)
+		}
+	} else {
+		q := datastore.NewQuery(nameKey)
+		if len(orgId) > 0 {
+			q = q.Filter("org_id =", orgId)
+		}
+
+		if len(status) > 0 {
+			q = q.Filter("status =", status)
+		}
+
+		q = q.Limit(maxAmount)
+		_, err := project.Dbclient.GetAll(ctx, q, &suppressed)
+		if err != nil && len(suppressed) == 0 {
+			return suppressed, err
+		}
+
+		sort.Slice(suppressed, func(i, j int) bool {
+			return suppressed[i].Created > suppressed[j].Created
+		})
+	}
+
+	return suppressed, nil
+}
+
+func GetEventSubscription(ctx context.Context, id string) (*EventSubscription, error) {
+	nameKey := "event_subscriptions"
+	cacheKey := fmt.Sprintf("%s_%s", nameKey, id)
+
+	subscription := &EventSubscription{}
+	if project.CacheDb {
+		cache, err := GetCache(ctx, cacheKey)
+		if err == nil {
+			cacheData := []byte(cache.([]uint8))
+			err = json.Unmarshal(cacheData, &subscription)
+			if err == nil && len(subscription.Id) > 0 {
+				return subscription, nil
+			}
+		}
+	}
+
+	if project.DbType == "opensearch" {
+		res, err := project.Es.Get(strings.ToLower(GetESIndexPrefix(nameKey)), id)
+		if err != nil {
+			log.Printf("[WARNING] Error for %s: %s", cacheKey, err)
+			return subscription, err
+		}
+
+		defer res.Body.Close()
+		if res.StatusCode == 404 {
+			return subscription, errors.New("Subscription doesn't exist")
+		}
+
+		respBody, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return subscription, err
+		}
+
+		wrapped := EventSubscriptionWrapper{}
+		err = json.Unmarshal(respBody, &wrapped)
+		if err != nil {
+			return subscription, err
+		}
+
+		subscription = &wrapped.Source
+	} else {
+		key := datastore.NameKey(nameKey, id, nil)
+		if err := project.Dbclient.Get(ctx, key, subscription); err != nil {
+			return subscription, err
+		}
+	}
+
+	if len(subscription.Id) == 0 {
+		return subscription, errors.New("Subscription doesn't exist")
+	}
+
+	if project.CacheDb {
+		data, err := json.Marshal(subscription)
+		if err != nil {
+			log.Printf("[WARNING] Failed marshalling subscription %s: %s", id, err)
+			return subscription, nil
+		}
+
+		err = SetCache(ctx, cacheKey, data, 30)
+		if err != nil {
+			log.Printf("[WARNING] Failed setting cache for subscription '%s': %s", cacheKey, err)
+		}
+	}
+
+	return subscription, nil
+}
+
+func SetEventSubscription(ctx context.Context, subscription EventSubscription) error {
+	nameKey := "event_subscriptions"
+	timeNow := time.Now().Unix()
+	subscription.Edited = timeNow
+	if subscription.Created == 0 {
+		subscription.Created = timeNow
+	}
+
+	data, err := json.Marshal(subscription)
+	if err != nil {
+		log.Printf("[WARNING] Failed marshalling in set subscription: %s", err)
+		return err
+	}
+
+	if project.DbType == "opensearch" {
+		err = indexEs(ctx, nameKey, subscription.Id, data)
+		if err != nil {
+			return err
+		}
+	} else {
+		key := datastore.NameKey(nameKey, subscription.Id, nil)
+		if _, err := project.Dbclient.Put(ctx, key, &subscription); err != nil {
+			log.Printf("[WARNING] Error adding subscription %s: %s", subscription.Id, err)
+			return err
+		}
+	}
+
+	if project.CacheDb {
+		cacheKey := fmt.Sprintf("%s_%s", nameKey, subscription.Id)
+		err = SetCache(ctx, cacheKey, data, 30)
+		if err != nil {
+			log.Printf("[WARNING] Failed setting cache for subscription '%s': %s", cacheKey, err)
+		}
+
+		DeleteCache(ctx, fmt.Sprintf("%s_org_%s", nameKey, subscription.OrgId))
+	}
+
+	return nil
+}
+
+func GetEventSubscriptions(ctx context.Context, orgId string) ([]EventSubscription, error) {
+	nameKey := "event_subscriptions"
+	cacheKey := fmt.Sprintf("%s_org_%s", nameKey, orgId)
+
+	subscriptions := []EventSubscription{}
+	if project.CacheDb {
+		cache, err := GetCache(ctx, cacheKey)
+		if err == nil {
+			cacheData := []byte(cache.([]uint8))
+			err = json.Unmarshal(cacheData, &subscriptions)
+			if err == nil {
+				return subscriptions, nil
+			}
+		}
+	}
+
+	if project.DbType == "opensearch" {
+		var buf bytes.Buffer
+		query := map[string]interface{}{
+			"from": 0,
+			"size": 1000,
+			"query": map[string]interface{}{
+				"match": map[string]interface{}{
+					"org_id": orgId,
+				},
+			},
+		}
+
+		if err := json.NewEncoder(&buf).Encode(query); err != nil {
+			log.Printf("[WARNING] Error encoding find subscription query: %s", err)
+			return subscriptions, err
+		}
+
+		res, err := project.Es.Search(
+			project.Es.Search.WithContext(ctx),
+			project.Es.Search.WithIndex(strings.ToLower(GetESIndexPrefix(nameKey))),
+			project.Es.Search.WithBody(&buf),
+			project.Es.Search.WithTrackTotalHits(true),
+		)
+		if err != nil {
+			log.Printf("[ERROR] Error getting response from Opensearch (get subscriptions): %s", err)
+			return subscriptions, err
+		}
+
+		defer res.Body.Close()
+		if res.StatusCode == 404 {
+			return subscriptions, nil
+		}
+
+		if res.StatusCode != 200 && res.StatusCode != 201 {
+			return subscriptions, errors.New(fmt.Sprintf("Bad statuscode: %d", res.StatusCode))
+		}
+
+		respBody, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return subscriptions, err
+		}
+
+		wrapped := EventSubscriptionSearchWrapper{}
+		err = json.Unmarshal(respBody, &wrapped)
+		if err != nil {
+			return subscriptions, err
+		}
+
+		for _, hit := range wrapped.Hits.Hits {
+			if hit.Source.OrgId != orgId {
+				continue
+			}
+
+			subscriptions = append(subscriptions, hit.Source)
+		}
+	} else {
+		q := datastore.NewQuery(nameKey).Filter("org_id =", orgId).Limit(1000)
+		_, err := project.Dbclient.GetAll(ctx, q, &subscriptions)
+		if err != nil && len(subscriptions) == 0 {
+			return subscriptions, err
+		}
+	}
+
+	if project.CacheDb {
+		data, err := json.Marshal(subscriptions)
+		if err != nil {
+			log.Printf("[WARNING] Failed marshalling subscriptions for org %s: %s", orgId, err)
+			return subscriptions, nil
+		}
+
+		err = SetCache(ctx, cacheKey, data, 30)
+		if err != nil {
+			log.Printf("[WARNING] Failed setting cache for subscriptions '%s': %s", cacheKey, err)
+		}
+	}
+
+	return subscriptions, nil
+}
+
+func SetBusEvent(ctx context.Context, event BusEvent) error {
+	nameKey := "bus_events"
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("[WARNING] Failed marshalling in set bus event: %s", err)
+		return err
+	}
+
+	if project.DbType == "opensearch" {
+		err = indexEs(ctx, nameKey, event.Id, data)
+		if err != nil {
+			return err
+		}
+	} else {
+		key := datastore.NameKey(nameKey, event.Id, nil)
+		if _, err := project.Dbclient.Put(ctx, key, &event); err != nil {
+			log.Printf("[WARNING] Error adding bus event %s: %s", event.Id, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Topic is optional. Newest events first.
+func GetBusEvents(ctx context.Context, orgId, topic string, maxAmount int) ([]BusEvent, error) {
+	return getBusEvents(ctx, orgId, topic, 0, maxAmount)
+}
+
+// Events created before the timestamp. Used for retention.
+func GetBusEventsBefore(ctx context.Context, orgId string, before int64, maxAmount int) ([]BusEvent, error) {
+	return getBusEvents(ctx, orgId, "", before, maxAmount)
+}
+
+func getBusEvents(ctx context.Context, orgId, topic string, before int64, maxAmount int) ([]BusEvent, error) {
+	nameKey := "bus_events"
+	if maxAmount <= 0 || maxAmount > 1000 {
+		maxAmount = 1000
+	}
+
+	events := []BusEvent{}
+	if project.DbType == "opensearch" {
+		must := []map[string]interface{}{
+			map[string]interface{}{
+				"match": map[string]interface{}{
+					"org_id": orgId,
+				},
+			},
+		}
+
+		if len(topic) > 0 {
+			must = append(must, map[string]interface{}{
+				"match": map[string]interface{}{
+					"topic": topic,
+				},
+			})
+		}
+
+		if before > 0 {
+			must = append(must, map[string]interface{}{
+				"range": map[string]interface{}{
+					"created": map[string]interface{}{
+						"lt": before,
+					},
+				},
+			})
+		}
+
+		var buf bytes.Buffer
+		query := map[string]interface{}{
+			"from": 0,
+			"size": maxAmount,
+			"sort": map[string]interface{}{
+				"created": map[string]interface{}{
+					"order": "desc",
+				},
+			},
+			"query": map[string]interface{}{
+				"bool": map[string]interface{}{
+					"must": must,
+				},
+			},
+		}
+
+		if err := json.NewEncoder(&buf).Encode(query); err != nil {
+			log.Printf("[WARNING] Error encoding bus event query: %s", err)
+			return events, err
+		}
+
+		res, err := project.Es.Search(
+			project.Es.Search.WithContext(ctx),
+			project.Es.Search.WithIndex(strings.ToLower(GetESIndexPrefix(nameKey))),
+			project.Es.Search.WithBody(&buf),
+			project.Es.Search.WithTrackTotalHits(true),
+		)
+		if err != nil {
+			log.Printf("[ERROR] Error getting response from Opensearch (get bus events): %s", err)
+			return events, err
+		}
+
+		defer res.Body.Close()
+		if res.StatusCode == 404 {
+			return events, nil
+		}
+
+		if res.StatusCode != 200 && res.StatusCode != 201 {
+			return events, errors.New(fmt.Sprintf("Bad statuscode: %d", res.StatusCode))
+		}
+
+		respBody, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return events, err
+		}
+
+		wrapped := BusEventSearchWrapper{}
+		err = json.Unmarshal(respBody, &wrapped)
+		if err != nil {
+			return events, err
+		}
+
+		for _, hit := range wrapped.Hits.Hits {
+			if hit.Source.OrgId != orgId {
+				continue
+			}
+
+			events = append(events, hit.Source)
+		}
+	} else {
+		q := datastore.NewQuery(nameKey).Filter("org_id =", orgId)
+		if len(topic) > 0 {
+			q = q.Filter("topic =", topic)
+		}
+
+		if before > 0 {
+			q = q.Filter("created <", before)
+		}
+
+		q = q.Order("-created").Limit(maxAmount)
+		_, err := project.Dbclient.GetAll(ctx, q, &events)
+		if err != nil && len(events) == 0 {
+			return events, err
+		}
+	}
+
+	return events, nil
+}
+
+func GetExecutionLogs(ctx context.Context, executionId string, chunk int) (*ExecutionLogs, error) {
+	nameKey := "execution_logs"
+	id := fmt.Sprintf("%s_%d", executionId, chunk)
+	executionLogs := &ExecutionLogs{}
+	if project.DbType == "opensearch" {
+		res, err := project.Es.Get(strings.ToLower(GetESIndexPrefix(nameKey)), id)
+		if err != nil {
+			log.Printf("[WARNING] Error getting execution logs for %s: %s", executionId, err)
+			return executionLogs, err
+		}
+
+		defer res.Body.Close()
+		if res.StatusCode == 404 {
+			return executionLogs, errors.New("Execution logs don't exist")
+		}
+
+		respBody, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return executionLogs, err
+		}
+
+		wrapped := ExecutionLogsWrapper{}
+		err = json.Unmarshal(respBody, &wrapped)
+		if err != nil {
+			return executionLogs, err
+		}
+
+		executionLogs = &wrapped.Source
+	} else {
+		key := datastore.NameKey(nameKey, id, nil)
+		if err := project.Dbclient.Get(ctx, key, executionLogs); err != nil {
+			return executionLogs, err
+		}
+	}
+
+	return executionLogs, nil
+}
+
+func SetExecutionLogs(ctx context.Context, executionLogs ExecutionLogs) error {
+	nameKey := "execution_logs"
+	executionLogs.Edited = time.Now().Unix()
+	data, err := json.Marshal(executionLogs)
+	if err != nil {
+		log.Printf("[WARNING] Failed marshalling in set execution logs: %s", err)
+		return err
+	}
+
+	id := fmt.Sprintf("%s_%d", executionLogs.ExecutionId, executionLogs.Chunk)
+	if project.DbType == "opensearch" {
+		err = indexEs(ctx, nameKey, id, data)
+		if err != nil {
+			return err
+		}
+	} else {
+		key := datastore.NameKey(nameKey, id, nil)
+		if _, err := project.Dbclient.Put(ctx, key, &executionLogs); err != nil {
+			log.Printf("[WARNING] Error adding execution logs for %s: %s", executionLogs.ExecutionId, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func GetOrgRole(ctx context.Context, id string) (*OrgRole, error) {
+	nameKey := "org_roles"
+	cacheKey := fmt.Sprintf("%s_%s", nameKey, id)
+
+	role := &OrgRole{}
+	if project.CacheDb {
+		cache, err := GetCache(ctx, cacheKey)
+		if err == nil {
+			cacheData := []byte(cache.([]uint8))
+			err = json.Unmarshal(cacheData, &role)
+			if err == nil && len(role.Id) > 0 {
+				return role, nil
+			}
+		}
+	}
+
+	if project.DbType == "opensearch" {
+		res, err := project.Es.Get(strings.ToLower(GetESIndexPrefix(nameKey)), id)
+		if err != nil {
+			log.Printf("[WARNING] Error for %s: %s", cacheKey, err)
+			return role, err
+		}
+
+		defer res.Body.Close()
+		if res.StatusCode == 404 {
+			return role, errors.New("Role doesn't exist")
+		}
+
+		respBody, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return role, err
+		}
+
+		wrapped := OrgRoleWrapper{}
+		err = json.Unmarshal(respBody, &wrapped)
+		if err != nil {
+			return role, err
+		}
+
+		role = &wrapped.Source
+	} else {
+		key := datastore.NameKey(nameKey, id, nil)
+		if err := project.Dbclient.Get(ctx, key, role); err != nil {
+			return role, err
+		}
+	}
+
+	if len(role.Id) == 0 {
+		return role, errors.New("Role doesn't exist")
+	}
+
+	if project.CacheDb {
+		data, err := json.Marshal(role)
+		if err != nil {
+			log.Printf("[WARNING] Failed marshalling role %s: %s", id, err)
+			return role, nil
+		}
+
+		err = SetCache(ctx, cacheKey, data, 30)
+		if err != nil {
+			log.Printf("[WARNING] Failed setting cache for role '%s': %s", cacheKey, err)
+		}
+	}
+
+	return role, nil
+}
+
+func SetOrgRole(ctx context.Context, role OrgRole) error {
+	nameKey := "org_roles"
+	timeNow := time.Now().Unix()
+	role.Edited = timeNow
+	if role.Created == 0 {
+		role.Created = timeNow
+	}
+
+	data, err := json.Marshal(role)
+	if err != nil {
+		log.Printf("[WARNING] Failed marshalling in set role: %s", err)
+		return err
+	}
+
+	if project.DbType == "opensearch" {
+		err = indexEs(ctx, nameKey, role.Id, data)
+		if err != nil {
+			return err
+		}
+	} else {
+		key := datastore.NameKey(nameKey, role.Id, nil)
+		if _, err := project.Dbclient.Put(ctx, key, &role); err != nil {
+			log.Printf("[WARNING] Error adding role %s: %s", role.Id, err)
+			return err
+		}
+	}
+
+	if project.CacheDb {
+		cacheKey := fmt.Sprintf("%s_%s", nameKey, role.Id)
+		err = SetCache(ctx, cacheKey, data, 30)
+		if err != nil {
+			log.Printf("[WARNING] Failed setting cache for role '%s': %s", cacheKey, err)
+		}
+
+		DeleteCache(ctx, fmt.Sprintf("%s_org_%s", nameKey, role.OrgId))
+	}
+
+	return nil
+}
+
+func GetOrgRoles(ctx context.Context, orgId string) ([]OrgRole, error) {
+	nameKey := "org_roles"
+	cacheKey := fmt.Sprintf("%s_org_%s", nameKey, orgId)
+
+	roles := []OrgRole{}
+	if project.CacheDb {
+		cache, err := GetCache(ctx, cacheKey)
+		if err == nil {
+			cacheData := []byte(cache.([]uint8))
+			err = json.Unmarshal(cacheData, &roles)
+			if err == nil {
+				return roles, nil
+			}
+		}
+	}
+
+	if project.DbType == "opensearch" {
+		var buf bytes.Buffer
+		query := map[string]interface{}{
+			"from": 0,
+			"size": 1000,
+			"query": map[string]interface{}{
+				"match": map[string]interface{}{
+					"org_id": orgId,
+				},
+			},
+		}
+
+		if err := json.NewEncoder(&buf).Encode(query); err != nil {
+			log.Printf("[WARNING] Error encoding find role query: %s", err)
+			return roles, err
+		}
+
+		res, err := project.Es.Search(
+			project.Es.Search.WithContext(ctx),
+			project.Es.Search.WithIndex(strings.ToLower(GetESIndexPrefix(nameKey))),
+			project.Es.Search.WithBody(&buf),
+			project.Es.Search.WithTrackTotalHits(true),
+		)
+		if err != nil {
+			log.Printf("[ERROR] Error getting response from Opensearch (get roles): %s", err)
+			return roles, err
+		}
+
+		defer res.Body.Close()
+		if res.StatusCode == 404 {
+			return roles, nil
+		}
+
+		if res.StatusCode != 200 && res.StatusCode != 201 {
+			return roles, errors.New(fmt.Sprintf("Bad statuscode: %d", res.StatusCode))
+		}
+
+		respBody, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return roles, err
+		}
+
+		wrapped := OrgRoleSearchWrapper{}
+		err = json.Unmarshal(respBody, &wrapped)
+		if err != nil {
+			return roles, err
+		}
+
+		for _, hit := range wrapped.Hits.Hits {
+			if hit.Source.OrgId != orgId {
+				continue
+			}
+
+			roles = append(roles, hit.Source)
+		}
+	} else {
+		q := datastore.NewQuery(nameKey).Filter("org_id =", orgId).Limit(1000)
+		_, err := project.Dbclient.GetAll(ctx, q, &roles)
+		if err != nil && len(roles) == 0 {
+			return roles, err
+		}
+	}
+
+	if project.CacheDb {
+		data, err := json.Marshal(roles)
+		if err != nil {
+			log.Printf("[WARNING] Failed marshalling roles for org %s: %s", orgId, err)
+			return roles, nil
+		}
+
+		err = SetCache(ctx, cacheKey, data, 30)
+		if err != nil {
+			log.Printf("[WARNING] Failed setting cache for roles '%s': %s", cacheKey, err)
+		}
+	}
+
+	return roles, nil
+}
+
+func GetUserApiKey(ctx context.Context, id string) (*UserApiKey, error) {
+	nameKey := "user_api_keys"
+	apiKey := &UserApiKey{}
+	if project.DbType == "opensearch" {
+		res, err := project.Es.Get(strings.ToLower(GetESIndexPrefix(nameKey)), id)
+		if err != nil {
+			log.Printf("[WARNING] Error getting API key %s: %s", id, err)
+			return apiKey, err
+		}
+
+		defer res.Body.Close()
+		if res.StatusCode == 404 {
+			return apiKey, errors.New("API key doesn't exist")
+		}
+
+		respBody, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return apiKey, err
+		}
+
+		wrapped := UserApiKeyWrapper{}
+		err = json.Unmarshal(respBody, &wrapped)
+		if err != nil {
+			return apiKey, err
+		}
+
+		apiKey = &wrapped.Source
+	} else {
+		key := datastore.NameKey(nameKey, id, nil)
+		if err := project.Dbclient.Get(ctx, key, apiKey); err != nil {
+			return apiKey, err
+		}
+	}
+
+	if len(apiKey.Id) == 0 {
+		return apiKey, errors.New("API key doesn't exist")
+	}
+
+	return apiKey, nil
+}
+
+func SetUserApiKey(ctx context.Context, apiKey UserApiKey) error {
+	nameKey := "user_api_keys"
+	data, err := json.Marshal(apiKey)
+	if err != nil {
+		log.Printf("[WARNING] Failed marshalling in set API key: %s", err)
+		return err
+	}
+
+	if project.DbType == "opensearch" {
+		err = indexEs(ctx, nameKey, apiKey.Id, data)
+		if err != nil {
+			return err
+		}
+	} else {
+		key := datastore.NameKey(nameKey, apiKey.Id, nil)
+		if _, err := project.Dbclient.Put(ctx, key, &apiKey); err != nil {
+			log.Printf("[WARNING] Error adding API key %s: %s", apiKey.Id, err)
+			return err
+		}
+	}
+
+	if project.CacheDb {
+		err = SetCache(ctx, fmt.Sprintf("%s_%s", nameKey, apiKey.KeyHash), data, 30)
+		if err != nil {
+			log.Printf("[WARNING] Failed setting cache for API key %s: %s", apiKey.Id, err)
+		}
+
+		DeleteCache(ctx, fmt.Sprintf("%s_user_%s", nameKey, apiKey.UserId))
+	}
+
+	return nil
+}
+
+func DeleteUserApiKey(ctx context.Context, apiKey UserApiKey) error {
+	nameKey := "user_api_keys"
+	err := DeleteKey(ctx, nameKey, apiKey.Id)
+	if err != nil {
+		return err
+	}
+
+	DeleteCache(ctx, fmt.Sprintf("%s_%s", nameKey, apiKey.KeyHash))
+	DeleteCache(ctx, fmt.Sprintf("%s_user_%s", nameKey, apiKey.UserId))
+	return nil
+}
+
+func searchUserApiKeys(ctx context.Context, field, value string) ([]UserApiKey, error) {
+	nameKey := "user_api_keys"
+	apiKeys := []UserApiKey{}
+	if project.DbType == "opensearch" {
+		var buf bytes.Buffer
+		query := map[string]interface{}{
+			"from": 0,
+			"size": 1000,
+			"query": map[string]interface{}{
+				"match": map[string]interface{}{
+					field: value,
+				},
+			},
+		}
+
+		if err := json.NewEncoder(&buf).Encode(query); err != nil {
+			log.Printf("[WARNING] Error encoding find API key query: %s", err)
+			return apiKeys, err
+		}
+
+		res, err := project.Es.Search(
+			project.Es.Search.WithContext(ctx),
+			project.Es.Search.WithIndex(strings.ToLower(GetESIndexPrefix(nameKey))),
+			project.Es.Search.WithBody(&buf),
+			project.Es.Search.WithTrackTotalHits(true),
+		)
+		if err != nil {
+			log.Printf("[ERROR] Error getting response from Opensearch (get API keys): %s", err)
+			return apiKeys, err
+		}
+
+		defer res.Body.Close()
+		if res.StatusCode == 404 {
+			return apiKeys, nil
+		}
+
+		if res.StatusCode != 200 && res.StatusCode != 201 {
+			return apiKeys, errors.New(fmt.Sprintf("Bad statuscode: %d", res.StatusCode))
+		}
+
+		respBody, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return apiKeys, err
+		}
+
+		wrapped := UserApiKeySearchWrapper{}
+		err = json.Unmarshal(respBody, &wrapped)
+		if err != nil {
+			return apiKeys, err
+		}
+
+		for _, hit := range wrapped.Hits.Hits {
+			if (field == "user_id" && hit.Source.UserId != value) || (field == "key_hash" && hit.Source.KeyHash != value) {
+				continue
+			}
+
+			apiKeys = append(apiKeys, hit.Source)
+		}
+	} else {
+		q := datastore.NewQuery(nameKey).Filter(fmt.Sprintf("%s =", field), value).Limit(1000)
+		_, err := project.Dbclient.GetAll(ctx, q, &apiKeys)
+		if err != nil && len(apiKeys) == 0 {
+			return apiKeys, err
+		}
+	}
+
+	return apiKeys, nil
+}
+
+func GetUserApiKeys(ctx context.Context, userId string) ([]UserApiKey, error) {
+	cacheKey := fmt.Sprintf("user_api_keys_user_%s", userId)
+	apiKeys := []UserApiKey{}
+	if project.CacheDb {
+		cache, err := GetCache(ctx, cacheKey)
+		if err == nil {
+			cacheData := []byte(cache.([]uint8))
+			err = json.Unmarshal(cacheData, &apiKeys)
+			if err == nil {
+				return apiKeys, nil
+			}
+		}
+	}
+
+	apiKeys, err := searchUserApiKeys(ctx, "user_id", userId)
+	if err != nil {
+		return apiKeys, err
+	}
+
+	if project.CacheDb {
+		data, err := json.Marshal(apiKeys)
+		if err == nil {
+			SetCache(ctx, cacheKey, data, 30)
+		}
+	}
+
+	return apiKeys, nil
+}
+
+func GetUserApiKeyByHash(ctx context.Context, keyHash string) (*UserApiKey, error) {
+	cacheKey := fmt.Sprintf("user_api_keys_%s", keyHash)
+	apiKey := &UserApiKey{}
+	if project.CacheDb {
+		cache, err := GetCache(ctx, cacheKey)
+		if err == nil {
+			cacheData := []byte(cache.([]uint8))
+			err = json.Unmarshal(cacheData, apiKey)
+			if err == nil && len(apiKey.Id) > 0 {
+				return apiKey, nil
+			}
+		}
+	}
+
+	apiKeys, err := searchUserApiKeys(ctx, "key_hash", keyHash)
+	if err != nil {
+		return apiKey, err
+	}
+
+	if len(apiKeys) == 0 {
+		return apiKey, errors.New("API key doesn't exist")
+	}
+
+	apiKey = &apiKeys[0]
+	if project.CacheDb {
+		data, err := json.Marshal(apiKey)
+		if err == nil {
+			SetCache(ctx, cacheKey, data, 30)
+		}
+	}
+
+	return apiKey, nil
+}
+
+// Updates the tracked info of a session without touching the user
+func UpdateSession(ctx context.Context, session Session) error {
+	nameKey := "sessions"
+	data, err := json.Marshal(session)
+	if err != nil {
+		log.Printf("[WARNING] Failed marshalling session: %s", err)
+		return err
+	}
+
+	if project.DbType == "opensearch" {
+		err = indexEs(ctx, nameKey, session.Session, data)
+		if err != nil {
+			return err
+		}
+	} else {
+		key := datastore.NameKey(nameKey, session.Session, nil)
+		if _, err := project.Dbclient.Put(ctx, key, &session); err != nil {
+			log.Printf("[WARNING] Error updating session for user %s: %s", session.UserId, err)
+			return err
+		}
+	}
+
+	if project.CacheDb {
+		err = SetCache(ctx, session.Session, data, 30)
+		if err != nil {
+			log.Printf("[WARNING] Failed updating session cache: %s", err)
+		}
+	}
+
+	return nil
+}
+
+func DeleteSession(ctx context.Context, sessionToken string) error {
+	DeleteCache(ctx, sessionToken)
+	DeleteCache(ctx, fmt.Sprintf("session_%s", sessionToken))
+
+	return DeleteKey(ctx, "sessions", sessionToken)
+}
+
+func GetUserSessions(ctx context.Context, userId string) ([]Session, error) {
+	nameKey := "sessions"
+	sessions := []Session{}
+	userId = strings.ToLower(userId)
+	if project.DbType == "opensearch" {
+		var buf bytes.Buffer
+		query := map[string]interface{}{
+			"from": 0,
+			"size": 1000,
+			"query": map[string]interface{}{
+				"match": map[string]interface{}{
+					"UserId": userId,
+				},
+			},
+		}
+
+		if err := json.NewEncoder(&buf).Encode(query); err != nil {
+			log.Printf("[WARNING] Error encoding find sessions query: %s", err)
+			return sessions, err
+		}
+
+		res, err := project.Es.Search(
+			project.Es.Search.WithContext(ctx),
+			project.Es.Search.WithIndex(strings.ToLower(GetESIndexPrefix(nameKey))),
+			project.Es.Search.WithBody(&buf),
+			project.Es.Search.WithTrackTotalHits(true),
+		)
+		if err != nil {
+			log.Printf("[ERROR] Error getting response from Opensearch (get user sessions): %s", err)
+			return sessions, err
+		}
+
+		defer res.Body.Close()
+		if res.StatusCode == 404 {
+			return sessions, nil
+		}
+
+		if res.StatusCode != 200 && res.StatusCode != 201 {
+			return sessions, errors.New(fmt.Sprintf("Bad statuscode: %d", res.StatusCode))
+		}
+
+		respBody, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return sessions, err
+		}
+
+		wrapped := SessionSearchWrapper{}
+		err = json.Unmarshal(respBody, &wrapped)
+		if err != nil {
+			return sessions, err
+		}
+
+		for _, hit := range wrapped.Hits.Hits {
+			if hit.Source.UserId != userId {
+				continue
+			}
+
+			sessions = append(sessions, hit.Source)
+		}
+	} else {
+		q := datastore.NewQuery(nameKey).Filter("user_id =", userId).Limit(1000)
+		_, err := project.Dbclient.GetAll(ctx, q, &sessions)
+		if err != nil && len(sessions) == 0 {
+			return sessions, err
+		}
+	}
+
+	return sessions, nil
+}
+
+func SetSupportAccessEvent(ctx context.Context, event SupportAccessEvent) error {
+	nameKey := "support_access_events"
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("[WARNING] Failed marshalling in set support access event: %s", err)
+		return err
+	}
+
+	if project.DbType == "opensearch" {
+		err = indexEs(ctx, nameKey, event.Id, data)
+		if err != nil {
+			return err
+		}
+	} else {
+		key := datastore.NameKey(nameKey, event.Id, nil)
+		if _, err := project.Dbclient.Put(ctx, key, &event); err != nil {
+			log.Printf("[WARNING] Error adding support access event %s: %s", event.Id, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Newest first
+func GetSupportAccessEvents(ctx context.Context, orgId string, maxAmount int) ([]SupportAccessEvent, error) {
+	nameKey := "support_access_events"
+	events := []SupportAccessEvent{}
+	if project.DbType == "opensearch" {
+		var buf bytes.Buffer
+		query := map[string]interface{}{
+			"from": 0,
+			"size": maxAmount,
+			"query": map[string]interface{}{
+				"match": map[string]interface{}{
+					"org_id": orgId,
+				},
+			},
+			"sort": map[string]interface{}{
+				"timestamp": map[string]interface{}{
+					"order": "desc",
+				},
+			},
+		}
+
+		if err := json.NewEncoder(&buf).Encode(query); err != nil {
+			log.Printf("[WARNING] Error encoding find support access events query: %s", err)
+			return events, err
+		}
+
+		res, err := project.Es.Search(
+			project.Es.Search.WithContext(ctx),
+			project.Es.Search.WithIndex(strings.ToLower(GetESIndexPrefix(nameKey))),
+			project.Es.Search.WithBody(&buf),
+			project.Es.Search.WithTrackTotalHits(true),
+		)
+		if err != nil {
+			log.Printf("[ERROR] Error getting response from Opensearch (get support access events): %s", err)
+			return events, err
+		}
+
+		defer res.Body.Close()
+		if res.StatusCode == 404 {
+			return events, nil
+		}
+
+		if res.StatusCode != 200 && res.StatusCode != 201 {
+			return events, errors.New(fmt.Sprintf("Bad statuscode: %d", res.StatusCode))
+		}
+
+		respBody, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return events, err
+		}
+
+		wrapped := SupportAccessEventSearchWrapper{}
+		err = json.Unmarshal(respBody, &wrapped)
+		if err != nil {
+			return events, err
+		}
+
+		for _, hit := range wrapped.Hits.Hits {
+			if hit.Source.OrgId != orgId {
+				continue
+			}
+
+			events = append(events, hit.Source)
+		}
+	} else {
+		q := datastore.NewQuery(nameKey).Filter("org_id =", orgId).Order("-timestamp").Limit(maxAmount)
+		_, err := project.Dbclient.GetAll(ctx, q, &events)
+		if err != nil && len(events) == 0 {
+			return events, err
+		}
+	}
+
+	return events, nil
+}
+
+func SetAuditEvent(ctx context.Context, event AuditEvent) error {
+	nameKey := "audit_events"
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("[WARNING] Failed marshalling in set audit event: %s", err)
+		return err
+	}
+
+	if project.DbType == "opensearch" {
+		err = indexEs(ctx, nameKey, event.Id, data)
+		if err != nil {
+			return err
+		}
+	} else {
+		key := datastore.NameKey(nameKey, event.Id, nil)
+		if _, err := project.Dbclient.Put(ctx, key, &event); err != nil {
+			log.Printf("[WARNING] Error adding audit event %s: %s", event.Id, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func DeleteAuditEvent(ctx context.Context, id string) error {
+	return DeleteKey(ctx, "audit_events", id)
+}
+
+// Newest first
+func GetAuditEvents(ctx context.Context, orgId string, search AuditEventSearch) ([]AuditEvent, error) {
+	nameKey := "audit_events"
+	events := []AuditEvent{}
+	if search.Limit <= 0 {
+		search.Limit = 100
+	}
+
+	if project.DbType == "opensearch" {
+		must := []map[string]interface{}{
+			map[string]interface{}{
+				"match": map[string]interface{}{
+					"org_id": orgId,
+				},
+			},
+		}
+
+		matches := map[string]string{
+			"actor_id":      search.ActorId,
+			"action":        search.Action,
+			"resource_type": search.ResourceType,
+			"resource_id":   search.ResourceId,
+		}
+
+		for field, value := range matches {
+			if len(value) == 0 {
+				continue
+			}
+
+			must = append(must, map[string]interface{}{
+				"match": map[string]interface{}{
+					field: value,
+				},
+			})
+		}
+
+		if search.StartTime > 0 || search.EndTime > 0 {
+			timeRange := map[string]interface{}{}
+			if search.StartTime > 0 {
+				timeRange["gte"] = search.StartTime
+			}
+
+			if search.EndTime > 0 {
+				timeRange["lte"] = search.EndTime
+			}
+
+			must = append(must, map[string]interface{}{
+				"range": map[string]interface{}{
+					"timestamp": timeRange,
+				},
+			})
+		}
+
+		var buf bytes.Buffer
+		query := map[string]interface{}{
+			"from": 0,
+			"size": search.Limit,
+			"query": map[string]interface{}{
+				"bool": map[string]interface{}{
+					"must": must,
+				},
+			},
+			"sort": map[string]interface{}{
+				"timestamp": map[string]interface{}{
+					"order": "desc",
+				},
+			},
+		}
+
+		if err := json.NewEncoder(&buf).Encode(query); err != nil {
+			log.Printf("[WARNING] Error encoding find audit events query: %s", err)
+			return events, err
+		}
+
+		res, err := project.Es.Search(
+			project.Es.Search.WithContext(ctx),
+			project.Es.Search.WithIndex(strings.ToLower(GetESIndexPrefix(nameKey))),
+			project.Es.Search.WithBody(&buf),
+			project.Es.Search.WithTrackTotalHits(true),
+		)
+		if err != nil {
+			log.Printf("[ERROR] Error getting response from Opensearch (get audit events): %s", err)
+			return events, err
+		}
+
+		defer res.Body.Close()
+		if res.StatusCode == 404 {
+			return events, nil
+		}
+
+		if res.StatusCode != 200 && res.StatusCode != 201 {
+			return events, errors.New(fmt.Sprintf("Bad statuscode: %d", res.StatusCode))
+		}
+
+		respBody, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return events, err
+		}
+
+		wrapped := AuditEventSearchWrapper{}
+		err = json.Unmarshal(respBody, &wrapped)
+		if err != nil {
+			return events, err
+		}
+
+		for _, hit := range wrapped.Hits.Hits {
+			event := hit.Source
+			if event.OrgId != orgId {
+				continue
+			}
+
+			if (len(search.ActorId) > 0 && event.ActorId != search.ActorId) || (len(search.Action) > 0 && event.Action != search.Action) || (len(search.ResourceType) > 0 && event.ResourceType != search.ResourceType) || (len(search.ResourceId) > 0 && event.ResourceId != search.ResourceId) {
+				continue
+			}
+
+			events = append(events, event)
+		}
+	} else {
+		q := datastore.NewQuery(nameKey).Filter("org_id =", orgId)
+		if len(search.ActorId) > 0 {
+			q = q.Filter("actor_id =", search.ActorId)
+		}
+
+		if len(search.Action) > 0 {
+			q = q.Filter("action =", search.Action)
+		}
+
+		if len(search.ResourceType) > 0 {
+			q = q.Filter("resource_type =", search.ResourceType)
+		}
+
+		if len(search.ResourceId) > 0 {
+			q = q.Filter("resource_id =", search.ResourceId)
+		}
+
+		if search.StartTime > 0 {
+			q = q.Filter("timestamp >=", search.StartTime)
+		}
+
+		if search.EndTime > 0 {
+			q = q.Filter("timestamp <=", search.EndTime)
+		}
+
+		q = q.Order("-timestamp").Limit(search.Limit)
+		_, err := project.Dbclient.GetAll(ctx, q, &events)
+		if err != nil && len(events) == 0 {
+			return events, err
+		}
+	}
+
+	return events, nil
+}
+
+func SetDataExport(ctx context.Context, export DataExport) error {
+	nameKey := "data_exports"
+	data, err := json.Marshal(export)
+	if err != nil {
+		log.Printf("[WARNING] Failed marshalling in set data export: %s", err)
+		return err
+	}
+
+	if project.DbType == "opensearch" {
+		err = indexEs(ctx, nameKey, export.Id, data)
+		if err != nil {
+			return err
+		}
+	} else {
+		key := datastore.NameKey(nameKey, export.Id, nil)
+		if _, err := project.Dbclient.Put(ctx, key, &export); err != nil {
+			log.Printf("[WARNING] Error adding data export %s: %s", export.Id, err)
+			return err
+		}
+	}
+
+	DeleteCache(ctx, fmt.Sprintf("%s_%s", nameKey, export.Id))
+	return nil
+}
+
+func GetDataExport(ctx context.Context, id string) (*DataExport, error) {
+	nameKey := "data_exports"
+	cacheKey := fmt.Sprintf("%s_%s", nameKey, id)
+
+	export := &DataExport{}
+	if project.CacheDb {
+		cache, err := GetCache(ctx, cacheKey)
+		if err == nil {
+			cacheData := []byte(cache.([]uint8))
+			err = json.Unmarshal(cacheData, &export)
+			if err == nil && len(export.Id) > 0 {
+				return export, nil
+			}
+		}
+	}
+
+	if project.DbType == "opensearch" {
+		res, err := project.Es.Get(strings.ToLower(GetESIndexPrefix(nameKey)), id)
+		if err != nil {
+			log.Printf("[WARNING] Error for %s: %s", cacheKey, err)
+			return export, err
+		}
+
+		defer res.Body.Close()
+		if res.StatusCode == 404 {
+			return export, errors.New("Export doesn't exist")
+		}
+
+		respBody, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return export, err
+		}
+
+		wrapped := DataExportWrapper{}
+		err = json.Unmarshal(respBody, &wrapped)
+		if err != nil {
+			return export, err
+		}
+
+		export = &wrapped.Source
+	} else {
+		key := datastore.NameKey(nameKey, id, nil)
+		if err := project.Dbclient.Get(ctx, key, export); err != nil {
+			return export, err
+		}
+	}
+
+	if len(export.Id) == 0 {
+		return export, errors.New("Export doesn't exist")
+	}
+
+	if project.CacheDb {
+		data, err := json.Marshal(export)
+		if err != nil {
+			log.Printf("[WARNING] Failed marshalling export %s: %s", id, err)
+			return export, nil
+		}
+
+		err = SetCache(ctx, cacheKey, data, 30)
+		if err != nil {
+			log.Printf("[WARNING] Failed setting cache for export '%s': %s", cacheKey, err)
+		}
+	}
+
+	return export, nil
+}
+
+// Newest first
+func GetDataExports(ctx context.Context, orgId string, maxAmount int) ([]DataExport, error) {
+	nameKey := "data_exports"
+	exports := []DataExport{}
+	if project.DbType == "opensearch" {
+		var buf bytes.Buffer
+		query := map[string]interface{}{
+			"from": 0,
+			"size": maxAmount,
+			"query": map[string]interface{}{
+				"match": map[string]interface{}{
+					"org_id": orgId,
+				},
+			},
+			"sort": map[string]interface{}{
+				"created": map[string]interface{}{
+					"order": "desc",
+				},
+			},
+		}
+
+		if err := json.NewEncoder(&buf).Encode(query); err != nil {
+			log.Printf("[WARNING] Error encoding find data exports query: %s", err)
+			return exports, err
+		}
+
+		res, err := project.Es.Search(
+			project.Es.Search.WithContext(ctx),
+			project.Es.Search.WithIndex(strings.ToLower(GetESIndexPrefix(nameKey))),
+			project.Es.Search.WithBody(&buf),
+			project.Es.Search.WithTrackTotalHits(true),
+		)
+		if err != nil {
+			log.Printf("[ERROR] Error getting response from Opensearch (get data exports): %s", err)
+			return exports, err
+		}
+
+		defer res.Body.Close()
+		if res.StatusCode == 404 {
+			return exports, nil
+		}
+
+		if res.StatusCode != 200 && res.StatusCode != 201 {
+			return exports, errors.New(fmt.Sprintf("Bad statuscode: %d", res.StatusCode))
+		}
+
+		respBody, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return exports, err
+		}
+
+		wrapped := DataExportSearchWrapper{}
+		err = json.Unmarshal(respBody, &wrapped)
+		if err != nil {
+			return exports, err
+		}
+
+		for _, hit := range wrapped.Hits.Hits {
+			if hit.Source.OrgId != orgId {
+				continue
+			}
+
+			exports = append(exports, hit.Source)
+		}
+	} else {
+		q := datastore.NewQuery(nameKey).Filter("org_id =", orgId).Order("-created").Limit(maxAmount)
+		_, err := project.Dbclient.GetAll(ctx, q, &exports)
+		if err != nil && len(exports) == 0 {
+			return exports, err
+		}
+	}
+
+	return exports, nil
+}
+
+func SetDeletionReport(ctx context.Context, report DeletionReport) error {
+	nameKey := "deletion_reports"
+	data, err := json.Marshal(report)
+	if err != nil {
+		log.Printf("[WARNING] Failed marshalling in set deletion report: %s", err)
+		return err
+	}
+
+	if project.DbType == "opensearch" {
+		err = indexEs(ctx, nameKey, report.Id, data)
+		if err != nil {
+			return err
+		}
+	} else {
+		key := datastore.NameKey(nameKey, report.Id, nil)
+		if _, err := project.Dbclient.Put(ctx, key, &report); err != nil {
+			log.Printf("[WARNING] Error adding deletion report %s: %s", report.Id, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Newest first
+func GetDeletionReports(ctx context.Context, orgId string, maxAmount int) ([]DeletionReport, error) {
+	nameKey := "deletion_reports"
+	reports := []DeletionReport{}
+	if project.DbType == "opensearch" {
+		var buf bytes.Buffer
+		query := map[string]interface{}{
+			"from": 0,
+			"size": maxAmount,
+			"query": map[string]interface{}{
+				"match": map[string]interface{}{
+					"org_id": orgId,
+				},
+			},
+			"sort": map[string]interface{}{
+				"timestamp": map[string]interface{}{
+					"order": "desc",
+				},
+			},
+		}
+
+		if err := json.NewEncoder(&buf).Encode(query); err != nil {
+			log.Printf("[WARNING] Error encoding find deletion reports query: %s", err)
+			return reports, err
+		}
+
+		res, err := project.Es.Search(
+			project.Es.Search.WithContext(ctx),
+			project.Es.Search.WithIndex(strings.ToLower(GetESIndexPrefix(nameKey))),
+			project.Es.Search.WithBody(&buf),
+			project.Es.Search.WithTrackTotalHits(true),
+		)
+		if err != nil {
+			log.Printf("[ERROR] Error getting response from Opensearch (get deletion reports): %s", err)
+			return reports, err
+		}
+
+		defer res.Body.Close()
+		if res.StatusCode == 404 {
+			return reports, nil
+		}
+
+		if res.StatusCode != 200 && res.StatusCode != 201 {
+			return reports, errors.New(fmt.Sprintf("Bad statuscode: %d", res.StatusCode))
+		}
+
+		respBody, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return reports, err
+		}
+
+		wrapped := DeletionReportSearchWrapper{}
+		err = json.Unmarshal(respBody, &wrapped)
+		if err != nil {
+			return reports, err
+		}
+
+		for _, hit := range wrapped.Hits.Hits {
+			if hit.Source.OrgId != orgId {
+				continue
+			}
+
+			reports = append(reports, hit.Source)
+		}
+	} else {
+		q := datastore.NewQuery(nameKey).Filter("org_id =", orgId).Order("-timestamp").Limit(maxAmount)
+		_, err := project.Dbclient.GetAll(ctx, q, &reports)
+		if err != nil && len(reports) == 0 {
+			return reports, err
+		}
+	}
+
+	return reports, nil
+}
+
+func SetKeyRotation(ctx context.Context, rotation KeyRotation) error {
+	nameKey := "key_rotations"
+	data, err := json.Marshal(rotation)
+	if err != nil {
+		log.Printf("[WARNING] Failed marshalling in set key rotation: %s", err)
+		return err
+	}
+
+	if project.DbType == "opensearch" {
+		err = indexEs(ctx, nameKey, rotation.Id, data)
+		if err != nil {
+			return err
+		}
+	} else {
+		key := datastore.NameKey(nameKey, rotation.Id, nil)
+		if _, err := project.Dbclient.Put(ctx, key, &rotation); err != nil {
+			log.Printf("[WARNING] Error adding key rotation %s: %s", rotation.Id, err)
+			return err
+		}
+	}
+
+	DeleteCache(ctx, fmt.Sprintf("%s_%s", nameKey, rotation.Id))
+	return nil
+}
+
+func GetKeyRotation(ctx context.Context, id string) (*KeyRotation, error) {
+	nameKey := "key_rotations"
+	cacheKey := fmt.Sprintf("%s_%s", nameKey, id)
+
+	rotation := &KeyRotation{}
+	if project.CacheDb {
+		cache, err := GetCache(ctx, cacheKey)
+		if err == nil {
+			cacheData := []byte(cache.([]uint8))
+			err = json.Unmarshal(cacheData, &rotation)
+			if err == nil && len(rotation.Id) > 0 {
+				return rotation, nil
+			}
+		}
+	}
+
+	if project.DbType == "opensearch" {
+		res, err := project.Es.Get(strings.ToLower(GetESIndexPrefix(nameKey)), id)
+		if err != nil {
+			log.Printf("[WARNING] Error for %s: %s", cacheKey, err)
+			return rotation, err
+		}
+
+		defer res.Body.Close()
+		if res.StatusCode == 404 {
+			return rotation, errors.New("Key rotation doesn't exist")
+		}
+
+		respBody, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return rotation, err
+		}
+
+		wrapped := KeyRotationWrapper{}
+		err = json.Unmarshal(respBody, &wrapped)
+		if err != nil {
+			return rotation, err
+		}
+
+		rotation = &wrapped.Source
+	} else {
+		key := datastore.NameKey(nameKey, id, nil)
+		if err := project.Dbclient.Get(ctx, key, rotation); err != nil {
+			return rotation, err
+		}
+	}
+
+	if len(rotation.Id) == 0 {
+		return rotation, errors.New("Key rotation doesn't exist")
+	}
+
+	if project.CacheDb {
+		data, err := json.Marshal(rotation)
+		if err != nil {
+			log.Printf("[WARNING] Failed marshalling key rotation %s: %s", id, err)
+			return rotation, nil
+		}
+
+		err = SetCache(ctx, cacheKey, data, 30)
+		if err != nil {
+			log.Printf("[WARNING] Failed setting cache for key rotation '%s': %s", cacheKey, err)
+		}
+	}
+
+	return rotation, nil
+}
@@ -242,7 +242,7 @@ func HandleToggleRule(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Role == "org-reader" {
+	if Authorize(user, "detection:write", "") != nil {
 		log.Printf("[WARNING] Org-reader doesn't have access to delete files: %s (%s)", user.Username, user.Id)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
@@ -321,7 +321,7 @@ func HandleFolderToggle(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Role == "org-reader" {
+	if Authorize(user, "detection:write", "") != nil {
 		log.Printf("[WARNING] Org-reader doesn't have access to toggle folder: %s (%s)", user.Username, user.Id)
 		resp.WriteHeader(403)
 		resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
@@ -511,7 +511,7 @@ func HandleSaveSelectedRules(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Role == "org-reader" {
+	if Authorize(user, "detection:write", "") != nil {
 		log.Printf("[WARNING] Org-reader doesn't have access to save rules: %s (%s)", user.Username, user.Id)
 		resp.WriteHeader(http.StatusForbidden)
 		resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
@@ -575,7 +575,7 @@ func HandleDetectionAutoConnect(resp http.ResponseWriter, request *http.Request)
 		return
 	}
 
-	if user.Role == "org-reader" {
+	if Authorize(user, "detection:write", "") != nil {
 		resp.WriteHeader(403)
 		resp.Write([]byte(`{"success": false, "reason": "Org reader does not have permission to connect to SIEM"}`))
 		return
@@ -0,0 +1,737 @@
+package shuffle
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Max amount of event -> workflow -> event hops before publishing is stopped.
+// Prevents workflows from triggering each other forever.
+var maxEventDepth = 10
+
+var validEventConditions = []string{"equals", "not_equals", "contains", "startswith", "endswith", "exists", "not_exists", "larger_than", "less_than"}
+var validEventTopic = regexp.MustCompile(`^[a-z0-9][a-z0-9._\-/]{0,127}$`)
+
+// Published events are deleted after this many days
+var busEventRetentionDays = 30
+
+// Publishes an event on the org's event bus and starts every matching
+// EVENT trigger. Returns the amount of subscriptions that matched.
+func PublishEvent(ctx context.Context, event BusEvent) (int, error) {
+	event.Topic = strings.ToLower(strings.TrimSpace(event.Topic))
+	if !validEventTopic.MatchString(event.Topic) {
+		return 0, errors.New(fmt.Sprintf("Invalid topic '%s'. Use lowercase letters, numbers, dots, dashes and slashes", event.Topic))
+	}
+
+	if len(event.OrgId) == 0 {
+		return 0, errors.New("No org specified for event")
+	}
+
+	var parsedData interface{}
+	if len(event.Data) > 0 {
+		err := json.Unmarshal([]byte(event.Data), &parsedData)
+		if err != nil {
+			parsedData = event.Data
+		}
+	}
+
+	if len(event.ExecutionId) > 0 {
+		cache, err := GetCache(ctx, fmt.Sprintf("event_depth_%s", event.ExecutionId))
+		if err == nil {
+			depth, err := strconv.Atoi(string(cache.([]uint8)))
+			if err == nil {
+				event.Depth = depth
+			}
+		}
+	}
+
+	if event.Depth >= maxEventDepth {
+		log.Printf("[WARNING] Stopped event on topic %s in org %s from execution %s. Max depth of %d reached", event.Topic, event.OrgId, event.ExecutionId, maxEventDepth)
+		return 0, errors.New(fmt.Sprintf("Max event depth of %d reached. Check for workflows triggering each other in a loop", maxEventDepth))
+	}
+
+	event.Id = uuid.NewV4().String()
+	event.Created = time.Now().Unix()
+
+	subscriptions, err := GetEventSubscriptions(ctx, event.OrgId)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting event subscriptions for org %s: %s", event.OrgId, err)
+	}
+
+	matched := []EventSubscription{}
+	for _, subscription := range subscriptions {
+		if subscription.Status != "running" || subscription.Topic != event.Topic {
+			continue
+		}
+
+		// Don't let a workflow trigger itself directly
+		if len(event.WorkflowId) > 0 && subscription.WorkflowId == event.WorkflowId {
+			continue
+		}
+
+		if !matchEventFilters(parsedData, subscription.Filters) {
+			continue
+		}
+
+		matched = append(matched, subscription)
+	}
+
+	event.Matched = len(matched)
+	err = SetBusEvent(ctx, event)
+	if err != nil {
+		log.Printf("[WARNING] Failed storing event %s on topic %s: %s", event.Id, event.Topic, err)
+	}
+
+	triggerBusEventCleanup(ctx, event.OrgId)
+
+	if len(matched) == 0 {
+		return 0, nil
+	}
+
+	argument, err := json.Marshal(map[string]interface{}{
+		"id":           event.Id,
+		"topic":        event.Topic,
+		"source":       event.Source,
+		"workflow_id":  event.WorkflowId,
+		"execution_id": event.ExecutionId,
+		"created":      event.Created,
+		"data":         parsedData,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, subscription := range matched {
+		go func(subscription EventSubscription) {
+			err := startEventSubscription(context.Background(), subscription, event, string(argument))
+			if err != nil {
+				log.Printf("[WARNING] Failed starting workflow %s from event %s on topic %s: %s", subscription.WorkflowId, event.Id, event.Topic, err)
+			}
+		}(subscription)
+	}
+
+	log.Printf("[INFO] Event %s on topic %s in org %s matched %d subscription(s)", event.Id, event.Topic, event.OrgId, len(matched))
+	return len(matched), nil
+}
+
+func startEventSubscription(ctx context.Context, subscription EventSubscription, event BusEvent, argument string) error {
+	workflow, err := GetWorkflow(ctx, subscription.WorkflowId)
+	if err != nil {
+		return err
+	}
+
+	if workflow.OrgId != subscription.OrgId {
+		return errors.New(fmt.Sprintf("Workflow %s doesn't belong to org %s", workflow.ID, subscription.OrgId))
+	}
+
+	startNode := subscription.Start
+	if len(startNode) == 0 {
+		startNode = workflow.Start
+	}
+
+	execRequest := ExecutionRequest{
+		ExecutionId:       uuid.NewV4().String(),
+		Start:             startNode,
+		ExecutionSource:   "event",
+		ExecutionArgument: argument,
+	}
+
+	if len(subscription.Environment) > 0 {
+		execRequest.Environments = []string{subscription.Environment}
+	}
+
+	// Set before starting so that events published by the new execution are counted
+	SetCache(ctx, fmt.Sprintf("event_depth_%s", execRequest.ExecutionId), []byte(strconv.Itoa(event.Depth+1)), 60)
+	return executeWorkflowAsOwner(ctx, *workflow, subscription.OrgId, execRequest)
+}
+
+// Prepares, stores and queues an execution for the workflow in-process.
+// Used when there is no request to take the auth from, e.g. queued or event triggers.
+// The owner has to still be a member of the org the execution runs in.
+func executeWorkflowAsOwner(ctx context.Context, workflow Workflow, orgId string, execRequest ExecutionRequest) error {
+	user, err := GetUser(ctx, workflow.Owner)
+	if err != nil || len(user.Id) == 0 || !ArrayContains(user.Orgs, orgId) {
+		return errors.New(fmt.Sprintf("No valid owner found for workflow %s", workflow.ID))
+	}
+
+	b, err := json.Marshal(execRequest)
+	if err != nil {
+		return err
+	}
+
+	// Only used to pass the execution request. No auth header, as the caller has already been authorized.
+	internalRequest, err := http.NewRequest(
+		"POST",
+		fmt.Sprintf("/api/v1/workflows/%s/execute", workflow.ID),
+		bytes.NewBuffer(b),
+	)
+	if err != nil {
+		return err
+	}
+
+	workflowExecution, execInfo, errString, err := PrepareWorkflowExecution(ctx, workflow, internalRequest, 10)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed preparing execution of workflow %s: %s %s", workflow.ID, errString, err))
+	}
+
+	err = SetWorkflowExecution(ctx, workflowExecution, true)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed storing execution %s: %s", workflowExecution.ExecutionId, err))
+	}
+
+	queueRequest := ExecutionRequest{
+		ExecutionId:   workflowExecution.ExecutionId,
+		WorkflowId:    workflowExecution.Workflow.ID,
+		Authorization: workflowExecution.Authorization,
+		Environments:  execInfo.Environments,
+		Priority:      workflowExecution.Priority,
+	}
+
+	for _, environment := range execInfo.Environments {
+		err = SetWorkflowQueue(ctx, queueRequest, getEnvironmentQueueName(environment, orgId))
+		if err != nil {
+			return errors.New(fmt.Sprintf("Failed queueing execution %s for environment %s: %s", workflowExecution.ExecutionId, environment, err))
+		}
+	}
+
+	return nil
+}
+
+// The queue name Orborus reads for an environment
+func getEnvironmentQueueName(environment, orgId string) string {
+	parsedEnv := strings.ToLower(strings.ReplaceAll(strings.ReplaceAll(environment, " ", "-"), "_", "-"))
+	if project.Environment == "cloud" {
+		parsedEnv = fmt.Sprintf("%s_%s", parsedEnv, orgId)
+	}
+
+	return parsedEnv
+}
+
+// Events created before this timestamp are past retention
+func getBusEventCutoff(timeNow int64) int64 {
+	return timeNow - int64(busEventRetentionDays*24*60*60)
+}
+
+// Deletes the org's events that are past retention
+func CleanupBusEvents(ctx context.Context, orgId string) error {
+	cutoff := getBusEventCutoff(time.Now().Unix())
+	deleted := 0
+	for {
+		events, err := GetBusEventsBefore(ctx, orgId, cutoff, 1000)
+		if err != nil {
+			return err
+		}
+
+		for _, event := range events {
+			err = DeleteKey(ctx, "bus_events", event.Id)
+			if err != nil {
+				log.Printf("[WARNING] Failed deleting event %s in org %s: %s", event.Id, orgId, err)
+				return err
+			}
+
+			deleted += 1
+		}
+
+		if len(events) < 1000 {
+			break
+		}
+	}
+
+	if deleted > 0 {
+		log.Printf("[INFO] Deleted %d event(s) older than %d days in org %s", deleted, busEventRetentionDays, orgId)
+	}
+
+	return nil
+}
+
+// Old events are cleaned up at most once a day per org
+func triggerBusEventCleanup(ctx context.Context, orgId string) {
+	cleanupKey := fmt.Sprintf("event_cleanup_%s", orgId)
+	if _, err := GetCache(ctx, cleanupKey); err != nil {
+		SetCache(ctx, cleanupKey, []byte("1"), 60*24)
+		go CleanupBusEvents(context.Background(), orgId)
+	}
+}
+
+// The subscription ID has to be an EVENT trigger in the workflow
+func getEventTrigger(workflow Workflow, triggerId string) (Trigger, error) {
+	for _, trigger := range workflow.Triggers {
+		if trigger.ID != triggerId {
+			continue
+		}
+
+		if trigger.TriggerType != "EVENT" {
+			return trigger, errors.New(fmt.Sprintf("Trigger %s is not an EVENT trigger", triggerId))
+		}
+
+		return trigger, nil
+	}
+
+	return Trigger{}, errors.New(fmt.Sprintf("Trigger %s not found in workflow %s", triggerId, workflow.ID))
+}
+
+// All filters have to match
+func matchEventFilters(data interface{}, filters []EventFilter) bool {
+	for _, filter := range filters {
+		value, found := getHookPayloadValue(data, filter.Field)
+		if filter.Condition == "exists" {
+			if !found {
+				return false
+			}
+
+			continue
+		}
+
+		if filter.Condition == "not_exists" {
+			if found {
+				return false
+			}
+
+			continue
+		}
+
+		if !found {
+			return false
+		}
+
+		parsedValue := ""
+		switch value.(type) {
+		case string:
+			parsedValue = value.(string)
+		case map[string]interface{}, []interface{}:
+			marshalled, err := json.Marshal(value)
+			if err != nil {
+				return false
+			}
+
+			parsedValue = string(marshalled)
+		default:
+			parsedValue = fmt.Sprintf("%v", value)
+		}
+
+		switch filter.Condition {
+		case "", "equals":
+			if parsedValue != filter.Value {
+				return false
+			}
+		case "not_equals":
+			if parsedValue == filter.Value {
+				return false
+			}
+		case "contains":
+			if !strings.Contains(strings.ToLower(parsedValue), strings.ToLower(filter.Value)) {
+				return false
+			}
+		case "startswith":
+			if !strings.HasPrefix(parsedValue, filter.Value) {
+				return false
+			}
+		case "endswith":
+			if !strings.HasSuffix(parsedValue, filter.Value) {
+				return false
+			}
+		case "larger_than", "less_than":
+			left, err := strconv.ParseFloat(parsedValue, 64)
+			if err != nil {
+				return false
+			}
+
+			right, err := strconv.ParseFloat(filter.Value, 64)
+			if err != nil {
+				return false
+			}
+
+			if filter.Condition == "larger_than" && left <= right {
+				return false
+			}
+
+			if filter.Condition == "less_than" && left >= right {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// Publishes to a topic. Accepts normal API auth, or execution_id +
+// authorization in the body when used from inside a workflow.
+func HandlePublishEvent(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		log.Printf("[WARNING] Failed reading body in publish event: %s", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	type publishRequest struct {
+		Topic         string          `json:"topic"`
+		Data          json.RawMessage `json:"data"`
+		ExecutionId   string          `json:"execution_id"`
+		Authorization string          `json:"authorization"`
+	}
+
+	var tmpData publishRequest
+	err = json.Unmarshal(body, &tmpData)
+	if err != nil {
+		log.Printf("[WARNING] Failed unmarshalling in publish event: %s", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Failed parsing event"}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	event := BusEvent{
+		Topic: tmpData.Topic,
+		Data:  string(tmpData.Data),
+	}
+
+	if len(tmpData.ExecutionId) > 0 && len(tmpData.Authorization) > 0 {
+		workflowExecution, err := GetWorkflowExecution(ctx, tmpData.ExecutionId)
+		if err != nil || workflowExecution.Authorization != tmpData.Authorization {
+			log.Printf("[INFO] Bad execution auth when publishing event from execution %s", tmpData.ExecutionId)
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false, "reason": "Failed authentication"}`))
+			return
+		}
+
+		if workflowExecution.Status != "EXECUTING" {
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false, "reason": "Workflow isn't executing"}`))
+			return
+		}
+
+		event.OrgId = workflowExecution.ExecutionOrg
+		if len(event.OrgId) == 0 {
+			event.OrgId = workflowExecution.Workflow.OrgId
+		}
+
+		event.Source = "workflow"
+		event.WorkflowId = workflowExecution.Workflow.ID
+		event.ExecutionId = workflowExecution.ExecutionId
+	} else {
+		user, err := HandleApiAuthentication(resp, request)
+		if err != nil {
+			log.Printf("[WARNING] Api authentication failed in publish event: %s", err)
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false}`))
+			return
+		}
+
+		if Authorize(user, "workflow:execute", "") != nil {
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
+			return
+		}
+
+		event.OrgId = user.ActiveOrg.Id
+		event.Source = fmt.Sprintf("user:%s", user.Username)
+	}
+
+	matched, err := PublishEvent(ctx, event)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, strings.Replace(err.Error(), "\"", "\\\"", -1))))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "matched": %d}`, matched)))
+}
+
+// Recent events in the org. Optional ?topic=
+func HandleGetEvents(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in get events: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	topic := strings.ToLower(request.URL.Query().Get("topic"))
+	events, err := GetBusEvents(ctx, user.ActiveOrg.Id, topic, 100)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting events for org %s: %s", user.ActiveOrg.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	newjson, err := json.Marshal(events)
+	if err != nil {
+		log.Printf("[WARNING] Failed marshalling events: %s", err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+func HandleGetEventSubscriptions(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in get event subscriptions: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	subscriptions, err := GetEventSubscriptions(ctx, user.ActiveOrg.Id)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting event subscriptions for org %s: %s", user.ActiveOrg.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	newjson, err := json.Marshal(subscriptions)
+	if err != nil {
+		log.Printf("[WARNING] Failed marshalling event subscriptions: %s", err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// Starts an EVENT trigger. The ID in the body is the trigger ID
+func HandleNewEventSubscription(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in new event subscription: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if Authorize(user, "triggers:write", "") != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		log.Printf("[WARNING] Failed reading body in new event subscription: %s", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	var subscription EventSubscription
+	err = json.Unmarshal(body, &subscription)
+	if err != nil {
+		log.Printf("[WARNING] Failed unmarshalling event subscription: %s", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Failed parsing subscription"}`))
+		return
+	}
+
+	if len(subscription.Id) != 36 || len(subscription.WorkflowId) != 36 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Valid trigger ID and workflow_id required"}`))
+		return
+	}
+
+	subscription.Topic = strings.ToLower(strings.TrimSpace(subscription.Topic))
+	if !validEventTopic.MatchString(subscription.Topic) {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Invalid topic. Use lowercase letters, numbers, dots, dashes and slashes"}`))
+		return
+	}
+
+	for filterIndex, filter := range subscription.Filters {
+		if len(filter.Field) == 0 {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Filter %d is missing a field"}`, filterIndex)))
+			return
+		}
+
+		if validateHookExpression(filter.Field) != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Filter %d has an invalid field. Must be a JMESPath expression"}`, filterIndex)))
+			return
+		}
+
+		if len(filter.Condition) == 0 {
+			subscription.Filters[filterIndex].Condition = "equals"
+		} else if !ArrayContains(validEventConditions, filter.Condition) {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Filter %d has an invalid condition. Use one of: %s"}`, filterIndex, strings.Join(validEventConditions, ", "))))
+			return
+		}
+	}
+
+	ctx := GetContext(request)
+	workflow, err := GetWorkflow(ctx, subscription.WorkflowId)
+	if err != nil || workflow.OrgId != user.ActiveOrg.Id {
+		resp.WriteHeader(404)
+		resp.Write([]byte(`{"success": false, "reason": "Workflow not found"}`))
+		return
+	}
+
+	_, err = getEventTrigger(*workflow, subscription.Id)
+	if err != nil {
+		log.Printf("[WARNING] Invalid event subscription from user %s (%s): %s", user.Username, user.Id, err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "The ID has to be an EVENT trigger in the workflow"}`))
+		return
+	}
+
+	existing, err := GetEventSubscription(ctx, subscription.Id)
+	if err == nil && len(existing.Id) > 0 {
+		if existing.OrgId != user.ActiveOrg.Id {
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false}`))
+			return
+		}
+
+		subscription.Created = existing.Created
+		subscription.CreatedBy = existing.CreatedBy
+	} else {
+		subscription.CreatedBy = user.Username
+	}
+
+	if len(subscription.Start) == 0 {
+		for _, branch := range workflow.Branches {
+			if branch.SourceID == subscription.Id {
+				subscription.Start = branch.DestinationID
+				break
+			}
+		}
+	}
+
+	subscription.OrgId = user.ActiveOrg.Id
+	subscription.Status = "running"
+	err = SetEventSubscription(ctx, subscription)
+	if err != nil {
+		log.Printf("[ERROR] Failed saving event subscription %s: %s", subscription.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed saving subscription"}`))
+		return
+	}
+
+	for triggerIndex, trigger := range workflow.Triggers {
+		if trigger.ID == subscription.Id {
+			workflow.Triggers[triggerIndex].Status = "running"
+			err = SetWorkflow(ctx, *workflow, workflow.ID)
+			if err != nil {
+				log.Printf("[WARNING] Failed updating trigger status for event subscription %s: %s", subscription.Id, err)
+			}
+
+			break
+		}
+	}
+
+	log.Printf("[AUDIT] User %s (%s) started event trigger %s on topic %s for workflow %s", user.Username, user.Id, subscription.Id, subscription.Topic, subscription.WorkflowId)
+	resp.WriteHeader(200)
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "id": "%s"}`, subscription.Id)))
+}
+
+// Stops an EVENT trigger: /api/v1/events/subscriptions/{id}
+func HandleDeleteEventSubscription(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in delete event subscription: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if Authorize(user, "triggers:write", "") != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
+		return
+	}
+
+	location := strings.Split(strings.Split(request.URL.String(), "?")[0], "/")
+	if len(location) <= 5 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Subscription ID required"}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	subscription, err := GetEventSubscription(ctx, location[5])
+	if err != nil || subscription.OrgId != user.ActiveOrg.Id {
+		resp.WriteHeader(404)
+		resp.Write([]byte(`{"success": false, "reason": "Subscription not found"}`))
+		return
+	}
+
+	err = DeleteKey(ctx, "event_subscriptions", subscription.Id)
+	if err != nil {
+		log.Printf("[ERROR] Failed deleting event subscription %s: %s", subscription.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	DeleteCache(ctx, fmt.Sprintf("event_subscriptions_org_%s", subscription.OrgId))
+
+	workflow, err := GetWorkflow(ctx, subscription.WorkflowId)
+	if err == nil {
+		for triggerIndex, trigger := range workflow.Triggers {
+			if trigger.ID == subscription.Id {
+				workflow.Triggers[triggerIndex].Status = "stopped"
+				err = SetWorkflow(ctx, *workflow, workflow.ID)
+				if err != nil {
+					log.Printf("[WARNING] Failed updating trigger status for event subscription %s: %s", subscription.Id, err)
+				}
+
+				break
+			}
+		}
+	}
+
+	log.Printf("[AUDIT] User %s (%s) stopped event trigger %s on topic %s for workflow %s", user.Username, user.Id, subscription.Id, subscription.Topic, subscription.WorkflowId)
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
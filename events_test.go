@@ -0,0 +1,102 @@
+package shuffle
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetEventTrigger(t *testing.T) {
+	workflow := Workflow{
+		ID: "workflow",
+		Triggers: []Trigger{
+			Trigger{ID: "webhook", TriggerType: "WEBHOOK"},
+			Trigger{ID: "event", TriggerType: "EVENT"},
+		},
+	}
+
+	if _, err := getEventTrigger(workflow, "event"); err != nil {
+		t.Errorf("EVENT trigger was rejected: %s", err)
+	}
+
+	if _, err := getEventTrigger(workflow, "webhook"); err == nil {
+		t.Errorf("Webhook trigger was accepted as an event subscription")
+	}
+
+	if _, err := getEventTrigger(workflow, "missing"); err == nil {
+		t.Errorf("Trigger that isn't in the workflow was accepted")
+	}
+}
+
+func TestBusEventCutoff(t *testing.T) {
+	timeNow := time.Now().Unix()
+	cutoff := getBusEventCutoff(timeNow)
+	if timeNow-cutoff != int64(busEventRetentionDays*24*60*60) {
+		t.Errorf("Expected a cutoff %d days back, got %d seconds", busEventRetentionDays, timeNow-cutoff)
+	}
+
+	if getBusEventCutoff(timeNow-60) >= cutoff {
+		t.Errorf("Cutoff doesn't move with time")
+	}
+}
+
+func TestEnvironmentQueueName(t *testing.T) {
+	originalEnvironment := project.Environment
+	defer func() {
+		project.Environment = originalEnvironment
+	}()
+
+	project.Environment = "onprem"
+	if name := getEnvironmentQueueName("Shuffle Env_1", "org"); name != "shuffle-env-1" {
+		t.Errorf("Unexpected onprem queue name %s", name)
+	}
+
+	project.Environment = "cloud"
+	if name := getEnvironmentQueueName("Cloud", "org"); name != "cloud_org" {
+		t.Errorf("Unexpected cloud queue name %s", name)
+	}
+}
+
+func TestMatchEventFilters(t *testing.T) {
+	data := map[string]interface{}{
+		"alert": map[string]interface{}{
+			"severity": "high",
+			"score":    float64(80),
+		},
+	}
+
+	if !matchEventFilters(data, []EventFilter{
+		EventFilter{Field: "alert.severity", Condition: "equals", Value: "high"},
+		EventFilter{Field: "alert.score", Condition: "larger_than", Value: "50"},
+		EventFilter{Field: "alert.owner", Condition: "not_exists"},
+	}) {
+		t.Errorf("Matching filters didn't match")
+	}
+
+	if matchEventFilters(data, []EventFilter{
+		EventFilter{Field: "alert.severity", Condition: "equals", Value: "high"},
+		EventFilter{Field: "alert.score", Condition: "less_than", Value: "50"},
+	}) {
+		t.Errorf("Event matched with one failing filter")
+	}
+}
+
+func TestPublishEventRejections(t *testing.T) {
+	ctx := context.Background()
+	if _, err := PublishEvent(ctx, BusEvent{OrgId: "org", Topic: "Invalid topic!"}); err == nil {
+		t.Errorf("Invalid topic was accepted")
+	}
+
+	if _, err := PublishEvent(ctx, BusEvent{Topic: "alerts.new"}); err == nil {
+		t.Errorf("Event without an org was accepted")
+	}
+
+	executionId := "events-test-depth"
+	SetCache(ctx, fmt.Sprintf("event_depth_%s", executionId), []byte(fmt.Sprintf("%d", maxEventDepth)), 1)
+	_, err := PublishEvent(ctx, BusEvent{OrgId: "org", Topic: "alerts.new", ExecutionId: executionId})
+	if err == nil || !strings.Contains(err.Error(), "depth") {
+		t.Errorf("Event past the max depth was accepted: %v", err)
+	}
+}
@@ -112,7 +112,7 @@ func HandleGetFiles(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Role != "admin" {
+	if Authorize(user, "files:manage", "") != nil {
 		log.Printf("[AUTH] User isn't admin")
 		resp.WriteHeader(401)
 		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Need to be admin to list files"}`)))
@@ -226,6 +226,8 @@ func HandleGetFileMeta(resp http.ResponseWriter, request *http.Request) {
 	found := false
 	if file.OrgId == user.ActiveOrg.Id {
 		found = true
+	} else if hasInheritedFileAccess(ctx, user, file) {
+		found = true
 	} else {
 		for _, item := range user.Orgs {
 			if item == file.OrgId {
@@ -316,7 +318,7 @@ func HandleDeleteFile(resp http.ResponseWriter, request *http.Request) {
 
 	log.Printf("[INFO] User %s (%s) is attempting to delete file %s", user.Username, user.Id, fileId)
 
-	if user.Role == "org-reader" {
+	if Authorize(user, "files:write", "") != nil {
 		log.Printf("[WARNING] Org-reader doesn't have access to delete files: %s (%s)", user.Username, user.Id)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
@@ -545,6 +547,21 @@ func HandleGetFileNamespace(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	// Suborgs also get the files their parent passes down
+	parentOrgId := ""
+	foundOrg, err := GetOrg(ctx, user.ActiveOrg.Id)
+	if err == nil {
+		parentOrg := getParentOrg(ctx, foundOrg)
+		inheritanceMode := getInheritanceMode(parentOrg, "files")
+		if len(inheritanceMode) > 0 {
+			parentFiles, err := GetAllFiles(ctx, parentOrg.Id, namespace)
+			if err == nil {
+				parentOrgId = parentOrg.Id
+				files = getInheritedFiles(files, parentFiles, inheritanceMode)
+			}
+		}
+	}
+
 	sort.Slice(files[:], func(i, j int) bool {
 		return files[i].UpdatedAt > files[j].UpdatedAt
 	})
@@ -566,7 +583,7 @@ func HandleGetFileNamespace(resp http.ResponseWriter, request *http.Request) {
 		}
 
 		//log.Printf("File namespace: %s", file.Namespace)
-		if file.Namespace == namespace && file.OrgId == user.ActiveOrg.Id {
+		if file.Namespace == namespace && (file.OrgId == user.ActiveOrg.Id || (len(parentOrgId) > 0 && file.OrgId == parentOrgId)) {
 
 			// FIXME: This double control is silly
 			fileResponse.Files = append(fileResponse.Files, file)
@@ -890,6 +907,8 @@ func HandleGetFileContent(resp http.ResponseWriter, request *http.Request) {
 	found := false
 	if file.OrgId == user.ActiveOrg.Id {
 		found = true
+	} else if hasInheritedFileAccess(ctx, user, file) {
+		found = true
 	} else {
 		for _, item := range user.Orgs {
 			if item == file.OrgId {
@@ -1175,7 +1194,7 @@ func HandleEditFile(resp http.ResponseWriter, request *http.Request) {
 		user.Username = "Execution File API"
 	}
 
-	if user.Role == "org-reader" {
+	if Authorize(user, "files:write", "") != nil {
 		log.Printf("[WARNING] Org-reader doesn't have access to upload file: %s (%s)", user.Username, user.Id)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
@@ -1333,7 +1352,7 @@ func HandleUploadFile(resp http.ResponseWriter, request *http.Request) {
 		user.Username = "Execution File API"
 	}
 
-	if user.Role == "org-reader" {
+	if Authorize(user, "files:write", "") != nil {
 		log.Printf("[WARNING] Org-reader doesn't have access to upload file: %s (%s)", user.Username, user.Id)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
@@ -1467,6 +1486,7 @@ func uploadFile(ctx context.Context, file *File, encryptionKey string, contents
 		log.Printf("[INFO] Already found a file with the same Md5 '%s' for org '%s' in ID: %s. Referencing same location.", md5, file.OrgId, outputFile.Id)
 
 		file.Encrypted = outputFile.Encrypted
+		file.KeyVersion = outputFile.KeyVersion
 		file.FileSize = outputFile.FileSize
 		file.StorageArea = outputFile.StorageArea
 		file.DownloadPath = outputFile.DownloadPath
@@ -1492,6 +1512,7 @@ func uploadFile(ctx context.Context, file *File, encryptionKey string, contents
 			} else {
 				newContents = []byte(newFileValue)
 				file.Encrypted = true
+				file.KeyVersion = getEncryptionKeyVersion()
 			}
 
 			contents = newContents
@@ -1584,7 +1605,7 @@ func HandleCreateFile(resp http.ResponseWriter, request *http.Request) {
 		user.Username = "Execution File API"
 	}
 
-	if user.Role == "org-reader" {
+	if Authorize(user, "files:write", "") != nil {
 		log.Printf("[WARNING] Org-reader doesn't have access to edit files: %s (%s)", user.Username, user.Id)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
@@ -1832,7 +1853,7 @@ func HandleDownloadRemoteFiles(resp http.ResponseWriter, request *http.Request)
 		return
 	}
 
-	if user.Role != "admin" {
+	if Authorize(user, "files:manage", "") != nil {
 		log.Printf("Wrong user (%s) when downloading from github", user.Username)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Downloading remotely requires admin"}`))
@@ -457,7 +457,7 @@ func RunOpsHealthCheck(resp http.ResponseWriter, request *http.Request) {
 				continue
 			}
 
-			if user.Role == "admin" {
+			if hasOrgPermission(user, org.Id, "org:manage") {
 				log.Printf("[DEBUG] Found admin user with api key: %s", user.Id)
 				validIndex = index
 				break
@@ -567,7 +567,7 @@ func RunOpsHealthCheck(resp http.ResponseWriter, request *http.Request) {
 		// FIXME: Add a check for if it's been <interval> length at least between runs. This is 15 minutes by default.
 	}
 
-	if project.Environment == "onprem" && userInfo.Role != "admin" {
+	if project.Environment == "onprem" && Authorize(userInfo, "org:manage", "") != nil {
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Only admins can run health check!"}`))
 		return
@@ -1121,7 +1121,7 @@ func InitOpsWorkflow(apiKey string, OrgId string) (string, error) {
 		return "", errors.New("Ops dashboard user not found")
 	}
 
-	if user.Role != "admin" {
+	if Authorize(user, "org:manage", OrgId) != nil {
 		log.Printf("[WARNING] Ops dashboard user not admin. Not setting up ops workflow")
 		return "", errors.New("Ops dashboard user not admin")
 	}
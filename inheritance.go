@@ -0,0 +1,499 @@
+package shuffle
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Settings and resource types a parent org can pass down to its suborgs.
+//
+// inherited: the parent's value is a minimum. Suborgs can only be stricter,
+// and see the parent's resources next to their own.
+// enforced: the parent's value and resources are used as is. Suborgs can't
+// change them.
+// overridable: the parent's value and resources are used until the suborg
+// sets its own.
+var inheritanceSettings = []string{"mfa_required", "sso", "password_policy", "notification_workflow", "app_auth", "files", "workflows"}
+var inheritanceModes = []string{"inherited", "enforced", "overridable"}
+
+// Settings that only support some of the modes. Distributed workflows are
+// always kept in sync with the parent's, so suborgs can only be blocked
+// from changing them.
+var inheritanceSettingModes = map[string][]string{
+	"workflows": []string{"enforced"},
+}
+
+// Normalizes a rule and checks that its setting and mode exist
+func validateInheritanceRule(rule InheritanceRule) (InheritanceRule, error) {
+	rule.Setting = strings.ToLower(strings.TrimSpace(rule.Setting))
+	rule.Mode = strings.ToLower(strings.TrimSpace(rule.Mode))
+	if !ArrayContains(inheritanceSettings, rule.Setting) {
+		return rule, errors.New(fmt.Sprintf("Invalid setting '%s'. Available: %s", rule.Setting, strings.Join(inheritanceSettings, ", ")))
+	}
+
+	// An empty mode stops passing the setting down
+	if len(rule.Mode) == 0 {
+		return rule, nil
+	}
+
+	modes := inheritanceModes
+	if settingModes, ok := inheritanceSettingModes[rule.Setting]; ok {
+		modes = settingModes
+	}
+
+	if !ArrayContains(modes, rule.Mode) {
+		return rule, errors.New(fmt.Sprintf("Invalid mode '%s' for %s. Available: %s", rule.Mode, rule.Setting, strings.Join(modes, ", ")))
+	}
+
+	return rule, nil
+}
+
+func getInheritanceMode(parentOrg *Org, setting string) string {
+	if parentOrg == nil {
+		return ""
+	}
+
+	for _, rule := range parentOrg.Inheritance {
+		if rule.Setting == setting {
+			return rule.Mode
+		}
+	}
+
+	return ""
+}
+
+// Parents can't have parents, so there is only ever one level to check
+func getParentOrg(ctx context.Context, org *Org) *Org {
+	if org == nil || len(org.CreatorOrg) == 0 || org.CreatorOrg == org.Id {
+		return nil
+	}
+
+	parentOrg, err := GetOrg(ctx, org.CreatorOrg)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting parent org %s of org %s: %s", org.CreatorOrg, org.Id, err)
+		return nil
+	}
+
+	return parentOrg
+}
+
+// Returns the mode the parent of an org uses for a setting, or an empty
+// string if the org doesn't inherit it
+func getOrgInheritanceMode(ctx context.Context, orgId, setting string) string {
+	org, err := GetOrg(ctx, orgId)
+	if err != nil {
+		return ""
+	}
+
+	return getInheritanceMode(getParentOrg(ctx, org), setting)
+}
+
+// Combines two policies, keeping the strictest value of each field
+func getStricterPasswordPolicy(first, second PasswordPolicy) PasswordPolicy {
+	policy := first
+	if second.MinLength > policy.MinLength {
+		policy.MinLength = second.MinLength
+	}
+
+	policy.RequireUppercase = policy.RequireUppercase || second.RequireUppercase
+	policy.RequireLowercase = policy.RequireLowercase || second.RequireLowercase
+	policy.RequireNumber = policy.RequireNumber || second.RequireNumber
+	policy.RequireSpecial = policy.RequireSpecial || second.RequireSpecial
+
+	// 0 means passwords never expire and accounts use the default lockout
+	if second.MaxAgeDays > 0 && (policy.MaxAgeDays == 0 || second.MaxAgeDays < policy.MaxAgeDays) {
+		policy.MaxAgeDays = second.MaxAgeDays
+	}
+
+	if second.HistoryCount > policy.HistoryCount {
+		policy.HistoryCount = second.HistoryCount
+	}
+
+	if second.LockoutAttempts > 0 && (policy.LockoutAttempts == 0 || second.LockoutAttempts < policy.LockoutAttempts) {
+		policy.LockoutAttempts = second.LockoutAttempts
+	}
+
+	if second.LockoutMinutes > policy.LockoutMinutes {
+		policy.LockoutMinutes = second.LockoutMinutes
+	}
+
+	return policy
+}
+
+func hasSsoConfig(config SSOConfig) bool {
+	return len(config.SSOEntrypoint) > 0 || len(config.OpenIdAuthorization) > 0
+}
+
+// Client secrets and certificates stay in the org they belong to
+func getPublicSsoConfig(config SSOConfig) map[string]interface{} {
+	return map[string]interface{}{
+		"sso_entrypoint":       config.SSOEntrypoint,
+		"client_id":            config.OpenIdClientId,
+		"openid_authorization": config.OpenIdAuthorization,
+		"SSORequired":          config.SSORequired,
+	}
+}
+
+// Applies the parent's rules to a copy of the org and lists where each
+// setting ends up coming from
+func resolveOrgInheritance(org *Org, parentOrg *Org) (*Org, []EffectiveSetting) {
+	effectiveOrg := *org
+	settings := []EffectiveSetting{}
+
+	for _, setting := range inheritanceSettings {
+		mode := getInheritanceMode(parentOrg, setting)
+		source := org.Id
+		fromParent := len(mode) > 0 && !(mode == "overridable" && ArrayContains(org.InheritanceOverrides, setting))
+
+		var value interface{}
+		switch setting {
+		case "mfa_required":
+			if fromParent {
+				if mode != "inherited" || !org.MFARequired {
+					source = parentOrg.Id
+				}
+
+				effectiveOrg.MFARequired = parentOrg.MFARequired || (mode == "inherited" && org.MFARequired)
+			}
+
+			value = effectiveOrg.MFARequired
+		case "sso":
+			if fromParent {
+				if mode != "inherited" || !hasSsoConfig(org.SSOConfig) {
+					effectiveOrg.SSOConfig = parentOrg.SSOConfig
+					source = parentOrg.Id
+				} else if parentOrg.SSOConfig.SSORequired {
+					effectiveOrg.SSOConfig.SSORequired = true
+				}
+			}
+
+			value = getPublicSsoConfig(effectiveOrg.SSOConfig)
+		case "password_policy":
+			if fromParent {
+				if mode == "inherited" {
+					effectiveOrg.PasswordPolicy = getStricterPasswordPolicy(org.PasswordPolicy, parentOrg.PasswordPolicy)
+				} else {
+					effectiveOrg.PasswordPolicy = parentOrg.PasswordPolicy
+				}
+
+				source = parentOrg.Id
+			}
+
+			value = getPasswordPolicy(&effectiveOrg)
+		case "notification_workflow":
+			// "parent" makes notifications use the parent's workflow and API key
+			if fromParent && (mode != "inherited" || len(org.Defaults.NotificationWorkflow) == 0) {
+				effectiveOrg.Defaults.NotificationWorkflow = "parent"
+				source = parentOrg.Id
+			}
+
+			value = effectiveOrg.Defaults.NotificationWorkflow
+			if value == "parent" && parentOrg != nil {
+				value = parentOrg.Defaults.NotificationWorkflow
+				source = parentOrg.Id
+			}
+		default:
+			// Resources are resolved where they are loaded
+			if fromParent {
+				source = parentOrg.Id
+			}
+		}
+
+		settings = append(settings, EffectiveSetting{
+			Setting: setting,
+			Mode:    mode,
+			Source:  source,
+			Value:   value,
+		})
+	}
+
+	return &effectiveOrg, settings
+}
+
+// Returns the org with the settings it inherits from its parent applied.
+// The result is only for reading and should never be saved.
+func getEffectiveOrg(ctx context.Context, org *Org) *Org {
+	parentOrg := getParentOrg(ctx, org)
+	if parentOrg == nil || len(parentOrg.Inheritance) == 0 {
+		return org
+	}
+
+	effectiveOrg, _ := resolveOrgInheritance(org, parentOrg)
+	return effectiveOrg
+}
+
+// Checks if a suborg may change a setting. Changing an overridable setting
+// marks it as overridden, so the org has to be saved afterwards.
+func checkInheritedSetting(ctx context.Context, org *Org, setting string) error {
+	mode := getInheritanceMode(getParentOrg(ctx, org), setting)
+	if mode == "enforced" {
+		return errors.New(fmt.Sprintf("The setting %s is enforced by the parent org", strings.Replace(setting, "_", " ", -1)))
+	}
+
+	if mode == "overridable" && !ArrayContains(org.InheritanceOverrides, setting) {
+		org.InheritanceOverrides = append(org.InheritanceOverrides, setting)
+	}
+
+	return nil
+}
+
+// Merges a suborg's own app auth with the parent's. Without a rule only auth
+// the parent distributed explicitly is included.
+func getInheritedAppAuth(auths []AppAuthenticationStorage, parentAuths []AppAuthenticationStorage, mode string) []AppAuthenticationStorage {
+	parentApps := []string{}
+	ownApps := []string{}
+	for _, auth := range auths {
+		ownApps = append(ownApps, auth.App.ID)
+	}
+
+	for _, parentAuth := range parentAuths {
+		if len(mode) == 0 && !parentAuth.SuborgDistributed {
+			continue
+		}
+
+		if mode == "overridable" && ArrayContains(ownApps, parentAuth.App.ID) {
+			continue
+		}
+
+		parentApps = append(parentApps, parentAuth.App.ID)
+		auths = append(auths, parentAuth)
+	}
+
+	if mode != "enforced" {
+		return auths
+	}
+
+	newAuths := []AppAuthenticationStorage{}
+	for _, auth := range auths {
+		if ArrayContains(parentApps, auth.App.ID) && auth.OrgId != parentAuths[0].OrgId {
+			continue
+		}
+
+		newAuths = append(newAuths, auth)
+	}
+
+	return newAuths
+}
+
+// Merges a suborg's own files with the parent's by namespace and filename
+func getInheritedFiles(files []File, parentFiles []File, mode string) []File {
+	if len(mode) == 0 || len(parentFiles) == 0 {
+		return files
+	}
+
+	getFileKey := func(file File) string {
+		return fmt.Sprintf("%s/%s", file.Namespace, file.Filename)
+	}
+
+	ownKeys := []string{}
+	for _, file := range files {
+		ownKeys = append(ownKeys, getFileKey(file))
+	}
+
+	parentKeys := []string{}
+	for _, parentFile := range parentFiles {
+		if mode == "overridable" && ArrayContains(ownKeys, getFileKey(parentFile)) {
+			continue
+		}
+
+		parentKeys = append(parentKeys, getFileKey(parentFile))
+		files = append(files, parentFile)
+	}
+
+	if mode != "enforced" {
+		return files
+	}
+
+	newFiles := []File{}
+	for _, file := range files {
+		if ArrayContains(parentKeys, getFileKey(file)) && file.OrgId != parentFiles[0].OrgId {
+			continue
+		}
+
+		newFiles = append(newFiles, file)
+	}
+
+	return newFiles
+}
+
+// Checks if a file belongs to the parent of the user's active org, and the
+// parent shares its files
+func hasInheritedFileAccess(ctx context.Context, user User, file *File) bool {
+	if file == nil || len(file.OrgId) == 0 || file.OrgId == user.ActiveOrg.Id {
+		return false
+	}
+
+	org, err := GetOrg(ctx, user.ActiveOrg.Id)
+	if err != nil || org.CreatorOrg != file.OrgId {
+		return false
+	}
+
+	return len(getOrgInheritanceMode(ctx, org.Id, "files")) > 0
+}
+
+// Sets which settings and resources the active org passes down to its suborgs
+func HandleSetInheritancePolicy(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in set inheritance policy: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if Authorize(user, "org:manage", "") != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "You don't have access to change the inheritance policy"}`))
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		log.Printf("[WARNING] Failed reading body in set inheritance policy: %s", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	var rules []InheritanceRule
+	err = json.Unmarshal(body, &rules)
+	if err != nil {
+		log.Printf("[WARNING] Failed unmarshalling inheritance policy: %s", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Failed parsing inheritance policy"}`))
+		return
+	}
+
+	newRules := []InheritanceRule{}
+	handledSettings := []string{}
+	for _, rule := range rules {
+		rule, err = validateInheritanceRule(rule)
+		if err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+			return
+		}
+
+		if ArrayContains(handledSettings, rule.Setting) {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Duplicate setting '%s'"}`, rule.Setting)))
+			return
+		}
+
+		if len(rule.Mode) == 0 {
+			continue
+		}
+
+		handledSettings = append(handledSettings, rule.Setting)
+		newRules = append(newRules, rule)
+	}
+
+	ctx := GetContext(request)
+	org, err := GetOrg(ctx, user.ActiveOrg.Id)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting org %s for inheritance policy: %s", user.ActiveOrg.Id, err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if len(org.CreatorOrg) > 0 && org.CreatorOrg != org.Id {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Suborgs can't pass settings down further"}`))
+		return
+	}
+
+	oldRules := org.Inheritance
+	org.Inheritance = newRules
+	err = SetOrg(ctx, *org, org.Id)
+	if err != nil {
+		log.Printf("[ERROR] Failed saving inheritance policy for org %s: %s", org.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	// Suborgs cache their auth and workflows including the parent's
+	for _, childOrg := range org.ChildOrgs {
+		DeleteCache(ctx, fmt.Sprintf("workflowappauth_%s", childOrg.Id))
+		DeleteCache(ctx, fmt.Sprintf("%s_workflows", childOrg.Id))
+	}
+
+	log.Printf("[AUDIT] User %s (%s) updated the inheritance policy of org %s", user.Username, user.Id, org.Id)
+	CreateAuditEvent(ctx, request, user, org.Id, "org.inheritance_update", "org", org.Id, oldRules, newRules)
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
+
+// Returns the settings that apply to an org after inheritance. Parent org
+// admins can look at any of their suborgs with ?org_id=
+func HandleGetEffectiveSettings(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in get effective settings: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	orgId := user.ActiveOrg.Id
+	if len(request.URL.Query().Get("org_id")) > 0 {
+		orgId = request.URL.Query().Get("org_id")
+	}
+
+	ctx := GetContext(request)
+	org, err := GetOrg(ctx, orgId)
+	if err != nil {
+		resp.WriteHeader(404)
+		resp.Write([]byte(`{"success": false, "reason": "Org not found"}`))
+		return
+	}
+
+	parentAdmin := org.CreatorOrg == user.ActiveOrg.Id && isOrgMember(user) && Authorize(user, "org:manage", "") == nil
+	if !ArrayContains(user.Orgs, org.Id) && !parentAdmin {
+		log.Printf("[AUDIT] User %s (%s) tried to get effective settings of org %s without access", user.Username, user.Id, org.Id)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "You don't have access to this org"}`))
+		return
+	}
+
+	parentOrg := getParentOrg(ctx, org)
+	_, settings := resolveOrgInheritance(org, parentOrg)
+
+	effectiveSettings := EffectiveOrgSettings{
+		Success:  true,
+		OrgId:    org.Id,
+		Settings: settings,
+	}
+
+	if parentOrg != nil {
+		effectiveSettings.ParentOrgId = parentOrg.Id
+	}
+
+	newjson, err := json.Marshal(effectiveSettings)
+	if err != nil {
+		log.Printf("[WARNING] Failed marshalling effective settings: %s", err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
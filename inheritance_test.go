@@ -0,0 +1,37 @@
+package shuffle
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateInheritanceRule(t *testing.T) {
+	rule, err := validateInheritanceRule(InheritanceRule{Setting: " Files ", Mode: "Overridable"})
+	if err != nil || rule.Setting != "files" || rule.Mode != "overridable" {
+		t.Errorf("validateInheritanceRule = %#v, %v; expected a normalized rule", rule, err)
+	}
+
+	if _, err := validateInheritanceRule(InheritanceRule{Setting: "workflows", Mode: "enforced"}); err != nil {
+		t.Errorf("Enforced workflows were rejected: %s", err)
+	}
+
+	// Distributed workflows are always synced from the parent, so only enforcing them does anything
+	for _, mode := range []string{"inherited", "overridable"} {
+		_, err := validateInheritanceRule(InheritanceRule{Setting: "workflows", Mode: mode})
+		if err == nil || !strings.Contains(err.Error(), "Available: enforced") {
+			t.Errorf("Workflows with mode %s = %v; expected it to be rejected", mode, err)
+		}
+	}
+
+	if _, err := validateInheritanceRule(InheritanceRule{Setting: "workflows"}); err != nil {
+		t.Errorf("Removing the workflows rule was rejected: %s", err)
+	}
+
+	if _, err := validateInheritanceRule(InheritanceRule{Setting: "unknown", Mode: "enforced"}); err == nil {
+		t.Errorf("Unknown setting was accepted")
+	}
+
+	if _, err := validateInheritanceRule(InheritanceRule{Setting: "sso", Mode: "unknown"}); err == nil {
+		t.Errorf("Unknown mode was accepted")
+	}
+}
@@ -0,0 +1,734 @@
+package shuffle
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Encryption keys are versioned. Version 1 is SHUFFLE_ENCRYPTION_MODIFIER,
+// and a key is rotated by defining SHUFFLE_ENCRYPTION_MODIFIER_V2, _V3 etc.
+// New values are always encrypted with the highest defined version, and are
+// prefixed with it ("$v2$...") unless it's version 1.
+//
+// A rotation re-encrypts everything handleKeyEncryption writes: app auth, files,
+// workflow git backup tokens, org git backup defaults, SAML SP private keys and
+// webhook secrets. KMS values are only cached for kmsCacheMinutes, so the
+// rotation waits that long.
+// An old modifier can be removed once a rotation has finished without failures.
+
+// The highest SHUFFLE_ENCRYPTION_MODIFIER_V<n> that is looked up
+const maxEncryptionKeyVersion = 100
+
+func getEncryptionModifier(version int) string {
+	if version <= 1 {
+		return os.Getenv("SHUFFLE_ENCRYPTION_MODIFIER")
+	}
+
+	return os.Getenv(fmt.Sprintf("SHUFFLE_ENCRYPTION_MODIFIER_V%d", version))
+}
+
+func getEncryptionKeyVersions() []int {
+	versions := []int{}
+	for version := 1; version <= maxEncryptionKeyVersion; version++ {
+		if len(getEncryptionModifier(version)) > 0 {
+			versions = append(versions, version)
+		}
+	}
+
+	return versions
+}
+
+// The version new values are encrypted with
+func getEncryptionKeyVersion() int {
+	versions := getEncryptionKeyVersions()
+	if len(versions) == 0 {
+		return 1
+	}
+
+	return versions[len(versions)-1]
+}
+
+func addEncryptionVersion(value string, version int) string {
+	if version <= 1 {
+		return value
+	}
+
+	return fmt.Sprintf("$v%d$%s", version, value)
+}
+
+// Returns the key version and the value without its version prefix.
+// Values without a prefix are from before keys were versioned.
+func parseEncryptionVersion(data []byte) (int, []byte) {
+	if !bytes.HasPrefix(data, []byte("$v")) {
+		return 1, data
+	}
+
+	end := bytes.IndexByte(data[2:], '$')
+	if end <= 0 {
+		return 1, data
+	}
+
+	version, err := strconv.Atoi(string(data[2 : end+2]))
+	if err != nil || version <= 1 {
+		return 1, data
+	}
+
+	return version, data[end+3:]
+}
+
+func getValueKeyVersion(value string) int {
+	version, _ := parseEncryptionVersion([]byte(value))
+	return version
+}
+
+// Re-encrypts every field of the auth with the current key version.
+// The key is the same one SetWorkflowAppAuthDatastore encrypts with.
+func rotateAppAuthKey(auth AppAuthenticationStorage) (AppAuthenticationStorage, error) {
+	newFields := []AuthenticationStore{}
+	for _, field := range auth.Fields {
+		parsedKey := fmt.Sprintf("%s_%d_%s_%s", auth.OrgId, auth.Created, auth.Label, field.Key)
+		decrypted, err := HandleKeyDecryption([]byte(field.Value), parsedKey)
+		if err != nil {
+			return auth, errors.New(fmt.Sprintf("Failed decrypting field %s: %s", field.Key, err))
+		}
+
+		encrypted, err := handleKeyEncryption(decrypted, parsedKey)
+		if err != nil {
+			return auth, errors.New(fmt.Sprintf("Failed encrypting field %s: %s", field.Key, err))
+		}
+
+		field.Value = string(encrypted)
+		newFields = append(newFields, field)
+	}
+
+	auth.Fields = newFields
+	auth.KeyVersion = getEncryptionKeyVersion()
+	return auth, nil
+}
+
+// Reads the stored file without decrypting it
+func readStoredFile(ctx context.Context, file File) ([]byte, error) {
+	if project.Environment == "cloud" || file.StorageArea == "google_storage" {
+		reader, err := project.StorageClient.Bucket(orgFileBucket).Object(file.DownloadPath).NewReader(ctx)
+		if err != nil {
+			return []byte{}, err
+		}
+
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+	}
+
+	return ioutil.ReadFile(file.DownloadPath)
+}
+
+// Overwrites the stored file, unlike uploadFile which appends to it.
+// Both replace the content in one step, so a failed write never leaves half a file:
+// a bucket object is only replaced when the writer is closed, and local files are
+// written to a temporary file next to it before being renamed into place.
+func writeStoredFile(ctx context.Context, file File, data []byte) error {
+	if project.Environment == "cloud" || file.StorageArea == "google_storage" {
+		writer := project.StorageClient.Bucket(orgFileBucket).Object(file.DownloadPath).NewWriter(ctx)
+		if _, err := writer.Write(data); err != nil {
+			writer.Close()
+			return err
+		}
+
+		return writer.Close()
+	}
+
+	return writeFileAtomic(file.DownloadPath, data)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".rotate-")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := tmpFile.Name()
+	_, err = tmpFile.Write(data)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+
+	closeErr := tmpFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	// Keeps the permissions of the file being replaced
+	if err == nil {
+		if info, statErr := os.Stat(path); statErr == nil {
+			err = os.Chmod(tmpPath, info.Mode().Perm())
+		}
+	}
+
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
+
+// Files referencing another file's content may be encrypted with either
+// key, the same way GetFileContent falls back when decrypting.
+func rotateFileKey(ctx context.Context, file File) error {
+	data, err := readStoredFile(ctx, file)
+	if err != nil {
+		return err
+	}
+
+	data = bytes.TrimSpace(data)
+	if getValueKeyVersion(string(data)) == getEncryptionKeyVersion() {
+		return nil
+	}
+
+	passphrase := fmt.Sprintf("%s_%s", file.OrgId, file.Id)
+	decrypted, err := HandleKeyDecryption(data, passphrase)
+	if err != nil && len(file.ReferenceFileId) > 0 {
+		passphrase = fmt.Sprintf("%s_%s", file.OrgId, file.ReferenceFileId)
+		decrypted, err = HandleKeyDecryption(data, passphrase)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := handleKeyEncryption(decrypted, passphrase)
+	if err != nil {
+		return err
+	}
+
+	return writeStoredFile(ctx, file, encrypted)
+}
+
+// Re-encrypts a single value with the current key version.
+// Returns false if the value already uses it.
+func rotateEncryptedValue(value, passphrase string, oldVersions map[int]bool) (string, bool, error) {
+	valueVersion := getValueKeyVersion(value)
+	if len(value) == 0 || valueVersion == getEncryptionKeyVersion() {
+		return value, false, nil
+	}
+
+	decrypted, err := HandleKeyDecryption([]byte(value), passphrase)
+	if err != nil {
+		return value, false, err
+	}
+
+	encrypted, err := handleKeyEncryption(decrypted, passphrase)
+	if err != nil {
+		return value, false, err
+	}
+
+	oldVersions[valueVersion] = true
+	return string(encrypted), true, nil
+}
+
+// Git backup tokens are encrypted per org and field, the same way
+// SaveWorkflow encrypts them and SetGitWorkflow decrypts them
+func rotateBackupTokens(orgId string, tokens map[string]*string, oldVersions map[int]bool) (bool, error) {
+	changed := false
+	for name, value := range tokens {
+		newValue, rotated, err := rotateEncryptedValue(*value, fmt.Sprintf("%s_%s", orgId, name), oldVersions)
+		if err != nil {
+			return false, errors.New(fmt.Sprintf("Failed rotating %s: %s", name, err))
+		}
+
+		if rotated {
+			*value = newValue
+			changed = true
+		}
+	}
+
+	return changed, nil
+}
+
+func rotateWorkflowBackupKeys(workflow Workflow, oldVersions map[int]bool) (Workflow, bool, error) {
+	if !workflow.BackupConfig.TokensEncrypted {
+		return workflow, false, nil
+	}
+
+	changed, err := rotateBackupTokens(workflow.OrgId, map[string]*string{
+		"upload_repo":     &workflow.BackupConfig.UploadRepo,
+		"upload_branch":   &workflow.BackupConfig.UploadBranch,
+		"upload_username": &workflow.BackupConfig.UploadUsername,
+		"upload_token":    &workflow.BackupConfig.UploadToken,
+	}, oldVersions)
+
+	return workflow, changed, err
+}
+
+func rotateOrgBackupKeys(org Org, oldVersions map[int]bool) (Org, bool, error) {
+	if !org.Defaults.TokensEncrypted {
+		return org, false, nil
+	}
+
+	changed, err := rotateBackupTokens(org.Id, map[string]*string{
+		"upload_repo":     &org.Defaults.WorkflowUploadRepo,
+		"upload_branch":   &org.Defaults.WorkflowUploadBranch,
+		"upload_username": &org.Defaults.WorkflowUploadUsername,
+		"upload_token":    &org.Defaults.WorkflowUploadToken,
+	}, oldVersions)
+
+	return org, changed, err
+}
+
+func rotateOrgSamlKey(org Org, oldVersions map[int]bool) (Org, bool, error) {
+	if !org.SamlConfig.SPKeyEncrypted {
+		return org, false, nil
+	}
+
+	newKey, changed, err := rotateEncryptedValue(org.SamlConfig.SPPrivateKey, getSamlKeyPassphrase(org.Id), oldVersions)
+	if err != nil {
+		return org, false, errors.New(fmt.Sprintf("Failed rotating SAML SP key: %s", err))
+	}
+
+	org.SamlConfig.SPPrivateKey = newKey
+	return org, changed, nil
+}
+
+func rotateHookKey(hook Hook, oldVersions map[int]bool) (Hook, bool, error) {
+	if !hook.Signature.SecretEncrypted {
+		return hook, false, nil
+	}
+
+	newSecret, changed, err := rotateEncryptedValue(hook.Signature.Secret, getHookSecretPassphrase(hook), oldVersions)
+	if err != nil {
+		return hook, false, err
+	}
+
+	hook.Signature.Secret = newSecret
+	return hook, changed, nil
+}
+
+type keyRotationCounts struct {
+	auths       ResourceCount
+	files       ResourceCount
+	workflows   ResourceCount
+	orgs        ResourceCount
+	hooks       ResourceCount
+	oldVersions map[int]bool
+}
+
+func newKeyRotationCounts() *keyRotationCounts {
+	return &keyRotationCounts{
+		auths:       ResourceCount{ResourceType: "app_auth", Ids: []string{}, Failed: []string{}},
+		files:       ResourceCount{ResourceType: "file", Ids: []string{}, Failed: []string{}},
+		workflows:   ResourceCount{ResourceType: "workflow_backup", Ids: []string{}, Failed: []string{}},
+		orgs:        ResourceCount{ResourceType: "org", Ids: []string{}, Failed: []string{}},
+		hooks:       ResourceCount{ResourceType: "webhook", Ids: []string{}, Failed: []string{}},
+		oldVersions: map[int]bool{},
+	}
+}
+
+func (counts *keyRotationCounts) all() []ResourceCount {
+	return []ResourceCount{counts.auths, counts.files, counts.workflows, counts.orgs, counts.hooks}
+}
+
+func (counts *keyRotationCounts) failed() bool {
+	for _, count := range counts.all() {
+		if len(count.Failed) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func rotateOrgKeys(ctx context.Context, org Org, counts *keyRotationCounts) {
+	version := getEncryptionKeyVersion()
+	authCount := &counts.auths
+	fileCount := &counts.files
+	oldVersions := counts.oldVersions
+
+	// Skips the cache to not miss auths that were changed recently
+	DeleteCache(ctx, fmt.Sprintf("workflowappauth_%s", org.Id))
+	auths, err := GetAllWorkflowAppAuth(ctx, org.Id)
+	if err != nil && len(auths) == 0 {
+		log.Printf("[WARNING] Failed getting app auth for key rotation in org %s: %s", org.Id, err)
+		authCount.Failed = append(authCount.Failed, org.Id)
+	}
+
+	for _, auth := range auths {
+		// Parent auths are distributed to suborgs
+		if auth.OrgId != org.Id || !auth.Encrypted {
+			continue
+		}
+
+		rotate := false
+		for _, field := range auth.Fields {
+			fieldVersion := getValueKeyVersion(field.Value)
+			if fieldVersion != version {
+				oldVersions[fieldVersion] = true
+				rotate = true
+			}
+		}
+
+		if !rotate {
+			continue
+		}
+
+		newAuth, err := rotateAppAuthKey(auth)
+		if err == nil {
+			err = SetWorkflowAppAuthDatastore(ctx, newAuth, newAuth.Id)
+		}
+
+		if err != nil {
+			log.Printf("[WARNING] Failed rotating key of app auth %s in org %s: %s", auth.Id, org.Id, err)
+			authCount.Failed = append(authCount.Failed, auth.Id)
+			continue
+		}
+
+		authCount.Count += 1
+		authCount.Ids = append(authCount.Ids, auth.Id)
+	}
+
+	DeleteCache(ctx, fmt.Sprintf("files_%s_", org.Id))
+	files, err := GetAllFiles(ctx, org.Id, "")
+	if err != nil && len(files) == 0 {
+		log.Printf("[WARNING] Failed getting files for key rotation in org %s: %s", org.Id, err)
+		fileCount.Failed = append(fileCount.Failed, org.Id)
+	}
+
+	// Files with the same content share a location
+	handledPaths := []string{}
+	for _, file := range files {
+		if file.OrgId != org.Id || !file.Encrypted || file.Status == "deleted" {
+			continue
+		}
+
+		fileVersion := file.KeyVersion
+		if fileVersion <= 1 {
+			fileVersion = 1
+		}
+
+		if fileVersion == version {
+			continue
+		}
+
+		oldVersions[fileVersion] = true
+		if !ArrayContains(handledPaths, file.DownloadPath) {
+			err = rotateFileKey(ctx, file)
+			if err != nil {
+				log.Printf("[WARNING] Failed rotating key of file %s in org %s: %s", file.Id, org.Id, err)
+				fileCount.Failed = append(fileCount.Failed, file.Id)
+				continue
+			}
+
+			handledPaths = append(handledPaths, file.DownloadPath)
+		}
+
+		file.KeyVersion = version
+		err = SetFile(ctx, file)
+		if err != nil {
+			log.Printf("[WARNING] Failed updating key version of file %s in org %s: %s", file.Id, org.Id, err)
+			fileCount.Failed = append(fileCount.Failed, file.Id)
+			continue
+		}
+
+		fileCount.Count += 1
+		fileCount.Ids = append(fileCount.Ids, file.Id)
+	}
+
+	newOrg, changed, err := rotateOrgBackupKeys(org, oldVersions)
+	if err == nil {
+		samlChanged := false
+		newOrg, samlChanged, err = rotateOrgSamlKey(newOrg, oldVersions)
+		changed = changed || samlChanged
+	}
+
+	if err == nil && changed {
+		err = SetOrg(ctx, newOrg, newOrg.Id)
+	}
+
+	if err != nil {
+		log.Printf("[WARNING] Failed rotating keys of org %s: %s", org.Id, err)
+		counts.orgs.Failed = append(counts.orgs.Failed, org.Id)
+	} else if changed {
+		counts.orgs.Count += 1
+		counts.orgs.Ids = append(counts.orgs.Ids, org.Id)
+	}
+
+	// A user with only the org's ID, to list all of its workflows
+	orgUser := User{
+		Username:  "key_rotation",
+		Role:      "admin",
+		ActiveOrg: OrgMini{Id: org.Id, Role: "admin"},
+	}
+
+	workflows, err := GetAllWorkflowsByQuery(ctx, orgUser, 250, "")
+	if err != nil && len(workflows) == 0 {
+		log.Printf("[WARNING] Failed getting workflows for key rotation in org %s: %s", org.Id, err)
+		counts.workflows.Failed = append(counts.workflows.Failed, org.Id)
+	}
+
+	for _, workflow := range workflows {
+		if workflow.OrgId != org.Id {
+			continue
+		}
+
+		newWorkflow, changed, err := rotateWorkflowBackupKeys(workflow, oldVersions)
+		if err == nil && changed {
+			err = SetWorkflow(ctx, newWorkflow, newWorkflow.ID)
+		}
+
+		if err != nil {
+			log.Printf("[WARNING] Failed rotating git backup keys of workflow %s in org %s: %s", workflow.ID, org.Id, err)
+			counts.workflows.Failed = append(counts.workflows.Failed, workflow.ID)
+			continue
+		}
+
+		if changed {
+			counts.workflows.Count += 1
+			counts.workflows.Ids = append(counts.workflows.Ids, workflow.ID)
+		}
+	}
+
+	hooks, err := GetHooks(ctx, org.Id)
+	if err != nil && len(hooks) == 0 {
+		log.Printf("[WARNING] Failed getting webhooks for key rotation in org %s: %s", org.Id, err)
+		counts.hooks.Failed = append(counts.hooks.Failed, org.Id)
+	}
+
+	for _, hook := range hooks {
+		if hook.OrgId != org.Id {
+			continue
+		}
+
+		newHook, changed, err := rotateHookKey(hook, oldVersions)
+		if err == nil && changed {
+			err = SetHook(ctx, newHook)
+		}
+
+		if err != nil {
+			log.Printf("[WARNING] Failed rotating secret of webhook %s in org %s: %s", hook.Id, org.Id, err)
+			counts.hooks.Failed = append(counts.hooks.Failed, hook.Id)
+			continue
+		}
+
+		if changed {
+			counts.hooks.Count += 1
+			counts.hooks.Ids = append(counts.hooks.Ids, hook.Id)
+		}
+	}
+}
+
+// KMS values are cached encrypted with the key version they were fetched with.
+// They can't be listed, so the rotation outlives them instead.
+func waitForKmsCache(started int64) {
+	expiry := time.Unix(started, 0).Add(time.Duration(kmsCacheMinutes) * time.Minute)
+	if wait := time.Until(expiry); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// Re-encrypts everything that is encrypted with an old key version.
+// Old key versions stay in use until this finishes without failures.
+func runKeyRotation(ctx context.Context, rotation KeyRotation) KeyRotation {
+	counts := newKeyRotationCounts()
+	orgs, err := GetAllOrgs(ctx)
+	if err != nil && len(orgs) == 0 {
+		log.Printf("[ERROR] Failed getting orgs for key rotation %s: %s", rotation.Id, err)
+		rotation.Status = "failed"
+		rotation.Reason = "Failed getting organizations"
+	} else {
+		for _, org := range orgs {
+			rotateOrgKeys(ctx, org, counts)
+		}
+
+		waitForKmsCache(rotation.Started)
+
+		rotation.Status = "finished"
+		if counts.failed() {
+			rotation.Status = "failed"
+			rotation.Reason = "Some records could not be migrated. Keep the old key versions defined and retry."
+		}
+	}
+
+	rotation.OldVersions = []int{}
+	for version := range counts.oldVersions {
+		rotation.OldVersions = append(rotation.OldVersions, version)
+	}
+
+	sort.Ints(rotation.OldVersions)
+	rotation.Counts = counts.all()
+	rotation.Completed = time.Now().Unix()
+
+	err = SetKeyRotation(ctx, rotation)
+	if err != nil {
+		log.Printf("[ERROR] Failed saving key rotation %s: %s", rotation.Id, err)
+	}
+
+	for _, count := range rotation.Counts {
+		log.Printf("[INFO] Key rotation to version %d: migrated %d %s. Failed: %d", rotation.KeyVersion, count.Count, count.ResourceType, len(count.Failed))
+	}
+
+	log.Printf("[INFO] Key rotation to version %d %s", rotation.KeyVersion, rotation.Status)
+	return rotation
+}
+
+// Can be used to run the rotation in the background, e.g. on startup
+// after a new key version has been defined.
+func RunKeyRotation(ctx context.Context) (KeyRotation, error) {
+	rotation, err := startKeyRotation(ctx, "")
+	if err != nil {
+		return rotation, err
+	}
+
+	return runKeyRotation(ctx, rotation), nil
+}
+
+func startKeyRotation(ctx context.Context, userId string) (KeyRotation, error) {
+	version := getEncryptionKeyVersion()
+	if len(getEncryptionModifier(version)) == 0 {
+		return KeyRotation{}, errors.New("No encryption modifier set")
+	}
+
+	rotationId := fmt.Sprintf("v%d", version)
+	oldRotation, err := GetKeyRotation(ctx, rotationId)
+	if err == nil && oldRotation.Status == "running" && oldRotation.Started > time.Now().Add(-1*time.Hour).Unix() {
+		return *oldRotation, errors.New(fmt.Sprintf("Key rotation to version %d is already running", version))
+	}
+
+	rotation := KeyRotation{
+		Id:          rotationId,
+		KeyVersion:  version,
+		Status:      "running",
+		OldVersions: []int{},
+		Counts:      []ResourceCount{},
+		StartedBy:   userId,
+		Started:     time.Now().Unix(),
+	}
+
+	err = SetKeyRotation(ctx, rotation)
+	if err != nil {
+		return rotation, err
+	}
+
+	log.Printf("[INFO] Started key rotation to version %d", version)
+	return rotation, nil
+}
+
+// Key rotation affects every org on the instance, so only the users
+// listed in SHUFFLE_INSTANCE_OWNERS (comma separated user IDs) may run it
+func hasKeyRotationAccess(user User) bool {
+	if len(user.Id) == 0 || len(user.ApiKeyId) > 0 {
+		return false
+	}
+
+	for _, ownerId := range strings.Split(os.Getenv("SHUFFLE_INSTANCE_OWNERS"), ",") {
+		ownerId = strings.TrimSpace(ownerId)
+		if len(ownerId) > 0 && subtle.ConstantTimeCompare([]byte(ownerId), []byte(user.Id)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func HandleStartKeyRotation(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in start key rotation: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if !hasKeyRotationAccess(user) {
+		log.Printf("[AUDIT] User %s (%s) tried to start key rotation without access", user.Username, user.Id)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	rotation, err := startKeyRotation(ctx, user.Id)
+	if err != nil {
+		log.Printf("[WARNING] Failed starting key rotation: %s", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	go runKeyRotation(context.Background(), rotation)
+
+	log.Printf("[AUDIT] User %s (%s) started key rotation to version %d", user.Username, user.Id, rotation.KeyVersion)
+	CreateAuditEvent(ctx, request, user, user.ActiveOrg.Id, "encryption.rotate", "key_rotation", rotation.Id, nil, nil)
+	resp.WriteHeader(200)
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "id": "%s", "key_version": %d}`, rotation.Id, rotation.KeyVersion)))
+}
+
+// Shows the rotation to the current key version, and which key
+// versions are defined and can be decrypted.
+func HandleGetKeyRotation(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in get key rotation: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if !hasKeyRotationAccess(user) {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	version := getEncryptionKeyVersion()
+	rotation, err := GetKeyRotation(ctx, fmt.Sprintf("v%d", version))
+	if err != nil {
+		rotation = &KeyRotation{}
+	}
+
+	newjson, err := json.Marshal(struct {
+		Success     bool        `json:"success"`
+		KeyVersion  int         `json:"key_version"`
+		KeyVersions []int       `json:"key_versions"`
+		Rotation    KeyRotation `json:"rotation"`
+	}{
+		Success:     true,
+		KeyVersion:  version,
+		KeyVersions: getEncryptionKeyVersions(),
+		Rotation:    *rotation,
+	})
+	if err != nil {
+		log.Printf("[WARNING] Failed marshalling key rotation: %s", err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
@@ -0,0 +1,191 @@
+package shuffle
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotateEncryptedValue(t *testing.T) {
+	t.Setenv("SHUFFLE_ENCRYPTION_MODIFIER", "rotation-test-v1")
+
+	encrypted, err := handleKeyEncryption([]byte("value"), "passphrase")
+	if err != nil {
+		t.Fatalf("Failed encrypting with version 1: %s", err)
+	}
+
+	t.Setenv("SHUFFLE_ENCRYPTION_MODIFIER_V2", "rotation-test-v2")
+	oldVersions := map[int]bool{}
+	rotated, changed, err := rotateEncryptedValue(string(encrypted), "passphrase", oldVersions)
+	if err != nil || !changed {
+		t.Fatalf("rotateEncryptedValue = %v, %v; expected the value to be rotated", changed, err)
+	}
+
+	if getValueKeyVersion(rotated) != 2 || !oldVersions[1] {
+		t.Errorf("Rotated value has version %d and old versions %v; expected 2 and [1]", getValueKeyVersion(rotated), oldVersions)
+	}
+
+	decrypted, err := HandleKeyDecryption([]byte(rotated), "passphrase")
+	if err != nil || string(decrypted) != "value" {
+		t.Errorf("Rotated value decrypted to %#v (%v)", string(decrypted), err)
+	}
+
+	_, changed, err = rotateEncryptedValue(rotated, "passphrase", oldVersions)
+	if err != nil || changed {
+		t.Errorf("Value on the current version was rotated again: %v, %v", changed, err)
+	}
+
+	_, _, err = rotateEncryptedValue(string(encrypted), "wrong passphrase", oldVersions)
+	if err == nil {
+		t.Errorf("Value was rotated with the wrong passphrase")
+	}
+}
+
+func TestRotateBackupAndHookKeys(t *testing.T) {
+	t.Setenv("SHUFFLE_ENCRYPTION_MODIFIER", "rotation-test-v1")
+
+	encrypt := func(value, passphrase string) string {
+		encrypted, err := handleKeyEncryption([]byte(value), passphrase)
+		if err != nil {
+			t.Fatalf("Failed encrypting %s: %s", value, err)
+		}
+
+		return string(encrypted)
+	}
+
+	workflow := Workflow{ID: "workflow", OrgId: "org"}
+	workflow.BackupConfig.TokensEncrypted = true
+	workflow.BackupConfig.UploadRepo = encrypt("github.com/org/repo", "org_upload_repo")
+	workflow.BackupConfig.UploadToken = encrypt("token", "org_upload_token")
+
+	org := Org{Id: "org"}
+	org.Defaults.TokensEncrypted = true
+	org.Defaults.WorkflowUploadUsername = encrypt("username", "org_upload_username")
+
+	hook := encryptHookSecret(Hook{Id: "hook", OrgId: "org", Signature: HookSignature{Scheme: "github", Secret: "secret"}})
+	org.SamlConfig = encryptSamlPrivateKey(org.Id, SamlConfig{SPPrivateKey: "sp-private-key"})
+
+	t.Setenv("SHUFFLE_ENCRYPTION_MODIFIER_V2", "rotation-test-v2")
+	oldVersions := map[int]bool{}
+
+	newWorkflow, changed, err := rotateWorkflowBackupKeys(workflow, oldVersions)
+	if err != nil || !changed {
+		t.Fatalf("rotateWorkflowBackupKeys = %v, %v; expected the tokens to be rotated", changed, err)
+	}
+
+	if getValueKeyVersion(newWorkflow.BackupConfig.UploadRepo) != 2 || getValueKeyVersion(newWorkflow.BackupConfig.UploadToken) != 2 || len(newWorkflow.BackupConfig.UploadBranch) > 0 {
+		t.Errorf("Workflow backup tokens weren't rotated: %#v", newWorkflow.BackupConfig)
+	}
+
+	token, err := HandleKeyDecryption([]byte(newWorkflow.BackupConfig.UploadToken), "org_upload_token")
+	if err != nil || string(token) != "token" {
+		t.Errorf("Rotated workflow token decrypted to %#v (%v)", string(token), err)
+	}
+
+	newOrg, changed, err := rotateOrgBackupKeys(org, oldVersions)
+	if err != nil || !changed || getValueKeyVersion(newOrg.Defaults.WorkflowUploadUsername) != 2 {
+		t.Errorf("rotateOrgBackupKeys = %v, %v; expected the username to be rotated", changed, err)
+	}
+
+	newOrg, changed, err = rotateOrgSamlKey(newOrg, oldVersions)
+	if err != nil || !changed || getValueKeyVersion(newOrg.SamlConfig.SPPrivateKey) != 2 {
+		t.Fatalf("rotateOrgSamlKey = %v, %v; expected the SP key to be rotated", changed, err)
+	}
+
+	privateKey, err := getSamlPrivateKey(&newOrg)
+	if err != nil || privateKey != "sp-private-key" {
+		t.Errorf("Rotated SP key decrypted to %#v (%v)", privateKey, err)
+	}
+
+	newHook, changed, err := rotateHookKey(hook, oldVersions)
+	if err != nil || !changed || getValueKeyVersion(newHook.Signature.Secret) != 2 {
+		t.Fatalf("rotateHookKey = %v, %v; expected the secret to be rotated", changed, err)
+	}
+
+	secret, err := getHookSecret(newHook)
+	if err != nil || secret != "secret" {
+		t.Errorf("Rotated hook secret decrypted to %#v (%v)", secret, err)
+	}
+
+	// Unencrypted values are left alone
+	workflow.BackupConfig.TokensEncrypted = false
+	if _, changed, _ := rotateWorkflowBackupKeys(workflow, oldVersions); changed {
+		t.Errorf("Unencrypted workflow backup tokens were rotated")
+	}
+
+	// A token that can't be decrypted fails the workflow, so the rotation isn't marked finished
+	workflow.BackupConfig.TokensEncrypted = true
+	workflow.BackupConfig.UploadToken = encrypt("token", "other_org_upload_token")
+	workflow.BackupConfig.UploadToken = workflow.BackupConfig.UploadToken[len("$v2$"):]
+	if _, _, err := rotateWorkflowBackupKeys(workflow, oldVersions); err == nil {
+		t.Errorf("Workflow token encrypted with another passphrase was rotated")
+	}
+}
+
+func TestKeyRotationCountsFailed(t *testing.T) {
+	counts := newKeyRotationCounts()
+	if counts.failed() || len(counts.all()) != 5 {
+		t.Fatalf("New key rotation counts = %#v; expected 5 resource types without failures", counts.all())
+	}
+
+	counts.hooks.Failed = append(counts.hooks.Failed, "hook")
+	if !counts.failed() {
+		t.Errorf("A failed webhook didn't fail the key rotation")
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(path, []byte("old content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeFileAtomic(path, []byte("new")); err != nil {
+		t.Fatalf("writeFileAtomic failed: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil || string(data) != "new" {
+		t.Errorf("File contains %#v (%v); expected it to be replaced", string(data), err)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("Temporary files were left behind: %d files", len(files))
+	}
+
+	// Nothing is written if the directory is gone
+	os.RemoveAll(dir)
+	if err := writeFileAtomic(path, []byte("new")); err == nil {
+		t.Errorf("writeFileAtomic succeeded in a missing directory")
+	}
+}
+
+func TestHasKeyRotationAccess(t *testing.T) {
+	t.Setenv("SHUFFLE_INSTANCE_OWNERS", "owner-id, other-owner")
+
+	handlers := []struct {
+		user     User
+		expected bool
+	}{
+		{User{Id: "owner-id"}, true},
+		{User{Id: "other-owner", Role: "user"}, true},
+		{User{Id: "admin-id", Role: "admin"}, false},
+		{User{Id: "support-id", SupportAccess: true, Role: "admin"}, false},
+		{User{Id: "owner-id", ApiKeyId: "scoped-key"}, false},
+		{User{}, false},
+	}
+
+	for _, tt := range handlers {
+		if hasKeyRotationAccess(tt.user) != tt.expected {
+			t.Errorf("hasKeyRotationAccess(%#v) = %v; expected %v", tt.user.Id, !tt.expected, tt.expected)
+		}
+	}
+
+	t.Setenv("SHUFFLE_INSTANCE_OWNERS", "")
+	if hasKeyRotationAccess(User{Id: "owner-id"}) {
+		t.Errorf("Key rotation was allowed without SHUFFLE_INSTANCE_OWNERS")
+	}
+}
@@ -23,6 +23,9 @@ import (
 	openai "github.com/sashabaranov/go-openai"
 )
 
+// How long decrypted KMS values are cached, encrypted, before they are fetched again
+const kmsCacheMinutes = 5
+
 //var model = "gpt-4-turbo-preview"
 //var model = "gpt-4o"
 var model = "gpt-4o-mini"
@@ -326,7 +329,7 @@ func DecryptKMS(ctx context.Context, auth AppAuthenticationStorage, key, authori
 	}
 
 	// Encrypt & cache for the key for a few minutes
-	err = SetKmsCache(ctx, auth, key, output, 5)
+	err = SetKmsCache(ctx, auth, key, output, kmsCacheMinutes)
 	if err != nil {
 		log.Printf("[ERROR] Failed to set KMS cache: %s", err)
 	}
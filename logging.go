@@ -0,0 +1,340 @@
+package shuffle
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Max lines kept per execution. Later lines are only printed.
+var maxExecutionLogEntries = 1000
+
+// Lines are written to the database in chunks of this size as soon as a
+// chunk is full. The rest is written when the execution finishes.
+var executionLogChunkSize = 50
+
+var executionLogLevel = regexp.MustCompile(`^\[([A-Z]+)\](\[[^\]]*\])?\s*`)
+
+// Logs lines the same way as log.Printf, but also keeps them on the
+// execution so that users can see them without server access.
+type ExecutionLogger struct {
+	ctx         context.Context
+	OrgId       string
+	WorkflowId  string
+	ExecutionId string
+	Fields      map[string]string
+}
+
+func NewExecutionLogger(ctx context.Context, workflowExecution WorkflowExecution) *ExecutionLogger {
+	orgId := workflowExecution.ExecutionOrg
+	if len(orgId) == 0 {
+		orgId = workflowExecution.Workflow.OrgId
+	}
+
+	workflowId := workflowExecution.WorkflowId
+	if len(workflowId) == 0 {
+		workflowId = workflowExecution.Workflow.ID
+	}
+
+	return &ExecutionLogger{
+		ctx:         ctx,
+		OrgId:       orgId,
+		WorkflowId:  workflowId,
+		ExecutionId: workflowExecution.ExecutionId,
+	}
+}
+
+// Returns a copy of the logger with an extra field on every line
+func (logger *ExecutionLogger) With(key, value string) *ExecutionLogger {
+	fields := map[string]string{}
+	for fieldKey, fieldValue := range logger.Fields {
+		fields[fieldKey] = fieldValue
+	}
+
+	fields[key] = value
+	return &ExecutionLogger{
+		ctx:         logger.ctx,
+		OrgId:       logger.OrgId,
+		WorkflowId:  logger.WorkflowId,
+		ExecutionId: logger.ExecutionId,
+		Fields:      fields,
+	}
+}
+
+// Format starts with the level like other log lines, e.g. "[WARNING] Failed ..."
+// The execution ID is added after the level if it isn't there already.
+func (logger *ExecutionLogger) Printf(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+
+	level := "INFO"
+	matches := executionLogLevel.FindStringSubmatch(message)
+	if len(matches) > 1 {
+		level = matches[1]
+		message = message[len(matches[0]):]
+	}
+
+	log.Printf("[%s][%s] %s", level, logger.ExecutionId, message)
+
+	// Debug lines are too noisy to keep
+	if level == "DEBUG" || len(logger.ExecutionId) == 0 {
+		return
+	}
+
+	appendExecutionLog(logger.ctx, ExecutionLogEntry{
+		Timestamp:   time.Now().Unix(),
+		Level:       level,
+		Message:     message,
+		OrgId:       logger.OrgId,
+		WorkflowId:  logger.WorkflowId,
+		ExecutionId: logger.ExecutionId,
+		Fields:      logger.Fields,
+	})
+}
+
+func getExecutionLogCountKey(executionId string) string {
+	return fmt.Sprintf("execution_logs_%s_count", executionId)
+}
+
+func getExecutionLogEntryKey(executionId string, index int64) string {
+	return fmt.Sprintf("execution_logs_%s_%d", executionId, index)
+}
+
+func getExecutionLogFlushedKey(executionId string, chunk int) string {
+	return fmt.Sprintf("execution_logs_%s_flushed_%d", executionId, chunk)
+}
+
+// Returns the first and last line index (1-based) of a chunk, capped by the
+// amount of lines written
+func getExecutionLogChunkRange(chunk int, count int64) (int64, int64) {
+	first := int64(chunk*executionLogChunkSize) + 1
+	last := int64((chunk + 1) * executionLogChunkSize)
+	if last > count {
+		last = count
+	}
+
+	return first, last
+}
+
+// Returns the cached lines of a chunk, and whether all of them were found
+func getCachedExecutionLogChunk(ctx context.Context, executionId string, chunk int, count int64) ([]ExecutionLogEntry, bool) {
+	entries := []ExecutionLogEntry{}
+	first, last := getExecutionLogChunkRange(chunk, count)
+	for index := first; index <= last; index++ {
+		cache, err := GetCache(ctx, getExecutionLogEntryKey(executionId, index))
+		if err != nil {
+			return entries, false
+		}
+
+		entry := ExecutionLogEntry{}
+		err = json.Unmarshal([]byte(cache.([]uint8)), &entry)
+		if err != nil {
+			return entries, false
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, true
+}
+
+// Every line gets its own index from a shared counter, so instances write
+// without waiting for each other. The line that fills a chunk writes it.
+func appendExecutionLog(ctx context.Context, entry ExecutionLogEntry) {
+	index, err := IncrementCacheCounter(ctx, getExecutionLogCountKey(entry.ExecutionId), 1440)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting log index for execution %s: %s", entry.ExecutionId, err)
+		return
+	}
+
+	if index > int64(maxExecutionLogEntries) {
+		return
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	err = SetCache(ctx, getExecutionLogEntryKey(entry.ExecutionId, index), data, 60)
+	if err != nil {
+		log.Printf("[WARNING] Failed caching log line for execution %s: %s", entry.ExecutionId, err)
+		return
+	}
+
+	if index%int64(executionLogChunkSize) == 0 {
+		chunk := int((index - 1) / int64(executionLogChunkSize))
+		flushExecutionLogChunk(ctx, ExecutionLogs{ExecutionId: entry.ExecutionId, OrgId: entry.OrgId, WorkflowId: entry.WorkflowId, Chunk: chunk}, index)
+	}
+}
+
+// Writes the cached lines of a chunk to the database. Lines other instances
+// haven't cached yet are written again when the execution finishes.
+func flushExecutionLogChunk(ctx context.Context, executionLogs ExecutionLogs, count int64) {
+	entries, _ := getCachedExecutionLogChunk(ctx, executionLogs.ExecutionId, executionLogs.Chunk, count)
+	if len(entries) == 0 {
+		return
+	}
+
+	executionLogs.Entries = entries
+	err := SetExecutionLogs(ctx, executionLogs)
+	if err != nil {
+		log.Printf("[WARNING] Failed saving log chunk %d for execution %s: %s", executionLogs.Chunk, executionLogs.ExecutionId, err)
+		return
+	}
+
+	SetCache(ctx, getExecutionLogFlushedKey(executionLogs.ExecutionId, executionLogs.Chunk), []byte(fmt.Sprintf("%d", len(entries))), 1440)
+}
+
+// Writes the chunks that aren't complete in the database yet once the execution is done
+func persistExecutionLogs(ctx context.Context, workflowExecution WorkflowExecution) {
+	if workflowExecution.Status != "FINISHED" && workflowExecution.Status != "ABORTED" && workflowExecution.Status != "FAILURE" {
+		return
+	}
+
+	count := GetCacheCounter(ctx, getExecutionLogCountKey(workflowExecution.ExecutionId))
+	if count > int64(maxExecutionLogEntries) {
+		count = int64(maxExecutionLogEntries)
+	}
+
+	logger := NewExecutionLogger(ctx, workflowExecution)
+	for chunk := 0; int64(chunk*executionLogChunkSize) < count; chunk++ {
+		first, last := getExecutionLogChunkRange(chunk, count)
+		flushed := GetCacheCounter(ctx, getExecutionLogFlushedKey(workflowExecution.ExecutionId, chunk))
+		if flushed >= last-first+1 {
+			continue
+		}
+
+		flushExecutionLogChunk(ctx, ExecutionLogs{
+			ExecutionId: workflowExecution.ExecutionId,
+			OrgId:       logger.OrgId,
+			WorkflowId:  logger.WorkflowId,
+			Chunk:       chunk,
+		}, count)
+	}
+}
+
+// Reads lines from cache while they are there, and from the database after
+func getExecutionLogEntries(ctx context.Context, executionId string) []ExecutionLogEntry {
+	count := GetCacheCounter(ctx, getExecutionLogCountKey(executionId))
+	if count > int64(maxExecutionLogEntries) {
+		count = int64(maxExecutionLogEntries)
+	}
+
+	entries := []ExecutionLogEntry{}
+	for chunk := 0; chunk*executionLogChunkSize < maxExecutionLogEntries; chunk++ {
+		if count > 0 && int64(chunk*executionLogChunkSize) >= count {
+			break
+		}
+
+		cachedEntries, found := getCachedExecutionLogChunk(ctx, executionId, chunk, count)
+		if count > 0 && found {
+			entries = append(entries, cachedEntries...)
+			continue
+		}
+
+		executionLogs, err := GetExecutionLogs(ctx, executionId, chunk)
+		if err != nil {
+			entries = append(entries, cachedEntries...)
+			break
+		}
+
+		entries = append(entries, executionLogs.Entries...)
+	}
+
+	return entries
+}
+
+// Captured log lines of an execution: /api/v1/executions/{id}/logs
+// Optional ?level=WARNING to only get one level
+func HandleGetExecutionLogs(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	location := strings.Split(strings.Split(request.URL.String(), "?")[0], "/")
+	if len(location) <= 4 || len(location[4]) != 36 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Valid execution ID required"}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	workflowExecution, err := GetWorkflowExecution(ctx, location[4])
+	if err != nil {
+		log.Printf("[WARNING] Failed getting execution %s for logs: %s", location[4], err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if !checkExecutionAccess(resp, request, *workflowExecution) {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	entries := getExecutionLogEntries(ctx, workflowExecution.ExecutionId)
+
+	level := strings.ToUpper(request.URL.Query().Get("level"))
+	filtered := []ExecutionLogEntry{}
+	for _, entry := range entries {
+		if len(level) > 0 && entry.Level != level {
+			continue
+		}
+
+		filtered = append(filtered, entry)
+	}
+
+	newjson, err := json.Marshal(filtered)
+	if err != nil {
+		log.Printf("[WARNING] Failed marshalling execution logs: %s", err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// Access to an execution is either through its authorization key (?authorization=
+// or the Authorization header used by workers), or as a user in the org that ran it.
+func checkExecutionAccess(resp http.ResponseWriter, request *http.Request, workflowExecution WorkflowExecution) bool {
+	authorization := request.URL.Query().Get("authorization")
+	if len(authorization) == 0 {
+		authorization = strings.TrimSpace(strings.Replace(request.Header.Get("Authorization"), "Bearer ", "", 1))
+	}
+
+	if len(authorization) > 0 && authorization == workflowExecution.Authorization {
+		return true
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed for execution %s: %s", workflowExecution.ExecutionId, err)
+		return false
+	}
+
+	executionOrg := workflowExecution.ExecutionOrg
+	if len(executionOrg) == 0 {
+		executionOrg = workflowExecution.Workflow.OrgId
+	}
+
+	if user.ActiveOrg.Id == executionOrg {
+		return true
+	}
+
+	if hasSupportAccess(request, &user, executionOrg, "read", "workflow", workflowExecution.Workflow.ID) {
+		log.Printf("[AUDIT] Letting verified support admin %s access execution %s", user.Username, workflowExecution.ExecutionId)
+		return true
+	}
+
+	log.Printf("[AUDIT] Wrong user (%s) for execution %s", user.Username, workflowExecution.ExecutionId)
+	return false
+}
@@ -0,0 +1,101 @@
+package shuffle
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestExecutionLoggerEntries(t *testing.T) {
+	ctx := context.Background()
+
+	// Full chunks are written to the database, which isn't there in tests
+	oldChunkSize := executionLogChunkSize
+	oldMaxEntries := maxExecutionLogEntries
+	executionLogChunkSize = 1000
+	maxExecutionLogEntries = 30
+	defer func() {
+		executionLogChunkSize = oldChunkSize
+		maxExecutionLogEntries = oldMaxEntries
+	}()
+
+	execution := WorkflowExecution{ExecutionId: "logger-test-execution", ExecutionOrg: "org", Workflow: Workflow{ID: "workflow"}}
+	logger := NewExecutionLogger(ctx, execution)
+	logger.Printf("[DEBUG] Not kept")
+	logger.Printf("[WARNING] Failed running %s", "node")
+	logger.With("node", "node1").Printf("Without a level")
+
+	entries := getExecutionLogEntries(ctx, execution.ExecutionId)
+	if len(entries) != 2 {
+		t.Fatalf("Entries = %#v; expected the warning and info lines", entries)
+	}
+
+	if entries[0].Level != "WARNING" || entries[0].Message != "Failed running node" || entries[0].OrgId != "org" || entries[0].WorkflowId != "workflow" {
+		t.Errorf("First entry = %#v", entries[0])
+	}
+
+	if entries[1].Level != "INFO" || entries[1].Fields["node"] != "node1" {
+		t.Errorf("Second entry = %#v", entries[1])
+	}
+
+	// Lines from many goroutines all get their own index, up to the max
+	wg := sync.WaitGroup{}
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			logger.Printf("[INFO] Line %d", i)
+		}(i)
+	}
+
+	wg.Wait()
+	entries = getExecutionLogEntries(ctx, execution.ExecutionId)
+	if len(entries) != maxExecutionLogEntries {
+		t.Errorf("Got %d entries; expected the max of %d", len(entries), maxExecutionLogEntries)
+	}
+
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		if seen[entry.Message] {
+			t.Errorf("Line %s was written twice", entry.Message)
+		}
+
+		seen[entry.Message] = true
+	}
+}
+
+func TestExecutionLogChunkRange(t *testing.T) {
+	oldChunkSize := executionLogChunkSize
+	executionLogChunkSize = 50
+	defer func() { executionLogChunkSize = oldChunkSize }()
+
+	for _, testCase := range []struct {
+		chunk int
+		count int64
+		first int64
+		last  int64
+	}{
+		{0, 120, 1, 50},
+		{1, 120, 51, 100},
+		{2, 120, 101, 120},
+		{0, 10, 1, 10},
+	} {
+		first, last := getExecutionLogChunkRange(testCase.chunk, testCase.count)
+		if first != testCase.first || last != testCase.last {
+			t.Errorf("getExecutionLogChunkRange(%d, %d) = %d, %d; expected %d, %d", testCase.chunk, testCase.count, first, last, testCase.first, testCase.last)
+		}
+	}
+}
+
+func TestPersistExecutionLogsRunning(t *testing.T) {
+	// Running executions aren't written, so this doesn't need the database
+	ctx := context.Background()
+	execution := WorkflowExecution{ExecutionId: "logger-running-execution", Status: "EXECUTING"}
+	NewExecutionLogger(ctx, execution).Printf("[INFO] Running")
+	persistExecutionLogs(ctx, execution)
+
+	if entries := getExecutionLogEntries(ctx, execution.ExecutionId); len(entries) != 1 {
+		t.Errorf("Entries = %s; expected the running line", fmt.Sprint(entries))
+	}
+}
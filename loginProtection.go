@@ -0,0 +1,247 @@
+package shuffle
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Failed logins are counted per username and per IP. IPs get higher
+// thresholds as many users can share one. The username count is also what
+// locks accounts when the org's password policy enables lockout.
+// Past the CAPTCHA threshold, failed responses tell the client to show one.
+const (
+	loginCaptchaThreshold   = 3
+	loginDelayThresholdUser = 5
+	loginDelayThresholdIp   = 20
+	maxLoginDelaySeconds    = 300
+	loginFailureWindow      = 60
+)
+
+type loginFailures struct {
+	Count int   `json:"count"`
+	Last  int64 `json:"last"`
+}
+
+func getLoginFailureKeys(request *http.Request, username string) (string, string) {
+	return fmt.Sprintf("login_failures_user_%s", strings.ToLower(username)), fmt.Sprintf("login_failures_ip_%s", GetRequestIp(request))
+}
+
+func getLoginFailures(ctx context.Context, cacheKey string) loginFailures {
+	failures := loginFailures{}
+	cache, err := GetCache(ctx, cacheKey)
+	if err != nil {
+		return failures
+	}
+
+	cacheData := []byte(cache.([]uint8))
+	err = json.Unmarshal(cacheData, &failures)
+	if err != nil {
+		return loginFailures{}
+	}
+
+	return failures
+}
+
+// Seconds left until the next attempt is allowed. The delay doubles for
+// every failure above the threshold.
+func getLoginDelay(failures loginFailures, threshold int, now int64) int {
+	if failures.Count < threshold {
+		return 0
+	}
+
+	delay := int(math.Min(math.Pow(2, float64(failures.Count-threshold)), maxLoginDelaySeconds))
+	remaining := failures.Last + int64(delay) - now
+	if remaining <= 0 {
+		return 0
+	}
+
+	return int(remaining)
+}
+
+func isLoginCaptchaRequired(userFailures, ipFailures loginFailures) bool {
+	return userFailures.Count >= loginCaptchaThreshold || ipFailures.Count >= loginCaptchaThreshold*4
+}
+
+// Returns how long the client has to wait before trying again, and whether
+// it should show a CAPTCHA
+func checkLoginThrottle(ctx context.Context, request *http.Request, username string) (int, bool) {
+	userKey, ipKey := getLoginFailureKeys(request, username)
+	userFailures := getLoginFailures(ctx, userKey)
+	ipFailures := getLoginFailures(ctx, ipKey)
+
+	timeNow := time.Now().Unix()
+	retryAfter := getLoginDelay(userFailures, loginDelayThresholdUser, timeNow)
+	ipRetryAfter := getLoginDelay(ipFailures, loginDelayThresholdIp, timeNow)
+	if ipRetryAfter > retryAfter {
+		retryAfter = ipRetryAfter
+	}
+
+	return retryAfter, isLoginCaptchaRequired(userFailures, ipFailures)
+}
+
+// Counts a failed login for the username and IP. Returns the failures of
+// the username, and whether the client should show a CAPTCHA.
+func registerLoginFailure(ctx context.Context, request *http.Request, username string) (int, bool) {
+	userKey, ipKey := getLoginFailureKeys(request, username)
+	timeNow := time.Now().Unix()
+
+	userFailures := loginFailures{}
+	ipFailures := loginFailures{}
+	for _, cacheKey := range []string{userKey, ipKey} {
+		failures := getLoginFailures(ctx, cacheKey)
+		failures.Count += 1
+		failures.Last = timeNow
+
+		data, err := json.Marshal(failures)
+		if err != nil {
+			continue
+		}
+
+		err = SetCache(ctx, cacheKey, data, loginFailureWindow)
+		if err != nil {
+			log.Printf("[WARNING] Failed setting login failures for %s: %s", cacheKey, err)
+		}
+
+		if cacheKey == userKey {
+			userFailures = failures
+		} else {
+			ipFailures = failures
+		}
+	}
+
+	log.Printf("[AUDIT] Failed login for username %s from IP %s", username, GetRequestIp(request))
+	return userFailures.Count, isLoginCaptchaRequired(userFailures, ipFailures)
+}
+
+// Wrong second factors count like wrong passwords, so codes can't be
+// guessed by someone who knows the password.
+func registerSecondFactorFailure(ctx context.Context, request *http.Request, user User, policy PasswordPolicy) bool {
+	failures, captchaRequired := registerLoginFailure(ctx, request, user.Username)
+	lockUserAfterLoginFailures(ctx, request, user, policy, failures)
+	CreateAuditEvent(ctx, request, user, user.ActiveOrg.Id, "user.mfa_failed", "user", user.Id, nil, nil)
+	return captchaRequired
+}
+
+// Locks the user when the policy enables lockout and the username has
+// failed too many times. The count starts over after the lock.
+func lockUserAfterLoginFailures(ctx context.Context, request *http.Request, user User, policy PasswordPolicy, failures int) {
+	if policy.LockoutAttempts <= 0 || failures < policy.LockoutAttempts || len(user.Id) == 0 {
+		return
+	}
+
+	// Attempts during a lock don't extend it
+	if user.LockedUntil > time.Now().Unix() {
+		return
+	}
+
+	log.Printf("[AUDIT] Locking user %s (%s) for %d minutes after %d failed logins", user.Username, user.Id, policy.LockoutMinutes, failures)
+	user.LockedUntil = time.Now().Unix() + int64(policy.LockoutMinutes*60)
+	err := SetUser(ctx, &user, false)
+	if err != nil {
+		log.Printf("[WARNING] Failed locking user %s (%s): %s", user.Username, user.Id, err)
+		return
+	}
+
+	clearLoginFailures(ctx, request, user.Username)
+	go notifyUserLocked(context.Background(), user, policy.LockoutMinutes)
+}
+
+// Only the username is cleared. Logging in to one account shouldn't reset
+// the attempts of an IP trying many.
+func clearLoginFailures(ctx context.Context, request *http.Request, username string) {
+	userKey, _ := getLoginFailureKeys(request, username)
+	DeleteCache(ctx, userKey)
+}
+
+func writeLoginThrottled(resp http.ResponseWriter, retryAfter int, captchaRequired bool) {
+	resp.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	resp.WriteHeader(429)
+	resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Too many failed login attempts. Try again in %d seconds", "captcha_required": %t}`, retryAfter, captchaRequired)))
+}
+
+// The same response for unknown users, wrong passwords and locked users,
+// so accounts can't be enumerated
+func writeLoginFailed(resp http.ResponseWriter, captchaRequired bool) {
+	resp.WriteHeader(401)
+	resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Username and/or password is incorrect", "captcha_required": %t}`, captchaRequired)))
+}
+
+// Lets the user know their account was locked. Admins see it too, so
+// they can unlock it.
+func notifyUserLocked(ctx context.Context, user User, minutes int) {
+	if len(user.ActiveOrg.Id) == 0 {
+		return
+	}
+
+	err := CreateOrgNotification(
+		ctx,
+		fmt.Sprintf("Account %s locked after too many failed logins", user.Username),
+		fmt.Sprintf("The account was locked for %d minutes after too many failed login attempts. If this wasn't you, change your password when the lock expires. Admins can unlock it from the user list.", minutes),
+		fmt.Sprintf("/admin?tab=users&user_id=%s", user.Id),
+		user.ActiveOrg.Id,
+		false,
+	)
+	if err != nil {
+		log.Printf("[WARNING] Failed creating lockout notification for user %s (%s): %s", user.Username, user.Id, err)
+	}
+}
+
+// Lets admins unlock a user before the lockout expires
+func HandleUnlockUser(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in unlock user: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if Authorize(user, "users:manage", "") != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "You don't have access to unlock users"}`))
+		return
+	}
+
+	location := strings.Split(strings.Split(request.URL.String(), "?")[0], "/")
+	if len(location) <= 4 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "User ID required"}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	foundUser, err := GetUser(ctx, location[4])
+	if err != nil || !ArrayContains(foundUser.Orgs, user.ActiveOrg.Id) {
+		resp.WriteHeader(404)
+		resp.Write([]byte(`{"success": false, "reason": "User not found"}`))
+		return
+	}
+
+	foundUser.LockedUntil = 0
+	err = SetUser(ctx, foundUser, false)
+	if err != nil {
+		log.Printf("[ERROR] Failed unlocking user %s: %s", foundUser.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	clearLoginFailures(ctx, request, foundUser.Username)
+
+	log.Printf("[AUDIT] User %s (%s) unlocked user %s (%s)", user.Username, user.Id, foundUser.Username, foundUser.Id)
+	CreateAuditEvent(ctx, request, user, user.ActiveOrg.Id, "user.unlock", "user", foundUser.Id, nil, nil)
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
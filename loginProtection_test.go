@@ -0,0 +1,134 @@
+package shuffle
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPasswordPolicyLockoutOptIn(t *testing.T) {
+	policy := getPasswordPolicy(&Org{})
+	if policy.LockoutAttempts != 0 || policy.LockoutMinutes != 0 {
+		t.Errorf("Policy without lockout = %#v; expected lockout to be off", policy)
+	}
+
+	policy = getPasswordPolicy(&Org{PasswordPolicy: PasswordPolicy{LockoutMinutes: 30}})
+	if policy.LockoutAttempts != 0 || policy.LockoutMinutes != 0 {
+		t.Errorf("Policy with only lockout minutes = %#v; expected lockout to be off", policy)
+	}
+
+	policy = getPasswordPolicy(&Org{PasswordPolicy: PasswordPolicy{LockoutAttempts: 5}})
+	if policy.LockoutAttempts != 5 || policy.LockoutMinutes != defaultLockoutMinutes {
+		t.Errorf("Policy with lockout = %#v; expected 5 attempts and the default minutes", policy)
+	}
+}
+
+func TestLoginThrottle(t *testing.T) {
+	ctx := context.Background()
+	request := httptest.NewRequest("POST", "/api/v1/login", nil)
+	request.RemoteAddr = "10.0.0.44:1234"
+	username := "throttle-test@example.com"
+
+	if retryAfter, _ := checkLoginThrottle(ctx, request, username); retryAfter != 0 {
+		t.Fatalf("New username was throttled for %d seconds", retryAfter)
+	}
+
+	failures := 0
+	for i := 0; i < loginDelayThresholdUser; i++ {
+		failures, _ = registerLoginFailure(ctx, request, username)
+	}
+
+	if failures != loginDelayThresholdUser {
+		t.Errorf("registerLoginFailure = %d; expected %d", failures, loginDelayThresholdUser)
+	}
+
+	if retryAfter, _ := checkLoginThrottle(ctx, request, username); retryAfter <= 0 {
+		t.Errorf("Username wasn't throttled after %d failures", failures)
+	}
+
+	// A successful login only clears the username, not the IP
+	clearLoginFailures(ctx, request, username)
+	if retryAfter, _ := checkLoginThrottle(ctx, request, username); retryAfter != 0 {
+		t.Errorf("Username was throttled after clearing its failures")
+	}
+
+	_, ipKey := getLoginFailureKeys(request, username)
+	if getLoginFailures(ctx, ipKey).Count != loginDelayThresholdUser {
+		t.Errorf("Clearing the username also cleared the IP")
+	}
+}
+
+func TestLoginCaptchaRequired(t *testing.T) {
+	ctx := context.Background()
+	request := httptest.NewRequest("POST", "/api/v1/login", nil)
+	request.RemoteAddr = "10.0.0.45:1234"
+	username := "captcha-test@example.com"
+
+	for i := 1; i <= loginCaptchaThreshold; i++ {
+		_, captchaRequired := registerLoginFailure(ctx, request, username)
+		if captchaRequired != (i >= loginCaptchaThreshold) {
+			t.Errorf("captcha_required = %t after %d failures", captchaRequired, i)
+		}
+	}
+
+	if _, captchaRequired := checkLoginThrottle(ctx, request, username); !captchaRequired {
+		t.Errorf("Throttle check didn't require a CAPTCHA past the threshold")
+	}
+
+	resp := httptest.NewRecorder()
+	writeLoginFailed(resp, true)
+	if resp.Code != 401 || !strings.Contains(resp.Body.String(), `"captcha_required": true`) {
+		t.Errorf("Failed login response = %d %s; expected captcha_required", resp.Code, resp.Body.String())
+	}
+
+	// Shared IPs need more failures before every user behind them gets one
+	if isLoginCaptchaRequired(loginFailures{}, loginFailures{Count: loginCaptchaThreshold}) {
+		t.Errorf("CAPTCHA was required after %d failures from an IP", loginCaptchaThreshold)
+	}
+}
+
+func TestLoginFailureKeysIgnoreSpoofedHeaders(t *testing.T) {
+	username := "spoof-test@example.com"
+	request := httptest.NewRequest("POST", "/api/v1/login", nil)
+	request.RemoteAddr = "203.0.113.9:1234"
+	_, ipKey := getLoginFailureKeys(request, username)
+
+	for _, spoofed := range []string{"198.51.100.1", "198.51.100.2, 10.0.0.1"} {
+		spoofedRequest := httptest.NewRequest("POST", "/api/v1/login", nil)
+		spoofedRequest.RemoteAddr = "203.0.113.9:4321"
+		spoofedRequest.Header.Set("X-Forwarded-For", spoofed)
+		spoofedRequest.Header.Set("X-Real-IP", spoofed)
+
+		if _, spoofedKey := getLoginFailureKeys(spoofedRequest, username); spoofedKey != ipKey {
+			t.Errorf("X-Forwarded-For %s moved the failures to %s; expected %s", spoofed, spoofedKey, ipKey)
+		}
+	}
+}
+
+func TestLoginDelay(t *testing.T) {
+	now := time.Now().Unix()
+	if delay := getLoginDelay(loginFailures{Count: 4, Last: now}, 5, now); delay != 0 {
+		t.Errorf("Delay below the threshold = %d", delay)
+	}
+
+	if delay := getLoginDelay(loginFailures{Count: 7, Last: now}, 5, now); delay != 4 {
+		t.Errorf("Delay two failures above the threshold = %d; expected 4", delay)
+	}
+
+	if delay := getLoginDelay(loginFailures{Count: 100, Last: now}, 5, now); delay != maxLoginDelaySeconds {
+		t.Errorf("Delay = %d; expected at most %d", delay, maxLoginDelaySeconds)
+	}
+}
+
+func TestLockUserAfterLoginFailuresDisabled(t *testing.T) {
+	// Writing the user needs the database, so these have to return early
+	ctx := context.Background()
+	request := httptest.NewRequest("POST", "/api/v1/login", nil)
+	user := User{Id: "lockout-test-user", Username: "lockout-test"}
+
+	lockUserAfterLoginFailures(ctx, request, user, getPasswordPolicy(&Org{}), 1000)
+	lockUserAfterLoginFailures(ctx, request, user, PasswordPolicy{LockoutAttempts: 5, LockoutMinutes: 15}, 4)
+	lockUserAfterLoginFailures(ctx, request, User{}, PasswordPolicy{LockoutAttempts: 5, LockoutMinutes: 15}, 5)
+}
@@ -0,0 +1,553 @@
+package shuffle
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+var validMaintenanceActions = []string{"pause", "queue", "drop"}
+var validMaintenanceRecurrences = []string{"", "daily", "weekly", "monthly"}
+
+// Checks if a window is active at the given unix timestamp.
+// Returns whether it is active, and when the current occurrence ends
+func maintenanceWindowActive(window MaintenanceWindow, now int64) (bool, int64) {
+	if window.End <= window.Start || now < window.Start {
+		return false, 0
+	}
+
+	duration := window.End - window.Start
+	occurrenceStart := window.Start
+	switch window.Recurrence {
+	case "daily", "weekly":
+		period := int64(86400)
+		if window.Recurrence == "weekly" {
+			period = 86400 * 7
+		}
+
+		occurrenceStart = window.Start + ((now-window.Start)/period)*period
+	case "monthly":
+		start := time.Unix(window.Start, 0).UTC()
+		current := time.Unix(now, 0).UTC()
+		months := (current.Year()-start.Year())*12 + int(current.Month()-start.Month())
+		for months >= 0 {
+			occurrenceStart = start.AddDate(0, months, 0).Unix()
+			if occurrenceStart <= now {
+				break
+			}
+
+			months -= 1
+		}
+	}
+
+	if window.Until > 0 && occurrenceStart > window.Until {
+		return false, 0
+	}
+
+	occurrenceEnd := occurrenceStart + duration
+	if now >= occurrenceStart && now < occurrenceEnd {
+		return true, occurrenceEnd
+	}
+
+	return false, 0
+}
+
+// Finds the first enabled calendar among calendarIds with an active window
+func GetActiveMaintenanceWindow(ctx context.Context, orgId string, calendarIds []string) (*MaintenanceCalendar, *MaintenanceWindow, int64, error) {
+	now := time.Now().Unix()
+	for _, calendarId := range calendarIds {
+		if len(calendarId) == 0 {
+			continue
+		}
+
+		calendar, err := GetMaintenanceCalendar(ctx, calendarId)
+		if err != nil {
+			log.Printf("[WARNING] Failed getting maintenance calendar %s: %s", calendarId, err)
+			continue
+		}
+
+		if calendar.OrgId != orgId || !calendar.Enabled {
+			continue
+		}
+
+		for _, window := range calendar.Windows {
+			active, windowEnd := maintenanceWindowActive(window, now)
+			if active {
+				return calendar, &window, windowEnd, nil
+			}
+		}
+	}
+
+	return nil, nil, 0, nil
+}
+
+// Used before a schedule or webhook starts an execution.
+// Returns true if the trigger may run. Otherwise it is recorded as suppressed,
+// and paused or queued triggers are released again when the window ends.
+func CheckTriggerMaintenance(ctx context.Context, calendarIds []string, suppressed SuppressedTrigger) (bool, *SuppressedTrigger, error) {
+	if len(calendarIds) == 0 || len(suppressed.OrgId) == 0 {
+		return true, nil, nil
+	}
+
+	triggerMaintenanceRelease(ctx, suppressed.OrgId)
+
+	calendar, window, windowEnd, err := GetActiveMaintenanceWindow(ctx, suppressed.OrgId, calendarIds)
+	if err != nil {
+		return true, nil, err
+	}
+
+	if calendar == nil {
+		return true, nil, nil
+	}
+
+	suppressed.Id = uuid.NewV4().String()
+	suppressed.CalendarId = calendar.Id
+	suppressed.WindowId = window.Id
+	suppressed.WindowEnd = windowEnd
+	suppressed.Created = time.Now().Unix()
+	suppressed = applyMaintenanceAction(suppressed, calendar.Action)
+
+	log.Printf("[AUDIT] Suppressed %s trigger %s for workflow %s in org %s. Calendar: %s (%s), window ends: %d, action: %s", suppressed.TriggerType, suppressed.TriggerId, suppressed.WorkflowId, suppressed.OrgId, calendar.Name, calendar.Id, windowEnd, suppressed.Action)
+
+	err = SetSuppressedTrigger(ctx, suppressed)
+	if err != nil {
+		log.Printf("[ERROR] Failed storing suppressed trigger %s: %s", suppressed.Id, err)
+	}
+
+	// Paused and queued triggers are released by ReleaseMaintenanceQueue once WindowEnd has passed
+	return false, &suppressed, nil
+}
+
+// Paused and queued triggers keep their payload to run after the window.
+// Dropped triggers are only kept for the audit trail.
+func applyMaintenanceAction(suppressed SuppressedTrigger, action string) SuppressedTrigger {
+	suppressed.Action = action
+	switch action {
+	case "queue":
+		suppressed.Status = "queued"
+	case "drop":
+		suppressed.Status = "dropped"
+		suppressed.ExecutionArgument = ""
+	default:
+		suppressed.Action = "pause"
+		suppressed.Status = "paused"
+	}
+
+	return suppressed
+}
+
+// Paused and queued triggers can run once the window they were stopped by has ended
+func maintenanceReleaseDue(suppressed SuppressedTrigger, now int64) bool {
+	if suppressed.Status != "queued" && suppressed.Status != "paused" {
+		return false
+	}
+
+	return suppressed.WindowEnd > 0 && suppressed.WindowEnd <= now
+}
+
+// Picks the triggers to run from those that are due. Every queued trigger runs,
+// while paused triggers only run once per trigger: the latest one. The rest
+// are returned to be skipped.
+func getMaintenanceReleases(suppressed []SuppressedTrigger, now int64) ([]SuppressedTrigger, []SuppressedTrigger) {
+	release := []SuppressedTrigger{}
+	latestPaused := map[string]SuppressedTrigger{}
+	skip := []SuppressedTrigger{}
+	for _, item := range suppressed {
+		if !maintenanceReleaseDue(item, now) {
+			continue
+		}
+
+		if item.Status == "queued" {
+			release = append(release, item)
+			continue
+		}
+
+		triggerKey := fmt.Sprintf("%s_%s", item.WorkflowId, item.TriggerId)
+		latest, found := latestPaused[triggerKey]
+		if !found {
+			latestPaused[triggerKey] = item
+			continue
+		}
+
+		if item.Created > latest.Created {
+			latestPaused[triggerKey] = item
+			skip = append(skip, latest)
+		} else {
+			skip = append(skip, item)
+		}
+	}
+
+	for _, item := range latestPaused {
+		release = append(release, item)
+	}
+
+	return release, skip
+}
+
+// Releases all paused and queued triggers for an org where the window has ended.
+// Runs from the environment rerun job, and when triggers are checked. Empty orgId = all orgs
+func ReleaseMaintenanceQueue(ctx context.Context, orgId string) error {
+	suppressed := []SuppressedTrigger{}
+	for _, status := range []string{"queued", "paused"} {
+		items, err := GetSuppressedTriggers(ctx, orgId, status, 1000)
+		if err != nil {
+			return err
+		}
+
+		suppressed = append(suppressed, items...)
+	}
+
+	now := time.Now().Unix()
+	release, skip := getMaintenanceReleases(suppressed, now)
+	for _, item := range skip {
+		item.Status = "skipped"
+		item.Released = now
+		err := SetSuppressedTrigger(ctx, item)
+		if err != nil {
+			log.Printf("[WARNING] Failed skipping paused trigger %s: %s", item.Id, err)
+		}
+	}
+
+	for _, item := range release {
+		err := releaseSuppressedTrigger(ctx, item)
+		if err != nil {
+			log.Printf("[WARNING] Failed releasing %s trigger %s: %s", item.Status, item.Id, err)
+		}
+	}
+
+	return nil
+}
+
+// Atomic claim so that a trigger is only released by one instance.
+// It outlives the release, after which the trigger isn't due anymore.
+func claimSuppressedTrigger(ctx context.Context, suppressed SuppressedTrigger) bool {
+	cacheKey := fmt.Sprintf("maintenance_release_%s", suppressed.Id)
+	return AddCache(ctx, cacheKey, []byte("1"), 3600) == nil
+}
+
+// Checks for ended windows at most once a minute per org
+func triggerMaintenanceRelease(ctx context.Context, orgId string) {
+	releaseKey := fmt.Sprintf("maintenance_release_check_%s", orgId)
+	if _, err := GetCache(ctx, releaseKey); err != nil {
+		SetCache(ctx, releaseKey, []byte("1"), 1)
+		go ReleaseMaintenanceQueue(context.Background(), orgId)
+	}
+}
+
+func releaseSuppressedTrigger(ctx context.Context, suppressed SuppressedTrigger) error {
+	if !claimSuppressedTrigger(ctx, suppressed) {
+		return nil
+	}
+
+	workflow, err := GetWorkflow(ctx, suppressed.WorkflowId)
+	if err != nil {
+		return err
+	}
+
+	if workflow.OrgId != suppressed.OrgId {
+		return errors.New(fmt.Sprintf("Workflow %s is not in org %s", workflow.ID, suppressed.OrgId))
+	}
+
+	execRequest := ExecutionRequest{
+		ExecutionId:       uuid.NewV4().String(),
+		Start:             suppressed.Start,
+		ExecutionSource:   suppressed.TriggerType,
+		ExecutionArgument: suppressed.ExecutionArgument,
+	}
+
+	err = executeWorkflowAsOwner(ctx, *workflow, suppressed.OrgId, execRequest)
+	suppressed.Released = time.Now().Unix()
+	if err != nil {
+		suppressed.Status = "failed"
+		SetSuppressedTrigger(ctx, suppressed)
+		return errors.New(fmt.Sprintf("Failed releasing trigger %s: %s", suppressed.Id, err))
+	}
+
+	log.Printf("[AUDIT] Released %s %s trigger %s for workflow %s in org %s after maintenance window", suppressed.Status, suppressed.TriggerType, suppressed.TriggerId, suppressed.WorkflowId, suppressed.OrgId)
+	suppressed.Status = "released"
+	suppressed.ExecutionId = execRequest.ExecutionId
+	return SetSuppressedTrigger(ctx, suppressed)
+}
+
+// Finds calendars of the trigger that started an execution
+func getExecutionTriggerCalendars(workflowExecution WorkflowExecution) (string, []string) {
+	triggerType := ""
+	if workflowExecution.ExecutionSource == "schedule" {
+		triggerType = "SCHEDULE"
+	} else if workflowExecution.ExecutionSource == "webhook" {
+		triggerType = "WEBHOOK"
+	} else {
+		return "", []string{}
+	}
+
+	triggerId := ""
+	calendars := []string{}
+	for _, trigger := range workflowExecution.Workflow.Triggers {
+		if trigger.TriggerType != triggerType || len(trigger.Calendars) == 0 {
+			continue
+		}
+
+		for _, branch := range workflowExecution.Workflow.Branches {
+			if branch.SourceID == trigger.ID && branch.DestinationID == workflowExecution.Start {
+				return trigger.ID, trigger.Calendars
+			}
+		}
+
+		// Fallback if the start node can't be matched
+		triggerId = trigger.ID
+		for _, calendarId := range trigger.Calendars {
+			if !ArrayContains(calendars, calendarId) {
+				calendars = append(calendars, calendarId)
+			}
+		}
+	}
+
+	return triggerId, calendars
+}
+
+func HandleGetMaintenanceCalendars(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in get maintenance calendars: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	calendars, err := GetMaintenanceCalendars(ctx, user.ActiveOrg.Id)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting maintenance calendars for org %s: %s", user.ActiveOrg.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed getting calendars"}`))
+		return
+	}
+
+	newjson, err := json.Marshal(calendars)
+	if err != nil {
+		log.Printf("[WARNING] Failed marshalling maintenance calendars: %s", err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// Creates or updates a calendar. Update if the ID is in the path:
+// /api/v1/maintenance/calendars/{id}
+func HandleSetMaintenanceCalendar(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in set maintenance calendar: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if Authorize(user, "org:manage", "") != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Admin required"}`))
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		log.Printf("[WARNING] Failed reading body in set maintenance calendar: %s", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	var calendar MaintenanceCalendar
+	err = json.Unmarshal(body, &calendar)
+	if err != nil {
+		log.Printf("[WARNING] Failed unmarshalling maintenance calendar: %s", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Failed parsing calendar"}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	location := strings.Split(strings.Split(request.URL.String(), "?")[0], "/")
+	if len(location) > 5 && len(location[5]) > 0 {
+		existing, err := GetMaintenanceCalendar(ctx, location[5])
+		if err != nil || existing.OrgId != user.ActiveOrg.Id {
+			resp.WriteHeader(404)
+			resp.Write([]byte(`{"success": false, "reason": "Calendar not found"}`))
+			return
+		}
+
+		calendar.Id = existing.Id
+		calendar.Created = existing.Created
+		calendar.CreatedBy = existing.CreatedBy
+	} else {
+		calendar.Id = uuid.NewV4().String()
+		calendar.CreatedBy = user.Username
+	}
+
+	calendar.OrgId = user.ActiveOrg.Id
+	calendar.Name = strings.TrimSpace(calendar.Name)
+	if len(calendar.Name) == 0 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Name is required"}`))
+		return
+	}
+
+	calendar.Action = strings.ToLower(strings.TrimSpace(calendar.Action))
+	if len(calendar.Action) == 0 {
+		calendar.Action = "pause"
+	}
+
+	if !ArrayContains(validMaintenanceActions, calendar.Action) {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Action must be one of: %s"}`, strings.Join(validMaintenanceActions, ", "))))
+		return
+	}
+
+	for windowIndex, window := range calendar.Windows {
+		if len(window.Id) == 0 {
+			calendar.Windows[windowIndex].Id = uuid.NewV4().String()
+		}
+
+		if window.End <= window.Start {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Window %d must end after it starts"}`, windowIndex)))
+			return
+		}
+
+		if !ArrayContains(validMaintenanceRecurrences, window.Recurrence) {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Window %d has an invalid recurrence. Use daily, weekly, monthly or leave it empty"}`, windowIndex)))
+			return
+		}
+
+		if (window.Recurrence == "daily" && window.End-window.Start > 86400) || (window.Recurrence == "weekly" && window.End-window.Start > 86400*7) {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Window %d is longer than its recurrence"}`, windowIndex)))
+			return
+		}
+	}
+
+	err = SetMaintenanceCalendar(ctx, calendar)
+	if err != nil {
+		log.Printf("[ERROR] Failed saving maintenance calendar %s: %s", calendar.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed saving calendar"}`))
+		return
+	}
+
+	log.Printf("[AUDIT] User %s (%s) saved maintenance calendar %s (%s) in org %s", user.Username, user.Id, calendar.Name, calendar.Id, calendar.OrgId)
+	resp.WriteHeader(200)
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "id": "%s"}`, calendar.Id)))
+}
+
+func HandleDeleteMaintenanceCalendar(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in delete maintenance calendar: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if Authorize(user, "org:manage", "") != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Admin required"}`))
+		return
+	}
+
+	location := strings.Split(strings.Split(request.URL.String(), "?")[0], "/")
+	if len(location) <= 5 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Calendar ID required"}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	calendar, err := GetMaintenanceCalendar(ctx, location[5])
+	if err != nil || calendar.OrgId != user.ActiveOrg.Id {
+		resp.WriteHeader(404)
+		resp.Write([]byte(`{"success": false, "reason": "Calendar not found"}`))
+		return
+	}
+
+	err = DeleteKey(ctx, "maintenance_calendars", calendar.Id)
+	if err != nil {
+		log.Printf("[ERROR] Failed deleting maintenance calendar %s: %s", calendar.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	DeleteCache(ctx, fmt.Sprintf("maintenance_calendars_org_%s", calendar.OrgId))
+	log.Printf("[AUDIT] User %s (%s) deleted maintenance calendar %s (%s) in org %s", user.Username, user.Id, calendar.Name, calendar.Id, calendar.OrgId)
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
+
+// Audit trail of suppressed triggers. Optional ?status=queued|paused|dropped|released|failed
+func HandleGetSuppressedTriggers(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in get suppressed triggers: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if Authorize(user, "org:manage", "") != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Admin required"}`))
+		return
+	}
+
+	status := request.URL.Query().Get("status")
+	ctx := GetContext(request)
+	suppressed, err := GetSuppressedTriggers(ctx, user.ActiveOrg.Id, status, 1000)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting suppressed triggers for org %s: %s", user.ActiveOrg.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	newjson, err := json.Marshal(suppressed)
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
@@ -0,0 +1,149 @@
+package shuffle
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceWindowActive(t *testing.T) {
+	// 2024-01-01 10:00 - 12:00 UTC
+	start := int64(1704103200)
+	end := start + 7200
+
+	handlers := []struct {
+		window   MaintenanceWindow
+		now      int64
+		expected bool
+	}{
+		{MaintenanceWindow{Start: start, End: end}, start + 60, true},
+		{MaintenanceWindow{Start: start, End: end}, end, false},
+		{MaintenanceWindow{Start: start, End: end}, start - 60, false},
+		{MaintenanceWindow{Start: start, End: end, Recurrence: "daily"}, start + 86400*3 + 60, true},
+		{MaintenanceWindow{Start: start, End: end, Recurrence: "daily"}, start + 86400*3 + 7200, false},
+		{MaintenanceWindow{Start: start, End: end, Recurrence: "weekly"}, start + 86400*14 + 3600, true},
+		{MaintenanceWindow{Start: start, End: end, Recurrence: "weekly"}, start + 86400*13 + 3600, false},
+		{MaintenanceWindow{Start: start, End: end, Recurrence: "monthly"}, 1706781600 + 60, true}, // 2024-02-01 10:01 UTC
+		{MaintenanceWindow{Start: start, End: end, Recurrence: "monthly"}, 1706868000, false},     // 2024-02-02 10:00 UTC
+		{MaintenanceWindow{Start: start, End: end, Recurrence: "daily", Until: start + 86400}, start + 86400*3 + 60, false},
+	}
+
+	for _, tt := range handlers {
+		result, _ := maintenanceWindowActive(tt.window, tt.now)
+		if result != tt.expected {
+			t.Errorf("maintenanceWindowActive(%#v, %d) = %v; expected %v", tt.window, tt.now, result, tt.expected)
+		}
+	}
+}
+
+func TestApplyMaintenanceAction(t *testing.T) {
+	handlers := []struct {
+		action   string
+		status   string
+		argument string
+	}{
+		{"queue", "queued", "payload"},
+		{"pause", "paused", "payload"},
+		{"", "paused", "payload"},
+		{"drop", "dropped", ""},
+	}
+
+	for _, tt := range handlers {
+		suppressed := applyMaintenanceAction(SuppressedTrigger{ExecutionArgument: "payload"}, tt.action)
+		if suppressed.Status != tt.status || suppressed.ExecutionArgument != tt.argument {
+			t.Errorf("applyMaintenanceAction(%s) = %s with argument '%s'; expected %s with '%s'", tt.action, suppressed.Status, suppressed.ExecutionArgument, tt.status, tt.argument)
+		}
+	}
+}
+
+func TestMaintenanceReleases(t *testing.T) {
+	now := time.Now().Unix()
+	suppressed := []SuppressedTrigger{
+		SuppressedTrigger{Id: "queued-1", Status: "queued", WorkflowId: "workflow", TriggerId: "webhook", WindowEnd: now - 1, Created: now - 30},
+		SuppressedTrigger{Id: "queued-2", Status: "queued", WorkflowId: "workflow", TriggerId: "webhook", WindowEnd: now - 1, Created: now - 20},
+		SuppressedTrigger{Id: "paused-1", Status: "paused", WorkflowId: "workflow", TriggerId: "schedule", WindowEnd: now - 1, Created: now - 30},
+		SuppressedTrigger{Id: "paused-3", Status: "paused", WorkflowId: "workflow", TriggerId: "schedule", WindowEnd: now - 1, Created: now - 10},
+		SuppressedTrigger{Id: "paused-2", Status: "paused", WorkflowId: "workflow", TriggerId: "schedule", WindowEnd: now - 1, Created: now - 20},
+		SuppressedTrigger{Id: "paused-other", Status: "paused", WorkflowId: "workflow", TriggerId: "other", WindowEnd: now - 1, Created: now - 30},
+		SuppressedTrigger{Id: "paused-active", Status: "paused", WorkflowId: "workflow", TriggerId: "active", WindowEnd: now + 60, Created: now - 30},
+		SuppressedTrigger{Id: "dropped", Status: "dropped", WorkflowId: "workflow", TriggerId: "webhook", WindowEnd: now - 1, Created: now - 30},
+	}
+
+	release, skip := getMaintenanceReleases(suppressed, now)
+	released := map[string]bool{}
+	for _, item := range release {
+		released[item.Id] = true
+	}
+
+	if len(release) != 4 || !released["queued-1"] || !released["queued-2"] || !released["paused-3"] || !released["paused-other"] {
+		t.Errorf("Expected both queued triggers and the latest paused trigger per trigger to be released, got %#v", release)
+	}
+
+	skipped := map[string]bool{}
+	for _, item := range skip {
+		skipped[item.Id] = true
+	}
+
+	if len(skip) != 2 || !skipped["paused-1"] || !skipped["paused-2"] {
+		t.Errorf("Expected the older paused triggers to be skipped, got %#v", skip)
+	}
+}
+
+func TestClaimSuppressedTrigger(t *testing.T) {
+	ctx := context.Background()
+	suppressed := SuppressedTrigger{Id: "maintenance-test-claim"}
+	defer DeleteCache(ctx, "maintenance_release_maintenance-test-claim")
+
+	claims := make(chan bool, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			claims <- claimSuppressedTrigger(ctx, suppressed)
+		}()
+	}
+
+	claimed := 0
+	for i := 0; i < 10; i++ {
+		if <-claims {
+			claimed += 1
+		}
+	}
+
+	if claimed != 1 {
+		t.Errorf("Expected one instance to claim the trigger, got %d", claimed)
+	}
+}
+
+func TestMaintenanceReleaseDue(t *testing.T) {
+	now := time.Now().Unix()
+	suppressed := SuppressedTrigger{Status: "queued", WindowEnd: now - 1}
+	if !maintenanceReleaseDue(suppressed, now) {
+		t.Errorf("Queued trigger wasn't released after its window ended")
+	}
+
+	suppressed.WindowEnd = now + 60
+	if maintenanceReleaseDue(suppressed, now) {
+		t.Errorf("Queued trigger was released before its window ended")
+	}
+
+	suppressed = SuppressedTrigger{Status: "paused", WindowEnd: now - 1}
+	if !maintenanceReleaseDue(suppressed, now) {
+		t.Errorf("Paused trigger wasn't released after its window ended")
+	}
+
+	for _, status := range []string{"dropped", "released", "skipped", "failed"} {
+		if maintenanceReleaseDue(SuppressedTrigger{Status: status, WindowEnd: now - 1}, now) {
+			t.Errorf("Trigger with status %s was released", status)
+		}
+	}
+
+	if maintenanceReleaseDue(SuppressedTrigger{Status: "queued"}, now) {
+		t.Errorf("Queued trigger without a window end was released")
+	}
+}
+
+func TestCheckTriggerMaintenanceWithoutCalendars(t *testing.T) {
+	allowed, suppressed, err := CheckTriggerMaintenance(context.Background(), []string{}, SuppressedTrigger{OrgId: "org"})
+	if !allowed || suppressed != nil || err != nil {
+		t.Errorf("Trigger without calendars was suppressed: %t %v %v", allowed, suppressed, err)
+	}
+}
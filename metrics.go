@@ -0,0 +1,321 @@
+package shuffle
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc"
+)
+
+// Own registry so that only Shuffle metrics and the Go runtime are exposed
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "shuffle_http_requests_total",
+		Help: "HTTP requests handled, by route and status code",
+	}, []string{"route", "method", "code"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "shuffle_http_request_duration_seconds",
+		Help:    "HTTP request latency by route",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	cacheRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "shuffle_cache_requests_total",
+		Help: "Cache lookups by result (hit or miss)",
+	}, []string{"result"})
+
+	dbRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "shuffle_db_request_duration_seconds",
+		Help:    "Database call latency by entity, operation and backend",
+		Buckets: []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"entity", "operation", "backend"})
+
+	queueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "shuffle_queue_depth",
+		Help: "Executions waiting in the queue of an environment, as seen on the last poll",
+	}, []string{"environment"})
+
+	executionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "shuffle_executions_total",
+		Help: "Finished workflow executions by final status",
+	}, []string{"status"})
+
+	actionResultsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "shuffle_action_results_total",
+		Help: "Action results by app and status. FAILURE over the total is the error rate",
+	}, []string{"app_name", "status"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequestsTotal,
+		httpRequestDuration,
+		cacheRequestsTotal,
+		dbRequestDuration,
+		queueDepth,
+		executionsTotal,
+		actionResultsTotal,
+	)
+}
+
+// Serves all metrics in the Prometheus/OpenMetrics format on /metrics.
+// Closed unless SHUFFLE_METRICS_TOKEN is set, and requires it as a bearer token.
+func HandleMetrics(resp http.ResponseWriter, request *http.Request) {
+	if !checkMetricsToken(os.Getenv("SHUFFLE_METRICS_TOKEN"), request.Header.Get("Authorization")) {
+		log.Printf("[AUDIT] Bad metrics token from %s", GetRequestIp(request))
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{
+		EnableOpenMetrics: true,
+	}).ServeHTTP(resp, request)
+}
+
+func checkMetricsToken(metricsToken, authorization string) bool {
+	if len(metricsToken) == 0 {
+		return false
+	}
+
+	expected := []byte(fmt.Sprintf("Bearer %s", metricsToken))
+	return subtle.ConstantTimeCompare([]byte(authorization), expected) == 1
+}
+
+// Records the status code while still letting streaming handlers flush
+type metricsResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *metricsResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *metricsResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func observeHttpRequest(next http.Handler, resp http.ResponseWriter, request *http.Request) {
+	startTime := time.Now()
+	writer := &metricsResponseWriter{ResponseWriter: resp, status: 200}
+	next.ServeHTTP(writer, request)
+
+	route := getMetricsRoute(request.URL.Path)
+	httpRequestsTotal.WithLabelValues(route, request.Method, strconv.Itoa(writer.status)).Inc()
+	httpRequestDuration.WithLabelValues(route, request.Method).Observe(time.Since(startTime).Seconds())
+}
+
+// Replaces IDs in the path so every workflow, execution etc. share a route:
+// /api/v1/workflows/<uuid>/execute -> /api/v1/workflows/:id/execute
+func getMetricsRoute(path string) string {
+	parts := strings.Split(path, "/")
+	if len(parts) > 7 {
+		parts = append(parts[:7], "...")
+	}
+
+	for index, part := range parts {
+		if len(part) == 0 || part == "..." {
+			continue
+		}
+
+		if len(part) >= 32 || strings.HasPrefix(part, "webhook_") {
+			parts[index] = ":id"
+			continue
+		}
+
+		if _, err := strconv.Atoi(part); err == nil {
+			parts[index] = ":id"
+		}
+	}
+
+	return strings.Join(parts, "/")
+}
+
+// Every Datastore and Opensearch call is observed by the client hooks below
+func observeDbDuration(entity, operation, backend string, duration time.Duration) {
+	// Queues have one index per environment
+	if strings.HasPrefix(entity, "workflowqueue-") {
+		entity = "workflowqueue"
+	}
+
+	if len(entity) == 0 {
+		entity = "unknown"
+	}
+
+	dbRequestDuration.WithLabelValues(entity, operation, backend).Observe(duration.Seconds())
+}
+
+// gRPC interceptor for the Datastore client. Added in GetDatastoreClient
+func observeDatastoreRequest(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	startTime := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+
+	entity, operation := getDatastoreRequestLabels(method, req)
+	if len(operation) > 0 {
+		observeDbDuration(entity, operation, "datastore", time.Since(startTime))
+	}
+
+	return err
+}
+
+// Kind and operation of a Datastore RPC. Transaction RPCs return no operation
+func getDatastoreRequestLabels(method string, req interface{}) (string, string) {
+	switch request := req.(type) {
+	case *pb.LookupRequest:
+		if len(request.GetKeys()) > 0 {
+			return getDatastoreKeyKind(request.GetKeys()[0]), "get"
+		}
+
+		return "", "get"
+	case *pb.RunQueryRequest:
+		if len(request.GetQuery().GetKind()) > 0 {
+			return request.GetQuery().GetKind()[0].GetName(), "query"
+		}
+
+		return "", "query"
+	case *pb.RunAggregationQueryRequest:
+		if len(request.GetAggregationQuery().GetNestedQuery().GetKind()) > 0 {
+			return request.GetAggregationQuery().GetNestedQuery().GetKind()[0].GetName(), "count"
+		}
+
+		return "", "count"
+	case *pb.CommitRequest:
+		for _, mutation := range request.GetMutations() {
+			if mutation.GetDelete() != nil {
+				return getDatastoreKeyKind(mutation.GetDelete()), "delete"
+			}
+
+			for _, entity := range []*pb.Entity{mutation.GetUpsert(), mutation.GetInsert(), mutation.GetUpdate()} {
+				if entity != nil {
+					return getDatastoreKeyKind(entity.GetKey()), "set"
+				}
+			}
+		}
+
+		return "", "commit"
+	}
+
+	return "", ""
+}
+
+func getDatastoreKeyKind(key *pb.Key) string {
+	path := key.GetPath()
+	if len(path) == 0 {
+		return ""
+	}
+
+	return path[len(path)-1].GetKind()
+}
+
+// Set as the Logger of the Opensearch client to time every round trip
+type opensearchMetricsLogger struct{}
+
+func (l opensearchMetricsLogger) LogRoundTrip(request *http.Request, response *http.Response, err error, startTime time.Time, duration time.Duration) error {
+	if request == nil || request.URL == nil {
+		return nil
+	}
+
+	entity, operation := getOpensearchRequestLabels(request.Method, request.URL.Path)
+	observeDbDuration(entity, operation, "opensearch", duration)
+	return nil
+}
+
+func (l opensearchMetricsLogger) RequestBodyEnabled() bool  { return false }
+func (l opensearchMetricsLogger) ResponseBodyEnabled() bool { return false }
+
+// /<prefix>_workflow/_doc/<id> -> workflow, get
+func getOpensearchRequestLabels(method, path string) (string, string) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	entity := ""
+	if len(parts) > 0 && !strings.HasPrefix(parts[0], "_") {
+		entity = parts[0]
+		prefix := os.Getenv("SHUFFLE_OPENSEARCH_INDEX_PREFIX")
+		if len(prefix) > 0 {
+			entity = strings.TrimPrefix(entity, fmt.Sprintf("%s_", prefix))
+		}
+	}
+
+	endpoint := ""
+	if len(parts) > 1 {
+		endpoint = parts[1]
+	}
+
+	switch endpoint {
+	case "_search", "_count", "_msearch":
+		return entity, "query"
+	case "_update", "_bulk":
+		return entity, "set"
+	case "_delete_by_query":
+		return entity, "delete"
+	case "_doc", "_create":
+		switch method {
+		case "GET", "HEAD":
+			return entity, "get"
+		case "DELETE":
+			return entity, "delete"
+		default:
+			return entity, "set"
+		}
+	}
+
+	return entity, strings.ToLower(method)
+}
+
+func observeCacheRequest(hit bool) {
+	if hit {
+		cacheRequestsTotal.WithLabelValues("hit").Inc()
+	} else {
+		cacheRequestsTotal.WithLabelValues("miss").Inc()
+	}
+}
+
+func observeQueueDepth(environment string, depth int) {
+	queueDepth.WithLabelValues(environment).Set(float64(depth))
+}
+
+func observeActionResult(actionResult ActionResult) {
+	if actionResult.Status != "SUCCESS" && actionResult.Status != "FAILURE" && actionResult.Status != "ABORTED" && actionResult.Status != "SKIPPED" {
+		return
+	}
+
+	appName := actionResult.Action.AppName
+	if len(appName) == 0 {
+		appName = "unknown"
+	}
+
+	actionResultsTotal.WithLabelValues(strings.ToLower(appName), actionResult.Status).Inc()
+}
+
+// Counted once per execution on this instance, even if it is saved multiple times when done
+func observeExecutionFinished(workflowExecution WorkflowExecution) {
+	if workflowExecution.Status != "FINISHED" && workflowExecution.Status != "ABORTED" && workflowExecution.Status != "FAILURE" {
+		return
+	}
+
+	if _, found := requestCache.Get(fmt.Sprintf("execution_metrics_%s", workflowExecution.ExecutionId)); found {
+		return
+	}
+
+	requestCache.Set(fmt.Sprintf("execution_metrics_%s", workflowExecution.ExecutionId), true, 60*time.Minute)
+	executionsTotal.WithLabelValues(workflowExecution.Status).Inc()
+}
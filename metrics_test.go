@@ -0,0 +1,102 @@
+package shuffle
+
+import (
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+func TestHandleMetricsToken(t *testing.T) {
+	originalToken := os.Getenv("SHUFFLE_METRICS_TOKEN")
+	defer os.Setenv("SHUFFLE_METRICS_TOKEN", originalToken)
+
+	os.Setenv("SHUFFLE_METRICS_TOKEN", "")
+	resp := httptest.NewRecorder()
+	HandleMetrics(resp, httptest.NewRequest("GET", "/metrics", nil))
+	if resp.Code != 401 {
+		t.Errorf("Metrics were served without a configured token: %d", resp.Code)
+	}
+
+	os.Setenv("SHUFFLE_METRICS_TOKEN", "metrics-secret")
+	for _, authorization := range []string{"", "Bearer wrong", "metrics-secret", "Bearer metrics-secret "} {
+		request := httptest.NewRequest("GET", "/metrics", nil)
+		request.Header.Set("Authorization", authorization)
+		resp = httptest.NewRecorder()
+		HandleMetrics(resp, request)
+		if resp.Code != 401 {
+			t.Errorf("Metrics were served with authorization '%s': %d", authorization, resp.Code)
+		}
+	}
+
+	request := httptest.NewRequest("GET", "/metrics", nil)
+	request.Header.Set("Authorization", "Bearer metrics-secret")
+	resp = httptest.NewRecorder()
+	HandleMetrics(resp, request)
+	if resp.Code != 200 || !strings.Contains(resp.Body.String(), "go_goroutines") {
+		t.Errorf("Metrics weren't served with the right token: %d", resp.Code)
+	}
+}
+
+func TestObserveExecutionFinishedLabels(t *testing.T) {
+	before := testutil.ToFloat64(executionsTotal.WithLabelValues("FINISHED"))
+	observeExecutionFinished(WorkflowExecution{ExecutionId: "metrics-test-execution", WorkflowId: "workflow", Status: "FINISHED"})
+	observeExecutionFinished(WorkflowExecution{ExecutionId: "metrics-test-execution", WorkflowId: "workflow", Status: "FINISHED"})
+	observeExecutionFinished(WorkflowExecution{ExecutionId: "metrics-test-running", WorkflowId: "workflow", Status: "EXECUTING"})
+
+	if after := testutil.ToFloat64(executionsTotal.WithLabelValues("FINISHED")); after != before+1 {
+		t.Errorf("Expected one more finished execution, got %f -> %f", before, after)
+	}
+}
+
+func TestDatastoreRequestLabels(t *testing.T) {
+	workflowKey := &pb.Key{Path: []*pb.Key_PathElement{&pb.Key_PathElement{Kind: "workflow"}}}
+	handlers := []struct {
+		request   interface{}
+		entity    string
+		operation string
+	}{
+		{&pb.LookupRequest{Keys: []*pb.Key{workflowKey}}, "workflow", "get"},
+		{&pb.RunQueryRequest{QueryType: &pb.RunQueryRequest_Query{Query: &pb.Query{Kind: []*pb.KindExpression{&pb.KindExpression{Name: "Users"}}}}}, "Users", "query"},
+		{&pb.CommitRequest{Mutations: []*pb.Mutation{&pb.Mutation{Operation: &pb.Mutation_Upsert{Upsert: &pb.Entity{Key: workflowKey}}}}}, "workflow", "set"},
+		{&pb.CommitRequest{Mutations: []*pb.Mutation{&pb.Mutation{Operation: &pb.Mutation_Delete{Delete: workflowKey}}}}, "workflow", "delete"},
+		{&pb.BeginTransactionRequest{}, "", ""},
+	}
+
+	for index, tt := range handlers {
+		entity, operation := getDatastoreRequestLabels("", tt.request)
+		if entity != tt.entity || operation != tt.operation {
+			t.Errorf("getDatastoreRequestLabels(%d) = %s, %s; expected %s, %s", index, entity, operation, tt.entity, tt.operation)
+		}
+	}
+}
+
+func TestOpensearchRequestLabels(t *testing.T) {
+	originalPrefix := os.Getenv("SHUFFLE_OPENSEARCH_INDEX_PREFIX")
+	defer os.Setenv("SHUFFLE_OPENSEARCH_INDEX_PREFIX", originalPrefix)
+	os.Setenv("SHUFFLE_OPENSEARCH_INDEX_PREFIX", "shuffle")
+
+	handlers := []struct {
+		method    string
+		path      string
+		entity    string
+		operation string
+	}{
+		{"GET", "/shuffle_workflow/_doc/1234", "workflow", "get"},
+		{"PUT", "/shuffle_workflow/_doc/1234", "workflow", "set"},
+		{"DELETE", "/shuffle_users/_doc/1234", "users", "delete"},
+		{"POST", "/shuffle_workflowexecution/_search", "workflowexecution", "query"},
+		{"POST", "/shuffle_workflowqueue-env/_delete_by_query", "workflowqueue-env", "delete"},
+		{"GET", "/", "", "get"},
+	}
+
+	for _, tt := range handlers {
+		entity, operation := getOpensearchRequestLabels(tt.method, tt.path)
+		if entity != tt.entity || operation != tt.operation {
+			t.Errorf("getOpensearchRequestLabels(%s %s) = %s, %s; expected %s, %s", tt.method, tt.path, entity, operation, tt.entity, tt.operation)
+		}
+	}
+}
@@ -134,7 +134,7 @@ func HandleClearNotifications(resp http.ResponseWriter, request *http.Request) {
 	}
 
 	/*
-		if user.Role != "admin" {
+		if Authorize(user, "org:manage", "") != nil {
 			log.Printf("[AUTH] User isn't admin")
 			resp.WriteHeader(401)
 			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Need to be admin to list files"}`)))
@@ -195,7 +195,7 @@ func HandleGetNotifications(resp http.ResponseWriter, request *http.Request) {
 	}
 
 	/*
-		if user.Role != "admin" {
+		if Authorize(user, "org:manage", "") != nil {
 			log.Printf("[AUTH] User isn't admin")
 			resp.WriteHeader(401)
 			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Need to be admin to list files"}`)))
@@ -730,6 +730,8 @@ func CreateOrgNotification(ctx context.Context, title, description, referenceUrl
 
 	selectedApikey := ""
 
+	// The parent may decide which workflow its suborgs notify
+	org = getEffectiveOrg(ctx, org)
 	authOrg := org
 	if org.Defaults.NotificationWorkflow == "parent" && org.CreatorOrg != "" {
 		log.Printf("[DEBUG] Sending notification to parent org %s' notification workflow", org.CreatorOrg)
@@ -746,7 +748,7 @@ func CreateOrgNotification(ctx context.Context, title, description, referenceUrl
 	}
 
 	for _, user := range authOrg.Users {
-		if user.Role == "admin" && len(user.ApiKey) > 0 && len(selectedApikey) == 0 {
+		if len(user.ApiKey) > 0 && len(selectedApikey) == 0 && hasOrgPermission(user, authOrg.Id, "org:manage") {
 			// Checking if it's the right active org
 			// FIXME: Should it need to be in the active org? Shouldn't matter? :thinking:
 			foundUser, err := GetUser(ctx, user.Id)
@@ -837,7 +839,7 @@ func CreateOrgNotification(ctx context.Context, title, description, referenceUrl
 			filteredUsers = org.Users
 		} else {
 			for _, user := range org.Users {
-				if user.Role == "admin" {
+				if hasOrgPermission(user, org.Id, "org:manage") {
 					filteredUsers = append(filteredUsers, user)
 				}
 			}
@@ -845,7 +847,7 @@ func CreateOrgNotification(ctx context.Context, title, description, referenceUrl
 
 		selectedApikey := ""
 		for _, user := range filteredUsers {
-			if user.Role == "admin" && len(user.ApiKey) > 0 && len(selectedApikey) == 0 {
+			if len(user.ApiKey) > 0 && len(selectedApikey) == 0 && hasOrgPermission(user, org.Id, "org:manage") {
 				// Checking if it's the right active org
 				// FIXME: Should it need to be in the active org? Shouldn't matter? :thinking:
 				foundUser, err := GetUser(ctx, user.Id)
@@ -1087,7 +1089,7 @@ func HandleCreateNotification(resp http.ResponseWriter, request *http.Request) {
 		notification.OrgId = orgId
 	}
 
-	if user.Role == "org-reader" {
+	if Authorize(user, "notifications:write", "") != nil {
 		log.Printf("[INFO] User %s (%s) tried to create a notification without being admin", user.Username, user.Id)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false}`))
@@ -505,7 +505,7 @@ func HandleNewGmailRegister(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Role == "org-reader" {
+	if Authorize(user, "triggers:write", "") != nil {
 		log.Printf("[WARNING] Org-reader doesn't have access to register gmail: %s (%s)", user.Username, user.Id)
 		resp.WriteHeader(403)
 		resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
@@ -728,7 +728,7 @@ func HandleNewOutlookRegister(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Role == "org-reader" {
+	if Authorize(user, "triggers:write", "") != nil {
 		log.Printf("[WARNING] Org-reader doesn't have access to register outlook: %s (%s)", user.Username, user.Id)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
@@ -936,7 +936,7 @@ func HandleGetSpecificTrigger(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Username != trigger.Owner && user.Role != "admin" {
+	if user.Username != trigger.Owner && Authorize(user, "triggers:manage", "") != nil {
 		log.Printf("[AUDIT] Wrong user (%s) for trigger %s", user.Username, trigger.Id)
 		resp.WriteHeader(403)
 		return
@@ -1422,7 +1422,7 @@ func HandleDeleteGmailSub(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Role == "org-reader" {
+	if Authorize(user, "triggers:write", "") != nil {
 		log.Printf("[WARNING] Org-reader doesn't have access delete gmail sub: %s (%s)", user.Username, user.Id)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
@@ -1430,7 +1430,7 @@ func HandleDeleteGmailSub(resp http.ResponseWriter, request *http.Request) {
 	}
 
 	if user.Id != workflow.Owner || len(user.Id) == 0 {
-		if workflow.OrgId == user.ActiveOrg.Id && user.Role == "admin" {
+		if Authorize(user, "triggers:manage", workflow.OrgId) == nil {
 			log.Printf("[INFO] User %s is accessing %s as admin (delete gmail sub)", user.Username, workflow.ID)
 		} else {
 			log.Printf("[WARNING] Wrong user (%s) for workflow %s when deleting gmail ", user.Username, workflow.ID)
@@ -1518,7 +1518,7 @@ func HandleDeleteOutlookSub(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Role == "org-reader" {
+	if Authorize(user, "triggers:write", "") != nil {
 		log.Printf("[WARNING] Org-reader doesn't have access to delete outlook (shared): %s (%s)", user.Username, user.Id)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
@@ -1527,7 +1527,7 @@ func HandleDeleteOutlookSub(resp http.ResponseWriter, request *http.Request) {
 
 	// FIXME - have a check for org etc too..
 	if user.Id != workflow.Owner || len(user.Id) == 0 {
-		if workflow.OrgId == user.ActiveOrg.Id && user.Role == "admin" {
+		if Authorize(user, "triggers:manage", workflow.OrgId) == nil {
 			log.Printf("[INFO] User %s is accessing %s as admin (delete outlook sub)", user.Username, workflow.ID)
 		} else {
 			log.Printf("[WARNING] Wrong user (%s) for workflow %s when deploying outlook", user.Username, workflow.ID)
@@ -1590,7 +1590,7 @@ func HandleCreateOutlookSub(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Role == "org-reader" {
+	if Authorize(user, "triggers:write", "") != nil {
 		log.Printf("[WARNING] Org-reader doesn't have access to create outlook sub (shared): %s (%s)", user.Username, user.Id)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
@@ -1598,7 +1598,7 @@ func HandleCreateOutlookSub(resp http.ResponseWriter, request *http.Request) {
 	}
 
 	// FIXME - have a check for org etc too..
-	if user.Id != workflow.Owner && user.Role != "admin" {
+	if user.Id != workflow.Owner && Authorize(user, "triggers:manage", "") != nil {
 		log.Printf("[WARNING] Wrong user (%s) for workflow %s when deploying outlook", user.Username, workflow.ID)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false}`))
@@ -1868,7 +1868,7 @@ func HandleCreateGmailSub(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Role == "org-reader" {
+	if Authorize(user, "triggers:write", "") != nil {
 		log.Printf("[WARNING] Org-reader doesn't have access create gmail sub: %s (%s)", user.Username, user.Id)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
@@ -1876,7 +1876,7 @@ func HandleCreateGmailSub(resp http.ResponseWriter, request *http.Request) {
 	}
 
 	// FIXME - have a check for org etc too..
-	if user.Id != workflow.Owner && user.Role != "admin" {
+	if user.Id != workflow.Owner && Authorize(user, "triggers:manage", "") != nil {
 		log.Printf("[WARNING] Wrong user (%s) for workflow %s when deploying outlook", user.Username, workflow.ID)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false}`))
@@ -4187,8 +4187,15 @@ func VerifyIdToken(ctx context.Context, idToken string) (IdTokenCheck, error) {
 			}
 			// Validating the user itself
 			if token.Aud == org.SSOConfig.OpenIdClientId || foundChallenge == org.SSOConfig.OpenIdClientSecret {
+				claims, err := verifyOidcIdToken(ctx, org, idToken)
+				if err != nil {
+					log.Printf("[WARNING] ID token verification failed for org %s: %s", org.Id, err)
+					return IdTokenCheck{}, err
+				}
+
 				log.Printf("[DEBUG] Correct token aud & challenge - successful login!")
 				token.Org = *org
+				token.Claims = claims
 				return token, nil
 			} else {
 			}
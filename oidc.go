@@ -0,0 +1,506 @@
+package shuffle
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// How long signing keys are cached. Unknown key IDs trigger a refresh at most
+// once per minute, which is how key rotation at the IdP is picked up.
+var oidcJwksCacheMinutes = int32(60)
+
+type oidcJwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type oidcJwks struct {
+	Keys []oidcJwk `json:"keys"`
+}
+
+func getOidcCacheKey(prefix, value string) string {
+	hash := sha256.Sum256([]byte(value))
+	return fmt.Sprintf("%s_%s", prefix, hex.EncodeToString(hash[:16]))
+}
+
+func getOidcUrl(ctx context.Context, fetchUrl string) ([]byte, error) {
+	client := &http.Client{Timeout: 15 * time.Second}
+	req, err := http.NewRequestWithContext(ctx, "GET", fetchUrl, nil)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	req.Header.Add("accept", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return []byte{}, errors.New(fmt.Sprintf("Bad status code %d from %s", res.StatusCode, fetchUrl))
+	}
+
+	return ioutil.ReadAll(io.LimitReader(res.Body, 1024*1024))
+}
+
+// The configured JWKS URL, or the one from the issuer's discovery document
+func getOidcJwksUrl(ctx context.Context, config OidcConfig) (string, error) {
+	if len(config.JwksUrl) > 0 {
+		return config.JwksUrl, nil
+	}
+
+	discoveryUrl := fmt.Sprintf("%s/.well-known/openid-configuration", strings.TrimRight(config.Issuer, "/"))
+	cacheKey := getOidcCacheKey("oidc_discovery", discoveryUrl)
+	cache, err := GetCache(ctx, cacheKey)
+	if err == nil {
+		return string(cache.([]uint8)), nil
+	}
+
+	body, err := getOidcUrl(ctx, discoveryUrl)
+	if err != nil {
+		return "", err
+	}
+
+	discovery := struct {
+		JwksUri string `json:"jwks_uri"`
+	}{}
+
+	err = json.Unmarshal(body, &discovery)
+	if err != nil || len(discovery.JwksUri) == 0 {
+		return "", errors.New(fmt.Sprintf("No jwks_uri in discovery document %s", discoveryUrl))
+	}
+
+	SetCache(ctx, cacheKey, []byte(discovery.JwksUri), oidcJwksCacheMinutes)
+	return discovery.JwksUri, nil
+}
+
+func decodeOidcInt(value string) (*big.Int, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(decoded), nil
+}
+
+func parseOidcJwk(key oidcJwk) (crypto.PublicKey, error) {
+	switch key.Kty {
+	case "RSA":
+		n, err := decodeOidcInt(key.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeOidcInt(key.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch key.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New(fmt.Sprintf("Unsupported curve %s", key.Crv))
+		}
+
+		x, err := decodeOidcInt(key.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decodeOidcInt(key.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("Unsupported key type %s", key.Kty))
+}
+
+func findOidcKey(data []byte, kid string) (crypto.PublicKey, error) {
+	var jwks oidcJwks
+	err := json.Unmarshal(data, &jwks)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range jwks.Keys {
+		if key.Use == "enc" {
+			continue
+		}
+
+		// Tokens without a key ID can only be checked against a single key
+		if key.Kid == kid || (len(kid) == 0 && len(jwks.Keys) == 1) {
+			return parseOidcJwk(key)
+		}
+	}
+
+	return nil, errors.New(fmt.Sprintf("Key %s not found", kid))
+}
+
+// Returns the signing key with the ID. The key set is cached, and fetched
+// again when the key isn't in it, as that means the IdP rotated its keys.
+func getOidcKey(ctx context.Context, jwksUrl, kid string) (crypto.PublicKey, error) {
+	cacheKey := getOidcCacheKey("oidc_jwks", jwksUrl)
+	cache, err := GetCache(ctx, cacheKey)
+	if err == nil {
+		key, err := findOidcKey([]byte(cache.([]uint8)), kid)
+		if err == nil {
+			return key, nil
+		}
+	}
+
+	refreshKey := getOidcCacheKey("oidc_jwks_refreshed", jwksUrl)
+	if _, err := GetCache(ctx, refreshKey); err == nil {
+		return nil, errors.New(fmt.Sprintf("Key %s not found, and the keys were refreshed less than a minute ago", kid))
+	}
+
+	SetCache(ctx, refreshKey, []byte("1"), 1)
+	body, err := getOidcUrl(ctx, jwksUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[INFO] Refreshed OpenID signing keys from %s", jwksUrl)
+	SetCache(ctx, cacheKey, body, oidcJwksCacheMinutes)
+	return findOidcKey(body, kid)
+}
+
+// ID tokens can only be verified when the org has an issuer or JWKS URL
+func canVerifyOidcIdToken(org *Org) bool {
+	return len(org.OidcConfig.Issuer) > 0 || len(org.OidcConfig.JwksUrl) > 0
+}
+
+// Verifies the signature, audience, issuer and expiry of an ID token and
+// returns its claims. Tokens are never read without verifying them.
+func verifyOidcIdToken(ctx context.Context, org *Org, idToken string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	if !canVerifyOidcIdToken(org) {
+		return claims, errors.New(fmt.Sprintf("ID token for org %s can't be verified. Set the OpenID issuer or JWKS URL to use ID tokens.", org.Id))
+	}
+
+	jwksUrl, err := getOidcJwksUrl(ctx, org.OidcConfig)
+	if err != nil {
+		return claims, err
+	}
+
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithAudience(org.SSOConfig.OpenIdClientId),
+		jwt.WithLeeway(2 * time.Minute),
+	}
+
+	if len(org.OidcConfig.Issuer) > 0 {
+		options = append(options, jwt.WithIssuer(org.OidcConfig.Issuer))
+	}
+
+	_, err = jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return getOidcKey(ctx, jwksUrl, kid)
+	}, options...)
+	if err != nil {
+		return claims, err
+	}
+
+	if _, found := claims["exp"]; !found {
+		return claims, errors.New("ID token has no expiry")
+	}
+
+	return claims, nil
+}
+
+// Groups from the configured claim. Either a list or a single string
+func getOidcGroups(org *Org, claims map[string]interface{}) []string {
+	claimName := org.OidcConfig.GroupsClaim
+	if len(claimName) == 0 {
+		claimName = "groups"
+	}
+
+	groups := []string{}
+	switch value := claims[claimName].(type) {
+	case string:
+		for _, group := range strings.Split(value, ",") {
+			if len(strings.TrimSpace(group)) > 0 {
+				groups = append(groups, strings.TrimSpace(group))
+			}
+		}
+	case []interface{}:
+		for _, group := range value {
+			if groupString, ok := group.(string); ok {
+				groups = append(groups, groupString)
+			}
+		}
+	}
+
+	return groups
+}
+
+func getOidcDefaultRole(ctx context.Context, org *Org) string {
+	if len(org.OidcConfig.DefaultRole) > 0 && isValidOrgRole(ctx, org.OidcConfig.DefaultRole, org.Id) {
+		return org.OidcConfig.DefaultRole
+	}
+
+	return "user"
+}
+
+func getOrgUserRole(org *Org, userId string) string {
+	for _, orgUser := range org.Users {
+		if orgUser.Id == userId {
+			return orgUser.Role
+		}
+	}
+
+	return ""
+}
+
+func hasOidcGroup(groups []string, group string) bool {
+	for _, userGroup := range groups {
+		if strings.EqualFold(userGroup, group) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Resolves the org's group mappings. The first matching mapping per org wins.
+// If the org itself has mappings but none match, the user falls back to the
+// default role, so removing someone from a group at the IdP demotes them.
+// Returns the role in the org, the roles in matched suborgs, and every
+// suborg the mappings manage.
+func getOidcMappedRoles(ctx context.Context, org *Org, groups []string) (string, map[string]string, []string) {
+	role := ""
+	orgMapped := false
+	suborgRoles := map[string]string{}
+	managedSuborgs := []string{}
+	for _, mapping := range org.OidcConfig.GroupMappings {
+		matched := hasOidcGroup(groups, mapping.Group)
+		if len(mapping.OrgId) == 0 || mapping.OrgId == org.Id {
+			orgMapped = true
+			if matched && len(role) == 0 {
+				role = mapping.Role
+			}
+
+			continue
+		}
+
+		if !ArrayContains(managedSuborgs, mapping.OrgId) {
+			managedSuborgs = append(managedSuborgs, mapping.OrgId)
+		}
+
+		if _, found := suborgRoles[mapping.OrgId]; matched && !found {
+			suborgRoles[mapping.OrgId] = mapping.Role
+		}
+	}
+
+	if orgMapped && len(role) == 0 {
+		role = getOidcDefaultRole(ctx, org)
+	}
+
+	return role, suborgRoles, managedSuborgs
+}
+
+// Applies the org's group mappings.
+// Runs on every login so group changes at the IdP are picked up.
+func applyOidcMappings(ctx context.Context, user *User, org *Org, groups []string) {
+	role, suborgRoles, managedSuborgs := getOidcMappedRoles(ctx, org, groups)
+
+	if len(role) > 0 && getOrgUserRole(org, user.Id) != role {
+		err := addUserToOrg(ctx, user, org, role)
+		if err != nil {
+			log.Printf("[WARNING] Failed setting OpenID role %s for %s in org %s: %s", role, user.Username, org.Id, err)
+		} else {
+			log.Printf("[AUDIT] Set role of %s (%s) in org %s to %s from OpenID groups", user.Username, user.Id, org.Id, role)
+		}
+	}
+
+	for _, suborgId := range managedSuborgs {
+		suborg, err := GetOrg(ctx, suborgId)
+		if err != nil {
+			log.Printf("[WARNING] Failed getting suborg %s for OpenID mapping in org %s: %s", suborgId, org.Id, err)
+			continue
+		}
+
+		suborgRole, matched := suborgRoles[suborgId]
+		if matched && getOrgUserRole(suborg, user.Id) != suborgRole {
+			err = addUserToOrg(ctx, user, suborg, suborgRole)
+			if err != nil {
+				log.Printf("[WARNING] Failed adding %s to suborg %s from OpenID groups: %s", user.Username, suborgId, err)
+				continue
+			}
+
+			log.Printf("[AUDIT] Added %s (%s) to suborg %s with role %s from OpenID groups", user.Username, user.Id, suborgId, suborgRole)
+		} else if !matched && ArrayContains(user.Orgs, suborgId) {
+			err = removeUserFromOrg(ctx, user, suborg, false)
+			if err != nil {
+				log.Printf("[WARNING] Failed removing %s from suborg %s from OpenID groups: %s", user.Username, suborgId, err)
+				continue
+			}
+
+			log.Printf("[AUDIT] Removed %s (%s) from suborg %s as they are no longer in a mapped OpenID group", user.Username, user.Id, suborgId)
+		}
+	}
+
+	// The login continues in the org itself
+	if orgRole := getOrgUserRole(org, user.Id); len(orgRole) > 0 {
+		user.Role = orgRole
+		user.Roles = []string{orgRole}
+	}
+}
+
+// Sets the OpenID config of the active org. Suborg mappings can only point
+// to the org's own suborgs.
+func HandleSetOidcConfig(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in set OpenID config: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if Authorize(user, "org:manage", "") != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "You don't have access to change SSO settings"}`))
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		log.Printf("[WARNING] Failed reading body in set OpenID config: %s", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	var config OidcConfig
+	err = json.Unmarshal(body, &config)
+	if err != nil {
+		log.Printf("[WARNING] Failed unmarshalling OpenID config: %s", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Failed parsing OpenID config"}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	org, err := GetOrg(ctx, user.ActiveOrg.Id)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting org %s for OpenID config: %s", user.ActiveOrg.Id, err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	err = checkInheritedSetting(ctx, org, "sso")
+	if err != nil {
+		resp.WriteHeader(403)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	config.Issuer = strings.TrimRight(strings.TrimSpace(config.Issuer), "/")
+	config.JwksUrl = strings.TrimSpace(config.JwksUrl)
+	for _, configUrl := range []string{config.Issuer, config.JwksUrl} {
+		if len(configUrl) > 0 && !strings.HasPrefix(configUrl, "https://") && !strings.HasPrefix(configUrl, "http://") {
+			resp.WriteHeader(400)
+			resp.Write([]byte(`{"success": false, "reason": "The issuer and JWKS URL have to be http(s) URLs"}`))
+			return
+		}
+	}
+
+	if len(config.DefaultRole) > 0 && !isValidOrgRole(ctx, config.DefaultRole, org.Id) {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Invalid default role '%s'"}`, config.DefaultRole)))
+		return
+	}
+
+	for _, mapping := range config.GroupMappings {
+		if len(strings.TrimSpace(mapping.Group)) == 0 {
+			resp.WriteHeader(400)
+			resp.Write([]byte(`{"success": false, "reason": "Group mappings need a group"}`))
+			return
+		}
+
+		mappingOrgId := org.Id
+		if len(mapping.OrgId) > 0 && mapping.OrgId != org.Id {
+			suborg, err := GetOrg(ctx, mapping.OrgId)
+			if err != nil || suborg.CreatorOrg != org.Id {
+				resp.WriteHeader(400)
+				resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Org %s is not a suborg of this org"}`, mapping.OrgId)))
+				return
+			}
+
+			mappingOrgId = suborg.Id
+		}
+
+		if !isValidOrgRole(ctx, mapping.Role, mappingOrgId) {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Invalid role '%s' for group %s"}`, mapping.Role, mapping.Group)))
+			return
+		}
+	}
+
+	if len(config.Issuer) > 0 && len(config.JwksUrl) == 0 {
+		_, err = getOidcJwksUrl(ctx, config)
+		if err != nil {
+			log.Printf("[WARNING] Failed OpenID discovery for %s: %s", config.Issuer, err)
+			resp.WriteHeader(400)
+			resp.Write([]byte(`{"success": false, "reason": "Failed finding the JWKS URL from the issuer. Set jwks_url instead"}`))
+			return
+		}
+	}
+
+	oldConfig := org.OidcConfig
+	org.OidcConfig = config
+	err = SetOrg(ctx, *org, org.Id)
+	if err != nil {
+		log.Printf("[ERROR] Failed saving OpenID config for org %s: %s", org.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	log.Printf("[AUDIT] User %s (%s) updated the OpenID config of org %s with %d group mappings", user.Username, user.Id, org.Id, len(config.GroupMappings))
+	CreateAuditEvent(ctx, request, user, org.Id, "org.oidc_update", "org", org.Id, oldConfig, config)
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
@@ -0,0 +1,143 @@
+package shuffle
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func getTestOidcJwks(key *rsa.PublicKey, kid string) []byte {
+	data, _ := json.Marshal(oidcJwks{
+		Keys: []oidcJwk{
+			oidcJwk{
+				Kid: kid,
+				Kty: "RSA",
+				Use: "sig",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			},
+		},
+	})
+
+	return data
+}
+
+func TestVerifyOidcIdToken(t *testing.T) {
+	signingKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, request *http.Request) {
+		resp.Write(getTestOidcJwks(&signingKey.PublicKey, "test-key"))
+	}))
+	defer server.Close()
+
+	org := &Org{Id: "org"}
+	org.SSOConfig.OpenIdClientId = "client"
+	org.OidcConfig.JwksUrl = server.URL
+	org.OidcConfig.Issuer = "https://idp.example.com"
+
+	sign := func(key *rsa.PrivateKey, claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "test-key"
+		signed, _ := token.SignedString(key)
+		return signed
+	}
+
+	validClaims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":    "https://idp.example.com",
+			"aud":    "client",
+			"sub":    "user",
+			"exp":    time.Now().Add(time.Hour).Unix(),
+			"groups": []string{"admins"},
+		}
+	}
+
+	wrongAudience := validClaims()
+	wrongAudience["aud"] = "other-client"
+
+	wrongIssuer := validClaims()
+	wrongIssuer["iss"] = "https://evil.example.com"
+
+	expired := validClaims()
+	expired["exp"] = time.Now().Add(-1 * time.Hour).Unix()
+
+	noExpiry := validClaims()
+	delete(noExpiry, "exp")
+
+	unsigned, _ := jwt.NewWithClaims(jwt.SigningMethodNone, validClaims()).SignedString(jwt.UnsafeAllowNoneSignatureType)
+
+	handlers := []struct {
+		name     string
+		token    string
+		expected bool
+	}{
+		{"valid", sign(signingKey, validClaims()), true},
+		{"wrong audience", sign(signingKey, wrongAudience), false},
+		{"wrong issuer", sign(signingKey, wrongIssuer), false},
+		{"expired", sign(signingKey, expired), false},
+		{"no expiry", sign(signingKey, noExpiry), false},
+		{"forged", sign(otherKey, validClaims()), false},
+		{"unsigned", unsigned, false},
+	}
+
+	for _, tt := range handlers {
+		claims, err := verifyOidcIdToken(context.Background(), org, tt.token)
+		if (err == nil) != tt.expected {
+			t.Errorf("verifyOidcIdToken(%s) = %v; expected success %v", tt.name, err, tt.expected)
+		}
+
+		if err == nil && len(getOidcGroups(org, claims)) != 1 {
+			t.Errorf("verifyOidcIdToken(%s) groups = %v; expected [admins]", tt.name, getOidcGroups(org, claims))
+		}
+	}
+
+	// Orgs without an issuer or JWKS URL can't use ID tokens at all
+	unverifiedOrg := &Org{Id: "unverified"}
+	unverifiedOrg.SSOConfig.OpenIdClientId = "client"
+	_, err := verifyOidcIdToken(context.Background(), unverifiedOrg, sign(otherKey, validClaims()))
+	if err == nil {
+		t.Errorf("verifyOidcIdToken should fail for orgs without an issuer or JWKS URL")
+	}
+}
+
+func TestOidcMappedRoles(t *testing.T) {
+	ctx := context.Background()
+	org := &Org{Id: "oidc-org"}
+	org.OidcConfig.DefaultRole = "org-reader"
+	org.OidcConfig.GroupMappings = []OidcGroupMapping{
+		OidcGroupMapping{Group: "Admins", Role: "admin"},
+		OidcGroupMapping{Group: "Engineers", Role: "user"},
+		OidcGroupMapping{Group: "Engineers", Role: "user", OrgId: "oidc-suborg"},
+	}
+
+	role, suborgRoles, managedSuborgs := getOidcMappedRoles(ctx, org, []string{"admins", "engineers"})
+	if role != "admin" || suborgRoles["oidc-suborg"] != "user" || len(managedSuborgs) != 1 {
+		t.Errorf("Matching groups = %s, %v, %v; expected admin in the org and user in the suborg", role, suborgRoles, managedSuborgs)
+	}
+
+	// Removed from every mapped group at the IdP
+	role, suborgRoles, _ = getOidcMappedRoles(ctx, org, []string{"marketing"})
+	if role != "org-reader" {
+		t.Errorf("User without mapped groups kept role %s; expected to be demoted to the default role", role)
+	}
+
+	if _, found := suborgRoles["oidc-suborg"]; found {
+		t.Errorf("User without mapped groups kept a suborg role")
+	}
+
+	// Orgs without mappings of their own keep the roles set in Shuffle
+	org.OidcConfig.GroupMappings = org.OidcConfig.GroupMappings[2:]
+	if role, _, _ = getOidcMappedRoles(ctx, org, []string{}); role != "" {
+		t.Errorf("Org without its own mappings got role %s", role)
+	}
+}
@@ -0,0 +1,411 @@
+package shuffle
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Used when an org has no policy, e.g. during registration
+var defaultPasswordPolicy = PasswordPolicy{
+	MinLength: 4,
+}
+
+// Used when a policy locks accounts without saying for how long
+var defaultLockoutMinutes = 15
+
+// bcrypt ignores everything past 72 bytes
+var maxPasswordLength = 72
+var maxPasswordHistory = 24
+
+// Returns the org's policy with defaults filled in
+func getPasswordPolicy(org *Org) PasswordPolicy {
+	if org == nil {
+		return defaultPasswordPolicy
+	}
+
+	policy := org.PasswordPolicy
+	if policy.MinLength < defaultPasswordPolicy.MinLength {
+		policy.MinLength = defaultPasswordPolicy.MinLength
+	}
+
+	if policy.HistoryCount > maxPasswordHistory {
+		policy.HistoryCount = maxPasswordHistory
+	}
+
+	// Lockout is opt-in. Everyone else is only throttled.
+	if policy.LockoutAttempts <= 0 {
+		policy.LockoutAttempts = 0
+		policy.LockoutMinutes = 0
+	} else if policy.LockoutMinutes <= 0 {
+		policy.LockoutMinutes = defaultLockoutMinutes
+	}
+
+	return policy
+}
+
+// Checks a new password against a policy and the breached password list.
+// Use SetUserPassword to set a password, which also checks the password history.
+func CheckPasswordPolicy(policy PasswordPolicy, password string) error {
+	if len(password) < policy.MinLength {
+		return errors.New(fmt.Sprintf("Minimum password length is %d.", policy.MinLength))
+	}
+
+	if len(password) > maxPasswordLength {
+		return errors.New(fmt.Sprintf("Maximum password length is %d.", maxPasswordLength))
+	}
+
+	hasUpper, hasLower, hasNumber, hasSpecial := false, false, false, false
+	for _, char := range password {
+		switch {
+		case unicode.IsUpper(char):
+			hasUpper = true
+		case unicode.IsLower(char):
+			hasLower = true
+		case unicode.IsDigit(char):
+			hasNumber = true
+		case unicode.IsPunct(char) || unicode.IsSymbol(char) || unicode.IsSpace(char):
+			hasSpecial = true
+		}
+	}
+
+	if policy.RequireUppercase && !hasUpper {
+		return errors.New("Password must contain an upper case char")
+	}
+
+	if policy.RequireLowercase && !hasLower {
+		return errors.New("Password must contain a lower case char")
+	}
+
+	if policy.RequireNumber && !hasNumber {
+		return errors.New("Password must contain a number")
+	}
+
+	if policy.RequireSpecial && !hasSpecial {
+		return errors.New("Password must contain a special char")
+	}
+
+	breached, err := isBreachedPassword(password)
+	if err != nil {
+		log.Printf("[WARNING] Failed checking breached password list: %s", err)
+	} else if breached {
+		return errors.New("This password has been found in a data breach. Please choose another one.")
+	}
+
+	return nil
+}
+
+// Checks a password against a local copy of the Pwned Passwords range files.
+// SHUFFLE_BREACHED_PASSWORDS_PATH is a directory with one file per 5 character
+// SHA-1 prefix (e.g. 21BD1 or 21BD1.txt), each line being "SUFFIX:COUNT".
+// The list is only read by prefix, so the full hash is never looked up as is.
+func isBreachedPassword(password string) (bool, error) {
+	breachedPath := os.Getenv("SHUFFLE_BREACHED_PASSWORDS_PATH")
+	if len(breachedPath) == 0 {
+		return false, nil
+	}
+
+	hash := sha1.Sum([]byte(password))
+	hexHash := strings.ToUpper(hex.EncodeToString(hash[:]))
+	prefix, suffix := hexHash[:5], hexHash[5:]
+
+	var file *os.File
+	var err error
+	for _, filename := range []string{prefix, fmt.Sprintf("%s.txt", prefix)} {
+		file, err = os.Open(filepath.Join(breachedPath, filename))
+		if err == nil {
+			break
+		}
+	}
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		lineSuffix := strings.Split(line, ":")[0]
+		if !strings.EqualFold(lineSuffix, suffix) {
+			continue
+		}
+
+		// Padding entries in the range files have a count of 0
+		if strings.HasSuffix(line, ":0") {
+			return false, nil
+		}
+
+		return true, nil
+	}
+
+	return false, scanner.Err()
+}
+
+// Fails if the password is the current one or one of the last historyCount ones
+func checkPasswordHistory(user User, password string, historyCount int) error {
+	if historyCount <= 0 {
+		return nil
+	}
+
+	hashes := []string{}
+	if len(user.Password) > 0 {
+		hashes = append(hashes, user.Password)
+	}
+
+	history := user.PasswordHistory
+	if len(history) > historyCount {
+		history = history[len(history)-historyCount:]
+	}
+
+	hashes = append(hashes, history...)
+	for _, hash := range hashes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil {
+			return errors.New(fmt.Sprintf("Can't reuse any of your last %d passwords", historyCount))
+		}
+	}
+
+	return nil
+}
+
+// Combines the policies of every org a user is in. A password has to
+// be accepted by each of them.
+func mergePasswordPolicies(policies []PasswordPolicy) PasswordPolicy {
+	if len(policies) == 0 {
+		return defaultPasswordPolicy
+	}
+
+	merged := policies[0]
+	for _, policy := range policies[1:] {
+		if policy.MinLength > merged.MinLength {
+			merged.MinLength = policy.MinLength
+		}
+
+		if policy.HistoryCount > merged.HistoryCount {
+			merged.HistoryCount = policy.HistoryCount
+		}
+
+		// 0 means passwords don't expire
+		if policy.MaxAgeDays > 0 && (merged.MaxAgeDays == 0 || policy.MaxAgeDays < merged.MaxAgeDays) {
+			merged.MaxAgeDays = policy.MaxAgeDays
+		}
+
+		merged.RequireUppercase = merged.RequireUppercase || policy.RequireUppercase
+		merged.RequireLowercase = merged.RequireLowercase || policy.RequireLowercase
+		merged.RequireNumber = merged.RequireNumber || policy.RequireNumber
+		merged.RequireSpecial = merged.RequireSpecial || policy.RequireSpecial
+	}
+
+	return merged
+}
+
+// The policy a new password for the user has to follow
+func getUserPasswordPolicy(ctx context.Context, user User) PasswordPolicy {
+	orgIds := user.Orgs
+	if len(user.ActiveOrg.Id) > 0 && !ArrayContains(orgIds, user.ActiveOrg.Id) {
+		orgIds = append(orgIds, user.ActiveOrg.Id)
+	}
+
+	policies := []PasswordPolicy{}
+	for _, orgId := range orgIds {
+		if len(orgId) == 0 {
+			continue
+		}
+
+		org, err := GetOrg(ctx, orgId)
+		if err != nil {
+			log.Printf("[WARNING] Failed getting org %s for the password policy of %s: %s", orgId, user.Id, err)
+			continue
+		}
+
+		policies = append(policies, getPasswordPolicy(getEffectiveOrg(ctx, org)))
+	}
+
+	return mergePasswordPolicies(policies)
+}
+
+// Checks a new password against the policy of the user's orgs and their history,
+// then sets it. Every path that sets a user's password uses this: registration,
+// password resets, and users or admins changing a password.
+func SetUserPassword(ctx context.Context, user *User, password string) error {
+	policy := getUserPasswordPolicy(ctx, *user)
+	err := CheckPasswordPolicy(policy, password)
+	if err != nil {
+		return err
+	}
+
+	err = checkPasswordHistory(*user, password, policy.HistoryCount)
+	if err != nil {
+		return err
+	}
+
+	return setUserPassword(user, password, policy)
+}
+
+// Hashes and sets a new password, keeping the old hash in the history
+func setUserPassword(user *User, password string, policy PasswordPolicy) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 8)
+	if err != nil {
+		return err
+	}
+
+	if len(user.Password) > 0 && policy.HistoryCount > 0 {
+		user.PasswordHistory = append(user.PasswordHistory, user.Password)
+	}
+
+	if len(user.PasswordHistory) > policy.HistoryCount {
+		user.PasswordHistory = user.PasswordHistory[len(user.PasswordHistory)-policy.HistoryCount:]
+	}
+
+	user.Password = string(hashedPassword)
+	user.PasswordChanged = time.Now().Unix()
+	user.LockedUntil = 0
+	return nil
+}
+
+func isPasswordExpired(user User, policy PasswordPolicy) bool {
+	if policy.MaxAgeDays <= 0 {
+		return false
+	}
+
+	changed := user.PasswordChanged
+	if changed == 0 {
+		changed = user.CreationTime
+	}
+
+	if changed == 0 {
+		return false
+	}
+
+	return time.Now().Unix() > changed+int64(policy.MaxAgeDays*86400)
+}
+
+func HandleGetPasswordPolicy(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in get password policy: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	org, err := GetOrg(ctx, user.ActiveOrg.Id)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting org %s for password policy: %s", user.ActiveOrg.Id, err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	newjson, err := json.Marshal(getPasswordPolicy(getEffectiveOrg(ctx, org)))
+	if err != nil {
+		log.Printf("[WARNING] Failed marshalling password policy: %s", err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// Sets the password policy of the active org. Existing passwords are
+// checked against it the next time they are changed or expire.
+func HandleSetPasswordPolicy(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in set password policy: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if Authorize(user, "org:manage", "") != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "You don't have access to change the password policy"}`))
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		log.Printf("[WARNING] Failed reading body in set password policy: %s", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	var policy PasswordPolicy
+	err = json.Unmarshal(body, &policy)
+	if err != nil {
+		log.Printf("[WARNING] Failed unmarshalling password policy: %s", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Failed parsing password policy"}`))
+		return
+	}
+
+	if policy.MinLength > maxPasswordLength || policy.MaxAgeDays < 0 || policy.HistoryCount < 0 || policy.HistoryCount > maxPasswordHistory || policy.LockoutAttempts < 0 || policy.LockoutMinutes < 0 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Invalid policy. Min length can be at most %d and history at most %d. Other values can't be negative"}`, maxPasswordLength, maxPasswordHistory)))
+		return
+	}
+
+	ctx := GetContext(request)
+	org, err := GetOrg(ctx, user.ActiveOrg.Id)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting org %s for password policy: %s", user.ActiveOrg.Id, err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	err = checkInheritedSetting(ctx, org, "password_policy")
+	if err != nil {
+		resp.WriteHeader(403)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	oldPolicy := org.PasswordPolicy
+	org.PasswordPolicy = policy
+	err = SetOrg(ctx, *org, org.Id)
+	if err != nil {
+		log.Printf("[ERROR] Failed saving password policy for org %s: %s", org.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	log.Printf("[AUDIT] User %s (%s) updated the password policy of org %s", user.Username, user.Id, org.Id)
+	CreateAuditEvent(ctx, request, user, org.Id, "org.password_policy_update", "org", org.Id, oldPolicy, policy)
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
@@ -0,0 +1,95 @@
+package shuffle
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// Puts an org in the cache so GetOrg doesn't need the database
+func setTestOrgCache(t *testing.T, org Org) {
+	oldCacheDb := project.CacheDb
+	project.CacheDb = true
+	t.Cleanup(func() { project.CacheDb = oldCacheDb })
+
+	data, err := json.Marshal(org)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SetCache(context.Background(), "Organizations_"+org.Id, data, 10)
+}
+
+func TestMergePasswordPolicies(t *testing.T) {
+	merged := mergePasswordPolicies([]PasswordPolicy{
+		{MinLength: 8, RequireUppercase: true, HistoryCount: 2},
+		{MinLength: 12, RequireNumber: true, HistoryCount: 1, MaxAgeDays: 90},
+		{MinLength: 4, MaxAgeDays: 30},
+		{MinLength: 4},
+	})
+
+	if merged.MinLength != 12 || merged.HistoryCount != 2 || merged.MaxAgeDays != 30 || !merged.RequireUppercase || !merged.RequireNumber || merged.RequireSpecial {
+		t.Errorf("mergePasswordPolicies = %#v; expected the strictest of both", merged)
+	}
+
+	if mergePasswordPolicies([]PasswordPolicy{}) != defaultPasswordPolicy {
+		t.Errorf("mergePasswordPolicies without orgs isn't the default policy")
+	}
+}
+
+func TestSetUserPassword(t *testing.T) {
+	ctx := context.Background()
+	setTestOrgCache(t, Org{Id: "password-test-org", PasswordPolicy: PasswordPolicy{MinLength: 10, RequireNumber: true, HistoryCount: 2}})
+
+	user := &User{Id: "password-test-user", Orgs: []string{"password-test-org"}}
+	if err := SetUserPassword(ctx, user, "short1"); err == nil {
+		t.Errorf("Password shorter than the org's policy was set")
+	}
+
+	if err := SetUserPassword(ctx, user, "longpassword"); err == nil {
+		t.Errorf("Password without the org's required number was set")
+	}
+
+	if err := SetUserPassword(ctx, user, "longpassword1"); err != nil {
+		t.Fatalf("Valid password was rejected: %s", err)
+	}
+
+	if err := SetUserPassword(ctx, user, "longpassword2"); err != nil {
+		t.Fatalf("Valid password was rejected: %s", err)
+	}
+
+	// Both the current and earlier passwords are in the history
+	if err := SetUserPassword(ctx, user, "longpassword2"); err == nil {
+		t.Errorf("Current password was reused")
+	}
+
+	if err := SetUserPassword(ctx, user, "longpassword1"); err == nil {
+		t.Errorf("Previous password was reused")
+	}
+
+	// Users without an org get the default policy
+	if err := SetUserPassword(ctx, &User{Id: "no-org"}, "abc"); err == nil {
+		t.Errorf("Password shorter than the default policy was set")
+	}
+}
+
+func TestCheckPasswordPolicyLength(t *testing.T) {
+	if err := CheckPasswordPolicy(defaultPasswordPolicy, "password1234"); err != nil {
+		t.Errorf("Password was rejected by the default policy: %s", err)
+	}
+
+	if err := CheckPasswordPolicy(defaultPasswordPolicy, strings.Repeat("a", 72)); err != nil {
+		t.Errorf("Password of 72 bytes was rejected: %s", err)
+	}
+
+	// bcrypt would ignore the last byte
+	if err := CheckPasswordPolicy(defaultPasswordPolicy, strings.Repeat("a", 73)); err == nil {
+		t.Errorf("Password longer than 72 bytes was accepted")
+	}
+
+	// Bytes count, not characters
+	if err := CheckPasswordPolicy(defaultPasswordPolicy, strings.Repeat("ø", 37)); err == nil {
+		t.Errorf("Password of 74 bytes was accepted")
+	}
+}
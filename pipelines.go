@@ -29,7 +29,7 @@ func HandleNewPipelineRegister(resp http.ResponseWriter, request *http.Request)
 		return
 	}
 
-	if user.Role == "org-reader" {
+	if Authorize(user, "triggers:write", "") != nil {
 		resp.WriteHeader(403)
 		resp.Write([]byte(`{"success": false, "reason": "You do not have permission to register a new pipeline."}`))
 		return
@@ -0,0 +1,510 @@
+package shuffle
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Requests per minute for an org per route group. Buckets can hold twice
+// that to allow short bursts. Can be overridden with environment variables
+// like SHUFFLE_RATELIMIT_FREE_EXECUTE=120.
+var rateLimitPlans = map[string]map[string]int{
+	"free": {
+		"api":     300,
+		"execute": 60,
+		"auth":    20,
+	},
+	"paid": {
+		"api":     1200,
+		"execute": 600,
+		"auth":    60,
+	},
+}
+
+// Requests without credentials are limited per IP
+var ipRateLimits = map[string]int{
+	"api":     120,
+	"execute": 60,
+	"auth":    20,
+}
+
+// Traffic from workers and apps during executions is never limited
+var rateLimitSkippedPaths = []string{
+	"/api/v1/streams",
+	"/api/v1/workflows/queue",
+	"/api/v1/health",
+	"/api/v1/_ah/health",
+}
+
+type rateLimitKey struct {
+	Key       string
+	PerMinute int
+	Capacity  int
+}
+
+type rateLimitBucket struct {
+	Tokens  float64 `json:"tokens"`
+	Updated int64   `json:"updated"`
+}
+
+type rateLimitResult struct {
+	Limit      int
+	Remaining  int
+	ResetAfter int
+	Allowed    bool
+}
+
+func isRateLimitEnabled() bool {
+	enabled := strings.ToLower(os.Getenv("SHUFFLE_RATELIMIT"))
+	if enabled == "false" {
+		return false
+	}
+
+	return enabled == "true" || project.Environment == "cloud"
+}
+
+func getRateLimitGroup(request *http.Request) string {
+	path := strings.ToLower(request.URL.Path)
+	if strings.Contains(path, "/login") || strings.Contains(path, "/register") || strings.Contains(path, "/password") || strings.Contains(path, "/saml/") {
+		return "auth"
+	}
+
+	if strings.HasSuffix(path, "/execute") || strings.HasPrefix(path, "/api/v1/hooks/") || strings.Contains(path, "/run") {
+		return "execute"
+	}
+
+	return "api"
+}
+
+// Free orgs get the free plan. Customers, POVs and orgs with an active
+// subscription get the paid one.
+func getOrgPlan(org Org) string {
+	if org.LeadInfo.Customer || org.LeadInfo.POV || org.LeadInfo.Internal {
+		return "paid"
+	}
+
+	for _, subscription := range org.Subscriptions {
+		if subscription.Active {
+			return "paid"
+		}
+	}
+
+	return "free"
+}
+
+// Returns the requests per minute for the org in a route group
+func getOrgRateLimit(org Org, group string) int {
+	for _, override := range org.RateLimits {
+		if override.Group == group && override.RequestsPerMinute > 0 {
+			return override.RequestsPerMinute
+		}
+	}
+
+	plan := getOrgPlan(org)
+	envLimit := os.Getenv(fmt.Sprintf("SHUFFLE_RATELIMIT_%s_%s", strings.ToUpper(plan), strings.ToUpper(group)))
+	if len(envLimit) > 0 {
+		limit, err := strconv.Atoi(envLimit)
+		if err == nil && limit > 0 {
+			return limit
+		}
+	}
+
+	return rateLimitPlans[plan][group]
+}
+
+// Takes a token from each bucket. Nothing is taken if any of them are empty.
+// State lives in the cache so all replicas share it. Concurrent requests
+// may both read the same state, which only lets a few extra requests through.
+func takeRateLimitTokens(ctx context.Context, keys []rateLimitKey) rateLimitResult {
+	timeNow := time.Now().UnixNano() / int64(time.Millisecond)
+	buckets := []rateLimitBucket{}
+	result := rateLimitResult{Allowed: true, Remaining: -1}
+	for _, key := range keys {
+		perMinute := float64(key.PerMinute)
+		capacity := float64(key.Capacity)
+
+		bucket := rateLimitBucket{Tokens: capacity, Updated: timeNow}
+		cache, err := GetCache(ctx, key.Key)
+		if err == nil {
+			cacheData := []byte(cache.([]uint8))
+			err = json.Unmarshal(cacheData, &bucket)
+			if err != nil {
+				bucket = rateLimitBucket{Tokens: capacity, Updated: timeNow}
+			}
+		}
+
+		bucket.Tokens = math.Min(capacity, bucket.Tokens+float64(timeNow-bucket.Updated)*perMinute/60000)
+		bucket.Updated = timeNow
+		buckets = append(buckets, bucket)
+
+		// The headers show the bucket closest to running out
+		remaining := int(bucket.Tokens) - 1
+		if remaining < 0 {
+			remaining = 0
+		}
+
+		if result.Remaining == -1 || remaining < result.Remaining {
+			result.Limit = int(capacity)
+			result.Remaining = remaining
+			result.ResetAfter = int(math.Ceil((capacity - bucket.Tokens + 1) * 60 / perMinute))
+		}
+
+		if bucket.Tokens < 1 {
+			result.Allowed = false
+			result.ResetAfter = int(math.Ceil((1 - bucket.Tokens) * 60 / perMinute))
+		}
+	}
+
+	if !result.Allowed {
+		return result
+	}
+
+	for index, key := range keys {
+		buckets[index].Tokens -= 1
+		data, err := json.Marshal(buckets[index])
+		if err != nil {
+			continue
+		}
+
+		// Long enough for the bucket to refill completely
+		err = SetCache(ctx, key.Key, data, 3)
+		if err != nil {
+			log.Printf("[WARNING] Failed setting rate limit cache for %s: %s", key.Key, err)
+		}
+	}
+
+	return result
+}
+
+func setRateLimitHeaders(resp http.ResponseWriter, result rateLimitResult) {
+	if resp == nil {
+		return
+	}
+
+	if result.ResetAfter < 1 {
+		result.ResetAfter = 1
+	}
+
+	resp.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	resp.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	resp.Header().Set("RateLimit-Reset", strconv.Itoa(result.ResetAfter))
+	if !result.Allowed {
+		resp.Header().Set("Retry-After", strconv.Itoa(result.ResetAfter))
+	}
+}
+
+// Hash of the API key or session used, so the raw credential isn't a cache key
+func getRateLimitCredential(request *http.Request) string {
+	credential := ""
+	authorization := request.Header.Get("Authorization")
+	if strings.HasPrefix(authorization, "Bearer ") {
+		credential = strings.TrimPrefix(authorization, "Bearer ")
+	} else {
+		credential = getSessionToken(request)
+	}
+
+	if len(credential) == 0 {
+		return ""
+	}
+
+	hash := sha256.Sum256([]byte(credential))
+	return hex.EncodeToString(hash[:16])
+}
+
+// Remembers which org a credential belongs to. The middleware runs before
+// authentication, so this is how it finds the org to limit. Only called once
+// the credential has been validated, when the authentication caches are
+// refreshed, so unknown credentials are limited by IP alone.
+func setRateLimitOrg(ctx context.Context, request *http.Request, orgId string) {
+	credential := getRateLimitCredential(request)
+	if len(credential) == 0 || len(orgId) == 0 {
+		return
+	}
+
+	err := SetCache(ctx, fmt.Sprintf("ratelimit_org_%s", credential), []byte(orgId), 60)
+	if err != nil {
+		log.Printf("[WARNING] Failed setting rate limit org for %s: %s", orgId, err)
+	}
+}
+
+// Returns the org of a credential validated by setRateLimitOrg
+func getRateLimitOrg(ctx context.Context, credential string) (*Org, error) {
+	if len(credential) == 0 {
+		return &Org{}, errors.New("No credential")
+	}
+
+	cache, err := GetCache(ctx, fmt.Sprintf("ratelimit_org_%s", credential))
+	if err != nil {
+		return &Org{}, err
+	}
+
+	return GetOrg(ctx, string([]byte(cache.([]uint8))))
+}
+
+// Requests per minute for an IP in a route group. Can be overridden with
+// environment variables like SHUFFLE_RATELIMIT_IP_API=600.
+func getIpRateLimit(group string) int {
+	envLimit := os.Getenv(fmt.Sprintf("SHUFFLE_RATELIMIT_IP_%s", strings.ToUpper(group)))
+	if len(envLimit) > 0 {
+		limit, err := strconv.Atoi(envLimit)
+		if err == nil && limit > 0 {
+			return limit
+		}
+	}
+
+	return ipRateLimits[group]
+}
+
+// Apps and workers authenticate with the execution ID and its authorization.
+// Only the real pair skips the limits.
+func isValidExecutionAuth(ctx context.Context, executionId, authorization string) bool {
+	if len(executionId) == 0 || len(authorization) == 0 {
+		return false
+	}
+
+	workflowExecution, err := GetWorkflowExecution(ctx, executionId)
+	if err != nil || len(workflowExecution.Authorization) == 0 {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(workflowExecution.Authorization), []byte(authorization)) == 1
+}
+
+// Returns the buckets a request takes a token from. Every request is limited
+// per IP. Credentials that have been validated are also limited per key and
+// per org.
+func getRateLimitKeys(request *http.Request, group string, org Org) []rateLimitKey {
+	ipLimit := getIpRateLimit(group)
+	keys := []rateLimitKey{}
+
+	credential := getRateLimitCredential(request)
+	if len(credential) > 0 && len(org.Id) > 0 {
+		// A single IP may be all of an org's traffic
+		limit := getOrgRateLimit(org, group)
+		if limit > ipLimit {
+			ipLimit = limit
+		}
+
+		// One key or session can use at most half of the org's limit
+		keyLimit := int(math.Max(1, float64(limit/2)))
+		keys = append(keys, rateLimitKey{
+			Key:       fmt.Sprintf("ratelimit_%s_key_%s", group, credential),
+			PerMinute: keyLimit,
+			Capacity:  keyLimit * 2,
+		})
+
+		keys = append(keys, rateLimitKey{
+			Key:       fmt.Sprintf("ratelimit_%s_org_%s", group, org.Id),
+			PerMinute: limit,
+			Capacity:  limit * 2,
+		})
+	}
+
+	keys = append([]rateLimitKey{rateLimitKey{
+		Key:       fmt.Sprintf("ratelimit_%s_ip_%s", group, GetRequestIp(request)),
+		PerMinute: ipLimit,
+		Capacity:  ipLimit * 2,
+	}}, keys...)
+
+	return keys
+}
+
+// Checks the limits of a request. Returns false if it was rejected, in
+// which case a 429 has already been written.
+func checkRateLimit(resp http.ResponseWriter, request *http.Request) bool {
+	if !isRateLimitEnabled() || request.Method == "OPTIONS" || !strings.HasPrefix(request.URL.Path, "/api/") {
+		return true
+	}
+
+	for _, path := range rateLimitSkippedPaths {
+		if strings.HasPrefix(request.URL.Path, path) {
+			return true
+		}
+	}
+
+	ctx := GetContext(request)
+	executionId := request.URL.Query().Get("execution_id")
+	authorization := request.URL.Query().Get("authorization")
+	if len(executionId) > 0 && len(authorization) > 0 && isValidExecutionAuth(ctx, executionId, authorization) {
+		return true
+	}
+
+	group := getRateLimitGroup(request)
+	org, err := getRateLimitOrg(ctx, getRateLimitCredential(request))
+	if err != nil {
+		org = &Org{}
+	}
+
+	keys := getRateLimitKeys(request, group, *org)
+	result := takeRateLimitTokens(ctx, keys)
+	setRateLimitHeaders(resp, result)
+	if result.Allowed {
+		return true
+	}
+
+	log.Printf("[INFO] Rate limited %s request to %s for %s", group, request.URL.Path, keys[len(keys)-1].Key)
+	resp.WriteHeader(429)
+	resp.Write([]byte(`{"success": false, "reason": "Too many requests"}`))
+	return false
+}
+
+func rateLimitHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, request *http.Request) {
+		if !checkRateLimit(resp, request) {
+			return
+		}
+
+		next.ServeHTTP(resp, request)
+	})
+}
+
+// Overrides the plan limits of an org. Only for support users, as org admins
+// could otherwise lift their own limits.
+func HandleSetOrgRateLimits(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in set rate limits: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if !isSupportUser(user) {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Only support users can change rate limits"}`))
+		return
+	}
+
+	location := strings.Split(strings.Split(request.URL.String(), "?")[0], "/")
+	if len(location) <= 4 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Org ID required"}`))
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	rateLimits := []RateLimit{}
+	err = json.Unmarshal(body, &rateLimits)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Failed parsing rate limits"}`))
+		return
+	}
+
+	for _, rateLimit := range rateLimits {
+		if _, found := ipRateLimits[rateLimit.Group]; !found || rateLimit.RequestsPerMinute < 0 {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Invalid rate limit for group '%s'. Groups are api, execute and auth"}`, rateLimit.Group)))
+			return
+		}
+	}
+
+	ctx := GetContext(request)
+	org, err := GetOrg(ctx, location[4])
+	if err != nil {
+		resp.WriteHeader(404)
+		resp.Write([]byte(`{"success": false, "reason": "Org not found"}`))
+		return
+	}
+
+	oldRateLimits := org.RateLimits
+	org.RateLimits = rateLimits
+	err = SetOrg(ctx, *org, org.Id)
+	if err != nil {
+		log.Printf("[ERROR] Failed saving rate limits for org %s: %s", org.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	log.Printf("[AUDIT] User %s (%s) updated the rate limits of org %s", user.Username, user.Id, org.Id)
+	CreateAuditEvent(ctx, request, user, org.Id, "org.rate_limits_update", "org", org.Id, oldRateLimits, rateLimits)
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
+
+// Shows the current limits of the org
+func HandleGetOrgRateLimits(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in get rate limits: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	org, err := GetOrg(ctx, user.ActiveOrg.Id)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	rateLimits := []RateLimit{}
+	for _, group := range []string{"api", "execute", "auth"} {
+		rateLimits = append(rateLimits, RateLimit{
+			Group:             group,
+			RequestsPerMinute: getOrgRateLimit(*org, group),
+		})
+	}
+
+	newjson, err := json.Marshal(struct {
+		Success    bool        `json:"success"`
+		Plan       string      `json:"plan"`
+		Enabled    bool        `json:"enabled"`
+		RateLimits []RateLimit `json:"rate_limits"`
+	}{
+		Success:    true,
+		Plan:       getOrgPlan(*org),
+		Enabled:    isRateLimitEnabled(),
+		RateLimits: rateLimits,
+	})
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// Returns the IP used by ValidateRequestOverload. Local requests aren't limited.
+func getRequestOverloadIp(request *http.Request) (string, error) {
+	foundIP := GetRequestIp(request)
+	if foundIP == "" || foundIP == "127.0.0.1" || foundIP == "::1" {
+		return foundIP, errors.New("Local request")
+	}
+
+	return foundIP, nil
+}
@@ -0,0 +1,125 @@
+package shuffle
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestGetRateLimitKeys(t *testing.T) {
+	request := httptest.NewRequest("GET", "/api/v1/workflows", nil)
+	request.RemoteAddr = "10.0.0.1:1234"
+
+	// Unknown credentials are only limited per IP
+	request.Header.Set("Authorization", "Bearer unvalidated-api-key")
+	keys := getRateLimitKeys(request, "api", Org{})
+	if len(keys) != 1 || !strings.Contains(keys[0].Key, "_ip_") {
+		t.Errorf("getRateLimitKeys without a validated org = %v; expected only an IP bucket", keys)
+	}
+
+	// Validated credentials are limited per IP, key and org
+	org := Org{Id: "org"}
+	keys = getRateLimitKeys(request, "api", org)
+	if len(keys) != 3 {
+		t.Fatalf("getRateLimitKeys with a validated org = %v; expected IP, key and org buckets", keys)
+	}
+
+	if !strings.Contains(keys[0].Key, "_ip_") || !strings.Contains(keys[1].Key, "_key_") || !strings.Contains(keys[2].Key, "_org_org") {
+		t.Errorf("getRateLimitKeys with a validated org = %v; expected IP, key and org buckets", keys)
+	}
+
+	if keys[0].PerMinute < getOrgRateLimit(org, "api") {
+		t.Errorf("IP limit %d is lower than the org limit %d", keys[0].PerMinute, getOrgRateLimit(org, "api"))
+	}
+
+	// Requests without credentials never get an org
+	request.Header.Del("Authorization")
+	keys = getRateLimitKeys(request, "api", org)
+	if len(keys) != 1 {
+		t.Errorf("getRateLimitKeys without credentials = %v; expected only an IP bucket", keys)
+	}
+}
+
+func TestTakeRateLimitTokens(t *testing.T) {
+	ctx := context.Background()
+	keys := []rateLimitKey{
+		rateLimitKey{Key: "ratelimit_test_ip", PerMinute: 1, Capacity: 3},
+		rateLimitKey{Key: "ratelimit_test_key", PerMinute: 1, Capacity: 2},
+	}
+
+	for i := 0; i < 2; i++ {
+		result := takeRateLimitTokens(ctx, keys)
+		if !result.Allowed {
+			t.Fatalf("Request %d was rate limited: %#v", i, result)
+		}
+	}
+
+	result := takeRateLimitTokens(ctx, keys)
+	if result.Allowed || result.ResetAfter < 1 {
+		t.Errorf("Request above the smallest bucket was allowed: %#v", result)
+	}
+
+	// Rejected requests take nothing, so the IP bucket still has a token
+	result = takeRateLimitTokens(ctx, keys[:1])
+	if !result.Allowed {
+		t.Errorf("Rejected request took a token from the IP bucket: %#v", result)
+	}
+}
+
+func TestIsValidExecutionAuth(t *testing.T) {
+	if isValidExecutionAuth(context.Background(), "", "authorization") || isValidExecutionAuth(context.Background(), "execution", "") {
+		t.Errorf("isValidExecutionAuth accepted an empty execution ID or authorization")
+	}
+}
+
+func TestRateLimitIpIgnoresSpoofedHeaders(t *testing.T) {
+	originalProxies := os.Getenv("SHUFFLE_TRUSTED_PROXIES")
+	defer os.Setenv("SHUFFLE_TRUSTED_PROXIES", originalProxies)
+	os.Setenv("SHUFFLE_TRUSTED_PROXIES", "")
+
+	buckets := map[string]bool{}
+	for _, spoofed := range []string{"1.1.1.1", "2.2.2.2, 3.3.3.3", ""} {
+		request := httptest.NewRequest("GET", "/api/v1/workflows", nil)
+		request.RemoteAddr = "203.0.113.7:4321"
+		request.Header.Set("X-Forwarded-For", spoofed)
+		request.Header.Set("X-Real-IP", "4.4.4.4")
+		request.Header.Set("CF-Connecting-IP", "5.5.5.5")
+
+		keys := getRateLimitKeys(request, "api", Org{})
+		buckets[keys[0].Key] = true
+	}
+
+	if len(buckets) != 1 || !buckets["ratelimit_api_ip_203.0.113.7"] {
+		t.Errorf("Spoofed forwarding headers changed the IP bucket: %v", buckets)
+	}
+}
+
+func TestGetRequestIpTrustedProxies(t *testing.T) {
+	originalProxies := os.Getenv("SHUFFLE_TRUSTED_PROXIES")
+	defer os.Setenv("SHUFFLE_TRUSTED_PROXIES", originalProxies)
+	os.Setenv("SHUFFLE_TRUSTED_PROXIES", "10.0.0.0/8, 192.168.1.1")
+
+	handlers := []struct {
+		remoteAddr string
+		forwarded  string
+		expected   string
+	}{
+		{"203.0.113.7:4321", "1.1.1.1", "203.0.113.7"},                // Untrusted peer
+		{"10.0.0.2:4321", "1.1.1.1", "1.1.1.1"},                       // Trusted peer
+		{"10.0.0.2:4321", "6.6.6.6, 1.1.1.1", "1.1.1.1"},              // Client prepended a hop
+		{"10.0.0.2:4321", "6.6.6.6, 1.1.1.1, 192.168.1.1", "1.1.1.1"}, // Chained trusted proxies
+		{"10.0.0.2:4321", "not-an-ip", "10.0.0.2"},
+		{"[2001:db8::1]:4321", "1.1.1.1", "2001:db8::1"},
+	}
+
+	for _, tt := range handlers {
+		request := httptest.NewRequest("GET", "/api/v1/workflows", nil)
+		request.RemoteAddr = tt.remoteAddr
+		request.Header.Set("X-Forwarded-For", tt.forwarded)
+		if ip := GetRequestIp(request); ip != tt.expected {
+			t.Errorf("GetRequestIp(%s, %s) = %s; expected %s", tt.remoteAddr, tt.forwarded, ip, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,529 @@
+package shuffle
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// All permissions a role can be made of. "workflow:*" gives every workflow
+// permission, and "*" gives everything.
+var validPermissions = []string{
+	"workflow:read",
+	"workflow:write",
+	"workflow:execute",
+	"executions:manage",
+	"app-auth:use",
+	"app-auth:manage",
+	"apps:write",
+	"files:read",
+	"files:write",
+	"files:manage",
+	"triggers:write",
+	"triggers:manage",
+	"detection:write",
+	"notifications:write",
+	"stats:write",
+	"users:manage",
+	"org:manage",
+}
+
+// The built-in roles. These match what admin, user and org-reader
+// could do before roles were configurable.
+var builtinRoles = map[string][]string{
+	"admin": []string{"*"},
+	"user": []string{
+		"workflow:*",
+		"app-auth:use",
+		"apps:write",
+		"files:read",
+		"files:write",
+		"triggers:write",
+		"detection:write",
+		"notifications:write",
+		"stats:write",
+	},
+	"org-reader": []string{
+		"workflow:read",
+		"files:read",
+	},
+}
+
+func isBuiltinRole(role string) bool {
+	_, found := builtinRoles[role]
+	return found
+}
+
+func isValidPermission(permission string) bool {
+	if permission == "*" || ArrayContains(validPermissions, permission) {
+		return true
+	}
+
+	if strings.HasSuffix(permission, ":*") {
+		prefix := strings.TrimSuffix(permission, "*")
+		for _, validPermission := range validPermissions {
+			if strings.HasPrefix(validPermission, prefix) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func permissionsContain(permissions []string, permission string) bool {
+	for _, granted := range permissions {
+		if granted == "*" || granted == permission {
+			return true
+		}
+
+		if strings.HasSuffix(granted, ":*") && strings.HasPrefix(permission, strings.TrimSuffix(granted, "*")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the permissions of a user's role in their active org.
+// Custom roles are referenced by their ID.
+func getRolePermissions(ctx context.Context, user User) ([]string, error) {
+	if permissions, found := builtinRoles[user.Role]; found {
+		return permissions, nil
+	}
+
+	if len(user.Role) == 0 {
+		return []string{}, errors.New("User has no role")
+	}
+
+	role, err := GetOrgRole(ctx, user.Role)
+	if err != nil {
+		return []string{}, errors.New(fmt.Sprintf("Role %s not found: %s", user.Role, err))
+	}
+
+	if role.OrgId != user.ActiveOrg.Id {
+		return []string{}, errors.New(fmt.Sprintf("Role %s doesn't belong to org %s", user.Role, user.ActiveOrg.Id))
+	}
+
+	return role.Permissions, nil
+}
+
+// Checks if the user has a permission. If resourceOrgId is set, the
+// resource also has to be in the user's active org.
+func Authorize(user User, permission string, resourceOrgId string) error {
+	if len(resourceOrgId) > 0 && resourceOrgId != user.ActiveOrg.Id {
+		return errors.New(fmt.Sprintf("User %s is not in org %s", user.Username, resourceOrgId))
+	}
+
+	permissions, err := getRolePermissions(context.Background(), user)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting permissions for user %s (%s): %s", user.Username, user.Id, err)
+		return err
+	}
+
+	if !permissionsContain(permissions, permission) {
+		log.Printf("[AUDIT] User %s (%s) with role %s is missing permission %s", user.Username, user.Id, user.Role, permission)
+		return errors.New(fmt.Sprintf("Missing permission %s", permission))
+	}
+
+	// Scoped API keys can never do more than the user's role
+	if len(user.ApiKeyId) > 0 && !permissionsContain(user.ApiKeyScopes, permission) {
+		log.Printf("[AUDIT] API key %s of user %s (%s) is missing scope %s", user.ApiKeyId, user.Username, user.Id, permission)
+		return errors.New(fmt.Sprintf("API key is missing scope %s", permission))
+	}
+
+	if !supportGrantAllows(user, permission) {
+		log.Printf("[AUDIT] Support user %s (%s) with %s access is missing permission %s", user.Username, user.Id, user.SupportGrantAccess, permission)
+		return errors.New(fmt.Sprintf("Support access doesn't cover %s", permission))
+	}
+
+	return nil
+}
+
+// Expands wildcards into the permissions they give
+func expandPermissions(permissions []string) []string {
+	expanded := []string{}
+	for _, permission := range validPermissions {
+		if permissionsContain(permissions, permission) {
+			expanded = append(expanded, permission)
+		}
+	}
+
+	return expanded
+}
+
+// The permissions the user can use right now. Scoped API keys only get
+// the part of the role their scopes allow, and support users the part
+// their grant allows.
+func getUserPermissions(ctx context.Context, user User) []string {
+	rolePermissions, err := getRolePermissions(ctx, user)
+	if err != nil {
+		return []string{}
+	}
+
+	permissions := []string{}
+	for _, permission := range expandPermissions(rolePermissions) {
+		if len(user.ApiKeyId) > 0 && !permissionsContain(user.ApiKeyScopes, permission) {
+			continue
+		}
+
+		if !supportGrantAllows(user, permission) {
+			continue
+		}
+
+		permissions = append(permissions, permission)
+	}
+
+	return permissions
+}
+
+// Permissions can only be handed out by users who have them, so
+// users:manage can't be used to get more access than the user has.
+func canGrantPermissions(ctx context.Context, user User, permissions []string) error {
+	userPermissions := getUserPermissions(ctx, user)
+	for _, permission := range expandPermissions(permissions) {
+		if !ArrayContains(userPermissions, permission) {
+			log.Printf("[AUDIT] User %s (%s) tried to grant permission %s they don't have", user.Username, user.Id, permission)
+			return errors.New(fmt.Sprintf("You can't grant the permission %s", permission))
+		}
+	}
+
+	return nil
+}
+
+func canGrantRole(ctx context.Context, user User, role string) error {
+	permissions, err := getRolePermissions(ctx, User{Role: role, ActiveOrg: OrgMini{Id: user.ActiveOrg.Id}})
+	if err != nil {
+		return err
+	}
+
+	return canGrantPermissions(ctx, user, permissions)
+}
+
+// Users can only manage users with fewer permissions than themselves.
+// Users with every permission (admins) can manage anyone in the org.
+func canManageUser(ctx context.Context, user User, target User) error {
+	if user.Id == target.Id {
+		return nil
+	}
+
+	userPermissions := getUserPermissions(ctx, user)
+	if len(userPermissions) == len(validPermissions) {
+		return nil
+	}
+
+	targetRole := ""
+	org, err := GetOrg(ctx, user.ActiveOrg.Id)
+	if err == nil {
+		targetRole = getOrgUserRole(org, target.Id)
+	} else if target.ActiveOrg.Id == user.ActiveOrg.Id {
+		targetRole = target.Role
+	}
+
+	// Users outside the org can't be compared, so they can't be managed
+	if len(targetRole) == 0 {
+		log.Printf("[AUDIT] User %s (%s) tried to manage user %s (%s) without a role in org %s", user.Username, user.Id, target.Username, target.Id, user.ActiveOrg.Id)
+		return errors.New(fmt.Sprintf("User %s isn't in your organization", target.Username))
+	}
+
+	targetPermissions, err := getRolePermissions(ctx, User{Role: targetRole, ActiveOrg: OrgMini{Id: user.ActiveOrg.Id}})
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed getting the role of user %s", target.Username))
+	}
+
+	err = hasMorePermissions(userPermissions, targetPermissions)
+	if err != nil {
+		log.Printf("[AUDIT] User %s (%s) tried to manage user %s (%s): %s", user.Username, user.Id, target.Username, target.Id, err)
+		return errors.New("You can only manage users with fewer permissions than yourself")
+	}
+
+	return nil
+}
+
+// Checks that the user has every permission of the target, and more
+func hasMorePermissions(userPermissions, targetPermissions []string) error {
+	userPermissions = expandPermissions(userPermissions)
+	targetPermissions = expandPermissions(targetPermissions)
+	for _, permission := range targetPermissions {
+		if !ArrayContains(userPermissions, permission) {
+			return errors.New(fmt.Sprintf("Target has permission %s", permission))
+		}
+	}
+
+	if len(targetPermissions) >= len(userPermissions) {
+		return errors.New("Target has the same permissions")
+	}
+
+	return nil
+}
+
+// Checks another user's permission in an org, e.g. when looking for
+// admins to notify. The role is the one from the org's user list.
+func hasOrgPermission(orgUser User, orgId, permission string) bool {
+	orgUser.ActiveOrg.Id = orgId
+	permissions, err := getRolePermissions(context.Background(), orgUser)
+	if err != nil {
+		return false
+	}
+
+	return permissionsContain(permissions, permission)
+}
+
+// Checks if a role can be given to users in the org
+func isValidOrgRole(ctx context.Context, role, orgId string) bool {
+	if isBuiltinRole(role) {
+		return true
+	}
+
+	orgRole, err := GetOrgRole(ctx, role)
+	if err != nil {
+		return false
+	}
+
+	return orgRole.OrgId == orgId
+}
+
+// Lists the built-in roles and the org's own roles
+func HandleGetOrgRoles(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in get org roles: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	roles, err := GetOrgRoles(ctx, user.ActiveOrg.Id)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting roles for org %s: %s", user.ActiveOrg.Id, err)
+		roles = []OrgRole{}
+	}
+
+	for _, name := range []string{"admin", "user", "org-reader"} {
+		roles = append(roles, OrgRole{
+			Id:          name,
+			Name:        name,
+			Description: "Built-in role",
+			Permissions: builtinRoles[name],
+		})
+	}
+
+	newjson, err := json.Marshal(struct {
+		Success     bool      `json:"success"`
+		Roles       []OrgRole `json:"roles"`
+		Permissions []string  `json:"permissions"`
+	}{
+		Success:     true,
+		Roles:       roles,
+		Permissions: validPermissions,
+	})
+	if err != nil {
+		log.Printf("[WARNING] Failed marshalling org roles: %s", err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// Creates or updates a custom role. Users get it through the users API
+// by setting their role to the role ID.
+func HandleSetOrgRole(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in set org role: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if Authorize(user, "users:manage", "") != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "You don't have access to manage roles"}`))
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		log.Printf("[WARNING] Failed reading body in set org role: %s", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	var role OrgRole
+	err = json.Unmarshal(body, &role)
+	if err != nil {
+		log.Printf("[WARNING] Failed unmarshalling org role: %s", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Failed parsing role"}`))
+		return
+	}
+
+	role.Name = strings.TrimSpace(role.Name)
+	if len(role.Name) == 0 || len(role.Name) > 64 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Role name must be between 1 and 64 characters"}`))
+		return
+	}
+
+	if isBuiltinRole(strings.ToLower(role.Name)) {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Can't use the name of a built-in role"}`))
+		return
+	}
+
+	permissions := []string{}
+	for _, permission := range role.Permissions {
+		permission = strings.ToLower(strings.TrimSpace(permission))
+		if !isValidPermission(permission) {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Invalid permission '%s'. Use one of: %s"}`, permission, strings.Join(validPermissions, ", "))))
+			return
+		}
+
+		if !ArrayContains(permissions, permission) {
+			permissions = append(permissions, permission)
+		}
+	}
+
+	role.Permissions = permissions
+
+	ctx := GetContext(request)
+	err = canGrantPermissions(ctx, user, role.Permissions)
+	if err != nil {
+		resp.WriteHeader(403)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	if len(role.Id) > 0 {
+		existing, err := GetOrgRole(ctx, role.Id)
+		if err != nil || existing.OrgId != user.ActiveOrg.Id {
+			resp.WriteHeader(404)
+			resp.Write([]byte(`{"success": false, "reason": "Role not found"}`))
+			return
+		}
+
+		// Users with the role may have more access than the editor
+		err = canGrantPermissions(ctx, user, existing.Permissions)
+		if err != nil {
+			resp.WriteHeader(403)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+			return
+		}
+
+		role.Created = existing.Created
+		role.CreatedBy = existing.CreatedBy
+	} else {
+		role.Id = uuid.NewV4().String()
+		role.Created = time.Now().Unix()
+		role.CreatedBy = user.Username
+	}
+
+	role.OrgId = user.ActiveOrg.Id
+	err = SetOrgRole(ctx, role)
+	if err != nil {
+		log.Printf("[ERROR] Failed saving role %s in org %s: %s", role.Id, role.OrgId, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed saving role"}`))
+		return
+	}
+
+	log.Printf("[AUDIT] User %s (%s) saved role %s (%s) in org %s with permissions %s", user.Username, user.Id, role.Name, role.Id, role.OrgId, strings.Join(role.Permissions, ","))
+	CreateAuditEvent(ctx, request, user, role.OrgId, "role.update", "role", role.Id, nil, map[string]interface{}{"name": role.Name, "permissions": role.Permissions})
+	resp.WriteHeader(200)
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "id": "%s"}`, role.Id)))
+}
+
+// Deletes a custom role: /api/v1/orgs/roles/{id}
+// Fails while users still have the role.
+func HandleDeleteOrgRole(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in delete org role: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if Authorize(user, "users:manage", "") != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "You don't have access to manage roles"}`))
+		return
+	}
+
+	location := strings.Split(strings.Split(request.URL.String(), "?")[0], "/")
+	if len(location) <= 5 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Role ID required"}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	role, err := GetOrgRole(ctx, location[5])
+	if err != nil || role.OrgId != user.ActiveOrg.Id {
+		resp.WriteHeader(404)
+		resp.Write([]byte(`{"success": false, "reason": "Role not found"}`))
+		return
+	}
+
+	err = canGrantPermissions(ctx, user, role.Permissions)
+	if err != nil {
+		resp.WriteHeader(403)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	org, err := GetOrg(ctx, user.ActiveOrg.Id)
+	if err == nil {
+		for _, orgUser := range org.Users {
+			if orgUser.Role == role.Id {
+				resp.WriteHeader(400)
+				resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Role is still used by %s"}`, orgUser.Username)))
+				return
+			}
+		}
+	}
+
+	err = DeleteKey(ctx, "org_roles", role.Id)
+	if err != nil {
+		log.Printf("[ERROR] Failed deleting role %s: %s", role.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	DeleteCache(ctx, fmt.Sprintf("org_roles_org_%s", role.OrgId))
+
+	log.Printf("[AUDIT] User %s (%s) deleted role %s (%s) in org %s", user.Username, user.Id, role.Name, role.Id, role.OrgId)
+	CreateAuditEvent(ctx, request, user, role.OrgId, "role.delete", "role", role.Id, map[string]interface{}{"name": role.Name, "permissions": role.Permissions}, nil)
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
@@ -0,0 +1,150 @@
+package shuffle
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCanGrantPermissions(t *testing.T) {
+	ctx := context.Background()
+	admin := User{Id: "1", Username: "admin", Role: "admin"}
+	user := User{Id: "2", Username: "user", Role: "user"}
+	scopedAdmin := User{Id: "3", Username: "key", Role: "admin", ApiKeyId: "key", ApiKeyScopes: []string{"users:manage", "workflow:read"}}
+
+	handlers := []struct {
+		user        User
+		permissions []string
+		expected    bool
+	}{
+		{admin, []string{"*"}, true},
+		{admin, []string{"users:manage", "org:manage"}, true},
+		{user, []string{"workflow:*"}, true},
+		{user, []string{"workflow:read", "files:read"}, true},
+		{user, []string{"*"}, false},
+		{user, []string{"users:manage"}, false},
+		{user, []string{"app-auth:*"}, false},
+		{scopedAdmin, []string{"workflow:read"}, true},
+		{scopedAdmin, []string{"workflow:write"}, false},
+		{scopedAdmin, []string{"*"}, false},
+	}
+
+	for index, tt := range handlers {
+		err := canGrantPermissions(ctx, tt.user, tt.permissions)
+		if (err == nil) != tt.expected {
+			t.Errorf("canGrantPermissions(%d, %s, %v) = %v; expected success %v", index, tt.user.Role, tt.permissions, err, tt.expected)
+		}
+	}
+}
+
+func TestCanGrantRole(t *testing.T) {
+	ctx := context.Background()
+	handlers := []struct {
+		role     string
+		grant    string
+		expected bool
+	}{
+		{"admin", "admin", true},
+		{"admin", "org-reader", true},
+		{"user", "org-reader", true},
+		{"user", "user", true},
+		{"user", "admin", false},
+		{"org-reader", "user", false},
+	}
+
+	for _, tt := range handlers {
+		user := User{Id: "1", Username: tt.role, Role: tt.role}
+		err := canGrantRole(ctx, user, tt.grant)
+		if (err == nil) != tt.expected {
+			t.Errorf("canGrantRole(%s, %s) = %v; expected success %v", tt.role, tt.grant, err, tt.expected)
+		}
+	}
+}
+
+func TestExpandPermissions(t *testing.T) {
+	if len(expandPermissions([]string{"*"})) != len(validPermissions) {
+		t.Errorf("expandPermissions(*) should give every permission")
+	}
+
+	expanded := expandPermissions([]string{"workflow:*", "files:read"})
+	for _, permission := range []string{"workflow:read", "workflow:write", "workflow:execute", "files:read"} {
+		if !ArrayContains(expanded, permission) {
+			t.Errorf("expandPermissions(workflow:*, files:read) is missing %s", permission)
+		}
+	}
+
+	if len(expanded) != 4 {
+		t.Errorf("expandPermissions(workflow:*, files:read) = %v; expected 4 permissions", expanded)
+	}
+}
+
+func TestHasMorePermissions(t *testing.T) {
+	handlers := []struct {
+		user     []string
+		target   []string
+		expected bool
+	}{
+		{builtinRoles["admin"], builtinRoles["user"], true},
+		{builtinRoles["user"], builtinRoles["org-reader"], true},
+		{[]string{"users:manage", "workflow:read"}, builtinRoles["org-reader"], false},
+		{[]string{"users:manage", "workflow:read"}, []string{"workflow:read"}, true},
+		{[]string{"users:manage", "workflow:read"}, []string{"users:manage", "workflow:read"}, false},
+		{[]string{"users:manage"}, builtinRoles["admin"], false},
+	}
+
+	for index, tt := range handlers {
+		err := hasMorePermissions(tt.user, tt.target)
+		if (err == nil) != tt.expected {
+			t.Errorf("hasMorePermissions(%d) = %v; expected success %v", index, err, tt.expected)
+		}
+	}
+}
+
+func TestHasOrgPermission(t *testing.T) {
+	handlers := []struct {
+		role       string
+		permission string
+		expected   bool
+	}{
+		{"admin", "org:manage", true},
+		{"user", "workflow:write", true},
+		{"user", "org:manage", false},
+		{"org-reader", "workflow:read", true},
+		{"org-reader", "workflow:write", false},
+		{"", "workflow:read", false},
+	}
+
+	for _, tt := range handlers {
+		result := hasOrgPermission(User{Id: "1", Role: tt.role}, "org", tt.permission)
+		if result != tt.expected {
+			t.Errorf("hasOrgPermission(%s, %s) = %v; expected %v", tt.role, tt.permission, result, tt.expected)
+		}
+	}
+}
+
+func TestCanManageUser(t *testing.T) {
+	orgId := "manage-test-org"
+	user := User{Id: "manager", Username: "manager", Role: "user", ActiveOrg: OrgMini{Id: orgId}}
+	reader := User{Id: "reader", Username: "reader", Role: "org-reader", ActiveOrg: OrgMini{Id: orgId}}
+	admin := User{Id: "admin", Username: "admin", Role: "admin", ActiveOrg: OrgMini{Id: orgId}}
+	outsider := User{Id: "outsider", Username: "outsider", Role: "org-reader", ActiveOrg: OrgMini{Id: "other-org"}}
+	setTestOrgCache(t, Org{Id: orgId, Name: "manage-test", Users: []User{user, reader, admin}})
+
+	handlers := []struct {
+		user     User
+		target   User
+		expected bool
+	}{
+		{user, user, true},
+		{user, reader, true},
+		{user, admin, false},
+		{user, outsider, false},
+	}
+
+	ctx := context.Background()
+	for _, tt := range handlers {
+		err := canManageUser(ctx, tt.user, tt.target)
+		if (err == nil) != tt.expected {
+			t.Errorf("canManageUser(%s, %s) = %v; expected success %v", tt.user.Username, tt.target.Username, err, tt.expected)
+		}
+	}
+}
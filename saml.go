@@ -0,0 +1,830 @@
+package shuffle
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/crewjam/saml"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// Max size of IdP metadata, both uploaded and downloaded
+var maxSamlMetadataSize = int64(1024 * 1024)
+
+// Attributes used for the username when the NameID isn't an email
+var samlEmailAttributes = []string{
+	"email",
+	"mail",
+	"emailaddress",
+	"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress",
+}
+
+// The SP's URLs are built from SHUFFLE_SAML_BASE_URL (e.g. https://shuffle.example.com).
+// The IdP has to reach /api/v1/login_sso on it. Never taken from the request,
+// as the Host and X-Forwarded-Proto headers are set by the client.
+func getSamlBaseUrl() string {
+	baseUrl := strings.TrimRight(os.Getenv("SHUFFLE_SAML_BASE_URL"), "/")
+	if len(baseUrl) == 0 && project.Environment == "cloud" {
+		baseUrl = "https://shuffler.io"
+	}
+
+	return baseUrl
+}
+
+// Where users start an SP-initiated login for the org. Without a base URL
+// they go straight to the IdP.
+func GetSamlLoginUrl(org Org) string {
+	baseUrl := getSamlBaseUrl()
+	if len(baseUrl) == 0 {
+		return org.SSOConfig.SSOEntrypoint
+	}
+
+	return fmt.Sprintf("%s/api/v1/saml/%s/login", baseUrl, org.Id)
+}
+
+// Creates the key pair used to sign authentication requests and decrypt
+// assertions the first time it's needed
+func ensureSamlKeyPair(ctx context.Context, org *Org) error {
+	if len(org.SamlConfig.SPPrivateKey) > 0 && len(org.SamlConfig.SPCertificate) > 0 {
+		return nil
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   fmt.Sprintf("Shuffle SAML %s", org.Id),
+			Organization: []string{"Shuffle"},
+		},
+		NotBefore:             time.Now().Add(-5 * time.Minute),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		BasicConstraintsValid: true,
+	}
+
+	certificate, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	org.SamlConfig.SPPrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+	org.SamlConfig.SPCertificate = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate}))
+	org.SamlConfig.SPKeyEncrypted = false
+	org.SamlConfig = encryptSamlPrivateKey(org.Id, org.SamlConfig)
+
+	log.Printf("[AUDIT] Generated SAML service provider certificate for org %s", org.Id)
+	return SetOrg(ctx, *org, org.Id)
+}
+
+func getSamlKeyPassphrase(orgId string) string {
+	return fmt.Sprintf("%s_saml_sp_private_key", orgId)
+}
+
+// Encrypts the SP private key before an org is stored.
+// Leaves it as is if no encryption key is configured, same as app auth
+func encryptSamlPrivateKey(orgId string, config SamlConfig) SamlConfig {
+	if config.SPKeyEncrypted || len(config.SPPrivateKey) == 0 {
+		return config
+	}
+
+	encrypted, err := handleKeyEncryption([]byte(config.SPPrivateKey), getSamlKeyPassphrase(orgId))
+	if err != nil {
+		return config
+	}
+
+	config.SPPrivateKey = string(encrypted)
+	config.SPKeyEncrypted = true
+	return config
+}
+
+// Returns the plaintext SP private key of an org
+func getSamlPrivateKey(org *Org) (string, error) {
+	if !org.SamlConfig.SPKeyEncrypted || len(org.SamlConfig.SPPrivateKey) == 0 {
+		return org.SamlConfig.SPPrivateKey, nil
+	}
+
+	decrypted, err := HandleKeyDecryption([]byte(org.SamlConfig.SPPrivateKey), getSamlKeyPassphrase(org.Id))
+	if err != nil {
+		return "", err
+	}
+
+	return string(decrypted), nil
+}
+
+// Parses IdP metadata. Metadata with several entities uses the first IdP in it
+func parseIdpMetadata(data []byte) (*saml.EntityDescriptor, error) {
+	entity := &saml.EntityDescriptor{}
+	err := xml.Unmarshal(data, entity)
+	if err == nil && len(entity.IDPSSODescriptors) > 0 {
+		return entity, nil
+	}
+
+	entities := &saml.EntitiesDescriptor{}
+	err = xml.Unmarshal(data, entities)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed parsing metadata: %s", err))
+	}
+
+	for _, descriptors := range append([]saml.EntitiesDescriptor{*entities}, entities.EntitiesDescriptors...) {
+		for _, entityDescriptor := range descriptors.EntityDescriptors {
+			if len(entityDescriptor.IDPSSODescriptors) > 0 {
+				return &entityDescriptor, nil
+			}
+		}
+	}
+
+	return nil, errors.New("No IdP found in metadata")
+}
+
+// Returns the IdP's login URL and its signing certificates
+func getIdpMetadataInfo(entity *saml.EntityDescriptor) (string, []string) {
+	ssoUrl := ""
+	certificates := []string{}
+	for _, descriptor := range entity.IDPSSODescriptors {
+		for _, service := range descriptor.SingleSignOnServices {
+			if service.Binding == saml.HTTPRedirectBinding || (len(ssoUrl) == 0 && service.Binding == saml.HTTPPostBinding) {
+				ssoUrl = service.Location
+			}
+		}
+
+		for _, keyDescriptor := range descriptor.KeyDescriptors {
+			if keyDescriptor.Use != "" && keyDescriptor.Use != "signing" {
+				continue
+			}
+
+			for _, certificate := range keyDescriptor.KeyInfo.X509Data.X509Certificates {
+				certificates = append(certificates, fixCertificate(certificate.Data))
+			}
+		}
+	}
+
+	return ssoUrl, certificates
+}
+
+// Builds the org's service provider. The IdP comes from imported metadata, or
+// from the SSO entrypoint, certificate and IdP entity ID set by hand.
+func getSamlServiceProvider(ctx context.Context, org *Org) (*saml.ServiceProvider, error) {
+	baseUrl := getSamlBaseUrl()
+	if len(baseUrl) == 0 {
+		return nil, errors.New("SHUFFLE_SAML_BASE_URL has to be set to use SAML")
+	}
+
+	err := ensureSamlKeyPair(ctx, org)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed creating SP key pair: %s", err))
+	}
+
+	privateKey, err := getSamlPrivateKey(org)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed decrypting SP private key: %s", err))
+	}
+
+	keyBlock, _ := pem.Decode([]byte(privateKey))
+	certBlock, _ := pem.Decode([]byte(org.SamlConfig.SPCertificate))
+	if keyBlock == nil || certBlock == nil {
+		return nil, errors.New("Invalid SP key pair")
+	}
+
+	key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	certificate, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	var idpMetadata *saml.EntityDescriptor
+	if len(org.SamlConfig.IdpMetadata) > 0 {
+		idpMetadata, err = parseIdpMetadata([]byte(org.SamlConfig.IdpMetadata))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if len(org.SSOConfig.SSOCertificate) == 0 {
+			return nil, errors.New("SAML is not configured for the org")
+		}
+
+		descriptor := saml.IDPSSODescriptor{
+			SingleSignOnServices: []saml.Endpoint{
+				saml.Endpoint{
+					Binding:  saml.HTTPRedirectBinding,
+					Location: org.SSOConfig.SSOEntrypoint,
+				},
+			},
+		}
+
+		descriptor.KeyDescriptors = []saml.KeyDescriptor{
+			saml.KeyDescriptor{
+				Use: "signing",
+				KeyInfo: saml.KeyInfo{
+					X509Data: saml.X509Data{
+						X509Certificates: []saml.X509Certificate{
+							saml.X509Certificate{Data: org.SSOConfig.SSOCertificate},
+						},
+					},
+				},
+			},
+		}
+
+		idpMetadata = &saml.EntityDescriptor{
+			EntityID:          org.SamlConfig.IdpEntityId,
+			IDPSSODescriptors: []saml.IDPSSODescriptor{descriptor},
+		}
+	}
+
+	metadataUrl, err := url.Parse(fmt.Sprintf("%s/api/v1/saml/%s/metadata", baseUrl, org.Id))
+	if err != nil {
+		return nil, err
+	}
+
+	acsUrl, err := url.Parse(fmt.Sprintf("%s/api/v1/login_sso", baseUrl))
+	if err != nil {
+		return nil, err
+	}
+
+	entityId := metadataUrl.String()
+	if len(org.SamlConfig.SPEntityId) > 0 {
+		entityId = org.SamlConfig.SPEntityId
+	}
+
+	return &saml.ServiceProvider{
+		EntityID:          entityId,
+		Key:               key,
+		Certificate:       certificate,
+		MetadataURL:       *metadataUrl,
+		AcsURL:            *acsUrl,
+		IDPMetadata:       idpMetadata,
+		AuthnNameIDFormat: saml.EmailAddressNameIDFormat,
+		SignatureMethod:   dsig.RSASHA256SignatureMethod,
+		AllowIDPInitiated: org.SamlConfig.AllowIdpInitiated,
+	}, nil
+}
+
+// The parts of a response needed to find the request it answers
+type samlResponseInfo struct {
+	InResponseTo string `xml:"InResponseTo,attr"`
+}
+
+// Validates the signature against the org's IdP certificates, the issuer,
+// audience, destination, recipient and time conditions, and decrypts encrypted
+// assertions. The issuer, audience and ACS URL always come from the org's
+// config. Responses to SP-initiated logins have to answer a request we sent,
+// and each assertion can only be used once.
+func validateSamlResponse(ctx context.Context, org *Org, responseXML []byte) (*saml.Assertion, error) {
+	var info samlResponseInfo
+	err := xml.Unmarshal(responseXML, &info)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed parsing response: %s", err))
+	}
+
+	if len(org.SamlConfig.IdpEntityId) == 0 {
+		return nil, errors.New("The org has no IdP entity ID. Import the IdP metadata or set idp_entity_id")
+	}
+
+	sp, err := getSamlServiceProvider(ctx, org)
+	if err != nil {
+		return nil, err
+	}
+
+	possibleRequestIds := []string{}
+	if len(info.InResponseTo) > 0 {
+		cacheKey := fmt.Sprintf("saml_request_%s", info.InResponseTo)
+		cache, err := GetCache(ctx, cacheKey)
+		if err == nil && string(cache.([]uint8)) == org.Id {
+			possibleRequestIds = append(possibleRequestIds, info.InResponseTo)
+
+			// A request can only be answered once
+			DeleteCache(ctx, cacheKey)
+		}
+	}
+
+	if len(possibleRequestIds) == 0 && !org.SamlConfig.AllowIdpInitiated {
+		return nil, errors.New("Response doesn't answer a known request, and IdP-initiated login is disabled")
+	}
+
+	sp.AllowIDPInitiated = len(possibleRequestIds) == 0
+	assertion, err := sp.ParseXMLResponse(responseXML, possibleRequestIds)
+	if err != nil {
+		if invalidErr, ok := err.(*saml.InvalidResponseError); ok && invalidErr.PrivateErr != nil {
+			return nil, invalidErr.PrivateErr
+		}
+
+		return nil, err
+	}
+
+	// Kept until the assertion expires. ParseXMLResponse rejects it after that.
+	cacheKey := fmt.Sprintf("saml_assertion_%s_%s", org.Id, assertion.ID)
+	if _, err := GetCache(ctx, cacheKey); err == nil {
+		return nil, errors.New(fmt.Sprintf("Assertion %s has already been used", assertion.ID))
+	}
+
+	expiration := int32(60)
+	if assertion.Conditions != nil && !assertion.Conditions.NotOnOrAfter.IsZero() {
+		expiration = int32(time.Until(assertion.Conditions.NotOnOrAfter).Minutes()) + 2
+	}
+
+	err = SetCache(ctx, cacheKey, []byte("1"), expiration)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed storing assertion %s: %s", assertion.ID, err))
+	}
+
+	return assertion, nil
+}
+
+// Finds the org a response is for. Responses to SP-initiated logins belong to
+// the org that sent the request. Others are matched by the signing certificate.
+// Either way the org is only used if the response validates against its config,
+// as nothing in the response can be trusted before that.
+func findSamlResponseOrg(ctx context.Context, responseXML []byte, certificate string) (Org, *saml.Assertion, error) {
+	var info samlResponseInfo
+	err := xml.Unmarshal(responseXML, &info)
+	if err != nil {
+		return Org{}, nil, errors.New(fmt.Sprintf("Failed parsing response: %s", err))
+	}
+
+	candidates := []Org{}
+	if len(info.InResponseTo) > 0 {
+		cache, err := GetCache(ctx, fmt.Sprintf("saml_request_%s", info.InResponseTo))
+		if err == nil {
+			org, err := GetOrg(ctx, string(cache.([]uint8)))
+			if err == nil {
+				candidates = append(candidates, *org)
+			}
+		}
+	}
+
+	if len(candidates) == 0 && len(certificate) > 0 {
+		orgs, err := GetOrgByField(ctx, "sso_config.sso_certificate", certificate)
+		if err == nil {
+			candidates = append(candidates, orgs...)
+		}
+	}
+
+	foundOrg := Org{}
+	var assertion *saml.Assertion
+	for _, org := range candidates {
+		orgAssertion, err := validateSamlResponse(ctx, &org, responseXML)
+		if err != nil {
+			log.Printf("[WARNING] SAML response isn't valid for org %s (%s): %s", org.Name, org.Id, err)
+			continue
+		}
+
+		if assertion != nil {
+			return Org{}, nil, errors.New(fmt.Sprintf("The response is valid for both org %s and %s", foundOrg.Id, org.Id))
+		}
+
+		foundOrg = org
+		assertion = orgAssertion
+	}
+
+	if assertion == nil {
+		return Org{}, nil, errors.New(fmt.Sprintf("The response isn't valid for any of %d matching orgs", len(candidates)))
+	}
+
+	return foundOrg, assertion, nil
+}
+
+func getSamlAttributeValues(assertion *saml.Assertion, name string) []string {
+	values := []string{}
+	for _, statement := range assertion.AttributeStatements {
+		for _, attribute := range statement.Attributes {
+			if !strings.EqualFold(attribute.Name, name) && !strings.EqualFold(attribute.FriendlyName, name) {
+				continue
+			}
+
+			for _, value := range attribute.Values {
+				values = append(values, strings.TrimSpace(value.Value))
+			}
+		}
+	}
+
+	return values
+}
+
+// The NameID, or the email attribute if the NameID isn't an email
+func getSamlUsername(assertion *saml.Assertion) string {
+	username := ""
+	if assertion.Subject != nil && assertion.Subject.NameID != nil {
+		username = strings.ToLower(strings.TrimSpace(assertion.Subject.NameID.Value))
+	}
+
+	if strings.Contains(username, "@") {
+		return username
+	}
+
+	for _, attribute := range samlEmailAttributes {
+		for _, value := range getSamlAttributeValues(assertion, attribute) {
+			if strings.Contains(value, "@") {
+				return strings.ToLower(value)
+			}
+		}
+	}
+
+	return username
+}
+
+// Maps the role attribute to an org role. Empty if nothing matches
+func getSamlRole(ctx context.Context, org *Org, assertion *saml.Assertion) string {
+	if len(org.SamlConfig.RoleAttribute) == 0 || len(org.SamlConfig.RoleMappings) == 0 {
+		return ""
+	}
+
+	values := getSamlAttributeValues(assertion, org.SamlConfig.RoleAttribute)
+	for _, mapping := range org.SamlConfig.RoleMappings {
+		for _, value := range values {
+			if !strings.EqualFold(value, mapping.Value) {
+				continue
+			}
+
+			if !isValidOrgRole(ctx, mapping.Role, org.Id) {
+				log.Printf("[WARNING] SAML role mapping %s in org %s points to missing role %s", mapping.Value, org.Id, mapping.Role)
+				continue
+			}
+
+			return mapping.Role
+		}
+	}
+
+	return ""
+}
+
+// Gives an existing user the mapped role in the org they logged in to
+func applySamlRole(ctx context.Context, user *User, org *Org, role string) {
+	if len(role) == 0 || (user.Role == role && ArrayContains(user.Orgs, org.Id)) {
+		return
+	}
+
+	err := addUserToOrg(ctx, user, org, role)
+	if err != nil {
+		log.Printf("[WARNING] Failed setting SAML role %s for %s in org %s: %s", role, user.Username, org.Id, err)
+		return
+	}
+
+	log.Printf("[AUDIT] Set role of %s (%s) in org %s to %s from SAML attributes", user.Username, user.Id, org.Id, role)
+	user.Role = role
+	user.Roles = []string{role}
+}
+
+// SP metadata for the IdP: /api/v1/saml/{orgId}/metadata
+// Public, as IdPs usually fetch it without credentials.
+func HandleSamlMetadata(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	location := strings.Split(strings.Split(request.URL.String(), "?")[0], "/")
+	if len(location) <= 4 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Org ID required"}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	org, err := GetOrg(ctx, location[4])
+	if err != nil {
+		resp.WriteHeader(404)
+		resp.Write([]byte(`{"success": false, "reason": "Org not found"}`))
+		return
+	}
+
+	sp, err := getSamlServiceProvider(ctx, org)
+	if err != nil {
+		log.Printf("[WARNING] Failed building SAML SP for org %s: %s", org.Id, err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "SAML is not configured for the org"}`))
+		return
+	}
+
+	metadata, err := xml.MarshalIndent(sp.Metadata(), "", "  ")
+	if err != nil {
+		log.Printf("[WARNING] Failed marshalling SAML metadata for org %s: %s", org.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/samlmetadata+xml")
+	resp.WriteHeader(200)
+	resp.Write(metadata)
+}
+
+// Starts an SP-initiated login: /api/v1/saml/{orgId}/login
+// The request ID is kept so the response can be matched to it.
+func HandleSamlLogin(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	location := strings.Split(strings.Split(request.URL.String(), "?")[0], "/")
+	if len(location) <= 4 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Org ID required"}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	org, err := GetOrg(ctx, location[4])
+	if err != nil {
+		resp.WriteHeader(404)
+		resp.Write([]byte(`{"success": false, "reason": "Org not found"}`))
+		return
+	}
+
+	sp, err := getSamlServiceProvider(ctx, org)
+	if err != nil {
+		log.Printf("[WARNING] Failed building SAML SP for org %s: %s", org.Id, err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "SAML is not configured for the org"}`))
+		return
+	}
+
+	idpUrl := sp.GetSSOBindingLocation(saml.HTTPRedirectBinding)
+	if len(idpUrl) == 0 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "The IdP has no redirect login URL"}`))
+		return
+	}
+
+	authnRequest, err := sp.MakeAuthenticationRequest(idpUrl, saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		log.Printf("[WARNING] Failed making SAML request for org %s: %s", org.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	redirectUrl, err := authnRequest.Redirect("", sp)
+	if err != nil {
+		log.Printf("[WARNING] Failed making SAML redirect for org %s: %s", org.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	err = SetCache(ctx, fmt.Sprintf("saml_request_%s", authnRequest.ID), []byte(org.Id), 10)
+	if err != nil {
+		log.Printf("[WARNING] Failed caching SAML request %s for org %s: %s", authnRequest.ID, org.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	http.Redirect(resp, request, redirectUrl.String(), http.StatusFound)
+}
+
+// The metadata has the IdP's signing certificates, so it's only trusted over https
+func getIdpMetadataFromUrl(metadataUrl string) ([]byte, error) {
+	if !strings.HasPrefix(strings.ToLower(metadataUrl), "https://") {
+		return []byte{}, errors.New("Metadata URL has to be https")
+	}
+
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			if request.URL.Scheme != "https" {
+				return errors.New("Metadata URL redirected away from https")
+			}
+
+			if len(via) >= 10 {
+				return errors.New("Too many redirects")
+			}
+
+			return nil
+		},
+	}
+	metadataResp, err := client.Get(metadataUrl)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	defer metadataResp.Body.Close()
+	if metadataResp.StatusCode != 200 {
+		return []byte{}, errors.New(fmt.Sprintf("Bad status code %d", metadataResp.StatusCode))
+	}
+
+	return ioutil.ReadAll(io.LimitReader(metadataResp.Body, maxSamlMetadataSize))
+}
+
+// Sets the SAML config of the active org. IdP metadata is imported from
+// idp_metadata or idp_metadata_url, and fills in the SSO entrypoint and
+// certificate. Without either, idp_entity_id can be set by hand for IdPs
+// configured with the SSO entrypoint and certificate.
+func HandleSetSamlConfig(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in set SAML config: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if Authorize(user, "org:manage", "") != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "You don't have access to change SSO settings"}`))
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(request.Body, maxSamlMetadataSize))
+	if err != nil {
+		log.Printf("[WARNING] Failed reading body in set SAML config: %s", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	var config SamlConfig
+	err = json.Unmarshal(body, &config)
+	if err != nil {
+		log.Printf("[WARNING] Failed unmarshalling SAML config: %s", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Failed parsing SAML config"}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	org, err := GetOrg(ctx, user.ActiveOrg.Id)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting org %s for SAML config: %s", user.ActiveOrg.Id, err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	err = checkInheritedSetting(ctx, org, "sso")
+	if err != nil {
+		resp.WriteHeader(403)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	for _, mapping := range config.RoleMappings {
+		if len(strings.TrimSpace(mapping.Value)) == 0 || !isValidOrgRole(ctx, mapping.Role, org.Id) {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Invalid role mapping '%s' to '%s'"}`, mapping.Value, mapping.Role)))
+			return
+		}
+	}
+
+	metadata := []byte(strings.TrimSpace(config.IdpMetadata))
+	if len(metadata) == 0 && len(config.IdpMetadataUrl) > 0 {
+		metadata, err = getIdpMetadataFromUrl(config.IdpMetadataUrl)
+		if err != nil {
+			log.Printf("[WARNING] Failed getting IdP metadata from %s: %s", config.IdpMetadataUrl, err)
+			resp.WriteHeader(400)
+			resp.Write([]byte(`{"success": false, "reason": "Failed getting IdP metadata from the URL"}`))
+			return
+		}
+	}
+
+	if len(metadata) > 0 {
+		entity, err := parseIdpMetadata(metadata)
+		if err != nil {
+			log.Printf("[WARNING] Failed parsing IdP metadata for org %s: %s", org.Id, err)
+			resp.WriteHeader(400)
+			resp.Write([]byte(`{"success": false, "reason": "Failed parsing IdP metadata"}`))
+			return
+		}
+
+		ssoUrl, certificates := getIdpMetadataInfo(entity)
+		if len(entity.EntityID) == 0 || len(ssoUrl) == 0 || len(certificates) == 0 {
+			resp.WriteHeader(400)
+			resp.Write([]byte(`{"success": false, "reason": "IdP metadata needs an entity ID, a login URL and a signing certificate"}`))
+			return
+		}
+
+		org.SamlConfig.IdpEntityId = entity.EntityID
+		org.SamlConfig.IdpMetadata = string(metadata)
+		org.SamlConfig.IdpMetadataUrl = config.IdpMetadataUrl
+		org.SSOConfig.SSOEntrypoint = ssoUrl
+		org.SSOConfig.SSOCertificate = certificates[0]
+	} else if len(strings.TrimSpace(config.IdpEntityId)) > 0 {
+		if len(org.SSOConfig.SSOEntrypoint) == 0 || len(org.SSOConfig.SSOCertificate) == 0 {
+			resp.WriteHeader(400)
+			resp.Write([]byte(`{"success": false, "reason": "Set the SSO entrypoint and certificate before the IdP entity ID"}`))
+			return
+		}
+
+		org.SamlConfig.IdpEntityId = strings.TrimSpace(config.IdpEntityId)
+	}
+
+	org.SamlConfig.SPEntityId = strings.TrimSpace(config.SPEntityId)
+	org.SamlConfig.AllowIdpInitiated = config.AllowIdpInitiated
+	org.SamlConfig.RoleAttribute = strings.TrimSpace(config.RoleAttribute)
+	org.SamlConfig.RoleMappings = config.RoleMappings
+
+	err = ensureSamlKeyPair(ctx, org)
+	if err == nil {
+		err = SetOrg(ctx, *org, org.Id)
+	}
+
+	if err != nil {
+		log.Printf("[ERROR] Failed saving SAML config for org %s: %s", org.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	log.Printf("[AUDIT] User %s (%s) updated the SAML config of org %s. IdP: %s", user.Username, user.Id, org.Id, org.SamlConfig.IdpEntityId)
+	CreateAuditEvent(ctx, request, user, org.Id, "org.saml_update", "org", org.Id, nil, map[string]interface{}{"idp_entity_id": org.SamlConfig.IdpEntityId})
+
+	entityId := fmt.Sprintf("%s/api/v1/saml/%s/metadata", getSamlBaseUrl(), org.Id)
+	if len(org.SamlConfig.SPEntityId) > 0 {
+		entityId = org.SamlConfig.SPEntityId
+	}
+
+	resp.WriteHeader(200)
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "entity_id": "%s", "acs_url": "%s/api/v1/login_sso", "login_url": "%s"}`, entityId, getSamlBaseUrl(), GetSamlLoginUrl(*org))))
+}
+
+// Removes the imported IdP metadata and entity ID. SAML logins are refused
+// until they are set again. The SP key pair is kept.
+func HandleDeleteSamlConfig(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in delete SAML config: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if Authorize(user, "org:manage", "") != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "You don't have access to change SSO settings"}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	org, err := GetOrg(ctx, user.ActiveOrg.Id)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting org %s for SAML config: %s", user.ActiveOrg.Id, err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	err = checkInheritedSetting(ctx, org, "sso")
+	if err != nil {
+		resp.WriteHeader(403)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	org.SamlConfig = SamlConfig{
+		SPCertificate:  org.SamlConfig.SPCertificate,
+		SPPrivateKey:   org.SamlConfig.SPPrivateKey,
+		SPKeyEncrypted: org.SamlConfig.SPKeyEncrypted,
+	}
+
+	err = SetOrg(ctx, *org, org.Id)
+	if err != nil {
+		log.Printf("[ERROR] Failed removing SAML config for org %s: %s", org.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	log.Printf("[AUDIT] User %s (%s) removed the SAML IdP metadata of org %s", user.Username, user.Id, org.Id)
+	CreateAuditEvent(ctx, request, user, org.Id, "org.saml_remove", "org", org.Id, nil, nil)
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
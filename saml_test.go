@@ -0,0 +1,279 @@
+package shuffle
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+func getTestSamlKeyPair(t *testing.T, name string) (*rsa.PrivateKey, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed generating key: %s", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-1 * time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+
+	certificateBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed creating certificate: %s", err)
+	}
+
+	certificate, err := x509.ParseCertificate(certificateBytes)
+	if err != nil {
+		t.Fatalf("Failed parsing certificate: %s", err)
+	}
+
+	return key, certificate
+}
+
+type testSamlSetup struct {
+	idp     *saml.IdentityProvider
+	org     Org
+	acsUrl  string
+	spId    string
+	counter int
+}
+
+func newTestSamlSetup(t *testing.T) *testSamlSetup {
+	idpKey, idpCertificate := getTestSamlKeyPair(t, "idp")
+	spKey, spCertificate := getTestSamlKeyPair(t, "sp")
+
+	metadataUrl, _ := url.Parse("https://idp.example.com/metadata")
+	ssoUrl, _ := url.Parse("https://idp.example.com/sso")
+	idp := &saml.IdentityProvider{
+		Key:             idpKey,
+		Certificate:     idpCertificate,
+		MetadataURL:     *metadataUrl,
+		SSOURL:          *ssoUrl,
+		SignatureMethod: dsig.RSASHA256SignatureMethod,
+	}
+
+	idpMetadata, err := xml.Marshal(idp.Metadata())
+	if err != nil {
+		t.Fatalf("Failed marshalling IdP metadata: %s", err)
+	}
+
+	org := Org{Id: "saml-test-org", Name: "SAML test"}
+	org.SamlConfig.IdpEntityId = metadataUrl.String()
+	org.SamlConfig.IdpMetadata = string(idpMetadata)
+	org.SamlConfig.AllowIdpInitiated = true
+	org.SamlConfig.SPPrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(spKey)}))
+	org.SamlConfig.SPCertificate = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: spCertificate.Raw}))
+
+	return &testSamlSetup{
+		idp:    idp,
+		org:    org,
+		acsUrl: "https://shuffle.example.com/api/v1/login_sso",
+		spId:   fmt.Sprintf("https://shuffle.example.com/api/v1/saml/%s/metadata", org.Id),
+	}
+}
+
+// Makes a response signed by the IdP, like it would be posted to the ACS URL
+func (setup *testSamlSetup) makeResponse(t *testing.T, audience, destination string) []byte {
+	setup.counter += 1
+	timeNow := time.Now()
+	assertion := &saml.Assertion{
+		ID:           fmt.Sprintf("id-%d-%d", timeNow.UnixNano(), setup.counter),
+		IssueInstant: timeNow,
+		Version:      "2.0",
+		Issuer: saml.Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  setup.idp.MetadataURL.String(),
+		},
+		Subject: &saml.Subject{
+			NameID: &saml.NameID{
+				Format: string(saml.EmailAddressNameIDFormat),
+				Value:  "user@example.com",
+			},
+			SubjectConfirmations: []saml.SubjectConfirmation{
+				saml.SubjectConfirmation{
+					Method: "urn:oasis:names:tc:SAML:2.0:cm:bearer",
+					SubjectConfirmationData: &saml.SubjectConfirmationData{
+						NotOnOrAfter: timeNow.Add(5 * time.Minute),
+						Recipient:    destination,
+					},
+				},
+			},
+		},
+		Conditions: &saml.Conditions{
+			NotBefore:    timeNow.Add(-5 * time.Minute),
+			NotOnOrAfter: timeNow.Add(5 * time.Minute),
+			AudienceRestrictions: []saml.AudienceRestriction{
+				saml.AudienceRestriction{Audience: saml.Audience{Value: audience}},
+			},
+		},
+		AuthnStatements: []saml.AuthnStatement{
+			saml.AuthnStatement{AuthnInstant: timeNow, SessionIndex: "session"},
+		},
+	}
+
+	request := &saml.IdpAuthnRequest{
+		IDP:         setup.idp,
+		Now:         timeNow,
+		Assertion:   assertion,
+		ACSEndpoint: &saml.IndexedEndpoint{Binding: saml.HTTPPostBinding, Location: destination},
+
+		// No keys, so the assertion isn't encrypted
+		SPSSODescriptor: &saml.SPSSODescriptor{},
+	}
+
+	form, err := request.PostBinding()
+	if err != nil {
+		t.Fatalf("Failed making SAML response: %s", err)
+	}
+
+	response, err := base64.StdEncoding.DecodeString(form.SAMLResponse)
+	if err != nil {
+		t.Fatalf("Failed decoding SAML response: %s", err)
+	}
+
+	return response
+}
+
+func TestValidateSamlResponse(t *testing.T) {
+	os.Setenv("SHUFFLE_SAML_BASE_URL", "https://shuffle.example.com")
+	defer os.Unsetenv("SHUFFLE_SAML_BASE_URL")
+
+	ctx := context.Background()
+	setup := newTestSamlSetup(t)
+
+	valid := setup.makeResponse(t, setup.spId, setup.acsUrl)
+	assertion, err := validateSamlResponse(ctx, &setup.org, valid)
+	if err != nil {
+		t.Fatalf("validateSamlResponse(valid) = %s; expected success", err)
+	}
+
+	if getSamlUsername(assertion) != "user@example.com" {
+		t.Errorf("getSamlUsername = %s; expected user@example.com", getSamlUsername(assertion))
+	}
+
+	// The same assertion can't log in twice
+	_, err = validateSamlResponse(ctx, &setup.org, valid)
+	if err == nil {
+		t.Errorf("validateSamlResponse(replayed) succeeded; expected it to fail")
+	}
+
+	wrongAudience := setup.makeResponse(t, "https://evil.example.com/metadata", setup.acsUrl)
+	_, err = validateSamlResponse(ctx, &setup.org, wrongAudience)
+	if err == nil {
+		t.Errorf("validateSamlResponse(wrong audience) succeeded; expected it to fail")
+	}
+
+	wrongDestination := setup.makeResponse(t, setup.spId, "https://evil.example.com/api/v1/login_sso")
+	_, err = validateSamlResponse(ctx, &setup.org, wrongDestination)
+	if err == nil {
+		t.Errorf("validateSamlResponse(wrong destination) succeeded; expected it to fail")
+	}
+
+	signature := regexp.MustCompile(`(?s)<ds:Signature.*?</ds:Signature>`)
+	unsigned := signature.ReplaceAll(setup.makeResponse(t, setup.spId, setup.acsUrl), []byte{})
+	_, err = validateSamlResponse(ctx, &setup.org, unsigned)
+	if err == nil {
+		t.Errorf("validateSamlResponse(unsigned) succeeded; expected it to fail")
+	}
+
+	// Signed by another IdP with the same entity ID
+	otherSetup := newTestSamlSetup(t)
+	forged := otherSetup.makeResponse(t, setup.spId, setup.acsUrl)
+	_, err = validateSamlResponse(ctx, &setup.org, forged)
+	if err == nil {
+		t.Errorf("validateSamlResponse(forged) succeeded; expected it to fail")
+	}
+}
+
+func TestValidateSamlResponseConfig(t *testing.T) {
+	ctx := context.Background()
+	setup := newTestSamlSetup(t)
+
+	os.Setenv("SHUFFLE_SAML_BASE_URL", "https://shuffle.example.com")
+	response := setup.makeResponse(t, setup.spId, setup.acsUrl)
+
+	// IdP-initiated logins have to be enabled
+	org := setup.org
+	org.SamlConfig.AllowIdpInitiated = false
+	_, err := validateSamlResponse(ctx, &org, response)
+	if err == nil {
+		t.Errorf("validateSamlResponse succeeded for an IdP-initiated login with it disabled")
+	}
+
+	// The IdP entity ID has to be configured
+	org = setup.org
+	org.SamlConfig.IdpEntityId = ""
+	_, err = validateSamlResponse(ctx, &org, response)
+	if err == nil {
+		t.Errorf("validateSamlResponse succeeded without an IdP entity ID")
+	}
+
+	// The base URL is never taken from the request
+	os.Unsetenv("SHUFFLE_SAML_BASE_URL")
+	_, err = validateSamlResponse(ctx, &setup.org, response)
+	if err == nil {
+		t.Errorf("validateSamlResponse succeeded without SHUFFLE_SAML_BASE_URL")
+	}
+
+	if GetSamlLoginUrl(Org{Id: "org", SSOConfig: SSOConfig{SSOEntrypoint: "https://idp.example.com/sso"}}) != "https://idp.example.com/sso" {
+		t.Errorf("GetSamlLoginUrl should fall back to the SSO entrypoint without a base URL")
+	}
+}
+
+func TestSamlPrivateKeyEncryption(t *testing.T) {
+	t.Setenv("SHUFFLE_ENCRYPTION_MODIFIER", "saml-test-modifier")
+	t.Setenv("SHUFFLE_SAML_BASE_URL", "https://shuffle.example.com")
+
+	ctx := context.Background()
+	setup := newTestSamlSetup(t)
+	plaintextKey := setup.org.SamlConfig.SPPrivateKey
+
+	org := setup.org
+	org.SamlConfig = encryptSamlPrivateKey(org.Id, org.SamlConfig)
+	if !org.SamlConfig.SPKeyEncrypted || strings.Contains(org.SamlConfig.SPPrivateKey, "PRIVATE KEY") {
+		t.Fatalf("SP private key wasn't encrypted")
+	}
+
+	if encryptSamlPrivateKey(org.Id, org.SamlConfig).SPPrivateKey != org.SamlConfig.SPPrivateKey {
+		t.Errorf("Encrypted SP private key was encrypted again")
+	}
+
+	privateKey, err := getSamlPrivateKey(&org)
+	if err != nil || privateKey != plaintextKey {
+		t.Errorf("Encrypted SP private key decrypted to something else (%v)", err)
+	}
+
+	// Logins keep working with the encrypted key
+	_, err = validateSamlResponse(ctx, &org, setup.makeResponse(t, setup.spId, setup.acsUrl))
+	if err != nil {
+		t.Errorf("validateSamlResponse with an encrypted SP key = %s; expected success", err)
+	}
+}
+
+func TestIdpMetadataUrlRequiresHttps(t *testing.T) {
+	for _, metadataUrl := range []string{"http://idp.example.com/metadata", "HTTP://idp.example.com/metadata", "file:///etc/passwd", "idp.example.com/metadata"} {
+		_, err := getIdpMetadataFromUrl(metadataUrl)
+		if err == nil || !strings.Contains(err.Error(), "https") {
+			t.Errorf("getIdpMetadataFromUrl(%s) = %v; expected it to require https", metadataUrl, err)
+		}
+	}
+}
@@ -0,0 +1,1111 @@
+package shuffle
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// SCIM 2.0 provisioning (RFC 7643/7644). Every org has its own base URL,
+// /api/scim/v2/{org_id}, authenticated with the org's SCIM bearer token.
+// Users map to org members, and groups map to roles: being a member of a
+// group means having that role in the org.
+
+var scimUserSchema = "urn:ietf:params:scim:schemas:core:2.0:User"
+var scimGroupSchema = "urn:ietf:params:scim:schemas:core:2.0:Group"
+var scimListSchema = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+var scimErrorSchema = "urn:ietf:params:scim:api:messages:2.0:Error"
+var scimMaxResults = 200
+
+var scimFilter = regexp.MustCompile(`(?i)^\s*([a-z.]+)\s+(eq|co|sw)\s+"([^"]*)"\s*$`)
+var scimMemberPath = regexp.MustCompile(`(?i)^members\[value eq "([^"]*)"\]$`)
+
+func writeScimResponse(resp http.ResponseWriter, status int, data interface{}) {
+	newjson, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("[WARNING] Failed marshalling SCIM response: %s", err)
+		status = 500
+		newjson = []byte(fmt.Sprintf(`{"schemas": ["%s"], "status": "500"}`, scimErrorSchema))
+	}
+
+	resp.Header().Set("Content-Type", "application/scim+json")
+	resp.WriteHeader(status)
+	resp.Write(newjson)
+}
+
+func writeScimError(resp http.ResponseWriter, status int, scimType, detail string) {
+	writeScimResponse(resp, status, map[string]interface{}{
+		"schemas":  []string{scimErrorSchema},
+		"status":   strconv.Itoa(status),
+		"scimType": scimType,
+		"detail":   detail,
+	})
+}
+
+func hashScimToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func getScimOrg(request *http.Request, orgId string) (*Org, error) {
+	authorization := request.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return nil, errors.New("No bearer token for authorization header")
+	}
+
+	org, err := GetOrg(GetContext(request), orgId)
+	if err != nil || org.Id != orgId {
+		return nil, errors.New(fmt.Sprintf("Org %s not found", orgId))
+	}
+
+	if len(org.ScimConfig.TokenHash) == 0 {
+		return nil, errors.New(fmt.Sprintf("SCIM isn't enabled for org %s", orgId))
+	}
+
+	token := strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+	if subtle.ConstantTimeCompare([]byte(hashScimToken(token)), []byte(org.ScimConfig.TokenHash)) != 1 {
+		return nil, errors.New(fmt.Sprintf("Bad SCIM token for org %s", orgId))
+	}
+
+	return org, nil
+}
+
+func getScimDefaultRole(org *Org) string {
+	if len(org.ScimConfig.DefaultRole) > 0 {
+		return org.ScimConfig.DefaultRole
+	}
+
+	return "user"
+}
+
+func formatScimTime(timestamp int64) string {
+	if timestamp == 0 {
+		return ""
+	}
+
+	return time.Unix(timestamp, 0).UTC().Format(time.RFC3339)
+}
+
+func getScimUser(user User, org *Org, active bool) ScimUser {
+	role := ""
+	for _, orgUser := range org.Users {
+		if orgUser.Id == user.Id {
+			role = orgUser.Role
+			break
+		}
+	}
+
+	scimUser := ScimUser{
+		Schemas:    []string{scimUserSchema},
+		Id:         user.Id,
+		ExternalId: user.ExternalId,
+		UserName:   user.Username,
+		Name: ScimName{
+			GivenName:  user.PersonalInfo.Firstname,
+			FamilyName: user.PersonalInfo.Lastname,
+		},
+		Active: &active,
+		Meta: ScimMeta{
+			ResourceType: "User",
+			Created:      formatScimTime(user.CreationTime),
+			Location:     fmt.Sprintf("/api/scim/v2/%s/Users/%s", org.Id, user.Id),
+		},
+	}
+
+	displayName := strings.TrimSpace(fmt.Sprintf("%s %s", user.PersonalInfo.Firstname, user.PersonalInfo.Lastname))
+	if len(displayName) > 0 {
+		scimUser.DisplayName = displayName
+	}
+
+	if strings.Contains(user.Username, "@") {
+		scimUser.Emails = []ScimMultiValue{ScimMultiValue{Value: user.Username, Type: "work", Primary: true}}
+	}
+
+	if len(role) > 0 {
+		scimUser.Groups = []ScimMultiValue{ScimMultiValue{Value: role, Display: role}}
+	}
+
+	return scimUser
+}
+
+// Adds the user to the org, or updates their role if they are already in it
+func addUserToOrg(ctx context.Context, user *User, org *Org, role string) error {
+	if !ArrayContains(user.Orgs, org.Id) {
+		user.Orgs = append(user.Orgs, org.Id)
+	}
+
+	if len(user.ActiveOrg.Id) == 0 || user.ActiveOrg.Id == org.Id {
+		user.ActiveOrg = OrgMini{
+			Id:   org.Id,
+			Name: org.Name,
+			Role: role,
+		}
+
+		user.Role = role
+		user.Roles = []string{role}
+	}
+
+	user.Active = true
+	err := SetUser(ctx, user, false)
+	if err != nil {
+		return err
+	}
+
+	orgUser := *user
+	orgUser.Password = ""
+	orgUser.PasswordHistory = []string{}
+	orgUser.Session = ""
+	orgUser.PrivateApps = []WorkflowApp{}
+	orgUser.Role = role
+	orgUser.Roles = []string{role}
+
+	found := false
+	for index, existing := range org.Users {
+		if existing.Id == user.Id {
+			org.Users[index] = orgUser
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		org.Users = append(org.Users, orgUser)
+	}
+
+	deactivated := []string{}
+	for _, userId := range org.ScimConfig.Deactivated {
+		if userId != user.Id {
+			deactivated = append(deactivated, userId)
+		}
+	}
+
+	org.ScimConfig.Deactivated = deactivated
+	return SetOrg(ctx, *org, org.Id)
+}
+
+// An existing user can only be linked to the IdP if they
+// are already in the org, or were deactivated in it
+func canScimLinkUser(user User, org *Org) bool {
+	if ArrayContains(user.Orgs, org.Id) || ArrayContains(org.ScimConfig.Deactivated, user.Id) {
+		return true
+	}
+
+	for _, orgUser := range org.Users {
+		if orgUser.Id == user.Id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Removes the user from the org the same way as DeleteUser. Deactivated users
+// are remembered so the IdP can still read and reactivate them.
+func removeUserFromOrg(ctx context.Context, user *User, org *Org, deactivate bool) error {
+	orgs := []string{}
+	for _, orgId := range user.Orgs {
+		if orgId != org.Id {
+			orgs = append(orgs, orgId)
+		}
+	}
+
+	user.Orgs = orgs
+	if user.ActiveOrg.Id == org.Id {
+		user.ActiveOrg = OrgMini{}
+		if len(orgs) > 0 {
+			user.ActiveOrg.Id = orgs[0]
+		}
+
+		// Logs the user out of the org
+		revokeUserSessions(ctx, user)
+	} else if deactivate {
+		revokeUserSessions(ctx, user)
+	}
+
+	err := SetUser(ctx, user, false)
+	if err != nil {
+		return err
+	}
+
+	users := []User{}
+	for _, orgUser := range org.Users {
+		if orgUser.Id != user.Id {
+			users = append(users, orgUser)
+		}
+	}
+
+	org.Users = users
+	if deactivate && !ArrayContains(org.ScimConfig.Deactivated, user.Id) {
+		org.ScimConfig.Deactivated = append(org.ScimConfig.Deactivated, user.Id)
+	} else if !deactivate {
+		deactivated := []string{}
+		for _, userId := range org.ScimConfig.Deactivated {
+			if userId != user.Id {
+				deactivated = append(deactivated, userId)
+			}
+		}
+
+		org.ScimConfig.Deactivated = deactivated
+	}
+
+	return SetOrg(ctx, *org, org.Id)
+}
+
+func setUserOrgRole(ctx context.Context, org *Org, userId, role string) error {
+	user, err := GetUser(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	if !ArrayContains(user.Orgs, org.Id) && user.ActiveOrg.Id != org.Id {
+		return errors.New(fmt.Sprintf("User %s is not in org %s", userId, org.Id))
+	}
+
+	return addUserToOrg(ctx, user, org, role)
+}
+
+func getScimBool(value interface{}) (bool, bool) {
+	switch parsed := value.(type) {
+	case bool:
+		return parsed, true
+	case string:
+		parsedBool, err := strconv.ParseBool(strings.ToLower(parsed))
+		if err == nil {
+			return parsedBool, true
+		}
+	}
+
+	return false, false
+}
+
+// Applies one attribute from a PUT or PATCH. Returns the new active state if it changed
+func applyScimUserAttribute(user *User, attribute string, value interface{}) *bool {
+	stringValue, _ := value.(string)
+	switch strings.ToLower(attribute) {
+	case "active":
+		active, ok := getScimBool(value)
+		if ok {
+			return &active
+		}
+	case "externalid":
+		user.ExternalId = stringValue
+	case "name.givenname":
+		user.PersonalInfo.Firstname = stringValue
+	case "name.familyname":
+		user.PersonalInfo.Lastname = stringValue
+	case "name":
+		if name, ok := value.(map[string]interface{}); ok {
+			for key, nameValue := range name {
+				applyScimUserAttribute(user, fmt.Sprintf("name.%s", key), nameValue)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Matches a resource against a simple filter like: userName eq "user@example.com"
+func matchScimFilter(filter string, values map[string]string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+
+	matches := scimFilter.FindStringSubmatch(filter)
+	if len(matches) != 4 {
+		return false
+	}
+
+	value, found := values[strings.ToLower(matches[1])]
+	if !found {
+		return false
+	}
+
+	// Attribute values like userName are case insensitive in SCIM
+	value = strings.ToLower(value)
+	wanted := strings.ToLower(matches[3])
+	switch strings.ToLower(matches[2]) {
+	case "eq":
+		return value == wanted
+	case "co":
+		return strings.Contains(value, wanted)
+	case "sw":
+		return strings.HasPrefix(value, wanted)
+	}
+
+	return false
+}
+
+func getScimPage(request *http.Request, resources []interface{}) ScimListResponse {
+	startIndex, err := strconv.Atoi(request.URL.Query().Get("startIndex"))
+	if err != nil || startIndex < 1 {
+		startIndex = 1
+	}
+
+	count, err := strconv.Atoi(request.URL.Query().Get("count"))
+	if err != nil || count < 0 || count > scimMaxResults {
+		count = scimMaxResults
+	}
+
+	page := []interface{}{}
+	for index := startIndex - 1; index < len(resources) && len(page) < count; index++ {
+		page = append(page, resources[index])
+	}
+
+	return ScimListResponse{
+		Schemas:      []string{scimListSchema},
+		TotalResults: len(resources),
+		StartIndex:   startIndex,
+		ItemsPerPage: len(page),
+		Resources:    page,
+	}
+}
+
+// Entrypoint for all SCIM requests: /api/scim/v2/{org_id}/{resource}/{id}
+func HandleScim(resp http.ResponseWriter, request *http.Request) {
+	location := strings.Split(strings.Split(request.URL.String(), "?")[0], "/")
+	if len(location) <= 5 {
+		writeScimError(resp, 404, "", "Resource not found")
+		return
+	}
+
+	org, err := getScimOrg(request, location[4])
+	if err != nil {
+		log.Printf("[AUDIT] SCIM authentication failed from %s: %s", GetRequestIp(request), err)
+		writeScimError(resp, 401, "", "Authentication failed")
+		return
+	}
+
+	resourceId := ""
+	if len(location) > 6 {
+		resourceId = location[6]
+	}
+
+	switch location[5] {
+	case "Users":
+		handleScimUsers(resp, request, org, resourceId)
+	case "Groups":
+		handleScimGroups(resp, request, org, resourceId)
+	case "ServiceProviderConfig":
+		writeScimResponse(resp, 200, map[string]interface{}{
+			"schemas":        []string{"urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"},
+			"patch":          map[string]bool{"supported": true},
+			"bulk":           map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+			"filter":         map[string]interface{}{"supported": true, "maxResults": scimMaxResults},
+			"changePassword": map[string]bool{"supported": false},
+			"sort":           map[string]bool{"supported": false},
+			"etag":           map[string]bool{"supported": false},
+			"authenticationSchemes": []map[string]interface{}{
+				map[string]interface{}{
+					"type":        "oauthbearertoken",
+					"name":        "OAuth Bearer Token",
+					"description": "The SCIM token generated for the org",
+					"primary":     true,
+				},
+			},
+		})
+	default:
+		writeScimError(resp, 404, "", "Resource not found")
+	}
+}
+
+func handleScimUsers(resp http.ResponseWriter, request *http.Request, org *Org, userId string) {
+	ctx := GetContext(request)
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		writeScimError(resp, 400, "invalidSyntax", "Failed reading body")
+		return
+	}
+
+	// Looks up a user that is, or was, provisioned to the org
+	getOrgUser := func(userId string) (*User, bool, error) {
+		for _, orgUser := range org.Users {
+			if orgUser.Id == userId {
+				user, err := GetUser(ctx, userId)
+				return user, true, err
+			}
+		}
+
+		if ArrayContains(org.ScimConfig.Deactivated, userId) {
+			user, err := GetUser(ctx, userId)
+			return user, false, err
+		}
+
+		return nil, false, errors.New("User not found")
+	}
+
+	if len(userId) == 0 && request.Method == "GET" {
+		filter := request.URL.Query().Get("filter")
+		resources := []interface{}{}
+
+		addUser := func(user User, active bool) {
+			if matchScimFilter(filter, map[string]string{
+				"username":   user.Username,
+				"externalid": user.ExternalId,
+				"id":         user.Id,
+				"emails":     user.Username,
+			}) {
+				resources = append(resources, getScimUser(user, org, active))
+			}
+		}
+
+		for _, orgUser := range org.Users {
+			addUser(orgUser, true)
+		}
+
+		for _, deactivatedId := range org.ScimConfig.Deactivated {
+			user, err := GetUser(ctx, deactivatedId)
+			if err == nil {
+				addUser(*user, false)
+			}
+		}
+
+		writeScimResponse(resp, 200, getScimPage(request, resources))
+		return
+	}
+
+	if len(userId) == 0 && request.Method == "POST" {
+		var scimUser ScimUser
+		err = json.Unmarshal(body, &scimUser)
+		if err != nil || len(strings.TrimSpace(scimUser.UserName)) == 0 {
+			writeScimError(resp, 400, "invalidValue", "userName is required")
+			return
+		}
+
+		username := strings.ToLower(strings.TrimSpace(scimUser.UserName))
+		user := &User{}
+		users, err := FindUser(ctx, username)
+		if err == nil && len(users) > 0 {
+			// Never take over accounts the org doesn't already have
+			user = &users[0]
+			if !canScimLinkUser(*user, org) {
+				log.Printf("[AUDIT] SCIM in org %s tried to provision existing user %s (%s) from outside the org", org.Id, user.Username, user.Id)
+				writeScimError(resp, 409, "uniqueness", "User already exists")
+				return
+			}
+		} else {
+			user = &User{
+				Id:           uuid.NewV4().String(),
+				Username:     username,
+				ApiKey:       uuid.NewV4().String(),
+				CreationTime: time.Now().Unix(),
+				Verified:     true,
+				Orgs:         []string{},
+			}
+
+			if len(org.SSOConfig.OpenIdAuthorization) > 0 {
+				user.LoginType = "OpenID"
+			} else if len(org.SSOConfig.SSOEntrypoint) > 0 {
+				user.LoginType = "SSO"
+			}
+		}
+
+		user.ExternalId = scimUser.ExternalId
+		if len(scimUser.Name.GivenName) > 0 || len(scimUser.Name.FamilyName) > 0 {
+			user.PersonalInfo.Firstname = scimUser.Name.GivenName
+			user.PersonalInfo.Lastname = scimUser.Name.FamilyName
+		}
+
+		// Linked members keep their role
+		role := getScimDefaultRole(org)
+		for _, orgUser := range org.Users {
+			if orgUser.Id == user.Id && len(orgUser.Role) > 0 {
+				role = orgUser.Role
+			}
+		}
+
+		err = addUserToOrg(ctx, user, org, role)
+		if err != nil {
+			log.Printf("[ERROR] Failed provisioning user %s to org %s: %s", username, org.Id, err)
+			writeScimError(resp, 500, "", "Failed creating user")
+			return
+		}
+
+		active := true
+		if scimUser.Active != nil && !*scimUser.Active {
+			active = false
+			err = removeUserFromOrg(ctx, user, org, true)
+			if err != nil {
+				log.Printf("[WARNING] Failed deactivating provisioned user %s in org %s: %s", username, org.Id, err)
+			}
+		}
+
+		log.Printf("[AUDIT] SCIM provisioned user %s (%s) to org %s", user.Username, user.Id, org.Id)
+		CreateAuditEvent(ctx, request, scimAuditUser, org.Id, "user.scim_provision", "user", user.Id, nil, map[string]interface{}{"username": user.Username, "role": role, "active": active})
+		writeScimResponse(resp, 201, getScimUser(*user, org, active))
+		return
+	}
+
+	user, active, err := getOrgUser(userId)
+	if err != nil {
+		writeScimError(resp, 404, "", "User not found")
+		return
+	}
+
+	switch request.Method {
+	case "GET":
+		writeScimResponse(resp, 200, getScimUser(*user, org, active))
+		return
+	case "DELETE":
+		err = removeUserFromOrg(ctx, user, org, false)
+		if err != nil {
+			log.Printf("[ERROR] Failed removing user %s from org %s with SCIM: %s", user.Id, org.Id, err)
+			writeScimError(resp, 500, "", "Failed deleting user")
+			return
+		}
+
+		log.Printf("[AUDIT] SCIM removed user %s (%s) from org %s", user.Username, user.Id, org.Id)
+		CreateAuditEvent(ctx, request, scimAuditUser, org.Id, "user.scim_remove", "user", user.Id, map[string]string{"username": user.Username}, nil)
+		resp.WriteHeader(204)
+		return
+	case "PUT", "PATCH":
+	default:
+		writeScimError(resp, 405, "", "Method not allowed")
+		return
+	}
+
+	// Only what SCIM can change
+	getScimAuditValue := func(user *User, active bool) map[string]interface{} {
+		return map[string]interface{}{
+			"external_id": user.ExternalId,
+			"firstname":   user.PersonalInfo.Firstname,
+			"lastname":    user.PersonalInfo.Lastname,
+			"active":      active,
+		}
+	}
+
+	before := getScimAuditValue(user, active)
+	var newActive *bool
+	if request.Method == "PUT" {
+		var scimUser ScimUser
+		err = json.Unmarshal(body, &scimUser)
+		if err != nil {
+			writeScimError(resp, 400, "invalidSyntax", "Failed parsing user")
+			return
+		}
+
+		user.ExternalId = scimUser.ExternalId
+		user.PersonalInfo.Firstname = scimUser.Name.GivenName
+		user.PersonalInfo.Lastname = scimUser.Name.FamilyName
+		newActive = scimUser.Active
+	} else {
+		var patch ScimPatchRequest
+		err = json.Unmarshal(body, &patch)
+		if err != nil {
+			writeScimError(resp, 400, "invalidSyntax", "Failed parsing patch")
+			return
+		}
+
+		for _, operation := range patch.Operations {
+			var value interface{}
+			json.Unmarshal(operation.Value, &value)
+
+			if strings.ToLower(operation.Op) == "remove" {
+				value = ""
+			}
+
+			// Without a path, the value is an object of attributes
+			if len(operation.Path) == 0 {
+				attributes, ok := value.(map[string]interface{})
+				if !ok {
+					writeScimError(resp, 400, "invalidValue", "Value must be an object when path is empty")
+					return
+				}
+
+				for attribute, attributeValue := range attributes {
+					if changed := applyScimUserAttribute(user, attribute, attributeValue); changed != nil {
+						newActive = changed
+					}
+				}
+
+				continue
+			}
+
+			if changed := applyScimUserAttribute(user, operation.Path, value); changed != nil {
+				newActive = changed
+			}
+		}
+	}
+
+	if newActive != nil && *newActive != active {
+		active = *newActive
+		if active {
+			err = addUserToOrg(ctx, user, org, getScimDefaultRole(org))
+			log.Printf("[AUDIT] SCIM reactivated user %s (%s) in org %s", user.Username, user.Id, org.Id)
+		} else {
+			err = removeUserFromOrg(ctx, user, org, true)
+			log.Printf("[AUDIT] SCIM deactivated user %s (%s) in org %s", user.Username, user.Id, org.Id)
+		}
+	} else {
+		err = SetUser(ctx, user, false)
+	}
+
+	if err != nil {
+		log.Printf("[ERROR] Failed updating user %s in org %s with SCIM: %s", user.Id, org.Id, err)
+		writeScimError(resp, 500, "", "Failed updating user")
+		return
+	}
+
+	action := "user.scim_update"
+	if before["active"] != active {
+		action = "user.scim_deactivate"
+		if active {
+			action = "user.scim_reactivate"
+		}
+	}
+
+	CreateAuditEvent(ctx, request, scimAuditUser, org.Id, action, "user", user.Id, before, getScimAuditValue(user, active))
+	writeScimResponse(resp, 200, getScimUser(*user, org, active))
+}
+
+// Groups are the built-in roles and the org's custom roles
+func getScimGroups(ctx context.Context, org *Org) []ScimGroup {
+	roles := []OrgRole{}
+	for _, name := range []string{"admin", "user", "org-reader"} {
+		roles = append(roles, OrgRole{Id: name, Name: name})
+	}
+
+	customRoles, err := GetOrgRoles(ctx, org.Id)
+	if err == nil {
+		roles = append(roles, customRoles...)
+	}
+
+	groups := []ScimGroup{}
+	for _, role := range roles {
+		group := ScimGroup{
+			Schemas:     []string{scimGroupSchema},
+			Id:          role.Id,
+			DisplayName: role.Name,
+			Members:     []ScimMultiValue{},
+			Meta: ScimMeta{
+				ResourceType: "Group",
+				Created:      formatScimTime(role.Created),
+				LastModified: formatScimTime(role.Edited),
+				Location:     fmt.Sprintf("/api/scim/v2/%s/Groups/%s", org.Id, role.Id),
+			},
+		}
+
+		for _, orgUser := range org.Users {
+			if orgUser.Role == role.Id {
+				group.Members = append(group.Members, ScimMultiValue{
+					Value:   orgUser.Id,
+					Display: orgUser.Username,
+					Ref:     fmt.Sprintf("/api/scim/v2/%s/Users/%s", org.Id, orgUser.Id),
+				})
+			}
+		}
+
+		groups = append(groups, group)
+	}
+
+	return groups
+}
+
+func getScimMemberIds(value interface{}) []string {
+	memberIds := []string{}
+	members, ok := value.([]interface{})
+	if !ok {
+		return memberIds
+	}
+
+	for _, member := range members {
+		if parsed, ok := member.(map[string]interface{}); ok {
+			if memberId, ok := parsed["value"].(string); ok {
+				memberIds = append(memberIds, memberId)
+			}
+		}
+	}
+
+	return memberIds
+}
+
+func handleScimGroups(resp http.ResponseWriter, request *http.Request, org *Org, groupId string) {
+	ctx := GetContext(request)
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		writeScimError(resp, 400, "invalidSyntax", "Failed reading body")
+		return
+	}
+
+	groups := getScimGroups(ctx, org)
+	if len(groupId) == 0 && request.Method == "GET" {
+		filter := request.URL.Query().Get("filter")
+		excludeMembers := strings.Contains(request.URL.Query().Get("excludedAttributes"), "members")
+		resources := []interface{}{}
+		for _, group := range groups {
+			if !matchScimFilter(filter, map[string]string{"displayname": group.DisplayName, "id": group.Id}) {
+				continue
+			}
+
+			if excludeMembers {
+				group.Members = []ScimMultiValue{}
+			}
+
+			resources = append(resources, group)
+		}
+
+		writeScimResponse(resp, 200, getScimPage(request, resources))
+		return
+	}
+
+	if len(groupId) == 0 && request.Method == "POST" {
+		var group ScimGroup
+		err = json.Unmarshal(body, &group)
+		if err != nil || len(strings.TrimSpace(group.DisplayName)) == 0 {
+			writeScimError(resp, 400, "invalidValue", "displayName is required")
+			return
+		}
+
+		for _, existing := range groups {
+			if strings.EqualFold(existing.DisplayName, group.DisplayName) {
+				writeScimError(resp, 409, "uniqueness", "Group already exists")
+				return
+			}
+		}
+
+		// New roles have no permissions until an admin gives them some
+		role := OrgRole{
+			Id:          uuid.NewV4().String(),
+			OrgId:       org.Id,
+			Name:        strings.TrimSpace(group.DisplayName),
+			Description: "Provisioned with SCIM",
+			Permissions: []string{},
+			CreatedBy:   "scim",
+		}
+
+		err = SetOrgRole(ctx, role)
+		if err != nil {
+			log.Printf("[ERROR] Failed creating role from SCIM group in org %s: %s", org.Id, err)
+			writeScimError(resp, 500, "", "Failed creating group")
+			return
+		}
+
+		for _, member := range group.Members {
+			err = setUserOrgRole(ctx, org, member.Value, role.Id)
+			if err != nil {
+				log.Printf("[WARNING] Failed adding %s to SCIM group %s: %s", member.Value, role.Id, err)
+			}
+		}
+
+		log.Printf("[AUDIT] SCIM created role %s (%s) in org %s", role.Name, role.Id, org.Id)
+		CreateAuditEvent(ctx, request, scimAuditUser, org.Id, "role.scim_create", "role", role.Id, nil, map[string]interface{}{"name": role.Name, "members": len(group.Members)})
+		for _, created := range getScimGroups(ctx, org) {
+			if created.Id == role.Id {
+				writeScimResponse(resp, 201, created)
+				return
+			}
+		}
+
+		writeScimError(resp, 500, "", "Failed creating group")
+		return
+	}
+
+	group := ScimGroup{}
+	for _, existing := range groups {
+		if existing.Id == groupId {
+			group = existing
+			break
+		}
+	}
+
+	if len(group.Id) == 0 {
+		writeScimError(resp, 404, "", "Group not found")
+		return
+	}
+
+	defaultRole := getScimDefaultRole(org)
+	currentMembers := []string{}
+	for _, member := range group.Members {
+		currentMembers = append(currentMembers, member.Value)
+	}
+
+	addMembers := []string{}
+	removeMembers := []string{}
+	newName := ""
+
+	switch request.Method {
+	case "GET":
+		writeScimResponse(resp, 200, group)
+		return
+	case "DELETE":
+		if isBuiltinRole(group.Id) {
+			writeScimError(resp, 400, "mutability", "Built-in roles can't be deleted")
+			return
+		}
+
+		for _, memberId := range currentMembers {
+			err = setUserOrgRole(ctx, org, memberId, defaultRole)
+			if err != nil {
+				log.Printf("[WARNING] Failed moving %s to role %s before deleting role %s: %s", memberId, defaultRole, group.Id, err)
+			}
+		}
+
+		err = DeleteKey(ctx, "org_roles", group.Id)
+		if err != nil {
+			writeScimError(resp, 500, "", "Failed deleting group")
+			return
+		}
+
+		DeleteCache(ctx, fmt.Sprintf("org_roles_org_%s", org.Id))
+		log.Printf("[AUDIT] SCIM deleted role %s (%s) in org %s", group.DisplayName, group.Id, org.Id)
+		CreateAuditEvent(ctx, request, scimAuditUser, org.Id, "role.scim_delete", "role", group.Id, map[string]interface{}{"name": group.DisplayName, "members": currentMembers}, nil)
+		resp.WriteHeader(204)
+		return
+	case "PUT":
+		var newGroup ScimGroup
+		err = json.Unmarshal(body, &newGroup)
+		if err != nil {
+			writeScimError(resp, 400, "invalidSyntax", "Failed parsing group")
+			return
+		}
+
+		newName = newGroup.DisplayName
+		wanted := []string{}
+		for _, member := range newGroup.Members {
+			wanted = append(wanted, member.Value)
+			if !ArrayContains(currentMembers, member.Value) {
+				addMembers = append(addMembers, member.Value)
+			}
+		}
+
+		for _, memberId := range currentMembers {
+			if !ArrayContains(wanted, memberId) {
+				removeMembers = append(removeMembers, memberId)
+			}
+		}
+	case "PATCH":
+		var patch ScimPatchRequest
+		err = json.Unmarshal(body, &patch)
+		if err != nil {
+			writeScimError(resp, 400, "invalidSyntax", "Failed parsing patch")
+			return
+		}
+
+		for _, operation := range patch.Operations {
+			var value interface{}
+			json.Unmarshal(operation.Value, &value)
+
+			op := strings.ToLower(operation.Op)
+			path := operation.Path
+			if len(path) == 0 {
+				if attributes, ok := value.(map[string]interface{}); ok {
+					if name, ok := attributes["displayName"].(string); ok {
+						newName = name
+					}
+
+					if members, ok := attributes["members"]; ok {
+						path = "members"
+						value = members
+					}
+				}
+			}
+
+			if pathMatch := scimMemberPath.FindStringSubmatch(path); len(pathMatch) == 2 && op == "remove" {
+				removeMembers = append(removeMembers, pathMatch[1])
+				continue
+			}
+
+			if strings.EqualFold(path, "displayName") {
+				if name, ok := value.(string); ok {
+					newName = name
+				}
+
+				continue
+			}
+
+			if !strings.EqualFold(path, "members") {
+				continue
+			}
+
+			memberIds := getScimMemberIds(value)
+			switch op {
+			case "add":
+				addMembers = append(addMembers, memberIds...)
+			case "remove":
+				if len(memberIds) == 0 {
+					memberIds = currentMembers
+				}
+
+				removeMembers = append(removeMembers, memberIds...)
+			case "replace":
+				addMembers = append(addMembers, memberIds...)
+				for _, memberId := range currentMembers {
+					if !ArrayContains(memberIds, memberId) {
+						removeMembers = append(removeMembers, memberId)
+					}
+				}
+			}
+		}
+	default:
+		writeScimError(resp, 405, "", "Method not allowed")
+		return
+	}
+
+	if len(newName) > 0 && newName != group.DisplayName {
+		if isBuiltinRole(group.Id) {
+			writeScimError(resp, 400, "mutability", "Built-in roles can't be renamed")
+			return
+		}
+
+		role, err := GetOrgRole(ctx, group.Id)
+		if err == nil {
+			role.Name = newName
+			err = SetOrgRole(ctx, *role)
+		}
+
+		if err != nil {
+			log.Printf("[WARNING] Failed renaming role %s from SCIM: %s", group.Id, err)
+		}
+	}
+
+	for _, memberId := range addMembers {
+		err = setUserOrgRole(ctx, org, memberId, group.Id)
+		if err != nil {
+			log.Printf("[WARNING] Failed adding %s to SCIM group %s: %s", memberId, group.Id, err)
+		}
+	}
+
+	// Users removed from a group fall back to the default role
+	for _, memberId := range removeMembers {
+		if ArrayContains(addMembers, memberId) || group.Id == defaultRole {
+			continue
+		}
+
+		err = setUserOrgRole(ctx, org, memberId, defaultRole)
+		if err != nil {
+			log.Printf("[WARNING] Failed removing %s from SCIM group %s: %s", memberId, group.Id, err)
+		}
+	}
+
+	log.Printf("[AUDIT] SCIM updated role %s in org %s. Added %d, removed %d", group.Id, org.Id, len(addMembers), len(removeMembers))
+	CreateAuditEvent(ctx, request, scimAuditUser, org.Id, "role.scim_update", "role", group.Id, map[string]interface{}{"name": group.DisplayName}, map[string]interface{}{"name": newName, "added": addMembers, "removed": removeMembers})
+	for _, updated := range getScimGroups(ctx, org) {
+		if updated.Id == group.Id {
+			writeScimResponse(resp, 200, updated)
+			return
+		}
+	}
+
+	resp.WriteHeader(204)
+}
+
+// Generates a new SCIM token for the active org. The old one stops working.
+// Optional body: {"default_role": "user"}
+func HandleGenerateScimToken(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in generate SCIM token: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if Authorize(user, "org:manage", "") != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "You don't have access to set up SCIM"}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	org, err := GetOrg(ctx, user.ActiveOrg.Id)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting org %s in generate SCIM token: %s", user.ActiveOrg.Id, err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	var config ScimConfig
+	body, err := ioutil.ReadAll(request.Body)
+	if err == nil && len(body) > 0 {
+		json.Unmarshal(body, &config)
+	}
+
+	if len(config.DefaultRole) > 0 && !isValidOrgRole(ctx, config.DefaultRole, org.Id) {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Invalid default role"}`))
+		return
+	}
+
+	token := strings.Replace(fmt.Sprintf("%s%s", uuid.NewV4().String(), uuid.NewV4().String()), "-", "", -1)
+	org.ScimConfig.TokenHash = hashScimToken(token)
+	org.ScimConfig.Created = time.Now().Unix()
+	org.ScimConfig.CreatedBy = user.Username
+	if len(config.DefaultRole) > 0 {
+		org.ScimConfig.DefaultRole = config.DefaultRole
+	}
+
+	err = SetOrg(ctx, *org, org.Id)
+	if err != nil {
+		log.Printf("[ERROR] Failed saving SCIM token for org %s: %s", org.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	log.Printf("[AUDIT] User %s (%s) generated a new SCIM token for org %s", user.Username, user.Id, org.Id)
+	CreateAuditEvent(ctx, request, user, org.Id, "org.scim_token_create", "org", org.Id, nil, nil)
+	resp.WriteHeader(200)
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "token": "%s", "url": "/api/scim/v2/%s"}`, token, org.Id)))
+}
+
+// Turns off SCIM for the active org
+func HandleDeleteScimToken(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in delete SCIM token: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if Authorize(user, "org:manage", "") != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "You don't have access to set up SCIM"}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	org, err := GetOrg(ctx, user.ActiveOrg.Id)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	org.ScimConfig.TokenHash = ""
+	err = SetOrg(ctx, *org, org.Id)
+	if err != nil {
+		log.Printf("[ERROR] Failed removing SCIM token for org %s: %s", org.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	log.Printf("[AUDIT] User %s (%s) disabled SCIM for org %s", user.Username, user.Id, org.Id)
+	CreateAuditEvent(ctx, request, user, org.Id, "org.scim_disable", "org", org.Id, nil, nil)
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
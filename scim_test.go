@@ -0,0 +1,30 @@
+package shuffle
+
+import (
+	"testing"
+)
+
+func TestCanScimLinkUser(t *testing.T) {
+	org := &Org{
+		Id:    "org",
+		Users: []User{{Id: "listed"}},
+	}
+	org.ScimConfig.Deactivated = []string{"deactivated"}
+
+	handlers := []struct {
+		user     User
+		expected bool
+	}{
+		{User{Id: "member", Orgs: []string{"other", "org"}}, true},
+		{User{Id: "listed"}, true},
+		{User{Id: "deactivated"}, true},
+		{User{Id: "outsider", Orgs: []string{"other"}}, false},
+		{User{Id: "no-orgs"}, false},
+	}
+
+	for _, tt := range handlers {
+		if canScimLinkUser(tt.user, org) != tt.expected {
+			t.Errorf("canScimLinkUser(%s) = %v; expected %v", tt.user.Id, !tt.expected, tt.expected)
+		}
+	}
+}
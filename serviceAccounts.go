@@ -0,0 +1,413 @@
+package shuffle
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+var serviceAccountNameRegex = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// Service account usernames include the org so they are unique, and are
+// easy to tell apart from people in updated_by fields and audit logs.
+func getServiceAccountUsername(name, orgId string) string {
+	name = serviceAccountNameRegex.ReplaceAllString(strings.ToLower(strings.TrimSpace(name)), "-")
+	return fmt.Sprintf("%s@%s.serviceaccount", strings.Trim(name, "-"), orgId)
+}
+
+func getOrgServiceAccount(ctx context.Context, orgId, serviceAccountId string) (*User, error) {
+	serviceAccount, err := GetUser(ctx, serviceAccountId)
+	if err != nil || !serviceAccount.ServiceAccount || !ArrayContains(serviceAccount.Orgs, orgId) {
+		return nil, errors.New("Service account not found")
+	}
+
+	serviceAccount.ActiveOrg.Id = orgId
+	return serviceAccount, nil
+}
+
+func getServiceAccountInfo(ctx context.Context, serviceAccount User, org *Org) ServiceAccountInfo {
+	apiKeys, err := GetUserApiKeys(ctx, serviceAccount.Id)
+	if err != nil {
+		apiKeys = []UserApiKey{}
+	}
+
+	for index := range apiKeys {
+		apiKeys[index].KeyHash = ""
+	}
+
+	return ServiceAccountInfo{
+		Id:          serviceAccount.Id,
+		Username:    serviceAccount.Username,
+		Description: serviceAccount.Description,
+		Role:        getOrgUserRole(org, serviceAccount.Id),
+		Active:      serviceAccount.Active,
+		Created:     serviceAccount.CreationTime,
+		CreatedBy:   serviceAccount.CreatedBy,
+		ApiKeys:     apiKeys,
+	}
+}
+
+func getServiceAccountAdmin(resp http.ResponseWriter, request *http.Request, action string) (User, bool) {
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in %s: %s", action, err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return user, false
+	}
+
+	if !isOrgMember(user) || Authorize(user, "users:manage", "") != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "You don't have access to manage service accounts"}`))
+		return user, false
+	}
+
+	return user, true
+}
+
+func HandleGetServiceAccounts(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, ok := getServiceAccountAdmin(resp, request, "get service accounts")
+	if !ok {
+		return
+	}
+
+	ctx := GetContext(request)
+	org, err := GetOrg(ctx, user.ActiveOrg.Id)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting org %s for service accounts: %s", user.ActiveOrg.Id, err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	serviceAccounts := []ServiceAccountInfo{}
+	for _, orgUser := range org.Users {
+		if !orgUser.ServiceAccount {
+			continue
+		}
+
+		serviceAccount, err := GetUser(ctx, orgUser.Id)
+		if err != nil {
+			continue
+		}
+
+		serviceAccounts = append(serviceAccounts, getServiceAccountInfo(ctx, *serviceAccount, org))
+	}
+
+	newjson, err := json.Marshal(struct {
+		Success         bool                 `json:"success"`
+		ServiceAccounts []ServiceAccountInfo `json:"service_accounts"`
+	}{
+		Success:         true,
+		ServiceAccounts: serviceAccounts,
+	})
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// Creates a service account in the active org. API keys are created for
+// it with HandleCreateUserApiKey and service_account_id.
+func HandleCreateServiceAccount(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, ok := getServiceAccountAdmin(resp, request, "create service account")
+	if !ok {
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		log.Printf("[WARNING] Failed reading body in create service account: %s", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	var input struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Role        string `json:"role"`
+	}
+
+	err = json.Unmarshal(body, &input)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Failed parsing body"}`))
+		return
+	}
+
+	username := getServiceAccountUsername(input.Name, user.ActiveOrg.Id)
+	if strings.HasPrefix(username, "@") || len(input.Name) > 64 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Name must be between 1 and 64 characters, and contain letters or numbers"}`))
+		return
+	}
+
+	if len(input.Role) == 0 {
+		input.Role = "user"
+	}
+
+	ctx := GetContext(request)
+	if !isValidOrgRole(ctx, input.Role, user.ActiveOrg.Id) {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Role %s doesn't exist"}`, input.Role)))
+		return
+	}
+
+	err = canGrantRole(ctx, user, input.Role)
+	if err != nil {
+		resp.WriteHeader(403)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	users, err := FindUser(ctx, username)
+	if err == nil && len(users) > 0 {
+		resp.WriteHeader(409)
+		resp.Write([]byte(`{"success": false, "reason": "A service account with this name already exists"}`))
+		return
+	}
+
+	org, err := GetOrg(ctx, user.ActiveOrg.Id)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting org %s for service account: %s", user.ActiveOrg.Id, err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	serviceAccount := &User{
+		Id:             uuid.NewV4().String(),
+		Username:       username,
+		CreationTime:   time.Now().Unix(),
+		Verified:       true,
+		Orgs:           []string{},
+		LoginType:      "ServiceAccount",
+		ServiceAccount: true,
+		Description:    input.Description,
+		CreatedBy:      user.Username,
+	}
+
+	err = addUserToOrg(ctx, serviceAccount, org, input.Role)
+	if err != nil {
+		log.Printf("[ERROR] Failed creating service account %s in org %s: %s", username, org.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	log.Printf("[AUDIT] User %s (%s) created service account %s (%s) in org %s with role %s", user.Username, user.Id, serviceAccount.Username, serviceAccount.Id, org.Id, input.Role)
+	CreateAuditEvent(ctx, request, user, org.Id, "service_account.create", "user", serviceAccount.Id, nil, map[string]interface{}{"username": serviceAccount.Username, "role": input.Role})
+
+	newjson, err := json.Marshal(struct {
+		Success        bool               `json:"success"`
+		ServiceAccount ServiceAccountInfo `json:"service_account"`
+	}{
+		Success:        true,
+		ServiceAccount: getServiceAccountInfo(ctx, *serviceAccount, org),
+	})
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// Changes the description, role or active state of a service account.
+// Disabled accounts keep their API keys, but they stop working.
+func HandleUpdateServiceAccount(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, ok := getServiceAccountAdmin(resp, request, "update service account")
+	if !ok {
+		return
+	}
+
+	location := strings.Split(strings.Split(request.URL.String(), "?")[0], "/")
+	if len(location) <= 5 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Service account ID required"}`))
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	var input struct {
+		Description *string `json:"description"`
+		Role        string  `json:"role"`
+		Active      *bool   `json:"active"`
+	}
+
+	err = json.Unmarshal(body, &input)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Failed parsing body"}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	serviceAccount, err := getOrgServiceAccount(ctx, user.ActiveOrg.Id, location[5])
+	if err != nil {
+		resp.WriteHeader(404)
+		resp.Write([]byte(`{"success": false, "reason": "Service account not found"}`))
+		return
+	}
+
+	if len(input.Role) > 0 && !isValidOrgRole(ctx, input.Role, user.ActiveOrg.Id) {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Role %s doesn't exist"}`, input.Role)))
+		return
+	}
+
+	err = canManageUser(ctx, user, *serviceAccount)
+	if err == nil && len(input.Role) > 0 {
+		err = canGrantRole(ctx, user, input.Role)
+	}
+
+	if err != nil {
+		resp.WriteHeader(403)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	org, err := GetOrg(ctx, user.ActiveOrg.Id)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting org %s for service account: %s", user.ActiveOrg.Id, err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	before := getServiceAccountInfo(ctx, *serviceAccount, org)
+	before.ApiKeys = nil
+
+	role := before.Role
+	if len(input.Role) > 0 {
+		role = input.Role
+	}
+
+	if input.Description != nil {
+		serviceAccount.Description = *input.Description
+	}
+
+	active := serviceAccount.Active
+	if input.Active != nil {
+		active = *input.Active
+	}
+
+	// Sets the role in both the user and org. This also activates it
+	err = addUserToOrg(ctx, serviceAccount, org, role)
+	if err == nil && !active {
+		serviceAccount.Active = false
+		err = SetUser(ctx, serviceAccount, false)
+	}
+
+	if err != nil {
+		log.Printf("[ERROR] Failed updating service account %s: %s", serviceAccount.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	after := getServiceAccountInfo(ctx, *serviceAccount, org)
+	after.ApiKeys = nil
+
+	log.Printf("[AUDIT] User %s (%s) updated service account %s (%s) in org %s", user.Username, user.Id, serviceAccount.Username, serviceAccount.Id, org.Id)
+	CreateAuditEvent(ctx, request, user, org.Id, "service_account.update", "user", serviceAccount.Id, before, after)
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
+
+// Deletes a service account and all of its API keys
+func HandleDeleteServiceAccount(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, ok := getServiceAccountAdmin(resp, request, "delete service account")
+	if !ok {
+		return
+	}
+
+	location := strings.Split(strings.Split(request.URL.String(), "?")[0], "/")
+	if len(location) <= 5 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Service account ID required"}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	serviceAccount, err := getOrgServiceAccount(ctx, user.ActiveOrg.Id, location[5])
+	if err != nil {
+		resp.WriteHeader(404)
+		resp.Write([]byte(`{"success": false, "reason": "Service account not found"}`))
+		return
+	}
+
+	err = canManageUser(ctx, user, *serviceAccount)
+	if err != nil {
+		resp.WriteHeader(403)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	apiKeys, err := GetUserApiKeys(ctx, serviceAccount.Id)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting API keys of service account %s: %s", serviceAccount.Id, err)
+	}
+
+	for _, apiKey := range apiKeys {
+		err = DeleteUserApiKey(ctx, apiKey)
+		if err != nil {
+			log.Printf("[WARNING] Failed deleting API key %s of service account %s: %s", apiKey.Id, serviceAccount.Id, err)
+		}
+	}
+
+	err = DeleteUsersAccount(ctx, serviceAccount)
+	if err != nil {
+		log.Printf("[ERROR] Failed deleting service account %s: %s", serviceAccount.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	log.Printf("[AUDIT] User %s (%s) deleted service account %s (%s) with %d API keys in org %s", user.Username, user.Id, serviceAccount.Username, serviceAccount.Id, len(apiKeys), user.ActiveOrg.Id)
+	CreateAuditEvent(ctx, request, user, user.ActiveOrg.Id, "service_account.delete", "user", serviceAccount.Id, map[string]interface{}{"username": serviceAccount.Username}, nil)
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
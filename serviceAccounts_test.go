@@ -0,0 +1,71 @@
+package shuffle
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGetServiceAccountUsername(t *testing.T) {
+	handlers := []struct {
+		name     string
+		expected string
+	}{
+		{"Splunk Forwarder", "splunk-forwarder@org.serviceaccount"},
+		{" --ci_bot-- ", "ci-bot@org.serviceaccount"},
+		{"!!!", "@org.serviceaccount"},
+	}
+
+	for _, tt := range handlers {
+		if username := getServiceAccountUsername(tt.name, "org"); username != tt.expected {
+			t.Errorf("getServiceAccountUsername(%s) = %s; expected %s", tt.name, username, tt.expected)
+		}
+	}
+}
+
+func TestCreateServiceAccountRejections(t *testing.T) {
+	orgId := "serviceaccount-test-org"
+	admin := User{Id: "serviceaccount-test-admin", Username: "serviceaccount-admin", Role: "admin", Active: true, Orgs: []string{orgId}, ActiveOrg: OrgMini{Id: orgId}}
+	user := User{Id: "serviceaccount-test-user", Username: "serviceaccount-user", Role: "user", Active: true, Orgs: []string{orgId}, ActiveOrg: OrgMini{Id: orgId}}
+	org := Org{Id: orgId, Name: "serviceaccount-test", Users: []User{admin, user}}
+
+	userKey := setTestApiKeyCache(t, user, org, UserApiKey{Id: "serviceaccount-test-user-key", Scopes: []string{"*"}})
+	scopedKey := setTestApiKeyCache(t, admin, org, UserApiKey{Id: "serviceaccount-test-scoped-key", Scopes: []string{"users:manage", "workflow:read"}})
+
+	handlers := []struct {
+		name   string
+		apiKey string
+		body   string
+		code   int
+		reason string
+	}{
+		{"user without users:manage", userKey, `{"name": "forwarder", "role": "user"}`, 401, "manage service accounts"},
+		{"key scoped below admin", scopedKey, `{"name": "forwarder", "role": "admin"}`, 403, "permission"},
+		{"key scoped below user", scopedKey, `{"name": "forwarder", "role": "user"}`, 403, "permission"},
+	}
+
+	for _, tt := range handlers {
+		request := httptest.NewRequest("POST", "/api/v1/users/service_accounts", strings.NewReader(tt.body))
+		request.Header.Set("Authorization", "Bearer "+tt.apiKey)
+		resp := httptest.NewRecorder()
+		HandleCreateServiceAccount(resp, request)
+
+		if resp.Code != tt.code || !strings.Contains(resp.Body.String(), tt.reason) {
+			t.Errorf("Service account was created by %s: %d %s", tt.name, resp.Code, resp.Body.String())
+		}
+	}
+}
+
+func TestDisabledServiceAccountApiKey(t *testing.T) {
+	orgId := "serviceaccount-test-org"
+	serviceAccount := User{Id: "serviceaccount-test-disabled", Username: "forwarder@serviceaccount-test-org.serviceaccount", Role: "user", ServiceAccount: true, Orgs: []string{orgId}}
+	org := Org{Id: orgId, Name: "serviceaccount-test", Users: []User{serviceAccount}}
+	rawKey := setTestApiKeyCache(t, serviceAccount, org, UserApiKey{Id: "serviceaccount-test-disabled-key"})
+
+	request := httptest.NewRequest("GET", "/api/v1/workflows", nil)
+	request.Header.Set("Authorization", "Bearer "+rawKey)
+	_, err := HandleApiAuthentication(httptest.NewRecorder(), request)
+	if err == nil || !strings.Contains(err.Error(), "deactivated") {
+		t.Errorf("Key of a disabled service account was accepted: %v", err)
+	}
+}
@@ -0,0 +1,449 @@
+package shuffle
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Sessions are listed and revoked by a hash of the token so the token
+// itself never leaves the cookie.
+func getSessionId(sessionToken string) string {
+	hash := sha256.Sum256([]byte(sessionToken))
+	return hex.EncodeToString(hash[:16])
+}
+
+func getSessionToken(request *http.Request) string {
+	c, err := request.Cookie("__session")
+	if err != nil {
+		c, err = request.Cookie("session_token")
+	}
+
+	if err != nil {
+		return ""
+	}
+
+	return c.Value
+}
+
+// Returns why a session is no longer valid, or an empty string if it is
+func getSessionExpiry(session Session, user User, policy SessionPolicy, now int64) string {
+	if user.PasswordChanged > 0 && session.Created < user.PasswordChanged {
+		return "password changed"
+	}
+
+	if policy.AbsoluteTimeoutMinutes > 0 && now-session.Created > int64(policy.AbsoluteTimeoutMinutes)*60 {
+		return "absolute timeout"
+	}
+
+	lastActivity := session.LastActivity
+	if lastActivity == 0 {
+		lastActivity = session.Created
+	}
+
+	if policy.IdleTimeoutMinutes > 0 && now-lastActivity > int64(policy.IdleTimeoutMinutes)*60 {
+		return "idle timeout"
+	}
+
+	return ""
+}
+
+func stampLegacySession(request *http.Request, session Session, now int64) Session {
+	session.Created = now
+	session.LastActivity = now
+	session.IP = GetRequestIp(request)
+	session.UserAgent = request.Header.Get("User-Agent")
+	return session
+}
+
+// Sessions from before sessions were tracked are looked up on the user, and
+// tracked from their first use so the org's timeouts apply to them too
+func trackLegacySession(ctx context.Context, request *http.Request, sessionToken string, session *Session) (*Session, error) {
+	if session == nil || len(session.UserId) == 0 {
+		user, err := GetSessionNew(ctx, sessionToken)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(user.Id) == 0 {
+			return nil, errors.New("Session doesn't exist")
+		}
+
+		session = &Session{
+			Username: strings.ToLower(user.Username),
+			Id:       user.Id,
+			UserId:   strings.ToLower(user.Id),
+			Session:  sessionToken,
+		}
+	}
+
+	*session = stampLegacySession(request, *session, time.Now().Unix())
+	err := UpdateSession(ctx, *session)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[AUDIT] Started tracking legacy session %s of user %s", getSessionId(sessionToken), session.UserId)
+	return session, nil
+}
+
+// Finds the user of a session and applies the timeouts of their active org
+func getSessionUser(ctx context.Context, request *http.Request, sessionToken string) (User, error) {
+	session, err := GetSession(ctx, sessionToken)
+	if err != nil || len(session.UserId) == 0 || session.Created == 0 {
+		if err != nil {
+			session = nil
+		}
+
+		session, err = trackLegacySession(ctx, request, sessionToken, session)
+		if err != nil {
+			return User{}, err
+		}
+	}
+
+	user, err := GetUser(ctx, session.UserId)
+	if err != nil {
+		return User{}, err
+	}
+
+	if user.ServiceAccount {
+		return User{}, errors.New("Service accounts can't log in interactively")
+	}
+
+	policy := SessionPolicy{}
+	if len(user.ActiveOrg.Id) > 0 {
+		org, err := GetOrg(ctx, user.ActiveOrg.Id)
+		if err == nil {
+			policy = org.SessionPolicy
+		}
+	}
+
+	timeNow := time.Now().Unix()
+	reason := getSessionExpiry(*session, *user, policy, timeNow)
+	if len(reason) > 0 {
+		log.Printf("[AUDIT] Session %s of user %s (%s) expired: %s", getSessionId(sessionToken), user.Username, user.Id, reason)
+
+		err = DeleteSession(ctx, sessionToken)
+		if err != nil {
+			log.Printf("[WARNING] Failed deleting expired session of user %s: %s", user.Id, err)
+		}
+
+		// Or the session would still be found on the user
+		if user.Session == sessionToken {
+			user.Session = ""
+			err = SetUser(ctx, user, false)
+			if err != nil {
+				log.Printf("[WARNING] Failed clearing expired session of user %s: %s", user.Id, err)
+			}
+		}
+
+		return User{}, errors.New(fmt.Sprintf("Session expired (%s)", reason))
+	}
+
+	// Activity is only written once a minute
+	if timeNow-session.LastActivity >= 60 {
+		session.LastActivity = timeNow
+		session.IP = GetRequestIp(request)
+		session.UserAgent = request.Header.Get("User-Agent")
+		err = UpdateSession(ctx, *session)
+		if err != nil {
+			log.Printf("[WARNING] Failed updating activity of session for user %s: %s", user.Id, err)
+		}
+
+		setRateLimitOrg(ctx, request, user.ActiveOrg.Id)
+	}
+
+	return *user, nil
+}
+
+// Logs the user out everywhere. The caller saves the user.
+func revokeUserSessions(ctx context.Context, user *User) {
+	sessions, err := GetUserSessions(ctx, user.Id)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting sessions of user %s: %s", user.Id, err)
+	}
+
+	for _, session := range sessions {
+		err = DeleteSession(ctx, session.Session)
+		if err != nil {
+			log.Printf("[WARNING] Failed revoking session of user %s: %s", user.Id, err)
+		}
+	}
+
+	if len(user.Session) > 0 {
+		DeleteSession(ctx, user.Session)
+	}
+
+	user.Session = ""
+	user.ValidatedSessionOrgs = []string{}
+	log.Printf("[AUDIT] Revoked %d session(s) of user %s (%s)", len(sessions), user.Username, user.Id)
+}
+
+// Gets the user whose sessions are managed. Admins with users:manage
+// can pass user_id for users in their org.
+func getSessionTargetUser(ctx context.Context, user User, request *http.Request) (*User, error) {
+	userId := request.URL.Query().Get("user_id")
+	if len(userId) == 0 || userId == user.Id {
+		return GetUser(ctx, user.Id)
+	}
+
+	if Authorize(user, "users:manage", "") != nil {
+		return &User{}, errors.New("Missing permission users:manage")
+	}
+
+	targetUser, err := GetUser(ctx, userId)
+	if err != nil || !ArrayContains(targetUser.Orgs, user.ActiveOrg.Id) {
+		return &User{}, errors.New("User not found")
+	}
+
+	err = canManageUser(ctx, user, *targetUser)
+	if err != nil {
+		return &User{}, err
+	}
+
+	return targetUser, nil
+}
+
+func getActiveSessions(ctx context.Context, user User) []Session {
+	sessions, err := GetUserSessions(ctx, user.Id)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting sessions of user %s: %s", user.Id, err)
+		return []Session{}
+	}
+
+	policy := SessionPolicy{}
+	if len(user.ActiveOrg.Id) > 0 {
+		org, err := GetOrg(ctx, user.ActiveOrg.Id)
+		if err == nil {
+			policy = org.SessionPolicy
+		}
+	}
+
+	timeNow := time.Now().Unix()
+	activeSessions := []Session{}
+	for _, session := range sessions {
+		if session.Created == 0 || len(getSessionExpiry(session, user, policy, timeNow)) > 0 {
+			continue
+		}
+
+		activeSessions = append(activeSessions, session)
+	}
+
+	return activeSessions
+}
+
+// Lists where the user is logged in
+func HandleGetUserSessions(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in get sessions: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	targetUser, err := getSessionTargetUser(ctx, user, request)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	currentSession := getSessionToken(request)
+	sessions := []SessionInfo{}
+	for _, session := range getActiveSessions(ctx, *targetUser) {
+		sessions = append(sessions, SessionInfo{
+			Id:           getSessionId(session.Session),
+			Created:      session.Created,
+			LastActivity: session.LastActivity,
+			IP:           session.IP,
+			UserAgent:    session.UserAgent,
+			Current:      session.Session == currentSession,
+		})
+	}
+
+	newjson, err := json.Marshal(struct {
+		Success  bool          `json:"success"`
+		Sessions []SessionInfo `json:"sessions"`
+	}{
+		Success:  true,
+		Sessions: sessions,
+	})
+	if err != nil {
+		log.Printf("[WARNING] Failed marshalling sessions: %s", err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// Revokes one session, or all of them with the ID "all"
+func HandleRevokeUserSession(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in revoke session: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	location := strings.Split(strings.Split(request.URL.String(), "?")[0], "/")
+	if len(location) <= 5 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Session ID required"}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	targetUser, err := getSessionTargetUser(ctx, user, request)
+	if err != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	sessionId := location[5]
+	if sessionId == "all" {
+		revokeUserSessions(ctx, targetUser)
+		err = SetUser(ctx, targetUser, false)
+		if err != nil {
+			log.Printf("[ERROR] Failed saving user %s after revoking sessions: %s", targetUser.Id, err)
+			resp.WriteHeader(500)
+			resp.Write([]byte(`{"success": false}`))
+			return
+		}
+
+		log.Printf("[AUDIT] User %s (%s) revoked all sessions of user %s (%s)", user.Username, user.Id, targetUser.Username, targetUser.Id)
+		CreateAuditEvent(ctx, request, user, user.ActiveOrg.Id, "session.revoke", "user", targetUser.Id, nil, "all")
+		resp.WriteHeader(200)
+		resp.Write([]byte(`{"success": true}`))
+		return
+	}
+
+	sessions, err := GetUserSessions(ctx, targetUser.Id)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting sessions of user %s: %s", targetUser.Id, err)
+	}
+
+	for _, session := range sessions {
+		if getSessionId(session.Session) != sessionId {
+			continue
+		}
+
+		err = DeleteSession(ctx, session.Session)
+		if err != nil {
+			log.Printf("[ERROR] Failed revoking session of user %s: %s", targetUser.Id, err)
+			resp.WriteHeader(500)
+			resp.Write([]byte(`{"success": false}`))
+			return
+		}
+
+		if targetUser.Session == session.Session {
+			targetUser.Session = ""
+			err = SetUser(ctx, targetUser, false)
+			if err != nil {
+				log.Printf("[WARNING] Failed clearing session of user %s: %s", targetUser.Id, err)
+			}
+		}
+
+		log.Printf("[AUDIT] User %s (%s) revoked session %s of user %s (%s)", user.Username, user.Id, sessionId, targetUser.Username, targetUser.Id)
+		CreateAuditEvent(ctx, request, user, user.ActiveOrg.Id, "session.revoke", "user", targetUser.Id, nil, sessionId)
+		resp.WriteHeader(200)
+		resp.Write([]byte(`{"success": true}`))
+		return
+	}
+
+	resp.WriteHeader(404)
+	resp.Write([]byte(`{"success": false, "reason": "Session not found"}`))
+}
+
+func HandleSetSessionPolicy(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in set session policy: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if Authorize(user, "org:manage", "") != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "You don't have access to change the session policy"}`))
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		log.Printf("[WARNING] Failed reading body in set session policy: %s", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	var policy SessionPolicy
+	err = json.Unmarshal(body, &policy)
+	if err != nil {
+		log.Printf("[WARNING] Failed unmarshalling session policy: %s", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Failed parsing session policy"}`))
+		return
+	}
+
+	// Short timeouts would log out users faster than activity is tracked
+	if policy.AbsoluteTimeoutMinutes < 0 || policy.IdleTimeoutMinutes < 0 || (policy.IdleTimeoutMinutes > 0 && policy.IdleTimeoutMinutes < 5) {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Timeouts can't be negative, and the idle timeout has to be at least 5 minutes"}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	org, err := GetOrg(ctx, user.ActiveOrg.Id)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting org %s for session policy: %s", user.ActiveOrg.Id, err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	oldPolicy := org.SessionPolicy
+	org.SessionPolicy = policy
+	err = SetOrg(ctx, *org, org.Id)
+	if err != nil {
+		log.Printf("[ERROR] Failed saving session policy for org %s: %s", org.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	log.Printf("[AUDIT] User %s (%s) updated the session policy of org %s", user.Username, user.Id, org.Id)
+	CreateAuditEvent(ctx, request, user, org.Id, "org.session_policy_update", "org", org.Id, oldPolicy, policy)
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
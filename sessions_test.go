@@ -0,0 +1,75 @@
+package shuffle
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGetSessionExpiry(t *testing.T) {
+	now := time.Now().Unix()
+	policy := SessionPolicy{IdleTimeoutMinutes: 30, AbsoluteTimeoutMinutes: 600}
+	for _, testCase := range []struct {
+		session  Session
+		user     User
+		expected string
+	}{
+		{Session{Created: now - 60, LastActivity: now - 60}, User{}, ""},
+		{Session{Created: now - 3600, LastActivity: now - 3600}, User{}, "idle timeout"},
+		{Session{Created: now - 3600*11, LastActivity: now - 60}, User{}, "absolute timeout"},
+		{Session{Created: now - 3600}, User{}, "idle timeout"},
+		{Session{Created: now - 60, LastActivity: now - 60}, User{PasswordChanged: now - 30}, "password changed"},
+	} {
+		if reason := getSessionExpiry(testCase.session, testCase.user, policy, now); reason != testCase.expected {
+			t.Errorf("getSessionExpiry(%#v) = %#v; expected %#v", testCase.session, reason, testCase.expected)
+		}
+	}
+
+	if reason := getSessionExpiry(Session{Created: now - 3600*24*365}, User{}, SessionPolicy{}, now); len(reason) > 0 {
+		t.Errorf("Session expired without a policy: %s", reason)
+	}
+}
+
+func TestStampLegacySession(t *testing.T) {
+	request := httptest.NewRequest("GET", "/api/v1/getinfo", nil)
+	request.RemoteAddr = "10.0.0.42:1234"
+	request.Header.Set("User-Agent", "legacy-browser")
+
+	now := time.Now().Unix()
+	session := stampLegacySession(request, Session{UserId: "user", Session: "token"}, now)
+	if session.Created != now || session.LastActivity != now || session.UserAgent != "legacy-browser" || len(session.IP) == 0 {
+		t.Fatalf("Stamped legacy session = %#v", session)
+	}
+
+	// From its first use, the legacy session times out like any other
+	policy := SessionPolicy{IdleTimeoutMinutes: 30, AbsoluteTimeoutMinutes: 600}
+	if reason := getSessionExpiry(session, User{}, policy, now+60); len(reason) > 0 {
+		t.Errorf("Legacy session expired right after it was tracked: %s", reason)
+	}
+
+	if reason := getSessionExpiry(session, User{}, policy, now+3600); reason != "idle timeout" {
+		t.Errorf("Legacy session idle for an hour = %#v; expected idle timeout", reason)
+	}
+}
+
+func TestGetSessionTargetUser(t *testing.T) {
+	orgId := "session-target-org"
+	manager := User{Id: "session-manager", Username: "session-manager", Role: "admin", ActiveOrg: OrgMini{Id: orgId}, Orgs: []string{orgId}, ApiKeyId: "key", ApiKeyScopes: []string{"users:manage", "workflow:read"}}
+	admin := User{Id: "session-admin", Username: "session-admin", Role: "admin", ActiveOrg: OrgMini{Id: orgId}, Orgs: []string{orgId}}
+	setTestOrgCache(t, Org{Id: orgId, Name: "session-target", Users: []User{manager, admin}})
+
+	data, err := json.Marshal(admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	SetCache(ctx, "user_"+admin.Id, data, 10)
+
+	request := httptest.NewRequest("GET", "/api/v1/users/sessions?user_id="+admin.Id, nil)
+	if _, err := getSessionTargetUser(ctx, manager, request); err == nil {
+		t.Errorf("User with fewer permissions could manage the sessions of an admin")
+	}
+}
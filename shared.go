@@ -10,6 +10,7 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -55,6 +56,8 @@ import (
 	"golang.org/x/crypto/bcrypt"
 
 	"github.com/Masterminds/semver"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var project ShuffleStorage
@@ -66,7 +69,7 @@ func RequestMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
-		next.ServeHTTP(w, r)
+		observeHttpRequest(rateLimitHandler(next), w, r)
 	})
 }
 
@@ -920,7 +923,7 @@ func HandleGetOrg(resp http.ResponseWriter, request *http.Request) {
 	}
 
 	admin := false
-	if user.SupportAccess == true {
+	if !ArrayContains(user.Orgs, org.Id) && hasSupportAccess(request, &user, org.Id, "read", "org", org.Id) {
 		admin = true
 		sanitizeOrg = false
 
@@ -951,7 +954,7 @@ func HandleGetOrg(resp http.ResponseWriter, request *http.Request) {
 			if inneruser.Id == user.Id {
 				userFound = true
 
-				if inneruser.Role == "admin" {
+				if hasOrgPermission(inneruser, org.Id, "org:manage") {
 					admin = true
 				}
 
@@ -971,6 +974,7 @@ func HandleGetOrg(resp http.ResponseWriter, request *http.Request) {
 	if !admin {
 		org.Defaults = Defaults{}
 		org.SSOConfig = SSOConfig{}
+		org.SamlConfig = SamlConfig{}
 		org.Subscriptions = []PaymentSubscription{}
 		org.ManagerOrgs = []OrgMini{}
 		org.ChildOrgs = []OrgMini{}
@@ -1103,6 +1107,7 @@ func HandleGetOrg(resp http.ResponseWriter, request *http.Request) {
 	org.Users = []User{}
 	org.SyncConfig.Apikey = ""
 	org.SyncConfig.Source = ""
+	org.SamlConfig.SPPrivateKey = ""
 
 	// This is for sending branding information
 	// to those who need it
@@ -1121,7 +1126,7 @@ func HandleGetOrg(resp http.ResponseWriter, request *http.Request) {
 		org.LeadInfo.SubOrg = true
 	}
 
-	if !user.SupportAccess {
+	if !isSupportUser(user) {
 		org.LeadInfo = LeadInfo{}
 	}
 
@@ -1218,7 +1223,7 @@ func HandleGetSubOrgs(resp http.ResponseWriter, request *http.Request) {
 		if inneruser.Id == user.Id {
 			parentUser = true
 
-			if inneruser.Role == "admin" {
+			if hasOrgPermission(inneruser, parentOrg.Id, "org:manage") {
 				isParentAdmin = true
 			}
 
@@ -1226,14 +1231,15 @@ func HandleGetSubOrgs(resp http.ResponseWriter, request *http.Request) {
 		}
 	}
 
-	if !userFound && !parentUser && !user.SupportAccess {
+	supportAccess := !userFound && !parentUser && hasSupportAccess(request, &user, org.Id, "read", "org", org.Id)
+	if !userFound && !parentUser && !supportAccess {
 		log.Printf("[ERROR] User '%s' (%s) isn't a part of org %s (get)", user.Username, user.Id, orgId)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "User doesn't have access to org"}`))
 		return
 	}
 
-	isSupportOrAdmin := user.SupportAccess || isParentAdmin
+	isSupportOrAdmin := supportAccess || isParentAdmin
 
 	childorgs, err := GetAllChildOrgs(ctx, parentOrg.Id)
 	if err != nil || len(childorgs) == 0 {
@@ -1348,6 +1354,9 @@ func HandleLogout(resp http.ResponseWriter, request *http.Request) {
 	runReturn := false
 	userInfo, usererr := HandleApiAuthentication(resp, request)
 	log.Printf("[AUDIT] Logging out user %s (%s)", userInfo.Username, userInfo.Id)
+	if usererr == nil {
+		CreateAuditEvent(ctx, request, userInfo, userInfo.ActiveOrg.Id, "user.logout", "user", userInfo.Id, nil, nil)
+	}
 	if project.Environment == "cloud" {
 		// Checking if it's a special region. All user-specific requests should
 		// go through shuffler.io and not subdomains
@@ -1452,6 +1461,15 @@ func HandleLogout(resp http.ResponseWriter, request *http.Request) {
 	DeleteCache(ctx, fmt.Sprintf("session_%s", userInfo.Session))
 	DeleteCache(ctx, userInfo.Session)
 
+	// Sessions on other devices stay logged in
+	sessionToken := getSessionToken(request)
+	if len(sessionToken) > 0 {
+		err = DeleteSession(ctx, sessionToken)
+		if err != nil {
+			log.Printf("[WARNING] Failed deleting session of user %s in logout: %s", userInfo.Id, err)
+		}
+	}
+
 	//store user's last session so we can force sso when user's session change.
 	userInfo.UsersLastSession = userInfo.Session
 
@@ -1638,7 +1656,7 @@ func AddAppAuthentication(resp http.ResponseWriter, request *http.Request) {
 			}
 		}
 
-		if user.Id == "" || user.Role != "admin" {
+		if user.Id == "" || Authorize(user, "app-auth:manage", "") != nil {
 			log.Printf("[WARNING] Api authentication failed in add app auth: %s", userErr)
 			resp.WriteHeader(401)
 			resp.Write([]byte(`{"success": false}`))
@@ -1646,7 +1664,7 @@ func AddAppAuthentication(resp http.ResponseWriter, request *http.Request) {
 		}
 	}
 
-	if user.Role == "org-reader" {
+	if Authorize(user, "app-auth:use", "") != nil {
 		log.Printf("[WARNING] Org-reader doesn't have access to set new workflowapp: %s (%s)", user.Username, user.Id)
 		resp.WriteHeader(403)
 		resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
@@ -1699,7 +1717,7 @@ func AddAppAuthentication(resp http.ResponseWriter, request *http.Request) {
 				return
 			}
 
-			if user.Role != "admin" {
+			if Authorize(user, "app-auth:manage", "") != nil {
 				log.Printf("[AUDIT] User %s (%s) isn't admin during auth edit", user.Username, user.Id)
 				resp.WriteHeader(403)
 				resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": ":("}`)))
@@ -1890,7 +1908,7 @@ func AddAppAuthentication(resp http.ResponseWriter, request *http.Request) {
 			}
 
 			if user.Id != workflow.Owner || len(user.Id) == 0 {
-				if workflow.OrgId == user.ActiveOrg.Id && user.Role != "org-reader" {
+				if Authorize(user, "workflow:write", workflow.OrgId) == nil {
 					log.Printf("[AUDIT] User %s is accessing workflow '%s' as admin (set oauth2)", user.Username, workflow.ID)
 				} else if workflow.Public {
 					log.Printf("[AUDIT] Letting user %s access workflow %s FOR AUTH because it's public", user.Username, workflow.ID)
@@ -2138,7 +2156,15 @@ func AddAppAuthentication(resp http.ResponseWriter, request *http.Request) {
 		}
 	}
 
-	if appAuth.SuborgDistributed {
+	// Suborgs also see the auth when the org passes all of it down
+	if !appAuth.SuborgDistributed && len(org.Id) == 0 {
+		parentOrg, err := GetOrg(ctx, user.ActiveOrg.Id)
+		if err == nil {
+			org = parentOrg
+		}
+	}
+
+	if appAuth.SuborgDistributed || len(getInheritanceMode(org, "app_auth")) > 0 {
 		// Clear auth cache for all suborgs
 
 		//nameKey := "workflowappauth"
@@ -2157,6 +2183,7 @@ func AddAppAuthentication(resp http.ResponseWriter, request *http.Request) {
 	}
 
 	log.Printf("[INFO] Set new app auth for %s (%s) with ID %s", app.Name, app.ID, appAuth.Id)
+	CreateAuditEvent(ctx, request, user, user.ActiveOrg.Id, "app_auth.update", "app_auth", appAuth.Id, nil, map[string]interface{}{"app": app.Name, "label": appAuth.Label})
 	resp.WriteHeader(200)
 	resp.Write([]byte(fmt.Sprintf(`{"success": true, "id": "%s"}`, appAuth.Id)))
 }
@@ -2175,7 +2202,7 @@ func AddAppAuthenticationGroup(resp http.ResponseWriter, request *http.Request)
 		return
 	}
 
-	if user.Role != "admin" {
+	if Authorize(user, "app-auth:manage", "") != nil {
 		log.Printf("[WARNING] Need to be admin to add appauth group")
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false}`))
@@ -2325,7 +2352,7 @@ func DeleteAppAuthenticationGroup(resp http.ResponseWriter, request *http.Reques
 		return
 	}
 
-	if user.Role != "admin" {
+	if Authorize(user, "app-auth:manage", "") != nil {
 		log.Printf("[WARNING] Need to be admin to delete appauth")
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false}`))
@@ -2401,7 +2428,7 @@ func DeleteAppAuthentication(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Role != "admin" {
+	if Authorize(user, "app-auth:manage", "") != nil {
 		log.Printf("[WARNING] Need to be admin to delete appauth")
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false}`))
@@ -2457,6 +2484,8 @@ func DeleteAppAuthentication(resp http.ResponseWriter, request *http.Request) {
 	cacheKey = fmt.Sprintf("%s_%s", nameKey, fileId)
 	DeleteCache(ctx, cacheKey)
 
+	CreateAuditEvent(ctx, request, user, user.ActiveOrg.Id, "app_auth.delete", "app_auth", fileId, map[string]interface{}{"app": auth.App.Name, "label": auth.Label}, nil)
+
 	resp.WriteHeader(200)
 	resp.Write([]byte(`{"success": true}`))
 }
@@ -2475,7 +2504,7 @@ func HandleSetEnvironments(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Role != "admin" {
+	if Authorize(user, "org:manage", "") != nil {
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Can't set environment without being admin"}`))
 		return
@@ -2654,7 +2683,7 @@ func HandleRerunExecutions(resp http.ResponseWriter, request *http.Request) {
 		fileId = location[4]
 	}
 
-	if user.Role != "admin" {
+	if Authorize(user, "executions:manage", "") != nil {
 		log.Printf("[AUDIT] User isn't admin during stop executions")
 		resp.WriteHeader(409)
 		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Must be admin to perform this action"}`)))
@@ -2699,6 +2728,12 @@ func HandleRerunExecutions(resp http.ResponseWriter, request *http.Request) {
 		}
 	}
 
+	// Runs on every rerun interval, so triggers queued during maintenance windows are picked up after restarts
+	err = ReleaseMaintenanceQueue(ctx, user.ActiveOrg.Id)
+	if err != nil {
+		log.Printf("[WARNING] Failed releasing maintenance queue for org %s: %s", user.ActiveOrg.Id, err)
+	}
+
 	// 1: Loop all workflows
 	workflows, err := GetAllWorkflowsByQuery(ctx, user, 250, "")
 	if err != nil {
@@ -2764,7 +2799,7 @@ func HandleStopExecutions(resp http.ResponseWriter, request *http.Request) {
 		}
 	}
 
-	if user.Role != "admin" {
+	if Authorize(user, "executions:manage", "") != nil {
 		log.Printf("[AUDIT] User isn't admin during stop executions")
 		resp.WriteHeader(409)
 		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Must be admin to perform this action"}`)))
@@ -3384,6 +3419,10 @@ func HandleApiAuthentication(resp http.ResponseWriter, request *http.Request) (U
 			newApikey = newApikey[0:248]
 		}
 
+		if strings.HasPrefix(newApikey, userApiKeyPrefix) {
+			return authenticateUserApiKey(ctx, request, newApikey, org_id)
+		}
+
 		cache, err := GetCache(ctx, newApikey+org_id)
 		if err == nil {
 			cacheData := []byte(cache.([]uint8))
@@ -3420,7 +3459,17 @@ func HandleApiAuthentication(resp http.ResponseWriter, request *http.Request) (U
 			return User{}, errors.New("Couldn't find the user")
 		}
 
+		if userdata.ServiceAccount {
+			return User{}, errors.New("Service accounts have to use scoped API keys")
+		}
+
+		err = checkLegacyApiKeyExpiry(ctx, &userdata)
+		if err != nil {
+			return User{}, err
+		}
+
 		// Caching both bad and good apikeys :)
+		supportSwitch := false
 		if len(org_id) > 0 && userdata.ActiveOrg.Id != org_id {
 			found := false
 			for _, org := range userdata.Orgs {
@@ -3432,9 +3481,9 @@ func HandleApiAuthentication(resp http.ResponseWriter, request *http.Request) (U
 
 			if !found {
 				// VERY specific override to allow ONLY support users in Shuffle to see info for an org to help them out.
-				// FIXME: Should this be allowed for API as well? May just be session based (?)
-				if project.Environment == "cloud" && user.Verified == true && user.Active == true && user.SupportAccess == true && strings.HasSuffix(user.Username, "@shuffler.io") {
+				if hasSupportAccess(request, &userdata, org_id, getSupportRequestAccess(request), "org", org_id) {
 					found = true
+					supportSwitch = true
 				}
 			}
 
@@ -3460,9 +3509,14 @@ func HandleApiAuthentication(resp http.ResponseWriter, request *http.Request) (U
 			return User{}, err
 		}
 
-		err = SetCache(ctx, newApikey+org_id, b, 30)
-		if err != nil {
-			log.Printf("[WARNING] Failed setting cache for apikey: %s", err)
+		// Support access is checked on every request, as grants expire
+		if !supportSwitch {
+			err = SetCache(ctx, newApikey+org_id, b, 30)
+			if err != nil {
+				log.Printf("[WARNING] Failed setting cache for apikey: %s", err)
+			}
+
+			setRateLimitOrg(ctx, request, userdata.ActiveOrg.Id)
 		}
 
 		go IncrementCache(ctx, userdata.ActiveOrg.Id, "api_usage")
@@ -3503,7 +3557,7 @@ func HandleApiAuthentication(resp http.ResponseWriter, request *http.Request) (U
 			newCookie.HttpOnly = true
 		}
 
-		user, err := GetSessionNew(ctx, sessionToken)
+		user, err := getSessionUser(ctx, request, sessionToken)
 		if err != nil {
 			log.Printf("[WARNING] No valid session token for ID %s. Setting cookie to expire. May cause fallback problems.", sessionToken)
 
@@ -3567,6 +3621,14 @@ func HandleApiAuthentication(resp http.ResponseWriter, request *http.Request) (U
 			return User{}, errors.New(fmt.Sprintf("Couldn't find user"))
 		}
 
+		// Support users switched into an org with HandleChangeUserOrg
+		// keep it as their active org. Their grant has to still cover it.
+		if len(org_id) == 0 && len(user.ActiveOrg.Id) > 0 && !ArrayContains(user.Orgs, user.ActiveOrg.Id) && isSupportUser(user) {
+			if !hasSupportAccess(request, &user, user.ActiveOrg.Id, getSupportRequestAccess(request), "org", user.ActiveOrg.Id) {
+				return User{}, errors.New(fmt.Sprintf("Support access to org %s has expired", user.ActiveOrg.Id))
+			}
+		}
+
 		// This is to be able to overwrite access with available orgs
 		// Org needs to match one the user already has access to
 		if len(org_id) > 0 {
@@ -3580,7 +3642,7 @@ func HandleApiAuthentication(resp http.ResponseWriter, request *http.Request) (U
 
 			if !found {
 				// VERY specific override to allow ONLY support users in Shuffle to see info for an org to help them out
-				if project.Environment == "cloud" && user.Verified == true && user.Active == true && user.SupportAccess == true && strings.HasSuffix(user.Username, "@shuffler.io") {
+				if hasSupportAccess(request, &user, org_id, getSupportRequestAccess(request), "org", org_id) {
 					found = true
 				}
 			}
@@ -3870,7 +3932,7 @@ func HandleGetWorkflowRunCount(resp http.ResponseWriter, request *http.Request)
 		if workflow.OrgId == user.ActiveOrg.Id {
 			//log.Printf("[AUDIT] User %s is accessing workflow count for '%s' (%s) as %s (get count) in org %s", user.Username, workflow.Name, workflow.ID, user.Role, user.ActiveOrg.Id)
 
-		} else if project.Environment == "cloud" && user.Verified == true && user.Active == true && user.SupportAccess == true && strings.HasSuffix(user.Username, "@shuffler.io") {
+		} else if hasSupportAccess(request, &user, workflow.OrgId, "read", "workflow", workflow.ID) {
 			log.Printf("[AUDIT] Letting verified support admin %s access workflow run count for %s", user.Username, workflow.ID)
 
 		} else {
@@ -4004,7 +4066,7 @@ func GetWorkflowExecutions(resp http.ResponseWriter, request *http.Request) {
 	if user.Id != workflow.Owner || len(user.Id) == 0 {
 		if workflow.OrgId == user.ActiveOrg.Id {
 			log.Printf("[AUDIT] User %s is accessing workflow '%s' (%s) executions as %s (get executions)", user.Username, workflow.Name, workflow.ID, user.Role)
-		} else if project.Environment == "cloud" && user.Verified == true && user.Active == true && user.SupportAccess == true && strings.HasSuffix(user.Username, "@shuffler.io") {
+		} else if hasSupportAccess(request, &user, workflow.OrgId, "read", "workflow", workflow.ID) {
 			log.Printf("[AUDIT] Letting verified support admin %s access workflow execs for %s", user.Username, workflow.ID)
 		} else {
 			log.Printf("[AUDIT] Wrong user (%s) for workflow %s (get workflow execs)", user.Username, workflow.ID)
@@ -4014,6 +4076,13 @@ func GetWorkflowExecutions(resp http.ResponseWriter, request *http.Request) {
 		}
 	}
 
+	if checkApiKeyWorkflow(user, fileId) != nil {
+		log.Printf("[AUDIT] API key %s of user %s (%s) doesn't have access to workflow %s (get workflow execs)", user.ApiKeyId, user.Username, user.Id, fileId)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "API key doesn't have access to this workflow"}`))
+		return
+	}
+
 	// Query for the specifci workflowId
 	//q := datastore.NewQuery("workflowexecution").Filter("workflow_id =", fileId).Order("-started_at").Limit(30)
 	//q := datastore.NewQuery("workflowexecution").Filter("workflow_id =", fileId)
@@ -4153,7 +4222,7 @@ func GetWorkflowExecutionsV2(resp http.ResponseWriter, request *http.Request) {
 	if user.Id != workflow.Owner || len(user.Id) == 0 {
 		if workflow.OrgId == user.ActiveOrg.Id {
 			log.Printf("[AUDIT] User %s (%s) is accessing workflow '%s' (%s) executions as %s (get executions)", user.Username, user.Id, workflow.Name, workflow.ID, user.Role)
-		} else if project.Environment == "cloud" && user.Verified == true && user.Active == true && user.SupportAccess == true && strings.HasSuffix(user.Username, "@shuffler.io") {
+		} else if hasSupportAccess(request, &user, workflow.OrgId, "read", "workflow", workflow.ID) {
 			log.Printf("[AUDIT] Letting verified support admin %s access workflow execs for %s", user.Username, workflow.ID)
 			checkExecOrg = false
 		} else {
@@ -4165,6 +4234,13 @@ func GetWorkflowExecutionsV2(resp http.ResponseWriter, request *http.Request) {
 		}
 	}
 
+	if checkApiKeyWorkflow(user, fileId) != nil {
+		log.Printf("[AUDIT] API key %s of user %s (%s) doesn't have access to workflow %s (get workflow execs v2)", user.ApiKeyId, user.Username, user.Id, fileId)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "API key doesn't have access to this workflow"}`))
+		return
+	}
+
 	// Query for the specifci workflowId
 	maxAmount := 50
 	top, topOk := request.URL.Query()["top"]
@@ -4348,6 +4424,8 @@ func GetWorkflows(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	workflows = filterApiKeyWorkflows(user, workflows)
+
 	if len(workflows) == 0 {
 		log.Printf("[INFO] No workflows found for user %s (%s) in org %s (%s)", user.Username, user.Id, user.ActiveOrg.Name, user.ActiveOrg.Id)
 		resp.WriteHeader(200)
@@ -4539,7 +4617,7 @@ func SetAuthenticationConfig(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Role != "admin" {
+	if Authorize(user, "app-auth:manage", "") != nil {
 		log.Printf("[AUDIT] User isn't admin during auth edit config")
 		resp.WriteHeader(409)
 		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Must be admin to perform this action"}`)))
@@ -4857,6 +4935,7 @@ func HandleGetTriggers(resp http.ResponseWriter, request *http.Request) {
 						hook.Auth = auth
 						hook.Version = version
 						hook.CustomResponse = customBody
+						hook.Calendars = trigger.Calendars
 						allHooks = append(allHooks, hook)
 					} else {
 						hookValue := storedHook
@@ -4868,7 +4947,7 @@ func HandleGetTriggers(resp http.ResponseWriter, request *http.Request) {
 							}
 						}
 
-						allHooks = append(allHooks, hookValue)
+						allHooks = append(allHooks, redactHookSecret(hookValue))
 					}
 				}
 			case "SCHEDULE":
@@ -4906,6 +4985,7 @@ func HandleGetTriggers(resp http.ResponseWriter, request *http.Request) {
 						Wrapper := fmt.Sprintf(`{"start": "%s", "execution_source": "schedule", "execution_argument": "%s"}`, startNode, schedule.Argument)
 						schedule.WrappedArgument = Wrapper
 						schedule.Status = "stopped"
+						schedule.Calendars = trigger.Calendars
 
 						allSchedules = append(allSchedules, schedule)
 					} else {
@@ -4988,7 +5068,7 @@ func HandleGetSchedules(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Role != "admin" {
+	if Authorize(user, "triggers:manage", "") != nil {
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Admin required"}`))
 		return
@@ -5031,7 +5111,7 @@ func HandleGetHooks(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Role != "admin" {
+	if Authorize(user, "triggers:manage", "") != nil {
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Admin required"}`))
 		return
@@ -5046,6 +5126,10 @@ func HandleGetHooks(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	for hookIndex, hook := range hooks {
+		hooks[hookIndex] = redactHookSecret(hook)
+	}
+
 	newjson, err := json.Marshal(hooks)
 	if err != nil {
 		log.Printf("Failed unmarshal: %s", err)
@@ -5126,7 +5210,7 @@ func HandleUpdateUser(resp http.ResponseWriter, request *http.Request) {
 
 	// Should this role reflect the users' org access?
 	// When you change org -> change user role
-	if userInfo.Role != "admin" && userInfo.Id != t.UserId {
+	if Authorize(userInfo, "users:manage", "") != nil && userInfo.Id != t.UserId {
 		log.Printf("[WARNING] User %s tried to update user %s. Role: %s", userInfo.Username, t.UserId, userInfo.Role)
 		resp.WriteHeader(401)
 		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "You need to be admin to change other users"}`)))
@@ -5156,7 +5240,7 @@ func HandleUpdateUser(resp http.ResponseWriter, request *http.Request) {
 			isSelf = CheckCreatorSelfPermission(ctx, userInfo, *foundUser, &AlgoliaSearchCreator{ObjectID: foundUser.Id, IsOrg: true})
 		}
 
-		if (!isSelf || len(foundUser.Id) != 32) && !userInfo.SupportAccess {
+		if (!isSelf || len(foundUser.Id) != 32) && !hasSupportAccess(request, &userInfo, foundUser.ActiveOrg.Id, "write", "user", foundUser.Id) {
 			log.Printf("[AUDIT] User %s (%s) is admin, but can't edit users outside their own org (%s).", userInfo.Username, userInfo.Id, foundUser.Id)
 			resp.WriteHeader(400)
 			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "You don't have access to modify this user. Contact support@shuffler.io if you think this is wrong."}`)))
@@ -5164,11 +5248,27 @@ func HandleUpdateUser(resp http.ResponseWriter, request *http.Request) {
 		}
 	}
 
+	err = canManageUser(ctx, userInfo, *foundUser)
+	if err != nil {
+		resp.WriteHeader(403)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	if len(t.Role) > 0 {
+		err = canGrantRole(ctx, userInfo, t.Role)
+		if err != nil {
+			resp.WriteHeader(403)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+			return
+		}
+	}
+
 	orgUpdater := true
-	if len(t.Role) > 0 && (t.Role != "admin" && t.Role != "user" && t.Role != "org-reader") {
+	if len(t.Role) > 0 && !isValidOrgRole(ctx, t.Role, userInfo.ActiveOrg.Id) {
 		log.Printf("[WARNING] %s tried and failed to update user %s", userInfo.Username, t.UserId)
 		resp.WriteHeader(401)
-		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Can only change to roles user, admin and org-reader"}`)))
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Can only change to roles user, admin, org-reader or a role in your org"}`)))
 		return
 	} else {
 		// Same user - can't edit yourself?
@@ -5180,6 +5280,7 @@ func HandleUpdateUser(resp http.ResponseWriter, request *http.Request) {
 
 		if len(t.Role) > 0 {
 			log.Printf("[INFO] Updated user %s from %s to %s in org %s. If role is empty, not updating", foundUser.Username, foundUser.Role, t.Role, userInfo.ActiveOrg.Id)
+			CreateAuditEvent(ctx, request, userInfo, userInfo.ActiveOrg.Id, "user.role_update", "user", foundUser.Id, foundUser.Role, t.Role)
 			orgUpdater = false
 
 			// Realtime update if the user is in the same org
@@ -5518,6 +5619,7 @@ func GenerateApikey(ctx context.Context, userInfo User) (User, error) {
 	// Generate UUID
 	// Set uuid to apikey in backend (update)
 	userInfo.ApiKey = uuid.NewV4().String()
+	userInfo.ApiKeyCreated = time.Now().Unix()
 	err := SetApikey(ctx, userInfo)
 	if err != nil {
 		log.Printf("[WARNING] Failed updating apikey: %s", err)
@@ -5549,7 +5651,7 @@ func SetNewWorkflow(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Role == "org-reader" {
+	if Authorize(user, "workflow:write", "") != nil {
 		log.Printf("[WARNING] Org-reader doesn't have access to set new workflow: %s (%s)", user.Username, user.Id)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
@@ -6843,7 +6945,7 @@ func SaveWorkflow(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Role == "org-reader" {
+	if Authorize(user, "workflow:write", "") != nil {
 		log.Printf("[WARNING] Org-reader doesn't have access to save workflow (2): %s (%s)", user.Username, user.Id)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
@@ -6883,6 +6985,13 @@ func SaveWorkflow(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	if checkApiKeyWorkflow(user, tmpworkflow.ID) != nil {
+		log.Printf("[AUDIT] API key %s of user %s (%s) doesn't have access to workflow %s (save workflow)", user.ApiKeyId, user.Username, user.Id, tmpworkflow.ID)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "API key doesn't have access to this workflow"}`))
+		return
+	}
+
 	workflow := Workflow{}
 	body, err := ioutil.ReadAll(request.Body)
 	if err != nil {
@@ -6904,7 +7013,7 @@ func SaveWorkflow(resp http.ResponseWriter, request *http.Request) {
 	if project.Environment == "cloud" && tmpworkflow.Validated == false {
 		if workflow.Validated == true {
 
-			if !user.SupportAccess {
+			if !isSupportUser(user) {
 				workflow.Validated = false
 			} else {
 				//log.Printf("[INFO] User %s is validating workflow %s", user.Username, tmpworkflow.ID)
@@ -6926,6 +7035,13 @@ func SaveWorkflow(resp http.ResponseWriter, request *http.Request) {
 		}
 	*/
 
+	if len(tmpworkflow.ParentWorkflowId) > 0 && getOrgInheritanceMode(ctx, tmpworkflow.OrgId, "workflows") == "enforced" {
+		log.Printf("[AUDIT] User %s (%s) tried to change workflow %s enforced by the parent of org %s", user.Username, user.Id, tmpworkflow.ID, tmpworkflow.OrgId)
+		resp.WriteHeader(403)
+		resp.Write([]byte(`{"success": false, "reason": "Can't change a workflow enforced by your parent org"}`))
+		return
+	}
+
 	if len(workflow.InputQuestions) > 0 {
 		log.Printf("[DEBUG] Making ALL '%d' input questions required for workflow %s", len(workflow.InputQuestions), workflow.ID)
 	}
@@ -7155,13 +7271,13 @@ func SaveWorkflow(resp http.ResponseWriter, request *http.Request) {
 				resp.Write([]byte(fmt.Sprintf(`{"success": true, "new_id": "%s"}`, workflow.ID)))
 				return
 			}
-		} else if project.Environment == "cloud" && user.Verified == true && user.Active == true && user.SupportAccess == true && strings.HasSuffix(user.Username, "@shuffler.io") {
+		} else if hasSupportAccess(request, &user, tmpworkflow.OrgId, "write", "workflow", tmpworkflow.ID) {
 			// Re-added this as in most cases when our users or customers need help, it makes it
 			// so we can finalize the workflow for them
 			log.Printf("[AUDIT] Letting verified support admin %s access workflow %s (save workflow)", user.Username, workflow.ID)
 
 			workflow.ID = tmpworkflow.ID
-		} else if tmpworkflow.OrgId == user.ActiveOrg.Id && user.Role != "org-reader" {
+		} else if Authorize(user, "workflow:write", tmpworkflow.OrgId) == nil {
 			log.Printf("[AUDIT] User %s is accessing workflow %s (save workflow)", user.Username, tmpworkflow.ID)
 			workflow.ID = tmpworkflow.ID
 		} else {
@@ -7720,6 +7836,13 @@ func SaveWorkflow(resp http.ResponseWriter, request *http.Request) {
 			} else if schedule.Id == "" {
 				trigger.Status = "stopped"
 			}
+		} else if trigger.TriggerType == "EVENT" && trigger.Status != "uninitialized" {
+			subscription, err := GetEventSubscription(ctx, trigger.ID)
+			if err != nil {
+				trigger.Status = "stopped"
+			} else if subscription.WorkflowId != workflow.ID {
+				trigger.Status = "stopped"
+			}
 		} else if trigger.TriggerType == "SUBFLOW" {
 			for _, param := range trigger.Parameters {
 				if param.Name == "workflow" {
@@ -8638,6 +8761,9 @@ func SaveWorkflow(resp http.ResponseWriter, request *http.Request) {
 		}
 	}
 
+	resetWorkflowCollabSnapshot(ctx, workflow)
+	CreateAuditEvent(ctx, request, user, workflow.OrgId, "workflow.update", "workflow", workflow.ID, map[string]interface{}{"name": tmpworkflow.Name, "actions": len(tmpworkflow.Actions), "triggers": len(tmpworkflow.Triggers)}, map[string]interface{}{"name": workflow.Name, "actions": len(workflow.Actions), "triggers": len(workflow.Triggers)})
+
 	if org.Id == "" {
 		org, err = GetOrg(ctx, user.ActiveOrg.Id)
 		if err != nil {
@@ -8882,7 +9008,7 @@ func HandleApiGeneration(resp http.ResponseWriter, request *http.Request) {
 
 		log.Printf("[INFO] Handling post for APIKEY gen FROM user %s. Userchange: %s!", userInfo.Username, t.UserId)
 
-		if userInfo.Role != "admin" {
+		if Authorize(userInfo, "users:manage", "") != nil {
 			log.Printf("[AUDIT] %s tried and failed to change apikey for %s (2)", userInfo.Username, t.UserId)
 			resp.WriteHeader(401)
 			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "You need to be admin to change others' apikey"}`)))
@@ -8898,13 +9024,21 @@ func HandleApiGeneration(resp http.ResponseWriter, request *http.Request) {
 		}
 
 		// FIXME: May not be good due to different roles in different organizations.
-		if foundUser.Role == "admin" {
+		if hasOrgPermission(*foundUser, userInfo.ActiveOrg.Id, "org:manage") {
 			log.Printf("[AUDIT] %s tried and failed to change apikey for %s. Skipping because users' role is admin", userInfo.Username, t.UserId)
 			resp.WriteHeader(401)
 			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Can't change the apikey of another admin"}`)))
 			return
 		}
 
+		err = canManageUser(ctx, userInfo, *foundUser)
+		if err != nil {
+			log.Printf("[AUDIT] %s tried and failed to change apikey for %s: %s", userInfo.Username, t.UserId, err)
+			resp.WriteHeader(403)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+			return
+		}
+
 		newUserInfo, err := GenerateApikey(ctx, *foundUser)
 		if err != nil {
 			log.Printf("Failed to generate apikey for user %s: %s", foundUser.Username, err)
@@ -8994,7 +9128,7 @@ func HandleGetUsers(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Role != "admin" {
+	if Authorize(user, "users:manage", "") != nil {
 		log.Printf("[AUDIT] User isn't admin (%s) and can't list users.", user.Role)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Not admin"}`))
@@ -9030,6 +9164,7 @@ func HandleGetUsers(resp http.ResponseWriter, request *http.Request) {
 		}
 
 		item.Password = ""
+		item.PasswordHistory = []string{}
 		item.Session = ""
 		item.VerificationToken = ""
 		item.Orgs = []string{}
@@ -9043,7 +9178,7 @@ func HandleGetUsers(resp http.ResponseWriter, request *http.Request) {
 			Active: item.MFA.Active,
 		}
 
-		if !user.SupportAccess {
+		if !isSupportUser(user) {
 			item.LoginInfo = []LoginInfo{}
 		}
 
@@ -9179,7 +9314,7 @@ func HandlePasswordChange(resp http.ResponseWriter, request *http.Request) {
 		curUserFound = true
 	}
 
-	if userInfo.Role != "admin" {
+	if Authorize(userInfo, "users:manage", "") != nil {
 		if t.Newpassword != t.Newpassword2 {
 			err := "Passwords don't match"
 			resp.WriteHeader(401)
@@ -9200,14 +9335,6 @@ func HandlePasswordChange(resp http.ResponseWriter, request *http.Request) {
 	}
 
 	// Current password
-	err = CheckPasswordStrength(t.Newpassword)
-	if err != nil {
-		log.Printf("[INFO] Bad password strength: %s", err)
-		resp.WriteHeader(401)
-		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
-		return
-	}
-
 	ctx := GetContext(request)
 	foundUser := User{}
 	if !curUserFound {
@@ -9227,6 +9354,20 @@ func HandlePasswordChange(resp http.ResponseWriter, request *http.Request) {
 		}
 
 		foundUser = users[0]
+		if Authorize(userInfo, "users:manage", "") != nil {
+			log.Printf("[AUDIT] User %s (%s) tried to change the password of %s without access", userInfo.Username, userInfo.Id, foundUser.Username)
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false, "reason": "You need to be admin to change others' passwords"}`))
+			return
+		}
+
+		err = canManageUser(ctx, userInfo, foundUser)
+		if err != nil {
+			resp.WriteHeader(403)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+			return
+		}
+
 		orgFound := false
 		if userInfo.ActiveOrg.Id == foundUser.ActiveOrg.Id {
 			orgFound = true
@@ -9247,7 +9388,7 @@ func HandlePasswordChange(resp http.ResponseWriter, request *http.Request) {
 		}
 	} else {
 		// Admins can re-generate others' passwords as well.
-		if userInfo.Role != "admin" {
+		if Authorize(userInfo, "users:manage", "") != nil {
 			err = bcrypt.CompareHashAndPassword([]byte(userInfo.Password), []byte(t.Currentpassword))
 			if err != nil {
 				log.Printf("[WARNING] Bad password for %s: %s", userInfo.Username, err)
@@ -9268,15 +9409,17 @@ func HandlePasswordChange(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(t.Newpassword), 8)
+	// The policy of the user whose password is set, also when an admin sets it
+	err = SetUserPassword(ctx, &foundUser, t.Newpassword)
 	if err != nil {
-		log.Printf("New password failure for %s: %s", userInfo.Username, err)
+		log.Printf("[INFO] New password for %s was rejected: %s", foundUser.Username, err)
 		resp.WriteHeader(401)
-		resp.Write([]byte(`{"success": false, "reason": "Username and/or password is incorrect"}`))
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
 		return
 	}
 
-	foundUser.Password = string(hashedPassword)
+	revokeUserSessions(ctx, &foundUser)
+
 	err = SetUser(ctx, &foundUser, true)
 	if err != nil {
 		log.Printf("Error fixing password for user %s: %s", userInfo.Username, err)
@@ -9285,40 +9428,12 @@ func HandlePasswordChange(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	CreateAuditEvent(ctx, request, userInfo, userInfo.ActiveOrg.Id, "user.password_change", "user", foundUser.Id, nil, nil)
+
 	resp.WriteHeader(200)
 	resp.Write([]byte(fmt.Sprintf(`{"success": true}`)))
 }
 
-// Can check against HIBP etc?
-// Removed for localhost
-func CheckPasswordStrength(password string) error {
-	// Check password strength here
-	if len(password) < 4 {
-		return errors.New("Minimum password length is 4.")
-	}
-
-	//if len(password) > 128 {
-	//	return errors.New("Maximum password length is 128.")
-	//}
-
-	//re := regexp.MustCompile("[0-9]+")
-	//if len(re.FindAllString(password, -1)) == 0 {
-	//	return errors.New("Password must contain a number")
-	//}
-
-	//re = regexp.MustCompile("[a-z]+")
-	//if len(re.FindAllString(password, -1)) == 0 {
-	//	return errors.New("Password must contain a lower case char")
-	//}
-
-	//re = regexp.MustCompile("[A-Z]+")
-	//if len(re.FindAllString(password, -1)) == 0 {
-	//	return errors.New("Password must contain an upper case char")
-	//}
-
-	return nil
-}
-
 func SendHookResult(resp http.ResponseWriter, request *http.Request) {
 	cors := HandleCors(resp, request)
 	if cors {
@@ -9374,7 +9489,7 @@ func SendHookResult(resp http.ResponseWriter, request *http.Request) {
 	// FIXME - set the hook result in the DB somehow as interface{}
 	// FIXME - should the hook do the transform? Hmm
 
-	b, err := json.Marshal(hook)
+	b, err := json.Marshal(redactHookSecret(*hook))
 	if err != nil {
 		log.Printf("Failed marshalling: %s", err)
 		resp.WriteHeader(401)
@@ -9436,7 +9551,7 @@ func HandleGetHook(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	b, err := json.Marshal(hook)
+	b, err := json.Marshal(redactHookSecret(*hook))
 	if err != nil {
 		log.Printf("Failed marshalling: %s", err)
 		resp.WriteHeader(401)
@@ -9509,7 +9624,7 @@ func DuplicateWorkflow(resp http.ResponseWriter, request *http.Request) {
 			log.Printf("[AUDIT] Letting user %s access workflow %s because it's public (duplicate workflow)", user.Username, workflow.ID)
 
 			// Only for Read-Only. No executions or impersonations.
-		} else if project.Environment == "cloud" && user.Verified == true && user.Active == true && user.SupportAccess == true && strings.HasSuffix(user.Username, "@shuffler.io") {
+		} else if hasSupportAccess(request, &user, workflow.OrgId, "read", "workflow", workflow.ID) {
 			log.Printf("[AUDIT] Letting verified support admin %s access workflow %s (duplicate workflow)", user.Username, workflow.ID)
 
 			isOwner = true
@@ -9724,6 +9839,13 @@ func GetSpecificWorkflow(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	if len(user.ApiKeyId) > 0 && (Authorize(user, "workflow:read", "") != nil || checkApiKeyWorkflow(user, workflow.ID) != nil) {
+		log.Printf("[AUDIT] API key %s of user %s (%s) doesn't have access to workflow %s (get workflow)", user.ApiKeyId, user.Username, user.Id, workflow.ID)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "API key doesn't have access to this workflow"}`))
+		return
+	}
+
 	// Special case to handle suborg distribution workflow loading
 	if len(workflow.SuborgDistribution) > 0 {
 		for _, orgId := range workflow.SuborgDistribution {
@@ -9788,7 +9910,7 @@ func GetSpecificWorkflow(resp http.ResponseWriter, request *http.Request) {
 			log.Printf("[AUDIT] Letting user %s access workflow %s because it's public", user.Username, workflow.ID)
 
 			// Only for Read-Only. No executions or impersonations.
-		} else if project.Environment == "cloud" && user.Verified == true && user.Active == true && user.SupportAccess == true && strings.HasSuffix(user.Username, "@shuffler.io") {
+		} else if hasSupportAccess(request, &user, workflow.OrgId, "read", "workflow", workflow.ID) {
 			log.Printf("[AUDIT] Letting verified support admin %s access workflow %s", user.Username, workflow.ID)
 
 			isOwner = true
@@ -10064,7 +10186,7 @@ func DeleteUser(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if userInfo.Role != "admin" {
+	if Authorize(userInfo, "users:manage", "") != nil {
 		log.Printf("[DEBUG] Wrong user (%s) when deleting - must be admin", userInfo.Username)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Must be admin"}`))
@@ -10126,13 +10248,20 @@ func DeleteUser(resp http.ResponseWriter, request *http.Request) {
 	}
 
 	// FIXME: Add a way to check if the user is a part of the
-	if !orgFound && !userInfo.SupportAccess {
+	if !orgFound && !hasSupportAccess(request, &userInfo, foundUser.ActiveOrg.Id, "write", "user", foundUser.Id) {
 		log.Printf("[AUDIT] User %s (%s) is admin, but can't delete users outside their own org.", userInfo.Username, userInfo.Id)
 		resp.WriteHeader(401)
 		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Can't change users outside your org (1)."}`)))
 		return
 	}
 
+	err = canManageUser(ctx, userInfo, *foundUser)
+	if err != nil {
+		resp.WriteHeader(403)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
 	// NEW
 	neworgs := []string{}
 	for _, orgid := range foundUser.Orgs {
@@ -10163,10 +10292,9 @@ func DeleteUser(resp http.ResponseWriter, request *http.Request) {
 		if err != nil {
 			log.Printf("[ERROR] Failed getting org '%s' in delete user: %s", foundUser.ActiveOrg.Id, err)
 		} else {
-			if foundUserOrg.SSOConfig.SSORequired && !ArrayContains(foundUser.ValidatedSessionOrgs, foundUserOrg.Id) {
+			if getEffectiveOrg(ctx, foundUserOrg).SSOConfig.SSORequired && !ArrayContains(foundUser.ValidatedSessionOrgs, foundUserOrg.Id) {
 				log.Printf("[AUDIT] User %s (%s) does not have an active session in org with forced SSO %s, so forcing a re-login (aka logout).", foundUser.Username, foundUser.Id, foundUser.ActiveOrg.Id)
-				foundUser.Session = ""
-				foundUser.ValidatedSessionOrgs = []string{}
+				revokeUserSessions(ctx, foundUser)
 			}
 		}
 	}
@@ -10207,6 +10335,7 @@ func DeleteUser(resp http.ResponseWriter, request *http.Request) {
 	}
 
 	log.Printf("[AUDIT] User %s (%s) successfully removed %s from org %s", userInfo.Username, userInfo.Id, foundUser.Username, userInfo.ActiveOrg.Id)
+	CreateAuditEvent(ctx, request, userInfo, userInfo.ActiveOrg.Id, "user.remove", "user", foundUser.Id, map[string]interface{}{"username": foundUser.Username}, nil)
 
 	resp.WriteHeader(200)
 	resp.Write([]byte(`{"success": true}`))
@@ -10267,14 +10396,15 @@ func HandleDeleteUsersAccount(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if !userInfo.SupportAccess && userInfo.Id != foundUser.Id {
+	supportDelete := userInfo.Id != foundUser.Id && hasSupportAccess(request, &userInfo, foundUser.ActiveOrg.Id, "write", "user", foundUser.Id)
+	if !supportDelete && userInfo.Id != foundUser.Id {
 		log.Printf("Unauthorized user (%s) attempted to delete an account. Must be a user or have support access.", userInfo.Username)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Unauthorize User. Must be a regular user or have support access"}`))
 		return
 	}
 
-	if !userInfo.SupportAccess {
+	if !supportDelete {
 		var requestBody struct {
 			Password string `json:"password"`
 		}
@@ -10323,13 +10453,20 @@ func HandleDeleteUsersAccount(resp http.ResponseWriter, request *http.Request) {
 	}
 
 	// FIXME: Add a way to check if the user is a part of the
-	if !orgFound && !userInfo.SupportAccess {
+	if !orgFound && !supportDelete {
 		log.Printf("[AUDIT] User %s (%s) is admin, but can't delete users outside their own org.", userInfo.Username, userInfo.Id)
 		resp.WriteHeader(401)
 		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Can't change users outside your org (1)."}`)))
 		return
 	}
 
+	err = canManageUser(ctx, userInfo, *foundUser)
+	if err != nil {
+		resp.WriteHeader(403)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
 	if len(foundUser.Orgs) == 0 {
 		log.Printf("[INFO] User %s (%s) doesn't have an org anymore after being deleted. This will be generated when they log in next time", foundUser.Username, foundUser.Id)
 	}
@@ -10372,6 +10509,7 @@ func HandleDeleteUsersAccount(resp http.ResponseWriter, request *http.Request) {
 		}
 	}
 
+	erased := eraseUserData(ctx, foundUser)
 	err = DeleteUsersAccount(ctx, foundUser)
 	if err != nil {
 		log.Printf("[Error] Can't Delete User with User name: %v and Id: %v", foundUser.Username, foundUser.Id)
@@ -10381,9 +10519,13 @@ func HandleDeleteUsersAccount(resp http.ResponseWriter, request *http.Request) {
 	}
 
 	log.Printf("[AUDIT] User %s (%s) successfully deleted %s (%s)", userInfo.Username, userInfo.Id, foundUser.Username, foundUser.Id)
+	CreateAuditEvent(ctx, request, userInfo, userInfo.ActiveOrg.Id, "user.delete", "user", foundUser.Id, map[string]interface{}{"username": foundUser.Username}, nil)
+
+	erased = append(erased, getErasedCount("user", []string{foundUser.Id}, []string{}))
+	reportId := createDeletionReport(ctx, userInfo, userInfo.ActiveOrg.Id, "user", foundUser.Id, foundUser.Username, erased, []ResourceCount{getRetainedAuditEvents(ctx, org, foundUser.Id)})
 
 	resp.WriteHeader(200)
-	resp.Write([]byte(`{"success": true}`))
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "deletion_report_id": "%s"}`, reportId)))
 
 }
 
@@ -10413,7 +10555,7 @@ func UpdateWorkflowAppConfig(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Role == "org-reader" {
+	if Authorize(user, "apps:write", "") != nil {
 		log.Printf("[WARNING] Org-reader doesn't have access to edit apps")
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
@@ -10576,7 +10718,7 @@ func DeleteWorkflowApp(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Role == "org-reader" {
+	if Authorize(user, "apps:write", "") != nil {
 		log.Printf("[WARNING] Org-reader doesn't have access to delete apps: %s (%s)", user.Username, user.Id)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
@@ -10609,10 +10751,10 @@ func DeleteWorkflowApp(resp http.ResponseWriter, request *http.Request) {
 	}
 
 	if user.Id != app.Owner && app.ReferenceOrg != user.ActiveOrg.Id {
-		if user.Role == "admin" && app.Owner == "" {
+		if Authorize(user, "org:manage", "") == nil && app.Owner == "" {
 			log.Printf("[INFO] Anyone can edit %s (%s), since it doesn't have an owner (DELETE).", app.Name, app.ID)
 		} else {
-			if user.Role == "admin" {
+			if Authorize(user, "org:manage", "") == nil {
 				err = deactivateApp(ctx, user, app)
 				if err == nil {
 					log.Printf("[INFO] App %s was deactivated for org %s", app.ID, user.ActiveOrg.Id)
@@ -11014,9 +11156,11 @@ func HandleChangeUserOrg(resp http.ResponseWriter, request *http.Request) {
 	// Add instantswap of backend
 	// This could in theory be built out open source as well
 	regionUrl := ""
-	if project.Environment == "cloud" && user.SupportAccess {
+	supportSwitch := false
+	if !foundOrg && hasSupportAccess(request, &user, tmpData.OrgId, "read", "org", tmpData.OrgId) {
 		regionUrl = "https://shuffler.io"
 		foundOrg = true
+		supportSwitch = true
 	}
 
 	if !foundOrg || tmpData.OrgId != fileId {
@@ -11034,9 +11178,13 @@ func HandleChangeUserOrg(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if (org.SSOConfig.SSORequired == true && user.UsersLastSession != user.Session && user.SupportAccess == false) || tmpData.SSOTest {
+	if (getEffectiveOrg(ctx, org).SSOConfig.SSORequired == true && user.UsersLastSession != user.Session && !supportSwitch) || tmpData.SSOTest {
 
 		baseSSOUrl := org.SSOConfig.SSOEntrypoint
+		if len(org.SamlConfig.IdpEntityId) > 0 {
+			baseSSOUrl = GetSamlLoginUrl(*org)
+		}
+
 		redirectKey := "SSO_REDIRECT"
 		if len(org.SSOConfig.OpenIdAuthorization) > 0 {
 			log.Printf("[INFO] OpenID login for %s", org.Id)
@@ -11086,16 +11234,20 @@ func HandleChangeUserOrg(resp http.ResponseWriter, request *http.Request) {
 		}
 	}
 
-	if !userFound && !user.SupportAccess {
+	if !userFound && !supportSwitch {
 		log.Printf("[WARNING] User %s (%s) can't change to org %s (%s) (2)", user.Username, user.Id, org.Name, org.Id)
 		resp.WriteHeader(403)
 		resp.Write([]byte(`{"success": false, "reason": "No permission to change to this org (2). Please contact support@shuffler.io if this is unexpected."}`))
 		return
 	}
 
-	if user.SupportAccess {
-		usr.Role = "admin"
-		user.Role = "admin"
+	// Support users only get what their grant allows. Requests are
+	// checked against the grant again while they are in the org.
+	if supportSwitch && !userFound {
+		usr.Role = "org-reader"
+		if _, found := getSupportGrant(*org, user, "write", "org", org.Id); found {
+			usr.Role = "admin"
+		}
 	}
 
 	user.ActiveOrg = OrgMini{
@@ -11165,7 +11317,7 @@ func HandleCreateSubOrg(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Role != "admin" {
+	if Authorize(user, "org:manage", "") != nil {
 		log.Printf("[WARNING] Can't make suborg without being admin: %s (%s).", user.Username, user.Id)
 		resp.WriteHeader(403)
 		resp.Write([]byte(`{"success": false, "reason": "Not admin"}`))
@@ -11345,7 +11497,7 @@ func HandleCreateSubOrg(resp http.ResponseWriter, request *http.Request) {
 
 	// Update all admins to have access to this suborg
 	for _, loopUser := range parentOrg.Users {
-		if loopUser.Role != "admin" {
+		if !hasOrgPermission(loopUser, parentOrg.Id, "org:manage") {
 			continue
 		}
 
@@ -11543,7 +11695,7 @@ func HandleEditOrg(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Role != "admin" {
+	if Authorize(user, "org:manage", "") != nil {
 		log.Printf("[WARNING] Not admin: %s (%s).", user.Username, user.Id)
 		resp.WriteHeader(403)
 		resp.Write([]byte(`{"success": false, "reason": "Not admin"}`))
@@ -11601,9 +11753,10 @@ func HandleEditOrg(resp http.ResponseWriter, request *http.Request) {
 	}
 
 	admin := false
+	supportAccess := false
 	if tmpData.OrgId != user.ActiveOrg.Id || fileId != user.ActiveOrg.Id {
 		log.Printf("[WARNING] User can't edit org %s (active: %s)", fileId, user.ActiveOrg.Id)
-		if !user.SupportAccess {
+		if tmpData.OrgId != fileId || !hasSupportAccess(request, &user, fileId, "write", "org", fileId) {
 			resp.WriteHeader(401)
 			resp.Write([]byte(`{"success": false, "reason": "No permission to edit this org (2)"}`))
 			return
@@ -11611,6 +11764,7 @@ func HandleEditOrg(resp http.ResponseWriter, request *http.Request) {
 
 		log.Printf("[AUDIT] User %s (%s) is editing org %s (%s) with support access", user.Username, user.Id, fileId, user.ActiveOrg.Id)
 		admin = true
+		supportAccess = true
 	}
 
 	ctx := GetContext(request)
@@ -11626,7 +11780,7 @@ func HandleEditOrg(resp http.ResponseWriter, request *http.Request) {
 	for _, inneruser := range org.Users {
 		if inneruser.Id == user.Id {
 			userFound = true
-			if inneruser.Role == "admin" {
+			if hasOrgPermission(inneruser, org.Id, "org:manage") {
 				admin = true
 			}
 
@@ -11634,13 +11788,14 @@ func HandleEditOrg(resp http.ResponseWriter, request *http.Request) {
 		}
 	}
 
-	if user.SupportAccess {
+	if !userFound && (supportAccess || hasSupportAccess(request, &user, org.Id, "write", "org", org.Id)) {
 		log.Printf("[AUDIT] User %s (%s) is editing org %s (%s) with support access", user.Username, user.Id, fileId, user.ActiveOrg.Id)
 		userFound = true
 		admin = true
+		supportAccess = true
 	}
 
-	if !userFound && !user.SupportAccess {
+	if !userFound {
 		log.Printf("[WARNING] User %s doesn't exist in organization for edit %s", user.Id, org.Id)
 		resp.WriteHeader(400)
 		resp.Write([]byte(`{"success": false}`))
@@ -11654,6 +11809,27 @@ func HandleEditOrg(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	// Suborgs can't change what their parent enforces
+	inheritedChanges := map[string]bool{
+		"mfa_required":          tmpData.MFARequired != org.MFARequired,
+		"sso":                   tmpData.SSOConfig.SSOEntrypoint != org.SSOConfig.SSOEntrypoint || tmpData.SSOConfig.SSORequired != org.SSOConfig.SSORequired || tmpData.SSOConfig.OpenIdClientId != org.SSOConfig.OpenIdClientId || tmpData.SSOConfig.OpenIdAuthorization != org.SSOConfig.OpenIdAuthorization,
+		"notification_workflow": len(tmpData.Defaults.NotificationWorkflow) > 0 && tmpData.Defaults.NotificationWorkflow != org.Defaults.NotificationWorkflow,
+	}
+
+	for setting, changed := range inheritedChanges {
+		if !changed {
+			continue
+		}
+
+		err = checkInheritedSetting(ctx, org, setting)
+		if err != nil {
+			log.Printf("[WARNING] User %s (%s) can't change %s in org %s: %s", user.Username, user.Id, setting, org.Id, err)
+			resp.WriteHeader(403)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+			return
+		}
+	}
+
 	sendOrgUpdaterHook := false
 	if len(tmpData.Image) > 0 {
 		org.Image = tmpData.Image
@@ -11762,7 +11938,7 @@ func HandleEditOrg(resp http.ResponseWriter, request *http.Request) {
 		log.Printf("[WARNING] Notification Workflow ID %s is not valid.", org.Defaults.NotificationWorkflow)
 	}
 
-	if len(tmpData.LeadInfo) > 0 && user.SupportAccess {
+	if len(tmpData.LeadInfo) > 0 && isSupportUser(user) {
 		//log.Printf("[INFO] Updating lead info for %s to %s", org.Id, tmpData.LeadInfo)
 
 		// Make a new one, as to start with all from false
@@ -11836,6 +12012,7 @@ func HandleEditOrg(resp http.ResponseWriter, request *http.Request) {
 			tmpOrg.ActiveApps = []string{}
 			tmpOrg.SyncUsage = SyncUsage{}
 			tmpOrg.SSOConfig = SSOConfig{}
+			tmpOrg.SamlConfig = SamlConfig{}
 			tmpOrg.SecurityFramework = Categories{}
 
 			tmpOrg.Priorities = []Priority{}
@@ -11973,14 +12150,14 @@ func HandleEditOrg(resp http.ResponseWriter, request *http.Request) {
 		}
 	}
 
-	if project.Environment == "cloud" && user.SupportAccess && tmpData.SyncFeatures.Editing {
+	if project.Environment == "cloud" && isSupportUser(user) && tmpData.SyncFeatures.Editing {
 		log.Printf("[DEBUG] Updating features for org %s (%s)", org.Name, org.Id)
 
 		org.SyncFeatures = tmpData.SyncFeatures
 		org.SyncFeatures.Editing = false
 	}
 
-	if (len(tmpData.Billing.Consultation.Hours) > 0 || len(tmpData.Billing.Consultation.Minutes) > 0) && user.SupportAccess {
+	if (len(tmpData.Billing.Consultation.Hours) > 0 || len(tmpData.Billing.Consultation.Minutes) > 0) && isSupportUser(user) {
 		org.Billing.Consultation = tmpData.Billing.Consultation
 	}
 
@@ -12000,6 +12177,8 @@ func HandleEditOrg(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	CreateAuditEvent(ctx, request, user, org.Id, "org.update", "org", org.Id, nil, map[string]interface{}{"name": org.Name, "sso_required": org.SSOConfig.SSORequired, "mfa_required": org.MFARequired})
+
 	// Sends tracker for this on cloud
 	if sendOrgUpdaterHook && project.Environment == "cloud" {
 		signupWebhook := os.Getenv("WEBSITE_ORG_WEBHOOK")
@@ -12231,7 +12410,7 @@ func AbortExecution(resp http.ResponseWriter, request *http.Request) {
 		}
 
 		if user.Id != workflowExecution.Workflow.Owner {
-			if workflowExecution.Workflow.OrgId == user.ActiveOrg.Id && user.Role == "admin" {
+			if Authorize(user, "executions:manage", workflowExecution.Workflow.OrgId) == nil {
 				log.Printf("[AUDIT] User %s is aborting execution %s as admin", user.Username, workflowExecution.Workflow.ID)
 			} else {
 				log.Printf("[AUDIT] Wrong user (%s) for ABORT of workflowexecution workflow %s", user.Username, workflowExecution.Workflow.ID)
@@ -12240,6 +12419,13 @@ func AbortExecution(resp http.ResponseWriter, request *http.Request) {
 				return
 			}
 		}
+
+		if checkApiKeyWorkflow(user, workflowExecution.Workflow.ID) != nil {
+			log.Printf("[AUDIT] API key %s of user %s (%s) doesn't have access to workflow %s (abort)", user.ApiKeyId, user.Username, user.Id, workflowExecution.Workflow.ID)
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false, "reason": "API key doesn't have access to this workflow"}`))
+			return
+		}
 	} else {
 		//log.Printf("[INFO] API key to abort/finish execution %s is correct.", executionId)
 	}
@@ -12468,7 +12654,7 @@ func HandleNewHook(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Role == "org-reader" {
+	if Authorize(user, "triggers:write", "") != nil {
 		log.Printf("[WARNING] Org-reader doesn't have access to make new hook: %s (%s)", user.Username, user.Id)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
@@ -12476,17 +12662,21 @@ func HandleNewHook(resp http.ResponseWriter, request *http.Request) {
 	}
 
 	type requestData struct {
-		Type           string `json:"type"`
-		Description    string `json:"description"`
-		Id             string `json:"id"`
-		Name           string `json:"name"`
-		Workflow       string `json:"workflow"`
-		Start          string `json:"start"`
-		Environment    string `json:"environment"`
-		Auth           string `json:"auth"`
-		CustomResponse string `json:"custom_response"`
-		Version        string `json:"version" datastore:"version"`
-		VersionTimeout int    `json:"version_timeout" datastore:"version_timeout"`
+		Type           string        `json:"type"`
+		Description    string        `json:"description"`
+		Id             string        `json:"id"`
+		Name           string        `json:"name"`
+		Workflow       string        `json:"workflow"`
+		Start          string        `json:"start"`
+		Environment    string        `json:"environment"`
+		Auth           string        `json:"auth"`
+		CustomResponse string        `json:"custom_response"`
+		Version        string        `json:"version" datastore:"version"`
+		VersionTimeout int           `json:"version_timeout" datastore:"version_timeout"`
+		Calendars      []string      `json:"calendars"`
+		Signature      HookSignature `json:"signature"`
+		PayloadSchema  string        `json:"payload_schema"`
+		Transform      HookTransform `json:"transform"`
 	}
 
 	body, err := ioutil.ReadAll(request.Body)
@@ -12560,8 +12750,8 @@ func HandleNewHook(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if (!(user.SupportAccess || user.Id == originalHook.Owner) || len(user.Id) == 0) && originalHook.Id != "" {
-		if originalHook.OrgId != user.ActiveOrg.Id && originalHook.OrgId != "" {
+	if (user.Id != originalHook.Owner || len(user.Id) == 0) && originalHook.Id != "" {
+		if originalHook.OrgId != user.ActiveOrg.Id && originalHook.OrgId != "" && !hasSupportAccess(request, &user, originalHook.OrgId, "write", "hook", originalHook.Id) {
 			log.Printf("[WARNING] User %s doesn't have access to hook %s", user.Username, originalHook.Id)
 			resp.WriteHeader(401)
 			resp.Write([]byte(`{"success": false, "reason": "User doesn't have access to hook"}`))
@@ -12569,6 +12759,53 @@ func HandleNewHook(resp http.ResponseWriter, request *http.Request) {
 		}
 	}
 
+	requestdata.Signature.Scheme = strings.ToLower(strings.TrimSpace(requestdata.Signature.Scheme))
+	if !ArrayContains(validHookSignatureSchemes, requestdata.Signature.Scheme) {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Signature scheme must be one of: %s"}`, strings.Join(validHookSignatureSchemes[1:], ", "))))
+		return
+	}
+
+	err = validateHookSignatureConfig(requestdata.Signature)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	// Keep the existing secret if the frontend doesn't send it back. It is never returned by the API
+	requestdata.Signature.SecretEncrypted = false
+	if len(requestdata.Signature.Scheme) > 0 && len(requestdata.Signature.Secret) == 0 && originalHook.OrgId == user.ActiveOrg.Id {
+		requestdata.Signature.Secret = originalHook.Signature.Secret
+		requestdata.Signature.SecretEncrypted = originalHook.Signature.SecretEncrypted
+	}
+
+	if len(requestdata.Signature.Scheme) > 0 && len(requestdata.Signature.Secret) == 0 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "A secret is required for signature verification"}`))
+		return
+	}
+
+	if len(strings.TrimSpace(requestdata.PayloadSchema)) > 0 {
+		_, err = parseHookSchema(requestdata.PayloadSchema)
+		if err != nil {
+			log.Printf("[WARNING] Bad payload schema for webhook %s: %s", newId, err)
+			resp.WriteHeader(400)
+			resp.Write([]byte(`{"success": false, "reason": "Invalid payload schema. Must be a valid JSON Schema object"}`))
+			return
+		}
+	}
+
+	for mappingIndex, mapping := range requestdata.Transform.Mappings {
+		err = validateHookExpression(mapping.Source)
+		if err != nil {
+			log.Printf("[WARNING] Bad field mapping for webhook %s: %s", newId, err)
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Mapping %d has an invalid source. Must be a JMESPath expression"}`, mappingIndex)))
+			return
+		}
+	}
+
 	// Let remote endpoint handle access checks (shuffler.io)
 	baseUrl := "https://shuffler.io"
 	if len(os.Getenv("SHUFFLE_GCEPROJECT")) > 0 && len(os.Getenv("SHUFFLE_GCEPROJECT_LOCATION")) > 0 {
@@ -12638,6 +12875,10 @@ func HandleNewHook(resp http.ResponseWriter, request *http.Request) {
 		CustomResponse: requestdata.CustomResponse,
 		Version:        requestdata.Version,
 		VersionTimeout: requestdata.VersionTimeout,
+		Calendars:      requestdata.Calendars,
+		Signature:      requestdata.Signature,
+		PayloadSchema:  requestdata.PayloadSchema,
+		Transform:      requestdata.Transform,
 	}
 
 	hook.Status = "running"
@@ -12696,7 +12937,7 @@ func HandleDeleteHook(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Role == "org-reader" {
+	if Authorize(user, "triggers:write", "") != nil {
 		log.Printf("[WARNING] Org-reader doesn't have access to delete hook: %s (%s)", user.Username, user.Id)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
@@ -12744,7 +12985,7 @@ func HandleDeleteHook(resp http.ResponseWriter, request *http.Request) {
 	//}
 
 	if user.Id != hook.Owner || len(user.Id) == 0 {
-		if hook.OrgId == user.ActiveOrg.Id && user.Role == "admin" {
+		if Authorize(user, "triggers:manage", hook.OrgId) == nil {
 			log.Printf("[AUDIT] User %s is stopping hook for workflow %s as admin. Owner: %s", user.Username, hook.Workflows[0], hook.Owner)
 		} else {
 			log.Printf("[AUDIT] Wrong user (%s) for hook %s (stop hook)", user.Username, hook.Workflows[0])
@@ -12989,9 +13230,9 @@ func GetWorkflowAppConfig(resp http.ResponseWriter, request *http.Request) {
 		log.Printf("[DEBUG] Got app %s with user %s (%s) in org %s", app.ID, user.Username, user.Id, user.ActiveOrg.Id)
 
 	} else {
-		if project.Environment == "cloud" && user.Verified == true && user.Active == true && user.SupportAccess == true && strings.HasSuffix(user.Username, "@shuffler.io") {
+		if hasSupportAccess(request, &user, app.ReferenceOrg, "read", "app", app.ID) {
 			log.Printf("[AUDIT] Support & Admin user %s (%s) got access to app %s (cloud only)", user.Username, user.Id, app.ID)
-		} else if user.Role == "admin" && app.Owner == "" {
+		} else if Authorize(user, "org:manage", "") == nil && app.Owner == "" {
 			log.Printf("[AUDIT] Any admin can GET %s (%s), since it doesn't have an owner (GET).", app.Name, app.ID)
 		} else {
 			exit := true
@@ -13135,72 +13376,100 @@ func GetOpenIdUrl(request *http.Request, org Org) string {
 	return baseSSOUrl
 }
 
+// Returns the client IP of a request. Forwarding headers can be set by the client,
+// so they are only used when the direct peer is a trusted proxy (SHUFFLE_TRUSTED_PROXIES).
+// Then the right-most X-Forwarded-For hop that isn't a trusted proxy is the client.
 func GetRequestIp(r *http.Request) string {
-	// Check the actual IP that is inbound
-	forwardedFor := r.Header.Get("X-Forwarded-For")
-	if forwardedFor != "" {
-		// The X-Forwarded-For header can contain a comma-separated list of IP addresses.
-		// The client's IP is usually the first one.
-		stringSplit := strings.Split(forwardedFor, ",")
-		if len(stringSplit) > 1 {
-			log.Printf("[DEBUG] Found multiple IPs in X-Forwarded-For header: %s", forwardedFor)
-			return stringSplit[0]
-		} else {
-			return forwardedFor
-		}
+	peerIp := getAddressIp(r.RemoteAddr)
+	if len(peerIp) == 0 {
+		return r.RemoteAddr
 	}
 
-	// Check for the X-Real-IP header
-	realIP := r.Header.Get("X-Real-IP")
-	if realIP != "" {
-		if strings.Count(realIP, ":") == 1 {
-			return strings.Split(realIP, ":")[0]
-		}
+	trustedProxies := getTrustedProxies()
+	if !isTrustedProxy(peerIp, trustedProxies) {
+		return peerIp
+	}
 
-		return realIP
+	forwardedHops := []string{}
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		forwardedHops = append(forwardedHops, strings.Split(header, ",")...)
 	}
 
-	realIP = r.Header.Get("CF-Connecting-IP")
-	if realIP != "" {
-		if strings.Count(realIP, ":") == 1 {
-			return strings.Split(realIP, ":")[0]
+	for hopIndex := len(forwardedHops) - 1; hopIndex >= 0; hopIndex-- {
+		hop := getAddressIp(strings.TrimSpace(forwardedHops[hopIndex]))
+		if len(hop) > 0 && !isTrustedProxy(hop, trustedProxies) {
+			return hop
 		}
-
-		return realIP
 	}
 
-	realIP = r.Header.Get("X-Appengine-User-Ip")
-	if realIP != "" {
-		if strings.Count(realIP, ":") == 1 {
-			return strings.Split(realIP, ":")[0]
+	// Single value headers set by the proxy itself
+	for _, header := range []string{"X-Real-IP", "CF-Connecting-IP", "X-Appengine-User-Ip"} {
+		realIp := getAddressIp(strings.TrimSpace(r.Header.Get(header)))
+		if len(realIp) > 0 {
+			return realIp
 		}
+	}
 
-		return realIP
+	return peerIp
+}
+
+// "10.0.0.1:1234", "[::1]:1234" or a bare IP -> the IP. Empty if it isn't an IP
+func getAddressIp(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = strings.Trim(address, "[]")
 	}
 
-	// Loop through and find headers with "IP" in them
-	for k, v := range r.Header {
-		if strings.Contains(strings.ToLower(k), "ip") {
-			log.Printf("[ERROR] Found useful unhandled IP header %s: %s", k, v)
-		}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
 	}
 
-	// IPv6 / localhostm apping. Just returning raw.
-	if strings.Contains(r.RemoteAddr, "::") || strings.Contains(r.RemoteAddr, "127.0.0.1") || strings.Contains(r.RemoteAddr, "localhost") {
-		return r.RemoteAddr
+	return ip.String()
+}
+
+// Comma separated IPs or CIDRs of the proxies in front of Shuffle
+func getTrustedProxies() []*net.IPNet {
+	trustedProxies := []*net.IPNet{}
+	for _, proxy := range strings.Split(os.Getenv("SHUFFLE_TRUSTED_PROXIES"), ",") {
+		proxy = strings.TrimSpace(proxy)
+		if len(proxy) == 0 {
+			continue
+		}
+
+		if !strings.Contains(proxy, "/") {
+			if strings.Contains(proxy, ":") {
+				proxy += "/128"
+			} else {
+				proxy += "/32"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			log.Printf("[WARNING] Invalid trusted proxy '%s' in SHUFFLE_TRUSTED_PROXIES: %s", proxy, err)
+			continue
+		}
+
+		trustedProxies = append(trustedProxies, network)
 	}
 
-	// If neither header is present, fall back to using the RemoteAddr field.
-	// Check for IPv6 and split accordingly.
-	re := regexp.MustCompile(`\[[^\]]+\]`)
-	remoteAddr := re.ReplaceAllString(r.RemoteAddr, "")
-	if remoteAddr != "" {
-		return remoteAddr
+	return trustedProxies
+}
+
+func isTrustedProxy(ip string, trustedProxies []*net.IPNet) bool {
+	parsedIp := net.ParseIP(ip)
+	if parsedIp == nil {
+		return false
 	}
 
-	remoteAddrSplit := strings.Split(r.RemoteAddr, ":")
-	return remoteAddrSplit[0]
+	for _, network := range trustedProxies {
+		if network.Contains(parsedIp) {
+			return true
+		}
+	}
 
+	return false
 }
 
 func HandleLogin(resp http.ResponseWriter, request *http.Request) {
@@ -13247,11 +13516,18 @@ func HandleLogin(resp http.ResponseWriter, request *http.Request) {
 	}
 
 	ctx := GetContext(request)
+	retryAfter, captchaRequired := checkLoginThrottle(ctx, request, data.Username)
+	if retryAfter > 0 {
+		log.Printf("[AUDIT] Login for %s from IP %s throttled for %d seconds after failed attempts", data.Username, GetRequestIp(request), retryAfter)
+		writeLoginThrottled(resp, retryAfter, captchaRequired)
+		return
+	}
+
 	users, err := FindUser(ctx, data.Username)
 	if err != nil && len(users) == 0 {
 		log.Printf("[WARNING] Failed getting user %s during login", data.Username)
-		resp.WriteHeader(401)
-		resp.Write([]byte(`{"success": false, "reason": "Username and/or password is incorrect"}`))
+		_, captchaRequired = registerLoginFailure(ctx, request, data.Username)
+		writeLoginFailed(resp, captchaRequired)
 		return
 	}
 
@@ -13272,6 +13548,11 @@ func HandleLogin(resp http.ResponseWriter, request *http.Request) {
 					continue
 				}
 
+				if user.LockedUntil > time.Now().Unix() {
+					log.Printf("[AUDIT] Login for %s (%s) blocked. User is locked after too many failed attempts", user.Username, user.Id)
+					continue
+				}
+
 				userdata = user
 				break
 			}
@@ -13280,6 +13561,14 @@ func HandleLogin(resp http.ResponseWriter, request *http.Request) {
 		userdata = users[0]
 	}
 
+	// Service accounts only authenticate with their API keys
+	if userdata.ServiceAccount {
+		log.Printf("[AUDIT] Blocked interactive login for service account %s (%s)", userdata.Username, userdata.Id)
+		_, captchaRequired = registerLoginFailure(ctx, request, data.Username)
+		writeLoginFailed(resp, captchaRequired)
+		return
+	}
+
 	// Starting caching of the username
 	// This is to make it faster later :)
 	go GetAllWorkflowsByQuery(context.Background(), userdata, 250, "")
@@ -13337,7 +13626,7 @@ func HandleLogin(resp http.ResponseWriter, request *http.Request) {
 
 	if orgerr == nil {
 		//log.Printf("Got org during signin: %s - checking SAML SSO", baseOrg.Id)
-		ssoRequired := org.SSOConfig.SSORequired
+		ssoRequired := getEffectiveOrg(ctx, org).SSOConfig.SSORequired
 		if ssoRequired {
 			orgFound := false
 			for _, orgString := range userdata.Orgs {
@@ -13347,7 +13636,7 @@ func HandleLogin(resp http.ResponseWriter, request *http.Request) {
 					continue
 				}
 
-				if innerorg.SSOConfig.SSORequired {
+				if getEffectiveOrg(ctx, innerorg).SSOConfig.SSORequired {
 					continue
 				}
 
@@ -13364,6 +13653,10 @@ func HandleLogin(resp http.ResponseWriter, request *http.Request) {
 				log.Printf("[INFO] Inside SSO / OpenID check: %s", org.Id)
 				// has to contain http(s)
 				baseSSOUrl := org.SSOConfig.SSOEntrypoint
+				if len(org.SamlConfig.IdpEntityId) > 0 {
+					baseSSOUrl = GetSamlLoginUrl(*org)
+				}
+
 				redirectKey := "SSO_REDIRECT"
 				if len(org.SSOConfig.OpenIdAuthorization) > 0 {
 					log.Printf("[INFO] OpenID login for %s", org.Id)
@@ -13405,20 +13698,35 @@ func HandleLogin(resp http.ResponseWriter, request *http.Request) {
 		}
 	}
 
+	passwordPolicy := getPasswordPolicy(getEffectiveOrg(ctx, org))
 	if len(users) == 1 && len(data.Password) > 0 {
 		err = bcrypt.CompareHashAndPassword([]byte(userdata.Password), []byte(data.Password))
 		if err != nil {
 			userdata = User{}
 			log.Printf("[WARNING] Bad password: %s", err)
+		} else if userdata.LockedUntil > time.Now().Unix() {
+			// Answered like a bad password so locks don't reveal that the account exists
+			log.Printf("[AUDIT] Login for %s (%s) blocked. User is locked after too many failed attempts", userdata.Username, userdata.Id)
+			userdata = User{}
 		} else {
 			log.Printf("[DEBUG] Correct password with single user!")
+
+			if userdata.LockedUntil > 0 {
+				userdata.LockedUntil = 0
+				updateUser = true
+			}
 		}
 	}
 
 	if userdata.Id == "" && userdata.Username == "" {
 		log.Printf(`[AUDIT] Login for Username %s isn't valid with that password. Amount of users checked: %d (2)`, data.Username, len(users))
-		resp.WriteHeader(401)
-		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Username and/or password is incorrect"}`)))
+		failures, captchaRequired := registerLoginFailure(ctx, request, data.Username)
+		if len(users) == 1 {
+			lockUserAfterLoginFailures(ctx, request, users[0], passwordPolicy, failures)
+			CreateAuditEvent(ctx, request, users[0], users[0].ActiveOrg.Id, "user.login_failed", "user", users[0].Id, nil, nil)
+		}
+
+		writeLoginFailed(resp, captchaRequired)
 		return
 	}
 
@@ -13443,7 +13751,22 @@ func HandleLogin(resp http.ResponseWriter, request *http.Request) {
 		log.Printf(`[WARNING] Username %s (%s) has login type set to OpenID (single sign-on).`, userdata.Username, userdata.Id)
 	}
 
-	if len(data.MFACode) == 0 {
+	// WebAuthn and recovery codes can be used instead of the HOTP code
+	mfaVerified := false
+	if len(data.WebAuthn) > 0 || len(data.RecoveryCode) > 0 {
+		err = verifyLoginSecondFactor(ctx, request, &userdata, data)
+		if err != nil {
+			log.Printf("[AUDIT] Failed second factor for %s (%s): %s", userdata.Username, userdata.Id, err)
+			captchaRequired = registerSecondFactorFailure(ctx, request, userdata, passwordPolicy)
+			resp.WriteHeader(401)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Failed verifying your 2-factor authentication. Please try again.", "captcha_required": %t}`, captchaRequired)))
+			return
+		}
+
+		mfaVerified = true
+	}
+
+	if len(data.MFACode) == 0 && !mfaVerified {
 		for _, orgID := range userdata.Orgs {
 			org, err := GetOrg(ctx, orgID)
 			if err != nil {
@@ -13451,8 +13774,8 @@ func HandleLogin(resp http.ResponseWriter, request *http.Request) {
 				continue
 			}
 
-			if org.MFARequired {
-				if org.MFARequired && !userdata.MFA.Active {
+			if getEffectiveOrg(ctx, org).MFARequired {
+				if !hasSecondFactor(userdata) {
 					log.Printf("MFA is required for org %s and user has not set up MFA.", orgID)
 
 					// Generate a unique code
@@ -13477,17 +13800,16 @@ func HandleLogin(resp http.ResponseWriter, request *http.Request) {
 					return
 				}
 				log.Printf("MFA is required for org %s. Redirecting.", orgID)
-				resp.WriteHeader(409)
-				resp.Write([]byte(fmt.Sprintf(`{"success": true, "reason": "MFA_REDIRECT"}`)))
+				writeMfaRedirect(ctx, resp, request, userdata)
 				return
 			}
 		}
 	}
 
-	if userdata.MFA.Active && len(data.MFACode) == 0 {
+	// A HOTP code only counts if HOTP is what the user has set up
+	if hasSecondFactor(userdata) && !mfaVerified && (len(data.MFACode) == 0 || !userdata.MFA.Active) {
 		log.Printf(`[DEBUG] Username %s (%s) has MFA activated. Redirecting.`, userdata.Username, userdata.Id)
-		resp.WriteHeader(409)
-		resp.Write([]byte(fmt.Sprintf(`{"success": true, "reason": "MFA_REDIRECT"}`)))
+		writeMfaRedirect(ctx, resp, request, userdata)
 		return
 	}
 
@@ -13502,15 +13824,38 @@ func HandleLogin(resp http.ResponseWriter, request *http.Request) {
 		}
 
 		if HOTP != data.MFACode {
-			log.Printf("[DEBUG] Bad code sent for user %s (%s). Sent: %s, Want: %s", userdata.Username, userdata.Id, data.MFACode, HOTP)
-			resp.WriteHeader(500)
-			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Wrong 2-factor code (%s). Please try again with a 6-digit code. If this persists, please contact support."}`, data.MFACode)))
+			log.Printf("[AUDIT] Bad 2-factor code sent for user %s (%s)", userdata.Username, userdata.Id)
+			captchaRequired = registerSecondFactorFailure(ctx, request, userdata, passwordPolicy)
+			resp.WriteHeader(401)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Wrong 2-factor code. Please try again with a 6-digit code. If this persists, please contact support.", "captcha_required": %t}`, captchaRequired)))
 			return
 		}
 
 		log.Printf("[DEBUG] MFA login for user %s (%s)!", userdata.Username, userdata.Id)
 	}
 
+	// Only cleared once every factor has been checked
+	clearLoginFailures(ctx, request, data.Username)
+
+	// Expired passwords have to be changed through the reset flow before logging in
+	if userdata.LoginType != "SSO" && userdata.LoginType != "OpenID" && isPasswordExpired(userdata, passwordPolicy) {
+		log.Printf("[AUDIT] Password of %s (%s) is older than %d days. Requiring a reset", userdata.Username, userdata.Id, passwordPolicy.MaxAgeDays)
+
+		userdata.ResetReference = uuid.NewV4().String()
+		userdata.ResetTimeout = time.Now().Unix() + 900
+		err = SetUser(ctx, &userdata, false)
+		if err != nil {
+			log.Printf("[WARNING] Failed setting reset reference for expired password of %s: %s", userdata.Username, err)
+			resp.WriteHeader(500)
+			resp.Write([]byte(`{"success": false, "reason": "Your password has expired. Please reset it."}`))
+			return
+		}
+
+		resp.WriteHeader(409)
+		resp.Write([]byte(fmt.Sprintf(`{"success": true, "reason": "PASSWORD_EXPIRED", "reference": "%s"}`, userdata.ResetReference)))
+		return
+	}
+
 	//tutorialsFinished := userdata.PersonalInfo.Tutorials
 	//if len(org.SecurityFramework.SIEM.Name) > 0 || len(org.SecurityFramework.Network.Name) > 0 || len(org.SecurityFramework.EDR.Name) > 0 || len(org.SecurityFramework.Cases.Name) > 0 || len(org.SecurityFramework.IAM.Name) > 0 || len(org.SecurityFramework.Assets.Name) > 0 || len(org.SecurityFramework.Intel.Name) > 0 || len(org.SecurityFramework.Communication.Name) > 0 {
 	//	tutorialsFinished = append(tutorialsFinished, "find_integrations")
@@ -13554,6 +13899,8 @@ func HandleLogin(resp http.ResponseWriter, request *http.Request) {
 		Tutorials: tutorialsFinished,
 	}
 
+	CreateAuditEvent(ctx, request, userdata, userdata.ActiveOrg.Id, "user.login", "user", userdata.Id, nil, nil)
+
 	loginData := `{"success": true}`
 	newData, err := json.Marshal(returnValue)
 	if err == nil {
@@ -13720,6 +14067,9 @@ func HandleLogin(resp http.ResponseWriter, request *http.Request) {
 		}
 	}
 
+	// Every password login gets its own session so it can be listed and revoked separately
+	userdata.Session = ""
+
 	if len(userdata.Session) != 0 {
 		log.Printf("[INFO] User session exists - resetting session")
 		expiration := time.Now().Add(3600 * time.Second)
@@ -13973,6 +14323,10 @@ func HandleSSOLogin(resp http.ResponseWriter, request *http.Request) {
 		}
 
 		baseSSOUrl := org.SSOConfig.SSOEntrypoint
+		if len(org.SamlConfig.IdpEntityId) > 0 {
+			baseSSOUrl = GetSamlLoginUrl(*org)
+		}
+
 		redirectKey := "SSO_REDIRECT"
 		if len(org.SSOConfig.OpenIdAuthorization) > 0 {
 			redirectKey = "SSO_REDIRECT"
@@ -14050,6 +14404,12 @@ func CheckUsername(Username string) error {
 // Let's do it anyway, since it seems like the best way to scale
 // without remoting problems and the like.
 func updateExecutionParent(ctx context.Context, executionParent, returnValue, parentAuth, parentNode, subflowExecutionId string) error {
+	ctx, span := startChildSpan(ctx, "updateExecutionParent", "",
+		attribute.String("shuffle.execution_id", subflowExecutionId),
+		attribute.String("shuffle.parent_execution_id", executionParent),
+		attribute.String("shuffle.parent_node", parentNode),
+	)
+	defer span.End()
 
 	// Was an error here. Now defined to run with http://shuffle-backend:5001 by default
 	backendUrl := os.Getenv("BASE_URL")
@@ -14111,6 +14471,7 @@ func updateExecutionParent(ctx context.Context, executionParent, returnValue, pa
 		bytes.NewBuffer([]byte(data)),
 	)
 
+	injectTraceHeaders(ctx, req)
 	newresp, err := topClient.Do(req)
 	if err != nil {
 		log.Printf("[ERROR] Failed making parent request: %s. Is URL valid: %s", err, backendUrl)
@@ -14801,10 +15162,11 @@ func RunExecutionTranslation(ctx context.Context, actionResult ActionResult) {
 // Updateparam is a check to see if the execution should be continuously validated
 func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecution, actionResult ActionResult, updateParam bool, retries int64) (*WorkflowExecution, bool, error) {
 	var err error
+	logger := NewExecutionLogger(ctx, workflowExecution)
 	if actionResult.Action.ID == "" && actionResult.Action.Name == "" {
 		// Can we find it based on label?
 
-		log.Printf("\n\n[ERROR][%s] Failed handling EMPTY action %#v (ParsedExecutionResult). Usually ONLY happens during worker run that sets everything?\n\n", workflowExecution.ExecutionId, actionResult)
+		logger.Printf("[ERROR] Failed handling EMPTY action %#v (ParsedExecutionResult). Usually ONLY happens during worker run that sets everything?", actionResult)
 
 		return &workflowExecution, true, nil
 	}
@@ -14816,6 +15178,15 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 
 	actionResult = FixActionResultOutput(actionResult)
 	actionCacheId := fmt.Sprintf("%s_%s_result", actionResult.ExecutionId, actionResult.Action.ID)
+
+	ctx, span := startChildSpan(ctx, "ParsedExecutionResult", workflowExecution.TraceParent,
+		attribute.String("shuffle.execution_id", workflowExecution.ExecutionId),
+		attribute.String("shuffle.action_id", actionResult.Action.ID),
+		attribute.String("shuffle.status", actionResult.Status),
+	)
+	defer span.End()
+	recordActionSpan(ctx, workflowExecution, actionResult)
+	observeActionResult(actionResult)
 	// Done elsewhere
 
 	// Don't set cache for triggers?
@@ -14840,10 +15211,10 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 				var subflowData SubflowMapping
 				err := json.Unmarshal([]byte(actionResult.Result), &subflowData)
 				if err == nil && subflowData.Success == false {
-					log.Printf("[INFO][%s] Userinput subflow failed. Should abort workflow or continue execution by default?", actionResult.ExecutionId)
+					logger.Printf("[INFO] Userinput subflow failed. Should abort workflow or continue execution by default?")
 
 				} else {
-					log.Printf("[INFO][%s] Userinput subflow succeeded. Should continue execution by default?", actionResult.ExecutionId)
+					logger.Printf("[INFO] Userinput subflow succeeded. Should continue execution by default?")
 
 					// FIXME:
 					// 1. What should happen on cloud?
@@ -14861,7 +15232,7 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 								workflowExecution.Results = append(workflowExecution.Results, actionResult)
 								setWorkflow = true
 							} else {
-								log.Printf("\n\n\n[DEBUG] NOT modifying workflow based on User Input as we are in worker\n\n\n")
+								logger.Printf("[DEBUG] NOT modifying workflow based on User Input as we are in worker")
 							}
 
 						} else {
@@ -14877,12 +15248,12 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 						// Set with database saving
 						err = SetWorkflowExecution(ctx, workflowExecution, true)
 						if err != nil {
-							log.Printf("[ERROR][%s] Failed setting workflow execution during user input return onprem~: %s", workflowExecution.ExecutionId, err)
+							logger.Printf("[ERROR] Failed setting workflow execution during user input return onprem~: %s", err)
 						}
 					}
 
 					if strings.Contains(actionResult.Result, "\"execution_id\":") && strings.Contains(actionResult.Result, "\"authorization\":") {
-						log.Printf("\n\n[DEBUG][%s] Found execution_id and authorization in result. Now verifying if the workflow should just continue or not\n\n", actionResult.ExecutionId)
+						logger.Printf("[DEBUG] Found execution_id and authorization in result. Now verifying if the workflow should just continue or not")
 						return &workflowExecution, false, errors.New("User Input")
 					}
 				}
@@ -14904,7 +15275,7 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 					cacheId := fmt.Sprintf("%s_%s_result", workflowExecution.ExecutionId, actionResult.Action.ID)
 					err = SetCache(ctx, cacheId, actionResultBody, 35)
 					if err != nil {
-						log.Printf("[WARNING] Couldn't find in fix exec %s (2): %s", cacheId, err)
+						logger.Printf("[WARNING] Couldn't find in fix exec %s (2): %s", cacheId, err)
 						continue
 					}
 				}
@@ -14921,14 +15292,14 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 					cacheId := fmt.Sprintf("%s_%s_result", workflowExecution.ExecutionId, actionResult.Action.ID)
 					err = SetCache(ctx, cacheId, actionResultBody, 35)
 					if err != nil {
-						log.Printf("[ERROR][%s] Failed to update cache for %s", workflowExecution.ExecutionId, cacheId)
+						logger.Printf("[ERROR] Failed to update cache for %s", cacheId)
 					}
 				}
 			}
 
 			err = SetWorkflowExecution(ctx, workflowExecution, true)
 			if err != nil {
-				log.Printf("[ERROR][%s] Failed setting workflow execution during user input return: %s", workflowExecution.ExecutionId, err)
+				logger.Printf("[ERROR] Failed setting workflow execution during user input return: %s", err)
 			}
 
 			return &workflowExecution, true, nil
@@ -14974,7 +15345,7 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 				//log.Printf("\n\n\n[ERROR] Failed setting cache for action in parsed exec results %s: %s\n\n", actionCacheId, err)
 			}
 		} else {
-			log.Printf("[ERROR] Failed marshalling result and put it in cache.")
+			logger.Printf("[ERROR] Failed marshalling result and put it in cache.")
 		}
 	} else {
 		//log.Printf("[WARNING] Skipping cache for %s", actionResult.Action.Name)
@@ -15019,7 +15390,7 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 			var subflowData SubflowMapping
 			err := json.Unmarshal([]byte(actionResult.Result), &subflowData)
 			if err != nil {
-				log.Printf("[ERROR] Failed to map in set execvar name with success: %s", err)
+				logger.Printf("[ERROR] Failed to map in set execvar name with success: %s", err)
 				setExecVar = false
 			} else {
 				if subflowData.Success == false {
@@ -15033,7 +15404,7 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 		}
 
 		if setExecVar {
-			log.Printf("[DEBUG][%s] Updating exec variable %s with new value of length %d (2)", workflowExecution.ExecutionId, actionResult.Action.ExecutionVariable.Name, len(actionResult.Result))
+			logger.Printf("[DEBUG] Updating exec variable %s with new value of length %d (2)", actionResult.Action.ExecutionVariable.Name, len(actionResult.Result))
 
 			if len(workflowExecution.Results) > 0 {
 				// Should this be used?
@@ -15056,7 +15427,7 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 				workflowExecution.ExecutionVariables = append(workflowExecution.ExecutionVariables, actionResult.Action.ExecutionVariable)
 			}
 		} else {
-			log.Printf("[DEBUG] NOT updating exec variable %s with new value of length %d. Check previous errors, or if action was successful (success: true)", actionResult.Action.ExecutionVariable.Name, len(actionResult.Result))
+			logger.Printf("[DEBUG] NOT updating exec variable %s with new value of length %d. Check previous errors, or if action was successful (success: true)", actionResult.Action.ExecutionVariable.Name, len(actionResult.Result))
 		}
 	}
 
@@ -15095,7 +15466,7 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 			)
 
 			if err != nil {
-				log.Printf("[WARNING] Failed making org notification: %s", err)
+				logger.Printf("[WARNING] Failed making org notification: %s", err)
 			} else {
 				workflowExecution.NotificationsCreated++
 			}
@@ -15135,7 +15506,7 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 				notificationSent = true
 				workflowExecution.NotificationsCreated++
 			} else {
-				log.Printf("[WARNING] Failed making org notification: %s", err)
+				logger.Printf("[WARNING] Failed making org notification: %s", err)
 			}
 		}
 	}
@@ -15163,7 +15534,7 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 			// Add an else for HTTP request errors with success "false"
 			// These could be "silent" issues
 			if actionResult.Status == "FAILURE" && workflowExecution.Workflow.Hidden == false {
-				log.Printf("[DEBUG] Result is %s for %s (%s). Making notification.", actionResult.Status, actionResult.Action.Label, actionResult.Action.ID)
+				logger.Printf("[DEBUG] Result is %s for %s (%s). Making notification.", actionResult.Status, actionResult.Action.Label, actionResult.Action.ID)
 				err := CreateOrgNotification(
 					ctx,
 					fmt.Sprintf("Error in Workflow %s", workflowExecution.Workflow.Name),
@@ -15174,7 +15545,7 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 				)
 
 				if err != nil {
-					log.Printf("[WARNING] Failed making org notification: %s", err)
+					logger.Printf("[WARNING] Failed making org notification: %s", err)
 				} else {
 					workflowExecution.NotificationsCreated++
 				}
@@ -15185,7 +15556,7 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 		childNodes := []string{}
 		if workflowExecution.Workflow.Configuration.ExitOnError {
 			// Find underlying nodes and add them
-			log.Printf("[WARNING] Actionresult is %s for node %s (%s) in execution %s. Should set workflowExecution and exit all running functions", actionResult.Status, actionResult.Action.Label, actionResult.Action.ID, workflowExecution.ExecutionId)
+			logger.Printf("[WARNING] Actionresult is %s for node %s (%s). Should set workflowExecution and exit all running functions", actionResult.Status, actionResult.Action.Label, actionResult.Action.ID)
 			workflowExecution.Status = actionResult.Status
 			workflowExecution.LastNode = actionResult.Action.ID
 
@@ -15196,15 +15567,15 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 			IncrementCache(ctx, workflowExecution.ExecutionOrg, "workflow_executions_failed")
 		} else {
 
-			log.Printf("[WARNING] Actionresult is %s for node %s in %s. Continuing anyway because of workflow configuration.", actionResult.Status, actionResult.Action.ID, workflowExecution.ExecutionId)
+			logger.Printf("[WARNING] Actionresult is %s for node %s. Continuing anyway because of workflow configuration.", actionResult.Status, actionResult.Action.ID)
 			// Finds ALL childnodes to set them to SKIPPED
 			// Remove duplicates
 			childNodes = FindChildNodes(workflowExecution.Workflow, actionResult.Action.ID, []string{}, []string{})
 			//log.Printf("[DEBUG][%s] FOUND %d CHILDNODES\n\n", workflowExecution.ExecutionId, len(childNodes))
 			for _, nodeId := range childNodes {
-				log.Printf("[DEBUG][%s] Checking if node %s is already in results", workflowExecution.ExecutionId, nodeId)
+				logger.Printf("[DEBUG] Checking if node %s is already in results", nodeId)
 				if nodeId == actionResult.Action.ID {
-					log.Printf("[DEBUG][%s] Skipping marking node %s (%s) as anything", workflowExecution.ExecutionId, nodeId, actionResult.Action.Label)
+					logger.Printf("[DEBUG] Skipping marking node %s (%s) as anything", nodeId, actionResult.Action.Label)
 					continue
 				}
 
@@ -15214,11 +15585,11 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 				for _, action := range workflowExecution.Workflow.Actions {
 					if action.ID == nodeId {
 						curAction = action
-						log.Printf("[DEBUG][%s] Found action %s (%s) for node %s", workflowExecution.ExecutionId, action.Label, action.ID, nodeId)
+						logger.Printf("[DEBUG] Found action %s (%s) for node %s", action.Label, action.ID, nodeId)
 						break
 					}
 				}
-				log.Printf("[DEBUG][%s] Found action with ID: %s", workflowExecution.ExecutionId, curAction.ID)
+				logger.Printf("[DEBUG] Found action with ID: %s", curAction.ID)
 
 				isTrigger := false
 				if len(curAction.ID) == 0 {
@@ -15242,14 +15613,14 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 
 					if len(curAction.ID) == 0 {
 						//log.Printf("Couldn't find subnode %s", nodeId)
-						log.Printf("[WARNING][%s] Couldn't find subnode %s. Forgetting about it", workflowExecution.ExecutionId, nodeId)
+						logger.Printf("[WARNING] Couldn't find subnode %s. Forgetting about it", nodeId)
 						continue
 					}
 				}
 
 				resultExists := false
 				for _, result := range workflowExecution.Results {
-					log.Printf("[DEBUG][%s] Checking if result %s (%s) exists in results", workflowExecution.ExecutionId, result.Action.Label, result.Action.ID)
+					logger.Printf("[DEBUG] Checking if result %s (%s) exists in results", result.Action.Label, result.Action.ID)
 					if result.Action.ID == curAction.ID {
 						resultExists = true
 						break
@@ -15267,29 +15638,29 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 							for _, trigger := range workflowExecution.Workflow.Triggers {
 								if trigger.ID == branch.SourceID {
 									if trigger.AppName != "User Input" && trigger.AppName != "Shuffle Workflow" {
-										log.Printf("[DEBUG][%s] Parent %s (%s) is a trigger. Continuing..", workflowExecution.ExecutionId, branch.SourceID, curAction.Label)
+										logger.Printf("[DEBUG] Parent %s (%s) is a trigger. Continuing..", branch.SourceID, curAction.Label)
 										parentTrigger = true
 									}
 								}
 							}
 
 							if parentTrigger {
-								log.Printf("[DEBUG][%s] Parent %s (of child %s) is a trigger. Continuing..", workflowExecution.ExecutionId, branch.SourceID, nodeId)
+								logger.Printf("[DEBUG] Parent %s (of child %s) is a trigger. Continuing..", branch.SourceID, nodeId)
 								continue
 							}
 
-							log.Printf("[DEBUG][%s] Parent %s (of child %s) is NOT a trigger. Continuing..", workflowExecution.ExecutionId, branch.SourceID, nodeId)
+							logger.Printf("[DEBUG] Parent %s (of child %s) is NOT a trigger. Continuing..", branch.SourceID, nodeId)
 
 							sourceNodeFound := false
 							for _, item := range childNodes {
 								if item == branch.SourceID {
-									log.Printf("[DEBUG][%s] Found source node %s (%s) for node %s", workflowExecution.ExecutionId, branch.SourceID, curAction.Label, nodeId)
+									logger.Printf("[DEBUG] Found source node %s (%s) for node %s", branch.SourceID, curAction.Label, nodeId)
 									sourceNodeFound = true
 									break
 								}
 							}
 
-							log.Printf("[DEBUG][%s] sourceNodeFound: %t for node %s", workflowExecution.ExecutionId, sourceNodeFound, nodeId)
+							logger.Printf("[DEBUG] sourceNodeFound: %t for node %s", sourceNodeFound, nodeId)
 
 							if !sourceNodeFound {
 								// FIXME: Shouldn't add skip for child nodes of these nodes. Check if this node is parent of upcoming nodes.
@@ -15298,7 +15669,7 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 
 								if !ArrayContains(visited, nodeId) && !ArrayContains(executed, nodeId) {
 									nextActions = append(nextActions, nodeId)
-									log.Printf("[INFO] SHOULD EXECUTE NODE %s. Next actions: %s", nodeId, nextActions)
+									logger.Printf("[INFO] SHOULD EXECUTE NODE %s. Next actions: %s", nodeId, nextActions)
 								}
 								break
 							}
@@ -15327,7 +15698,7 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 						//var visited []string
 						//var executed []string
 						//var nextActions []string
-						log.Printf("[DEBUG][%s] Not adding %s - %s as a skipaction.", workflowExecution.ExecutionId, curAction.ID, nodeId)
+						logger.Printf("[DEBUG] Not adding %s - %s as a skipaction.", curAction.ID, nodeId)
 					}
 				}
 			}
@@ -15337,7 +15708,7 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 		lastResult := ""
 		// type ActionResult struct {
 		for _, result := range workflowExecution.Results {
-			log.Printf("[DEBUG][%s] Checking result %s (%s) with status %s", workflowExecution.ExecutionId, result.Action.Label, result.Action.ID, result.Status)
+			logger.Printf("[DEBUG] Checking result %s (%s) with status %s", result.Action.Label, result.Action.ID, result.Status)
 			if actionResult.Action.ID == result.Action.ID {
 				continue
 			}
@@ -15413,7 +15784,7 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 			}
 
 			// FIXME: Debug logs necessary to understand how workflows finish?
-			log.Printf("[DEBUG][%s] Found that %s (%s) should be skipped? Should check if it has more parents. If not, send in a skip", workflowExecution.ExecutionId, foundAction.Label, foundAction.AppName)
+			logger.Printf("[DEBUG] Found that %s (%s) should be skipped? Should check if it has more parents. If not, send in a skip", foundAction.Label, foundAction.AppName)
 
 			foundCount := 0
 			skippedBranches := []string{}
@@ -15463,7 +15834,7 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 
 					resultData, err := json.Marshal(newResult)
 					if err != nil {
-						log.Printf("[ERROR] Failed skipping action")
+						logger.Printf("[ERROR] Failed skipping action")
 						continue
 					}
 
@@ -15507,27 +15878,27 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 					)
 
 					if err != nil {
-						log.Printf("[ERROR] Error building SKIPPED request (%s): %s", foundAction.Label, err)
+						logger.Printf("[ERROR] Error building SKIPPED request (%s): %s", foundAction.Label, err)
 						continue
 					}
 
 					client := &http.Client{}
 					newresp, err := client.Do(req)
 					if err != nil {
-						log.Printf("[ERROR] Error running SKIPPED request (%s): %s", foundAction.Label, err)
+						logger.Printf("[ERROR] Error running SKIPPED request (%s): %s", foundAction.Label, err)
 						continue
 					}
 
 					defer newresp.Body.Close()
 					body, err := ioutil.ReadAll(newresp.Body)
 					if err != nil {
-						log.Printf("[ERROR] Failed reading body when running SKIPPED request (%s): %s", foundAction.Label, err)
+						logger.Printf("[ERROR] Failed reading body when running SKIPPED request (%s): %s", foundAction.Label, err)
 						continue
 					}
 
 					//log.Printf("[DEBUG] Skipped body return from %s (%d): %s", streamUrl, newresp.StatusCode, string(body))
 					if strings.Contains(string(body), "already finished") {
-						log.Printf("[WARNING] Data couldn't be re-inputted for %s.", foundAction.Label)
+						logger.Printf("[WARNING] Data couldn't be re-inputted for %s.", foundAction.Label)
 						// DONT CHANGE THE ERROR OUTPUT HERE
 						return &workflowExecution, true, errors.New(fmt.Sprintf("Workflow has already been ran with label %s. Raw: %s", foundAction.Label, string(body)))
 					}
@@ -15562,7 +15933,7 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 				)
 
 				if err != nil {
-					log.Printf("[WARNING] Failed making org notification for %s: %s", workflowExecution.ExecutionOrg, err)
+					logger.Printf("[WARNING] Failed making org notification for %s: %s", workflowExecution.ExecutionOrg, err)
 				} else {
 					workflowExecution.NotificationsCreated++
 				}
@@ -15608,10 +15979,10 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 						// Sets the value for the variable
 
 						if len(actionResult.Result) > 0 {
-							log.Printf("\n\n[DEBUG] SET EXEC VAR %s\n\n", execvar.Name)
+							logger.Printf("[DEBUG] SET EXEC VAR %s", execvar.Name)
 							workflowExecution.ExecutionVariables[index].Value = actionResult.Result
 						} else {
-							log.Printf("\n\n[DEBUG] SKIPPING EXEC VAR\n\n")
+							logger.Printf("[DEBUG] SKIPPING EXEC VAR")
 						}
 
 						break
@@ -15619,7 +15990,7 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 				}
 			}
 
-			log.Printf("[INFO][%s] Updating %s (%s) in workflow from %s to %s", workflowExecution.ExecutionId, actionResult.Action.Name, actionResult.Action.ID, workflowExecution.Results[outerindex].Status, actionResult.Status)
+			logger.Printf("[INFO] Updating %s (%s) in workflow from %s to %s", actionResult.Action.Name, actionResult.Action.ID, workflowExecution.Results[outerindex].Status, actionResult.Status)
 
 			if workflowExecution.Results[outerindex].Status != actionResult.Status {
 				dbSave = true
@@ -15632,12 +16003,12 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 				cacheId := fmt.Sprintf("%s_%s_result", workflowExecution.ExecutionId, actionResult.Action.ID)
 				err = SetCache(ctx, cacheId, actionResultBody, 35)
 				if err != nil {
-					log.Printf("[ERROR] Failed setting cache for User Input to %s: %s", actionResult.Status, err)
+					logger.Printf("[ERROR] Failed setting cache for User Input to %s: %s", actionResult.Status, err)
 				} else {
 					//log.Printf("[DEBUG] Set cache for SUBFLOW action result %s", cacheId)
 				}
 			} else {
-				log.Printf("[ERROR] Failed marshaling action result for %s: %s", actionResult.Action.ID, err)
+				logger.Printf("[ERROR] Failed marshaling action result for %s: %s", actionResult.Action.ID, err)
 			}
 
 			workflowExecution.Results[outerindex] = actionResult
@@ -15645,7 +16016,7 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 			workflowExecution.Results = append(workflowExecution.Results, actionResult)
 		}
 	} else {
-		log.Printf("[INFO][%s] Setting value of %s (INIT - %s) to %s (%d)", workflowExecution.ExecutionId, actionResult.Action.Label, actionResult.Action.ID, actionResult.Status, len(workflowExecution.Results))
+		logger.Printf("[INFO] Setting value of %s (INIT - %s) to %s (%d)", actionResult.Action.Label, actionResult.Action.ID, actionResult.Status, len(workflowExecution.Results))
 		workflowExecution.Results = append(workflowExecution.Results, actionResult)
 	}
 
@@ -15684,7 +16055,7 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 			if len(workflowExecution.ExecutionParent) == 0 {
 				//log.Printf("[INFO][%s] Execution in workflow %s finished (not subflow).", workflowExecution.ExecutionId, workflowExecution.Workflow.ID)
 			} else {
-				log.Printf("[INFO][%s] SubExecution of parentExecution %s in workflow %s finished (subflow).", workflowExecution.ExecutionId, workflowExecution.ExecutionParent, workflowExecution.Workflow.ID)
+				logger.Printf("[INFO] SubExecution of parentExecution %s in workflow %s finished (subflow).", workflowExecution.ExecutionParent, workflowExecution.Workflow.ID)
 			}
 
 			for actionIndex, action := range workflowExecution.Workflow.Actions {
@@ -15721,7 +16092,7 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 								// 1. Find the parent workflow
 								// 2. Find the parent's existing value
 
-								log.Printf("[DEBUG] FOUND SUBFLOW WITH EXECUTIONPARENT %s!", workflowExecution.ExecutionParent)
+								logger.Printf("[DEBUG] FOUND SUBFLOW WITH EXECUTIONPARENT %s!", workflowExecution.ExecutionParent)
 							}
 						} else {
 							valueToReturn = workflowExecution.Result
@@ -15757,7 +16128,7 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 						}
 
 						if isLooping {
-							log.Printf("[DEBUG] Parentexecutions' subflow IS looping.")
+							logger.Printf("[DEBUG] Parentexecutions' subflow IS looping.")
 						}
 					}
 
@@ -15767,11 +16138,11 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 
 				// Check if source node has "Wait for Results" set to true
 
-				log.Printf("[DEBUG][%s] Found execution parent %s for workflow '%s' (%s)", workflowExecution.ExecutionId, workflowExecution.ExecutionParent, workflowExecution.Workflow.Name, workflowExecution.Workflow.ID)
+				logger.Printf("[DEBUG] Found execution parent %s for workflow '%s' (%s)", workflowExecution.ExecutionParent, workflowExecution.Workflow.Name, workflowExecution.Workflow.ID)
 
 				err = updateExecutionParent(ctx, workflowExecution.ExecutionParent, valueToReturn, workflowExecution.ExecutionSourceAuth, workflowExecution.ExecutionSourceNode, workflowExecution.ExecutionId)
 				if err != nil {
-					log.Printf("[ERROR][%s] Failed running update execution parent: %s", workflowExecution.ExecutionId, err)
+					NewExecutionLogger(ctx, workflowExecution).Printf("[ERROR] Failed sending the result to parent execution %s: %s", workflowExecution.ExecutionParent, err)
 				} else {
 					updateParentRan = true
 				}
@@ -15808,7 +16179,7 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 						cacheData := []byte(value.([]uint8))
 						err = json.Unmarshal(cacheData, &parsedValue)
 						if err == nil {
-							log.Printf("[INFO][%s] Found subflow result (1) %s for subflow %s in recheck from cache with %d results and result %s", workflowExecution.ExecutionId, parsedValue.Status, subflowData.ExecutionId, len(parsedValue.Results), parsedValue.Result)
+							logger.Printf("[INFO] Found subflow result (1) %s for subflow %s in recheck from cache with %d results and result %s", parsedValue.Status, subflowData.ExecutionId, len(parsedValue.Results), parsedValue.Result)
 
 							if len(parsedValue.Result) > 0 {
 								subflowData.Result = parsedValue.Result
@@ -15820,13 +16191,13 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 						// Check backend
 						//log.Printf("[INFO][%s] Found subflow result %s for subflow %s in recheck from cache with %d results and result %s", workflowExecution.ExecutionId, parsedValue.Status, subflowData.ExecutionId, len(parsedValue.Results), parsedValue.Result)
 						if len(subflowData.Result) == 0 && !strings.Contains(actionResult.Result, "\"result\"") {
-							log.Printf("[INFO][%s] No subflow result found in cache for subflow %s. Checking backend next", workflowExecution.ExecutionId, subflowData.ExecutionId)
+							logger.Printf("[INFO] No subflow result found in cache for subflow %s. Checking backend next", subflowData.ExecutionId)
 							if len(subflowData.ExecutionId) > 0 {
 								parsedValue, err := GetBackendexecution(ctx, subflowData.ExecutionId, subflowData.Authorization)
 								if err != nil {
-									log.Printf("[WARNING] Failed getting subflow execution from backend to verify: %s", err)
+									logger.Printf("[WARNING] Failed getting subflow execution from backend to verify: %s", err)
 								} else {
-									log.Printf("[INFO][%s] Found subflow result (2) %s for subflow %s in backend with %d results and result %s", workflowExecution.ExecutionId, parsedValue.Status, subflowData.ExecutionId, len(parsedValue.Results), parsedValue.Result)
+									logger.Printf("[INFO] Found subflow result (2) %s for subflow %s in backend with %d results and result %s", parsedValue.Status, subflowData.ExecutionId, len(parsedValue.Results), parsedValue.Result)
 									if len(parsedValue.Result) > 0 {
 										subflowData.Result = parsedValue.Result
 									} else if parsedValue.Status == "FINISHED" {
@@ -15839,7 +16210,7 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 				}
 			}
 
-			log.Printf("[WARNING][%s] Sinkholing request of %s IF the subflow-result DOESNT have result.", workflowExecution.ExecutionId, actionResult.Action.Label)
+			logger.Printf("[WARNING] Sinkholing request of %s IF the subflow-result DOESNT have result.", actionResult.Action.Label)
 
 			// Just set the sinkholed data for some time in cache in case
 			// it will be necessary to use later. E.g. for wait for results
@@ -15848,7 +16219,7 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 			go SetCache(ctx, newCacheKey, []byte(actionResult.Result), 35)
 
 			if jsonerr == nil && len(subflowData.Result) == 0 && !strings.Contains(actionResult.Result, "\"result\"") {
-				log.Printf("[INFO][%s] NO RESULT FOR SUBFLOW RESULT - SETTING TO EXECUTING. Results: %d. Trying to find subexec in cache onprem", workflowExecution.ExecutionId, len(workflowExecution.Results))
+				logger.Printf("[INFO] NO RESULT FOR SUBFLOW RESULT - SETTING TO EXECUTING. Results: %d. Trying to find subexec in cache onprem", len(workflowExecution.Results))
 
 				// Finding the result, and removing it if it exists. "Sinkholing"
 				workflowExecution.Status = "EXECUTING"
@@ -15881,7 +16252,7 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 					}
 
 				} else {
-					log.Printf("[WARNING] LIST sinkholed (len: %d) for action %s (%s) - Should apply list setup for same as subflow without result! Set the execution back to EXECUTING and the action to WAITING, as it's already running. Waiting for each individual result to add to the list.", len(subflowDataList), actionResult.Action.Label, actionResult.Action.ID)
+					logger.Printf("[WARNING] LIST sinkholed (len: %d) for action %s (%s) - Should apply list setup for same as subflow without result! Set the execution back to EXECUTING and the action to WAITING, as it's already running. Waiting for each individual result to add to the list.", len(subflowDataList), actionResult.Action.Label, actionResult.Action.ID)
 
 					//log.Printf("\n\n\nRESULT: %#v\n\n\n", actionResult.Result)
 
@@ -15896,7 +16267,7 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 						}
 					}
 
-					log.Printf("[DEBUG] %d / %d subflows finished with a result. If equal, status = SUCCESS", amountFinished, len(subflowDataList))
+					logger.Printf("[DEBUG] %d / %d subflows finished with a result. If equal, status = SUCCESS", amountFinished, len(subflowDataList))
 					actionResultCache := fmt.Sprintf("%s_%s_result", workflowExecution.ExecutionId, actionResult.Action.ID)
 					if amountFinished >= len(subflowDataList) {
 						actionResult.Status = "SUCCESS"
@@ -15927,7 +16298,7 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 							cacheId := fmt.Sprintf("%s_%s_result", workflowExecution.ExecutionId, actionResult.Action.ID)
 							err = SetCache(ctx, cacheId, actionResultBody, 35)
 							if err != nil {
-								log.Printf("[ERROR] Failed setting cache for SUBFLOW to WAITING: %s", err)
+								logger.Printf("[ERROR] Failed setting cache for SUBFLOW to WAITING: %s", err)
 							} else {
 								//log.Printf("[DEBUG] Set cache for SUBFLOW action result %s", cacheId)
 							}
@@ -15939,7 +16310,7 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 					}
 
 					if !foundSubflow {
-						log.Printf("[ERROR] Failed finding subflow in results for %s (%s). Setting it in cache so that it can be loaded.", actionResult.Action.Label, actionResult.Action.ID)
+						logger.Printf("[ERROR] Failed finding subflow in results for %s (%s). Setting it in cache so that it can be loaded.", actionResult.Action.Label, actionResult.Action.ID)
 					}
 				}
 
@@ -15956,7 +16327,7 @@ func ParsedExecutionResult(ctx context.Context, workflowExecution WorkflowExecut
 	// Does it work to cache it here?
 	err = SetWorkflowExecution(ctx, workflowExecution, dbSave)
 	if err != nil {
-		log.Printf("[ERROR][%s] Failed saving execution to DB: %s", workflowExecution.ExecutionId, err)
+		NewExecutionLogger(ctx, workflowExecution).Printf("[ERROR] Failed saving execution to DB: %s", err)
 	}
 
 	// Should only apply a few seconds after execution, otherwise it's bascially spam.
@@ -16428,7 +16799,7 @@ func ValidateSwagger(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Role == "org-reader" {
+	if Authorize(user, "apps:write", "") != nil {
 		log.Printf("[WARNING] Org-reader doesn't have access to validate swagger (shared): %s (%s)", user.Username, user.Id)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
@@ -16796,12 +17167,15 @@ func GetReplacementNodes(ctx context.Context, execution WorkflowExecution, trigg
 }
 
 // Uses a simple way to be able to modify the encryption key being used
-// FIXME: Investigate better ways of handling EVERYTHING related to encryption
-// E.g. rolling keys and such
-func create32Hash(key string) ([]byte, error) {
-	encryptionModifier := os.Getenv("SHUFFLE_ENCRYPTION_MODIFIER")
+// The version decides which modifier is used. See keyRotation.go
+func create32Hash(key string, version int) ([]byte, error) {
+	encryptionModifier := getEncryptionModifier(version)
 	if len(encryptionModifier) == 0 {
-		return []byte{}, errors.New(fmt.Sprintf("No encryption modifier set. Define SHUFFLE_ENCRYPTION_MODIFIER and NEVER change it to start encrypting auth."))
+		if version <= 1 {
+			return []byte{}, errors.New(fmt.Sprintf("No encryption modifier set. Define SHUFFLE_ENCRYPTION_MODIFIER and NEVER change it to start encrypting auth."))
+		}
+
+		return []byte{}, errors.New(fmt.Sprintf("No encryption modifier set for key version %d. Define SHUFFLE_ENCRYPTION_MODIFIER_V%d until all data is migrated away from it.", version, version))
 	}
 
 	key += encryptionModifier
@@ -16811,7 +17185,8 @@ func create32Hash(key string) ([]byte, error) {
 }
 
 func handleKeyEncryption(data []byte, passphrase string) ([]byte, error) {
-	key, err := create32Hash(passphrase)
+	version := getEncryptionKeyVersion()
+	key, err := create32Hash(passphrase, version)
 	if err != nil {
 		log.Printf("[WARNING] Failed hashing in encrypt: %s", err)
 		return []byte{}, err
@@ -16839,13 +17214,14 @@ func handleKeyEncryption(data []byte, passphrase string) ([]byte, error) {
 
 	// base64 encoding to ensure we can store it as a string
 	parsedValue := base64.StdEncoding.EncodeToString(ciphertext)
-	return []byte(parsedValue), nil
+	return []byte(addEncryptionVersion(parsedValue, version)), nil
 }
 
 func HandleKeyDecryption(data []byte, passphrase string) ([]byte, error) {
 	//log.Printf("[DEBUG] Passphrase: %s", passphrase)
 	//log.Printf("Decrypting key: %s", data)
-	key, err := create32Hash(passphrase)
+	version, data := parseEncryptionVersion(data)
+	key, err := create32Hash(passphrase, version)
 	if err != nil {
 		log.Printf("[ERROR] Failed hashing in decrypt: %s", err)
 		return []byte{}, err
@@ -16901,13 +17277,6 @@ func HandleListCacheKeys(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Role != "admin" && !user.SupportAccess {
-		log.Printf("[AUDIT] User %s (%s) tried to list cache keys without admin role", user.Username, user.Id)
-		resp.WriteHeader(401)
-		resp.Write([]byte(`{"success": false, "reason": "Admin required"}`))
-		return
-	}
-
 	//for key, value := range data.Apps {
 	var fileId string
 	location := strings.Split(request.URL.String(), "/")
@@ -16935,6 +17304,13 @@ func HandleListCacheKeys(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	if Authorize(user, "org:manage", org.Id) != nil && !hasSupportAccess(request, &user, org.Id, "read", "org", org.Id) {
+		log.Printf("[AUDIT] User %s (%s) tried to list cache keys of org %s without admin role", user.Username, user.Id, org.Id)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Admin required"}`))
+		return
+	}
+
 	maxAmount := 30
 	top, topOk := request.URL.Query()["top"]
 	if topOk && len(top) > 0 {
@@ -17737,6 +18113,7 @@ func HandleSetCacheKey(resp http.ResponseWriter, request *http.Request) {
 }
 
 // Checks authentication string for Webhooks
+// Use ValidateHookRequest to also verify signatures
 func CheckHookAuth(request *http.Request, auth string) error {
 	if len(auth) == 0 {
 		return nil
@@ -18832,6 +19209,7 @@ func HandleOpenId(resp http.ResponseWriter, request *http.Request) {
 
 	skipValidation := false
 	openidUser := OpenidUserinfo{}
+	oidcGroups := []string{}
 	org := &Org{}
 	code := request.URL.Query().Get("code")
 	if len(code) == 0 {
@@ -18865,6 +19243,7 @@ func HandleOpenId(resp http.ResponseWriter, request *http.Request) {
 					openidUser.Sub = token.Sub
 					openidUser.Email = token.Email
 					org = &token.Org
+					oidcGroups = getOidcGroups(org, token.Claims)
 					skipValidation = true
 
 					break
@@ -18965,6 +19344,22 @@ func HandleOpenId(resp http.ResponseWriter, request *http.Request) {
 			return
 		}
 
+		// Without an issuer or JWKS URL the ID token can't be verified, and
+		// only the userinfo endpoint is used
+		if len(openid.IdToken) > 0 && !canVerifyOidcIdToken(org) {
+			log.Printf("[WARNING] Ignoring the ID token for org %s, as there is no OpenID issuer or JWKS URL to verify it with", org.Id)
+		} else if len(openid.IdToken) > 0 {
+			claims, err := verifyOidcIdToken(ctx, org, openid.IdToken)
+			if err != nil {
+				log.Printf("[WARNING] ID token verification failed for org %s: %s", org.Id, err)
+				resp.WriteHeader(401)
+				resp.Write([]byte(`{"success": false, "reason": "Failed verifying the ID token"}`))
+				return
+			}
+
+			oidcGroups = getOidcGroups(org, claims)
+		}
+
 		// Automated replacement
 		userInfoUrlSplit := strings.Split(org.SSOConfig.OpenIdAuthorization, "/")
 		userinfoEndpoint := strings.Join(userInfoUrlSplit[0:len(userInfoUrlSplit)-1], "/") + "/userinfo"
@@ -19004,6 +19399,14 @@ func HandleOpenId(resp http.ResponseWriter, request *http.Request) {
 			resp.Write([]byte(`{"success": false}`))
 			return
 		}
+
+		// Some IdPs only send groups from the userinfo endpoint
+		if len(oidcGroups) == 0 {
+			userinfoClaims := map[string]interface{}{}
+			if json.Unmarshal(body, &userinfoClaims) == nil {
+				oidcGroups = getOidcGroups(org, userinfoClaims)
+			}
+		}
 	}
 
 	//log.Printf("Got user body: %s", string(body))
@@ -19054,6 +19457,7 @@ func HandleOpenId(resp http.ResponseWriter, request *http.Request) {
 				log.Printf("[AUDIT] Found user %s (%s) which matches SSO info for %s. Redirecting to login!", user.Username, user.Id, userName)
 
 				//log.Printf("SESSION: %s", user.Session)
+				applyOidcMappings(ctx, &user, org, oidcGroups)
 				user.ActiveOrg = OrgMini{
 					Name: org.Name,
 					Id:   org.Id,
@@ -19153,6 +19557,7 @@ func HandleOpenId(resp http.ResponseWriter, request *http.Request) {
 				log.Printf("[AUDIT] Found user %s (%s) which matches SSO info for %s. Redirecting to login %s!", user.Username, user.Id, userName, redirectUrl)
 
 				//log.Printf("SESSION: %s", user.Session)
+				applyOidcMappings(ctx, &user, org, oidcGroups)
 				user.ActiveOrg = OrgMini{
 					Name: org.Name,
 					Id:   org.Id,
@@ -19268,6 +19673,13 @@ func HandleOpenId(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	if org.OidcConfig.JitDisabled {
+		log.Printf("[AUDIT] Not creating OpenID user %s in org %s as just-in-time provisioning is disabled", userName, org.Id)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Your user has not been provisioned in this organization"}`))
+		return
+	}
+
 	log.Printf("[AUDIT] Adding user %s to org %s (%s) through single sign-on", userName, org.Name, org.Id)
 	newUser := new(User)
 	// Random password to ensure its not empty
@@ -19279,12 +19691,13 @@ func HandleOpenId(resp http.ResponseWriter, request *http.Request) {
 	newUser.CreationTime = time.Now().Unix()
 	newUser.Orgs = []string{org.Id}
 	newUser.LoginType = "OpenID"
-	newUser.Role = "user"
+	newUser.Role = getOidcDefaultRole(ctx, org)
+	newUser.Roles = []string{newUser.Role}
 	newUser.Session = uuid.NewV4().String()
 	newUser.ActiveOrg = OrgMini{
 		Name: org.Name,
 		Id:   org.Id,
-		Role: "user",
+		Role: newUser.Role,
 	}
 
 	verifyToken := uuid.NewV4()
@@ -19336,6 +19749,8 @@ func HandleOpenId(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	applyOidcMappings(ctx, newUser, org, oidcGroups)
+
 	http.Redirect(resp, request, redirectUrl, http.StatusSeeOther)
 	return
 }
@@ -19487,49 +19902,22 @@ func HandleSSO(resp http.ResponseWriter, request *http.Request) {
 	parsedX509Key := fixCertificate(baseCertificate)
 
 	ctx := GetContext(request)
-	matchingOrgs, err := GetOrgByField(ctx, "sso_config.sso_certificate", parsedX509Key)
-	if err != nil && len(matchingOrgs) == 0 {
-		log.Printf("[DEBUG] BYTES FROM REQUEST (DEBUG): %s", string(bytesXML))
-
-		log.Printf("[WARNING] Bad certificate (%d): Failed to find a org with certificate matching the SSO", len(parsedX509Key))
-		resp.WriteHeader(401)
-		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Failed finding an org with the right certificate"}`)))
-		return
-	}
-
-	// Validating the orgs
-	if len(matchingOrgs) >= 1 {
-		newOrgs := []Org{}
-		for _, org := range matchingOrgs {
-			if org.SSOConfig.SSOCertificate == parsedX509Key {
-				newOrgs = append(newOrgs, org)
-			} else {
-				log.Printf("[WARNING] Skipping org append because bad cert: %d vs %d", len(org.SSOConfig.SSOCertificate), len(parsedX509Key))
-
-				//log.Printf(parsedX509Key)
-				//log.Printf(org.SSOConfig.SSOCertificate)
-			}
-		}
-
-		matchingOrgs = newOrgs
-	}
-
-	if len(matchingOrgs) != 1 {
-		log.Printf("[DEBUG] BYTES FROM REQUEST (2 - DEBUG): %s", string(bytesXML))
-		log.Printf("[WARNING] Bad certificate (%d). Original orgs: %d: X509 doesnt match certificate for any organization", len(parsedX509Key), len(matchingOrgs))
+	foundOrg, assertion, err := findSamlResponseOrg(ctx, bytesXML, parsedX509Key)
+	if err != nil {
+		log.Printf("[WARNING] SAML response failed validation (certificate length %d): %s", len(parsedX509Key), err)
 		resp.WriteHeader(401)
-		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Certificate for SSO doesn't match any organization"}`)))
+		resp.Write([]byte(`{"success": false, "reason": "The SAML response is not valid for any organization"}`))
 		return
 	}
 
-	foundOrg := matchingOrgs[0]
-	userName := strings.ToLower(strings.TrimSpace(samlResp.Assertion.Subject.NameID.Text))
+	samlRole := getSamlRole(ctx, &foundOrg, assertion)
+	userName := getSamlUsername(assertion)
 	if !strings.Contains(userName, "@") {
-		log.Printf("[ERROR] Bad username, but allowing due to SSO: %s. Full Subject: %#v", userName, samlResp.Assertion.Subject)
+		log.Printf("[ERROR] Bad username, but allowing due to SSO: %s. Full Subject: %#v", userName, assertion.Subject)
 	}
 
 	if len(userName) == 0 {
-		log.Printf("[WARNING] Failed finding user - No name: %s", samlResp.Assertion.Subject)
+		log.Printf("[WARNING] Failed finding user - No name: %#v", assertion.Subject)
 		resp.WriteHeader(401)
 		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Failed finding a user to authenticate"}`)))
 		return
@@ -19549,7 +19937,7 @@ func HandleSSO(resp http.ResponseWriter, request *http.Request) {
 	*/
 
 	if len(userName) == 0 {
-		log.Printf("[ERROR] Username (%v) is empty in SAML SSO login for org: %v", userName, matchingOrgs[0].Id)
+		log.Printf("[ERROR] Username (%v) is empty in SAML SSO login for org: %v", userName, foundOrg.Id)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Username is empty"}`))
 		return
@@ -19563,7 +19951,7 @@ func HandleSSO(resp http.ResponseWriter, request *http.Request) {
 				log.Printf("[AUDIT] Found user %s (%s) which matches SSO info for %s. Redirecting to login!", user.Username, user.Id, userName)
 
 				if project.Environment == "cloud" {
-					// user.ActiveOrg.Id = matchingOrgs[0].Id
+					// user.ActiveOrg.Id = foundOrg.Id
 
 					DeleteCache(ctx, fmt.Sprintf("%s_workflows", user.Id))
 					DeleteCache(ctx, fmt.Sprintf("apps_%s", user.Id))
@@ -19572,9 +19960,10 @@ func HandleSSO(resp http.ResponseWriter, request *http.Request) {
 					DeleteCache(ctx, fmt.Sprintf("user_%s", user.Id))
 				}
 
+				applySamlRole(ctx, &user, &foundOrg, samlRole)
 				user.ActiveOrg = OrgMini{
-					Name: matchingOrgs[0].Name,
-					Id:   matchingOrgs[0].Id,
+					Name: foundOrg.Name,
+					Id:   foundOrg.Id,
 					Role: user.Role,
 				}
 				//log.Printf("SESSION: %s", user.Session)
@@ -19677,12 +20066,13 @@ func HandleSSO(resp http.ResponseWriter, request *http.Request) {
 
 				//log.Printf("SESSION: %s", user.Session)
 				// if project.Environment == "cloud" {
-				// 	user.ActiveOrg.Id = matchingOrgs[0].Id
+				// 	user.ActiveOrg.Id = foundOrg.Id
 				// }
 
+				applySamlRole(ctx, &user, &foundOrg, samlRole)
 				user.ActiveOrg = OrgMini{
-					Name: matchingOrgs[0].Name,
-					Id:   matchingOrgs[0].Id,
+					Name: foundOrg.Name,
+					Id:   foundOrg.Id,
 					Role: user.Role,
 				}
 
@@ -19809,14 +20199,19 @@ func HandleSSO(resp http.ResponseWriter, request *http.Request) {
 	newUser.Orgs = []string{foundOrg.Id}
 	newUser.LoginType = "SSO"
 	newUser.Role = "user"
+	if len(samlRole) > 0 {
+		newUser.Role = samlRole
+	}
+
+	newUser.Roles = []string{newUser.Role}
 	newUser.Session = uuid.NewV4().String()
 
-	// newUser.ActiveOrg.Id = matchingOrgs[0].Id
+	// newUser.ActiveOrg.Id = foundOrg.Id
 
 	newUser.ActiveOrg = OrgMini{
-		Name: matchingOrgs[0].Name,
-		Id:   matchingOrgs[0].Id,
-		Role: "user",
+		Name: foundOrg.Name,
+		Id:   foundOrg.Id,
+		Role: newUser.Role,
 	}
 
 	verifyToken := uuid.NewV4()
@@ -19969,6 +20364,9 @@ func DownloadFromUrl(ctx context.Context, url string) ([]byte, error) {
 
 // New execution with firestore
 func PrepareWorkflowExecution(ctx context.Context, workflow Workflow, request *http.Request, maxExecutionDepth int64) (WorkflowExecution, ExecInfo, string, error) {
+	ctx, span := startExecutionSpan(ctx, request)
+	defer span.End()
+
 	// Check the URL for the workflow ID itself
 	if request != nil { // && len(workflow.Actions) == 0 {
 
@@ -20003,6 +20401,20 @@ func PrepareWorkflowExecution(ctx context.Context, workflow Workflow, request *h
 		}
 	}
 
+	// Scoped API keys need the execute scope and access to this workflow
+	if request != nil && strings.HasPrefix(request.Header.Get("Authorization"), "Bearer "+userApiKeyPrefix) {
+		user, err := HandleApiAuthentication(nil, request)
+		if err != nil {
+			return WorkflowExecution{}, ExecInfo{}, "Invalid API key", err
+		}
+
+		err = AuthorizeWorkflow(user, "workflow:execute", workflow)
+		if err != nil {
+			log.Printf("[AUDIT] API key %s of user %s (%s) can't execute workflow %s: %s", user.ApiKeyId, user.Username, user.Id, workflow.ID, err)
+			return WorkflowExecution{}, ExecInfo{}, "API key doesn't have access to execute this workflow", err
+		}
+	}
+
 	var workflowExecution WorkflowExecution
 	workflowBytes, err := json.Marshal(workflow)
 	if err != nil {
@@ -20812,11 +21224,31 @@ func PrepareWorkflowExecution(ctx context.Context, workflow Workflow, request *h
 		workflowExecution.Status = "EXECUTING"
 	}
 
+	setExecutionTrace(&workflowExecution, span)
 	if len(workflowExecution.ExecutionSource) == 0 {
 		//log.Printf("[INFO] No execution source (trigger) specified. Setting to default")
 		workflowExecution.ExecutionSource = "default"
 	}
 
+	// Schedules and webhooks may be paused, queued or dropped during maintenance windows
+	triggerId, calendars := getExecutionTriggerCalendars(workflowExecution)
+	if len(calendars) > 0 {
+		allowed, suppressed, err := CheckTriggerMaintenance(ctx, calendars, SuppressedTrigger{
+			OrgId:             workflow.OrgId,
+			TriggerType:       workflowExecution.ExecutionSource,
+			TriggerId:         triggerId,
+			WorkflowId:        workflow.ID,
+			Start:             workflowExecution.Start,
+			ExecutionArgument: workflowExecution.ExecutionArgument,
+		})
+		if err != nil {
+			log.Printf("[WARNING][%s] Failed checking maintenance calendars: %s", workflowExecution.ExecutionId, err)
+		} else if !allowed {
+			reason := fmt.Sprintf("Trigger suppressed by maintenance calendar %s (action: %s)", suppressed.CalendarId, suppressed.Action)
+			return workflowExecution, ExecInfo{}, reason, errors.New(reason)
+		}
+	}
+
 	// Look for header 'appauth' with upper/lowercase check
 	authHeader := ""
 	chosenEnvironment := ""
@@ -21005,7 +21437,7 @@ func PrepareWorkflowExecution(ctx context.Context, workflow Workflow, request *h
 								continue
 							}
 
-							if user.Role != "org-reader" {
+							if hasOrgPermission(user, org.Id, "workflow:execute") {
 								backupApikey = user.ApiKey
 							}
 
@@ -21047,7 +21479,7 @@ func PrepareWorkflowExecution(ctx context.Context, workflow Workflow, request *h
 								continue
 							}
 
-							if user.Role != "org-reader" {
+							if hasOrgPermission(user, org.Id, "workflow:execute") {
 								backupApikey = user.ApiKey
 							}
 
@@ -21109,7 +21541,7 @@ func PrepareWorkflowExecution(ctx context.Context, workflow Workflow, request *h
 				log.Printf("[DEBUG][%s] Found %d users in org %s", workflowExecution.ExecutionId, len(org.Users), org.Id)
 
 				for _, user := range org.Users {
-					if user.Role != "admin" {
+					if !hasOrgPermission(user, org.Id, "org:manage") {
 						continue
 					}
 
@@ -22578,7 +23010,7 @@ func EchoOpenapiData(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Role == "org-reader" {
+	if Authorize(user, "apps:write", "") != nil {
 		log.Printf("[WARNING] Org-reader doesn't have access to echo OpenAPI data: %s (%s)", user.Username, user.Id)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
@@ -22709,7 +23141,7 @@ func SetFrameworkConfiguration(resp http.ResponseWriter, request *http.Request)
 		return
 	}
 
-	if user.Role == "org-reader" {
+	if Authorize(user, "apps:write", "") != nil {
 		log.Printf("[WARNING] Org-reader doesn't have access to set detection framework: %s (%s)", user.Username, user.Id)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Read only user"}}`))
@@ -23759,10 +24191,12 @@ func ActionSkip(ctx context.Context, foundAction Action, exec *WorkflowExecution
 // Decideds what should happen next. Used both for cloud & onprem environments
 // Added early 2023 as yet another way to standardize decisionmaking of app executions
 func DecideExecution(ctx context.Context, workflowExecution WorkflowExecution, environment string) (WorkflowExecution, []Action) {
+	logger := NewExecutionLogger(ctx, workflowExecution)
+
 	// ensuring always latest
 	newexec, err := GetWorkflowExecution(ctx, workflowExecution.ExecutionId)
 	if err != nil {
-		log.Printf("[ERROR] Failed to get workflow execution in Decide: %s", err)
+		logger.Printf("[ERROR] Failed to get workflow execution in Decide: %s", err)
 	} else {
 		workflowExecution = *newexec
 	}
@@ -23771,7 +24205,7 @@ func DecideExecution(ctx context.Context, workflowExecution WorkflowExecution, e
 	if len(startAction) == 0 {
 		startAction = workflowExecution.Start
 		if len(startAction) == 0 {
-			log.Printf("[WARNING] Didn't find execution start action. Setting it to workflow start action.")
+			logger.Printf("[WARNING] Didn't find execution start action. Setting it to workflow start action.")
 			startAction = workflowExecution.Workflow.Start
 		}
 	}
@@ -23795,13 +24229,13 @@ func DecideExecution(ctx context.Context, workflowExecution WorkflowExecution, e
 	workflowExecution.Results = newResults
 	relevantActions := []Action{}
 
-	log.Printf("[INFO][%s] Inside Decide execution with %d / %d results (extra: %d). Status: %s", workflowExecution.ExecutionId, len(workflowExecution.Results), len(workflowExecution.Workflow.Actions)+extra, extra, workflowExecution.Status)
+	logger.Printf("[INFO] Inside Decide execution with %d / %d results (extra: %d). Status: %s", len(workflowExecution.Results), len(workflowExecution.Workflow.Actions)+extra, extra, workflowExecution.Status)
 
 	if len(startAction) == 0 {
 		startAction = workflowExecution.Start
 
 		if len(startAction) == 0 {
-			log.Printf("[WARNING] Didn't find execution start action. Setting it to workflow start action (%s)", workflowExecution.Workflow.Start)
+			logger.Printf("[WARNING] Didn't find execution start action. Setting it to workflow start action (%s)", workflowExecution.Workflow.Start)
 			startAction = workflowExecution.Workflow.Start
 			workflowExecution.Start = workflowExecution.Workflow.Start
 		}
@@ -23879,7 +24313,7 @@ func DecideExecution(ctx context.Context, workflowExecution WorkflowExecution, e
 	// care if it gets stuck in a loop.
 	// FIXME: Force killing a worker should result in a notification somewhere
 	if len(nextActions) == 0 {
-		log.Printf("[DEBUG] No next action. Finished? Result vs Actions: %d - %d", len(workflowExecution.Results), len(workflowExecution.Workflow.Actions))
+		logger.Printf("[DEBUG] No next action. Finished? Result vs Actions: %d - %d", len(workflowExecution.Results), len(workflowExecution.Workflow.Actions))
 		extra = 0
 
 		for _, trigger := range workflowExecution.Workflow.Triggers {
@@ -23897,7 +24331,7 @@ func DecideExecution(ctx context.Context, workflowExecution WorkflowExecution, e
 		}
 
 		if len(environments) == 1 {
-			log.Printf("[INFO] Should send results to the backend because environments are %s", environments)
+			logger.Printf("[INFO] Should send results to the backend because environments are %s", environments)
 			ValidateFinished(ctx, extra, workflowExecution)
 		}
 
@@ -24010,7 +24444,7 @@ func DecideExecution(ctx context.Context, workflowExecution WorkflowExecution, e
 			for _, parent := range parents[nextAction] {
 				// Check if the parent is also a child. This can ensure continueation no matter what
 				if ArrayContains(childNodes, parent) {
-					log.Printf("[ERROR][%s] Parent %s is also a child of %s. Skipping parent check", workflowExecution.ExecutionId, parent, nextAction)
+					logger.Printf("[ERROR] Parent %s is also a child of %s. Skipping parent check", parent, nextAction)
 					fixed += 1
 					continue
 				}
@@ -24116,7 +24550,7 @@ func DecideExecution(ctx context.Context, workflowExecution WorkflowExecution, e
 					if result.Status == "SUCCESS" || result.Status == "SKIPPED" {
 						parentFinished += 1
 					} else {
-						log.Printf("[WARNING] Parent %s has status %s", result.Action.Label, result.Status)
+						logger.Printf("[WARNING] Parent %s has status %s", result.Action.Label, result.Status)
 					}
 
 					break
@@ -24138,7 +24572,7 @@ func DecideExecution(ctx context.Context, workflowExecution WorkflowExecution, e
 			}
 
 			if branchesFound != parentFinished {
-				log.Printf("[WARNING][%s] Skipping execution of %s (%s) due to unfinished parents (%d/%d). Orig parentlen: %d", workflowExecution.ExecutionId, action.Label, nextAction, parentFinished, branchesFound, parentlen)
+				logger.Printf("[WARNING] Skipping execution of %s (%s) due to unfinished parents (%d/%d). Orig parentlen: %d", action.Label, nextAction, parentFinished, branchesFound, parentlen)
 				continue
 			}
 		}
@@ -24265,7 +24699,7 @@ func DecideExecution(ctx context.Context, workflowExecution WorkflowExecution, e
 					executed = append(executed, action.ID)
 					continue
 				} else {
-					log.Printf("[DEBUG][%s] Should stop after this iteration because it's user-input based.", workflowExecution.ExecutionId)
+					logger.Printf("[DEBUG] Should stop after this iteration because it's user-input based.")
 
 					trigger := Trigger{}
 					for _, innertrigger := range workflowExecution.Workflow.Triggers {
@@ -24278,7 +24712,7 @@ func DecideExecution(ctx context.Context, workflowExecution WorkflowExecution, e
 					trigger.LargeImage = ""
 					triggerData, err := json.Marshal(trigger)
 					if err != nil {
-						log.Printf("[WARNING] Failed unmarshalling action: %s", err)
+						logger.Printf("[WARNING] Failed unmarshalling action: %s", err)
 						triggerData = []byte("Failed unmarshalling. Cancel execution!")
 					}
 
@@ -24302,7 +24736,7 @@ func DecideExecution(ctx context.Context, workflowExecution WorkflowExecution, e
 					workflowExecution.Status = "WAITING"
 					err = SetWorkflowExecution(ctx, workflowExecution, true)
 					if err != nil {
-						log.Printf("[ERROR] Error saving workflow execution actionresult setting: %s", err)
+						logger.Printf("[ERROR] Error saving workflow execution actionresult setting: %s", err)
 						break
 					}
 
@@ -24390,7 +24824,7 @@ func DecideExecution(ctx context.Context, workflowExecution WorkflowExecution, e
 						})
 					}
 
-					log.Printf("[DEBUG][%s] Starting with user input sourcenode '%s'", workflowExecution.ExecutionId, trigger.ID)
+					logger.Printf("[DEBUG] Starting with user input sourcenode '%s'", trigger.ID)
 					action.Parameters = append(action.Parameters, WorkflowAppActionParameter{
 						Name:  "source_node",
 						Value: trigger.ID,
@@ -24404,7 +24838,7 @@ func DecideExecution(ctx context.Context, workflowExecution WorkflowExecution, e
 							log.Printf("[DEBUG] Got syncconfig key: %s", org.SyncConfig.Apikey)
 							syncApikey = org.SyncConfig.Apikey
 						} else {
-							log.Printf("[ERROR] Failed to get org %s: %s", workflowExecution.ExecutionOrg, err)
+							logger.Printf("[ERROR] Failed to get org %s: %s", workflowExecution.ExecutionOrg, err)
 						}
 					}
 
@@ -24421,7 +24855,7 @@ func DecideExecution(ctx context.Context, workflowExecution WorkflowExecution, e
 		// Here it's still in a loop..?
 		_, _, _, _, _, executed, _, _ = GetExecutionVariables(ctx, workflowExecution.ExecutionId)
 		if ArrayContains(visited, action.ID) || ArrayContains(executed, action.ID) {
-			log.Printf("[WARNING][%s] SKIP EXECUTION %s:%s with label %s", workflowExecution.ExecutionId, action.AppName, action.AppVersion, action.Label)
+			logger.Printf("[WARNING] SKIP EXECUTION %s:%s with label %s", action.AppName, action.AppVersion, action.Label)
 			continue
 		} else {
 			// FIXME? This was a test to check if a result was finished or not after a certain time. Not viable for production (obv)
@@ -24831,7 +25265,7 @@ func RunCategoryAction(resp http.ResponseWriter, request *http.Request) {
 		user.ActiveOrg.Id = exec.ExecutionOrg
 	}
 
-	if user.Role == "org-reader" {
+	if Authorize(user, "workflow:execute", "") != nil {
 		log.Printf("[WARNING] Org-reader doesn't have access to run category action: %s (%s)", user.Username, user.Id)
 		resp.WriteHeader(403)
 		resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
@@ -27267,7 +27701,7 @@ func HandleGetenvStats(resp http.ResponseWriter, request *http.Request) {
 		fileId = location[4]
 	}
 
-	if user.Role != "admin" {
+	if Authorize(user, "org:manage", "") != nil {
 		log.Printf("[AUDIT] User isn't admin during stop executions")
 		resp.WriteHeader(409)
 		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Must be admin to perform this action"}`)))
@@ -27830,7 +28264,7 @@ func GetWorkflowRevisions(resp http.ResponseWriter, request *http.Request) {
 			log.Printf("[AUDIT] User %s is accessing workflow %s as admin (get workflow revisions)", user.Username, workflow.ID)
 
 			// Only for Read-Only. No executions or impersonations.
-		} else if project.Environment == "cloud" && user.Verified == true && user.Active == true && user.SupportAccess == true && strings.HasSuffix(user.Username, "@shuffler.io") {
+		} else if hasSupportAccess(request, &user, workflow.OrgId, "read", "workflow", workflow.ID) {
 			log.Printf("[AUDIT] Letting verified support admin %s access workflow revisions for %s", user.Username, workflow.ID)
 
 		} else {
@@ -27905,7 +28339,7 @@ func HandleDeleteOrg(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Role != "admin" {
+	if Authorize(user, "org:manage", "") != nil {
 		log.Printf("[WARNING] Not admin: %s (%s).", user.Username, user.Id)
 		resp.WriteHeader(403)
 		resp.Write([]byte(`{"success": false, "reason": "Not admin"}`))
@@ -27922,7 +28356,7 @@ func HandleDeleteOrg(resp http.ResponseWriter, request *http.Request) {
 
 	foundAdmin := false
 	for _, orgUser := range org.Users {
-		if user.Username == orgUser.Username && orgUser.Role == "admin" {
+		if user.Username == orgUser.Username && hasOrgPermission(orgUser, org.Id, "org:manage") {
 			foundAdmin = true
 			break
 		}
@@ -27962,6 +28396,9 @@ func HandleDeleteOrg(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	// Erase what would otherwise be left behind without an org
+	erased := eraseOrgData(ctx, org)
+
 	// Delete the org
 	err = DeleteKey(ctx, "Organizations", fileId)
 	if err != nil {
@@ -27971,6 +28408,17 @@ func HandleDeleteOrg(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	erased = append(erased, getErasedCount("org", []string{org.Id}, []string{}))
+
+	// The report is kept by the parent, as the org is gone
+	reportOrgId := org.CreatorOrg
+	if len(reportOrgId) == 0 {
+		reportOrgId = org.ManagerOrgs[0].Id
+	}
+
+	reportId := createDeletionReport(ctx, user, reportOrgId, "org", org.Id, org.Name, erased, []ResourceCount{getRetainedAuditEvents(ctx, org, "")})
+	CreateAuditEvent(ctx, request, user, reportOrgId, "org.delete", "org", org.Id, map[string]interface{}{"name": org.Name}, nil)
+
 	newOrgString := []string{}
 	for _, orgId := range user.Orgs {
 		if orgId != fileId {
@@ -28030,7 +28478,7 @@ func HandleDeleteOrg(resp http.ResponseWriter, request *http.Request) {
 	}
 
 	resp.WriteHeader(200)
-	resp.Write([]byte(`{"success": true}`))
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "deletion_report_id": "%s"}`, reportId)))
 }
 
 func AssignAuthEverywhere(ctx context.Context, auth *AppAuthenticationStorage, user User) error {
@@ -28164,7 +28612,7 @@ func HandleWorkflowRunSearch(resp http.ResponseWriter, request *http.Request) {
 				log.Printf("[AUDIT] Letting user %s access workflow %s because it's public", user.Username, workflow.ID)
 
 				// Only for Read-Only. No executions or impersonations.
-			} else if project.Environment == "cloud" && user.Verified == true && user.Active == true && user.SupportAccess == true && strings.HasSuffix(user.Username, "@shuffler.io") {
+			} else if hasSupportAccess(request, &user, workflow.OrgId, "read", "workflow", workflow.ID) {
 				log.Printf("[AUDIT] Letting verified support admin %s access workflow run debug search for %s", user.Username, workflow.ID)
 			} else {
 				log.Printf("[AUDIT] Wrong user (%s) for workflow %s (workflow run search). Verified: %t, Active: %t, SupportAccess: %t, Username: %s", user.Username, workflow.ID, user.Verified, user.Active, user.SupportAccess, user.Username)
@@ -28175,12 +28623,9 @@ func HandleWorkflowRunSearch(resp http.ResponseWriter, request *http.Request) {
 		}
 	}
 
-	chosenOrg := user.ActiveOrg.Id
-	if search.IgnoreOrg == true && user.SupportAccess {
-		chosenOrg = ""
-	}
-
-	runs, cursor, err := GetWorkflowRunsBySearch(ctx, chosenOrg, search)
+	// Searching across orgs isn't covered by any grant. Support users
+	// search the org they were granted access to.
+	runs, cursor, err := GetWorkflowRunsBySearch(ctx, user.ActiveOrg.Id, search)
 	if err != nil {
 		log.Printf("[WARNING] Failed getting workflow runs by search: %s", err)
 		resp.WriteHeader(400)
@@ -28191,9 +28636,7 @@ func HandleWorkflowRunSearch(resp http.ResponseWriter, request *http.Request) {
 	parsedRuns := []WorkflowExecution{}
 	for _, run := range runs {
 		if run.ExecutionOrg != user.ActiveOrg.Id {
-			if !user.SupportAccess {
-				continue
-			}
+			continue
 		}
 
 		parsedRuns = append(parsedRuns, run)
@@ -28372,108 +28815,30 @@ func parseSubflowResults(ctx context.Context, result ActionResult) (ActionResult
 }
 
 func ValidateRequestOverload(resp http.ResponseWriter, request *http.Request, amount ...int) error {
-	// 1. Get current amount of requests for the user
-	// 2. Check if the user is allowed to make more requests
-	// 3. If not, return error
-	// 4. If yes, continue and add the request to the list
-	// Use the GetCache() and SetCache() functions to store the request count
-
 	maxAmount := 4
 	if len(amount) > 0 {
 		maxAmount = amount[0]
 	}
 
 	// Max amount per minute
-	foundIP := GetRequestIp(request)
-
-	portRemoval := strings.Split(foundIP, ":")
-	if len(portRemoval) > 1 {
-		foundIP = strings.Join(portRemoval[:len(portRemoval)-1], ":")
-	}
-
-	//log.Printf("\n\n\nIP: %s\n\n\n", foundIP)
-	if foundIP == "" || foundIP == "127.0.0.1" || foundIP == "::1" || foundIP == "[::1]" {
+	foundIP, err := getRequestOverloadIp(request)
+	if err != nil {
 		log.Printf("[DEBUG] Skipping request overload check for IP: %s", foundIP)
 		return nil
 	}
 
-	// Check if the foundIP includes ONE colon for the port
-	if strings.Count(foundIP, ":") == 1 {
-		foundIP = strings.Split(foundIP, ":")[0]
-	}
-
-	timenow := time.Now().Unix()
-	userRequest := UserRequest{
-		IP:        foundIP,
-		Method:    request.Method,
-		Path:      request.URL.Path,
-		Timestamp: timenow,
-	}
-
-	requestList := []UserRequest{}
-
-	// Maybe do per path? Idk
 	ctx := GetContext(request)
-	cacheKey := fmt.Sprintf("userrequest_%s", userRequest.IP)
-	cache, err := GetCache(ctx, cacheKey)
-	if err != nil {
-		//log.Printf("[ERROR] Failed getting cache for key %s: %s", cacheKey, err)
-		requestList = append(requestList, userRequest)
-
-		b, err := json.Marshal(requestList)
-		if err != nil {
-			log.Printf("[WARNING] Failed marshalling requestlist: %s", err)
-			return nil
-		}
-
-		// Set cache for 1 minute
-		err = SetCache(ctx, cacheKey, b, 1)
-		if err != nil {
-			log.Printf("[ERROR] Failed setting cache for key %s: %s", cacheKey, err)
-			return nil
-		}
-
-		return nil
-	}
-
-	// Parse out the data in the cache
-	cacheData := []byte(cache.([]uint8))
-	err = json.Unmarshal(cacheData, &requestList)
-	if err != nil {
-		log.Printf("[WARNING] Failed unmarshalling requestlist: %s", err)
-		return nil
-	}
-
-	// Remove any item more than 60 seconds back to make a sliding window
-	newList := []UserRequest{}
-	for _, req := range requestList {
-		if req.Timestamp < (timenow - 60) {
-			continue
-		}
-
-		newList = append(newList, req)
-	}
-
-	if len(newList) >= maxAmount {
-		// FIXME: Should we add to the list even if we return an error?
-
+	result := takeRateLimitTokens(ctx, []rateLimitKey{{
+		Key:       fmt.Sprintf("userrequest_%s", foundIP),
+		PerMinute: maxAmount,
+		Capacity:  maxAmount,
+	}})
+
+	setRateLimitHeaders(resp, result)
+	if !result.Allowed {
 		return errors.New("Too many requests")
 	}
 
-	//log.Printf("[DEBUG] Adding request to list")
-	newList = append(newList, userRequest)
-	b, err := json.Marshal(newList)
-	if err != nil {
-		log.Printf("[ERROR] Failed marshalling requestlist: %s", err)
-		return nil
-	}
-
-	// Set cache for 1 minute
-	err = SetCache(ctx, cacheKey, b, 1)
-	if err != nil {
-		log.Printf("[ERROR] Failed setting cache for key %s: %s", cacheKey, err)
-	}
-
 	return nil
 }
 
@@ -28993,7 +29358,7 @@ func GetChildWorkflows(resp http.ResponseWriter, request *http.Request) {
 			log.Printf("[AUDIT] User %s is accessing workflow %s as admin (get child workflows)", user.Username, workflow.ID)
 
 			// Only for Read-Only. No executions or impersonations.
-		} else if project.Environment == "cloud" && user.Verified == true && user.Active == true && user.SupportAccess == true && strings.HasSuffix(user.Username, "@shuffler.io") {
+		} else if hasSupportAccess(request, &user, workflow.OrgId, "read", "workflow", workflow.ID) {
 			log.Printf("[AUDIT] Letting verified support admin %s access childs workflows for %s", user.Username, workflow.ID)
 
 		} else {
@@ -29557,7 +29922,7 @@ func GetWorkflowValidation(resp http.ResponseWriter, request *http.Request) {
 			log.Printf("[AUDIT] User %s is accessing workflow %s as admin (get workflow revisions)", user.Username, workflow.ID)
 
 			// Only for Read-Only. No executions or impersonations.
-		} else if project.Environment == "cloud" && user.Verified == true && user.Active == true && user.SupportAccess == true && strings.HasSuffix(user.Username, "@shuffler.io") {
+		} else if hasSupportAccess(request, &user, workflow.OrgId, "read", "workflow", workflow.ID) {
 			log.Printf("[AUDIT] Letting verified support admin %s access workflow revisions for %s", user.Username, workflow.ID)
 
 		} else {
@@ -142,7 +142,7 @@ func HandleNewWidget(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Role == "org-reader" {
+	if Authorize(user, "stats:write", "") != nil {
 		log.Printf("[WARNING] Org-reader doesn't have access to make new widgets: %s (%s)", user.Username, user.Id)
 		resp.WriteHeader(401)
 		resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
@@ -531,7 +531,7 @@ func HandleGetStatistics(resp http.ResponseWriter, request *http.Request) {
 		}
 	}
 
-	if user.SupportAccess {
+	if !userFound && hasSupportAccess(request, &user, org.Id, "read", "org", org.Id) {
 		log.Printf("[AUDIT] User %s (%s) is getting org stats for %s (%s) with support access", user.Username, user.Id, org.Name, orgId)
 		userFound = true
 	}
@@ -698,7 +698,7 @@ func HandleAppendStatistics(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if user.Role == "org-reader" {
+	if Authorize(user, "stats:write", "") != nil {
 		log.Printf("[WARNING] Org-reader doesn't have access to add stats: %s (%s)", user.Username, user.Id)
 		resp.WriteHeader(403)
 		resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
@@ -1,11 +1,14 @@
 package shuffle
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"log"
-	"strings"
 	"net/http"
-	"io/ioutil"
-	"fmt"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -54,13 +57,13 @@ func HandleStreamWorkflowUpdate(resp http.ResponseWriter, request *http.Request)
 	}
 
 	if user.Id != workflow.Owner || len(user.Id) == 0 {
-		if workflow.OrgId == user.ActiveOrg.Id && user.Role != "org-reader" {
+		if Authorize(user, "workflow:write", workflow.OrgId) == nil {
 			log.Printf("[AUDIT] User %s is accessing workflow %s as admin (SET workflow stream)", user.Username, workflow.ID)
 
 			//} else if workflow.Public {
 			//log.Printf("[AUDIT] Letting user %s access workflow %s for streaming because it's public (SET workflow stream)", user.Username, workflow.ID)
 
-		} else if project.Environment == "cloud" && user.Verified == true && user.SupportAccess == true && user.Role == "admin" {
+		} else if hasSupportAccess(request, &user, workflow.OrgId, "write", "workflow", workflow.ID) {
 			log.Printf("[AUDIT] Letting verified support admin %s access workflow %s", user.Username, workflow.ID)
 
 		} else {
@@ -79,23 +82,49 @@ func HandleStreamWorkflowUpdate(resp http.ResponseWriter, request *http.Request)
 		return
 	}
 
-	/*
-	streamKey := fmt.Sprintf("%s_stream_users", workflow.ID)
-	cache, err = GetCache(ctx, streamKey, user.Id, 30)
-	if err != nil {
-		log.Printf("[WARNING] Failed setting cache for apikey: %s", err)
-	} else {
-		// We are here to get the users in the stream
-		cacheData := []byte(cache.([]uint8))
+	var op WorkflowEditOperation
+	err = json.Unmarshal(body, &op)
+	if err == nil && op.Type == "presence" {
+		var presence CollaboratorPresence
+		json.Unmarshal(body, &presence)
+		presence.UserId = user.Id
+		presence.Username = user.Username
+
+		collaborators := UpdateCollaboratorPresence(ctx, workflow.ID, presence, false)
+		newjson, err := json.Marshal(collaborators)
+		if err != nil {
+			newjson = []byte("[]")
+		}
+
+		resp.WriteHeader(200)
+		resp.Write([]byte(fmt.Sprintf(`{"success": true, "collaborators": %s}`, newjson)))
+		return
+	}
+
+	if err == nil && len(op.Type) > 0 {
+		op.UserId = user.Id
+		op.Username = user.Username
+
+		newOp, err := ApplyWorkflowOperation(ctx, *workflow, op)
+		if err != nil {
+			log.Printf("[INFO] Rejected %s operation from %s on workflow %s: %s", op.Type, user.Username, workflow.ID, err)
+			resp.WriteHeader(409)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, strings.Replace(err.Error(), "\"", "\\\"", -1))))
+			return
+		}
+
+		resp.WriteHeader(200)
+		resp.Write([]byte(fmt.Sprintf(`{"success": true, "seq": %d}`, newOp.Seq)))
+		return
 	}
-	*/
 
-	// FIXME: Should append to the stream and keep some items in memory
-	// Not just purely overwrite it
-	sessionKey := fmt.Sprintf("%s_stream", workflow.ID)
-	err = SetCache(ctx, sessionKey, body, 30)
+	// Older clients send the full workflow. Pushed as-is to everyone else.
+	err = SetWorkflowCollabUpdate(ctx, workflow.ID, user.Id, body)
 	if err != nil {
-		log.Printf("[WARNING] Failed setting cache for apikey: %s", err)
+		log.Printf("[WARNING] Failed storing workflow update for %s: %s", workflow.ID, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
 	}
 
 	resp.WriteHeader(200)
@@ -149,13 +178,13 @@ func HandleStreamWorkflow(resp http.ResponseWriter, request *http.Request) {
 
 	if user.Id != workflow.Owner || len(user.Id) == 0 {
 
-		if workflow.OrgId == user.ActiveOrg.Id && (user.Role == "admin" || user.Role == "org-reader") {
+		if Authorize(user, "workflow:read", workflow.OrgId) == nil {
 			log.Printf("[AUDIT] User %s is accessing workflow %s as admin (stream edit workflow)", user.Username, workflow.ID)
 
 		} else if workflow.Public {
 			log.Printf("[AUDIT] Letting user %s access workflow %s for streaming because it's public (get workflow stream)", user.Username, workflow.ID)
 
-		} else if project.Environment == "cloud" && user.Verified == true && user.Active == true && user.SupportAccess == true && strings.HasSuffix(user.Username, "@shuffler.io") {
+		} else if hasSupportAccess(request, &user, workflow.OrgId, "read", "workflow", workflow.ID) {
 			log.Printf("[AUDIT] Letting verified support admin %s access workflow %s", user.Username, workflow.ID)
 		} else {
 			log.Printf("[AUDIT] Wrong user (%s) for workflow %s (get workflow stream)", user.Username, workflow.ID)
@@ -167,63 +196,342 @@ func HandleStreamWorkflow(resp http.ResponseWriter, request *http.Request) {
 
 	// FIXME: If public, it should ONLY allow you to set certain actions
 
-	resp.Header().Set("Connection", "Keep-Alive")
-	resp.Header().Set("X-Content-Type-Options", "nosniff")
+	lastSeq := int64(0)
+	lastSeqHeader := request.Header.Get("Last-Event-ID")
+	if len(lastSeqHeader) == 0 {
+		lastSeqHeader = request.URL.Query().Get("since")
+	}
+
+	if len(lastSeqHeader) > 0 {
+		lastSeq, err = strconv.ParseInt(lastSeqHeader, 10, 64)
+		if err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(`{"success": false, "reason": "Invalid Last-Event-ID"}`))
+			return
+		}
+	}
 
 	conn, ok := resp.(http.Flusher)
 	if !ok {
 		log.Printf("[ERROR] Flusher error: %t", ok)
-		http.Error(resp, "Streaming supported on AppEngine", http.StatusInternalServerError)
+		http.Error(resp, "Streaming not supported", http.StatusInternalServerError)
 		return
 	}
 
 	resp.Header().Set("Content-Type", "text/event-stream")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.Header().Set("Connection", "keep-alive")
+	resp.Header().Set("X-Content-Type-Options", "nosniff")
+	resp.Header().Set("X-Accel-Buffering", "no")
 	resp.WriteHeader(http.StatusOK)
 
+	// Subscribe before reading the log so no operation is missed in between
+	channel := workflowCollabHub.subscribe(workflow.ID)
+	defer workflowCollabHub.unsubscribe(workflow.ID, channel)
 
-	sessionKey := fmt.Sprintf("%s_stream", workflow.ID)
-	previousCache := []byte{}
+	if len(user.Id) > 0 {
+		UpdateCollaboratorPresence(ctx, workflow.ID, CollaboratorPresence{
+			UserId:   user.Id,
+			Username: user.Username,
+		}, false)
+
+		defer UpdateCollaboratorPresence(context.Background(), workflow.ID, CollaboratorPresence{
+			UserId:   user.Id,
+			Username: user.Username,
+		}, true)
+	}
+
+	// Catches up from the log, or sends the merged workflow if the log
+	// no longer goes back far enough
+	stream := &workflowCollabStream{
+		workflow: *workflow,
+		userId:   user.Id,
+		lastSeq:  lastSeq,
+	}
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+
+	poll := time.NewTicker(workflowCollabPollInterval)
+	defer poll.Stop()
 	for {
-		cache, err := GetCache(ctx, sessionKey)
-		if err == nil {
+		for _, event := range stream.nextEvents(ctx) {
+			_, err := fmt.Fprint(resp, event)
+			if err != nil {
+				log.Printf("[WARNING] Failed in writing stream to user '%s' (%s): %s", user.Username, user.Id, err)
+				return
+			}
+		}
 
-			cacheData := []byte(cache.([]uint8))
-			if string(previousCache) == string(cacheData) {
-				//log.Printf("[DEBUG] Still same cache for %s", user.Id)
-			} else {
+		conn.Flush()
 
-				// A way to only check for data from other people
-				if (len(user.Id) > 0 && !strings.Contains(string(cacheData), user.Id)) || len(user.Id) == 0 {
-					//log.Printf("[DEBUG] NEW cache for %s (1) - sending: %s.", user.Id, cacheData)
+		select {
+		case <-request.Context().Done():
+			return
+		case <-heartbeat.C:
+			_, err := fmt.Fprintf(resp, ": heartbeat\n\n")
+			if err != nil {
+				return
+			}
+		case <-poll.C:
+		case <-channel:
+		}
+	}
+}
 
-					//fw.Write(cacheData)
-					//w.Write(cacheData)
+// Max events kept per execution for resuming with Last-Event-ID
+var maxExecutionStreamEvents = 500
 
-					_, err := fmt.Fprintf(resp, string(cacheData))
-					if err != nil {
-						log.Printf("[ERROR] Failed in writing stream to user '%s' (%s): %s", user.Username, user.Id, err)
+// Max result size sent in a stream event. Fetch the execution for the full result.
+var maxExecutionStreamResult = 10000
 
-						if strings.Contains(err.Error(), "broken pipe") { 
-							break
-						}
-					} else {
-						previousCache = cacheData
-						conn.Flush()
-					}
+// Every execution event is stored in its own cache key, and is only added once per
+// event key. No lock is needed even when the execution is saved from multiple instances.
+func getExecutionStreamEventKey(event ExecutionStreamEvent) string {
+	if event.Type == "execution_started" || event.Type == "execution_finished" {
+		return event.Type
+	}
 
-				} else {
-					//log.Printf("[ERROR] NEW cache for %s (2) - NOT sending: %s.", user.Id, cacheData)
+	return fmt.Sprintf("%s_%s", event.ActionId, event.Status)
+}
 
-					previousCache = cacheData
-				}
+// All events that describe the execution as it is now
+func getExecutionStreamEvents(workflowExecution WorkflowExecution) []ExecutionStreamEvent {
+	events := []ExecutionStreamEvent{}
+	if len(workflowExecution.Status) > 0 {
+		events = append(events, ExecutionStreamEvent{
+			Type:   "execution_started",
+			Status: workflowExecution.Status,
+		})
+	}
 
-			}
+	for _, result := range workflowExecution.Results {
+		if len(result.Action.ID) == 0 || len(result.Status) == 0 {
+			continue
+		}
+
+		event := ExecutionStreamEvent{
+			ActionId:    result.Action.ID,
+			ActionLabel: result.Action.Label,
+			Status:      result.Status,
+		}
+
+		if result.Status == "SKIPPED" {
+			event.Type = "action_skipped"
+		} else if result.Status == "EXECUTING" {
+			event.Type = "action_started"
+		} else if result.Status == "WAITING" {
+			event.Type = "action_waiting"
 		} else {
-			//log.Printf("[DEBUG] Failed getting cache for %s: %s", user.Id, err)
+			event.Type = "action_result"
+			event.Result = result.Result
+			if len(event.Result) > maxExecutionStreamResult {
+				event.Result = event.Result[:maxExecutionStreamResult]
+				event.Truncated = true
+			}
+		}
+
+		events = append(events, event)
+	}
+
+	if workflowExecution.Status == "FINISHED" || workflowExecution.Status == "ABORTED" || workflowExecution.Status == "FAILURE" {
+		events = append(events, ExecutionStreamEvent{
+			Type:   "execution_finished",
+			Status: workflowExecution.Status,
+		})
+	}
+
+	return events
+}
+
+// Stores the events that haven't been streamed yet. Called every time an execution is saved.
+func recordExecutionStreamEvents(ctx context.Context, workflowExecution WorkflowExecution) {
+	timeNow := time.Now().Unix()
+	for _, event := range getExecutionStreamEvents(workflowExecution) {
+		eventKey := fmt.Sprintf("execution_stream_%s_key_%s", workflowExecution.ExecutionId, getExecutionStreamEventKey(event))
+		err := AddCache(ctx, eventKey, []byte("1"), 3600)
+		if err != nil {
+			continue
+		}
+
+		event.Id, err = IncrementCacheCounter(ctx, fmt.Sprintf("execution_stream_%s_last_id", workflowExecution.ExecutionId), 60)
+		if err != nil {
+			log.Printf("[WARNING] Failed getting execution stream ID for %s: %s", workflowExecution.ExecutionId, err)
+			DeleteCache(ctx, eventKey)
+			continue
+		}
+
+		event.ExecutionId = workflowExecution.ExecutionId
+		event.Timestamp = timeNow
+		data, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("[WARNING] Failed marshalling execution stream event for %s: %s", workflowExecution.ExecutionId, err)
+			continue
+		}
+
+		err = SetCache(ctx, fmt.Sprintf("execution_stream_%s_%d", workflowExecution.ExecutionId, event.Id), data, 60)
+		if err != nil {
+			log.Printf("[WARNING] Failed setting execution stream event for %s: %s", workflowExecution.ExecutionId, err)
+		}
+	}
+}
+
+// Returns the events after lastEventId, up to the first one that has an ID
+// but isn't written yet, and the latest ID given out.
+func getExecutionStreamEventsSince(ctx context.Context, executionId string, lastEventId int64) ([]ExecutionStreamEvent, int64) {
+	events := []ExecutionStreamEvent{}
+	lastId := GetCacheCounter(ctx, fmt.Sprintf("execution_stream_%s_last_id", executionId))
+	if lastId-lastEventId > int64(maxExecutionStreamEvents) {
+		lastEventId = lastId - int64(maxExecutionStreamEvents)
+	}
+
+	for eventId := lastEventId + 1; eventId <= lastId; eventId++ {
+		cache, err := GetCache(ctx, fmt.Sprintf("execution_stream_%s_%d", executionId, eventId))
+		if err != nil {
+			break
+		}
+
+		event := ExecutionStreamEvent{}
+		err = json.Unmarshal([]byte(cache.([]uint8)), &event)
+		if err != nil {
+			log.Printf("[WARNING] Failed unmarshalling execution stream event %d for %s: %s", eventId, executionId, err)
+			break
 		}
 
-		// FIXME: This is a hack to make sure we don't fully utilize the thread 
-		time.Sleep(100 * time.Millisecond)
+		events = append(events, event)
 	}
+
+	return events, lastId
 }
 
+// Streams execution events as Server-Sent Events: /api/v1/streams/executions/{id}
+// Same access as the execution itself. Resume with the Last-Event-ID header or ?last_event_id=
+func HandleStreamExecution(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	location := strings.Split(strings.Split(request.URL.String(), "?")[0], "/")
+	if len(location) <= 5 || len(location[5]) != 36 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Valid execution ID required"}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	workflowExecution, err := GetWorkflowExecution(ctx, location[5])
+	if err != nil {
+		log.Printf("[WARNING] Failed getting execution %s for stream: %s", location[5], err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if !checkExecutionAccess(resp, request, *workflowExecution) {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	lastEventId := int64(0)
+	lastEventHeader := request.Header.Get("Last-Event-ID")
+	if len(lastEventHeader) == 0 {
+		lastEventHeader = request.URL.Query().Get("last_event_id")
+	}
+
+	if len(lastEventHeader) > 0 {
+		lastEventId, err = strconv.ParseInt(lastEventHeader, 10, 64)
+		if err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(`{"success": false, "reason": "Invalid Last-Event-ID"}`))
+			return
+		}
+	}
+
+	conn, ok := resp.(http.Flusher)
+	if !ok {
+		log.Printf("[ERROR] Flusher error: %t", ok)
+		http.Error(resp, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "text/event-stream")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.Header().Set("Connection", "keep-alive")
+	resp.Header().Set("X-Accel-Buffering", "no")
+	resp.WriteHeader(http.StatusOK)
+
+	// Executions that were done before streaming was added have no events.
+	// Recording is idempotent, so this never adds duplicates.
+	if lastEventId == 0 {
+		recordExecutionStreamEvents(ctx, *workflowExecution)
+	}
+
+	heartbeat := time.Now()
+	gapSince := time.Time{}
+	for {
+		select {
+		case <-request.Context().Done():
+			return
+		default:
+		}
+
+		finished := false
+		events, lastId := getExecutionStreamEventsSince(ctx, workflowExecution.ExecutionId, lastEventId)
+		for _, event := range events {
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+
+			_, err = fmt.Fprintf(resp, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Type, data)
+			if err != nil {
+				log.Printf("[WARNING] Failed writing execution stream for %s: %s", workflowExecution.ExecutionId, err)
+				return
+			}
+
+			lastEventId = event.Id
+			heartbeat = time.Now()
+			if event.Type == "execution_finished" {
+				finished = true
+			}
+		}
+
+		// An event that got an ID is written right after. If it never is, e.g.
+		// because the instance writing it stopped, it is skipped.
+		if len(events) > 0 {
+			gapSince = time.Time{}
+		}
+
+		if lastEventId < lastId {
+			if gapSince.IsZero() {
+				gapSince = time.Now()
+			} else if time.Since(gapSince) > 10*time.Second {
+				log.Printf("[WARNING] Skipping missing execution stream event %d for %s", lastEventId+1, workflowExecution.ExecutionId)
+				lastEventId += 1
+				gapSince = time.Time{}
+			}
+		} else {
+			gapSince = time.Time{}
+		}
+
+		if finished {
+			conn.Flush()
+			return
+		}
+
+		// Keeps proxies from closing the connection
+		if time.Since(heartbeat) > 15*time.Second {
+			_, err := fmt.Fprintf(resp, ": heartbeat\n\n")
+			if err != nil {
+				return
+			}
+
+			heartbeat = time.Now()
+		}
+
+		conn.Flush()
+		time.Sleep(250 * time.Millisecond)
+	}
+}
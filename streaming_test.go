@@ -0,0 +1,124 @@
+package shuffle
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRecordExecutionStreamEvents(t *testing.T) {
+	ctx := context.Background()
+	execution := WorkflowExecution{
+		ExecutionId: "stream-test-execution",
+		Status:      "EXECUTING",
+		Results: []ActionResult{
+			{Action: Action{ID: "action1", Label: "first"}, Status: "EXECUTING"},
+		},
+	}
+
+	recordExecutionStreamEvents(ctx, execution)
+	events, lastId := getExecutionStreamEventsSince(ctx, execution.ExecutionId, 0)
+	if len(events) != 2 || lastId != 2 || events[0].Type != "execution_started" || events[1].Type != "action_started" {
+		t.Fatalf("Events after start = %#v (%d); expected execution_started and action_started", events, lastId)
+	}
+
+	// Saving the same execution again adds nothing
+	recordExecutionStreamEvents(ctx, execution)
+	if events, _ := getExecutionStreamEventsSince(ctx, execution.ExecutionId, lastId); len(events) > 0 {
+		t.Errorf("Duplicate events were recorded: %#v", events)
+	}
+
+	execution.Status = "FINISHED"
+	execution.Results[0].Status = "SUCCESS"
+	execution.Results[0].Result = strings.Repeat("a", maxExecutionStreamResult+1)
+	recordExecutionStreamEvents(ctx, execution)
+
+	events, lastId = getExecutionStreamEventsSince(ctx, execution.ExecutionId, 2)
+	if len(events) != 2 || lastId != 4 || events[0].Type != "action_result" || events[1].Type != "execution_finished" {
+		t.Fatalf("Events after finishing = %#v; expected action_result and execution_finished", events)
+	}
+
+	if !events[0].Truncated || len(events[0].Result) != maxExecutionStreamResult {
+		t.Errorf("Large result wasn't truncated: %d", len(events[0].Result))
+	}
+}
+
+func TestRecordExecutionStreamEventsConcurrently(t *testing.T) {
+	ctx := context.Background()
+	execution := WorkflowExecution{ExecutionId: "stream-test-concurrent", Status: "EXECUTING"}
+	for i := 0; i < 20; i++ {
+		execution.Results = append(execution.Results, ActionResult{Action: Action{ID: fmt.Sprintf("action%d", i)}, Status: "SUCCESS"})
+	}
+
+	// Like several instances saving the same execution at once
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recordExecutionStreamEvents(ctx, execution)
+		}()
+	}
+
+	wg.Wait()
+	events, lastId := getExecutionStreamEventsSince(ctx, execution.ExecutionId, 0)
+	if len(events) != 21 || lastId != 21 {
+		t.Fatalf("Got %d events with last ID %d; expected 21 unique events", len(events), lastId)
+	}
+
+	seen := map[string]bool{}
+	for index, event := range events {
+		if event.Id != int64(index+1) {
+			t.Errorf("Event %d has ID %d", index, event.Id)
+		}
+
+		key := getExecutionStreamEventKey(event)
+		if seen[key] {
+			t.Errorf("Event %s was recorded twice", key)
+		}
+
+		seen[key] = true
+	}
+}
+
+func TestGetExecutionStreamEventsSinceGap(t *testing.T) {
+	ctx := context.Background()
+	executionId := "stream-test-gap"
+	execution := WorkflowExecution{ExecutionId: executionId, Status: "EXECUTING"}
+	recordExecutionStreamEvents(ctx, execution)
+
+	// An ID that was given out, but not written yet
+	IncrementCacheCounter(ctx, fmt.Sprintf("execution_stream_%s_last_id", executionId), 60)
+	execution.Status = "FINISHED"
+	recordExecutionStreamEvents(ctx, execution)
+
+	events, lastId := getExecutionStreamEventsSince(ctx, executionId, 0)
+	if len(events) != 1 || lastId != 3 {
+		t.Errorf("Events = %#v (%d); expected to stop before the missing event", events, lastId)
+	}
+
+	events, _ = getExecutionStreamEventsSince(ctx, executionId, 2)
+	if len(events) != 1 || events[0].Type != "execution_finished" {
+		t.Errorf("Events after the missing event = %#v; expected execution_finished", events)
+	}
+}
+
+func TestIncrementCacheCounter(t *testing.T) {
+	ctx := context.Background()
+	if GetCacheCounter(ctx, "counter_test") != 0 {
+		t.Errorf("Missing counter isn't 0")
+	}
+
+	for i := int64(1); i <= 3; i++ {
+		value, err := IncrementCacheCounter(ctx, "counter_test", 1)
+		if err != nil || value != i {
+			t.Errorf("IncrementCacheCounter = %d, %v; expected %d", value, err, i)
+		}
+	}
+
+	if GetCacheCounter(ctx, "counter_test") != 3 {
+		t.Errorf("GetCacheCounter = %d; expected 3", GetCacheCounter(ctx, "counter_test"))
+	}
+}
@@ -1,6 +1,7 @@
 package shuffle
 
 import (
+	"encoding/json"
 	"encoding/xml"
 	"time"
 )
@@ -134,7 +135,8 @@ type ExecutionRequest struct {
 	Type              string   `json:"type"`
 	Priority          int64    `json:"priority" datastore:"priority" yaml:"priority"` // Mapped back to workflowexecutions' priority
 
-	Authgroup string `json:"authgroup" datastore:"authgroup"`
+	Authgroup   string `json:"authgroup" datastore:"authgroup"`
+	TraceParent string `json:"traceparent,omitempty" datastore:"traceparent,noindex"`
 }
 
 type RetStruct struct {
@@ -527,6 +529,25 @@ type MFAInfo struct {
 	Active       bool   `datastore:"active" json:"active"`
 	ActiveCode   string `datastore:"active_code" json:"active_code"`
 	PreviousCode string `datastore:"previous_code" json:"previous_code"`
+
+	// WebAuthn keys and passkeys. Any of them can be used instead of the HOTP code
+	Authenticators []WebAuthnAuthenticator `datastore:"authenticators,noindex" json:"authenticators"`
+	RecoveryCodes  []string                `datastore:"recovery_codes,noindex" json:"recovery_codes,omitempty"` // SHA-256 of unused codes
+}
+
+type WebAuthnAuthenticator struct {
+	Id              string   `datastore:"id" json:"id"`
+	Name            string   `datastore:"name" json:"name"`
+	CredentialId    []byte   `datastore:"credential_id,noindex" json:"credential_id"`
+	PublicKey       []byte   `datastore:"public_key,noindex" json:"public_key"`
+	AttestationType string   `datastore:"attestation_type,noindex" json:"attestation_type"`
+	Transport       []string `datastore:"transport,noindex" json:"transport"`
+	AAGUID          []byte   `datastore:"aaguid,noindex" json:"aaguid"`
+	SignCount       uint32   `datastore:"sign_count,noindex" json:"sign_count"`
+	BackupEligible  bool     `datastore:"backup_eligible,noindex" json:"backup_eligible"`
+	BackupState     bool     `datastore:"backup_state,noindex" json:"backup_state"`
+	Created         int64    `datastore:"created" json:"created"`
+	LastUsed        int64    `datastore:"last_used" json:"last_used"`
 }
 
 type PublicProfile struct {
@@ -588,6 +609,7 @@ type User struct {
 	Roles                []string      `datastore:"roles" json:"roles"`
 	VerificationToken    string        `datastore:"verification_token" json:"verification_token"`
 	ApiKey               string        `datastore:"apikey" json:"apikey"`
+	ApiKeyCreated        int64         `datastore:"apikey_created" json:"apikey_created"`
 	ResetReference       string        `datastore:"reset_reference" json:"reset_reference"`
 	Executions           ExecutionInfo `datastore:"executions" json:"executions"`
 	Limits               UserLimits    `datastore:"limits" json:"limits,omitempty"`
@@ -614,6 +636,29 @@ type User struct {
 	LoginInfo    []LoginInfo  `datastore:"login_info" json:"login_info"`
 	PersonalInfo PersonalInfo `datastore:"personal_info" json:"personal_info"`
 	Regions      []string     `datastore:"regions" json:"regions"`
+
+	// Password policy tracking
+	PasswordHistory []string `datastore:"password_history,noindex" json:"password_history,omitempty"`
+	PasswordChanged int64    `datastore:"password_changed" json:"password_changed"`
+	LockedUntil     int64    `datastore:"locked_until,noindex" json:"locked_until"`
+
+	// ID of the user in the identity provider that provisioned it
+	ExternalId string `datastore:"external_id" json:"external_id"`
+
+	// Service accounts belong to one org, can't log in and only
+	// authenticate with scoped API keys
+	ServiceAccount bool   `datastore:"service_account" json:"service_account"`
+	Description    string `datastore:"description,noindex" json:"description,omitempty"`
+	CreatedBy      string `datastore:"created_by" json:"created_by,omitempty"`
+
+	// Set when authenticated with a scoped API key. Never stored
+	ApiKeyId        string   `datastore:"-" json:"-"`
+	ApiKeyScopes    []string `datastore:"-" json:"-"`
+	ApiKeyWorkflows []string `datastore:"-" json:"-"`
+
+	// "read" or "write" when a support user got into the org through
+	// a support grant. Never stored
+	SupportGrantAccess string `datastore:"-" json:"-"`
 }
 
 type EthInfo struct {
@@ -624,8 +669,24 @@ type EthInfo struct {
 type Session struct {
 	Username string `datastore:"Username,noindex"`
 	Id       string `datastore:"Id,noindex"`
-	UserId   string `datastore:"user_id,noindex"`
+	UserId   string `datastore:"user_id"`
 	Session  string `datastore:"session,noindex"`
+
+	// Sessions without a creation time were made before sessions were tracked
+	Created      int64  `json:"created" datastore:"created,noindex"`
+	LastActivity int64  `json:"last_activity" datastore:"last_activity,noindex"`
+	IP           string `json:"ip" datastore:"ip,noindex"`
+	UserAgent    string `json:"user_agent" datastore:"user_agent,noindex"`
+}
+
+// What users see of their sessions. The session token itself is never returned
+type SessionInfo struct {
+	Id           string `json:"id"`
+	Created      int64  `json:"created"`
+	LastActivity int64  `json:"last_activity"`
+	IP           string `json:"ip"`
+	UserAgent    string `json:"user_agent"`
+	Current      bool   `json:"current"`
 }
 
 type Contact struct {
@@ -704,6 +765,7 @@ type ScheduleOld struct {
 	Frequency            string       `json:"frequency" datastore:"frequency,noindex"`
 	Environment          string       `json:"environment" datastore:"environment"`
 	Status               string       `json:"status" datastore:"status"`
+	Calendars            []string     `json:"calendars" datastore:"calendars"` // Maintenance calendars that can suppress the schedule
 }
 
 // Returned from /GET /schedules
@@ -808,21 +870,54 @@ type HookAction struct {
 }
 
 type Hook struct {
-	Id             string       `json:"id" datastore:"id"`
-	Start          string       `json:"start" datastore:"start"`
-	Info           Info         `json:"info" datastore:"info"`
-	Actions        []HookAction `json:"actions" datastore:"actions,noindex"`
-	Type           string       `json:"type" datastore:"type"`
-	Owner          string       `json:"owner" datastore:"owner"`
-	Status         string       `json:"status" datastore:"status"`
-	Workflows      []string     `json:"workflows" datastore:"workflows"`
-	Running        bool         `json:"running" datastore:"running"`
-	OrgId          string       `json:"org_id" datastore:"org_id"`
-	Environment    string       `json:"environment" datastore:"environment"`
-	Auth           string       `json:"auth" datastore:"auth"`
-	CustomResponse string       `json:"custom_response" datastore:"custom_response"`
-	Version        string       `json:"version" datastore:"version"`
-	VersionTimeout int          `json:"version_timeout" datastore:"version_timeout"`
+	Id             string        `json:"id" datastore:"id"`
+	Start          string        `json:"start" datastore:"start"`
+	Info           Info          `json:"info" datastore:"info"`
+	Actions        []HookAction  `json:"actions" datastore:"actions,noindex"`
+	Type           string        `json:"type" datastore:"type"`
+	Owner          string        `json:"owner" datastore:"owner"`
+	Status         string        `json:"status" datastore:"status"`
+	Workflows      []string      `json:"workflows" datastore:"workflows"`
+	Running        bool          `json:"running" datastore:"running"`
+	OrgId          string        `json:"org_id" datastore:"org_id"`
+	Environment    string        `json:"environment" datastore:"environment"`
+	Auth           string        `json:"auth" datastore:"auth"`
+	CustomResponse string        `json:"custom_response" datastore:"custom_response"`
+	Version        string        `json:"version" datastore:"version"`
+	VersionTimeout int           `json:"version_timeout" datastore:"version_timeout"`
+	Calendars      []string      `json:"calendars" datastore:"calendars"` // Maintenance calendars that can suppress the hook
+	Signature      HookSignature `json:"signature" datastore:"signature,noindex"`
+	PayloadSchema  string        `json:"payload_schema" datastore:"payload_schema,noindex"` // JSON Schema the body has to match
+	Transform      HookTransform `json:"transform" datastore:"transform,noindex"`
+}
+
+// Normalises a webhook payload before it becomes the execution argument
+type HookTransform struct {
+	KeepOriginal bool               `json:"keep_original" datastore:"keep_original"` // Add mapped fields to the original payload instead of a new object
+	Mappings     []HookFieldMapping `json:"mappings" datastore:"mappings"`
+}
+
+// Source is a JMESPath expression such as "alert.items[0].id". Destination is a dotted path
+type HookFieldMapping struct {
+	Source      string `json:"source" datastore:"source"`
+	Destination string `json:"destination" datastore:"destination"`
+	Default     string `json:"default,omitempty" datastore:"default"`
+	Required    bool   `json:"required,omitempty" datastore:"required"`
+}
+
+// Signature verification for incoming webhook requests.
+// Scheme: github, stripe, slack or hmac (generic). Empty = disabled
+type HookSignature struct {
+	Scheme          string `json:"scheme" datastore:"scheme"`
+	Secret          string `json:"secret" datastore:"secret,noindex"`
+	Header          string `json:"header,omitempty" datastore:"header"`                     // hmac: header containing the signature. Default X-Signature
+	Algorithm       string `json:"algorithm,omitempty" datastore:"algorithm"`               // hmac: sha256 (default) or sha1
+	Encoding        string `json:"encoding,omitempty" datastore:"encoding"`                 // hmac: hex (default) or base64
+	Prefix          string `json:"prefix,omitempty" datastore:"prefix"`                     // hmac: prefix in front of the signature, e.g. "sha256="
+	TimestampHeader string `json:"timestamp_header,omitempty" datastore:"timestamp_header"` // hmac: if set, "<timestamp>.<body>" is signed
+	NonceHeader     string `json:"nonce_header,omitempty" datastore:"nonce_header"`         // hmac: header with a unique delivery ID. Required without a timestamp header
+	Tolerance       int64  `json:"tolerance,omitempty" datastore:"tolerance"`               // Max age of a timestamped request in seconds. Default 300
+	SecretEncrypted bool   `json:"secret_encrypted" datastore:"secret_encrypted"`
 }
 
 type RegionBody struct {
@@ -920,6 +1015,136 @@ type Org struct {
 	EulaSigned   bool    `json:"eula_signed" datastore:"eula_signed"`
 	EulaSignedBy string  `json:"eula_signed_by" datastore:"eula_signed_by"`
 	Billing      Billing `json:"Billing" datastore:"Billing"`
+
+	PasswordPolicy PasswordPolicy `json:"password_policy" datastore:"password_policy"`
+	ScimConfig     ScimConfig     `json:"scim_config" datastore:"scim_config"`
+	SamlConfig     SamlConfig     `json:"saml_config" datastore:"saml_config"`
+	OidcConfig     OidcConfig     `json:"oidc_config" datastore:"oidc_config"`
+	SessionPolicy  SessionPolicy  `json:"session_policy" datastore:"session_policy"`
+	RateLimits     []RateLimit    `json:"rate_limits" datastore:"rate_limits"`
+	SupportGrants  []SupportGrant `json:"support_grants" datastore:"support_grants"`
+	AuditConfig    AuditConfig    `json:"audit_config" datastore:"audit_config"`
+
+	Inheritance          []InheritanceRule `json:"inheritance" datastore:"inheritance"`
+	InheritanceOverrides []string          `json:"inheritance_overrides" datastore:"inheritance_overrides"`
+}
+
+// SCIM provisioning for an org. Only the hash of the token is stored
+type ScimConfig struct {
+	TokenHash   string   `json:"token_hash" datastore:"token_hash,noindex"`
+	Created     int64    `json:"created" datastore:"created"`
+	CreatedBy   string   `json:"created_by" datastore:"created_by"`
+	DefaultRole string   `json:"default_role" datastore:"default_role"`
+	Deactivated []string `json:"deactivated" datastore:"deactivated,noindex"` // Users deactivated by the IdP. Kept so they can be reactivated
+}
+
+// SAML service provider settings for an org. Orgs with imported IdP metadata
+// (IdpEntityId set) get strict validation of audience, destination and request IDs.
+type SamlConfig struct {
+	IdpEntityId       string            `json:"idp_entity_id" datastore:"idp_entity_id"`
+	IdpMetadata       string            `json:"idp_metadata" datastore:"idp_metadata,noindex"`
+	IdpMetadataUrl    string            `json:"idp_metadata_url" datastore:"idp_metadata_url,noindex"`
+	SPEntityId        string            `json:"sp_entity_id" datastore:"sp_entity_id"` // Defaults to the SP metadata URL
+	SPCertificate     string            `json:"sp_certificate" datastore:"sp_certificate,noindex"`
+	SPPrivateKey      string            `json:"sp_private_key" datastore:"sp_private_key,noindex"`
+	SPKeyEncrypted    bool              `json:"sp_key_encrypted" datastore:"sp_key_encrypted"`
+	AllowIdpInitiated bool              `json:"allow_idp_initiated" datastore:"allow_idp_initiated"`
+	RoleAttribute     string            `json:"role_attribute" datastore:"role_attribute"`
+	RoleMappings      []SamlRoleMapping `json:"role_mappings" datastore:"role_mappings"`
+}
+
+// Users with Value in the role attribute get Role. The first matching mapping is used
+type SamlRoleMapping struct {
+	Value string `json:"value" datastore:"value"`
+	Role  string `json:"role" datastore:"role"`
+}
+
+// OpenID Connect settings for an org. With an issuer or JWKS URL, ID token
+// signatures are verified. Group mappings are applied on every login.
+type OidcConfig struct {
+	Issuer        string             `json:"issuer" datastore:"issuer"`
+	JwksUrl       string             `json:"jwks_url" datastore:"jwks_url,noindex"`
+	GroupsClaim   string             `json:"groups_claim" datastore:"groups_claim"`
+	DefaultRole   string             `json:"default_role" datastore:"default_role"`
+	JitDisabled   bool               `json:"jit_disabled" datastore:"jit_disabled"`
+	GroupMappings []OidcGroupMapping `json:"group_mappings" datastore:"group_mappings"`
+}
+
+// Users in Group get Role in OrgId, or in the org itself when OrgId is empty.
+// Suborgs in a mapping are managed by the IdP: users without a matching group are removed on login.
+type OidcGroupMapping struct {
+	Group string `json:"group" datastore:"group"`
+	Role  string `json:"role" datastore:"role"`
+	OrgId string `json:"org_id" datastore:"org_id"`
+}
+
+// Zero values mean the check is off, except MinLength which is never below the default
+type PasswordPolicy struct {
+	MinLength        int  `json:"min_length" datastore:"min_length"`
+	RequireUppercase bool `json:"require_uppercase" datastore:"require_uppercase"`
+	RequireLowercase bool `json:"require_lowercase" datastore:"require_lowercase"`
+	RequireNumber    bool `json:"require_number" datastore:"require_number"`
+	RequireSpecial   bool `json:"require_special" datastore:"require_special"`
+	MaxAgeDays       int  `json:"max_age_days" datastore:"max_age_days"`
+	HistoryCount     int  `json:"history_count" datastore:"history_count"`
+	LockoutAttempts  int  `json:"lockout_attempts" datastore:"lockout_attempts"`
+	LockoutMinutes   int  `json:"lockout_minutes" datastore:"lockout_minutes"`
+}
+
+// Overrides the plan's requests per minute for a route group
+type RateLimit struct {
+	Group             string `json:"group" datastore:"group"`
+	RequestsPerMinute int    `json:"requests_per_minute" datastore:"requests_per_minute"`
+}
+
+// Timeouts for sessions of users in the org. 0 means no timeout
+type SessionPolicy struct {
+	AbsoluteTimeoutMinutes int `json:"absolute_timeout_minutes" datastore:"absolute_timeout_minutes"`
+	IdleTimeoutMinutes     int `json:"idle_timeout_minutes" datastore:"idle_timeout_minutes"`
+}
+
+// How a setting or resource type flows from a parent org to its suborgs.
+// Mode is "inherited", "enforced" or "overridable".
+type InheritanceRule struct {
+	Setting string `json:"setting" datastore:"setting"`
+	Mode    string `json:"mode" datastore:"mode"`
+}
+
+// A setting as it applies to an org. Source is the org the value comes from
+type EffectiveSetting struct {
+	Setting string      `json:"setting"`
+	Mode    string      `json:"mode"`
+	Source  string      `json:"source"`
+	Value   interface{} `json:"value"`
+}
+
+type EffectiveOrgSettings struct {
+	Success     bool               `json:"success"`
+	OrgId       string             `json:"org_id"`
+	ParentOrgId string             `json:"parent_org_id"`
+	Settings    []EffectiveSetting `json:"settings"`
+}
+
+// How long audit events are kept, and where they are streamed.
+// SyslogFormat is "cef" or "json".
+type AuditConfig struct {
+	RetentionDays  int    `json:"retention_days" datastore:"retention_days"`
+	SyslogAddress  string `json:"syslog_address" datastore:"syslog_address"`
+	SyslogProtocol string `json:"syslog_protocol" datastore:"syslog_protocol"`
+	SyslogFormat   string `json:"syslog_format" datastore:"syslog_format"`
+}
+
+// Lets Shuffle support into the org for a limited time. An empty GrantedTo
+// means any support user, and WorkflowIds limits it to those workflows.
+type SupportGrant struct {
+	Id          string   `json:"id" datastore:"id"`
+	GrantedBy   string   `json:"granted_by" datastore:"granted_by"`
+	GrantedTo   string   `json:"granted_to" datastore:"granted_to"`
+	ReadOnly    bool     `json:"read_only" datastore:"read_only"`
+	WorkflowIds []string `json:"workflow_ids" datastore:"workflow_ids"`
+	Reason      string   `json:"reason" datastore:"reason,noindex"`
+	Created     int64    `json:"created" datastore:"created"`
+	Expires     int64    `json:"expires" datastore:"expires"`
 }
 
 type Billing struct {
@@ -1131,6 +1356,10 @@ type WorkflowExecution struct {
 
 	NotificationsCreated int64  `json:"notifications_created" datastore:"notifications_created"`
 	Authgroup            string `json:"authgroup" datastore:"authgroup"`
+
+	// W3C trace context of the execution. Used to connect spans from the backend, workers and subflows
+	TraceId     string `json:"trace_id,omitempty" datastore:"trace_id"`
+	TraceParent string `json:"traceparent,omitempty" datastore:"traceparent,noindex"`
 }
 
 type Position struct {
@@ -1205,6 +1434,7 @@ type Trigger struct {
 	SourceWorkflow string      `json:"source_workflow" yaml:"source_workflow" datastore:"source_workflow"`
 	ExecutionDelay int64       `json:"execution_delay" yaml:"execution_delay" datastore:"execution_delay"`
 	AppAssociation WorkflowApp `json:"app_association" yaml:"app_association" datastore:"app_association"`
+	Calendars      []string    `json:"calendars,omitempty" yaml:"calendars" datastore:"calendars"` // Maintenance calendars for schedules and webhooks
 
 	ParentControlled bool `json:"parent_controlled" datastore:"parent_controlled"` // If the parent workflow node exists, and shouldn't be editable by child workflow
 }
@@ -1461,6 +1691,7 @@ type File struct {
 	CreatedBy       string   `json:"created_by" datastore:"created_by"`
 	Namespace       string   `json:"namespace" datastore:"namespace"`
 	Encrypted       bool     `json:"encrypted" datastore:"encrypted"`
+	KeyVersion      int      `json:"key_version" datastore:"key_version"`
 	IsEdited        bool     `json:"isedited" datastore:"isedited"`
 	LastEditor      string   `json:"lasteditor" datastore:"lasteditor"`
 	OriginalMd5sum  string   `json:"Originalmd5_sum" datastore:"Originalmd5_sum"`
@@ -1544,6 +1775,7 @@ type AppAuthenticationStorage struct {
 	Defined           bool                  `json:"defined" datastore:"defined"`
 	Type              string                `json:"type" datastore:"type"`
 	Encrypted         bool                  `json:"encrypted" datastore:"encrypted"`
+	KeyVersion        int                   `json:"key_version" datastore:"key_version"`
 	ReferenceWorkflow string                `json:"reference_workflow" datastore:"reference_workflow"`
 	AutoDistribute    bool                  `json:"auto_distribute" datastore:"auto_distribute"`
 
@@ -1577,9 +1809,11 @@ type CloudSyncJob struct {
 }
 
 type loginStruct struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
-	MFACode  string `json:"mfa_code"`
+	Username     string          `json:"username"`
+	Password     string          `json:"password"`
+	MFACode      string          `json:"mfa_code"`
+	WebAuthn     json.RawMessage `json:"webauthn"`
+	RecoveryCode string          `json:"recovery_code"`
 }
 
 type ExecutionVariableWrapper struct {
@@ -2308,6 +2542,21 @@ type SessionWrapper struct {
 	Source      Session `json:"_source"`
 }
 
+type SessionSearchWrapper struct {
+	Hits struct {
+		Total struct {
+			Value    int    `json:"value"`
+			Relation string `json:"relation"`
+		} `json:"total"`
+		Hits []struct {
+			Index  string  `json:"_index"`
+			ID     string  `json:"_id"`
+			Score  float64 `json:"_score"`
+			Source Session `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
 // Used for Gmail triggers using Pubsub
 type SubscriptionRecipient struct {
 	HistoryId    string `json:"history_id"`
@@ -3575,6 +3824,8 @@ type IdTokenCheck struct {
 	Ver   string `json:"ver"`
 	Email string `json:"email"`
 	Org   Org    `json:"org"`
+
+	Claims map[string]interface{} `json:"-"`
 }
 
 type WidgetMeta struct {
@@ -4169,3 +4420,558 @@ type RequestResponse struct {
 	Reason  string `json:"reason"`
 	Details string `json:"details"`
 }
+
+// A single blackout window within a maintenance calendar.
+// Start and End are unix timestamps for the first occurrence.
+// Recurrence repeats the window: "" (one-off), "daily", "weekly" or "monthly"
+type MaintenanceWindow struct {
+	Id         string `json:"id" datastore:"id"`
+	Name       string `json:"name" datastore:"name"`
+	Start      int64  `json:"start" datastore:"start"`
+	End        int64  `json:"end" datastore:"end"`
+	Recurrence string `json:"recurrence" datastore:"recurrence"`
+	Until      int64  `json:"until" datastore:"until"` // Last time a recurring window may start. 0 = forever
+}
+
+// Org-level blackout calendar referenced by schedules and webhooks.
+// Action decides what happens to a trigger during a window:
+// pause = reject so the sender can retry, queue = run when the window ends, drop = discard
+type MaintenanceCalendar struct {
+	Id          string              `json:"id" datastore:"id"`
+	Name        string              `json:"name" datastore:"name"`
+	Description string              `json:"description" datastore:"description,noindex"`
+	OrgId       string              `json:"org_id" datastore:"org_id"`
+	Action      string              `json:"action" datastore:"action"` // pause: the latest trigger runs after the window. queue: all of them do. drop: none do
+	Enabled     bool                `json:"enabled" datastore:"enabled"`
+	Windows     []MaintenanceWindow `json:"windows" datastore:"windows,noindex"`
+	CreatedBy   string              `json:"created_by" datastore:"created_by"`
+	Created     int64               `json:"created" datastore:"created"`
+	Edited      int64               `json:"edited" datastore:"edited"`
+}
+
+// Audit entry for every trigger suppressed by a maintenance calendar
+type SuppressedTrigger struct {
+	Id                string `json:"id" datastore:"id"`
+	OrgId             string `json:"org_id" datastore:"org_id"`
+	CalendarId        string `json:"calendar_id" datastore:"calendar_id"`
+	WindowId          string `json:"window_id" datastore:"window_id"`
+	WindowEnd         int64  `json:"window_end" datastore:"window_end"`
+	Action            string `json:"action" datastore:"action"`
+	Status            string `json:"status" datastore:"status"` // paused, dropped, queued, released, skipped, failed
+	TriggerType       string `json:"trigger_type" datastore:"trigger_type"`
+	TriggerId         string `json:"trigger_id" datastore:"trigger_id"`
+	WorkflowId        string `json:"workflow_id" datastore:"workflow_id"`
+	Start             string `json:"start" datastore:"start"`
+	ExecutionArgument string `json:"execution_argument" datastore:"execution_argument,noindex"`
+	ExecutionId       string `json:"execution_id" datastore:"execution_id"` // Set when a paused or queued trigger is released
+	Created           int64  `json:"created" datastore:"created"`
+	Released          int64  `json:"released" datastore:"released"`
+}
+
+type MaintenanceCalendarWrapper struct {
+	Index   string              `json:"_index"`
+	Type    string              `json:"_type"`
+	ID      string              `json:"_id"`
+	Version int                 `json:"_version"`
+	Found   bool                `json:"found"`
+	Source  MaintenanceCalendar `json:"_source"`
+}
+
+type MaintenanceCalendarSearchWrapper struct {
+	Hits struct {
+		Total struct {
+			Value    int    `json:"value"`
+			Relation string `json:"relation"`
+		} `json:"total"`
+		Hits []struct {
+			Index  string              `json:"_index"`
+			ID     string              `json:"_id"`
+			Score  float64             `json:"_score"`
+			Source MaintenanceCalendar `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+type SuppressedTriggerSearchWrapper struct {
+	Hits struct {
+		Total struct {
+			Value    int    `json:"value"`
+			Relation string `json:"relation"`
+		} `json:"total"`
+		Hits []struct {
+			Index  string            `json:"_index"`
+			ID     string            `json:"_id"`
+			Score  float64           `json:"_score"`
+			Source SuppressedTrigger `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+// Published on the internal event bus. Data is kept as the raw JSON string
+type BusEvent struct {
+	Id          string `json:"id" datastore:"id"`
+	OrgId       string `json:"org_id" datastore:"org_id"`
+	Topic       string `json:"topic" datastore:"topic"`
+	Data        string `json:"data" datastore:"data,noindex"`
+	Source      string `json:"source" datastore:"source"`
+	WorkflowId  string `json:"workflow_id" datastore:"workflow_id"`
+	ExecutionId string `json:"execution_id" datastore:"execution_id"`
+	Depth       int    `json:"depth" datastore:"depth"`
+	Matched     int    `json:"matched" datastore:"matched"`
+	Created     int64  `json:"created" datastore:"created"`
+}
+
+// Used by EVENT triggers. The Id is the same as the trigger ID
+type EventSubscription struct {
+	Id          string        `json:"id" datastore:"id"`
+	OrgId       string        `json:"org_id" datastore:"org_id"`
+	WorkflowId  string        `json:"workflow_id" datastore:"workflow_id"`
+	Topic       string        `json:"topic" datastore:"topic"`
+	Start       string        `json:"start" datastore:"start"`
+	Environment string        `json:"environment" datastore:"environment"`
+	Status      string        `json:"status" datastore:"status"`
+	Filters     []EventFilter `json:"filters" datastore:"filters"`
+	CreatedBy   string        `json:"created_by" datastore:"created_by"`
+	Created     int64         `json:"created" datastore:"created"`
+	Edited      int64         `json:"edited" datastore:"edited"`
+}
+
+// Field is a JMESPath expression into the event data, e.g. "alert.severity" or "items[0].id"
+type EventFilter struct {
+	Field     string `json:"field" datastore:"field"`
+	Condition string `json:"condition" datastore:"condition"`
+	Value     string `json:"value" datastore:"value"`
+}
+
+type EventSubscriptionWrapper struct {
+	Index   string            `json:"_index"`
+	Type    string            `json:"_type"`
+	ID      string            `json:"_id"`
+	Version int               `json:"_version"`
+	Found   bool              `json:"found"`
+	Source  EventSubscription `json:"_source"`
+}
+
+type EventSubscriptionSearchWrapper struct {
+	Hits struct {
+		Total struct {
+			Value    int    `json:"value"`
+			Relation string `json:"relation"`
+		} `json:"total"`
+		Hits []struct {
+			Index  string            `json:"_index"`
+			ID     string            `json:"_id"`
+			Score  float64           `json:"_score"`
+			Source EventSubscription `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+type BusEventSearchWrapper struct {
+	Hits struct {
+		Total struct {
+			Value    int    `json:"value"`
+			Relation string `json:"relation"`
+		} `json:"total"`
+		Hits []struct {
+			Index  string   `json:"_index"`
+			ID     string   `json:"_id"`
+			Score  float64  `json:"_score"`
+			Source BusEvent `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+// A single edit in a collaborative workflow session. Seq is set by the
+// server and gives every editor the same order to apply operations in.
+type WorkflowEditOperation struct {
+	Id         string          `json:"id"`
+	Seq        int64           `json:"seq"`
+	BaseSeq    int64           `json:"base_seq"`
+	WorkflowId string          `json:"workflow_id"`
+	UserId     string          `json:"user_id"`
+	Username   string          `json:"username"`
+	Type       string          `json:"type"`
+	NodeId     string          `json:"node_id,omitempty"`
+	NodeType   string          `json:"node_type,omitempty"`
+	Field      string          `json:"field,omitempty"`
+	Value      json.RawMessage `json:"value,omitempty"`
+	Position   *Position       `json:"position,omitempty"`
+	Timestamp  int64           `json:"timestamp"`
+}
+
+// A change in an execution, streamed to clients as a Server-Sent Event.
+// Id increases per execution, and can be used as Last-Event-ID.
+type ExecutionStreamEvent struct {
+	Id          int64  `json:"id"`
+	ExecutionId string `json:"execution_id"`
+	Type        string `json:"type"`
+	ActionId    string `json:"action_id,omitempty"`
+	ActionLabel string `json:"action_label,omitempty"`
+	Status      string `json:"status"`
+	Result      string `json:"result,omitempty"`
+	Truncated   bool   `json:"truncated,omitempty"`
+	Timestamp   int64  `json:"timestamp"`
+}
+
+type CollaboratorPresence struct {
+	UserId       string    `json:"user_id"`
+	Username     string    `json:"username"`
+	Cursor       *Position `json:"cursor,omitempty"`
+	SelectedNode string    `json:"selected_node,omitempty"`
+	LastSeen     int64     `json:"last_seen"`
+}
+
+type ExecutionLogEntry struct {
+	Timestamp   int64             `json:"timestamp" datastore:"timestamp"`
+	Level       string            `json:"level" datastore:"level"`
+	Message     string            `json:"message" datastore:"message,noindex"`
+	OrgId       string            `json:"org_id" datastore:"org_id"`
+	WorkflowId  string            `json:"workflow_id" datastore:"workflow_id"`
+	ExecutionId string            `json:"execution_id" datastore:"execution_id"`
+	Fields      map[string]string `json:"fields,omitempty" datastore:"-"`
+}
+
+// A chunk of the captured log lines of one execution. The ID is the
+// execution ID and chunk number, e.g. <execution_id>_0
+type ExecutionLogs struct {
+	ExecutionId string              `json:"execution_id" datastore:"execution_id"`
+	Chunk       int                 `json:"chunk" datastore:"chunk"`
+	OrgId       string              `json:"org_id" datastore:"org_id"`
+	WorkflowId  string              `json:"workflow_id" datastore:"workflow_id"`
+	Entries     []ExecutionLogEntry `json:"entries" datastore:"entries,noindex"`
+	Edited      int64               `json:"edited" datastore:"edited"`
+}
+
+type ExecutionLogsWrapper struct {
+	Index   string        `json:"_index"`
+	Type    string        `json:"_type"`
+	ID      string        `json:"_id"`
+	Version int           `json:"_version"`
+	Found   bool          `json:"found"`
+	Source  ExecutionLogs `json:"_source"`
+}
+
+// A role defined by an org. Users get it by having the role ID as their role
+type OrgRole struct {
+	Id          string   `json:"id" datastore:"id"`
+	OrgId       string   `json:"org_id" datastore:"org_id"`
+	Name        string   `json:"name" datastore:"name"`
+	Description string   `json:"description" datastore:"description,noindex"`
+	Permissions []string `json:"permissions" datastore:"permissions"`
+	CreatedBy   string   `json:"created_by" datastore:"created_by"`
+	Created     int64    `json:"created" datastore:"created"`
+	Edited      int64    `json:"edited" datastore:"edited"`
+}
+
+// A named API key limited to some scopes in one org. Only the hash of the key is stored
+type UserApiKey struct {
+	Id          string   `json:"id" datastore:"id"`
+	UserId      string   `json:"user_id" datastore:"user_id"`
+	OrgId       string   `json:"org_id" datastore:"org_id"`
+	Name        string   `json:"name" datastore:"name"`
+	KeyHash     string   `json:"key_hash" datastore:"key_hash"`
+	Prefix      string   `json:"prefix" datastore:"prefix,noindex"`
+	Scopes      []string `json:"scopes" datastore:"scopes"`
+	WorkflowIds []string `json:"workflow_ids" datastore:"workflow_ids"` // Limits workflow permissions to these workflows. Empty means all
+	Created     int64    `json:"created" datastore:"created"`
+	CreatedBy   string   `json:"created_by" datastore:"created_by"`
+	Expires     int64    `json:"expires" datastore:"expires"`
+	LastUsed    int64    `json:"last_used" datastore:"last_used,noindex"`
+	LastUsedIp  string   `json:"last_used_ip" datastore:"last_used_ip,noindex"`
+}
+
+type OrgRoleWrapper struct {
+	Index   string  `json:"_index"`
+	Type    string  `json:"_type"`
+	ID      string  `json:"_id"`
+	Version int     `json:"_version"`
+	Found   bool    `json:"found"`
+	Source  OrgRole `json:"_source"`
+}
+
+type OrgRoleSearchWrapper struct {
+	Hits struct {
+		Total struct {
+			Value    int    `json:"value"`
+			Relation string `json:"relation"`
+		} `json:"total"`
+		Hits []struct {
+			Index  string  `json:"_index"`
+			ID     string  `json:"_id"`
+			Score  float64 `json:"_score"`
+			Source OrgRole `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+type UserApiKeyWrapper struct {
+	Index   string     `json:"_index"`
+	Type    string     `json:"_type"`
+	ID      string     `json:"_id"`
+	Version int        `json:"_version"`
+	Found   bool       `json:"found"`
+	Source  UserApiKey `json:"_source"`
+}
+
+type UserApiKeySearchWrapper struct {
+	Hits struct {
+		Total struct {
+			Value    int    `json:"value"`
+			Relation string `json:"relation"`
+		} `json:"total"`
+		Hits []struct {
+			Index  string     `json:"_index"`
+			ID     string     `json:"_id"`
+			Score  float64    `json:"_score"`
+			Source UserApiKey `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+type ScimMeta struct {
+	ResourceType string `json:"resourceType"`
+	Created      string `json:"created,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	Location     string `json:"location,omitempty"`
+}
+
+type ScimName struct {
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+	Formatted  string `json:"formatted,omitempty"`
+}
+
+type ScimMultiValue struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+type ScimUser struct {
+	Schemas     []string         `json:"schemas"`
+	Id          string           `json:"id"`
+	ExternalId  string           `json:"externalId,omitempty"`
+	UserName    string           `json:"userName"`
+	Name        ScimName         `json:"name"`
+	DisplayName string           `json:"displayName,omitempty"`
+	Emails      []ScimMultiValue `json:"emails,omitempty"`
+	Active      *bool            `json:"active,omitempty"`
+	Groups      []ScimMultiValue `json:"groups,omitempty"`
+	Meta        ScimMeta         `json:"meta"`
+}
+
+type ScimGroup struct {
+	Schemas     []string         `json:"schemas"`
+	Id          string           `json:"id"`
+	ExternalId  string           `json:"externalId,omitempty"`
+	DisplayName string           `json:"displayName"`
+	Members     []ScimMultiValue `json:"members"`
+	Meta        ScimMeta         `json:"meta"`
+}
+
+type ScimListResponse struct {
+	Schemas      []string      `json:"schemas"`
+	TotalResults int           `json:"totalResults"`
+	StartIndex   int           `json:"startIndex"`
+	ItemsPerPage int           `json:"itemsPerPage"`
+	Resources    []interface{} `json:"Resources"`
+}
+
+type ScimPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+type ScimPatchRequest struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []ScimPatchOperation `json:"Operations"`
+}
+
+type SupportAccessEvent struct {
+	Id           string `json:"id" datastore:"id"`
+	OrgId        string `json:"org_id" datastore:"org_id"`
+	GrantId      string `json:"grant_id" datastore:"grant_id"`
+	Username     string `json:"username" datastore:"username"`
+	UserId       string `json:"user_id" datastore:"user_id"`
+	Access       string `json:"access" datastore:"access"`
+	ResourceType string `json:"resource_type" datastore:"resource_type"`
+	ResourceId   string `json:"resource_id" datastore:"resource_id"`
+	Method       string `json:"method" datastore:"method,noindex"`
+	Path         string `json:"path" datastore:"path,noindex"`
+	IP           string `json:"ip" datastore:"ip,noindex"`
+	Timestamp    int64  `json:"timestamp" datastore:"timestamp"`
+}
+
+type SupportAccessEventSearchWrapper struct {
+	Hits struct {
+		Total struct {
+			Value    int    `json:"value"`
+			Relation string `json:"relation"`
+		} `json:"total"`
+		Hits []struct {
+			Index  string             `json:"_index"`
+			ID     string             `json:"_id"`
+			Score  float64            `json:"_score"`
+			Source SupportAccessEvent `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+type AuditEvent struct {
+	Id           string `json:"id" datastore:"id"`
+	OrgId        string `json:"org_id" datastore:"org_id"`
+	ActorId      string `json:"actor_id" datastore:"actor_id"`
+	ActorName    string `json:"actor_name" datastore:"actor_name"`
+	ActorType    string `json:"actor_type" datastore:"actor_type"`
+	Action       string `json:"action" datastore:"action"`
+	ResourceType string `json:"resource_type" datastore:"resource_type"`
+	ResourceId   string `json:"resource_id" datastore:"resource_id"`
+	Before       string `json:"before" datastore:"before,noindex"`
+	After        string `json:"after" datastore:"after,noindex"`
+	IP           string `json:"ip" datastore:"ip"`
+	Timestamp    int64  `json:"timestamp" datastore:"timestamp"`
+}
+
+type AuditEventSearchWrapper struct {
+	Hits struct {
+		Total struct {
+			Value    int    `json:"value"`
+			Relation string `json:"relation"`
+		} `json:"total"`
+		Hits []struct {
+			Index  string     `json:"_index"`
+			ID     string     `json:"_id"`
+			Score  float64    `json:"_score"`
+			Source AuditEvent `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+// Filters for audit events in an org. Empty fields match everything
+type AuditEventSearch struct {
+	ActorId      string `json:"actor_id"`
+	Action       string `json:"action"`
+	ResourceType string `json:"resource_type"`
+	ResourceId   string `json:"resource_id"`
+	StartTime    int64  `json:"start_time"`
+	EndTime      int64  `json:"end_time"`
+	Limit        int    `json:"limit"`
+}
+
+type ServiceAccountInfo struct {
+	Id          string       `json:"id"`
+	Username    string       `json:"username"`
+	Description string       `json:"description"`
+	Role        string       `json:"role"`
+	Active      bool         `json:"active"`
+	Created     int64        `json:"created"`
+	CreatedBy   string       `json:"created_by"`
+	ApiKeys     []UserApiKey `json:"apikeys"`
+}
+
+// A background job that packs what is stored about an org or one of its
+// users into a zip file in the org's "exports" file namespace
+type DataExport struct {
+	Id          string          `json:"id" datastore:"id"`
+	OrgId       string          `json:"org_id" datastore:"org_id"`
+	Type        string          `json:"type" datastore:"type"` // "org" or "user"
+	SubjectId   string          `json:"subject_id" datastore:"subject_id"`
+	Status      string          `json:"status" datastore:"status"` // "running", "finished", "failed" or "expired"
+	Reason      string          `json:"reason" datastore:"reason,noindex"`
+	FileId      string          `json:"file_id" datastore:"file_id"`
+	Counts      []ResourceCount `json:"counts" datastore:"counts,noindex"`
+	RequestedBy string          `json:"requested_by" datastore:"requested_by"`
+	Created     int64           `json:"created" datastore:"created"`
+	Completed   int64           `json:"completed" datastore:"completed"`
+	Expires     int64           `json:"expires" datastore:"expires"`
+}
+
+type ResourceCount struct {
+	ResourceType string   `json:"resource_type" datastore:"resource_type"`
+	Count        int      `json:"count" datastore:"count"`
+	Ids          []string `json:"ids,omitempty" datastore:"ids,noindex"`
+	Failed       []string `json:"failed,omitempty" datastore:"failed,noindex"`
+	Reason       string   `json:"reason,omitempty" datastore:"reason,noindex"`
+}
+
+type DataExportWrapper struct {
+	Index   string     `json:"_index"`
+	Type    string     `json:"_type"`
+	ID      string     `json:"_id"`
+	Version int        `json:"_version"`
+	Found   bool       `json:"found"`
+	Source  DataExport `json:"_source"`
+}
+
+type DataExportSearchWrapper struct {
+	Hits struct {
+		Total struct {
+			Value    int    `json:"value"`
+			Relation string `json:"relation"`
+		} `json:"total"`
+		Hits []struct {
+			Index  string     `json:"_index"`
+			ID     string     `json:"_id"`
+			Score  float64    `json:"_score"`
+			Source DataExport `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+// What was erased when an org or user was deleted. It is kept by the org
+// the deletion was made from, and Checksum is the SHA-256 of the report
+// without the checksum.
+type DeletionReport struct {
+	Id          string          `json:"id" datastore:"id"`
+	OrgId       string          `json:"org_id" datastore:"org_id"`
+	Type        string          `json:"type" datastore:"type"` // "org" or "user"
+	SubjectId   string          `json:"subject_id" datastore:"subject_id"`
+	SubjectName string          `json:"subject_name" datastore:"subject_name"`
+	DeletedBy   string          `json:"deleted_by" datastore:"deleted_by"`
+	Erased      []ResourceCount `json:"erased" datastore:"erased,noindex"`
+	Retained    []ResourceCount `json:"retained" datastore:"retained,noindex"`
+	Timestamp   int64           `json:"timestamp" datastore:"timestamp"`
+	KeyVersion  int             `json:"key_version" datastore:"key_version,noindex"`
+	Checksum    string          `json:"checksum" datastore:"checksum,noindex"`
+	Verified    bool            `json:"verified" datastore:"-"`
+}
+
+type DeletionReportSearchWrapper struct {
+	Hits struct {
+		Total struct {
+			Value    int    `json:"value"`
+			Relation string `json:"relation"`
+		} `json:"total"`
+		Hits []struct {
+			Index  string         `json:"_index"`
+			ID     string         `json:"_id"`
+			Score  float64        `json:"_score"`
+			Source DeletionReport `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+type KeyRotation struct {
+	Id          string          `json:"id" datastore:"id"`
+	KeyVersion  int             `json:"key_version" datastore:"key_version"`
+	Status      string          `json:"status" datastore:"status"` // "running", "finished", "failed" or "expired"
+	Reason      string          `json:"reason" datastore:"reason,noindex"`
+	OldVersions []int           `json:"old_versions" datastore:"old_versions"`
+	Counts      []ResourceCount `json:"counts" datastore:"counts,noindex"`
+	StartedBy   string          `json:"started_by" datastore:"started_by"`
+	Started     int64           `json:"started" datastore:"started"`
+	Completed   int64           `json:"completed" datastore:"completed"`
+}
+
+type KeyRotationWrapper struct {
+	Index   string      `json:"_index"`
+	Type    string      `json:"_type"`
+	ID      string      `json:"_id"`
+	Version int         `json:"_version"`
+	Found   bool        `json:"found"`
+	Source  KeyRotation `json:"_source"`
+}
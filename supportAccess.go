@@ -0,0 +1,381 @@
+package shuffle
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Grants are short lived on purpose. Admins can grant again if more
+// time is needed.
+const (
+	defaultSupportGrantHours = 24
+	maxSupportGrantHours     = 24 * 7
+	maxSupportAccessEvents   = 500
+)
+
+// Base requirements for Shuffle support users. On their own they only show
+// Shuffle's own fields, like lead info. Org data needs a grant from the org,
+// checked with hasSupportAccess.
+func isSupportUser(user User) bool {
+	return project.Environment == "cloud" && user.Verified == true && user.Active == true && user.SupportAccess == true && strings.HasSuffix(user.Username, "@shuffler.io")
+}
+
+// Finds an unexpired grant in the org covering the access. access is
+// "read" or "write". Workflow scoped grants only cover those workflows.
+func getSupportGrant(org Org, user User, access, resourceType, resourceId string) (SupportGrant, bool) {
+	timeNow := time.Now().Unix()
+	for _, grant := range org.SupportGrants {
+		if grant.Expires <= timeNow {
+			continue
+		}
+
+		if len(grant.GrantedTo) > 0 && strings.ToLower(grant.GrantedTo) != strings.ToLower(user.Username) && grant.GrantedTo != user.Id {
+			continue
+		}
+
+		if access != "read" && grant.ReadOnly {
+			continue
+		}
+
+		if len(grant.WorkflowIds) > 0 && (resourceType != "workflow" || !ArrayContains(grant.WorkflowIds, resourceId)) {
+			continue
+		}
+
+		return grant, true
+	}
+
+	return SupportGrant{}, false
+}
+
+// Checks if a support user can access a resource in another org, and
+// records the access for the org to see. The user's permissions are
+// capped at what the grant allows for the rest of the request.
+func hasSupportAccess(request *http.Request, user *User, orgId, access, resourceType, resourceId string) bool {
+	if !isSupportUser(*user) || len(orgId) == 0 {
+		return false
+	}
+
+	ctx := GetContext(request)
+	org, err := GetOrg(ctx, orgId)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting org %s for support access: %s", orgId, err)
+		return false
+	}
+
+	grant, found := getSupportGrant(*org, *user, access, resourceType, resourceId)
+	if !found {
+		log.Printf("[AUDIT] Support user %s (%s) has no %s grant for %s %s in org %s", user.Username, user.Id, access, resourceType, resourceId, orgId)
+		return false
+	}
+
+	user.SupportGrantAccess = getSupportGrantAccess(grant)
+	event := SupportAccessEvent{
+		Id:           uuid.NewV4().String(),
+		OrgId:        orgId,
+		GrantId:      grant.Id,
+		Username:     user.Username,
+		UserId:       user.Id,
+		Access:       access,
+		ResourceType: resourceType,
+		ResourceId:   resourceId,
+		Method:       request.Method,
+		Path:         strings.Split(request.URL.String(), "?")[0],
+		IP:           GetRequestIp(request),
+		Timestamp:    time.Now().Unix(),
+	}
+
+	err = SetSupportAccessEvent(ctx, event)
+	if err != nil {
+		log.Printf("[ERROR] Failed recording support access by %s to %s %s in org %s: %s", user.Username, resourceType, resourceId, orgId, err)
+	}
+
+	log.Printf("[AUDIT] Support user %s (%s) got %s access to %s %s in org %s through grant %s", user.Username, user.Id, access, resourceType, resourceId, orgId, grant.Id)
+	CreateAuditEvent(ctx, request, *user, orgId, fmt.Sprintf("support.%s", access), resourceType, resourceId, nil, map[string]interface{}{"grant_id": grant.Id, "method": request.Method, "path": event.Path})
+	return true
+}
+
+func getSupportGrantAccess(grant SupportGrant) string {
+	if grant.ReadOnly {
+		return "read"
+	}
+
+	return "write"
+}
+
+// Support users with read access only get the read permissions of their role
+func supportGrantAllows(user User, permission string) bool {
+	return user.SupportGrantAccess != "read" || strings.HasSuffix(permission, ":read")
+}
+
+// The access level of a request made by a support user switched into an org
+func getSupportRequestAccess(request *http.Request) string {
+	if request.Method == "GET" || request.Method == "HEAD" || request.Method == "OPTIONS" {
+		return "read"
+	}
+
+	return "write"
+}
+
+func getActiveSupportGrants(grants []SupportGrant) []SupportGrant {
+	activeGrants := []SupportGrant{}
+	timeNow := time.Now().Unix()
+	for _, grant := range grants {
+		if grant.Expires <= timeNow {
+			continue
+		}
+
+		activeGrants = append(activeGrants, grant)
+	}
+
+	return activeGrants
+}
+
+// Support users switched into an org have it as their active org, but
+// aren't members. They shouldn't manage their own grants.
+func isOrgMember(user User) bool {
+	return len(user.ActiveOrg.Id) > 0 && ArrayContains(user.Orgs, user.ActiveOrg.Id)
+}
+
+// Returns the active grants and the latest support access in the org
+func HandleGetSupportAccess(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in get support access: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if !isOrgMember(user) {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "You don't have access to this org"}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	org, err := GetOrg(ctx, user.ActiveOrg.Id)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting org %s for support access: %s", user.ActiveOrg.Id, err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	events, err := GetSupportAccessEvents(ctx, org.Id, maxSupportAccessEvents)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting support access events for org %s: %s", org.Id, err)
+		events = []SupportAccessEvent{}
+	}
+
+	newjson, err := json.Marshal(struct {
+		Success bool                 `json:"success"`
+		Grants  []SupportGrant       `json:"grants"`
+		Events  []SupportAccessEvent `json:"events"`
+	}{
+		Success: true,
+		Grants:  getActiveSupportGrants(org.SupportGrants),
+		Events:  events,
+	})
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+func HandleCreateSupportGrant(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in create support grant: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if !isOrgMember(user) || Authorize(user, "org:manage", "") != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "You don't have access to grant support access"}`))
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		log.Printf("[WARNING] Failed reading body in create support grant: %s", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	var grantRequest struct {
+		GrantedTo   string   `json:"granted_to"`
+		ReadOnly    bool     `json:"read_only"`
+		WorkflowIds []string `json:"workflow_ids"`
+		Reason      string   `json:"reason"`
+		Hours       int      `json:"hours"`
+	}
+
+	err = json.Unmarshal(body, &grantRequest)
+	if err != nil {
+		log.Printf("[WARNING] Failed unmarshalling support grant: %s", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Failed parsing support grant"}`))
+		return
+	}
+
+	if grantRequest.Hours == 0 {
+		grantRequest.Hours = defaultSupportGrantHours
+	}
+
+	if grantRequest.Hours < 0 || grantRequest.Hours > maxSupportGrantHours {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Support access can be granted for 1 to %d hours"}`, maxSupportGrantHours)))
+		return
+	}
+
+	grantRequest.GrantedTo = strings.TrimSpace(grantRequest.GrantedTo)
+	if len(grantRequest.GrantedTo) > 0 && strings.Contains(grantRequest.GrantedTo, "@") && !strings.HasSuffix(strings.ToLower(grantRequest.GrantedTo), "@shuffler.io") {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Support access can only be granted to Shuffle support users"}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	workflowIds := []string{}
+	for _, workflowId := range grantRequest.WorkflowIds {
+		if len(workflowId) == 0 || ArrayContains(workflowIds, workflowId) {
+			continue
+		}
+
+		workflow, err := GetWorkflow(ctx, workflowId)
+		if err != nil || workflow.OrgId != user.ActiveOrg.Id {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Workflow %s not found in this org"}`, workflowId)))
+			return
+		}
+
+		workflowIds = append(workflowIds, workflowId)
+	}
+
+	org, err := GetOrg(ctx, user.ActiveOrg.Id)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting org %s for support grant: %s", user.ActiveOrg.Id, err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	timeNow := time.Now().Unix()
+	grant := SupportGrant{
+		Id:          uuid.NewV4().String(),
+		GrantedBy:   user.Username,
+		GrantedTo:   grantRequest.GrantedTo,
+		ReadOnly:    grantRequest.ReadOnly,
+		WorkflowIds: workflowIds,
+		Reason:      grantRequest.Reason,
+		Created:     timeNow,
+		Expires:     timeNow + int64(grantRequest.Hours*3600),
+	}
+
+	org.SupportGrants = append(getActiveSupportGrants(org.SupportGrants), grant)
+	err = SetOrg(ctx, *org, org.Id)
+	if err != nil {
+		log.Printf("[ERROR] Failed saving support grant for org %s: %s", org.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	log.Printf("[AUDIT] User %s (%s) granted support access to '%s' in org %s for %d hours. Read-only: %t, workflows: %#v", user.Username, user.Id, grant.GrantedTo, org.Id, grantRequest.Hours, grant.ReadOnly, grant.WorkflowIds)
+	CreateAuditEvent(ctx, request, user, org.Id, "support.grant", "support_grant", grant.Id, nil, grant)
+	resp.WriteHeader(200)
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "id": "%s", "expires": %d}`, grant.Id, grant.Expires)))
+}
+
+func HandleRevokeSupportGrant(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in revoke support grant: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if !isOrgMember(user) || Authorize(user, "org:manage", "") != nil {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "You don't have access to revoke support access"}`))
+		return
+	}
+
+	location := strings.Split(strings.Split(request.URL.String(), "?")[0], "/")
+	if len(location) <= 5 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Grant ID required"}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	org, err := GetOrg(ctx, user.ActiveOrg.Id)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting org %s for support grant: %s", user.ActiveOrg.Id, err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	grantId := location[5]
+	found := false
+	newGrants := []SupportGrant{}
+	for _, grant := range getActiveSupportGrants(org.SupportGrants) {
+		if grantId == "all" || grant.Id == grantId {
+			found = true
+			continue
+		}
+
+		newGrants = append(newGrants, grant)
+	}
+
+	if !found && grantId != "all" {
+		resp.WriteHeader(404)
+		resp.Write([]byte(`{"success": false, "reason": "Grant not found"}`))
+		return
+	}
+
+	org.SupportGrants = newGrants
+	err = SetOrg(ctx, *org, org.Id)
+	if err != nil {
+		log.Printf("[ERROR] Failed revoking support grant %s for org %s: %s", grantId, org.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	log.Printf("[AUDIT] User %s (%s) revoked support grant %s in org %s", user.Username, user.Id, grantId, org.Id)
+	CreateAuditEvent(ctx, request, user, org.Id, "support.revoke", "support_grant", grantId, nil, nil)
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
@@ -0,0 +1,129 @@
+package shuffle
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsSupportUser(t *testing.T) {
+	originalEnvironment := project.Environment
+	defer func() { project.Environment = originalEnvironment }()
+
+	supportUser := User{Username: "support@shuffler.io", Verified: true, Active: true, SupportAccess: true}
+
+	project.Environment = "onprem"
+	if isSupportUser(supportUser) {
+		t.Errorf("isSupportUser should be false outside of cloud")
+	}
+
+	project.Environment = "cloud"
+	if !isSupportUser(supportUser) {
+		t.Errorf("isSupportUser should be true for verified Shuffle support users")
+	}
+
+	outsideUser := supportUser
+	outsideUser.Username = "support@example.com"
+	if isSupportUser(outsideUser) {
+		t.Errorf("isSupportUser should be false for users outside of Shuffle")
+	}
+
+	inactiveUser := supportUser
+	inactiveUser.Active = false
+	if isSupportUser(inactiveUser) {
+		t.Errorf("isSupportUser should be false for inactive users")
+	}
+}
+
+func TestGetSupportGrant(t *testing.T) {
+	timeNow := time.Now().Unix()
+	user := User{Id: "support", Username: "support@shuffler.io"}
+	org := Org{
+		Id: "org",
+		SupportGrants: []SupportGrant{
+			SupportGrant{Id: "expired", Expires: timeNow - 10},
+			SupportGrant{Id: "other", GrantedTo: "other@shuffler.io", Expires: timeNow + 3600},
+			SupportGrant{Id: "readonly", ReadOnly: true, Expires: timeNow + 3600},
+			SupportGrant{Id: "workflow", WorkflowIds: []string{"workflow"}, Expires: timeNow + 3600},
+		},
+	}
+
+	handlers := []struct {
+		access       string
+		resourceType string
+		resourceId   string
+		expected     string
+	}{
+		{"read", "org", "org", "readonly"},
+		{"write", "org", "org", ""},
+		{"write", "workflow", "workflow", "workflow"},
+		{"write", "workflow", "other-workflow", ""},
+	}
+
+	for _, tt := range handlers {
+		grant, found := getSupportGrant(org, user, tt.access, tt.resourceType, tt.resourceId)
+		if found != (len(tt.expected) > 0) || grant.Id != tt.expected {
+			t.Errorf("getSupportGrant(%s, %s %s) = %s, %t; expected %s", tt.access, tt.resourceType, tt.resourceId, grant.Id, found, tt.expected)
+		}
+	}
+}
+
+func TestHasSupportAccessRequiresSupportUser(t *testing.T) {
+	originalEnvironment := project.Environment
+	defer func() { project.Environment = originalEnvironment }()
+	project.Environment = "cloud"
+
+	// Checked before the org is loaded, so no database is needed
+	request := httptest.NewRequest("GET", "/api/v1/orgs/org", nil)
+	user := User{Username: "admin@example.com", Verified: true, Active: true, SupportAccess: true}
+	if hasSupportAccess(request, &user, "org", "read", "org", "org") {
+		t.Errorf("hasSupportAccess should be false for users outside of Shuffle")
+	}
+
+	if hasSupportAccess(request, &User{Username: "support@shuffler.io", Verified: true, Active: true, SupportAccess: true}, "", "read", "org", "") {
+		t.Errorf("hasSupportAccess should be false without an org")
+	}
+}
+
+func TestReadOnlySupportGrantBlocksWrites(t *testing.T) {
+	user := User{Id: "support", Username: "support@shuffler.io", Role: "admin", ActiveOrg: OrgMini{Id: "org"}}
+	if Authorize(user, "workflow:write", "org") != nil {
+		t.Fatalf("Admin without a support grant is missing workflow:write")
+	}
+
+	user.SupportGrantAccess = getSupportGrantAccess(SupportGrant{ReadOnly: true})
+	for _, permission := range []string{"workflow:read", "files:read"} {
+		if err := Authorize(user, permission, "org"); err != nil {
+			t.Errorf("Read-only support grant blocked %s: %s", permission, err)
+		}
+	}
+
+	for _, permission := range []string{"workflow:write", "workflow:execute", "users:manage", "org:manage"} {
+		if Authorize(user, permission, "org") == nil {
+			t.Errorf("Read-only support grant allowed %s", permission)
+		}
+	}
+
+	for _, permission := range getUserPermissions(context.Background(), user) {
+		if !strings.HasSuffix(permission, ":read") {
+			t.Errorf("Read-only support grant gave the permission %s", permission)
+		}
+	}
+
+	user.SupportGrantAccess = getSupportGrantAccess(SupportGrant{})
+	if Authorize(user, "workflow:write", "org") != nil {
+		t.Errorf("Support grant with write access blocked workflow:write")
+	}
+}
+
+func TestGetSupportRequestAccess(t *testing.T) {
+	if getSupportRequestAccess(httptest.NewRequest("GET", "/api/v1/workflows", nil)) != "read" {
+		t.Errorf("GET requests should need read access")
+	}
+
+	if getSupportRequestAccess(httptest.NewRequest("POST", "/api/v1/workflows", nil)) != "write" {
+		t.Errorf("POST requests should need write access")
+	}
+}
@@ -0,0 +1,239 @@
+package shuffle
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracingOnce sync.Once
+var tracerProvider *sdktrace.TracerProvider
+var tracePropagator = propagation.TraceContext{}
+
+// Tracing is enabled with the standard OTEL_EXPORTER_OTLP_ENDPOINT or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT variables, e.g. http://otel-collector:4318.
+// Without them all spans are no-ops.
+func tracingEnabled() bool {
+	return len(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")) > 0 || len(os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")) > 0
+}
+
+func getTracer() trace.Tracer {
+	tracingOnce.Do(func() {
+		if !tracingEnabled() {
+			return
+		}
+
+		exporter, err := otlptracehttp.New(context.Background())
+		if err != nil {
+			log.Printf("[ERROR] Failed setting up OTLP trace exporter: %s", err)
+			return
+		}
+
+		serviceName := os.Getenv("OTEL_SERVICE_NAME")
+		if len(serviceName) == 0 {
+			serviceName = "shuffle-backend"
+		}
+
+		tracerProvider = sdktrace.NewTracerProvider(
+			sdktrace.WithBatcher(exporter),
+			sdktrace.WithResource(resource.NewWithAttributes(
+				semconv.SchemaURL,
+				semconv.ServiceName(serviceName),
+				attribute.String("shuffle.environment", project.Environment),
+			)),
+		)
+
+		otel.SetTracerProvider(tracerProvider)
+		otel.SetTextMapPropagator(tracePropagator)
+		log.Printf("[INFO] Exporting traces over OTLP as %s", serviceName)
+	})
+
+	return otel.Tracer("github.com/shuffle/shuffle-shared")
+}
+
+// Flushes remaining spans. Should be called by the backend before exiting.
+func ShutdownTracing(ctx context.Context) error {
+	if tracerProvider == nil {
+		return nil
+	}
+
+	return tracerProvider.Shutdown(ctx)
+}
+
+// Parses a W3C traceparent into a context that new spans can be children of
+func contextWithTraceParent(ctx context.Context, traceParent string) context.Context {
+	if len(traceParent) == 0 {
+		return ctx
+	}
+
+	carrier := propagation.MapCarrier{"traceparent": traceParent}
+	return tracePropagator.Extract(ctx, carrier)
+}
+
+func getTraceParent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	tracePropagator.Inject(ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+// Adds the current trace context to an outgoing request
+func injectTraceHeaders(ctx context.Context, req *http.Request) {
+	if !tracingEnabled() {
+		return
+	}
+
+	tracePropagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+}
+
+// Starts the span of a new execution. The parent is the traceparent header of
+// the request, or the parent execution's trace for subflows.
+func startExecutionSpan(ctx context.Context, request *http.Request) (context.Context, trace.Span) {
+	tracer := getTracer()
+	if request != nil && tracingEnabled() {
+		ctx = tracePropagator.Extract(ctx, propagation.HeaderCarrier(request.Header))
+		if !trace.SpanContextFromContext(ctx).IsValid() {
+			parentId := request.URL.Query().Get("source_execution")
+			if len(parentId) == 0 {
+				parentId = request.URL.Query().Get("reference_execution")
+			}
+
+			if len(parentId) > 0 {
+				parentExecution, err := GetWorkflowExecution(ctx, parentId)
+				if err == nil {
+					ctx = contextWithTraceParent(ctx, parentExecution.TraceParent)
+				}
+			}
+		}
+	}
+
+	return tracer.Start(ctx, "PrepareWorkflowExecution")
+}
+
+// Stores the trace of the span on the execution if it doesn't have one
+func setExecutionTrace(workflowExecution *WorkflowExecution, span trace.Span) {
+	if len(workflowExecution.TraceParent) > 0 || !span.SpanContext().IsValid() {
+		return
+	}
+
+	spanContext := span.SpanContext()
+	workflowExecution.TraceId = spanContext.TraceID().String()
+	workflowExecution.TraceParent = getTraceParent(trace.ContextWithSpanContext(context.Background(), spanContext))
+
+	span.SetAttributes(
+		attribute.String("shuffle.execution_id", workflowExecution.ExecutionId),
+		attribute.String("shuffle.workflow_id", workflowExecution.WorkflowId),
+		attribute.String("shuffle.org_id", workflowExecution.ExecutionOrg),
+		attribute.String("shuffle.execution_source", workflowExecution.ExecutionSource),
+	)
+}
+
+// Starts a span as a child of an existing execution
+func startChildSpan(ctx context.Context, name, traceParent string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	if len(traceParent) > 0 {
+		ctx = contextWithTraceParent(ctx, traceParent)
+	}
+
+	return getTracer().Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// Results and executions have both second and millisecond timestamps
+func parseTraceTimestamp(timestamp int64) time.Time {
+	if timestamp > 100000000000 {
+		return time.UnixMilli(timestamp)
+	}
+
+	return time.Unix(timestamp, 0)
+}
+
+// Adds a span for a finished action, using the start and end time reported
+// by the worker. The time between them is spent in Orborus, the worker and the app.
+func recordActionSpan(ctx context.Context, workflowExecution WorkflowExecution, actionResult ActionResult) {
+	if !tracingEnabled() || len(workflowExecution.TraceParent) == 0 || actionResult.StartedAt == 0 {
+		return
+	}
+
+	if actionResult.Status != "SUCCESS" && actionResult.Status != "FAILURE" && actionResult.Status != "ABORTED" && actionResult.Status != "SKIPPED" {
+		return
+	}
+
+	completedAt := actionResult.CompletedAt
+	if completedAt == 0 {
+		completedAt = time.Now().UnixMilli()
+	}
+
+	spanCtx := contextWithTraceParent(ctx, workflowExecution.TraceParent)
+	_, span := getTracer().Start(spanCtx, fmt.Sprintf("action %s", actionResult.Action.Label),
+		trace.WithTimestamp(parseTraceTimestamp(actionResult.StartedAt)),
+		trace.WithAttributes(
+			attribute.String("shuffle.execution_id", workflowExecution.ExecutionId),
+			attribute.String("shuffle.action_id", actionResult.Action.ID),
+			attribute.String("shuffle.app_name", actionResult.Action.AppName),
+			attribute.String("shuffle.app_version", actionResult.Action.AppVersion),
+			attribute.String("shuffle.action_name", actionResult.Action.Name),
+			attribute.String("shuffle.environment", actionResult.Action.Environment),
+			attribute.String("shuffle.status", actionResult.Status),
+		),
+	)
+
+	if actionResult.Status == "FAILURE" || actionResult.Status == "ABORTED" {
+		span.SetStatus(codes.Error, actionResult.Status)
+	}
+
+	span.End(trace.WithTimestamp(parseTraceTimestamp(completedAt)))
+}
+
+// Adds a span covering the whole execution once it is done
+func recordExecutionSpan(ctx context.Context, workflowExecution WorkflowExecution) {
+	if !tracingEnabled() || len(workflowExecution.TraceParent) == 0 {
+		return
+	}
+
+	if workflowExecution.Status != "FINISHED" && workflowExecution.Status != "ABORTED" && workflowExecution.Status != "FAILURE" {
+		return
+	}
+
+	cacheKey := fmt.Sprintf("execution_traced_%s", workflowExecution.ExecutionId)
+	_, err := GetCache(ctx, cacheKey)
+	if err == nil {
+		return
+	}
+
+	SetCache(ctx, cacheKey, []byte("1"), 60)
+
+	completedAt := workflowExecution.CompletedAt
+	if completedAt == 0 {
+		completedAt = time.Now().Unix()
+	}
+
+	spanCtx := contextWithTraceParent(ctx, workflowExecution.TraceParent)
+	_, span := getTracer().Start(spanCtx, "workflow execution",
+		trace.WithTimestamp(parseTraceTimestamp(workflowExecution.StartedAt)),
+		trace.WithAttributes(
+			attribute.String("shuffle.execution_id", workflowExecution.ExecutionId),
+			attribute.String("shuffle.workflow_id", workflowExecution.WorkflowId),
+			attribute.String("shuffle.org_id", workflowExecution.ExecutionOrg),
+			attribute.String("shuffle.status", workflowExecution.Status),
+			attribute.Int("shuffle.results", len(workflowExecution.Results)),
+		),
+	)
+
+	if workflowExecution.Status != "FINISHED" {
+		span.SetStatus(codes.Error, workflowExecution.Status)
+	}
+
+	span.End(trace.WithTimestamp(parseTraceTimestamp(completedAt)))
+}
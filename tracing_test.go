@@ -0,0 +1,134 @@
+package shuffle
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const testTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+// Records spans in memory instead of exporting them over OTLP
+func setTestTracer(t *testing.T, enabled bool) *tracetest.InMemoryExporter {
+	if enabled {
+		t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4318")
+	} else {
+		t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	}
+
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	tracingOnce.Do(func() {})
+
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() {
+		otel.SetTracerProvider(trace.NewNoopTracerProvider())
+	})
+
+	return exporter
+}
+
+func TestExecutionSpans(t *testing.T) {
+	exporter := setTestTracer(t, true)
+	ctx := context.Background()
+
+	request := httptest.NewRequest("POST", "/api/v1/workflows/workflow/execute", nil)
+	request.Header.Set("traceparent", testTraceParent)
+	_, span := startExecutionSpan(ctx, request)
+	if span.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Execution span didn't continue the trace of the request: %s", span.SpanContext().TraceID())
+	}
+
+	workflowExecution := WorkflowExecution{ExecutionId: "tracing-test-execution", WorkflowId: "workflow", Status: "FINISHED", StartedAt: time.Now().Unix() - 10}
+	setExecutionTrace(&workflowExecution, span)
+	span.End()
+	if workflowExecution.TraceId != "4bf92f3577b34da6a3ce929d0e0e4736" || len(workflowExecution.TraceParent) == 0 {
+		t.Fatalf("Trace wasn't stored on the execution: %s %s", workflowExecution.TraceId, workflowExecution.TraceParent)
+	}
+
+	recordActionSpan(ctx, workflowExecution, ActionResult{
+		Action:    Action{ID: "action", Label: "lookup"},
+		Status:    "FAILURE",
+		StartedAt: time.Now().UnixMilli() - 1000,
+	})
+
+	defer DeleteCache(ctx, "execution_traced_tracing-test-execution")
+	recordExecutionSpan(ctx, workflowExecution)
+	recordExecutionSpan(ctx, workflowExecution)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 3 {
+		t.Fatalf("Expected the execution, action and workflow execution spans, got %d", len(spans))
+	}
+
+	actionSpan := spans[1]
+	if actionSpan.Name != "action lookup" || actionSpan.Status.Code != codes.Error {
+		t.Errorf("Unexpected action span %s with status %v", actionSpan.Name, actionSpan.Status.Code)
+	}
+
+	for _, recorded := range spans[1:] {
+		if recorded.Parent.SpanID() != span.SpanContext().SpanID() {
+			t.Errorf("Span %s isn't a child of the execution span", recorded.Name)
+		}
+	}
+}
+
+func TestTraceContextPropagation(t *testing.T) {
+	setTestTracer(t, true)
+	ctx := contextWithTraceParent(context.Background(), testTraceParent)
+	if traceParent := getTraceParent(ctx); traceParent != testTraceParent {
+		t.Errorf("Trace parent wasn't kept: %s", traceParent)
+	}
+
+	if contextWithTraceParent(ctx, "") != ctx {
+		t.Errorf("Empty trace parent changed the context")
+	}
+
+	childCtx, span := startChildSpan(context.Background(), "child", testTraceParent)
+	defer span.End()
+	if span.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Child span started a new trace: %s", span.SpanContext().TraceID())
+	}
+
+	request := httptest.NewRequest("GET", "/api/v1/apps", nil)
+	injectTraceHeaders(childCtx, request)
+	if request.Header.Get("traceparent") != getTraceParent(childCtx) {
+		t.Errorf("Outgoing request didn't get the trace of the child span: %s", request.Header.Get("traceparent"))
+	}
+}
+
+func TestTracingDisabled(t *testing.T) {
+	exporter := setTestTracer(t, false)
+	if tracingEnabled() {
+		t.Fatalf("Tracing was enabled without an exporter endpoint")
+	}
+
+	ctx := contextWithTraceParent(context.Background(), testTraceParent)
+	request := httptest.NewRequest("GET", "/api/v1/apps", nil)
+	injectTraceHeaders(ctx, request)
+	if len(request.Header.Get("traceparent")) > 0 {
+		t.Errorf("Trace headers were added with tracing disabled")
+	}
+
+	request = httptest.NewRequest("POST", "/api/v1/workflows/workflow/execute", nil)
+	request.Header.Set("traceparent", testTraceParent)
+	_, span := startExecutionSpan(context.Background(), request)
+	span.End()
+	if span.SpanContext().TraceID().String() == "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Trace of the request was used with tracing disabled")
+	}
+
+	workflowExecution := WorkflowExecution{ExecutionId: "tracing-test-disabled", Status: "FINISHED", TraceParent: testTraceParent}
+	recordActionSpan(ctx, workflowExecution, ActionResult{Status: "SUCCESS", StartedAt: time.Now().UnixMilli()})
+	recordExecutionSpan(ctx, workflowExecution)
+	if len(exporter.GetSpans()) != 1 {
+		t.Errorf("Action or execution spans were recorded with tracing disabled: %d", len(exporter.GetSpans()))
+	}
+}
@@ -0,0 +1,714 @@
+package shuffle
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	uuid "github.com/satori/go.uuid"
+)
+
+var recoveryCodeAmount = 10
+
+// Wraps a user so it can be used by the webauthn library
+type webauthnUser struct {
+	user *User
+}
+
+func (w webauthnUser) WebAuthnID() []byte {
+	return []byte(w.user.Id)
+}
+
+func (w webauthnUser) WebAuthnName() string {
+	return w.user.Username
+}
+
+func (w webauthnUser) WebAuthnDisplayName() string {
+	return w.user.Username
+}
+
+func (w webauthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (w webauthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := []webauthn.Credential{}
+	for _, authenticator := range w.user.MFA.Authenticators {
+		transports := []protocol.AuthenticatorTransport{}
+		for _, transport := range authenticator.Transport {
+			transports = append(transports, protocol.AuthenticatorTransport(transport))
+		}
+
+		credentials = append(credentials, webauthn.Credential{
+			ID:              authenticator.CredentialId,
+			PublicKey:       authenticator.PublicKey,
+			AttestationType: authenticator.AttestationType,
+			Transport:       transports,
+			Flags: webauthn.CredentialFlags{
+				BackupEligible: authenticator.BackupEligible,
+				BackupState:    authenticator.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    authenticator.AAGUID,
+				SignCount: authenticator.SignCount,
+			},
+		})
+	}
+
+	return credentials
+}
+
+// The relying party is the frontend users log in through. It comes from
+// server config only, never the request's Host or forwarded headers:
+// SHUFFLE_WEBAUTHN_ORIGINS (comma separated, e.g. https://shuffler.io),
+// falling back to SSO_REDIRECT_URL. SHUFFLE_WEBAUTHN_RPID defaults to the
+// first origin's hostname.
+func getWebAuthnConfig() (string, []string, error) {
+	origins := []string{}
+	for _, origin := range strings.Split(os.Getenv("SHUFFLE_WEBAUTHN_ORIGINS"), ",") {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		if len(origin) > 0 {
+			origins = append(origins, origin)
+		}
+	}
+
+	if len(origins) == 0 && len(os.Getenv("SSO_REDIRECT_URL")) > 0 {
+		origins = append(origins, strings.TrimRight(strings.TrimSpace(os.Getenv("SSO_REDIRECT_URL")), "/"))
+	}
+
+	if len(origins) == 0 && project.Environment == "cloud" {
+		origins = append(origins, "https://shuffler.io")
+	}
+
+	if len(origins) == 0 {
+		return "", origins, errors.New("WebAuthn requires SHUFFLE_WEBAUTHN_ORIGINS or SSO_REDIRECT_URL to be set")
+	}
+
+	for _, origin := range origins {
+		parsedOrigin, err := url.Parse(origin)
+		if err != nil || (parsedOrigin.Scheme != "https" && parsedOrigin.Scheme != "http") || len(parsedOrigin.Hostname()) == 0 {
+			return "", origins, errors.New(fmt.Sprintf("Invalid WebAuthn origin %#v", origin))
+		}
+	}
+
+	rpId := strings.TrimSpace(os.Getenv("SHUFFLE_WEBAUTHN_RPID"))
+	if len(rpId) == 0 {
+		parsedOrigin, _ := url.Parse(origins[0])
+		rpId = parsedOrigin.Hostname()
+	}
+
+	return rpId, origins, nil
+}
+
+func getWebAuthn() (*webauthn.WebAuthn, error) {
+	rpId, origins, err := getWebAuthnConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return webauthn.New(&webauthn.Config{
+		RPID:          rpId,
+		RPDisplayName: "Shuffle",
+		RPOrigins:     origins,
+	})
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	hash := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(hash[:])
+}
+
+// Generates new one-time recovery codes. Only the hashes are stored
+func generateRecoveryCodes(user *User) ([]string, error) {
+	codes := []string{}
+	hashes := []string{}
+	for i := 0; i < recoveryCodeAmount; i++ {
+		randomBytes := make([]byte, 10)
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return codes, err
+		}
+
+		code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))
+		code = fmt.Sprintf("%s-%s", code[:8], code[8:])
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	user.MFA.RecoveryCodes = hashes
+	return codes, nil
+}
+
+// Uses up a recovery code if it matches one of the unused ones
+func useRecoveryCode(user *User, code string) bool {
+	if len(code) == 0 {
+		return false
+	}
+
+	hash := hashRecoveryCode(code)
+	for index, storedHash := range user.MFA.RecoveryCodes {
+		if storedHash == hash {
+			user.MFA.RecoveryCodes = append(user.MFA.RecoveryCodes[:index], user.MFA.RecoveryCodes[index+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasSecondFactor(user User) bool {
+	return user.MFA.Active || len(user.MFA.Authenticators) > 0
+}
+
+// Starts a WebAuthn login for the user. The returned options are passed to
+// navigator.credentials.get() and the result is sent back as "webauthn" in the login.
+func beginWebauthnLogin(ctx context.Context, request *http.Request, user User) (*protocol.CredentialAssertion, error) {
+	webAuthn, err := getWebAuthn()
+	if err != nil {
+		return nil, err
+	}
+
+	assertion, session, err := webAuthn.BeginLogin(webauthnUser{user: &user})
+	if err != nil {
+		return nil, err
+	}
+
+	sessionData, err := json.Marshal(session)
+	if err != nil {
+		return nil, err
+	}
+
+	err = SetCache(ctx, fmt.Sprintf("webauthn_login_%s", user.Id), sessionData, 5)
+	if err != nil {
+		return nil, err
+	}
+
+	return assertion, nil
+}
+
+// Verifies a WebAuthn assertion or recovery code sent during login.
+// The user is updated with the new sign count or the used code removed.
+func verifyLoginSecondFactor(ctx context.Context, request *http.Request, user *User, data loginStruct) error {
+	if len(data.RecoveryCode) > 0 {
+		if !useRecoveryCode(user, data.RecoveryCode) {
+			return errors.New("Invalid recovery code")
+		}
+
+		log.Printf("[AUDIT] User %s (%s) logged in with a recovery code. %d codes left", user.Username, user.Id, len(user.MFA.RecoveryCodes))
+		return SetUser(ctx, user, false)
+	}
+
+	cacheKey := fmt.Sprintf("webauthn_login_%s", user.Id)
+	cache, err := GetCache(ctx, cacheKey)
+	if err != nil {
+		return errors.New("WebAuthn login not started or timed out")
+	}
+
+	// Only one attempt per challenge
+	DeleteCache(ctx, cacheKey)
+
+	session := webauthn.SessionData{}
+	err = json.Unmarshal([]byte(cache.([]uint8)), &session)
+	if err != nil {
+		return err
+	}
+
+	parsedResponse, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(data.WebAuthn))
+	if err != nil {
+		return err
+	}
+
+	webAuthn, err := getWebAuthn()
+	if err != nil {
+		return err
+	}
+
+	credential, err := webAuthn.ValidateLogin(webauthnUser{user: user}, session, parsedResponse)
+	if err != nil {
+		return err
+	}
+
+	if credential.Authenticator.CloneWarning {
+		log.Printf("[WARNING] Sign count of WebAuthn authenticator for %s (%s) went backwards. It may be cloned", user.Username, user.Id)
+	}
+
+	for index, authenticator := range user.MFA.Authenticators {
+		if bytes.Equal(authenticator.CredentialId, credential.ID) {
+			user.MFA.Authenticators[index].SignCount = credential.Authenticator.SignCount
+			user.MFA.Authenticators[index].BackupState = credential.Flags.BackupState
+			user.MFA.Authenticators[index].LastUsed = time.Now().Unix()
+			break
+		}
+	}
+
+	return SetUser(ctx, user, false)
+}
+
+// Users can enroll keys with their session, or with the MFA_SETUP code
+// from login when their org requires MFA: ?code=<code>
+func getWebauthnSetupUser(resp http.ResponseWriter, request *http.Request) (User, error) {
+	user, err := HandleApiAuthentication(resp, request)
+	if err == nil {
+		return user, nil
+	}
+
+	setupCode := request.URL.Query().Get("code")
+	if len(setupCode) == 0 {
+		return user, err
+	}
+
+	ctx := GetContext(request)
+	cacheUserId, cacheErr := GetCache(ctx, fmt.Sprintf("user_id_%s", setupCode))
+	if cacheErr != nil {
+		return user, err
+	}
+
+	foundUser, err := GetUser(ctx, string(cacheUserId.([]uint8)))
+	if err != nil {
+		return user, err
+	}
+
+	return *foundUser, nil
+}
+
+func HandleBeginWebauthnRegistration(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := getWebauthnSetupUser(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in begin webauthn registration: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	foundUser, err := GetUser(ctx, user.Id)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting user %s in begin webauthn registration: %s", user.Id, err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	webAuthn, err := getWebAuthn()
+	if err != nil {
+		log.Printf("[ERROR] Failed setting up WebAuthn: %s", err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "WebAuthn is not configured correctly"}`))
+		return
+	}
+
+	// Don't let the same key be registered twice
+	exclusions := []protocol.CredentialDescriptor{}
+	for _, credential := range (webauthnUser{user: foundUser}).WebAuthnCredentials() {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+
+	creation, session, err := webAuthn.BeginRegistration(webauthnUser{user: foundUser}, webauthn.WithExclusions(exclusions))
+	if err != nil {
+		log.Printf("[WARNING] Failed beginning webauthn registration for %s: %s", foundUser.Username, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	sessionData, err := json.Marshal(session)
+	if err == nil {
+		err = SetCache(ctx, fmt.Sprintf("webauthn_registration_%s", foundUser.Id), sessionData, 5)
+	}
+
+	if err != nil {
+		log.Printf("[WARNING] Failed storing webauthn registration for %s: %s", foundUser.Username, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	newjson, err := json.Marshal(creation)
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// Finishes the registration with the result of navigator.credentials.create().
+// ?name= names the authenticator. Recovery codes are returned when the first
+// second factor is added.
+func HandleFinishWebauthnRegistration(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := getWebauthnSetupUser(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in finish webauthn registration: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	foundUser, err := GetUser(ctx, user.Id)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting user %s in finish webauthn registration: %s", user.Id, err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	cacheKey := fmt.Sprintf("webauthn_registration_%s", foundUser.Id)
+	cache, err := GetCache(ctx, cacheKey)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Registration not started or timed out. Please try again."}`))
+		return
+	}
+
+	DeleteCache(ctx, cacheKey)
+	session := webauthn.SessionData{}
+	err = json.Unmarshal([]byte(cache.([]uint8)), &session)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	parsedResponse, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(body))
+	if err != nil {
+		log.Printf("[WARNING] Failed parsing webauthn registration for %s: %s", foundUser.Username, err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Failed parsing the authenticator response"}`))
+		return
+	}
+
+	webAuthn, err := getWebAuthn()
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	credential, err := webAuthn.CreateCredential(webauthnUser{user: foundUser}, session, parsedResponse)
+	if err != nil {
+		log.Printf("[WARNING] Failed verifying webauthn registration for %s: %s", foundUser.Username, err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Failed verifying the authenticator"}`))
+		return
+	}
+
+	name := strings.TrimSpace(request.URL.Query().Get("name"))
+	if len(name) == 0 {
+		name = fmt.Sprintf("Key %d", len(foundUser.MFA.Authenticators)+1)
+	}
+
+	if len(name) > 64 {
+		name = name[:64]
+	}
+
+	transports := []string{}
+	for _, transport := range credential.Transport {
+		transports = append(transports, string(transport))
+	}
+
+	firstFactor := !hasSecondFactor(*foundUser)
+	foundUser.MFA.Authenticators = append(foundUser.MFA.Authenticators, WebAuthnAuthenticator{
+		Id:              uuid.NewV4().String(),
+		Name:            name,
+		CredentialId:    credential.ID,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		Transport:       transports,
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+		BackupEligible:  credential.Flags.BackupEligible,
+		BackupState:     credential.Flags.BackupState,
+		Created:         time.Now().Unix(),
+	})
+
+	codes := []string{}
+	if firstFactor || len(foundUser.MFA.RecoveryCodes) == 0 {
+		codes, err = generateRecoveryCodes(foundUser)
+		if err != nil {
+			log.Printf("[ERROR] Failed generating recovery codes for %s: %s", foundUser.Username, err)
+		}
+	}
+
+	err = SetUser(ctx, foundUser, true)
+	if err != nil {
+		log.Printf("[WARNING] Failed saving webauthn authenticator for %s: %s", foundUser.Username, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed updating your user. Please try again."}`))
+		return
+	}
+
+	log.Printf("[AUDIT] User %s (%s) registered WebAuthn authenticator '%s'", foundUser.Username, foundUser.Id, name)
+	CreateAuditEvent(ctx, request, *foundUser, foundUser.ActiveOrg.Id, "user.mfa_add", "user", foundUser.Id, nil, name)
+	newjson, err := json.Marshal(struct {
+		Success       bool     `json:"success"`
+		RecoveryCodes []string `json:"recovery_codes,omitempty"`
+	}{
+		Success:       true,
+		RecoveryCodes: codes,
+	})
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// Lists the user's authenticators without their keys
+func HandleGetWebauthnAuthenticators(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in get webauthn authenticators: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	foundUser, err := GetUser(ctx, user.Id)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	authenticators := []WebAuthnAuthenticator{}
+	for _, authenticator := range foundUser.MFA.Authenticators {
+		authenticator.PublicKey = []byte{}
+		authenticator.CredentialId = []byte{}
+		authenticators = append(authenticators, authenticator)
+	}
+
+	newjson, err := json.Marshal(struct {
+		Success        bool                    `json:"success"`
+		Authenticators []WebAuthnAuthenticator `json:"authenticators"`
+		RecoveryCodes  int                     `json:"recovery_codes_left"`
+	}{
+		Success:        true,
+		Authenticators: authenticators,
+		RecoveryCodes:  len(foundUser.MFA.RecoveryCodes),
+	})
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// Removes an authenticator: /api/v1/users/webauthn/{id}
+func HandleDeleteWebauthnAuthenticator(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in delete webauthn authenticator: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	location := strings.Split(strings.Split(request.URL.String(), "?")[0], "/")
+	if len(location) <= 5 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Authenticator ID required"}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	foundUser, err := GetUser(ctx, user.Id)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	authenticators := []WebAuthnAuthenticator{}
+	removed := WebAuthnAuthenticator{}
+	for _, authenticator := range foundUser.MFA.Authenticators {
+		if authenticator.Id == location[5] {
+			removed = authenticator
+			continue
+		}
+
+		authenticators = append(authenticators, authenticator)
+	}
+
+	if len(removed.Id) == 0 {
+		resp.WriteHeader(404)
+		resp.Write([]byte(`{"success": false, "reason": "Authenticator not found"}`))
+		return
+	}
+
+	foundUser.MFA.Authenticators = authenticators
+	if !hasSecondFactor(*foundUser) {
+		foundUser.MFA.RecoveryCodes = []string{}
+	}
+
+	err = SetUser(ctx, foundUser, true)
+	if err != nil {
+		log.Printf("[WARNING] Failed removing webauthn authenticator for %s: %s", foundUser.Username, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	log.Printf("[AUDIT] User %s (%s) removed WebAuthn authenticator '%s'", foundUser.Username, foundUser.Id, removed.Name)
+	CreateAuditEvent(ctx, request, *foundUser, foundUser.ActiveOrg.Id, "user.mfa_remove", "user", foundUser.Id, removed.Name, nil)
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
+
+// Replaces the user's recovery codes with new ones. Old codes stop working
+func HandleGenerateRecoveryCodes(resp http.ResponseWriter, request *http.Request) {
+	cors := HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in generate recovery codes: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	ctx := GetContext(request)
+	foundUser, err := GetUser(ctx, user.Id)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if !hasSecondFactor(*foundUser) {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Set up 2-factor authentication before generating recovery codes"}`))
+		return
+	}
+
+	codes, err := generateRecoveryCodes(foundUser)
+	if err != nil {
+		log.Printf("[ERROR] Failed generating recovery codes for %s: %s", foundUser.Username, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	err = SetUser(ctx, foundUser, true)
+	if err != nil {
+		log.Printf("[WARNING] Failed saving recovery codes for %s: %s", foundUser.Username, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	log.Printf("[AUDIT] User %s (%s) generated new recovery codes", foundUser.Username, foundUser.Id)
+	CreateAuditEvent(ctx, request, *foundUser, foundUser.ActiveOrg.Id, "user.recovery_codes_create", "user", foundUser.Id, nil, nil)
+	newjson, err := json.Marshal(struct {
+		Success       bool     `json:"success"`
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{
+		Success:       true,
+		RecoveryCodes: codes,
+	})
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// Tells the client which second factors it can use. With WebAuthn keys,
+// the options for navigator.credentials.get() are included.
+func writeMfaRedirect(ctx context.Context, resp http.ResponseWriter, request *http.Request, user User) {
+	methods := []string{}
+	if user.MFA.Active {
+		methods = append(methods, "totp")
+	}
+
+	var assertion *protocol.CredentialAssertion
+	if len(user.MFA.Authenticators) > 0 {
+		var err error
+		assertion, err = beginWebauthnLogin(ctx, request, user)
+		if err != nil {
+			log.Printf("[WARNING] Failed starting webauthn login for %s (%s): %s", user.Username, user.Id, err)
+		} else {
+			methods = append(methods, "webauthn")
+		}
+	}
+
+	if len(user.MFA.RecoveryCodes) > 0 {
+		methods = append(methods, "recovery_code")
+	}
+
+	newjson, err := json.Marshal(struct {
+		Success  bool                          `json:"success"`
+		Reason   string                        `json:"reason"`
+		Methods  []string                      `json:"methods"`
+		WebAuthn *protocol.CredentialAssertion `json:"webauthn,omitempty"`
+	}{
+		Success:  true,
+		Reason:   "MFA_REDIRECT",
+		Methods:  methods,
+		WebAuthn: assertion,
+	})
+	if err != nil {
+		newjson = []byte(`{"success": true, "reason": "MFA_REDIRECT"}`)
+	}
+
+	resp.WriteHeader(409)
+	resp.Write(newjson)
+}
@@ -0,0 +1,53 @@
+package shuffle
+
+import (
+	"testing"
+)
+
+func TestGetWebAuthnConfig(t *testing.T) {
+	oldEnvironment := project.Environment
+	project.Environment = "onprem"
+	defer func() { project.Environment = oldEnvironment }()
+
+	t.Setenv("SHUFFLE_WEBAUTHN_ORIGINS", "")
+	t.Setenv("SHUFFLE_WEBAUTHN_RPID", "")
+	t.Setenv("SSO_REDIRECT_URL", "")
+	if _, _, err := getWebAuthnConfig(); err == nil {
+		t.Errorf("WebAuthn was configured without any server config")
+	}
+
+	if _, err := getWebAuthn(); err == nil {
+		t.Errorf("getWebAuthn worked without any server config")
+	}
+
+	t.Setenv("SSO_REDIRECT_URL", "https://shuffle.example.com:3443/")
+	rpId, origins, err := getWebAuthnConfig()
+	if err != nil || rpId != "shuffle.example.com" || len(origins) != 1 || origins[0] != "https://shuffle.example.com:3443" {
+		t.Errorf("Config from SSO_REDIRECT_URL = %s, %v, %v", rpId, origins, err)
+	}
+
+	t.Setenv("SHUFFLE_WEBAUTHN_ORIGINS", "https://app.example.com, https://admin.example.com")
+	t.Setenv("SHUFFLE_WEBAUTHN_RPID", "example.com")
+	rpId, origins, err = getWebAuthnConfig()
+	if err != nil || rpId != "example.com" || len(origins) != 2 || origins[1] != "https://admin.example.com" {
+		t.Errorf("Config from SHUFFLE_WEBAUTHN_ORIGINS = %s, %v, %v", rpId, origins, err)
+	}
+
+	if _, err := getWebAuthn(); err != nil {
+		t.Errorf("getWebAuthn failed with valid config: %s", err)
+	}
+
+	t.Setenv("SHUFFLE_WEBAUTHN_ORIGINS", "app.example.com")
+	if _, _, err := getWebAuthnConfig(); err == nil {
+		t.Errorf("Origin without a scheme was accepted")
+	}
+
+	t.Setenv("SHUFFLE_WEBAUTHN_ORIGINS", "")
+	t.Setenv("SSO_REDIRECT_URL", "")
+	t.Setenv("SHUFFLE_WEBAUTHN_RPID", "")
+	project.Environment = "cloud"
+	rpId, origins, err = getWebAuthnConfig()
+	if err != nil || rpId != "shuffler.io" || origins[0] != "https://shuffler.io" {
+		t.Errorf("Cloud config = %s, %v, %v", rpId, origins, err)
+	}
+}
@@ -0,0 +1,494 @@
+package shuffle
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmespath/go-jmespath"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+var validHookSignatureSchemes = []string{"", "github", "stripe", "slack", "hmac"}
+
+// How long deliveries without a signed timestamp are remembered
+const hookNonceSeconds = 24 * 60 * 60
+
+// Every scheme needs either a signed timestamp or a delivery ID to stop replays
+func validateHookSignatureConfig(config HookSignature) error {
+	if config.Scheme == "hmac" && len(config.TimestampHeader) == 0 && len(config.NonceHeader) == 0 {
+		return errors.New("hmac signatures need a timestamp header or a nonce header")
+	}
+
+	return nil
+}
+
+// Runs all checks for an incoming webhook request before it may start an execution:
+// static auth headers (CheckHookAuth), signature verification with replay protection,
+// payload schema validation and transformation.
+// Returns the (transformed) body, which is also set back on the request for PrepareWorkflowExecution,
+// and the status code to respond with on failure (401 for auth, 400 for bad payloads).
+func ValidateHookRequest(ctx context.Context, request *http.Request, hook Hook) ([]byte, int, error) {
+	body := []byte{}
+	if request.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(request.Body)
+		if err != nil {
+			return body, 400, err
+		}
+
+		request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	err := CheckHookAuth(request, hook.Auth)
+	if err != nil {
+		return body, 401, err
+	}
+
+	err = CheckHookSignature(ctx, request, body, hook)
+	if err != nil {
+		log.Printf("[AUDIT] Webhook %s in org %s rejected: %s", hook.Id, hook.OrgId, err)
+		return body, 401, err
+	}
+
+	newBody, validationErrors, err := ValidateHookPayload(hook, body)
+	if err != nil {
+		if len(validationErrors) > 0 {
+			err = errors.New(fmt.Sprintf("%s: %s", err, strings.Join(validationErrors, "; ")))
+		}
+
+		log.Printf("[INFO] Webhook %s in org %s got a bad payload: %s", hook.Id, hook.OrgId, err)
+		return body, 400, err
+	}
+
+	request.Body = ioutil.NopCloser(bytes.NewReader(newBody))
+	request.ContentLength = int64(len(newBody))
+	return newBody, 200, nil
+}
+
+// Validates a webhook payload against the hook's JSON Schema, then applies the field mappings.
+// Returns the new payload and a list of detailed validation errors
+func ValidateHookPayload(hook Hook, body []byte) ([]byte, []string, error) {
+	if len(strings.TrimSpace(hook.PayloadSchema)) == 0 && len(hook.Transform.Mappings) == 0 {
+		return body, []string{}, nil
+	}
+
+	var payload interface{}
+	err := json.Unmarshal(body, &payload)
+	if err != nil {
+		return body, []string{err.Error()}, errors.New("Payload is not valid JSON")
+	}
+
+	if len(strings.TrimSpace(hook.PayloadSchema)) > 0 {
+		schema, err := parseHookSchema(hook.PayloadSchema)
+		if err != nil {
+			return body, []string{}, err
+		}
+
+		err = schema.Validate(payload)
+		if err != nil {
+			return body, getSchemaErrorDetails(err), errors.New("Payload doesn't match the webhook schema")
+		}
+	}
+
+	if len(hook.Transform.Mappings) == 0 {
+		return body, []string{}, nil
+	}
+
+	transformed, missing := transformHookPayload(payload, hook.Transform)
+	if len(missing) > 0 {
+		return body, missing, errors.New("Payload is missing required fields")
+	}
+
+	newBody, err := json.Marshal(transformed)
+	if err != nil {
+		return body, []string{}, err
+	}
+
+	return newBody, []string{}, nil
+}
+
+// Compiles a JSON Schema. Remote and file $refs are not loaded
+func parseHookSchema(rawSchema string) (*jsonschema.Schema, error) {
+	compiler := jsonschema.NewCompiler()
+	compiler.LoadURL = func(url string) (io.ReadCloser, error) {
+		return nil, errors.New(fmt.Sprintf("Loading external schema %s is not allowed", url))
+	}
+
+	err := compiler.AddResource("webhook.json", strings.NewReader(rawSchema))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid payload schema: %s", err))
+	}
+
+	schema, err := compiler.Compile("webhook.json")
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid payload schema: %s", err))
+	}
+
+	return schema, nil
+}
+
+// Flattens schema errors to "/path: reason" for the innermost causes
+func getSchemaErrorDetails(err error) []string {
+	validationErr, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return []string{err.Error()}
+	}
+
+	if len(validationErr.Causes) == 0 {
+		location := validationErr.InstanceLocation
+		if len(location) == 0 {
+			location = "/"
+		}
+
+		return []string{fmt.Sprintf("%s: %s", location, validationErr.Message)}
+	}
+
+	details := []string{}
+	for _, cause := range validationErr.Causes {
+		details = append(details, getSchemaErrorDetails(cause)...)
+	}
+
+	return details
+}
+
+func transformHookPayload(payload interface{}, transform HookTransform) (interface{}, []string) {
+	output := map[string]interface{}{}
+	if original, ok := payload.(map[string]interface{}); ok && transform.KeepOriginal {
+		output = original
+	}
+
+	missing := []string{}
+	for _, mapping := range transform.Mappings {
+		if len(mapping.Destination) == 0 {
+			continue
+		}
+
+		value, found := getHookPayloadValue(payload, mapping.Source)
+		if !found {
+			if mapping.Required {
+				missing = append(missing, fmt.Sprintf("%s: required field not found", mapping.Source))
+				continue
+			}
+
+			if len(mapping.Default) == 0 {
+				continue
+			}
+
+			value = mapping.Default
+		}
+
+		setHookPayloadValue(output, splitHookPath(mapping.Destination), value)
+	}
+
+	return output, missing
+}
+
+// Destination paths: "alert.items[0].id" -> ["alert", "items", "0", "id"]
+func splitHookPath(path string) []string {
+	path = strings.ReplaceAll(path, "[", ".")
+	path = strings.ReplaceAll(path, "]", "")
+
+	parts := []string{}
+	for _, part := range strings.Split(path, ".") {
+		if len(part) > 0 {
+			parts = append(parts, part)
+		}
+	}
+
+	return parts
+}
+
+// Sources are JMESPath expressions. Null and missing values are both treated as not found
+func getHookPayloadValue(payload interface{}, expression string) (interface{}, bool) {
+	value, err := jmespath.Search(expression, payload)
+	if err != nil || value == nil {
+		return nil, false
+	}
+
+	return value, true
+}
+
+// Used when saving hooks and event subscriptions
+func validateHookExpression(expression string) error {
+	_, err := jmespath.Compile(expression)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid JMESPath expression '%s': %s", expression, err))
+	}
+
+	return nil
+}
+
+func setHookPayloadValue(output map[string]interface{}, parts []string, value interface{}) {
+	if len(parts) == 0 {
+		return
+	}
+
+	if len(parts) == 1 {
+		output[parts[0]] = value
+		return
+	}
+
+	next, ok := output[parts[0]].(map[string]interface{})
+	if !ok {
+		next = map[string]interface{}{}
+		output[parts[0]] = next
+	}
+
+	setHookPayloadValue(next, parts[1:], value)
+}
+
+// Verifies the HMAC signature of a webhook body based on the hook's signature scheme.
+// Every request is checked for replays. Schemes with a signed timestamp (stripe, slack
+// and hmac with a timestamp header) are checked against the tolerance, and the hash of
+// the signed payload is claimed for that window. The rest need a delivery ID (github's
+// X-GitHub-Delivery or the hmac nonce header), which is claimed for a day.
+func CheckHookSignature(ctx context.Context, request *http.Request, body []byte, hook Hook) error {
+	config := hook.Signature
+	if len(config.Scheme) == 0 {
+		return nil
+	}
+
+	secret, err := getHookSecret(hook)
+	if err != nil {
+		log.Printf("[ERROR] Failed decrypting signature secret for hook %s: %s", hook.Id, err)
+		return errors.New("Failed loading the signature secret")
+	}
+
+	if len(secret) == 0 {
+		return errors.New("Signature verification is enabled, but no secret is configured")
+	}
+
+	tolerance := config.Tolerance
+	if tolerance <= 0 {
+		tolerance = 300
+	}
+
+	timestamp := ""
+	nonce := ""
+	signedPayload := body
+	validSignature := false
+	switch config.Scheme {
+	case "github":
+		nonce = request.Header.Get("X-GitHub-Delivery")
+		if len(nonce) == 0 {
+			return errors.New("Missing header X-GitHub-Delivery")
+		}
+
+		signature := request.Header.Get("X-Hub-Signature-256")
+		if len(signature) > 0 {
+			validSignature = compareHookSignature(sha256.New, secret, body, strings.TrimPrefix(signature, "sha256="), "hex")
+		} else {
+			signature = request.Header.Get("X-Hub-Signature")
+			if len(signature) == 0 {
+				return errors.New("Missing header X-Hub-Signature-256")
+			}
+
+			validSignature = compareHookSignature(sha1.New, secret, body, strings.TrimPrefix(signature, "sha1="), "hex")
+		}
+	case "stripe":
+		// Stripe-Signature: t=1492774577,v1=5257a869e7...,v1=...
+		header := request.Header.Get("Stripe-Signature")
+		if len(header) == 0 {
+			return errors.New("Missing header Stripe-Signature")
+		}
+
+		signatures := []string{}
+		for _, item := range strings.Split(header, ",") {
+			itemSplit := strings.SplitN(strings.TrimSpace(item), "=", 2)
+			if len(itemSplit) != 2 {
+				continue
+			}
+
+			if itemSplit[0] == "t" {
+				timestamp = itemSplit[1]
+			} else if itemSplit[0] == "v1" {
+				signatures = append(signatures, itemSplit[1])
+			}
+		}
+
+		if len(timestamp) == 0 || len(signatures) == 0 {
+			return errors.New("Bad Stripe-Signature header format")
+		}
+
+		signedPayload = append([]byte(timestamp+"."), body...)
+		for _, signature := range signatures {
+			if compareHookSignature(sha256.New, secret, signedPayload, signature, "hex") {
+				validSignature = true
+				break
+			}
+		}
+	case "slack":
+		timestamp = request.Header.Get("X-Slack-Request-Timestamp")
+		signature := request.Header.Get("X-Slack-Signature")
+		if len(timestamp) == 0 || len(signature) == 0 {
+			return errors.New("Missing header X-Slack-Request-Timestamp or X-Slack-Signature")
+		}
+
+		signedPayload = append([]byte(fmt.Sprintf("v0:%s:", timestamp)), body...)
+		validSignature = compareHookSignature(sha256.New, secret, signedPayload, strings.TrimPrefix(signature, "v0="), "hex")
+	case "hmac":
+		headerName := config.Header
+		if len(headerName) == 0 {
+			headerName = "X-Signature"
+		}
+
+		signature := request.Header.Get(headerName)
+		if len(signature) == 0 {
+			return errors.New(fmt.Sprintf("Missing header %s", headerName))
+		}
+
+		if len(config.TimestampHeader) > 0 {
+			timestamp = request.Header.Get(config.TimestampHeader)
+			if len(timestamp) == 0 {
+				return errors.New(fmt.Sprintf("Missing header %s", config.TimestampHeader))
+			}
+
+			signedPayload = append([]byte(timestamp+"."), body...)
+		} else {
+			err = validateHookSignatureConfig(config)
+			if err != nil {
+				return err
+			}
+
+			nonce = request.Header.Get(config.NonceHeader)
+			if len(nonce) == 0 {
+				return errors.New(fmt.Sprintf("Missing header %s", config.NonceHeader))
+			}
+		}
+
+		hashFunc := sha256.New
+		if strings.ToLower(config.Algorithm) == "sha1" {
+			hashFunc = sha1.New
+		}
+
+		validSignature = compareHookSignature(hashFunc, secret, signedPayload, strings.TrimPrefix(signature, config.Prefix), config.Encoding)
+	default:
+		return errors.New(fmt.Sprintf("Unknown signature scheme '%s'", config.Scheme))
+	}
+
+	if !validSignature {
+		return errors.New("Invalid webhook signature")
+	}
+
+	if len(timestamp) == 0 {
+		// The delivery ID isn't signed, so the body is claimed as well.
+		// Otherwise a replay could get through by sending a new ID.
+		err = claimHookNonce(ctx, hook.Id, "delivery", []byte(nonce), hookNonceSeconds)
+		if err != nil {
+			return err
+		}
+
+		return claimHookNonce(ctx, hook.Id, "body", body, hookNonceSeconds)
+	}
+
+	parsedTimestamp, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("Invalid signature timestamp")
+	}
+
+	// Some senders use milliseconds
+	if parsedTimestamp > 100000000000 {
+		parsedTimestamp = parsedTimestamp / 1000
+	}
+
+	if math.Abs(float64(time.Now().Unix()-parsedTimestamp)) > float64(tolerance) {
+		return errors.New(fmt.Sprintf("Signature timestamp is outside the tolerance of %d seconds", tolerance))
+	}
+
+	// The signed payload covers both the timestamp and the body, so its hash
+	// identifies the delivery. Remember it at least as long as the timestamp is valid
+	return claimHookNonce(ctx, hook.Id, "payload", signedPayload, int32(tolerance*2))
+}
+
+// Claims a delivery in the cache shared by every instance. Only the first
+// request with the same value gets it, so concurrent replays are refused too.
+func claimHookNonce(ctx context.Context, hookId, nonceType string, value []byte, seconds int32) error {
+	valueHash := sha256.Sum256(value)
+	nonceKey := fmt.Sprintf("webhook_nonce_%s_%s_%s", hookId, nonceType, hex.EncodeToString(valueHash[:]))
+	err := AddCache(ctx, nonceKey, []byte("1"), seconds)
+	if err != nil {
+		log.Printf("[AUDIT] Refused replayed webhook request for hook %s (%s)", hookId, nonceType)
+		return errors.New("Replayed webhook request")
+	}
+
+	return nil
+}
+
+// Returns the plaintext signature secret of a hook
+func getHookSecret(hook Hook) (string, error) {
+	if !hook.Signature.SecretEncrypted || len(hook.Signature.Secret) == 0 {
+		return hook.Signature.Secret, nil
+	}
+
+	decrypted, err := HandleKeyDecryption([]byte(hook.Signature.Secret), getHookSecretPassphrase(hook))
+	if err != nil {
+		return "", err
+	}
+
+	return string(decrypted), nil
+}
+
+func getHookSecretPassphrase(hook Hook) string {
+	return fmt.Sprintf("%s_%s_webhook_secret", hook.OrgId, strings.ToLower(hook.Id))
+}
+
+// Encrypts the signature secret before a hook is stored.
+// Leaves it as is if no encryption key is configured, same as app auth
+func encryptHookSecret(hook Hook) Hook {
+	if hook.Signature.SecretEncrypted || len(hook.Signature.Secret) == 0 {
+		return hook
+	}
+
+	encrypted, err := handleKeyEncryption([]byte(hook.Signature.Secret), getHookSecretPassphrase(hook))
+	if err != nil {
+		return hook
+	}
+
+	hook.Signature.Secret = string(encrypted)
+	hook.Signature.SecretEncrypted = true
+	return hook
+}
+
+// Removes the signature secret before a hook is returned to a user
+func redactHookSecret(hook Hook) Hook {
+	hook.Signature.Secret = ""
+	hook.Signature.SecretEncrypted = false
+	return hook
+}
+
+func compareHookSignature(hashFunc func() hash.Hash, secret string, payload []byte, signature, encoding string) bool {
+	mac := hmac.New(hashFunc, []byte(secret))
+	mac.Write(payload)
+	expected := mac.Sum(nil)
+
+	var received []byte
+	var err error
+	if strings.ToLower(encoding) == "base64" {
+		received, err = base64.StdEncoding.DecodeString(strings.TrimSpace(signature))
+	} else {
+		received, err = hex.DecodeString(strings.ToLower(strings.TrimSpace(signature)))
+	}
+
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal(expected, received)
+}
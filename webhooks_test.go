@@ -0,0 +1,397 @@
+package shuffle
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func signHookPayload(hashFunc func() hash.Hash, secret string, payload []byte) string {
+	mac := hmac.New(hashFunc, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestCheckHookSignatureGithub(t *testing.T) {
+	ctx := context.Background()
+	body := []byte(`{"action": "opened"}`)
+	hook := Hook{Id: "hook-github", Signature: HookSignature{Scheme: "github", Secret: "secret"}}
+
+	request := httptest.NewRequest("POST", "/api/v1/hooks/webhook_hook-github", nil)
+	request.Header.Set("X-GitHub-Delivery", "delivery-1")
+	request.Header.Set("X-Hub-Signature-256", "sha256="+signHookPayload(sha256.New, "secret", body))
+	if err := CheckHookSignature(ctx, request, body, hook); err != nil {
+		t.Fatalf("Valid github signature was rejected: %s", err)
+	}
+
+	err := CheckHookSignature(ctx, request, body, hook)
+	if err == nil || !strings.Contains(err.Error(), "Replayed") {
+		t.Errorf("Replayed github delivery was accepted: %v", err)
+	}
+
+	// The delivery ID isn't signed, so a new one doesn't make a replay look new
+	request.Header.Set("X-GitHub-Delivery", "delivery-2")
+	err = CheckHookSignature(ctx, request, body, hook)
+	if err == nil || !strings.Contains(err.Error(), "Replayed") {
+		t.Errorf("Replayed github body with a new delivery ID was accepted: %v", err)
+	}
+
+	request.Header.Del("X-GitHub-Delivery")
+	err = CheckHookSignature(ctx, request, []byte(`{"action": "closed"}`), hook)
+	if err == nil || !strings.Contains(err.Error(), "X-GitHub-Delivery") {
+		t.Errorf("Github request without a delivery ID was accepted: %v", err)
+	}
+
+	sha1Body := []byte(`{"action": "edited"}`)
+	request = httptest.NewRequest("POST", "/api/v1/hooks/webhook_hook-github", nil)
+	request.Header.Set("X-GitHub-Delivery", "delivery-3")
+	request.Header.Set("X-Hub-Signature", "sha1="+signHookPayload(sha1.New, "secret", sha1Body))
+	if err := CheckHookSignature(ctx, request, sha1Body, hook); err != nil {
+		t.Errorf("Valid sha1 github signature was rejected: %s", err)
+	}
+
+	request.Header.Set("X-GitHub-Delivery", "delivery-4")
+	request.Header.Set("X-Hub-Signature", "sha1="+signHookPayload(sha1.New, "wrong", sha1Body))
+	if err := CheckHookSignature(ctx, request, sha1Body, hook); err == nil {
+		t.Errorf("Github signature with the wrong secret was accepted")
+	}
+
+	request = httptest.NewRequest("POST", "/api/v1/hooks/webhook_hook-github", nil)
+	request.Header.Set("X-GitHub-Delivery", "delivery-5")
+	if err := CheckHookSignature(ctx, request, body, hook); err == nil {
+		t.Errorf("Github request without a signature was accepted")
+	}
+}
+
+func TestCheckHookSignatureConcurrentReplays(t *testing.T) {
+	ctx := context.Background()
+	body := []byte(`{"action": "concurrent"}`)
+	hook := Hook{Id: "hook-concurrent", Signature: HookSignature{Scheme: "github", Secret: "secret"}}
+	signature := "sha256=" + signHookPayload(sha256.New, "secret", body)
+
+	accepted := int32(0)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			request := httptest.NewRequest("POST", "/api/v1/hooks/webhook_hook-concurrent", nil)
+			request.Header.Set("X-GitHub-Delivery", "concurrent-delivery")
+			request.Header.Set("X-Hub-Signature-256", signature)
+			if CheckHookSignature(ctx, request, body, hook) == nil {
+				atomic.AddInt32(&accepted, 1)
+			}
+		}()
+	}
+
+	wg.Wait()
+	if accepted != 1 {
+		t.Errorf("%d concurrent copies of one delivery were accepted; expected 1", accepted)
+	}
+}
+
+func TestCheckHookSignatureStripe(t *testing.T) {
+	ctx := context.Background()
+	body := []byte(`{"type": "charge.succeeded"}`)
+	hook := Hook{Id: "hook-stripe", Signature: HookSignature{Scheme: "stripe", Secret: "secret"}}
+
+	timestamp := fmt.Sprintf("%d", time.Now().Unix())
+	signature := signHookPayload(sha256.New, "secret", []byte(timestamp+"."+string(body)))
+
+	request := httptest.NewRequest("POST", "/api/v1/hooks/webhook_hook-stripe", nil)
+	request.Header.Set("Stripe-Signature", fmt.Sprintf("t=%s,v1=%s", timestamp, signature))
+	if err := CheckHookSignature(ctx, request, body, hook); err != nil {
+		t.Fatalf("Valid stripe signature was rejected: %s", err)
+	}
+
+	err := CheckHookSignature(ctx, request, body, hook)
+	if err == nil || !strings.Contains(err.Error(), "Replayed") {
+		t.Errorf("Replayed stripe request was accepted: %v", err)
+	}
+
+	oldTimestamp := fmt.Sprintf("%d", time.Now().Unix()-3600)
+	oldSignature := signHookPayload(sha256.New, "secret", []byte(oldTimestamp+"."+string(body)))
+	request.Header.Set("Stripe-Signature", fmt.Sprintf("t=%s,v1=%s", oldTimestamp, oldSignature))
+	err = CheckHookSignature(ctx, request, body, hook)
+	if err == nil || !strings.Contains(err.Error(), "tolerance") {
+		t.Errorf("Stripe request outside the tolerance was accepted: %v", err)
+	}
+
+	// A changed timestamp invalidates the signature
+	newTimestamp := fmt.Sprintf("%d", time.Now().Unix()+1)
+	request.Header.Set("Stripe-Signature", fmt.Sprintf("t=%s,v1=%s", newTimestamp, signature))
+	err = CheckHookSignature(ctx, request, body, hook)
+	if err == nil || !strings.Contains(err.Error(), "Invalid webhook signature") {
+		t.Errorf("Stripe request with a modified timestamp was accepted: %v", err)
+	}
+}
+
+func TestCheckHookSignatureSlack(t *testing.T) {
+	ctx := context.Background()
+	body := []byte(`token=abc&team_id=T1`)
+	hook := Hook{Id: "hook-slack", Signature: HookSignature{Scheme: "slack", Secret: "secret"}}
+
+	timestamp := fmt.Sprintf("%d", time.Now().Unix())
+	signature := signHookPayload(sha256.New, "secret", []byte("v0:"+timestamp+":"+string(body)))
+
+	request := httptest.NewRequest("POST", "/api/v1/hooks/webhook_hook-slack", nil)
+	request.Header.Set("X-Slack-Request-Timestamp", timestamp)
+	request.Header.Set("X-Slack-Signature", "v0="+signature)
+	if err := CheckHookSignature(ctx, request, body, hook); err != nil {
+		t.Fatalf("Valid slack signature was rejected: %s", err)
+	}
+
+	// Changing unsigned headers doesn't make a replay look new
+	request.Header.Set("X-Slack-Retry-Num", "1")
+	if err := CheckHookSignature(ctx, request, body, hook); err == nil {
+		t.Errorf("Replayed slack request was accepted")
+	}
+}
+
+func TestCheckHookSignatureHmac(t *testing.T) {
+	ctx := context.Background()
+	body := []byte(`{"id": 1}`)
+	hook := Hook{Id: "hook-hmac", Signature: HookSignature{
+		Scheme:          "hmac",
+		Secret:          "secret",
+		Header:          "X-Custom-Signature",
+		Prefix:          "sha256=",
+		TimestampHeader: "X-Custom-Timestamp",
+	}}
+
+	timestamp := fmt.Sprintf("%d", time.Now().Unix())
+	request := httptest.NewRequest("POST", "/api/v1/hooks/webhook_hook-hmac", nil)
+	request.Header.Set("X-Custom-Timestamp", timestamp)
+	request.Header.Set("X-Custom-Signature", "sha256="+signHookPayload(sha256.New, "secret", []byte(timestamp+"."+string(body))))
+	if err := CheckHookSignature(ctx, request, body, hook); err != nil {
+		t.Fatalf("Valid hmac signature was rejected: %s", err)
+	}
+
+	if err := CheckHookSignature(ctx, request, body, hook); err == nil {
+		t.Errorf("Replayed hmac request was accepted")
+	}
+
+	request.Header.Del("X-Custom-Timestamp")
+	if err := CheckHookSignature(ctx, request, body, hook); err == nil {
+		t.Errorf("Hmac request without the timestamp header was accepted")
+	}
+
+	// Without a timestamp header, a delivery ID header is required
+	body = []byte(`{"id": 2}`)
+	hook.Signature.TimestampHeader = ""
+	request = httptest.NewRequest("POST", "/api/v1/hooks/webhook_hook-hmac", nil)
+	request.Header.Set("X-Custom-Signature", "sha256="+signHookPayload(sha256.New, "secret", body))
+	if err := CheckHookSignature(ctx, request, body, hook); err == nil {
+		t.Errorf("Hmac request without a timestamp or nonce header was accepted")
+	}
+
+	hook.Signature.NonceHeader = "X-Custom-Delivery"
+	if err := CheckHookSignature(ctx, request, body, hook); err == nil {
+		t.Errorf("Hmac request without the nonce header was accepted")
+	}
+
+	request.Header.Set("X-Custom-Delivery", "delivery-1")
+	if err := CheckHookSignature(ctx, request, body, hook); err != nil {
+		t.Errorf("Valid hmac request with a nonce was rejected: %s", err)
+	}
+
+	if err := CheckHookSignature(ctx, request, body, hook); err == nil {
+		t.Errorf("Replayed hmac request with a nonce was accepted")
+	}
+
+	hook.Signature.Scheme = "unknown"
+	if err := CheckHookSignature(ctx, request, body, hook); err == nil {
+		t.Errorf("Unknown signature scheme was accepted")
+	}
+
+	hook.Signature = HookSignature{Scheme: "hmac"}
+	if err := CheckHookSignature(ctx, request, body, hook); err == nil {
+		t.Errorf("Signature scheme without a secret was accepted")
+	}
+}
+
+func TestHookSecretEncryption(t *testing.T) {
+	t.Setenv("SHUFFLE_ENCRYPTION_MODIFIER", "webhook-test-modifier")
+
+	hook := Hook{Id: "hook-encrypted", OrgId: "org", Signature: HookSignature{Scheme: "github", Secret: "secret"}}
+	encryptedHook := encryptHookSecret(hook)
+	if !encryptedHook.Signature.SecretEncrypted || encryptedHook.Signature.Secret == "secret" {
+		t.Fatalf("Hook secret wasn't encrypted: %#v", encryptedHook.Signature)
+	}
+
+	// Encrypting twice keeps the same value
+	if encryptHookSecret(encryptedHook).Signature.Secret != encryptedHook.Signature.Secret {
+		t.Errorf("Encrypted hook secret was encrypted again")
+	}
+
+	secret, err := getHookSecret(encryptedHook)
+	if err != nil || secret != "secret" {
+		t.Fatalf("getHookSecret = %#v, %v; expected the original secret", secret, err)
+	}
+
+	body := []byte(`{}`)
+	request := httptest.NewRequest("POST", "/api/v1/hooks/webhook_hook-encrypted", nil)
+	request.Header.Set("X-GitHub-Delivery", "delivery-encrypted")
+	request.Header.Set("X-Hub-Signature-256", "sha256="+signHookPayload(sha256.New, "secret", body))
+	if err := CheckHookSignature(context.Background(), request, body, encryptedHook); err != nil {
+		t.Errorf("Signature was rejected with an encrypted secret: %s", err)
+	}
+
+	// The secret is bound to the hook and org
+	movedHook := encryptedHook
+	movedHook.OrgId = "other-org"
+	if _, err := getHookSecret(movedHook); err == nil {
+		t.Errorf("Hook secret decrypted for another org")
+	}
+
+	redacted := redactHookSecret(encryptedHook)
+	if len(redacted.Signature.Secret) > 0 || redacted.Signature.SecretEncrypted {
+		t.Errorf("redactHookSecret kept the secret: %#v", redacted.Signature)
+	}
+
+	if redacted.Signature.Scheme != "github" {
+		t.Errorf("redactHookSecret removed the scheme")
+	}
+}
+
+func TestValidateHookPayloadSchemaErrors(t *testing.T) {
+	hook := Hook{
+		PayloadSchema: `{"type": "object", "required": ["alert"], "properties": {"alert": {"type": "object", "properties": {"severity": {"enum": ["low", "high"]}, "score": {"type": "number", "maximum": 100}}}}}`,
+	}
+
+	_, details, err := ValidateHookPayload(hook, []byte(`{"alert": {"severity": "medium", "score": 120}}`))
+	if err == nil {
+		t.Fatalf("Payload breaking the schema was accepted")
+	}
+
+	joined := strings.Join(details, "; ")
+	if !strings.Contains(joined, "/alert/severity") || !strings.Contains(joined, "/alert/score") {
+		t.Errorf("Expected errors for both fields, got %s", joined)
+	}
+
+	if _, _, err := ValidateHookPayload(hook, []byte(`{"alert": {"severity": "high", "score": 12}}`)); err != nil {
+		t.Errorf("Valid payload was rejected: %s", err)
+	}
+}
+
+func TestParseHookSchemaRejections(t *testing.T) {
+	if _, err := parseHookSchema(`{"type": "not-a-type"}`); err == nil {
+		t.Errorf("Schema with an invalid type was accepted")
+	}
+
+	if _, err := parseHookSchema(`not json`); err == nil {
+		t.Errorf("Invalid JSON was accepted as a schema")
+	}
+
+	for _, ref := range []string{"file:///etc/passwd", "http://169.254.169.254/latest/meta-data"} {
+		if _, err := parseHookSchema(fmt.Sprintf(`{"$ref": "%s"}`, ref)); err == nil {
+			t.Errorf("Schema with an external $ref to %s was accepted", ref)
+		}
+	}
+}
+
+func TestHookPayloadExpressions(t *testing.T) {
+	payload := map[string]interface{}{
+		"alert": map[string]interface{}{
+			"items": []interface{}{
+				map[string]interface{}{"id": "a", "severity": "low"},
+				map[string]interface{}{"id": "b", "severity": "high"},
+			},
+			"owner": nil,
+		},
+	}
+
+	value, found := getHookPayloadValue(payload, "alert.items[1].id")
+	if !found || value != "b" {
+		t.Errorf("Expected b, got %v (%t)", value, found)
+	}
+
+	value, found = getHookPayloadValue(payload, "alert.items[?severity=='high'].id | [0]")
+	if !found || value != "b" {
+		t.Errorf("Expected b from filter expression, got %v (%t)", value, found)
+	}
+
+	if _, found := getHookPayloadValue(payload, "alert.owner"); found {
+		t.Errorf("Null value was found")
+	}
+
+	if _, found := getHookPayloadValue(payload, "alert.missing"); found {
+		t.Errorf("Missing value was found")
+	}
+
+	if err := validateHookExpression("alert.items[0].id"); err != nil {
+		t.Errorf("Valid expression was rejected: %s", err)
+	}
+
+	if err := validateHookExpression("alert.items[0"); err == nil {
+		t.Errorf("Invalid expression was accepted")
+	}
+}
+
+func TestValidateHookSignatureConfig(t *testing.T) {
+	handlers := []struct {
+		config   HookSignature
+		expected bool
+	}{
+		{HookSignature{}, true},
+		{HookSignature{Scheme: "github"}, true},
+		{HookSignature{Scheme: "hmac"}, false},
+		{HookSignature{Scheme: "hmac", TimestampHeader: "X-Timestamp"}, true},
+		{HookSignature{Scheme: "hmac", NonceHeader: "X-Delivery"}, true},
+	}
+
+	for index, tt := range handlers {
+		err := validateHookSignatureConfig(tt.config)
+		if (err == nil) != tt.expected {
+			t.Errorf("validateHookSignatureConfig(%d) = %v; expected success %v", index, err, tt.expected)
+		}
+	}
+}
+
+func TestValidateHookPayload(t *testing.T) {
+	hook := Hook{
+		PayloadSchema: `{"type": "object", "required": ["alert"], "properties": {"alert": {"type": "object", "required": ["id"], "properties": {"id": {"type": "string"}}}}}`,
+		Transform: HookTransform{
+			Mappings: []HookFieldMapping{
+				{Source: "alert.id", Destination: "id"},
+				{Source: "alert.tags[1]", Destination: "meta.tag"},
+				{Source: "alert.severity", Destination: "severity", Default: "low"},
+			},
+		},
+	}
+
+	handlers := []struct {
+		body     string
+		expected string
+	}{
+		{`{"alert": {"id": "1", "tags": ["a", "b"]}}`, `{"id":"1","meta":{"tag":"b"},"severity":"low"}`},
+		{`{"alert": {"id": 1}}`, ""},
+		{`{"other": true}`, ""},
+		{`not json`, ""},
+	}
+
+	for _, tt := range handlers {
+		result, details, err := ValidateHookPayload(hook, []byte(tt.body))
+		if len(tt.expected) == 0 {
+			if err == nil {
+				t.Errorf("ValidateHookPayload(%s) should fail", tt.body)
+			}
+
+			continue
+		}
+
+		if err != nil || string(result) != tt.expected {
+			t.Errorf("ValidateHookPayload(%s) = %s (%v, %v); expected %s", tt.body, string(result), err, details, tt.expected)
+		}
+	}
+}